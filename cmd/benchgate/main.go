@@ -0,0 +1,158 @@
+// Command benchgate compares two runs of the benchmarks and fails if a benchmark got slower
+// than the threshold allows, so a change can be checked before it's merged:
+//
+//	go test ./internal/bdkeeper -run '^$' -bench BenchmarkKeeper -count 6 > new.txt
+//	benchgate -baseline internal/bdkeeper/testdata/bench-baseline.txt -new new.txt [-threshold 15%]
+//
+// The files hold the output of go test -bench. The median time per operation of every benchmark
+// is compared, so a run or two disturbed by the machine don't count. The benchmarks found in only
+// one of the files are listed without failing the gate. It exits with status 2 on a regression.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// procsSuffix is the GOMAXPROCS suffix go test appends to the benchmark names,
+// dropped so that runs on machines with another number of CPUs compare.
+var procsSuffix = regexp.MustCompile(`-\d+$`)
+
+func main() {
+	baseline := flag.String("baseline", "", "output of the benchmarks before the change")
+	current := flag.String("new", "", "output of the benchmarks after the change")
+	threshold := flag.String("threshold", "15%", "slowdown of a benchmark tolerated, in percent")
+	flag.Parse()
+
+	if *baseline == "" || *current == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	limit, err := parseThreshold(*threshold)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	before, err := readResults(*baseline)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	after, err := readResults(*current)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if regressions := compare(os.Stdout, before, after, limit); regressions > 0 {
+		fmt.Fprintf(os.Stderr, "%d benchmarks slower by more than %s\n", regressions, *threshold)
+		os.Exit(2)
+	}
+}
+
+// parseThreshold parses a percentage, with or without the percent sign.
+func parseThreshold(s string) (float64, error) {
+	limit, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil || limit < 0 {
+		return 0, fmt.Errorf("invalid threshold %q", s)
+	}
+
+	return limit, nil
+}
+
+// readResults returns the median nanoseconds per operation of every benchmark of the go test output.
+func readResults(path string) (map[string]float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	runs := make(map[string][]float64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// BenchmarkKeeper/memory/PointRead-8   1000000   1097 ns/op   448 B/op   4 allocs/op
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+		for i := 2; i+1 < len(fields); i += 2 {
+			if fields[i+1] != "ns/op" {
+				continue
+			}
+			ns, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid result %q", path, scanner.Text())
+			}
+			name := procsSuffix.ReplaceAllString(fields[0], "")
+			runs[name] = append(runs[name], ns)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(runs) == 0 {
+		return nil, fmt.Errorf("%s: no benchmark results", path)
+	}
+
+	results := make(map[string]float64, len(runs))
+	for name, ns := range runs {
+		sort.Float64s(ns)
+		mid := len(ns) / 2
+		if len(ns)%2 == 0 {
+			results[name] = (ns[mid-1] + ns[mid]) / 2
+		} else {
+			results[name] = ns[mid]
+		}
+	}
+
+	return results, nil
+}
+
+// compare writes a table of the benchmarks of both runs and returns the number of those
+// slower than the limit, a percentage of the baseline.
+func compare(out io.Writer, before, after map[string]float64, limit float64) int {
+	names := make([]string, 0, len(before))
+	for name := range before {
+		names = append(names, name)
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "benchmark\tbaseline ns/op\tnew ns/op\tdelta\t")
+
+	var regressions int
+	for _, name := range names {
+		old, inBefore := before[name]
+		cur, inAfter := after[name]
+		switch {
+		case !inBefore:
+			fmt.Fprintf(w, "%s\t-\t%.0f\t\tnew\n", name, cur)
+		case !inAfter:
+			fmt.Fprintf(w, "%s\t%.0f\t-\t\tmissing\n", name, old)
+		default:
+			delta := (cur - old) / old * 100
+			verdict := ""
+			if delta > limit {
+				verdict = "REGRESSION"
+				regressions++
+			}
+			fmt.Fprintf(w, "%s\t%.0f\t%.0f\t%+.1f%%\t%s\n", name, old, cur, delta, verdict)
+		}
+	}
+	w.Flush()
+
+	return regressions
+}
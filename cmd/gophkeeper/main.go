@@ -18,8 +18,8 @@ func main() {
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
 
-	// Start the server
-	server := app.NewServer(ctx)
+	// Start the server, the keeper is created from the configuration
+	server := app.NewServer(ctx, nil)
 	go func() {
 		// Wait for a signal
 		sig := <-signalCh
@@ -0,0 +1,38 @@
+// Command migrate provides developer tooling for the SQL migrations.
+//
+// Usage:
+//
+//	migrate lint [dir]
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/migrate"
+)
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] != "lint" {
+		log.Fatalln("usage: migrate lint [dir]")
+	}
+
+	dir := "migrations"
+	if len(os.Args) > 2 {
+		dir = os.Args[2]
+	}
+
+	problems, err := migrate.Lint(dir)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
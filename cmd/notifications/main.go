@@ -0,0 +1,73 @@
+// Command notifications renders the emails of the server with sample data, for the operators
+// to check their templates before deploying them.
+//
+// It takes the configuration of the server, including its mail templates, then run:
+//
+//	notifications preview -template verify_email [-lang en] [server flags]
+//
+// It prints the subject, the text and the HTML of the email in the language, or the closest one
+// which has templates for it. Without a template it lists the notifications and the languages.
+// It exits with status 1 if the templates don't load and 2 on a usage error.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/config"
+	"github.com/wurt83ow/gophkeeper-server/internal/mail"
+)
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] != "preview" {
+		fmt.Fprintln(os.Stderr, "usage: notifications preview -template <notification> [-lang <language>] [server flags]")
+		os.Exit(2)
+	}
+	// The flags follow the subcommand
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+
+	kind := flag.String("template", "", "notification rendered, empty lists them")
+	lang := flag.String("lang", mail.DefaultLanguage, "language the notification is rendered in")
+
+	option := config.NewOptions()
+	option.ParseFlags()
+
+	templates, err := mail.LoadTemplates(option.MailTemplates())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	sample, ok := mail.Sample(*kind)
+	if !ok {
+		if *kind != "" {
+			fmt.Fprintf(os.Stderr, "unknown notification %q\n\n", *kind)
+		}
+		listTemplates(templates)
+		os.Exit(2)
+	}
+
+	msg, err := templates.Render(*lang, sample)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Subject: %s\n\n%s", msg.Subject, msg.Body)
+	if msg.HTML != "" {
+		fmt.Printf("\n--- HTML ---\n\n%s", msg.HTML)
+	}
+}
+
+// listTemplates prints the notifications and the languages of the templates to the standard error.
+func listTemplates(templates *mail.Templates) {
+	kinds := make([]string, 0, len(mail.Samples))
+	for _, n := range mail.Samples {
+		kinds = append(kinds, n.Kind())
+	}
+
+	fmt.Fprintf(os.Stderr, "notifications: %s\n", strings.Join(kinds, ", "))
+	fmt.Fprintf(os.Stderr, "languages: %s\n", strings.Join(templates.Languages(), ", "))
+}
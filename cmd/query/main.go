@@ -0,0 +1,170 @@
+// Command query runs an ad-hoc read query of an operator on the database of the server, e.g.
+// to count the users with more than a number of devices, instead of connecting to it directly.
+//
+// It takes the configuration of the server, then run:
+//
+//	query -sql 'SELECT ...' [-operator alice] [-format table|json|csv] [-max-rows 1000] [-timeout 30s] [-redact col1,col2] [server flags]
+//
+// Only a single read statement is accepted, and it runs in a read-only transaction across the users.
+// The sensitive columns, and those of -redact, are redacted from the output. Every query is recorded
+// in the audit log with its text and the operator, the user running the command by default.
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"os/user"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/app"
+	"github.com/wurt83ow/gophkeeper-server/internal/bdkeeper"
+	"github.com/wurt83ow/gophkeeper-server/internal/config"
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"go.uber.org/zap"
+)
+
+func main() {
+	query := flag.String("sql", "", "read statement to run")
+	operator := flag.String("operator", "", "operator recorded in the audit log, empty is the user running the command")
+	format := flag.String("format", "table", "output format: table, json or csv")
+	maxRows := flag.Int("max-rows", 1000, "rows output at most")
+	timeout := flag.Duration("timeout", 30*time.Second, "time the query may run")
+	redact := flag.String("redact", "", "columns redacted in addition to the sensitive ones, separated by commas")
+
+	option := config.NewOptions()
+	option.ParseFlags()
+
+	nLogger, err := logger.NewLogger(option.LogLevel())
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	q := bdkeeper.OperatorQuery{
+		SQL:      *query,
+		Operator: *operator,
+		Timeout:  *timeout,
+		MaxRows:  *maxRows,
+	}
+	if *redact != "" {
+		q.Redact = strings.Split(*redact, ",")
+	}
+	if err := run(option, nLogger, q, *format, os.Stdout); err != nil {
+		nLogger.Error("query failed", zap.Error(err))
+		os.Exit(1)
+	}
+}
+
+// run runs the query on the configured database and writes its result in the format to w.
+func run(option *config.Options, nLogger *logger.Logger, q bdkeeper.OperatorQuery, format string, w io.Writer) error {
+	if q.SQL == "" {
+		return errors.New("no query is given with -sql")
+	}
+	if q.MaxRows <= 0 || q.Timeout <= 0 {
+		return errors.New("the row limit and the timeout must be positive")
+	}
+	write, ok := writers[format]
+	if !ok {
+		return fmt.Errorf("unknown format %q", format)
+	}
+	if q.Operator == "" {
+		current, err := user.Current()
+		if err != nil {
+			return fmt.Errorf("failed to identify the operator, give -operator: %w", err)
+		}
+		q.Operator = current.Username
+	}
+
+	keeper, err := app.OpenKeeper(option, nLogger)
+	if err != nil {
+		return err
+	}
+	defer keeper.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	result, err := keeper.RunOperatorQuery(ctx, q)
+	if err != nil {
+		return err
+	}
+	if result.Truncated {
+		nLogger.Warn("the result is truncated", zap.Int("rows", q.MaxRows))
+	}
+
+	return write(w, result)
+}
+
+// writers write a query result in the output formats.
+var writers = map[string]func(io.Writer, bdkeeper.QueryResult) error{
+	"table": writeTable,
+	"json":  writeJSON,
+	"csv":   writeCSV,
+}
+
+// writeTable writes the result as aligned columns under a header.
+func writeTable(w io.Writer, result bdkeeper.QueryResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(result.Columns, "\t"))
+	for _, row := range result.Rows {
+		fmt.Fprintln(tw, strings.Join(formatRow(row, "NULL"), "\t"))
+	}
+
+	return tw.Flush()
+}
+
+// writeJSON writes the result as an array of objects keyed by the columns.
+func writeJSON(w io.Writer, result bdkeeper.QueryResult) error {
+	objects := make([]map[string]interface{}, 0, len(result.Rows))
+	for _, row := range result.Rows {
+		object := make(map[string]interface{}, len(row))
+		for i, value := range row {
+			object[result.Columns[i]] = value
+		}
+		objects = append(objects, object)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(objects)
+}
+
+// writeCSV writes the result as CSV with a header, NULL as an empty field.
+func writeCSV(w io.Writer, result bdkeeper.QueryResult) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(result.Columns); err != nil {
+		return err
+	}
+	for _, row := range result.Rows {
+		if err := cw.Write(formatRow(row, "")); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+
+	return cw.Error()
+}
+
+// formatRow returns the values of the row as text, null for NULL.
+func formatRow(row []interface{}, null string) []string {
+	fields := make([]string, len(row))
+	for i, value := range row {
+		if value == nil {
+			fields[i] = null
+			continue
+		}
+		fields[i] = fmt.Sprint(value)
+	}
+
+	return fields
+}
@@ -0,0 +1,77 @@
+// Command rotatekeys re-encrypts the stored sensitive columns with the current encryption key.
+//
+// It takes the configuration of the server, the current key set by -m and its id by -i,
+// and the previous keys by -g. Start the servers with the same keys first, so they write
+// with the new key and still read the old one, then run:
+//
+//	rotatekeys [-batch 500] [-sample 100] [server flags]
+//
+// The servers started with previous keys run the same rotation in the background, this
+// command runs it in the foreground. An interrupted rotation resumes where it stopped.
+// Once it reports success, the previous keys can be removed from the configuration;
+// until then, the servers refuse to start without them.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/app"
+	"github.com/wurt83ow/gophkeeper-server/internal/bdkeeper"
+	"github.com/wurt83ow/gophkeeper-server/internal/config"
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"go.uber.org/zap"
+)
+
+func main() {
+	batchSize := flag.Int("batch", 500, "rows re-encrypted per transaction")
+	sample := flag.Int("sample", 100, "rows per table checked after the rotation")
+
+	option := config.NewOptions()
+	option.ParseFlags()
+
+	nLogger, err := logger.NewLogger(option.LogLevel())
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if err := run(option, nLogger, *batchSize, *sample); err != nil {
+		nLogger.Error("rotation failed", zap.Error(err))
+		os.Exit(1)
+	}
+	nLogger.Info("rotation completed, the previous keys can be removed")
+}
+
+// run rotates the keys of the configured database and verifies a sample of the rows.
+func run(option *config.Options, nLogger *logger.Logger, batchSize, sample int) error {
+	if option.EncryptionKey() == "" {
+		return errors.New("no encryption key is configured")
+	}
+
+	keeper, err := app.OpenKeeper(option, nLogger)
+	if err != nil {
+		return err
+	}
+	defer keeper.Close()
+
+	// An interrupted batch is rolled back, the next run resumes after the last committed one
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := keeper.StartRotation(ctx); err != nil {
+		return err
+	}
+	err = keeper.RotateKeys(ctx, batchSize, func(p bdkeeper.RotationProgress) {
+		nLogger.Info("rotation progress", zap.String("table", p.Table), zap.Int("rotated", p.Rotated), zap.Bool("done", p.Done))
+	})
+	if err != nil {
+		return err
+	}
+
+	return keeper.VerifyRotation(ctx, sample)
+}
@@ -0,0 +1,82 @@
+// Command verifyintegrity compares the stored entries with the checksums written with them
+// and lists the entries which don't match, e.g. after a restore from a backup.
+//
+// It takes the configuration of the server, including its encryption keys, then run:
+//
+//	verifyintegrity [-user 0] [-table UserCredentials] [server flags]
+//
+// A user of 0 checks the entries of all users, an empty table checks every data table.
+// The entries unchanged since before the checksums were added have none and are skipped.
+// It exits with status 2 if an entry doesn't match.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/app"
+	"github.com/wurt83ow/gophkeeper-server/internal/config"
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"go.uber.org/zap"
+)
+
+func main() {
+	userID := flag.Int("user", 0, "id of the user whose entries are checked, 0 checks all users")
+	table := flag.String("table", "", "data table checked, empty checks all of them")
+
+	option := config.NewOptions()
+	option.ParseFlags()
+
+	nLogger, err := logger.NewLogger(option.LogLevel())
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	mismatches, err := run(option, nLogger, *table, *userID)
+	if err != nil {
+		nLogger.Error("verification failed", zap.Error(err))
+		os.Exit(1)
+	}
+	if mismatches > 0 {
+		nLogger.Error("entries don't match their checksums", zap.Int("entries", mismatches))
+		os.Exit(2)
+	}
+	nLogger.Info("all entries match their checksums")
+}
+
+// run verifies the entries of the configured database and logs those which don't match.
+// It returns their number.
+func run(option *config.Options, nLogger *logger.Logger, table string, userID int) (int, error) {
+	keeper, err := app.OpenKeeper(option, nLogger)
+	if err != nil {
+		return 0, err
+	}
+	defer keeper.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	tables := models.DataTables
+	if table != "" {
+		tables = []string{table}
+	}
+
+	var mismatches int
+	for _, table := range tables {
+		ids, err := keeper.VerifyIntegrity(ctx, table, userID)
+		if err != nil {
+			return mismatches, err
+		}
+		if len(ids) > 0 {
+			nLogger.Warn("entries don't match their checksums", zap.String("table", table), zap.Strings("entries", ids))
+		}
+		mismatches += len(ids)
+	}
+
+	return mismatches, nil
+}
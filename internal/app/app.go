@@ -2,31 +2,68 @@ package app
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
+	"github.com/prometheus/client_golang/prometheus"
 	authz "github.com/wurt83ow/gophkeeper-server/internal/authorization"
+	"github.com/wurt83ow/gophkeeper-server/internal/authorization/keys"
 	"github.com/wurt83ow/gophkeeper-server/internal/bdkeeper"
 	"github.com/wurt83ow/gophkeeper-server/internal/config"
 	"github.com/wurt83ow/gophkeeper-server/internal/controllers"
+	"github.com/wurt83ow/gophkeeper-server/internal/egress"
+	"github.com/wurt83ow/gophkeeper-server/internal/events"
 	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"github.com/wurt83ow/gophkeeper-server/internal/mail"
+	"github.com/wurt83ow/gophkeeper-server/internal/metrics"
 	"github.com/wurt83ow/gophkeeper-server/internal/middleware"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"github.com/wurt83ow/gophkeeper-server/internal/objstore"
 	"github.com/wurt83ow/gophkeeper-server/internal/storage"
+	"go.uber.org/zap"
 )
 
 // Server represents the application server.
 type Server struct {
-	srv *http.Server
-	ctx context.Context
+	srv    *http.Server
+	ctx    context.Context
+	keeper storage.Keeper
+
+	// lifecycle stops the server, the jobs and the keeper in order, it is set up by Serve
+	lifecycle *lifecycle
+	// stopped is closed once Shutdown has stopped every stage
+	stopped chan struct{}
+}
+
+// drainer is implemented by the keepers waiting for their operations in flight when shutting down.
+type drainer interface {
+	Shutdown(ctx context.Context) error
+}
+
+// changeNotifier is implemented by the keepers notifying the other instances of the server of their changes.
+type changeNotifier interface {
+	EnableChangeNotifications() error
+	ListenChanges(ctx context.Context, sub bdkeeper.ChangeSubscriber) error
 }
 
-// NewServer creates a new Server instance.
-func NewServer(ctx context.Context) *Server {
+// jobChangeListener is the name of the background job passing the changes of the other instances to the broker.
+const jobChangeListener = "change_listener"
+
+// NewServer creates a new Server instance that stores data in the given keeper.
+// If keeper is nil, Serve connects to the database configured by the options.
+func NewServer(ctx context.Context, keeper storage.Keeper) *Server {
 	server := new(Server)
 	server.ctx = ctx
+	server.keeper = keeper
+	server.stopped = make(chan struct{})
 
 	return server
 }
@@ -42,27 +79,257 @@ func (server *Server) Serve() {
 	if err != nil {
 		log.Fatalln(err)
 	}
+	server.lifecycle = newLifecycle(nLogger)
 
 	// Initialize the keeper instance
-	keeper, err := initializeKeeper(option.DataBaseDSN, nLogger)
+	if server.keeper == nil {
+		keeper, err := OpenKeeper(option, nLogger)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		storageMetrics, err := metrics.NewStorage(prometheus.DefaultRegisterer)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		keeper.SetMetrics(storageMetrics)
+		server.keeper = keeper
+	}
+	server.lifecycle.register(stageKeeper, "keeper", server.stopKeeper)
+
+	// The jobs configured to run dry only report what they would delete
+	dryRun, err := parseDryRunJobs(option.DryRunJobs())
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// Delete the expired entries in the background
+	if interval := option.ExpiryInterval(); interval > 0 {
+		server.lifecycle.startJob(server.ctx, jobExpiry, func(ctx context.Context) {
+			runExpiry(ctx, server.keeper, interval, dryRun[jobExpiry], nLogger)
+		})
+	}
+
+	// Delete the audit events older than the retention in the background
+	if retention := option.AuditRetention(); retention > 0 {
+		server.lifecycle.startJob(server.ctx, jobAuditPruning, func(ctx context.Context) {
+			runAuditPruning(ctx, server.keeper, auditPruneInterval, retention, dryRun[jobAuditPruning], nLogger)
+		})
+	}
+
+	// Delete the revocations of the expired access tokens in the background
+	server.lifecycle.startJob(server.ctx, jobRevokedTokenPruning, func(ctx context.Context) {
+		runRevokedTokenPruning(ctx, server.keeper, revokedTokenPruneInterval, nLogger)
+	})
+
+	// Delete the expired upload sessions and their staged chunks in the background
+	server.lifecycle.startJob(server.ctx, jobUploadPruning, func(ctx context.Context) {
+		staging := filepath.Join(option.FileStoragePath(), controllers.UploadStagingDir)
+		runUploadPruning(ctx, server.keeper, staging, uploadPruneInterval, option.UploadSessionTTL(), nLogger)
+	})
+
+	// Re-encrypt the entries with the current key in the background while previous keys are configured
+	if rotator, ok := server.keeper.(keyRotator); ok && option.PreviousEncryptionKeys() != "" {
+		server.lifecycle.startJob(server.ctx, jobKeyRotation, func(ctx context.Context) {
+			runKeyRotation(ctx, rotator, option.RotationBatch(), option.RotationSample(), rotationRetryInterval, nLogger)
+		})
+	}
+
+	// Every outbound connection goes through the egress policy
+	policy, err := newEgressPolicy(option)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	defer keeper.Close()
+	egressMetrics, err := metrics.NewEgress(prometheus.DefaultRegisterer)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	policy.SetMetrics(egressMetrics)
 
+	// The emails are only sent if an SMTP server is configured
+	var sender mail.Sender
+	if addr := option.SMTPAddr(); addr != "" {
+		sender = mail.NewSMTPSender(addr, option.SMTPUsername(), option.SMTPPassword(), option.SMTPFrom(),
+			policy.Dialer(egress.ClassSMTP))
+	}
+
+	// Check the health served to the uptime monitors in the background, a ping doesn't reach the keeper
+	health := newHealthState(option.MonitorCheckInterval())
+	if interval := option.MonitorCheckInterval(); interval > 0 {
+		server.lifecycle.startJob(server.ctx, jobHealthCheck, func(ctx context.Context) {
+			runHealthCheck(ctx, server.keeper, health, interval, nLogger)
+		})
+	}
+
+	// Count the requests rejected by the rate limiter
+	rateMetrics, err := metrics.NewRateLimit(prometheus.DefaultRegisterer)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// Deliver the changes to the event streams of the other sessions, the streams end first on shutdown
+	broker := events.NewBroker()
+	server.lifecycle.register(stageServe, "events", func(context.Context) error {
+		broker.Close()
+		return nil
+	})
+
+	// Tell the other instances sharing the database of the changes, and their changes to the event streams
+	if option.EventsRelay() {
+		notifier, ok := server.keeper.(changeNotifier)
+		if !ok {
+			log.Fatalln("the keeper can't notify the changes to the other instances")
+		}
+		if err := notifier.EnableChangeNotifications(); err != nil {
+			log.Fatalln(err)
+		}
+		server.lifecycle.startJob(server.ctx, jobChangeListener, func(ctx context.Context) {
+			if err := notifier.ListenChanges(ctx, broker); err != nil && ctx.Err() == nil {
+				nLogger.Warn("the changes of the other instances aren't listened to", zap.Error(err))
+			}
+		})
+	}
+
+	// Replicate the vault of a user from the primary server in the background, their writes here are rejected
+	var replicated controllers.Replication
+	if option.ReplicationPrimary() != "" {
+		replicator, err := newReplicator(server.keeper, option, policy, nLogger)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		replicationMetrics, err := metrics.NewReplication(prometheus.DefaultRegisterer)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		replicator.SetMetrics(replicationMetrics)
+		server.lifecycle.startJob(server.ctx, jobReplication, func(ctx context.Context) {
+			replicator.Run(ctx, option.ReplicationInterval())
+		})
+		replicated = replicator
+	}
+
+	// Put the files uploaded in chunks into the blob store, if one is configured, and delete its orphaned objects
+	// in the background
+	blobs, err := newBlobStore(option, policy)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if interval := option.BlobGCInterval(); blobs != nil && interval > 0 {
+		server.lifecycle.startJob(server.ctx, jobBlobReconciliation, func(ctx context.Context) {
+			runBlobReconciliation(ctx, server.keeper, blobs, interval, option.BlobGCGrace(),
+				dryRun[jobBlobReconciliation], nLogger)
+		})
+	}
+
+	r := newRouter(server.keeper, option, nLogger, sender, policy, health, rateMetrics, broker, replicated, blobs)
+
+	// Configure and start the server, it returns once Shutdown was called
+	startServer(server, r, option.RunAddr(), option.EnableHTTPS(),
+		option.HTTPSCertFile(), option.HTTPSKeyFile())
+
+	// Wait for the requests, the jobs and the queries in flight to finish
+	<-server.stopped
+}
+
+// newEgressPolicy creates the policy of the outbound connections from the configuration.
+func newEgressPolicy(option *config.Options) (*egress.Policy, error) {
+	rules, err := egress.ParseRules(option.EgressAllow())
+	if err != nil {
+		return nil, err
+	}
+
+	var proxy *url.URL
+	if raw := option.EgressProxy(); raw != "" {
+		if proxy, err = url.Parse(raw); err != nil {
+			return nil, fmt.Errorf("invalid egress proxy: %w", err)
+		}
+	}
+
+	return egress.NewPolicy(rules, proxy), nil
+}
+
+// newRouter creates a router serving the API on top of the given keeper, mailing the tokens with the sender if not nil,
+// rendered with the mail templates of the options.
+// The external services are connected to through the egress policy, one without rules if it is nil.
+// The monitor ping serves the health as last checked. The changes are published to the broker, the event streams
+// aren't served if it is nil. The writes of the user whose vault is replicated from a primary server are rejected,
+// if replicated isn't nil. The files uploaded in chunks are put into the blob store if it isn't nil.
+func newRouter(keeper storage.Keeper, option *config.Options, nLogger *logger.Logger, sender mail.Sender, policy *egress.Policy,
+	health controllers.Health, rateMetrics middleware.RateMetrics, broker controllers.Events, replicated controllers.Replication,
+	blobs objstore.BlobStore) chi.Router {
 	// Initialize the storage instance
 	memoryStorage := initializeStorage(keeper, nLogger)
 
+	passwordParams := authz.Argon2Params{
+		Memory:      option.Argon2Memory(),
+		Time:        option.Argon2Time(),
+		Parallelism: option.Argon2Parallelism(),
+		SaltLength:  option.Argon2SaltLength(),
+	}
+	classes, err := authz.ParseClasses(option.PasswordClasses())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	passwordPolicy := authz.PasswordPolicy{MinLength: option.PasswordMinLength(), Classes: classes, AllowHashed: option.LegacyHashedPasswords()}
+	usernamePolicy := authz.UsernamePolicy{
+		Denylist:   authz.ParseUsernames(option.ReservedUsernames()),
+		FailClosed: option.UsernameCheckerFailClosed(),
+	}
+	if url := option.UsernameCheckerURL(); url != "" {
+		if policy == nil {
+			policy = egress.NewPolicy(nil, nil)
+		}
+		client := policy.HTTPClient(egress.ClassUsernameChecker, option.UsernameCheckerTimeout())
+		usernamePolicy.Checker = authz.NewHTTPUsernameChecker(url, client)
+	}
 	authz := authz.NewJWTAuthz(option.JWTSigningKey(), nLogger)
+	authz.SetAccessTokenTTL(option.AccessTokenTTL())
+	authz.SetIssuer(option.JWTIssuer(), option.JWTAudience())
+	if spec := option.JWTKeys(); spec != "" {
+		keyset, err := keys.Load(spec, option.JWTActiveKey())
+		if err != nil {
+			log.Fatalln(err)
+		}
+		authz.SetKeys(keyset)
+	}
+	if err := authz.SetPasswordParams(passwordParams); err != nil {
+		log.Fatalln(err)
+	}
+	if err := authz.SetPasswordPolicy(passwordPolicy); err != nil {
+		log.Fatalln(err)
+	}
+	authz.SetUsernamePolicy(usernamePolicy)
 
 	// Create a new controller to process incoming requests
 	baseController := initializeBaseController(memoryStorage, option, nLogger, authz)
+	// The templates are loaded even without a sender, a broken override fails the startup either way
+	templates, err := mail.LoadTemplates(option.MailTemplates())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if sender != nil {
+		baseController.SetMailer(mail.NewNotifier(sender, templates))
+	}
+	baseController.SetHealth(health)
+	if broker != nil {
+		baseController.SetEvents(broker)
+	}
+	if replicated != nil {
+		baseController.SetReplication(replicated)
+	}
+	if blobs != nil {
+		baseController.SetBlobStore(blobs)
+	}
 
 	// Create an instance of ChiServerOptions with your middleware
 	options := controllers.ChiServerOptions{
+		// The last of the middlewares runs first, the write fence needs the user authenticated
 		Middlewares: []controllers.MiddlewareFunc{
+			baseController.WriteFence,
 			authz.JWTAuthzMiddleware(memoryStorage, nLogger),
 		},
+		AdminMiddlewares: []controllers.MiddlewareFunc{
+			authz.RequireRole(models.RoleAdmin),
+		},
 	}
 
 	// Create a handler with options
@@ -71,18 +338,186 @@ func (server *Server) Serve() {
 	// Get a middleware for logging requests
 	reqLog := middleware.NewReqLog(nLogger)
 
+	// Get a middleware limiting the rate of the requests of each client, more strictly on the authentication routes
+	limiter := middleware.NewRateLimiter(middleware.NewMemLimiter(), map[middleware.RateGroup]middleware.Limit{
+		middleware.RateGroupAuth:   perMinute(option.AuthRateLimit(), option.AuthRateBurst()),
+		middleware.RateGroupData:   perMinute(option.DataRateLimit(), option.DataRateBurst()),
+		middleware.RateGroupExport: perHour(option.ExportRateLimit(), option.ExportRateBurst()),
+	}, rateRoutes, authz.RateLimitKey, nLogger)
+	if rateMetrics != nil {
+		limiter.SetMetrics(rateMetrics)
+	}
+
+	// Get a middleware shedding load under overload, lower priorities are rejected first
+	shedder := middleware.NewLoadShedder(option.ShedMaxInFlight(), option.ShedMaxLatency(), routeClasses, nLogger)
+
+	// Get a middleware negotiating the protocol version of every request
+	protocol := middleware.NewProtocolNegotiator(models.ServerProtocol, nLogger)
+
+	// Get a middleware compressing the larger responses and decompressing the pushed changes
+	compressor := middleware.NewCompressor(option.CompressMinSize(), int64(option.MaxDecompressedSize()), compressedRoutes)
+
 	// Create router and mount routes
 	r := chi.NewRouter()
 	r.Use(reqLog.RequestLogger)
+	r.Use(limiter.Limit)
+	r.Use(shedder.Shed)
+	r.Use(protocol.Negotiate)
+	r.Use(compressor.Compress)
+	r.Get("/ping", ping(keeper))
 	r.Mount("/", genHandler)
 
-	// Configure and start the server
-	startServer(server, r, option.RunAddr(), option.EnableHTTPS(),
-		option.HTTPSCertFile(), option.HTTPSKeyFile())
+	return r
+}
+
+// rateRoutes assigns the routes to the groups of the rate limits, the prefixes label the rejected requests
+// in the metrics. The health probes aren't limited, the monitor pings have a limit of their own.
+var rateRoutes = []middleware.RateRoute{
+	{Prefix: "/ping", Group: middleware.RateGroupExempt},
+	{Prefix: "/api/monitor/", Group: middleware.RateGroupExempt},
+	{Prefix: "/register", Group: middleware.RateGroupAuth},
+	{Prefix: "/login", Group: middleware.RateGroupAuth},
+	{Prefix: "/getUserID/", Group: middleware.RateGroupAuth},
+	{Prefix: "/getPassword/", Group: middleware.RateGroupAuth},
+	{Prefix: "/api/user/refresh", Group: middleware.RateGroupAuth},
+	{Prefix: "/api/user/logout", Group: middleware.RateGroupAuth},
+	{Prefix: "/api/user/reset", Group: middleware.RateGroupAuth},
+	{Prefix: "/api/user/verify", Group: middleware.RateGroupAuth},
+	{Prefix: "/api/user/password", Group: middleware.RateGroupAuth},
+	{Prefix: "/addData/", Group: middleware.RateGroupData},
+	{Prefix: "/updateData/", Group: middleware.RateGroupData},
+	{Prefix: "/deleteData/", Group: middleware.RateGroupData},
+	{Prefix: "/getData/", Group: middleware.RateGroupData},
+	{Prefix: "/getAllData/", Group: middleware.RateGroupData},
+	{Prefix: "/sendFile/", Group: middleware.RateGroupData},
+	{Prefix: "/getFile/", Group: middleware.RateGroupData},
+	{Prefix: "/api/files/", Group: middleware.RateGroupData},
+	{Prefix: "/api/sync", Group: middleware.RateGroupData},
+	{Prefix: "/api/search", Group: middleware.RateGroupData},
+	{Prefix: "/api/data/", Group: middleware.RateGroupData},
+	{Prefix: "/api/export", Group: middleware.RateGroupExport},
+	{Prefix: "/api/import", Group: middleware.RateGroupExport},
+	{Prefix: "/api/user/", Group: middleware.RateGroupData},
+	{Prefix: "/api/admin/", Group: middleware.RateGroupData},
+	{Prefix: "/api/", Group: middleware.RateGroupData},
+}
+
+// perMinute returns the limit of the requests per minute and the burst, no limit for 0 requests.
+func perMinute(requests, burst int) middleware.Limit {
+	return middleware.Limit{Rate: float64(requests) / 60, Burst: burst}
+}
+
+// perHour returns the limit of the requests per hour and the burst, no limit for 0 requests.
+func perHour(requests, burst int) middleware.Limit {
+	return middleware.Limit{Rate: float64(requests) / 3600, Burst: burst}
+}
+
+// routeClasses assigns the load shedding priorities to the routes.
+// Routes not listed here, such as the data reads, have the lowest priority.
+var routeClasses = []middleware.RouteClass{
+	{Prefix: "/ping", Priority: middleware.PriorityCritical},
+	{Prefix: "/api/monitor/", Priority: middleware.PriorityCritical},
+	{Prefix: "/register", Priority: middleware.PriorityAuth},
+	{Prefix: "/login", Priority: middleware.PriorityAuth},
+	{Prefix: "/api/user/", Priority: middleware.PriorityAuth},
+	{Prefix: "/getUserID/", Priority: middleware.PriorityAuth},
+	{Prefix: "/getPassword/", Priority: middleware.PriorityAuth},
+	{Prefix: "/addData/", Priority: middleware.PrioritySync},
+	{Prefix: "/updateData/", Priority: middleware.PrioritySync},
+	{Prefix: "/deleteData/", Priority: middleware.PrioritySync},
+	{Prefix: "/sendFile/", Priority: middleware.PrioritySync},
+	{Prefix: "/api/sync", Priority: middleware.PrioritySync},
+	{Prefix: "/api/files/", Priority: middleware.PrioritySync, Stream: true},
+	{Prefix: "/api/events", Priority: middleware.PriorityLow, Stream: true},
+	{Prefix: "/api/export", Priority: middleware.PriorityLow, Stream: true},
+	{Prefix: "/api/import", Priority: middleware.PriorityLow, Stream: true},
+}
+
+// compressedRoutes are the routes pushing the changes of the clients, which may send them gzipped.
+var compressedRoutes = []string{"/api/sync", "/addData/", "/updateData/"}
+
+// ping is the health probe handler, it reports whether the keeper is reachable.
+func ping(keeper storage.Keeper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !keeper.Ping() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
 }
 
-func initializeKeeper(dataBaseDSN func() string, logger *logger.Logger) (*bdkeeper.BDKeeper, error) {
-	return bdkeeper.NewBDKeeper(dataBaseDSN, logger, nil)
+// OpenKeeper connects to the database configured by the options and sets the keeper up as configured,
+// so the tools working on the database of the server see it as the server does.
+func OpenKeeper(option *config.Options, logger *logger.Logger) (*bdkeeper.BDKeeper, error) {
+	keeper, err := bdkeeper.NewBDKeeper(option.DataBaseDSN, logger, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	keeper.SetHistoryLimit(option.HistoryVersions())
+	if err := keeper.SetReadReplica(option.ReadDataBaseDSN(), option.ReadAfterWriteWindow()); err != nil {
+		keeper.Close()
+		return nil, err
+	}
+	if err := enableEncryption(keeper, option); err != nil {
+		keeper.Close()
+		return nil, err
+	}
+	// The previous keys can't be removed before the rotation to the current key is verified
+	if err := keeper.CheckRotationKeys(context.Background()); err != nil {
+		keeper.Close()
+		return nil, err
+	}
+	if option.RowLevelSecurity() {
+		if err := keeper.EnableRowLevelSecurity(option.RLSBypassRole()); err != nil {
+			keeper.Close()
+			return nil, err
+		}
+	}
+	if option.VerifyReads() {
+		keeper.EnableReadVerification()
+	}
+
+	return keeper, nil
+}
+
+// enableEncryption sets the configured encryption key of the keeper and the previous keys
+// still accepted during a rotation.
+func enableEncryption(keeper *bdkeeper.BDKeeper, option *config.Options) error {
+	encoded := option.EncryptionKey()
+	if encoded == "" {
+		return nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("encryption key is not base64: %w", err)
+	}
+	if err := keeper.EnableEncryption(option.EncryptionKeyID(), key); err != nil {
+		return err
+	}
+
+	// The previous keys are given as id=base64 pairs separated by commas
+	for i, pair := range strings.Split(option.PreviousEncryptionKeys(), ",") {
+		if pair == "" {
+			continue
+		}
+		keyID, encoded, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("previous encryption key %d is not id=base64", i+1)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("previous encryption key %q is not base64: %w", keyID, err)
+		}
+		if err := keeper.AddDecryptionKey(keyID, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func initializeStorage(keeper storage.Keeper, logger *logger.Logger) *storage.MemoryStorage {
@@ -114,6 +549,7 @@ func startServer(server *Server, router chi.Router, address string,
 		IdleTimeout:       readTimeout,
 		MaxHeaderBytes:    oneMegabyte, // 1 MB
 	}
+	server.lifecycle.register(stageServe, "http", server.srv.Shutdown)
 
 	log.Printf("Starting server at %s\n", address)
 
@@ -132,20 +568,26 @@ func startServer(server *Server, router chi.Router, address string,
 
 }
 
-// Shutdown gracefully shuts down the server.
+// Shutdown gracefully shuts down the server: it stops accepting connections and waits
+// for the requests in flight, then cancels the background jobs and waits for them,
+// then shuts the keeper down waiting for its queries in flight. Each stage moves on
+// once its timeout expires, logging what was still running.
 func (server *Server) Shutdown() {
+	defer close(server.stopped)
 	log.Printf("server stopped")
 
-	const shutdownTimeout = 5 * time.Second
-	ctxShutDown, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	server.lifecycle.shutdown()
 
-	defer cancel()
+	log.Println("server exited properly")
+}
 
-	if err := server.srv.Shutdown(ctxShutDown); err != nil {
-		if !errors.Is(err, http.ErrServerClosed) {
-			log.Fatalf("server Shutdown Failed:%s", err)
-		}
+// stopKeeper shuts the keeper down waiting for its queries in flight, the keepers
+// without operations to wait for are closed at once.
+func (server *Server) stopKeeper(ctx context.Context) error {
+	if keeper, ok := server.keeper.(drainer); ok {
+		return keeper.Shutdown(ctx)
 	}
+	server.keeper.Close()
 
-	log.Println("server exited properly")
+	return nil
 }
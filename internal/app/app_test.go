@@ -0,0 +1,3963 @@
+package app
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/bdkeeper"
+	"github.com/wurt83ow/gophkeeper-server/internal/config"
+	"github.com/wurt83ow/gophkeeper-server/internal/controllers"
+	"github.com/wurt83ow/gophkeeper-server/internal/events"
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"github.com/wurt83ow/gophkeeper-server/internal/mail"
+	"github.com/wurt83ow/gophkeeper-server/internal/middleware"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"github.com/wurt83ow/gophkeeper-server/internal/objstore"
+	"github.com/wurt83ow/gophkeeper-server/internal/replication"
+	"github.com/wurt83ow/gophkeeper-server/internal/storage"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The entry ids of the tests, clients send UUIDs.
+const (
+	entry1ID  = "6f1e2a4c-3b5d-4e7f-8a9b-0c1d2e3f4a51"
+	entry2ID  = "6f1e2a4c-3b5d-4e7f-8a9b-0c1d2e3f4a52"
+	entry3ID  = "6f1e2a4c-3b5d-4e7f-8a9b-0c1d2e3f4a53"
+	foreignID = "9d8c7b6a-5f4e-4d3c-9b2a-1f0e9d8c7b6a"
+	missingID = "0a1b2c3d-4e5f-4a6b-8c7d-8e9f0a1b2c3d"
+)
+
+// newTestServer starts an HTTP server backed by an in-memory keeper.
+// TestMain runs the tests with the bcrypt hashes of the legacy clients accepted as the passwords, the users of
+// the tests register and log in with them.
+func TestMain(m *testing.M) {
+	config.NewOptions().ParseFlags()
+	flag.Set("legacy-hashed-passwords", "true")
+
+	os.Exit(m.Run())
+}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	option := config.NewOptions()
+	option.ParseFlags()
+
+	nLogger, err := logger.NewLogger(option.LogLevel())
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(newRouter(storage.NewMemKeeper(), option, nLogger, nil, nil, newHealthState(time.Minute), nil, nil, nil, nil))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// withoutAuthRateLimit lifts the rate limit of the authentication routes for the test, which logs in
+// more often from its single address than a client would.
+func withoutAuthRateLimit(t *testing.T) {
+	t.Helper()
+
+	config.NewOptions().ParseFlags()
+	require.NoError(t, flag.Set("auth-rate-limit", "0"))
+	t.Cleanup(func() { flag.Set("auth-rate-limit", "30") })
+}
+
+// doJSON sends a request with a JSON body and returns the response.
+func doJSON(t *testing.T, method, url, token string, body any) *http.Response {
+	t.Helper()
+
+	b, err := json.Marshal(body)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(b))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+
+	return resp
+}
+
+func TestServer_DataFlow(t *testing.T) {
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	credentials := map[string]string{"username": "alice", "password": string(hash)}
+
+	resp := doJSON(t, http.MethodPost, srv.URL+"/register", "", credentials)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doJSON(t, http.MethodPost, srv.URL+"/login", "", credentials)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var login struct {
+		UserID int    `json:"userID"`
+		Token  string `json:"token"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&login))
+	resp.Body.Close()
+
+	// Data endpoints require a token
+	url := fmt.Sprintf("%s/addData/UserCredentials/%d/%s", srv.URL, login.UserID, entry1ID)
+	resp = doJSON(t, http.MethodPost, url, "", map[string]string{"login": "alice"})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = doJSON(t, http.MethodPost, url, login.Token, map[string]string{"login": "alice"})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Writes respond with the timestamp assigned by the storage
+	var written struct {
+		UpdatedAt time.Time `json:"updated_at"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&written))
+	resp.Body.Close()
+	assert.False(t, written.UpdatedAt.IsZero())
+
+	url = fmt.Sprintf("%s/getAllData/UserCredentials/%d/0001-01-01T00:00:00Z", srv.URL, login.UserID)
+	resp = doJSON(t, http.MethodGet, url, login.Token, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var data []map[string]string
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&data))
+	resp.Body.Close()
+
+	require.Len(t, data, 1)
+	assert.Equal(t, entry1ID, data[0]["id"])
+	assert.Equal(t, "alice", data[0]["login"])
+	assert.Equal(t, written.UpdatedAt.Format(time.RFC3339Nano), data[0]["updated_at"])
+}
+
+func TestServer_SyncPush(t *testing.T) {
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	credentials := map[string]string{"username": "bob", "password": string(hash)}
+
+	resp := doJSON(t, http.MethodPost, srv.URL+"/register", "", credentials)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doJSON(t, http.MethodPost, srv.URL+"/login", "", credentials)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var login struct {
+		Token string `json:"token"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&login))
+	resp.Body.Close()
+
+	push := map[string]any{
+		"changes": []map[string]any{
+			{"table": "UserCredentials", "op": "add", "entry_id": entry1ID, "fields": map[string]string{"login": "bob"}},
+			{"table": "UserCredentials", "op": "update", "entry_id": missingID, "updated_at": "2024-01-01T00:00:00Z"},
+		},
+	}
+
+	resp = doJSON(t, http.MethodPost, srv.URL+"/api/sync/push", "", push)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = doJSON(t, http.MethodPost, srv.URL+"/api/sync/push", login.Token, push)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var pushed struct {
+		Results []struct {
+			EntryID string `json:"entry_id"`
+			Status  string `json:"status"`
+		} `json:"results"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&pushed))
+	resp.Body.Close()
+
+	require.Len(t, pushed.Results, 2)
+	assert.Equal(t, "applied", pushed.Results[0].Status)
+	assert.Equal(t, "not_found", pushed.Results[1].Status)
+
+	// Malformed batches are rejected as a whole
+	resp = doJSON(t, http.MethodPost, srv.URL+"/api/sync/push", login.Token, map[string]any{
+		"changes": []map[string]any{{"table": "UserCredentials", "op": "rename", "entry_id": entry1ID}},
+	})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+// syncResponse is the response to a synchronization in one round trip.
+type syncResponse struct {
+	Results []struct {
+		EntryID   string    `json:"entry_id"`
+		Status    string    `json:"status"`
+		UpdatedAt time.Time `json:"updated_at"`
+	} `json:"results"`
+	Conflicts []struct {
+		EntryID string `json:"entry_id"`
+		Client  struct {
+			Fields map[string]string `json:"fields"`
+		} `json:"client"`
+		Server map[string]string `json:"server"`
+	} `json:"conflicts"`
+	Changes   map[string][]map[string]string `json:"changes"`
+	Watermark time.Time                      `json:"watermark"`
+}
+
+func TestServer_Sync(t *testing.T) {
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	_, token := registerAndLogin(t, srv, "nina", string(hash))
+
+	sync := func(lastSync time.Time, changes ...map[string]any) syncResponse {
+		t.Helper()
+		resp := doJSON(t, http.MethodPost, srv.URL+"/api/sync", token, map[string]any{"last_sync": lastSync, "changes": changes})
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var got syncResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+		return got
+	}
+
+	// The laptop adds an entry, its own change isn't sent back
+	laptop := sync(time.Time{}, map[string]any{
+		"table": "UserCredentials", "op": "add", "entry_id": entry1ID, "fields": map[string]string{"login": "laptop"},
+	})
+	require.Len(t, laptop.Results, 1)
+	assert.Equal(t, "applied", laptop.Results[0].Status)
+	assert.Empty(t, laptop.Changes["UserCredentials"])
+	assert.True(t, laptop.Watermark.Equal(laptop.Results[0].UpdatedAt))
+
+	// The phone pulls it and edits it
+	phone := sync(time.Time{})
+	require.Len(t, phone.Changes["UserCredentials"], 1)
+	time.Sleep(5 * time.Millisecond)
+	phone = sync(phone.Watermark, map[string]any{
+		"table": "UserCredentials", "op": "update", "entry_id": entry1ID, "fields": map[string]string{"login": "phone"},
+		"updated_at": laptop.Results[0].UpdatedAt,
+	})
+	require.Equal(t, "applied", phone.Results[0].Status)
+
+	// The stale edit of the laptop loses to the newer server row, the laptop gets both versions in the same round trip
+	laptop = sync(laptop.Watermark, map[string]any{
+		"table": "UserCredentials", "op": "update", "entry_id": entry1ID, "fields": map[string]string{"login": "offline"},
+		"updated_at": laptop.Results[0].UpdatedAt,
+	})
+	require.Len(t, laptop.Results, 1)
+	assert.Equal(t, "conflict", laptop.Results[0].Status)
+	require.Len(t, laptop.Conflicts, 1)
+	assert.Equal(t, entry1ID, laptop.Conflicts[0].EntryID)
+	assert.Equal(t, "offline", laptop.Conflicts[0].Client.Fields["login"])
+	assert.Equal(t, "phone", laptop.Conflicts[0].Server["login"])
+	require.Len(t, laptop.Changes["UserCredentials"], 1)
+	assert.Equal(t, "phone", laptop.Changes["UserCredentials"][0]["login"])
+	assert.True(t, laptop.Watermark.Equal(phone.Watermark))
+
+	// Nothing changed since the watermark
+	assert.Empty(t, sync(laptop.Watermark).Changes["UserCredentials"])
+
+	// Malformed batches are rejected as a whole
+	resp := doJSON(t, http.MethodPost, srv.URL+"/api/sync", token, map[string]any{
+		"changes": []map[string]any{{"table": "UserCredentials", "op": "add", "entry_id": "not-a-uuid"}},
+	})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = doJSON(t, http.MethodPost, srv.URL+"/api/sync", "", map[string]any{})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestServer_Audit(t *testing.T) {
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	credentials := map[string]string{"username": "grace", "password": string(hash)}
+
+	resp := doJSON(t, http.MethodPost, srv.URL+"/register", "", credentials)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doJSON(t, http.MethodPost, srv.URL+"/login", "", map[string]string{"username": "grace", "password": "wrong"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = doJSON(t, http.MethodPost, srv.URL+"/login", "", credentials)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var login struct {
+		UserID int    `json:"userID"`
+		Token  string `json:"token"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&login))
+	resp.Body.Close()
+
+	url := fmt.Sprintf("%s/addData/UserCredentials/%d/%s", srv.URL, login.UserID, entry1ID)
+	resp = doJSON(t, http.MethodPost, url, login.Token, map[string]string{"login": "grace"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/audit", "", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// The user sees their own history, newest first, with the client of every request
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/audit", login.Token, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var events []models.AuditEvent
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&events))
+	resp.Body.Close()
+
+	require.Len(t, events, 4)
+	assert.Equal(t, models.AuditAdd, events[0].Action)
+	assert.Equal(t, entry1ID, events[0].EntryID)
+	assert.Equal(t, models.AuditLogin, events[1].Action)
+	assert.True(t, events[1].Success)
+	assert.Equal(t, models.AuditLogin, events[2].Action)
+	assert.False(t, events[2].Success)
+	assert.Equal(t, models.AuditRegister, events[3].Action)
+	assert.Equal(t, "Go-http-client/1.1", events[0].UserAgent)
+	assert.NotEmpty(t, events[0].RemoteAddr)
+
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/audit?limit=1", login.Token, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&events))
+	resp.Body.Close()
+	assert.Len(t, events, 1)
+
+	since := events[0].CreatedAt.Add(time.Second).Format(time.RFC3339Nano)
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/audit?since="+since, login.Token, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&events))
+	resp.Body.Close()
+	assert.Empty(t, events)
+
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/audit?since=yesterday", login.Token, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+// registerAndLogin registers the user with the bcrypt hash as password and returns its id and token.
+func registerAndLogin(t *testing.T, srv *httptest.Server, username, hash string) (int, string) {
+	credentials := map[string]string{"username": username, "password": hash}
+
+	resp := doJSON(t, http.MethodPost, srv.URL+"/register", "", credentials)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doJSON(t, http.MethodPost, srv.URL+"/login", "", credentials)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var login struct {
+		UserID int    `json:"userID"`
+		Token  string `json:"token"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&login))
+	resp.Body.Close()
+
+	return login.UserID, login.Token
+}
+
+// readResponse returns the status and the body of the response.
+func readResponse(t *testing.T, resp *http.Response) (int, string) {
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return resp.StatusCode, string(body)
+}
+
+func TestServer_ForeignEntry(t *testing.T) {
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	ownerID, ownerToken := registerAndLogin(t, srv, "heidi", string(hash))
+	proberID, proberToken := registerAndLogin(t, srv, "ivan", string(hash))
+
+	url := fmt.Sprintf("%s/addData/UserCredentials/%d/%s", srv.URL, ownerID, foreignID)
+	resp := doJSON(t, http.MethodPost, url, ownerToken, map[string]string{"login": "heidi"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	status, body := readResponse(t, doJSON(t, http.MethodGet,
+		fmt.Sprintf("%s/getData/UserCredentials/%d/%s", srv.URL, proberID, missingID), proberToken, nil))
+	require.Equal(t, http.StatusNotFound, status)
+
+	// The entry of another user, asked for under either user, looks like a missing one
+	requests := []struct{ method, url string }{
+		{http.MethodGet, fmt.Sprintf("%s/getData/UserCredentials/%d/%s", srv.URL, proberID, foreignID)},
+		{http.MethodGet, fmt.Sprintf("%s/getData/UserCredentials/%d/%s", srv.URL, ownerID, foreignID)},
+		{http.MethodGet, fmt.Sprintf("%s/getData/UserCredentials/%d/%s", srv.URL, ownerID, missingID)},
+		{http.MethodPost, srv.URL + "/api/UserCredentials/" + foreignID + "/restore"},
+		{http.MethodPost, srv.URL + "/api/UserCredentials/" + missingID + "/restore"},
+		{http.MethodPut, fmt.Sprintf("%s/updateData/UserCredentials/%d/%s", srv.URL, ownerID, foreignID)},
+		{http.MethodDelete, fmt.Sprintf("%s/deleteData/UserCredentials/%d/%s", srv.URL, ownerID, foreignID)},
+		{http.MethodPut, fmt.Sprintf("%s/updateData/UserCredentials/%d/%s", srv.URL, proberID, foreignID)},
+		{http.MethodPut, fmt.Sprintf("%s/updateData/UserCredentials/%d/%s", srv.URL, proberID, missingID)},
+		{http.MethodDelete, fmt.Sprintf("%s/deleteData/UserCredentials/%d/%s", srv.URL, proberID, foreignID)},
+		{http.MethodDelete, fmt.Sprintf("%s/deleteData/UserCredentials/%d/%s", srv.URL, proberID, missingID)},
+		{http.MethodGet, fmt.Sprintf("%s/getAllData/UserCredentials/%d/0001-01-01T00:00:00Z", srv.URL, ownerID)},
+	}
+	for _, req := range requests {
+		gotStatus, gotBody := readResponse(t, doJSON(t, req.method, req.url, proberToken, map[string]string{"login": "ivan"}))
+		assert.Equal(t, status, gotStatus, req.url)
+		assert.Equal(t, body, gotBody, req.url)
+	}
+
+	// The entry of the owner is untouched
+	status, body = readResponse(t, doJSON(t, http.MethodGet,
+		fmt.Sprintf("%s/getData/UserCredentials/%d/%s", srv.URL, ownerID, foreignID), ownerToken, nil))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `"login":"heidi"`)
+	assert.Contains(t, body, `"deleted":"false"`)
+}
+
+func TestServer_Shares(t *testing.T) {
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	ownerID, ownerToken := registerAndLogin(t, srv, "judy", string(hash))
+	granteeID, granteeToken := registerAndLogin(t, srv, "karl", string(hash))
+
+	resp := doJSON(t, http.MethodPost, fmt.Sprintf("%s/addData/UserCredentials/%d/%s", srv.URL, ownerID, foreignID),
+		ownerToken, map[string]string{"login": "judy"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	sharesURL := srv.URL + "/api/UserCredentials/" + foreignID + "/shares"
+	status, _ := readResponse(t, doJSON(t, http.MethodPost, sharesURL, ownerToken, map[string]string{"grantee": "nobody"}))
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = readResponse(t, doJSON(t, http.MethodPost, sharesURL, ownerToken, map[string]string{"grantee": "judy"}))
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = readResponse(t, doJSON(t, http.MethodPost, sharesURL, granteeToken, map[string]string{"grantee": "judy"}))
+	assert.Equal(t, http.StatusNotFound, status, "only the owner shares an entry")
+
+	// Shared read-only by default
+	status, body := readResponse(t, doJSON(t, http.MethodPost, sharesURL, ownerToken, map[string]string{"grantee": "karl"}))
+	require.Equal(t, http.StatusOK, status, body)
+	var share models.Share
+	require.NoError(t, json.Unmarshal([]byte(body), &share))
+	assert.Equal(t, models.ShareRead, share.Permission)
+	assert.Equal(t, granteeID, share.GranteeID)
+
+	status, body = readResponse(t, doJSON(t, http.MethodGet, srv.URL+"/api/shares", granteeToken, nil))
+	require.Equal(t, http.StatusOK, status)
+	var shared []models.SharedEntry
+	require.NoError(t, json.Unmarshal([]byte(body), &shared))
+	require.Len(t, shared, 1)
+	assert.Equal(t, "judy", shared[0].Owner)
+	assert.Equal(t, "judy", shared[0].Fields["login"])
+
+	updateURL := fmt.Sprintf("%s/updateData/UserCredentials/%d/%s", srv.URL, granteeID, foreignID)
+	status, _ = readResponse(t, doJSON(t, http.MethodPut, updateURL, granteeToken, map[string]string{"login": "karl"}))
+	assert.Equal(t, http.StatusForbidden, status)
+	status, _ = readResponse(t, doJSON(t, http.MethodDelete,
+		fmt.Sprintf("%s/deleteData/UserCredentials/%d/%s", srv.URL, granteeID, foreignID), granteeToken, nil))
+	assert.Equal(t, http.StatusForbidden, status)
+
+	// Shared again with the write permission
+	status, _ = readResponse(t, doJSON(t, http.MethodPost, sharesURL, ownerToken,
+		map[string]string{"grantee": "karl", "permission": models.ShareWrite}))
+	require.Equal(t, http.StatusOK, status)
+	status, _ = readResponse(t, doJSON(t, http.MethodPut, updateURL, granteeToken, map[string]string{"login": "karl"}))
+	assert.Equal(t, http.StatusOK, status)
+	status, body = readResponse(t, doJSON(t, http.MethodGet,
+		fmt.Sprintf("%s/getData/UserCredentials/%d/%s", srv.URL, ownerID, foreignID), ownerToken, nil))
+	require.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `"karl"`)
+
+	status, _ = readResponse(t, doJSON(t, http.MethodDelete, sharesURL+"/karl", ownerToken, nil))
+	assert.Equal(t, http.StatusNoContent, status)
+	status, _ = readResponse(t, doJSON(t, http.MethodDelete, sharesURL+"/karl", ownerToken, nil))
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, body = readResponse(t, doJSON(t, http.MethodGet, srv.URL+"/api/shares", granteeToken, nil))
+	require.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `[]`, body)
+}
+
+func TestServer_Folders(t *testing.T) {
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	userID, token := registerAndLogin(t, srv, "judy", string(hash))
+
+	status, body := readResponse(t, doJSON(t, http.MethodPost, srv.URL+"/api/folders", token, map[string]string{"name": "Work"}))
+	require.Equal(t, http.StatusCreated, status, body)
+	var work models.Folder
+	require.NoError(t, json.Unmarshal([]byte(body), &work))
+	assert.NoError(t, models.ValidateEntryID(work.ID))
+	status, _ = readResponse(t, doJSON(t, http.MethodPost, srv.URL+"/api/folders", token, map[string]string{"name": "work"}))
+	assert.Equal(t, http.StatusConflict, status)
+	status, _ = readResponse(t, doJSON(t, http.MethodPost, srv.URL+"/api/folders", token,
+		map[string]string{"name": "Lost", "parent_id": foreignID}))
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, body = readResponse(t, doJSON(t, http.MethodPost, srv.URL+"/api/folders", token,
+		map[string]string{"id": foreignID, "name": "Projects", "parent_id": work.ID}))
+	require.Equal(t, http.StatusCreated, status, body)
+
+	// The entries are filed in a folder through their folder_id
+	resp := doJSON(t, http.MethodPost, fmt.Sprintf("%s/addData/UserCredentials/%d", srv.URL, userID), token,
+		map[string]string{"login": "judy", models.FolderField: foreignID})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	status, body = readResponse(t, doJSON(t, http.MethodGet, srv.URL+"/api/UserCredentials?folder="+foreignID, token, nil))
+	require.Equal(t, http.StatusOK, status)
+	var listed []map[string]string
+	require.NoError(t, json.Unmarshal([]byte(body), &listed))
+	require.Len(t, listed, 1)
+	assert.Equal(t, foreignID, listed[0][models.FolderField])
+	// but not in a folder of another user
+	_, otherToken := registerAndLogin(t, srv, "ivan", string(hash))
+	status, body = readResponse(t, doJSON(t, http.MethodPost, srv.URL+"/api/folders", otherToken, map[string]string{"name": "Other"}))
+	require.Equal(t, http.StatusCreated, status, body)
+	var other models.Folder
+	require.NoError(t, json.Unmarshal([]byte(body), &other))
+	status, _ = readResponse(t, doJSON(t, http.MethodPost, fmt.Sprintf("%s/addData/UserCredentials/%d", srv.URL, userID), token,
+		map[string]string{"login": "judy", models.FolderField: other.ID}))
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, body = readResponse(t, doJSON(t, http.MethodGet, srv.URL+"/api/UserCredentials?folder=root", token, nil))
+	require.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `[]`, body)
+	status, _ = readResponse(t, doJSON(t, http.MethodGet, srv.URL+"/api/UserCredentials?folder=work", token, nil))
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, body = readResponse(t, doJSON(t, http.MethodPut, srv.URL+"/api/folders/"+work.ID, token, map[string]string{"name": "Job"}))
+	require.Equal(t, http.StatusOK, status, body)
+	status, _ = readResponse(t, doJSON(t, http.MethodPut, srv.URL+"/api/folders/"+work.ID, token,
+		map[string]string{"name": "Job", "parent_id": foreignID}))
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, body = readResponse(t, doJSON(t, http.MethodGet, srv.URL+"/api/folders", token, nil))
+	require.Equal(t, http.StatusOK, status)
+	var folders []models.Folder
+	require.NoError(t, json.Unmarshal([]byte(body), &folders))
+	require.Len(t, folders, 2)
+	assert.Equal(t, "Job", folders[0].Name)
+
+	status, _ = readResponse(t, doJSON(t, http.MethodDelete, srv.URL+"/api/folders/"+foreignID, token, nil))
+	assert.Equal(t, http.StatusConflict, status)
+	status, _ = readResponse(t, doJSON(t, http.MethodDelete, srv.URL+"/api/folders/"+foreignID+"?move_children=true", token, nil))
+	assert.Equal(t, http.StatusNoContent, status)
+	status, _ = readResponse(t, doJSON(t, http.MethodDelete, srv.URL+"/api/folders/"+foreignID, token, nil))
+	assert.Equal(t, http.StatusNotFound, status)
+	// The entry of the deleted folder moved to its parent
+	status, body = readResponse(t, doJSON(t, http.MethodGet, srv.URL+"/api/UserCredentials?folder="+work.ID, token, nil))
+	require.Equal(t, http.StatusOK, status)
+	listed = nil
+	require.NoError(t, json.Unmarshal([]byte(body), &listed))
+	require.Len(t, listed, 1)
+	assert.Equal(t, work.ID, listed[0][models.FolderField])
+}
+
+func TestServer_EntryRoutesOtherTables(t *testing.T) {
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	userID, token := registerAndLogin(t, srv, "kim", string(hash))
+	status, body := readResponse(t, doJSON(t, http.MethodPost, srv.URL+"/api/folders", token, map[string]string{"id": foreignID, "name": "Work"}))
+	require.Equal(t, http.StatusCreated, status, body)
+
+	// The folders are changed by their own routes only, which check them
+	for _, table := range []string{"folders", "Users", "shared_entries"} {
+		status, _ = readResponse(t, doJSON(t, http.MethodPost, fmt.Sprintf("%s/addData/%s/%d/%s", srv.URL, table, userID, models.NewEntryID()), token,
+			map[string]string{"name": "Loop", "parent_id": foreignID}))
+		assert.Equal(t, http.StatusBadRequest, status, table)
+		status, _ = readResponse(t, doJSON(t, http.MethodPut, fmt.Sprintf("%s/updateData/%s/%d/%s", srv.URL, table, userID, foreignID), token,
+			map[string]string{"parent_id": foreignID}))
+		assert.Equal(t, http.StatusBadRequest, status, table)
+		status, _ = readResponse(t, doJSON(t, http.MethodDelete, fmt.Sprintf("%s/deleteData/%s/%d/%s", srv.URL, table, userID, foreignID), token, nil))
+		assert.Equal(t, http.StatusBadRequest, status, table)
+		status, _ = readResponse(t, doJSON(t, http.MethodGet, fmt.Sprintf("%s/getData/%s/%d/%s", srv.URL, table, userID, foreignID), token, nil))
+		assert.Equal(t, http.StatusBadRequest, status, table)
+		status, _ = readResponse(t, doJSON(t, http.MethodPost, fmt.Sprintf("%s/api/%s/%s/restore", srv.URL, table, foreignID), token, nil))
+		assert.Equal(t, http.StatusBadRequest, status, table)
+	}
+
+	status, body = readResponse(t, doJSON(t, http.MethodGet, srv.URL+"/api/folders", token, nil))
+	require.Equal(t, http.StatusOK, status)
+	var folders []models.Folder
+	require.NoError(t, json.Unmarshal([]byte(body), &folders))
+	require.Len(t, folders, 1)
+	assert.Equal(t, "Work", folders[0].Name)
+	assert.Empty(t, folders[0].ParentID)
+}
+
+func TestServer_Seeds(t *testing.T) {
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	userID, token := registerAndLogin(t, srv, "kate", string(hash))
+	addURL := fmt.Sprintf("%s/addData/%s/%d", srv.URL, models.OtpTable, userID)
+
+	status, _ := readResponse(t, doJSON(t, http.MethodPost, addURL, token,
+		map[string]string{models.OtpSecretField: "JBSWY3DP1", "issuer": "Example"}))
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = readResponse(t, doJSON(t, http.MethodPost, addURL, token,
+		map[string]string{models.OtpSecretField: "JBSWY3DP", models.OtpDigitsField: "10"}))
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, body := readResponse(t, doJSON(t, http.MethodPost, addURL, token,
+		map[string]string{models.OtpSecretField: "jbsw y3dp", "issuer": "Example", "account": "kate", models.OtpLinkedField: foreignID}))
+	require.Equal(t, http.StatusOK, status, body)
+
+	// The list of the seeds shows whose they are, without the secrets
+	status, body = readResponse(t, doJSON(t, http.MethodGet, srv.URL+"/api/"+models.OtpTable, token, nil))
+	require.Equal(t, http.StatusOK, status)
+	var listed []map[string]string
+	require.NoError(t, json.Unmarshal([]byte(body), &listed))
+	require.Len(t, listed, 1)
+	assert.Equal(t, "Example", listed[0]["issuer"])
+	assert.Equal(t, foreignID, listed[0][models.OtpLinkedField])
+	assert.NotContains(t, listed[0], models.OtpSecretField)
+}
+
+func TestServer_SshKeys(t *testing.T) {
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	userID, token := registerAndLogin(t, srv, "liam", string(hash))
+
+	const publicKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAOhB7/zzhC+HXDdGOdLwJln5NYwm6UNXx3chmQSVTG4 liam@laptop"
+	const fingerprint = "SHA256:lbmsoA0yIEcEiVDRnMWuzm+nV+3ZEEpVIURqFoeSspg"
+	status, body := readResponse(t, doJSON(t, http.MethodPost, fmt.Sprintf("%s/addData/%s/%d", srv.URL, models.SshKeysTable, userID), token,
+		map[string]string{models.SshPrivateKeyField: "sealed", models.SshPublicKeyField: publicKey, "title": "Laptop"}))
+	require.Equal(t, http.StatusOK, status, body)
+
+	// The fingerprint is looked up as ssh-keygen prints it, with or without its prefix
+	for _, query := range []string{url.QueryEscape(fingerprint), url.QueryEscape(strings.TrimPrefix(fingerprint, "SHA256:"))} {
+		status, body = readResponse(t, doJSON(t, http.MethodGet, srv.URL+"/api/sshkeys?fingerprint="+query, token, nil))
+		require.Equal(t, http.StatusOK, status, body)
+		var found []map[string]string
+		require.NoError(t, json.Unmarshal([]byte(body), &found))
+		require.Len(t, found, 1)
+		assert.Equal(t, "Laptop", found[0]["title"])
+		assert.Equal(t, fingerprint, found[0][models.SshFingerprintField])
+		assert.NotContains(t, found[0], models.SshPrivateKeyField)
+	}
+
+	status, body = readResponse(t, doJSON(t, http.MethodGet, srv.URL+"/api/sshkeys?fingerprint="+"SHA256:"+strings.Repeat("A", 43), token, nil))
+	require.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `[]`, body)
+	status, _ = readResponse(t, doJSON(t, http.MethodGet, srv.URL+"/api/sshkeys?fingerprint=MD5:ab:cd", token, nil))
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = readResponse(t, doJSON(t, http.MethodGet, srv.URL+"/api/sshkeys", token, nil))
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestServer_EntryIDs(t *testing.T) {
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	userID, token := registerAndLogin(t, srv, "judy", string(hash))
+
+	// Entries added without an id get distinct ones from the server, handed back to the client
+	ids := make(map[string]bool)
+	for _, login := range []string{"judy", "kate"} {
+		resp := doJSON(t, http.MethodPost, fmt.Sprintf("%s/addData/UserCredentials/%d", srv.URL, userID), token, map[string]string{"login": login})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var added struct {
+			ID        string    `json:"id"`
+			UpdatedAt time.Time `json:"updated_at"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&added))
+		resp.Body.Close()
+		assert.NoError(t, models.ValidateEntryID(added.ID))
+		assert.False(t, added.UpdatedAt.IsZero())
+		ids[added.ID] = true
+
+		resp = doJSON(t, http.MethodGet, fmt.Sprintf("%s/getData/UserCredentials/%d/%s", srv.URL, userID, added.ID), token, nil)
+		status, body := readResponse(t, resp)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Contains(t, body, login)
+	}
+	assert.Len(t, ids, 2)
+
+	// An id sent by the client must be a UUID
+	for _, id := range []string{"entry1", "6f1e2a4c3b5d4e7f8a9b0c1d2e3f4a51", "{6f1e2a4c-3b5d-4e7f-8a9b-0c1d2e3f4a51}"} {
+		for _, req := range []struct{ method, url string }{
+			{http.MethodPost, fmt.Sprintf("%s/addData/UserCredentials/%d/%s", srv.URL, userID, id)},
+			{http.MethodGet, fmt.Sprintf("%s/getData/UserCredentials/%d/%s", srv.URL, userID, id)},
+			{http.MethodPut, fmt.Sprintf("%s/updateData/UserCredentials/%d/%s", srv.URL, userID, id)},
+			{http.MethodDelete, fmt.Sprintf("%s/deleteData/UserCredentials/%d/%s", srv.URL, userID, id)},
+			{http.MethodGet, fmt.Sprintf("%s/api/UserCredentials/%s/history", srv.URL, id)},
+			{http.MethodPost, fmt.Sprintf("%s/api/UserCredentials/%s/restore", srv.URL, id)},
+		} {
+			status, body := readResponse(t, doJSON(t, req.method, req.url, token, map[string]string{"login": "judy"}))
+			assert.Equal(t, http.StatusBadRequest, status, req.url)
+			assert.Contains(t, body, models.ErrInvalidEntryID.Error(), req.url)
+		}
+	}
+
+	resp := doJSON(t, http.MethodPost, srv.URL+"/api/sync/push", token, map[string]any{
+		"changes": []map[string]any{{"table": "UserCredentials", "op": "add", "entry_id": "entry1", "fields": map[string]string{"login": "judy"}}},
+	})
+	status, body := readResponse(t, resp)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, body, models.ErrInvalidEntryID.Error())
+}
+
+func TestServer_LoginUnknownAccount(t *testing.T) {
+	srv := newTestServer(t)
+
+	// The stored hash has the cost of the dummy one, as the hashes of real clients do
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
+	require.NoError(t, err)
+	registerAndLogin(t, srv, "judy", string(hash))
+
+	login := func(username string) (int, string, time.Duration) {
+		start := time.Now()
+		status, body := readResponse(t, doJSON(t, http.MethodPost, srv.URL+"/login", "",
+			map[string]string{"username": username, "password": "wrong"}))
+		return status, body, time.Since(start)
+	}
+
+	// A wrong password and an unknown account fail the same way and take about as long
+	var known, unknown []time.Duration
+	for i := 0; i < 3; i++ {
+		knownStatus, knownBody, d := login("judy")
+		known = append(known, d)
+		unknownStatus, unknownBody, d := login("nobody")
+		unknown = append(unknown, d)
+
+		assert.Equal(t, http.StatusUnauthorized, knownStatus)
+		assert.Equal(t, knownStatus, unknownStatus)
+		assert.Equal(t, knownBody, unknownBody)
+	}
+	sort.Slice(known, func(i, j int) bool { return known[i] < known[j] })
+	sort.Slice(unknown, func(i, j int) bool { return unknown[i] < unknown[j] })
+	assert.InDelta(t, bits.Len64(uint64(known[1])), bits.Len64(uint64(unknown[1])), 1,
+		"wrong password took %s, unknown account %s", known[1], unknown[1])
+}
+
+func TestServer_LoginLockout(t *testing.T) {
+	withoutAuthRateLimit(t)
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	_, token := registerAndLogin(t, srv, "ivan", string(hash))
+	login := func(password string) *http.Response {
+		return doJSON(t, http.MethodPost, srv.URL+"/login", "", map[string]string{"username": "ivan", "password": password})
+	}
+
+	// A successful login resets the consecutive failures
+	for i := 0; i < 4; i++ {
+		status, _ := readResponse(t, login("wrong"))
+		require.Equal(t, http.StatusUnauthorized, status)
+	}
+	status, _ := readResponse(t, login("password123"))
+	require.Equal(t, http.StatusOK, status)
+
+	// The fifth consecutive failure locks the account, even the right password is rejected then
+	for i := 0; i < 5; i++ {
+		status, _ := readResponse(t, login("wrong"))
+		require.Equal(t, http.StatusUnauthorized, status)
+	}
+	resp := login("password123")
+	status, _ = readResponse(t, resp)
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	retry, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	require.NoError(t, err)
+	assert.InDelta(t, 60, retry, 2)
+
+	// The owner sees the lockout in the audit log
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/audit", token, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var events []models.AuditEvent
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&events))
+	resp.Body.Close()
+	require.NotEmpty(t, events)
+	assert.Equal(t, models.AuditLockout, events[0].Action)
+}
+
+func TestServer_LoginIPLimit(t *testing.T) {
+	withoutAuthRateLimit(t)
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	registerAndLogin(t, srv, "kate", string(hash))
+
+	// A password list tried against many accounts from one address is stopped by the address
+	for i := 0; i < 20; i++ {
+		status, _ := readResponse(t, doJSON(t, http.MethodPost, srv.URL+"/login", "",
+			map[string]string{"username": fmt.Sprintf("user%d", i), "password": "wrong"}))
+		require.Equal(t, http.StatusUnauthorized, status)
+	}
+	resp := doJSON(t, http.MethodPost, srv.URL+"/login", "", map[string]string{"username": "kate", "password": "password123"})
+	status, _ := readResponse(t, resp)
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+}
+
+func TestServer_RateLimit(t *testing.T) {
+	config.NewOptions().ParseFlags()
+	for name, value := range map[string]string{"auth-rate-burst": "5", "data-rate-limit": "1", "data-rate-burst": "3"} {
+		require.NoError(t, flag.Set(name, value))
+	}
+	t.Cleanup(func() {
+		flag.Set("auth-rate-burst", "10")
+		flag.Set("data-rate-limit", "600")
+		flag.Set("data-rate-burst", "100")
+	})
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	_, leoToken := registerAndLogin(t, srv, "leo", string(hash))
+	_, miaToken := registerAndLogin(t, srv, "mia", string(hash))
+
+	// The authentication routes are limited by address
+	status, _ := readResponse(t, doJSON(t, http.MethodPost, srv.URL+"/login", "",
+		map[string]string{"username": "leo", "password": string(hash)}))
+	require.Equal(t, http.StatusOK, status)
+	resp := doJSON(t, http.MethodPost, srv.URL+"/login", "", map[string]string{"username": "leo", "password": string(hash)})
+	status, _ = readResponse(t, resp)
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+
+	// The data routes are limited by user, the other users of the address are served
+	for i := 0; i < 3; i++ {
+		status, _ := readResponse(t, doJSON(t, http.MethodGet, srv.URL+"/api/user/devices", leoToken, nil))
+		require.Equal(t, http.StatusOK, status)
+	}
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/user/devices", leoToken, nil)
+	status, _ = readResponse(t, resp)
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	assert.Equal(t, "60", resp.Header.Get("Retry-After"))
+	status, _ = readResponse(t, doJSON(t, http.MethodGet, srv.URL+"/api/user/devices", miaToken, nil))
+	assert.Equal(t, http.StatusOK, status)
+
+	// The health probes aren't limited
+	status, _ = readResponse(t, doJSON(t, http.MethodGet, srv.URL+"/ping", "", nil))
+	assert.Equal(t, http.StatusOK, status)
+}
+
+// tokens is the response to a login or a refresh.
+type tokens struct {
+	UserID       int    `json:"userID"`
+	Token        string `json:"token"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	DeviceID     string `json:"device_id"`
+}
+
+// refresh exchanges the refresh token for new tokens, returning the status of the response.
+func refresh(t *testing.T, srv *httptest.Server, refreshToken string) (int, tokens) {
+	resp := doJSON(t, http.MethodPost, srv.URL+"/api/user/refresh", "", map[string]string{"refresh_token": refreshToken})
+	defer resp.Body.Close()
+
+	var got tokens
+	if resp.StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+	}
+
+	return resp.StatusCode, got
+}
+
+func TestServer_PasswordRehash(t *testing.T) {
+	option := config.NewOptions()
+	option.ParseFlags()
+	nLogger, err := logger.NewLogger(option.LogLevel())
+	require.NoError(t, err)
+	keeper := storage.NewMemKeeper()
+	srv := httptest.NewServer(newRouter(keeper, option, nLogger, nil, nil, newHealthState(time.Minute), nil, nil, nil, nil))
+	t.Cleanup(srv.Close)
+	ctx := context.Background()
+
+	// The accounts registered with a bcrypt hash
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	for _, username := range []string{"ivan", "judy"} {
+		resp := doJSON(t, http.MethodPost, srv.URL+"/register", "", map[string]string{"username": username, "password": string(hash)})
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	login := func(username, password string) tokens {
+		resp := doJSON(t, http.MethodPost, srv.URL+"/login", "", map[string]string{"username": username, "password": password, "device_id": "phone"})
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var got tokens
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+		return got
+	}
+
+	// A login with the password in plain rehashes it with Argon2id, the session goes on
+	first := login("ivan", "password123")
+	stored, err := keeper.GetPassword(ctx, "ivan")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(stored, "$argon2id$"), stored)
+	status, _ := refresh(t, srv, first.RefreshToken)
+	assert.Equal(t, http.StatusOK, status)
+
+	// The next login verifies the new hash and leaves it as it is
+	login("ivan", "password123")
+	again, err := keeper.GetPassword(ctx, "ivan")
+	require.NoError(t, err)
+	assert.Equal(t, stored, again)
+
+	// A client sending the hash itself keeps it as its password
+	login("judy", string(hash))
+	stored, err = keeper.GetPassword(ctx, "judy")
+	require.NoError(t, err)
+	assert.Equal(t, string(hash), stored)
+}
+
+func TestServer_RefreshTokens(t *testing.T) {
+	withoutAuthRateLimit(t)
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	credentials := map[string]string{"username": "heidi", "password": string(hash), "device_id": "phone"}
+	resp := doJSON(t, http.MethodPost, srv.URL+"/register", "", credentials)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The login returns a short-lived access token and a refresh token for the device
+	resp = doJSON(t, http.MethodPost, srv.URL+"/login", "", credentials)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var login tokens
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&login))
+	resp.Body.Close()
+	assert.NotEmpty(t, login.Token)
+	assert.NotEmpty(t, login.RefreshToken)
+	assert.Equal(t, "phone", login.DeviceID)
+	assert.Equal(t, 15*60, login.ExpiresIn)
+
+	// A refresh rotates the refresh token and returns a working access token
+	status, first := refresh(t, srv, login.RefreshToken)
+	require.Equal(t, http.StatusOK, status)
+	assert.NotEqual(t, login.RefreshToken, first.RefreshToken)
+	assert.Equal(t, "phone", first.DeviceID)
+	url := fmt.Sprintf("%s/getAllData/UserCredentials/%d/0001-01-01T00:00:00Z", srv.URL, login.UserID)
+	resp = doJSON(t, http.MethodGet, url, first.Token, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	status, second := refresh(t, srv, first.RefreshToken)
+	require.Equal(t, http.StatusOK, status)
+
+	// The rotated token presented again revokes the whole chain, the latest token too
+	status, _ = refresh(t, srv, login.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, _ = refresh(t, srv, second.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/audit?limit=1", login.Token, nil)
+	var events []models.AuditEvent
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&events))
+	resp.Body.Close()
+	require.Len(t, events, 1)
+	assert.Equal(t, models.AuditRefresh, events[0].Action)
+	assert.False(t, events[0].Success)
+
+	// A logout ends the session of its device only
+	resp = doJSON(t, http.MethodPost, srv.URL+"/login", "", credentials)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&login))
+	resp.Body.Close()
+	laptop := map[string]string{"username": "heidi", "password": string(hash), "device_id": "laptop"}
+	resp = doJSON(t, http.MethodPost, srv.URL+"/login", "", laptop)
+	var other tokens
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&other))
+	resp.Body.Close()
+
+	resp = doJSON(t, http.MethodPost, srv.URL+"/api/user/logout", "", map[string]string{"refresh_token": login.RefreshToken})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	status, _ = refresh(t, srv, login.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, _ = refresh(t, srv, other.RefreshToken)
+	assert.Equal(t, http.StatusOK, status)
+
+	// A logout with the access token revokes it, the other tokens keep working
+	resp = doJSON(t, http.MethodPost, srv.URL+"/api/user/logout", other.Token, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = doJSON(t, http.MethodGet, url, other.Token, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp = doJSON(t, http.MethodGet, url, login.Token, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Unknown tokens are rejected
+	status, _ = refresh(t, srv, "unknown")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	resp = doJSON(t, http.MethodPost, srv.URL+"/api/user/logout", "", map[string]string{"refresh_token": "unknown"})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp = doJSON(t, http.MethodPost, srv.URL+"/api/user/logout", "", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestServer_PasswordChange(t *testing.T) {
+	withoutAuthRateLimit(t)
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	ivanID, ivanToken := registerAndLogin(t, srv, "ivan", string(hash))
+	_, judyToken := registerAndLogin(t, srv, "judy", string(hash))
+
+	laptop := map[string]string{"username": "ivan", "password": string(hash), "device_id": "laptop"}
+	resp := doJSON(t, http.MethodPost, srv.URL+"/login", "", laptop)
+	var session tokens
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&session))
+	resp.Body.Close()
+
+	change := func(token string, body map[string]string) int {
+		resp := doJSON(t, http.MethodPost, srv.URL+"/api/user/password", token, body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// A wrong current password, an unknown account and the account of another user all fail alike
+	assert.Equal(t, http.StatusUnauthorized, change("", map[string]string{"username": "ivan", "current_password": "password123", "new_password": "new-secret"}))
+	assert.Equal(t, http.StatusUnauthorized, change(ivanToken, map[string]string{"username": "ivan", "current_password": "wrong", "new_password": "new-secret"}))
+	assert.Equal(t, http.StatusUnauthorized, change(ivanToken, map[string]string{"username": "nobody", "current_password": "password123", "new_password": "new-secret"}))
+	assert.Equal(t, http.StatusUnauthorized, change(judyToken, map[string]string{"username": "ivan", "current_password": "password123", "new_password": "new-secret"}))
+	assert.Equal(t, http.StatusBadRequest, change(ivanToken, map[string]string{"username": "ivan", "current_password": "password123"}))
+	status, _ := refresh(t, srv, session.RefreshToken)
+	require.Equal(t, http.StatusOK, status)
+
+	// The tokens are issued at a whole second, the ones issued before the second of the change end with it
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+
+	// The change returns a new session for the device changing it and ends the others
+	resp = doJSON(t, http.MethodPost, srv.URL+"/api/user/password", ivanToken,
+		map[string]string{"username": "ivan", "current_password": "password123", "new_password": "new-secret", "device_id": "phone"})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var changed tokens
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&changed))
+	resp.Body.Close()
+	assert.Equal(t, ivanID, changed.UserID)
+	assert.Equal(t, "phone", changed.DeviceID)
+
+	status, _ = refresh(t, srv, changed.RefreshToken)
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = refresh(t, srv, session.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// The access tokens issued before the change are rejected too, the one of judy isn't
+	logins := func(token string) int {
+		resp := doJSON(t, http.MethodGet, srv.URL+"/api/user/logins", token, nil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusUnauthorized, logins(ivanToken))
+	assert.Equal(t, http.StatusUnauthorized, logins(session.Token))
+	assert.Equal(t, http.StatusOK, logins(changed.Token))
+	assert.Equal(t, http.StatusOK, logins(judyToken))
+
+	// Only the new password logs in
+	resp = doJSON(t, http.MethodPost, srv.URL+"/login", "", map[string]string{"username": "ivan", "password": string(hash)})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp = doJSON(t, http.MethodPost, srv.URL+"/login", "", map[string]string{"username": "ivan", "password": "new-secret"})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The attempts are in the audit log of the user of the token, the one of judy in hers
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/audit", changed.Token, nil)
+	var events []models.AuditEvent
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&events))
+	resp.Body.Close()
+	var changes []bool
+	for _, ev := range events {
+		if ev.Action == models.AuditPasswordChange {
+			changes = append(changes, ev.Success)
+		}
+	}
+	assert.Equal(t, []bool{true, false, false}, changes)
+}
+
+func TestServer_PasswordPolicy(t *testing.T) {
+	// The hashes of the legacy clients are rejected unless the server accepts them
+	require.NoError(t, flag.Set("legacy-hashed-passwords", "false"))
+	t.Cleanup(func() { flag.Set("legacy-hashed-passwords", "true") })
+	srv := newTestServer(t)
+
+	// weak returns the status and the rules of the policy broken by a rejected password
+	weak := func(resp *http.Response) (int, []string) {
+		defer resp.Body.Close()
+		var body struct {
+			Violations []models.PolicyViolation `json:"violations"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		var rules []string
+		for _, v := range body.Violations {
+			rules = append(rules, v.Rule)
+		}
+		return resp.StatusCode, rules
+	}
+
+	// A plain password breaking the policy isn't registered, the response lists the rules it breaks
+	status, rules := weak(doJSON(t, http.MethodPost, srv.URL+"/register", "", map[string]string{"username": "mallory", "password": "1234"}))
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, []string{"min_length", "breached"}, rules)
+	status, rules = weak(doJSON(t, http.MethodPost, srv.URL+"/register", "", map[string]string{"username": "mallory", "password": "mallory-rules"}))
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, []string{"contains_username"}, rules)
+
+	// A hash sent instead of the password can't be checked, it isn't registered
+	hash, err := bcrypt.GenerateFromPassword([]byte("a"), bcrypt.MinCost)
+	require.NoError(t, err)
+	status, rules = weak(doJSON(t, http.MethodPost, srv.URL+"/register", "", map[string]string{"username": "mallory", "password": string(hash)}))
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, []string{"hashed"}, rules)
+
+	// A plain password following it is hashed before it is stored, and logs in
+	resp := doJSON(t, http.MethodPost, srv.URL+"/register", "", map[string]string{"username": "mallory", "password": "correct horse battery"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = doJSON(t, http.MethodPost, srv.URL+"/login", "", map[string]string{"username": "mallory", "password": "correct horse battery"})
+	var session tokens
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&session))
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The new password of a change follows the policy as well
+	status, rules = weak(doJSON(t, http.MethodPost, srv.URL+"/api/user/password", session.Token,
+		map[string]string{"username": "mallory", "current_password": "correct horse battery", "new_password": "qwerty123"}))
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, []string{"breached"}, rules)
+	status, rules = weak(doJSON(t, http.MethodPost, srv.URL+"/api/user/password", session.Token,
+		map[string]string{"username": "mallory", "current_password": "correct horse battery", "new_password": string(hash)}))
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, []string{"hashed"}, rules)
+
+	resp = doJSON(t, http.MethodPost, srv.URL+"/login", "", map[string]string{"username": "mallory", "password": "correct horse battery"})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestServer_UsernamePolicy(t *testing.T) {
+	withoutAuthRateLimit(t)
+	option := config.NewOptions()
+	option.ParseFlags()
+	nLogger, err := logger.NewLogger(option.LogLevel())
+	require.NoError(t, err)
+	keeper := storage.NewMemKeeper()
+	srv := httptest.NewServer(newRouter(keeper, option, nLogger, nil, nil, newHealthState(time.Minute), nil, nil, nil, nil))
+	t.Cleanup(srv.Close)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	// rejected returns the status and the code of a rejected registration
+	rejected := func(username string) (int, string) {
+		resp := doJSON(t, http.MethodPost, srv.URL+"/register", "", map[string]string{"username": username, "password": string(hash)})
+		defer resp.Body.Close()
+		var body struct {
+			Code string `json:"code"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body.Code
+	}
+
+	// The reserved usernames and their lookalikes aren't registered
+	for _, username := range []string{"admin", "_Support_", "rооt"} {
+		status, code := rejected(username)
+		assert.Equal(t, http.StatusBadRequest, status, username)
+		assert.Equal(t, models.RuleUsernameReserved, code, username)
+	}
+	status, code := rejected("--")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, models.RuleUsernameInvalid, code)
+
+	// Nor the lookalikes of the usernames taken
+	adminID, _ := registerAndLogin(t, srv, "sybil", string(hash))
+	status, code = rejected("SYB1L")
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Equal(t, models.RuleUsernameTaken, code)
+
+	// The users registered before the policy keep their username, the admins find them in the report
+	ctx := context.Background()
+	require.NoError(t, keeper.AddUser(ctx, "root", string(hash)))
+	require.NoError(t, keeper.AddUser(ctx, "sybi1", string(hash)))
+	require.NoError(t, keeper.SetUserRole(ctx, adminID, models.RoleAdmin))
+	adminToken := loginAs(t, srv, "sybil", string(hash))
+
+	var report struct {
+		Users []struct {
+			Username string `json:"username"`
+			Rule     string `json:"rule"`
+		} `json:"users"`
+	}
+	resp := doJSON(t, http.MethodGet, srv.URL+"/api/admin/users/flagged", adminToken, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	resp.Body.Close()
+	require.Len(t, report.Users, 2)
+	assert.Equal(t, "root", report.Users[0].Username)
+	assert.Equal(t, models.RuleUsernameReserved, report.Users[0].Rule)
+	assert.Equal(t, "sybi1", report.Users[1].Username)
+	assert.Equal(t, models.RuleUsernameTaken, report.Users[1].Rule)
+}
+
+func TestServer_UsernameChecker(t *testing.T) {
+	withoutAuthRateLimit(t)
+	checker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(checker.Close)
+
+	option := config.NewOptions()
+	option.ParseFlags()
+	require.NoError(t, flag.Set("username-checker-url", checker.URL))
+	t.Cleanup(func() {
+		flag.Set("username-checker-url", "")
+		flag.Set("username-checker-fail-closed", "false")
+	})
+	nLogger, err := logger.NewLogger(option.LogLevel())
+	require.NoError(t, err)
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	register := func(srv *httptest.Server, username string) (int, string) {
+		return readResponse(t, doJSON(t, http.MethodPost, srv.URL+"/register", "",
+			map[string]string{"username": username, "password": string(hash)}))
+	}
+
+	// A failed checker lets the usernames through by default
+	srv := httptest.NewServer(newRouter(storage.NewMemKeeper(), option, nLogger, nil, nil, newHealthState(time.Minute), nil, nil, nil, nil))
+	t.Cleanup(srv.Close)
+	status, _ := register(srv, "trent")
+	assert.Equal(t, http.StatusOK, status)
+
+	// A policy failing closed rejects them until the checker is back
+	require.NoError(t, flag.Set("username-checker-fail-closed", "true"))
+	closed := httptest.NewServer(newRouter(storage.NewMemKeeper(), option, nLogger, nil, nil, newHealthState(time.Minute), nil, nil, nil, nil))
+	t.Cleanup(closed.Close)
+	status, body := register(closed, "trent")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Contains(t, body, models.RuleUsernameUnchecked)
+}
+
+func TestServer_LoginHistory(t *testing.T) {
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	credentials := map[string]string{"username": "niaj", "password": string(hash)}
+	resp := doJSON(t, http.MethodPost, srv.URL+"/register", "", credentials)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, otherToken := registerAndLogin(t, srv, "olivia", string(hash))
+
+	// A failed and a successful login are both in the history, from the client which made them
+	resp = doJSON(t, http.MethodPost, srv.URL+"/login", "", map[string]string{"username": "niaj", "password": "wrong"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp = doJSON(t, http.MethodPost, srv.URL+"/login", "", credentials)
+	var session tokens
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&session))
+	resp.Body.Close()
+
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/user/logins", session.Token, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var logins []models.LoginEvent
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&logins))
+	resp.Body.Close()
+	require.Len(t, logins, 2)
+	assert.True(t, logins[0].Success)
+	assert.False(t, logins[1].Success)
+	assert.Equal(t, "127.0.0.1", logins[0].IP)
+	assert.Equal(t, "Go-http-client/1.1", logins[0].UserAgent)
+
+	// Every user only sees their own history, an anonymous request none
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/user/logins", otherToken, nil)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&logins))
+	resp.Body.Close()
+	assert.Len(t, logins, 1)
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/user/logins", "", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestServer_AdminUsers(t *testing.T) {
+	option := config.NewOptions()
+	option.ParseFlags()
+	nLogger, err := logger.NewLogger(option.LogLevel())
+	require.NoError(t, err)
+	keeper := storage.NewMemKeeper()
+	srv := httptest.NewServer(newRouter(keeper, option, nLogger, nil, nil, newHealthState(time.Minute), nil, nil, nil, nil))
+	t.Cleanup(srv.Close)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	adminID, userToken := registerAndLogin(t, srv, "peggy", string(hash))
+	userID, token := registerAndLogin(t, srv, "quentin", string(hash))
+	otherID, _ := registerAndLogin(t, srv, "rupert", string(hash))
+	resp := doJSON(t, http.MethodPost, srv.URL+"/addData/UserCredentials/"+strconv.Itoa(userID), token,
+		map[string]string{"login": "quentin", "password": "secret"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The admin endpoints need the role, and a token issued with it
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/admin/users", userToken, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.NoError(t, keeper.SetUserRole(context.Background(), adminID, models.RoleAdmin))
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/admin/users", userToken, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	adminToken := loginAs(t, srv, "peggy", string(hash))
+
+	// The users are paged by id, with their usage and last login
+	var page struct {
+		Users []models.UserSummary `json:"users"`
+		Next  *int                 `json:"next"`
+	}
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/admin/users?limit=2", adminToken, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&page))
+	resp.Body.Close()
+	require.Len(t, page.Users, 2)
+	assert.Equal(t, models.RoleAdmin, page.Users[0].Role)
+	assert.Equal(t, "quentin", page.Users[1].Username)
+	assert.Equal(t, 1, page.Users[1].Entries)
+	assert.Positive(t, page.Users[1].Bytes)
+	assert.NotNil(t, page.Users[1].LastLoginAt)
+	require.NotNil(t, page.Next)
+	resp = doJSON(t, http.MethodGet, fmt.Sprintf("%s/api/admin/users?limit=2&after=%d", srv.URL, *page.Next), adminToken, nil)
+	page.Next = nil
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&page))
+	resp.Body.Close()
+	require.Len(t, page.Users, 1)
+	assert.Equal(t, otherID, page.Users[0].ID)
+	assert.Nil(t, page.Next)
+
+	// The memory keeper doesn't encrypt, so no key rotation is in progress
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/admin/jobs/rotation", token, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/admin/jobs/rotation", adminToken, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// A disabled user is rejected at once, at login and at refresh too, until they are enabled again
+	url := fmt.Sprintf("%s/api/admin/users/%d", srv.URL, userID)
+	resp = doJSON(t, http.MethodPost, url+"/disable", adminToken, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/user/logins", token, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	credentials := map[string]string{"username": "quentin", "password": string(hash)}
+	resp = doJSON(t, http.MethodPost, srv.URL+"/login", "", credentials)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = doJSON(t, http.MethodPost, url+"/enable", adminToken, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = doJSON(t, http.MethodPost, srv.URL+"/login", "", credentials)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The admin can't lock themselves out, unknown users aren't found
+	resp = doJSON(t, http.MethodPost, fmt.Sprintf("%s/api/admin/users/%d/disable", srv.URL, adminID), adminToken, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = doJSON(t, http.MethodDelete, fmt.Sprintf("%s/api/admin/users/%d", srv.URL, adminID), adminToken, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = doJSON(t, http.MethodPost, srv.URL+"/api/admin/users/999/disable", adminToken, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// A deleted user is gone with their entries, the actions are audited for the admin
+	resp = doJSON(t, http.MethodDelete, url, adminToken, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = doJSON(t, http.MethodPost, srv.URL+"/login", "", credentials)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp = doJSON(t, http.MethodDelete, url, adminToken, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/audit", adminToken, nil)
+	var events []models.AuditEvent
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&events))
+	resp.Body.Close()
+	var actions []models.AuditAction
+	for _, ev := range events {
+		if ev.EntryID == strconv.Itoa(userID) {
+			actions = append(actions, ev.Action)
+		}
+	}
+	assert.Equal(t, []models.AuditAction{models.AuditDeleteUser, models.AuditEnableUser, models.AuditDisableUser}, actions)
+}
+
+// loginAs logs a registered user in and returns their new token.
+func loginAs(t *testing.T, srv *httptest.Server, username, hash string) string {
+	resp := doJSON(t, http.MethodPost, srv.URL+"/login", "", map[string]string{"username": username, "password": hash})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var login tokens
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&login))
+	resp.Body.Close()
+
+	return login.Token
+}
+
+func TestServer_ProtocolHandshake(t *testing.T) {
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	credentials := map[string]string{"username": "sybil", "password": string(hash)}
+	resp := doJSON(t, http.MethodPost, srv.URL+"/register", "", credentials)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The login tells the versions the server speaks, every response the version negotiated
+	b, err := json.Marshal(credentials)
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/login", bytes.NewReader(b))
+	require.NoError(t, err)
+	req.Header.Set(middleware.ProtocolHeader, "1-4")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get(middleware.ProtocolHeader))
+	var login struct {
+		RefreshToken string               `json:"refresh_token"`
+		Protocol     models.ProtocolRange `json:"protocol"`
+		Capabilities []string             `json:"capabilities"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&login))
+	resp.Body.Close()
+	assert.Equal(t, models.ServerProtocol, login.Protocol)
+	assert.Equal(t, models.ServerCapabilities, login.Capabilities)
+
+	resp = doJSON(t, http.MethodPost, srv.URL+"/api/user/refresh", "", map[string]string{"refresh_token": login.RefreshToken})
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&login))
+	resp.Body.Close()
+	assert.Equal(t, models.ServerProtocol, login.Protocol)
+
+	// A client speaking only newer versions is told the server is too old
+	req, err = http.NewRequest(http.MethodPost, srv.URL+"/login", bytes.NewReader(b))
+	require.NoError(t, err)
+	req.Header.Set(middleware.ProtocolHeader, "2-3")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusUpgradeRequired, resp.StatusCode)
+	var mismatch middleware.ProtocolMismatch
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&mismatch))
+	resp.Body.Close()
+	assert.Equal(t, middleware.OutdatedServer, mismatch.Outdated)
+	assert.Equal(t, models.ProtocolRange{Min: 2, Max: 3}, mismatch.Client)
+}
+
+func TestServer_APIKeys(t *testing.T) {
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	userID, token := registerAndLogin(t, srv, "trent", string(hash))
+	url := srv.URL + "/api/user/apikeys"
+
+	// Keys only read and write, a key writing entries also reads them
+	resp := doJSON(t, http.MethodPost, url, token, map[string]any{"label": "backup", "scopes": []string{"session"}})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	createKey := func(scopes ...string) (int, string) {
+		resp := doJSON(t, http.MethodPost, url, token, map[string]any{"label": "backup", "scopes": scopes})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var created struct {
+			models.APIKey
+			Key string `json:"key"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+		resp.Body.Close()
+		return created.ID, "ApiKey " + created.Key
+	}
+	readID, readKey := createKey(models.ScopeRead)
+	_, writeKey := createKey(models.ScopeWrite)
+
+	// The list never shows the keys themselves
+	resp = doJSON(t, http.MethodGet, url, token, nil)
+	_, body := readResponse(t, resp)
+	assert.Contains(t, body, `"scopes":["read","write"]`)
+	assert.NotContains(t, body, `"key"`)
+
+	entries := fmt.Sprintf("%s/getAllData/UserCredentials/%d/0001-01-01T00:00:00Z", srv.URL, userID)
+	add := srv.URL + "/addData/UserCredentials/" + strconv.Itoa(userID)
+	entry := map[string]string{"login": "trent", "password": "secret"}
+	resp = doJSON(t, http.MethodPost, add, readKey, entry)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = doJSON(t, http.MethodPost, add, writeKey, entry)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = doJSON(t, http.MethodGet, entries, readKey, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The account is managed in a session, not with a key
+	resp = doJSON(t, http.MethodGet, url, writeKey, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = doJSON(t, http.MethodPost, srv.URL+"/api/user/password", writeKey,
+		map[string]string{"username": "trent", "current_password": string(hash), "new_password": "Another-password-42"})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// A revoked key is rejected from its next request on
+	resp = doJSON(t, http.MethodDelete, fmt.Sprintf("%s/%d", url, readID), token, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = doJSON(t, http.MethodGet, entries, readKey, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp = doJSON(t, http.MethodDelete, fmt.Sprintf("%s/%d", url, readID), token, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestServer_Ping(t *testing.T) {
+	srv := newTestServer(t)
+
+	resp := doJSON(t, http.MethodGet, srv.URL+"/ping", "", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+// probedKeeper counts the pings of the keeper and the lookups of the monitor tokens.
+type probedKeeper struct {
+	storage.Keeper
+	pings   atomic.Int32
+	lookups atomic.Int32
+}
+
+func (k *probedKeeper) Ping() bool {
+	k.pings.Add(1)
+	return k.Keeper.Ping()
+}
+
+func (k *probedKeeper) GetMonitorTokenByHash(ctx context.Context, hash string) (models.MonitorToken, error) {
+	k.lookups.Add(1)
+	return k.Keeper.GetMonitorTokenByHash(ctx, hash)
+}
+
+func TestServer_MonitorPing(t *testing.T) {
+	require.NoError(t, flag.Set("monitor-rate-limit", "3"))
+	t.Cleanup(func() { flag.Set("monitor-rate-limit", "60") })
+	option := config.NewOptions()
+	option.ParseFlags()
+	nLogger, err := logger.NewLogger(option.LogLevel())
+	require.NoError(t, err)
+	memKeeper := storage.NewMemKeeper()
+	keeper := &probedKeeper{Keeper: memKeeper}
+	health := newHealthState(time.Minute)
+	health.record(true)
+	srv := httptest.NewServer(newRouter(keeper, option, nLogger, nil, nil, health, nil, nil, nil, nil))
+	t.Cleanup(srv.Close)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	adminID, userToken := registerAndLogin(t, srv, "victor", string(hash))
+	url := srv.URL + "/api/admin/monitors"
+
+	// The tokens are managed by the admins
+	resp := doJSON(t, http.MethodPost, url, userToken, map[string]string{"name": "status page"})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.NoError(t, memKeeper.SetUserRole(context.Background(), adminID, models.RoleAdmin))
+	adminToken := loginAs(t, srv, "victor", string(hash))
+	resp = doJSON(t, http.MethodPost, url, adminToken, map[string]string{"name": " "})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	createToken := func(name string) (int, string) {
+		resp := doJSON(t, http.MethodPost, url, adminToken, map[string]string{"name": name})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var created struct {
+			models.MonitorToken
+			Token string `json:"token"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+		resp.Body.Close()
+		return created.ID, "Bearer " + created.Token
+	}
+	statusID, statusToken := createToken("status page")
+	_, pagerToken := createToken("pager")
+
+	// A ping needs a monitor token, neither a session nor nothing
+	ping := func(token string) (int, string) {
+		return readResponse(t, doJSON(t, http.MethodGet, srv.URL+"/api/monitor/ping", token, nil))
+	}
+	code, _ := ping("")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = ping(adminToken)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = ping("Bearer gkm_unknown")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	// The ping serves the state of the last check, only its status, and the token isn't looked up again
+	lookups := keeper.lookups.Load()
+	code, body := ping(statusToken)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok\n", body)
+	health.record(false)
+	code, body = ping(statusToken)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unavailable\n", body)
+	assert.Equal(t, lookups+1, keeper.lookups.Load())
+	assert.Zero(t, keeper.pings.Load())
+
+	// The pings of a token are limited, those of the other tokens aren't
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/monitor/ping", statusToken, nil)
+	resp.Body.Close()
+	require.NotEqual(t, http.StatusTooManyRequests, resp.StatusCode)
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/monitor/ping", statusToken, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+	code, _ = ping(pagerToken)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	// The admins see when every monitor last pinged
+	var tokens []models.MonitorToken
+	resp = doJSON(t, http.MethodGet, url, adminToken, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&tokens))
+	resp.Body.Close()
+	require.Len(t, tokens, 2)
+	assert.Equal(t, "status page", tokens[0].Name)
+	require.NotNil(t, tokens[0].LastUsedAt)
+
+	// A revoked token is rejected from its next ping on
+	resp = doJSON(t, http.MethodDelete, fmt.Sprintf("%s/%d", url, statusID), adminToken, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	code, _ = ping(statusToken)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	resp = doJSON(t, http.MethodDelete, fmt.Sprintf("%s/%d", url, statusID), adminToken, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestHealthState(t *testing.T) {
+	now := time.Now()
+	health := newHealthState(10 * time.Second)
+	health.now = func() time.Time { return now }
+
+	// The state is stale until the first check and once the checks stop for three intervals
+	up, status := health.Status()
+	assert.False(t, up)
+	assert.Equal(t, healthStale, status)
+
+	health.record(true)
+	now = now.Add(30 * time.Second)
+	up, status = health.Status()
+	assert.True(t, up)
+	assert.Equal(t, healthOK, status)
+	now = now.Add(time.Millisecond)
+	up, status = health.Status()
+	assert.False(t, up)
+	assert.Equal(t, healthStale, status)
+
+	health.record(false)
+	up, status = health.Status()
+	assert.False(t, up)
+	assert.Equal(t, healthUnavailable, status)
+}
+
+func TestRunHealthCheck(t *testing.T) {
+	keeper := &probedKeeper{Keeper: storage.NewMemKeeper()}
+	health := newHealthState(10 * time.Millisecond)
+	nLogger, err := logger.NewLogger("info")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runHealthCheck(ctx, keeper, health, 10*time.Millisecond, nLogger)
+		close(done)
+	}()
+
+	// The keeper is checked at once, then every interval
+	require.Eventually(t, func() bool { return keeper.pings.Load() >= 3 }, time.Second, time.Millisecond)
+	up, status := health.Status()
+	assert.True(t, up)
+	assert.Equal(t, healthOK, status)
+
+	cancel()
+	<-done
+}
+
+func TestServer_Restore(t *testing.T) {
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	credentials := map[string]string{"username": "carol", "password": string(hash)}
+
+	resp := doJSON(t, http.MethodPost, srv.URL+"/register", "", credentials)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doJSON(t, http.MethodPost, srv.URL+"/login", "", credentials)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var login struct {
+		UserID int    `json:"userID"`
+		Token  string `json:"token"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&login))
+	resp.Body.Close()
+
+	url := fmt.Sprintf("%s/addData/UserCredentials/%d/%s", srv.URL, login.UserID, entry1ID)
+	resp = doJSON(t, http.MethodPost, url, login.Token, map[string]string{"login": "carol"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	url = fmt.Sprintf("%s/deleteData/UserCredentials/%d/%s", srv.URL, login.UserID, entry1ID)
+	resp = doJSON(t, http.MethodDelete, url, login.Token, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The state before the delete is kept in the history
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/UserCredentials/"+entry1ID+"/history?limit=5", login.Token, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var versions []struct {
+		Snapshot map[string]string `json:"snapshot"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&versions))
+	resp.Body.Close()
+
+	require.Len(t, versions, 1)
+	assert.Equal(t, "carol", versions[0].Snapshot["login"])
+
+	resp = doJSON(t, http.MethodPost, srv.URL+"/api/UserCredentials/"+entry1ID+"/restore", "", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = doJSON(t, http.MethodPost, srv.URL+"/api/UserCredentials/"+missingID+"/restore", login.Token, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = doJSON(t, http.MethodPost, srv.URL+"/api/UserCredentials/"+entry1ID+"/restore", login.Token, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	url = fmt.Sprintf("%s/getAllData/UserCredentials/%d/0001-01-01T00:00:00Z", srv.URL, login.UserID)
+	resp = doJSON(t, http.MethodGet, url, login.Token, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var data []map[string]string
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&data))
+	resp.Body.Close()
+
+	require.Len(t, data, 1)
+	assert.Equal(t, "false", data[0]["deleted"])
+}
+
+func TestServer_HistoryDiff(t *testing.T) {
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	userID, token := registerAndLogin(t, srv, "vera", string(hash))
+
+	url := fmt.Sprintf("%s/addData/TextData/%d/%s", srv.URL, userID, entry1ID)
+	resp := doJSON(t, http.MethodPost, url, token, map[string]string{"data": "sealed", "meta_info": "groceries", "preview": "Milk"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// A metadata edit, a payload edit, then a delete and a restore
+	url = fmt.Sprintf("%s/updateData/TextData/%d/%s", srv.URL, userID, entry1ID)
+	for _, fields := range []map[string]string{{"meta_info": "shopping", "preview": "Bread"}, {"data": "resealed"}} {
+		resp = doJSON(t, http.MethodPut, url, token, fields)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	resp = doJSON(t, http.MethodDelete, fmt.Sprintf("%s/deleteData/TextData/%d/%s", srv.URL, userID, entry1ID), token, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = doJSON(t, http.MethodPost, srv.URL+"/api/TextData/"+entry1ID+"/restore", token, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	history := func() []models.EntryVersion {
+		resp := doJSON(t, http.MethodGet, srv.URL+"/api/TextData/"+entry1ID+"/history", token, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var versions []models.EntryVersion
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&versions))
+		resp.Body.Close()
+		require.Len(t, versions, 4)
+		return versions
+	}
+	value := func(s string) *string { return &s }
+
+	// Every version has the change made to it, newest first: the restore brings the entry back
+	// to its state before the delete, the payload only shows it changed
+	versions := history()
+	assert.Equal(t, []models.FieldChange{{Field: "deleted", Old: value("true"), New: value("false")}}, versions[0].Changes)
+	assert.Equal(t, []models.FieldChange{{Field: "deleted", Old: value("false"), New: value("true")}}, versions[1].Changes)
+	assert.Equal(t, []models.FieldChange{{Field: "data", Redacted: true}}, versions[2].Changes)
+	assert.Equal(t, []models.FieldChange{
+		{Field: "meta_info", Old: value("groceries"), New: value("shopping")},
+		{Field: models.PreviewField, Old: value("Milk"), New: value("Bread")},
+	}, versions[3].Changes)
+	assert.Equal(t, history(), versions)
+
+	// A server storing no plaintext metadata doesn't show the previews either
+	require.NoError(t, flag.Set("plaintext-previews", "false"))
+	t.Cleanup(func() { flag.Set("plaintext-previews", "true") })
+
+	versions = history()
+	assert.Equal(t, []models.FieldChange{
+		{Field: "meta_info", Old: value("groceries"), New: value("shopping")},
+		{Field: models.PreviewField, Redacted: true},
+	}, versions[3].Changes)
+}
+
+func TestServer_Search(t *testing.T) {
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	credentials := map[string]string{"username": "dave", "password": string(hash)}
+
+	resp := doJSON(t, http.MethodPost, srv.URL+"/register", "", credentials)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doJSON(t, http.MethodPost, srv.URL+"/login", "", credentials)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var login struct {
+		UserID int    `json:"userID"`
+		Token  string `json:"token"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&login))
+	resp.Body.Close()
+
+	url := fmt.Sprintf("%s/addData/UserCredentials/%d/%s", srv.URL, login.UserID, entry1ID)
+	resp = doJSON(t, http.MethodPost, url, login.Token, map[string]string{"login": "dave", "meta_info": "wifi for the cabin"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/search?q=cabin", "", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/search", login.Token, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/search?q=cabin+wifi&table=UserCredentials", login.Token, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var results map[string][]map[string]string
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&results))
+	resp.Body.Close()
+
+	require.Len(t, results["UserCredentials"], 1)
+	assert.Equal(t, entry1ID, results["UserCredentials"][0]["id"])
+}
+
+func TestServer_PendingData(t *testing.T) {
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	userID, token := registerAndLogin(t, srv, "grace", string(hash))
+
+	url := fmt.Sprintf("%s/addData/UserCredentials/%d/%s", srv.URL, userID, entry1ID)
+	resp := doJSON(t, http.MethodPost, url, token, map[string]string{"login": "grace", "password": "s3cret"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/data/pending", "", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/data/pending?cursor=yesterday", token, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// The estimate of a full download has the sizes but none of the data
+	status, body := readResponse(t, doJSON(t, http.MethodGet, srv.URL+"/api/data/pending", token, nil))
+	require.Equal(t, http.StatusOK, status)
+	assert.NotContains(t, body, "s3cret")
+
+	var pending struct {
+		models.PendingSize
+		Tables map[string]models.PendingSize `json:"tables"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &pending))
+	assert.Equal(t, 1, pending.Entries)
+	assert.Positive(t, pending.Bytes)
+	assert.Equal(t, pending.PendingSize, pending.Tables["UserCredentials"])
+	assert.Zero(t, pending.Tables["TextData"])
+
+	// Nothing is pending after a later cursor
+	cursor := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/data/pending?cursor="+cursor, token, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&pending))
+	resp.Body.Close()
+	assert.Zero(t, pending.Entries)
+}
+
+// brokenTableKeeper fails the reads of a table as a corrupted table would, the other tables being fine.
+// No table fails if table is empty.
+type brokenTableKeeper struct {
+	storage.Keeper
+	table string
+}
+
+var errBrokenTable = errors.New("database disk image is malformed")
+
+func (k *brokenTableKeeper) SearchData(ctx context.Context, userID int, query string, tables []string, limit int, partial bool) (map[string][]map[string]string, error) {
+	results, err := k.Keeper.SearchData(ctx, userID, query, tables, limit, partial)
+	if err != nil || k.table == "" {
+		return results, err
+	}
+	if !partial {
+		return nil, errBrokenTable
+	}
+	delete(results, k.table)
+
+	return results, &models.PartialError{Tables: map[string]error{k.table: errBrokenTable}}
+}
+
+func (k *brokenTableKeeper) PendingData(ctx context.Context, userID int, since time.Time, partial bool) (map[string]models.PendingSize, error) {
+	pending, err := k.Keeper.PendingData(ctx, userID, since, partial)
+	if err != nil || k.table == "" {
+		return pending, err
+	}
+	if !partial {
+		return nil, errBrokenTable
+	}
+	delete(pending, k.table)
+
+	return pending, &models.PartialError{Tables: map[string]error{k.table: errBrokenTable}}
+}
+
+func TestServer_PartialResults(t *testing.T) {
+	option := config.NewOptions()
+	option.ParseFlags()
+	nLogger, err := logger.NewLogger(option.LogLevel())
+	require.NoError(t, err)
+	keeper := &brokenTableKeeper{Keeper: storage.NewMemKeeper(), table: "TextData"}
+	srv := httptest.NewServer(newRouter(keeper, option, nLogger, nil, nil, newHealthState(time.Minute), nil, nil, nil, nil))
+	t.Cleanup(srv.Close)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	userID, token := registerAndLogin(t, srv, "heidi", string(hash))
+
+	url := fmt.Sprintf("%s/addData/UserCredentials/%d/%s", srv.URL, userID, entry1ID)
+	resp := doJSON(t, http.MethodPost, url, token, map[string]string{"login": "heidi", "meta_info": "wifi"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Unless the client asks for the partial results, the broken table fails the whole read
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/search?q=wifi", token, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/data/pending", token, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+	// The other tables arrive with their status, the broken one with its error instead of data
+	var search struct {
+		Partial bool `json:"partial"`
+		Tables  map[string]struct {
+			Status models.TableStatus  `json:"status"`
+			Data   []map[string]string `json:"data"`
+			Error  *models.TableError  `json:"error"`
+		} `json:"tables"`
+	}
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/search?q=wifi&partial=true", token, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&search))
+	resp.Body.Close()
+
+	assert.True(t, search.Partial)
+	assert.Len(t, search.Tables, len(models.DataTables))
+	assert.Equal(t, models.TableOK, search.Tables["UserCredentials"].Status)
+	require.Len(t, search.Tables["UserCredentials"].Data, 1)
+	assert.Equal(t, entry1ID, search.Tables["UserCredentials"].Data[0]["id"])
+	assert.Equal(t, models.TableOK, search.Tables["CreditCardData"].Status)
+	assert.NotNil(t, search.Tables["CreditCardData"].Data)
+	assert.Nil(t, search.Tables["CreditCardData"].Error)
+	assert.Equal(t, models.TableFailed, search.Tables["TextData"].Status)
+	assert.Nil(t, search.Tables["TextData"].Data)
+	require.NotNil(t, search.Tables["TextData"].Error)
+	assert.Equal(t, errBrokenTable.Error(), search.Tables["TextData"].Error.Message)
+
+	var pending struct {
+		models.PendingSize
+		Partial bool `json:"partial"`
+		Tables  map[string]struct {
+			Status models.TableStatus  `json:"status"`
+			Data   *models.PendingSize `json:"data"`
+			Error  *models.TableError  `json:"error"`
+		} `json:"tables"`
+	}
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/data/pending?partial=true", token, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&pending))
+	resp.Body.Close()
+
+	assert.True(t, pending.Partial)
+	assert.Equal(t, 1, pending.Entries)
+	assert.Equal(t, models.TableOK, pending.Tables["UserCredentials"].Status)
+	require.NotNil(t, pending.Tables["UserCredentials"].Data)
+	assert.Equal(t, pending.PendingSize, *pending.Tables["UserCredentials"].Data)
+	assert.Equal(t, models.TableFailed, pending.Tables["TextData"].Status)
+	assert.Nil(t, pending.Tables["TextData"].Data)
+	assert.NotNil(t, pending.Tables["TextData"].Error)
+
+	// Without a failure the response isn't marked partial
+	keeper.table = ""
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/search?q=wifi&partial=true", token, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&search))
+	resp.Body.Close()
+	assert.False(t, search.Partial)
+}
+
+func TestServer_Tags(t *testing.T) {
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	credentials := map[string]string{"username": "erin", "password": string(hash)}
+
+	resp := doJSON(t, http.MethodPost, srv.URL+"/register", "", credentials)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doJSON(t, http.MethodPost, srv.URL+"/login", "", credentials)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var login struct {
+		UserID int    `json:"userID"`
+		Token  string `json:"token"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&login))
+	resp.Body.Close()
+
+	for id, tags := range map[string]string{entry1ID: "Work,banking", entry2ID: "home"} {
+		url := fmt.Sprintf("%s/addData/UserCredentials/%d/%s", srv.URL, login.UserID, id)
+		resp = doJSON(t, http.MethodPost, url, login.Token, map[string]string{"login": "erin", "tags": tags})
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// Empty tags are rejected
+	url := fmt.Sprintf("%s/addData/UserCredentials/%d/%s", srv.URL, login.UserID, entry3ID)
+	resp = doJSON(t, http.MethodPost, url, login.Token, map[string]string{"login": "erin", "tags": "work,"})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/UserCredentials?tag=work", "", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/Users?tag=work", login.Token, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/UserCredentials?tag=WORK", login.Token, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var data []map[string]string
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&data))
+	resp.Body.Close()
+
+	require.Len(t, data, 1)
+	assert.Equal(t, entry1ID, data[0]["id"])
+	assert.Equal(t, "work,banking", data[0]["tags"])
+	// The list is a light projection without the secrets
+	assert.NotContains(t, data[0], "login")
+
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/UserCredentials?tag=work&columns=login,meta_info", login.Token, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	data = nil
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&data))
+	resp.Body.Close()
+	require.Len(t, data, 1)
+	assert.Equal(t, "erin", data[0]["login"])
+	assert.NotContains(t, data[0], "tags")
+
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/UserCredentials?columns=no_such_column", login.Token, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/UserCredentials?sort=id&dir=desc", login.Token, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	data = nil
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&data))
+	resp.Body.Close()
+	require.Len(t, data, 2)
+	assert.Equal(t, entry2ID, data[0]["id"])
+	assert.Equal(t, entry1ID, data[1]["id"])
+
+	for _, query := range []string{"sort=id&dir=sideways", "sort=no_such_column", "dir=asc"} {
+		resp = doJSON(t, http.MethodGet, srv.URL+"/api/UserCredentials?"+query, login.Token, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+	}
+
+	url = fmt.Sprintf("%s/getData/UserCredentials/%d/%s", srv.URL, login.UserID, entry2ID)
+	resp = doJSON(t, http.MethodGet, url, login.Token, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var entry map[string]string
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&entry))
+	resp.Body.Close()
+	assert.Equal(t, "home", entry["tags"])
+	assert.Equal(t, "erin", entry["login"])
+
+	url = fmt.Sprintf("%s/getData/UserCredentials/%d/%s", srv.URL, login.UserID, missingID)
+	resp = doJSON(t, http.MethodGet, url, login.Token, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestServer_TagRename(t *testing.T) {
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	userID, token := registerAndLogin(t, srv, "victor", string(hash))
+	otherDevice := loginAs(t, srv, "victor", string(hash))
+
+	for id, tags := range map[string]string{entry1ID: "banks,work", entry2ID: "banking,banks", entry3ID: "home"} {
+		url := fmt.Sprintf("%s/addData/UserCredentials/%d/%s", srv.URL, userID, id)
+		resp := doJSON(t, http.MethodPost, url, token, map[string]string{"login": "victor", "tags": tags})
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// The other device synchronizes, its watermark is the latest updated_at it got
+	sync := func(lastSync string) []map[string]string {
+		url := fmt.Sprintf("%s/getAllData/UserCredentials/%d/%s", srv.URL, userID, lastSync)
+		resp := doJSON(t, http.MethodGet, url, otherDevice, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var data []map[string]string
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&data))
+		resp.Body.Close()
+		return data
+	}
+	var watermark time.Time
+	for _, row := range sync("0001-01-01T00:00:00Z") {
+		updatedAt, err := time.Parse(time.RFC3339Nano, row["updated_at"])
+		require.NoError(t, err)
+		if updatedAt.After(watermark) {
+			watermark = updatedAt
+		}
+	}
+
+	resp := doJSON(t, http.MethodPost, srv.URL+"/api/data/tags/rename", token, map[string]string{"from": "Banks", "to": "banking"})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var result struct {
+		Renamed int `json:"renamed"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	resp.Body.Close()
+	assert.Equal(t, 2, result.Renamed)
+
+	// Only the renamed entries are synchronized again, merged with the tag they already had
+	tags := make(map[string]string)
+	for _, row := range sync(watermark.Format(time.RFC3339Nano)) {
+		tags[row["id"]] = row["tags"]
+	}
+	assert.Equal(t, map[string]string{entry1ID: "banking,work", entry2ID: "banking"}, tags)
+
+	resp = doJSON(t, http.MethodPost, srv.URL+"/api/data/tags/rename", token, map[string]string{"from": "work", "to": ""})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = doJSON(t, http.MethodPost, srv.URL+"/api/data/tags/rename", "", map[string]string{"from": "work", "to": "job"})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestRunExpiry(t *testing.T) {
+	keeper := storage.NewMemKeeper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	require.NoError(t, keeper.AddUser(ctx, "frank", "hash"))
+	userID, err := keeper.GetUserID(ctx, "frank")
+	require.NoError(t, err)
+
+	_, _, err = keeper.AddData(ctx, "UserCredentials", userID, "code", map[string]string{
+		"login":      "frank",
+		"expires_at": time.Now().Add(-time.Minute).Format(time.RFC3339),
+	})
+	require.NoError(t, err)
+
+	nLogger, err := logger.NewLogger("info")
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		runExpiry(ctx, keeper, 10*time.Millisecond, false, nLogger)
+		close(done)
+	}()
+
+	// The expired entry becomes a tombstone
+	assert.Eventually(t, func() bool {
+		data, err := keeper.GetAllData(ctx, "UserCredentials", userID, models.DataQuery{InclDeleted: true, InclExpired: true})
+		return err == nil && len(data) == 1 && data[0]["deleted"] == "true"
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	<-done
+}
+
+func TestRunExpiry_DryRun(t *testing.T) {
+	keeper := storage.NewMemKeeper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	require.NoError(t, keeper.AddUser(ctx, "grace", "hash"))
+	userID, err := keeper.GetUserID(ctx, "grace")
+	require.NoError(t, err)
+
+	_, _, err = keeper.AddData(ctx, "UserCredentials", userID, "code", map[string]string{
+		"login":      "grace",
+		"expires_at": time.Now().Add(-time.Minute).Format(time.RFC3339),
+	})
+	require.NoError(t, err)
+	require.NoError(t, keeper.AddAuditEvent(ctx, models.AuditEvent{UserID: userID, Action: models.AuditLogin, Success: true}))
+
+	nLogger, err := logger.NewLogger("info")
+	require.NoError(t, err)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		runExpiry(ctx, keeper, 5*time.Millisecond, true, nLogger)
+		done <- struct{}{}
+	}()
+	go func() {
+		runAuditPruning(ctx, keeper, 5*time.Millisecond, time.Millisecond, true, nLogger)
+		done <- struct{}{}
+	}()
+
+	// Several runs later nothing is deleted
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+	<-done
+
+	data, err := keeper.GetAllData(context.Background(), "UserCredentials", userID, models.DataQuery{InclDeleted: true, InclExpired: true})
+	require.NoError(t, err)
+	require.Len(t, data, 1)
+	assert.Equal(t, "false", data[0]["deleted"])
+	// The addition and the login are still in the audit log
+	events, err := keeper.GetAuditEvents(context.Background(), userID, time.Time{}, 0)
+	require.NoError(t, err)
+	assert.Len(t, events, 2)
+}
+
+func TestParseDryRunJobs(t *testing.T) {
+	jobs, err := parseDryRunJobs(" expiry, audit_pruning ,")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{jobExpiry: true, jobAuditPruning: true}, jobs)
+
+	jobs, err = parseDryRunJobs("")
+	require.NoError(t, err)
+	assert.Empty(t, jobs)
+
+	// A misspelled job must not run for real
+	_, err = parseDryRunJobs("expiry,audit_prune")
+	assert.ErrorContains(t, err, "audit_prune")
+}
+
+func TestRunAuditPruning(t *testing.T) {
+	keeper := storage.NewMemKeeper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	require.NoError(t, keeper.AddAuditEvent(ctx, models.AuditEvent{UserID: 1, Action: models.AuditLogin, Success: true}))
+
+	nLogger, err := logger.NewLogger("info")
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		runAuditPruning(ctx, keeper, 10*time.Millisecond, time.Millisecond, false, nLogger)
+		close(done)
+	}()
+
+	// The event older than the retention is deleted
+	assert.Eventually(t, func() bool {
+		events, err := keeper.GetAuditEvents(ctx, 1, time.Time{}, 0)
+		return err == nil && len(events) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	<-done
+}
+
+func TestRunRevokedTokenPruning(t *testing.T) {
+	keeper := storage.NewMemKeeper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	require.NoError(t, keeper.RevokeToken(ctx, "expired", time.Now().Add(-time.Minute)))
+	require.NoError(t, keeper.RevokeToken(ctx, "live", time.Now().Add(time.Hour)))
+
+	nLogger, err := logger.NewLogger("info")
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		runRevokedTokenPruning(ctx, keeper, 10*time.Millisecond, nLogger)
+		close(done)
+	}()
+
+	// Only the revocation of the expired token is deleted
+	assert.Eventually(t, func() bool {
+		revoked, err := keeper.IsTokenRevoked(ctx, "expired")
+		return err == nil && !revoked
+	}, time.Second, 10*time.Millisecond)
+	revoked, err := keeper.IsTokenRevoked(ctx, "live")
+	require.NoError(t, err)
+	assert.True(t, revoked)
+
+	cancel()
+	<-done
+}
+
+func TestRunUploadPruning(t *testing.T) {
+	keeper := storage.NewMemKeeper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	staging := t.TempDir()
+	expired, err := keeper.CreateUploadSession(ctx, models.UploadSession{ID: "expired", UserID: 1, EntryID: entry1ID,
+		Size: 4, ExpiresAt: time.Now().Add(-time.Minute)})
+	require.NoError(t, err)
+	live, err := keeper.CreateUploadSession(ctx, models.UploadSession{ID: "live", UserID: 1, EntryID: entry2ID,
+		Size: 4, ExpiresAt: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	for _, id := range []string{expired.ID, live.ID, "orphan"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(staging, id), 0700))
+		require.NoError(t, os.WriteFile(filepath.Join(staging, id, "0"), []byte("scan"), 0600))
+	}
+	// The orphan was last written to before the ttl, a session expires within it
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(staging, "orphan"), old, old))
+
+	nLogger, err := logger.NewLogger("info")
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		runUploadPruning(ctx, keeper, staging, 10*time.Millisecond, time.Hour, nLogger)
+		close(done)
+	}()
+
+	// Only the chunks of the live session are kept
+	assert.Eventually(t, func() bool {
+		dirs, err := os.ReadDir(staging)
+		return err == nil && len(dirs) == 1 && dirs[0].Name() == live.ID
+	}, time.Second, 10*time.Millisecond)
+	_, err = keeper.GetUploadSession(ctx, 1, live.ID)
+	require.NoError(t, err)
+	pruned, err := keeper.PruneUploadSessions(ctx, time.Now())
+	require.NoError(t, err)
+	assert.Empty(t, pruned)
+
+	cancel()
+	<-done
+}
+
+func TestRunBlobReconciliation(t *testing.T) {
+	keeper := storage.NewMemKeeper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	blobs, err := objstore.NewFS(dir)
+	require.NoError(t, err)
+	referenced := models.FileBlob{Key: controllers.FileBlobPrefix + entry1ID + "/b1", Size: 4}
+	_, _, err = keeper.WriteFileBlob(ctx, 1, entry1ID, map[string]string{"path": "scan.pdf"}, referenced)
+	require.NoError(t, err)
+	orphan := controllers.FileBlobPrefix + entry2ID + "/b2"
+	young := controllers.FileBlobPrefix + entry3ID + "/b3"
+	for _, key := range []string{referenced.Key, orphan, young} {
+		require.NoError(t, blobs.Put(ctx, key, strings.NewReader("scan"), 4))
+	}
+	// The young object may be put by an upload whose entry isn't written yet
+	old := time.Now().Add(-2 * time.Hour)
+	for _, key := range []string{referenced.Key, orphan} {
+		require.NoError(t, os.Chtimes(filepath.Join(dir, filepath.FromSlash(key)), old, old))
+	}
+
+	orphans, err := orphanedBlobs(ctx, keeper, blobs, time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, []string{orphan}, orphans)
+
+	nLogger, err := logger.NewLogger("info")
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		runBlobReconciliation(ctx, keeper, blobs, 10*time.Millisecond, time.Hour, false, nLogger)
+		close(done)
+	}()
+
+	// Only the orphan older than the grace is deleted
+	assert.Eventually(t, func() bool {
+		exists, err := blobs.Exists(ctx, orphan)
+		return err == nil && !exists
+	}, time.Second, 10*time.Millisecond)
+	for _, key := range []string{referenced.Key, young} {
+		exists, err := blobs.Exists(ctx, key)
+		require.NoError(t, err)
+		assert.True(t, exists, key)
+	}
+
+	cancel()
+	<-done
+}
+
+// fakeRotator is a keyRotator whose first rotations fail.
+type fakeRotator struct {
+	failures int
+	started  int
+	verified int
+}
+
+func (f *fakeRotator) StartRotation(ctx context.Context) error {
+	f.started++
+	return nil
+}
+
+func (f *fakeRotator) RotateKeys(ctx context.Context, batchSize int, report func(bdkeeper.RotationProgress)) error {
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("database is unavailable")
+	}
+	report(bdkeeper.RotationProgress{Table: "UserCredentials", Rotated: batchSize, Done: true})
+	return nil
+}
+
+func (f *fakeRotator) VerifyRotation(ctx context.Context, sample int) error {
+	f.verified++
+	return nil
+}
+
+func TestRunKeyRotation(t *testing.T) {
+	nLogger, err := logger.NewLogger("info")
+	require.NoError(t, err)
+
+	// A failed rotation is resumed, then verified once
+	rotator := &fakeRotator{failures: 2}
+	runKeyRotation(context.Background(), rotator, 10, 5, time.Millisecond, nLogger)
+	assert.Equal(t, 3, rotator.started)
+	assert.Equal(t, 1, rotator.verified)
+
+	// A stopped server leaves the rotation to resume at the next start, unverified
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rotator = &fakeRotator{failures: 1}
+	runKeyRotation(ctx, rotator, 10, 5, time.Hour, nLogger)
+	assert.Equal(t, 1, rotator.started)
+	assert.Zero(t, rotator.verified)
+}
+
+// mailedToken returns the token on its own line in the last message sent to the address.
+func mailedToken(t *testing.T, sender *mail.Fake, to string) string {
+	t.Helper()
+
+	sent := sender.Sent()
+	for i := len(sent) - 1; i >= 0; i-- {
+		if sent[i].To != to {
+			continue
+		}
+		lines := strings.Split(sent[i].Body, "\n")
+		require.Greater(t, len(lines), 2)
+		return lines[2]
+	}
+	t.Fatalf("no mail sent to %s", to)
+
+	return ""
+}
+
+func TestServer_EmailReset(t *testing.T) {
+	withoutAuthRateLimit(t)
+	option := config.NewOptions()
+	option.ParseFlags()
+	nLogger, err := logger.NewLogger(option.LogLevel())
+	require.NoError(t, err)
+	sender := &mail.Fake{}
+	srv := httptest.NewServer(newRouter(storage.NewMemKeeper(), option, nLogger, sender, nil, newHealthState(time.Minute), nil, nil, nil, nil))
+	t.Cleanup(srv.Close)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	ivanID, ivanToken := registerAndLogin(t, srv, "ivan", string(hash))
+	_, judyToken := registerAndLogin(t, srv, "judy", string(hash))
+
+	getEmail := func(token string) models.UserEmail {
+		resp := doJSON(t, http.MethodGet, srv.URL+"/api/user/email", token, nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var email models.UserEmail
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&email))
+		return email
+	}
+	status := func(resp *http.Response) int {
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	requestReset := func(email string) int {
+		return status(doJSON(t, http.MethodPost, srv.URL+"/api/user/reset/request", "", map[string]string{"email": email}))
+	}
+
+	// The email is set unverified and a token is mailed to it, another account can't take it
+	assert.Equal(t, http.StatusBadRequest, status(doJSON(t, http.MethodPut, srv.URL+"/api/user/email", ivanToken, map[string]string{"email": "not an email"})))
+	require.Equal(t, http.StatusAccepted, status(doJSON(t, http.MethodPut, srv.URL+"/api/user/email", ivanToken, map[string]string{"email": "Ivan@Example.com"})))
+	assert.Equal(t, http.StatusConflict, status(doJSON(t, http.MethodPut, srv.URL+"/api/user/email", judyToken, map[string]string{"email": "ivan@example.com"})))
+	assert.Equal(t, models.UserEmail{Email: "ivan@example.com"}, getEmail(ivanToken))
+
+	// An unverified email gets no reset token
+	require.Equal(t, http.StatusAccepted, requestReset("ivan@example.com"))
+	require.Len(t, sender.Sent(), 1)
+
+	// A token is used once
+	verify := mailedToken(t, sender, "ivan@example.com")
+	assert.Equal(t, http.StatusBadRequest, status(doJSON(t, http.MethodGet, srv.URL+"/api/user/verify?token=wrong", "", nil)))
+	require.Equal(t, http.StatusNoContent, status(doJSON(t, http.MethodGet, srv.URL+"/api/user/verify?token="+verify, "", nil)))
+	assert.Equal(t, http.StatusBadRequest, status(doJSON(t, http.MethodGet, srv.URL+"/api/user/verify?token="+verify, "", nil)))
+	assert.True(t, getEmail(ivanToken).Verified)
+
+	// An unknown email is answered like a known one
+	assert.Equal(t, http.StatusAccepted, requestReset("nobody@example.com"))
+	require.Equal(t, http.StatusAccepted, requestReset("ivan@example.com"))
+	require.Len(t, sender.Sent(), 2)
+	reset := mailedToken(t, sender, "ivan@example.com")
+
+	resp := doJSON(t, http.MethodPost, srv.URL+"/login", "", map[string]string{"username": "ivan", "password": string(hash), "device_id": "laptop"})
+	var session tokens
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&session))
+	resp.Body.Close()
+
+	// The reset ends the sessions and only the new password logs in
+	assert.Equal(t, http.StatusBadRequest, status(doJSON(t, http.MethodPost, srv.URL+"/api/user/reset", "",
+		map[string]string{"token": "wrong", "new_password": "new-secret"})))
+	resp = doJSON(t, http.MethodPost, srv.URL+"/api/user/reset", "", map[string]string{"token": reset, "new_password": "new-secret"})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var result struct {
+		UserID int    `json:"userID"`
+		Notice string `json:"notice"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	resp.Body.Close()
+	assert.Equal(t, ivanID, result.UserID)
+	assert.Contains(t, result.Notice, "can't be decrypted")
+
+	code, _ := refresh(t, srv, session.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, http.StatusBadRequest, status(doJSON(t, http.MethodPost, srv.URL+"/api/user/reset", "",
+		map[string]string{"token": reset, "new_password": "other-secret"})))
+	assert.Equal(t, http.StatusUnauthorized, status(doJSON(t, http.MethodPost, srv.URL+"/login", "", map[string]string{"username": "ivan", "password": string(hash)})))
+	assert.Equal(t, http.StatusOK, status(doJSON(t, http.MethodPost, srv.URL+"/login", "", map[string]string{"username": "ivan", "password": "new-secret"})))
+
+	// A changed email voids the reset tokens mailed to the previous one
+	ivanToken = loginAs(t, srv, "ivan", "new-secret")
+	require.Equal(t, http.StatusAccepted, requestReset("ivan@example.com"))
+	reset = mailedToken(t, sender, "ivan@example.com")
+	require.Equal(t, http.StatusNoContent, status(doJSON(t, http.MethodPut, srv.URL+"/api/user/email", ivanToken, map[string]string{"email": ""})))
+	assert.Equal(t, http.StatusBadRequest, status(doJSON(t, http.MethodPost, srv.URL+"/api/user/reset", "",
+		map[string]string{"token": reset, "new_password": "other-secret"})))
+}
+
+func TestServer_UserLanguage(t *testing.T) {
+	withoutAuthRateLimit(t)
+	option := config.NewOptions()
+	option.ParseFlags()
+	nLogger, err := logger.NewLogger(option.LogLevel())
+	require.NoError(t, err)
+	sender := &mail.Fake{}
+	srv := httptest.NewServer(newRouter(storage.NewMemKeeper(), option, nLogger, sender, nil, newHealthState(time.Minute), nil, nil, nil, nil))
+	t.Cleanup(srv.Close)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	// The language of the client is the default of the account
+	b, err := json.Marshal(map[string]string{"username": "olga", "password": string(hash)})
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/register", bytes.NewReader(b))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept-Language", "ru-RU;q=0.9, fr;q=0.8")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	olgaToken := loginAs(t, srv, "olga", string(hash))
+	_, peggyToken := registerAndLogin(t, srv, "peggy", string(hash))
+
+	getLanguage := func(token string) string {
+		resp := doJSON(t, http.MethodGet, srv.URL+"/api/user/language", token, nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var body struct {
+			Language string `json:"language"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return body.Language
+	}
+	setLanguage := func(token, language string) int {
+		resp := doJSON(t, http.MethodPut, srv.URL+"/api/user/language", token, map[string]string{"language": language})
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, "ru-RU", getLanguage(olgaToken))
+	assert.Empty(t, getLanguage(peggyToken))
+
+	// The emails are in the language of the user, or the closest one which has templates
+	resp = doJSON(t, http.MethodPut, srv.URL+"/api/user/email", olgaToken, map[string]string{"email": "olga@example.com"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	sent := sender.Sent()
+	require.Len(t, sent, 1)
+	assert.Equal(t, "Подтвердите email", sent[0].Subject)
+	assert.NotEmpty(t, sent[0].HTML)
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/user/verify?token="+mailedToken(t, sender, "olga@example.com"), "", nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	assert.Equal(t, http.StatusBadRequest, setLanguage(olgaToken, "not a language"))
+	require.Equal(t, http.StatusOK, setLanguage(olgaToken, "pt-BR"))
+	assert.Equal(t, "pt-BR", getLanguage(olgaToken))
+	resp = doJSON(t, http.MethodPost, srv.URL+"/api/user/reset/request", "", map[string]string{"email": "olga@example.com"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	sent = sender.Sent()
+	require.Len(t, sent, 2)
+	assert.Equal(t, "Reset your password", sent[1].Subject)
+
+	// An empty language is the default of the server
+	require.Equal(t, http.StatusOK, setLanguage(olgaToken, ""))
+	assert.Empty(t, getLanguage(olgaToken))
+}
+
+func TestServer_Devices(t *testing.T) {
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	credentials := map[string]string{"username": "trent", "password": string(hash)}
+	resp := doJSON(t, http.MethodPost, srv.URL+"/register", "", credentials)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// A login registers its device, with the name the client gives
+	login := func(deviceID, name string) tokens {
+		body := map[string]string{"username": "trent", "password": string(hash), "device_id": deviceID, "device_name": name}
+		resp := doJSON(t, http.MethodPost, srv.URL+"/login", "", body)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var login tokens
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&login))
+		resp.Body.Close()
+		return login
+	}
+	phone := login("phone", "Phone")
+	laptop := login("laptop", "")
+
+	url := fmt.Sprintf("%s/addData/UserCredentials/%d/%s", srv.URL, phone.UserID, entry1ID)
+	resp = doJSON(t, http.MethodPost, url, phone.Token, map[string]string{"login": "trent"})
+	var written struct {
+		UpdatedAt time.Time `json:"updated_at"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&written))
+	resp.Body.Close()
+
+	pull := func(token, deviceID string) int {
+		url := fmt.Sprintf("%s/getAllData/UserCredentials/%d/0001-01-01T00:00:00Z", srv.URL, phone.UserID)
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", token)
+		req.Header.Set(controllers.DeviceIDHeader, deviceID)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// A pull of the device keeps its checkpoint, the other device has none
+	require.Equal(t, http.StatusOK, pull(phone.Token, "phone"))
+	getDevices := func() []models.Device {
+		resp := doJSON(t, http.MethodGet, srv.URL+"/api/user/devices", phone.Token, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var devices []models.Device
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&devices))
+		resp.Body.Close()
+		return devices
+	}
+	devices := getDevices()
+	require.Len(t, devices, 2)
+	assert.Equal(t, "phone", devices[0].DeviceID)
+	assert.Equal(t, "Phone", devices[0].Name)
+	require.NotNil(t, devices[0].LastSyncAt)
+	assert.True(t, written.UpdatedAt.Equal(*devices[0].LastSyncAt))
+	assert.Equal(t, "laptop", devices[1].DeviceID)
+	assert.Nil(t, devices[1].LastSyncAt)
+
+	// An unknown device has to log in again
+	assert.Equal(t, http.StatusUnauthorized, pull(phone.Token, "tablet"))
+
+	// A revoked device can neither refresh nor synchronize
+	resp = doJSON(t, http.MethodDelete, srv.URL+"/api/user/devices/laptop", phone.Token, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	status, _ := refresh(t, srv, laptop.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, http.StatusUnauthorized, pull(laptop.Token, "laptop"))
+	status, _ = refresh(t, srv, phone.RefreshToken)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, getDevices(), 1)
+
+	resp = doJSON(t, http.MethodDelete, srv.URL+"/api/user/devices/laptop", phone.Token, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestServer_Previews(t *testing.T) {
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	userID, token := registerAndLogin(t, srv, "uma", string(hash))
+
+	// The list view of the notes returns their preview, not their data
+	url := fmt.Sprintf("%s/addData/TextData/%d/%s", srv.URL, userID, entry1ID)
+	resp := doJSON(t, http.MethodPost, url, token, map[string]string{"data": "sealed", "preview": "Shopping\nlist"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/TextData", token, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var list []map[string]string
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+	resp.Body.Close()
+	require.Len(t, list, 1)
+	assert.Equal(t, "Shopping list", list[0]["preview"])
+	assert.NotContains(t, list[0], "data")
+
+	url = fmt.Sprintf("%s/updateData/TextData/%d/%s", srv.URL, userID, entry1ID)
+	resp = doJSON(t, http.MethodPut, url, token, map[string]string{"preview": strings.Repeat("x", models.MaxPreviewChars+1)})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// A server storing no plaintext metadata rejects the previews on every write
+	require.NoError(t, flag.Set("plaintext-previews", "false"))
+	t.Cleanup(func() { flag.Set("plaintext-previews", "true") })
+
+	resp = doJSON(t, http.MethodPut, url, token, map[string]string{"Preview": "Shopping"})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = doJSON(t, http.MethodPost, srv.URL+"/api/sync/push", token, map[string]any{
+		"changes": []map[string]any{
+			{"table": "TextData", "op": "add", "entry_id": entry2ID, "fields": map[string]string{"data": "sealed", "preview": "Todo"}},
+		},
+	})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = doJSON(t, http.MethodPut, url, token, map[string]string{"data": "resealed"})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestServer_Events(t *testing.T) {
+	withoutAuthRateLimit(t)
+	option := config.NewOptions()
+	option.ParseFlags()
+	nLogger, err := logger.NewLogger(option.LogLevel())
+	require.NoError(t, err)
+	broker := events.NewBroker()
+	srv := httptest.NewServer(newRouter(storage.NewMemKeeper(), option, nLogger, nil, nil, newHealthState(time.Minute), nil, broker, nil, nil))
+	t.Cleanup(srv.Close)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	resp := doJSON(t, http.MethodPost, srv.URL+"/register", "", map[string]string{"username": "ursula", "password": string(hash)})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	login := func(deviceID string) tokens {
+		resp := doJSON(t, http.MethodPost, srv.URL+"/login", "", map[string]string{"username": "ursula", "password": string(hash), "device_id": deviceID})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var login tokens
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&login))
+		resp.Body.Close()
+		return login
+	}
+	phone := login("phone")
+	laptop := login("laptop")
+
+	// The stream needs a token
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/events", "", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// The phone holds a stream open
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/events", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", phone.Token)
+	req.Header.Set(controllers.DeviceIDHeader, "phone")
+	stream, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer stream.Body.Close()
+	require.Equal(t, http.StatusOK, stream.StatusCode)
+	assert.Equal(t, "text/event-stream", stream.Header.Get("Content-Type"))
+	lines := bufio.NewReader(stream.Body)
+
+	// next returns the data of the next event of the stream, skipping the heartbeats
+	next := func() models.VaultEvent {
+		for {
+			line, err := lines.ReadString('\n')
+			require.NoError(t, err)
+			if data, ok := strings.CutPrefix(line, "data: "); ok {
+				var ev models.VaultEvent
+				require.NoError(t, json.Unmarshal([]byte(data), &ev))
+				return ev
+			}
+		}
+	}
+	write := func(token, deviceID, entryID string) {
+		url := fmt.Sprintf("%s/addData/TextData/%d/%s", srv.URL, phone.UserID, entryID)
+		b, err := json.Marshal(map[string]string{"data": "d"})
+		require.NoError(t, err)
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", token)
+		req.Header.Set(controllers.DeviceIDHeader, deviceID)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// The writes of the phone itself aren't sent to it, those of the laptop are
+	write(phone.Token, "phone", entry1ID)
+	write(laptop.Token, "laptop", entry2ID)
+	ev := next()
+	assert.Equal(t, "TextData", ev.Table)
+	assert.Equal(t, entry2ID, ev.EntryID)
+	assert.False(t, ev.UpdatedAt.IsZero())
+
+	// The changes of a synchronization are sent too
+	resp = doJSON(t, http.MethodPost, srv.URL+"/api/sync/push", laptop.Token, map[string]any{"changes": []models.Change{
+		{Table: "TextData", Op: models.ChangeDelete, EntryID: entry2ID, UpdatedAt: time.Now()},
+	}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	ev = next()
+	assert.Equal(t, entry2ID, ev.EntryID)
+
+	// The subscription ends with the connection of the client
+	assert.Equal(t, 1, broker.Subscribers())
+	cancel()
+	assert.Eventually(t, func() bool { return broker.Subscribers() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+// countingKeeper counts the reads of the entries of the data tables.
+type countingKeeper struct {
+	storage.Keeper
+	reads atomic.Int32
+}
+
+func (k *countingKeeper) GetAllData(ctx context.Context, table string, userID int, q models.DataQuery) ([]map[string]string, error) {
+	k.reads.Add(1)
+	return k.Keeper.GetAllData(ctx, table, userID, q)
+}
+
+func TestServer_ETag(t *testing.T) {
+	option := config.NewOptions()
+	option.ParseFlags()
+	nLogger, err := logger.NewLogger(option.LogLevel())
+	require.NoError(t, err)
+	keeper := &countingKeeper{Keeper: storage.NewMemKeeper()}
+	srv := httptest.NewServer(newRouter(keeper, option, nLogger, nil, nil, newHealthState(time.Minute), nil, nil, nil, nil))
+	t.Cleanup(srv.Close)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	userID, token := registerAndLogin(t, srv, "ivan", string(hash))
+
+	get := func(url, ifNoneMatch string) (int, string, string) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", token)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		status, body := readResponse(t, resp)
+		return status, resp.Header.Get("ETag"), body
+	}
+	list := srv.URL + "/api/UserCredentials"
+	pull := fmt.Sprintf("%s/getAllData/UserCredentials/%d/0001-01-01T00:00:00Z", srv.URL, userID)
+
+	url := fmt.Sprintf("%s/addData/UserCredentials/%d/%s", srv.URL, userID, entry1ID)
+	resp := doJSON(t, http.MethodPost, url, token, map[string]string{"login": "ivan", "meta_info": "wifi"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The list comes with the ETag of the vault, which stays the same while nothing changes
+	status, etag, body := get(list, "")
+	require.Equal(t, http.StatusOK, status)
+	require.NotEmpty(t, etag)
+	assert.Contains(t, body, entry1ID)
+	_, again, _ := get(list, "")
+	assert.Equal(t, etag, again)
+	reads := keeper.reads.Load()
+
+	// A client which has the entries gets no body, and the entries aren't read
+	status, again, body = get(list, etag)
+	assert.Equal(t, http.StatusNotModified, status)
+	assert.Equal(t, etag, again)
+	assert.Empty(t, body)
+	status, _, _ = get(list, `"other", `+etag)
+	assert.Equal(t, http.StatusNotModified, status)
+	status, _, _ = get(pull, etag)
+	assert.Equal(t, http.StatusNotModified, status)
+	assert.Equal(t, reads, keeper.reads.Load())
+
+	// A delete changes the ETag, the entries are sent again
+	url = fmt.Sprintf("%s/deleteData/UserCredentials/%d/%s", srv.URL, userID, entry1ID)
+	resp = doJSON(t, http.MethodDelete, url, token, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	status, deleted, _ := get(list, etag)
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotEqual(t, etag, deleted)
+	status, _, body = get(pull, etag)
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotContains(t, body, entry1ID)
+	assert.Equal(t, reads+2, keeper.reads.Load())
+}
+
+func TestServer_Export(t *testing.T) {
+	config.NewOptions().ParseFlags()
+	files := t.TempDir()
+	require.NoError(t, flag.Set("n", files))
+	require.NoError(t, flag.Set("export-rate-burst", "4"))
+	t.Cleanup(func() {
+		flag.Set("n", "")
+		flag.Set("export-rate-burst", "2")
+	})
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	userID, token := registerAndLogin(t, srv, "judy", string(hash))
+	_, otherToken := registerAndLogin(t, srv, "karl", string(hash))
+
+	add := func(table, id, token string, fields map[string]string) {
+		url := fmt.Sprintf("%s/addData/%s/%d/%s", srv.URL, table, userID, id)
+		status, _ := readResponse(t, doJSON(t, http.MethodPost, url, token, fields))
+		require.Equal(t, http.StatusOK, status)
+	}
+	add("UserCredentials", entry1ID, token, map[string]string{"login": "judy", "meta_info": "mail", "tags": "work"})
+	add("UserCredentials", entry2ID, token, map[string]string{"login": "old"})
+	add("FilesData", entry3ID, token, map[string]string{"meta_info": "scan.pdf"})
+	add("FilesData", missingID, token, map[string]string{"meta_info": "never uploaded"})
+	status, _ := readResponse(t, doJSON(t, http.MethodDelete,
+		fmt.Sprintf("%s/deleteData/UserCredentials/%d/%s", srv.URL, userID, entry2ID), token, nil))
+	require.Equal(t, http.StatusOK, status)
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/sendFile/%d/%s", srv.URL, userID, entry3ID), strings.NewReader("encrypted scan"))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", token)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	status, _ = readResponse(t, resp)
+	require.Equal(t, http.StatusOK, status)
+
+	type document struct {
+		SchemaVersion int                            `json:"schema_version"`
+		ExportedAt    time.Time                      `json:"exported_at"`
+		Folders       []map[string]string            `json:"folders"`
+		Tables        map[string][]map[string]string `json:"tables"`
+	}
+	export := func(query, token string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/api/export"+query, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// The document has every table, with the entries which aren't deleted and their metainfo, tags and timestamps
+	resp = export("", token)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Contains(t, resp.Header.Get("Content-Disposition"), "attachment")
+	var doc document
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&doc))
+	resp.Body.Close()
+	assert.Equal(t, 2, doc.SchemaVersion)
+	assert.WithinDuration(t, time.Now(), doc.ExportedAt, time.Minute)
+	assert.NotNil(t, doc.Folders)
+	assert.Empty(t, doc.Folders)
+	assert.Len(t, doc.Tables, len(models.DataTables))
+	assert.Empty(t, doc.Tables["TextData"])
+	require.Len(t, doc.Tables["UserCredentials"], 1)
+	entry := doc.Tables["UserCredentials"][0]
+	assert.Equal(t, entry1ID, entry["id"])
+	assert.Equal(t, "mail", entry["meta_info"])
+	assert.Equal(t, "work", entry["tags"])
+	assert.NotEmpty(t, entry["updated_at"])
+	assert.NotContains(t, entry, "user_id")
+	assert.NotContains(t, entry, "deleted")
+	assert.Len(t, doc.Tables["FilesData"], 2)
+	assert.NotContains(t, doc.Tables["FilesData"][0], "export_file")
+
+	// The archive has the document and the stored files, which the entries name
+	resp = export("?format=zip", token)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/zip", resp.Header.Get("Content-Type"))
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	require.NoError(t, err)
+	contents := make(map[string]string)
+	for _, f := range archive.File {
+		rc, err := f.Open()
+		require.NoError(t, err)
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		require.NoError(t, err)
+		contents[f.Name] = string(b)
+	}
+	assert.Len(t, contents, 2)
+	assert.Equal(t, "encrypted scan", contents["files/"+entry3ID])
+	require.NoError(t, json.Unmarshal([]byte(contents["vault.json"]), &doc))
+	require.Len(t, doc.Tables["FilesData"], 2)
+	for _, entry := range doc.Tables["FilesData"] {
+		if entry["id"] == entry3ID {
+			assert.Equal(t, "files/"+entry3ID, entry["export_file"])
+		} else {
+			assert.NotContains(t, entry, "export_file")
+		}
+	}
+
+	// Another user exports their own vault only
+	resp = export("", otherToken)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&doc))
+	resp.Body.Close()
+	for _, entries := range doc.Tables {
+		assert.Empty(t, entries)
+	}
+
+	status, _ = readResponse(t, export("?format=csv", token))
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = readResponse(t, export("", ""))
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// The exports are recorded in the audit log with their format
+	resp = doJSON(t, http.MethodGet, srv.URL+"/api/audit?limit=2", token, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var events []models.AuditEvent
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&events))
+	resp.Body.Close()
+	require.Len(t, events, 2)
+	assert.Equal(t, models.AuditExport, events[0].Action)
+	assert.Equal(t, "zip", events[0].Detail)
+	assert.True(t, events[0].Success)
+	assert.Equal(t, "json", events[1].Detail)
+
+	// The exports have a limit of their own, below the one of the data routes
+	status, _ = readResponse(t, export("", token))
+	require.Equal(t, http.StatusOK, status)
+	resp = export("", token)
+	status, _ = readResponse(t, resp)
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+	status, _ = readResponse(t, doJSON(t, http.MethodGet, srv.URL+"/api/user/devices", token, nil))
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestServer_Reencrypt(t *testing.T) {
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	credentials := map[string]string{"username": "judy", "password": string(hash)}
+	resp := doJSON(t, http.MethodPost, srv.URL+"/register", "", credentials)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	login := func(deviceID string) tokens {
+		body := map[string]string{"username": "judy", "password": string(hash), "device_id": deviceID}
+		resp := doJSON(t, http.MethodPost, srv.URL+"/login", "", body)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var login tokens
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&login))
+		resp.Body.Close()
+		return login
+	}
+	laptop := login("laptop")
+	phone := login("phone")
+
+	do := func(method, url string, session tokens, body any) *http.Response {
+		b, err := json.Marshal(body)
+		require.NoError(t, err)
+		req, err := http.NewRequest(method, url, bytes.NewReader(b))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", session.Token)
+		req.Header.Set(controllers.DeviceIDHeader, session.DeviceID)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+	write := func(session tokens, id string) *http.Response {
+		url := fmt.Sprintf("%s/addData/UserCredentials/%d/%s", srv.URL, session.UserID, id)
+		return do(http.MethodPost, url, session, map[string]string{"login": "judy"})
+	}
+	sync := func(session tokens, changes ...map[string]any) int {
+		status, _ := readResponse(t, do(http.MethodPost, srv.URL+"/api/sync", session, map[string]any{"changes": changes}))
+		return status
+	}
+	start := func(session tokens) (int, models.UserOperation) {
+		resp := do(http.MethodPost, srv.URL+"/api/user/reencrypt", session, map[string]int{"expected_seconds": 30})
+		defer resp.Body.Close()
+		var op models.UserOperation
+		if resp.StatusCode == http.StatusCreated {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&op))
+		}
+		return resp.StatusCode, op
+	}
+	finish := func(session tokens, id, status string) int {
+		url := fmt.Sprintf("%s/api/user/reencrypt/%s", srv.URL, id)
+		code, _ := readResponse(t, do(http.MethodPut, url, session, map[string]string{"status": status}))
+		return code
+	}
+
+	// The laptop starts the re-encryption, only one runs at a time
+	status, op := start(laptop)
+	require.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, models.OperationReencrypt, op.Kind)
+	assert.Equal(t, models.OperationRunning, op.Status)
+	assert.Equal(t, "laptop", op.DeviceID)
+	assert.Equal(t, 30, op.ExpectedSeconds)
+	status, _ = start(phone)
+	assert.Equal(t, http.StatusConflict, status)
+
+	// The writes of the phone are fenced with the running operation, its reads and pulls aren't
+	resp = write(phone, entry1ID)
+	require.Equal(t, http.StatusLocked, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+	var locked struct {
+		OperationID     string `json:"operation_id"`
+		ExpectedSeconds int    `json:"expected_seconds"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&locked))
+	resp.Body.Close()
+	assert.Equal(t, op.ID, locked.OperationID)
+	assert.Equal(t, 30, locked.ExpectedSeconds)
+	status, _ = readResponse(t, do(http.MethodGet, srv.URL+"/api/UserCredentials", phone, nil))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, http.StatusOK, sync(phone))
+	assert.Equal(t, http.StatusLocked, sync(phone, map[string]any{
+		"table": "UserCredentials", "op": "add", "entry_id": entry2ID, "fields": map[string]string{"login": "phone"},
+	}))
+
+	// The laptop writes the entries under the new key, the phone can neither extend nor finish its operation
+	status, _ = readResponse(t, write(laptop, entry1ID))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, http.StatusLocked, finish(phone, op.ID, models.OperationCompleted))
+	assert.Equal(t, http.StatusBadRequest, finish(laptop, op.ID, "paused"))
+	assert.Equal(t, http.StatusNotFound, finish(laptop, "unknown", models.OperationCompleted))
+	assert.Equal(t, http.StatusOK, finish(laptop, op.ID, models.OperationRunning))
+
+	// Once it completes, the phone writes again
+	assert.Equal(t, http.StatusOK, finish(laptop, op.ID, models.OperationCompleted))
+	status, _ = readResponse(t, write(phone, entry2ID))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, http.StatusNotFound, finish(laptop, op.ID, models.OperationCompleted))
+
+	// An operation without a heartbeat fails once its timeout passes, and releases the fence
+	require.NoError(t, flag.Set("reencrypt-timeout", "50ms"))
+	t.Cleanup(func() { flag.Set("reencrypt-timeout", "10m") })
+	status, op = start(laptop)
+	require.Equal(t, http.StatusCreated, status)
+	status, _ = readResponse(t, write(phone, entry3ID))
+	assert.Equal(t, http.StatusLocked, status)
+	time.Sleep(100 * time.Millisecond)
+	status, _ = readResponse(t, write(phone, entry3ID))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, http.StatusNotFound, finish(laptop, op.ID, models.OperationCompleted))
+
+	// The start and the end of the operations are in the audit log, an expired one only started
+	resp = do(http.MethodGet, srv.URL+"/api/audit", laptop, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var events []models.AuditEvent
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&events))
+	resp.Body.Close()
+	var details []string
+	for _, event := range events {
+		if event.Action == models.AuditReencrypt {
+			details = append(details, event.Detail)
+		}
+	}
+	assert.Equal(t, []string{models.OperationRunning, models.OperationCompleted, models.OperationRunning}, details)
+}
+
+func TestServer_Import(t *testing.T) {
+	config.NewOptions().ParseFlags()
+	require.NoError(t, flag.Set("export-rate-limit", "0"))
+	t.Cleanup(func() { flag.Set("export-rate-limit", "6") })
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	userID, token := registerAndLogin(t, srv, "lena", string(hash))
+	otherID, otherToken := registerAndLogin(t, srv, "mona", string(hash))
+
+	type result struct {
+		Imported int `json:"imported"`
+		Skipped  int `json:"skipped"`
+		Failed   int `json:"failed"`
+		Folders  int `json:"folders"`
+		Errors   []struct {
+			Record int    `json:"record"`
+			Reason string `json:"reason"`
+		} `json:"errors"`
+	}
+	send := func(format, token, body string) (int, result) {
+		url := srv.URL + "/api/import"
+		if format != "" {
+			url += "?format=" + format
+		}
+		req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var res result
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		}
+		return resp.StatusCode, res
+	}
+	entries := func(token string, userID int, table string) []map[string]string {
+		url := fmt.Sprintf("%s/getAllData/%s/%d/0001-01-01T00:00:00Z", srv.URL, table, userID)
+		resp := doJSON(t, http.MethodGet, url, token, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var entries []map[string]string
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&entries))
+		resp.Body.Close()
+		return entries
+	}
+
+	folders := func(token string) map[string]models.Folder {
+		status, body := readResponse(t, doJSON(t, http.MethodGet, srv.URL+"/api/folders", token, nil))
+		require.Equal(t, http.StatusOK, status)
+		var list []models.Folder
+		require.NoError(t, json.Unmarshal([]byte(body), &list))
+		byName := make(map[string]models.Folder, len(list))
+		for _, f := range list {
+			byName[f.Name] = f
+		}
+		return byName
+	}
+
+	// The export of a vault is imported into another one with new ids, its folders included,
+	// a second import only has duplicates
+	status, body := readResponse(t, doJSON(t, http.MethodPost, srv.URL+"/api/folders", token, map[string]string{"name": "Mail"}))
+	require.Equal(t, http.StatusCreated, status, body)
+	status, body = readResponse(t, doJSON(t, http.MethodPost, srv.URL+"/api/folders", token,
+		map[string]string{"id": foreignID, "name": "Archive", "parent_id": folders(token)["Mail"].ID}))
+	require.Equal(t, http.StatusCreated, status, body)
+	url := fmt.Sprintf("%s/addData/UserCredentials/%d/%s", srv.URL, userID, entry1ID)
+	status, _ = readResponse(t, doJSON(t, http.MethodPost, url, token, map[string]string{
+		"login": "lena", "password": "secret", "meta_info": "mail", "tags": "work", models.FolderField: foreignID,
+	}))
+	require.Equal(t, http.StatusOK, status)
+	url = fmt.Sprintf("%s/addData/FilesData/%d/%s", srv.URL, userID, entry2ID)
+	status, _ = readResponse(t, doJSON(t, http.MethodPost, url, token, map[string]string{"path": "scan.pdf"}))
+	require.Equal(t, http.StatusOK, status)
+	status, export := readResponse(t, doJSON(t, http.MethodGet, srv.URL+"/api/export", token, nil))
+	require.Equal(t, http.StatusOK, status)
+
+	status, res := send("", otherToken, export)
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 1, res.Imported)
+	assert.Equal(t, 1, res.Failed)
+	assert.Equal(t, 2, res.Folders)
+	require.Len(t, res.Errors, 1)
+	assert.Contains(t, res.Errors[0].Reason, "FilesData")
+	imported := entries(otherToken, otherID, "UserCredentials")
+	require.Len(t, imported, 1)
+	assert.NotEqual(t, entry1ID, imported[0]["id"])
+	assert.Equal(t, "lena", imported[0]["login"])
+	assert.Equal(t, "secret", imported[0]["password"])
+	assert.Equal(t, "work", imported[0]["tags"])
+	recreated := folders(otherToken)
+	require.Len(t, recreated, 2)
+	assert.NotEqual(t, foreignID, recreated["Archive"].ID)
+	assert.Equal(t, recreated["Mail"].ID, recreated["Archive"].ParentID)
+	assert.Equal(t, recreated["Archive"].ID, imported[0][models.FolderField])
+	status, res = send("gophkeeper", otherToken, export)
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 0, res.Imported)
+	assert.Equal(t, 1, res.Skipped)
+	assert.Equal(t, 0, res.Folders)
+	assert.Len(t, entries(otherToken, otherID, "UserCredentials"), 1)
+	assert.Len(t, folders(otherToken), 2)
+
+	// Folders nested in each other fail the import, nothing of it is created
+	nested := fmt.Sprintf(`{"schema_version": 2, "folders": [{"id": "%s", "name": "A", "parent_id": "%s"},
+		{"id": "%s", "name": "B", "parent_id": "%s"}, {"id": "%s", "name": "C"}], "tables": {}}`,
+		entry1ID, entry2ID, entry2ID, entry1ID, models.NewEntryID())
+	status, _ = send("", otherToken, nested)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Len(t, folders(otherToken), 2)
+
+	// A KeePass row with a username or a password is a login, the others are notes
+	keepass := "\ufeff\"Group\",\"Title\",\"Username\",\"Password\",\"URL\",\"Notes\",\"Last Modified\"\n" +
+		"\"Root/Mail\",\"Webmail\",\"lena\",\"hunter2\",\"https://mail.example.com\",\"\",\"2023-04-05T06:07:08Z\"\n" +
+		"\"Root\",\"Alarm code\",\"\",\"\",\"\",\"1234\",\"\"\n" +
+		"\"Root\",\"Broken\"\n" +
+		"\"Root\",\"Empty\",\"\",\"\",\"\",\"\",\"\"\n" +
+		"\"Root/Mail\",\"Webmail\",\"lena\",\"hunter2\",\"https://mail.example.com\",\"\",\"2023-04-05T06:07:08Z\"\n"
+	status, res = send("keepass", token, keepass)
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 2, res.Imported)
+	assert.Equal(t, 1, res.Skipped)
+	assert.Equal(t, 2, res.Failed)
+	require.Len(t, res.Errors, 2)
+	assert.Equal(t, 3, res.Errors[0].Record)
+	assert.Equal(t, 4, res.Errors[1].Record)
+	var login map[string]string
+	for _, entry := range entries(token, userID, "UserCredentials") {
+		if entry["login"] == "lena" && entry["password"] == "hunter2" {
+			login = entry
+		}
+	}
+	require.NotNil(t, login)
+	assert.Equal(t, "Webmail\nhttps://mail.example.com", login["meta_info"])
+	assert.Equal(t, "mail", login["tags"])
+	assert.Equal(t, "2023-04-05T06:07:08Z", login[models.ClientModifiedAt])
+	notes := entries(token, userID, "TextData")
+	require.Len(t, notes, 1)
+	assert.Equal(t, "1234", notes[0]["data"])
+	assert.Equal(t, "Alarm code", notes[0]["meta_info"])
+
+	// The logins, the notes and the cards of Bitwarden are imported, the identities and the encrypted exports aren't
+	bitwarden := `{"encrypted": false, "folders": [{"id": "f1", "name": "Bank"}], "items": [
+		{"type": 3, "name": "Visa", "folderId": "f1", "card": {"number": "4111111111111111", "expMonth": "5", "expYear": "2030", "code": "123"}},
+		{"type": 1, "name": "Forum", "notes": "old account", "login": {"username": "lena", "password": "pw", "uris": [{"uri": "https://forum.example.com"}], "totp": "otpauth://x"}},
+		{"type": 4, "name": "Passport"},
+		{"type": 2, "name": "Wifi", "notes": "password: guest"},
+		{"type": "login"}
+	]}`
+	status, res = send("bitwarden", token, bitwarden)
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 3, res.Imported)
+	assert.Equal(t, 2, res.Failed)
+	cards := entries(token, userID, "CreditCardData")
+	require.Len(t, cards, 1)
+	assert.Equal(t, "4111111111111111", cards[0]["card_number"])
+	assert.Equal(t, "05/30", cards[0]["expiration_date"])
+	assert.Equal(t, "123", cards[0]["cvv"])
+	assert.Equal(t, "bank", cards[0]["tags"])
+	assert.Len(t, entries(token, userID, "TextData"), 2)
+	status, _ = send("bitwarden", token, `{"encrypted": true, "items": []}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// A file broken midway imports nothing, not even the records before the break
+	status, _ = send("bitwarden", token, `{"items": [{"type": 2, "name": "Lost", "notes": "never"}, {"type": `)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Len(t, entries(token, userID, "TextData"), 2)
+	status, _ = send("lastpass", token, "")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// A file over the limit is rejected
+	require.NoError(t, flag.Set("import-max-size", "64"))
+	t.Cleanup(func() { flag.Set("import-max-size", strconv.Itoa(64<<20)) })
+	status, _ = send("bitwarden", token, bitwarden)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+
+	// The imports are audited with their format
+	resp := doJSON(t, http.MethodGet, srv.URL+"/api/audit", token, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var events []models.AuditEvent
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&events))
+	resp.Body.Close()
+	var formats []string
+	for _, event := range events {
+		if event.Action == models.AuditImport {
+			formats = append(formats, fmt.Sprintf("%s:%t", event.Detail, event.Success))
+		}
+	}
+	assert.Equal(t, []string{"bitwarden:false", "bitwarden:false", "bitwarden:false", "bitwarden:true", "keepass:true"}, formats)
+}
+
+func TestServer_ChunkedUpload(t *testing.T) {
+	config.NewOptions().ParseFlags()
+	files := t.TempDir()
+	require.NoError(t, flag.Set("n", files))
+	require.NoError(t, flag.Set("upload-chunk-max-size", "8"))
+	t.Cleanup(func() {
+		flag.Set("n", "")
+		flag.Set("upload-chunk-max-size", "16777216")
+	})
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	userID, token := registerAndLogin(t, srv, "nora", string(hash))
+	otherID, otherToken := registerAndLogin(t, srv, "otto", string(hash))
+
+	type session struct {
+		UploadID string `json:"upload_id"`
+		EntryID  string `json:"entry_id"`
+		Size     int64  `json:"size"`
+		Chunks   []int  `json:"chunks"`
+		Received int64  `json:"received"`
+	}
+	start := func(entryID string, size int) session {
+		resp := doJSON(t, http.MethodPost, fmt.Sprintf("%s/api/files/%s/upload", srv.URL, entryID), token, map[string]int{"size": size})
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		var s session
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&s))
+		resp.Body.Close()
+		return s
+	}
+	put := func(entryID, uploadID string, chunk int, body string) int {
+		url := fmt.Sprintf("%s/api/files/%s/upload/%s/%d", srv.URL, entryID, uploadID, chunk)
+		req, err := http.NewRequest(http.MethodPut, url, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		status, _ := readResponse(t, resp)
+		return status
+	}
+	check := func(entryID, uploadID, token string) (int, session) {
+		resp := doJSON(t, http.MethodGet, fmt.Sprintf("%s/api/files/%s/upload/%s", srv.URL, entryID, uploadID), token, nil)
+		defer resp.Body.Close()
+		var s session
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&s))
+		}
+		return resp.StatusCode, s
+	}
+	commit := func(entryID, uploadID string, chunks int, content string, fields map[string]string) (int, string) {
+		sum := sha256.Sum256([]byte(content))
+		return readResponse(t, doJSON(t, http.MethodPost, fmt.Sprintf("%s/api/files/%s/upload/%s/commit", srv.URL, entryID, uploadID),
+			token, map[string]any{"chunks": chunks, "sha256": hex.EncodeToString(sum[:]), "fields": fields}))
+	}
+	file := func(entryID string) string {
+		status, body := readResponse(t, doJSON(t, http.MethodGet, fmt.Sprintf("%s/getFile/%d/%s", srv.URL, userID, entryID), token, nil))
+		require.Equal(t, http.StatusOK, status)
+		return body
+	}
+
+	// A session is only started for an entry id and a positive size within the limit
+	status, _ := readResponse(t, doJSON(t, http.MethodPost, srv.URL+"/api/files/not-a-uuid/upload", token, map[string]int{"size": 1}))
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = readResponse(t, doJSON(t, http.MethodPost, srv.URL+"/api/files/"+entry1ID+"/upload", token, map[string]int{"size": 0}))
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = readResponse(t, doJSON(t, http.MethodPost, srv.URL+"/api/files/"+entry1ID+"/upload", token, map[string]int{"size": 80001}))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+
+	content := "encrypted scan of a contract"
+	upload := start(entry1ID, len(content))
+	assert.Equal(t, entry1ID, upload.EntryID)
+
+	// The connection drops after some chunks, the client asks which ones arrived
+	assert.Equal(t, http.StatusNoContent, put(entry1ID, upload.UploadID, 0, content[:8]))
+	assert.Equal(t, http.StatusNoContent, put(entry1ID, upload.UploadID, 2, content[16:24]))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, put(entry1ID, upload.UploadID, 1, content[8:17]))
+	assert.Equal(t, http.StatusBadRequest, put(entry1ID, upload.UploadID, -1, content[8:16]))
+	status, got := check(entry1ID, upload.UploadID, token)
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []int{0, 2}, got.Chunks)
+	assert.Equal(t, int64(16), got.Received)
+
+	// The session is only found by its user and for its entry
+	status, _ = check(entry1ID, upload.UploadID, otherToken)
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = check(entry2ID, upload.UploadID, token)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, http.StatusNotFound, put(entry1ID, missingID, 1, content[8:16]))
+
+	// The commit needs all the chunks, of the size and the checksum of the upload
+	status, body := commit(entry1ID, upload.UploadID, 4, content, map[string]string{"path": "contract.pdf"})
+	assert.Equal(t, http.StatusConflict, status)
+	assert.JSONEq(t, `{"error":"the upload lacks chunks","missing":[1,3]}`, body)
+	assert.Equal(t, http.StatusNoContent, put(entry1ID, upload.UploadID, 1, content[8:16]))
+	assert.Equal(t, http.StatusNoContent, put(entry1ID, upload.UploadID, 3, content[24:]))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, put(entry1ID, upload.UploadID, 4, "x"))
+	status, _ = commit(entry1ID, upload.UploadID, 4, "another contract", map[string]string{"path": "contract.pdf"})
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+
+	status, body = commit(entry1ID, upload.UploadID, 4, content, map[string]string{"path": "contract.pdf"})
+	require.Equal(t, http.StatusOK, status, body)
+	assert.Contains(t, body, entry1ID)
+	assert.Equal(t, content, file(entry1ID))
+	status, _ = check(entry1ID, upload.UploadID, token)
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = commit(entry1ID, upload.UploadID, 4, content, nil)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// Another upload replaces the file of the entry
+	replacement := "v2"
+	upload = start(entry1ID, len(replacement))
+	assert.Equal(t, http.StatusNoContent, put(entry1ID, upload.UploadID, 0, replacement))
+	status, body = commit(entry1ID, upload.UploadID, 1, replacement, nil)
+	require.Equal(t, http.StatusOK, status, body)
+	assert.Equal(t, replacement, file(entry1ID))
+	status, body = readResponse(t, doJSON(t, http.MethodGet,
+		fmt.Sprintf("%s/getData/FilesData/%d/%s", srv.URL, userID, entry1ID), token, nil))
+	require.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, "contract.pdf")
+
+	// The file of an entry of another user isn't overwritten: no session is started for its id,
+	// and an upload to an id another user took meanwhile fails its commit
+	status, _ = readResponse(t, doJSON(t, http.MethodPost, srv.URL+"/api/files/"+entry1ID+"/upload", otherToken, map[string]int{"size": 2}))
+	assert.Equal(t, http.StatusConflict, status)
+	upload = start(entry3ID, len(replacement))
+	assert.Equal(t, http.StatusNoContent, put(entry3ID, upload.UploadID, 0, replacement))
+	status, body = readResponse(t, doJSON(t, http.MethodPost,
+		fmt.Sprintf("%s/addData/FilesData/%d/%s", srv.URL, otherID, entry3ID), otherToken, map[string]string{"path": "theirs.pdf"}))
+	require.Equal(t, http.StatusOK, status, body)
+	status, _ = commit(entry3ID, upload.UploadID, 1, replacement, nil)
+	assert.Equal(t, http.StatusConflict, status)
+	_, err = os.Stat(filepath.Join(files, entry3ID))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	status, _ = readResponse(t, doJSON(t, http.MethodDelete, fmt.Sprintf("%s/api/files/%s/upload/%s", srv.URL, entry3ID, upload.UploadID), token, nil))
+	assert.Equal(t, http.StatusNoContent, status)
+
+	// An abandoned upload is deleted with its chunks
+	upload = start(entry2ID, 4)
+	assert.Equal(t, http.StatusNoContent, put(entry2ID, upload.UploadID, 0, "scan"))
+	status, _ = readResponse(t, doJSON(t, http.MethodDelete, fmt.Sprintf("%s/api/files/%s/upload/%s", srv.URL, entry2ID, upload.UploadID), token, nil))
+	assert.Equal(t, http.StatusNoContent, status)
+	status, _ = check(entry2ID, upload.UploadID, token)
+	assert.Equal(t, http.StatusNotFound, status)
+	staged, err := os.ReadDir(filepath.Join(files, controllers.UploadStagingDir))
+	require.NoError(t, err)
+	assert.Empty(t, staged)
+}
+
+func TestServer_FileContent(t *testing.T) {
+	config.NewOptions().ParseFlags()
+	files := t.TempDir()
+	require.NoError(t, flag.Set("n", files))
+	t.Cleanup(func() { flag.Set("n", "") })
+	srv := newTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	userID, token := registerAndLogin(t, srv, "fiona", string(hash))
+	_, otherToken := registerAndLogin(t, srv, "felix", string(hash))
+
+	content := "encrypted scan of a contract"
+	require.NoError(t, os.WriteFile(filepath.Join(files, entry1ID), []byte(content), 0o600))
+	status, body := readResponse(t, doJSON(t, http.MethodPost,
+		fmt.Sprintf("%s/addData/FilesData/%d/%s", srv.URL, userID, entry1ID), token, map[string]string{"path": "docs/contract.pdf"}))
+	require.Equal(t, http.StatusOK, status, body)
+
+	get := func(token, entryID, rangeHeader string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/files/%s/content", srv.URL, entryID), nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", token)
+		req.Header.Set("Accept-Encoding", "gzip")
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// The whole file is streamed as it is stored
+	resp := get(token, entry1ID, "")
+	status, body = readResponse(t, resp)
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, content, body)
+	assert.Equal(t, "application/octet-stream", resp.Header.Get("Content-Type"))
+	assert.Equal(t, strconv.Itoa(len(content)), resp.Header.Get("Content-Length"))
+	assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+	assert.Equal(t, `attachment; filename=contract.pdf`, resp.Header.Get("Content-Disposition"))
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	etag := resp.Header.Get("ETag")
+	require.NotEmpty(t, etag)
+
+	// A dropped download resumes from where it stopped
+	resp = get(token, entry1ID, "bytes=10-")
+	status, body = readResponse(t, resp)
+	require.Equal(t, http.StatusPartialContent, status)
+	assert.Equal(t, content[10:], body)
+	assert.Equal(t, fmt.Sprintf("bytes 10-%d/%d", len(content)-1, len(content)), resp.Header.Get("Content-Range"))
+	assert.Equal(t, strconv.Itoa(len(content)-10), resp.Header.Get("Content-Length"))
+	status, _ = readResponse(t, get(token, entry1ID, fmt.Sprintf("bytes=%d-", len(content)+1)))
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, status)
+
+	// The sync and the pull carry the URL of the contents with the metadata of the entry
+	resp = doJSON(t, http.MethodPost, srv.URL+"/api/sync", token, map[string]any{"last_sync": time.Time{}})
+	var synced syncResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&synced))
+	resp.Body.Close()
+	require.Len(t, synced.Changes["FilesData"], 1)
+	entry := synced.Changes["FilesData"][0]
+	assert.Equal(t, "/api/files/"+entry1ID+"/content", entry["content_url"])
+	status, body = readResponse(t, doJSON(t, http.MethodGet,
+		fmt.Sprintf("%s/getAllData/FilesData/%d/%s", srv.URL, userID, time.Time{}.Format(time.RFC3339)), token, nil))
+	require.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `"content_url":"/api/files/`+entry1ID+`/content"`)
+
+	// A client sending the entry back without the fields the server owns doesn't store the URL
+	for _, key := range []string{"id", "user_id", "updated_at", "deleted"} {
+		delete(entry, key)
+	}
+	entry["path"] = "docs/signed contract.pdf"
+	status, body = readResponse(t, doJSON(t, http.MethodPut,
+		fmt.Sprintf("%s/updateData/FilesData/%d/%s", srv.URL, userID, entry1ID), token, entry))
+	require.Equal(t, http.StatusOK, status, body)
+	assert.Equal(t, `attachment; filename="signed contract.pdf"`, get(token, entry1ID, "").Header.Get("Content-Disposition"))
+
+	// Another user, an entry without a file and a deleted entry don't find it
+	status, _ = readResponse(t, get(otherToken, entry1ID, ""))
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = readResponse(t, get(token, missingID, ""))
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = readResponse(t, doJSON(t, http.MethodPost,
+		fmt.Sprintf("%s/addData/FilesData/%d/%s", srv.URL, userID, entry2ID), token, map[string]string{"path": "lost.pdf"}))
+	require.Equal(t, http.StatusOK, status)
+	status, _ = readResponse(t, get(token, entry2ID, ""))
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = readResponse(t, get(token, "not-a-uuid", ""))
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, _ = readResponse(t, doJSON(t, http.MethodDelete,
+		fmt.Sprintf("%s/deleteData/FilesData/%d/%s", srv.URL, userID, entry1ID), token, nil))
+	require.Equal(t, http.StatusOK, status)
+	status, _ = readResponse(t, get(token, entry1ID, ""))
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestServer_BlobStore(t *testing.T) {
+	option := config.NewOptions()
+	option.ParseFlags()
+	files := t.TempDir()
+	require.NoError(t, flag.Set("n", files))
+	t.Cleanup(func() { flag.Set("n", "") })
+
+	nLogger, err := logger.NewLogger(option.LogLevel())
+	require.NoError(t, err)
+	blobs, err := objstore.NewFS(t.TempDir())
+	require.NoError(t, err)
+	srv := httptest.NewServer(newRouter(storage.NewMemKeeper(), option, nLogger, nil, nil, newHealthState(time.Minute), nil, nil, nil, blobs))
+	t.Cleanup(srv.Close)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	userID, token := registerAndLogin(t, srv, "bella", string(hash))
+
+	upload := func(entryID, content string) {
+		resp := doJSON(t, http.MethodPost, fmt.Sprintf("%s/api/files/%s/upload", srv.URL, entryID), token, map[string]int{"size": len(content)})
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		var session struct {
+			UploadID string `json:"upload_id"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&session))
+		resp.Body.Close()
+
+		req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/api/files/%s/upload/%s/0", srv.URL, entryID, session.UploadID), strings.NewReader(content))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", token)
+		resp, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		status, _ := readResponse(t, resp)
+		require.Equal(t, http.StatusNoContent, status)
+
+		sum := sha256.Sum256([]byte(content))
+		status, body := readResponse(t, doJSON(t, http.MethodPost, fmt.Sprintf("%s/api/files/%s/upload/%s/commit", srv.URL, entryID, session.UploadID),
+			token, map[string]any{"chunks": 1, "sha256": hex.EncodeToString(sum[:]), "fields": map[string]string{"path": "scan.pdf"}}))
+		require.Equal(t, http.StatusOK, status, body)
+	}
+	content := func(entryID string) string {
+		status, body := readResponse(t, doJSON(t, http.MethodGet, fmt.Sprintf("%s/api/files/%s/content", srv.URL, entryID), token, nil))
+		require.Equal(t, http.StatusOK, status)
+		return body
+	}
+	stored := func() []string {
+		var keys []string
+		require.NoError(t, blobs.List(context.Background(), controllers.FileBlobPrefix, func(info objstore.Info) error {
+			keys = append(keys, info.Key)
+			return nil
+		}))
+		return keys
+	}
+
+	// A file kept on disk before the store was configured is still served
+	require.NoError(t, os.WriteFile(filepath.Join(files, entry1ID), []byte("legacy scan"), 0o600))
+	status, body := readResponse(t, doJSON(t, http.MethodPost,
+		fmt.Sprintf("%s/addData/FilesData/%d/%s", srv.URL, userID, entry1ID), token, map[string]string{"path": "scan.pdf"}))
+	require.Equal(t, http.StatusOK, status, body)
+	assert.Equal(t, "legacy scan", content(entry1ID))
+
+	// An upload moves it into the store
+	upload(entry1ID, "first scan")
+	assert.Equal(t, "first scan", content(entry1ID))
+	_, err = os.Stat(filepath.Join(files, entry1ID))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	first := stored()
+	require.Len(t, first, 1)
+	sum := sha256.Sum256([]byte("first scan"))
+	assert.True(t, strings.HasPrefix(first[0], controllers.FileBlobPrefix+hex.EncodeToString(sum[:])+"/"))
+
+	// A new upload gets a new object, the previous one is deleted
+	upload(entry1ID, "second scan")
+	assert.Equal(t, "second scan", content(entry1ID))
+	second := stored()
+	require.Len(t, second, 1)
+	assert.NotEqual(t, first, second)
+
+	// The same contents uploaded for another entry are stored once
+	upload(entry3ID, "second scan")
+	assert.Equal(t, "second scan", content(entry3ID))
+	assert.Equal(t, second, stored())
+
+	// A new entry is added with its object, the export reads it from the store
+	upload(entry2ID, "passport")
+	assert.Equal(t, "passport", content(entry2ID))
+	assert.Len(t, stored(), 2)
+	status, body = readResponse(t, doJSON(t, http.MethodGet, srv.URL+"/api/export?format=zip", token, nil))
+	require.Equal(t, http.StatusOK, status)
+	archive, err := zip.NewReader(strings.NewReader(body), int64(len(body)))
+	require.NoError(t, err)
+	exported, err := archive.Open("files/" + entry2ID)
+	require.NoError(t, err)
+	b, err := io.ReadAll(exported)
+	exported.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "passport", string(b))
+
+	// The clients can't point an entry at an object
+	status, _ = readResponse(t, doJSON(t, http.MethodPut, fmt.Sprintf("%s/updateData/FilesData/%d/%s", srv.URL, userID, entry2ID),
+		token, map[string]string{"path": "scan.pdf", "blob_key": second[0]}))
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "passport", content(entry2ID))
+}
+
+// partitionTransport fails the requests while the network is partitioned.
+type partitionTransport struct {
+	down atomic.Bool
+}
+
+func (p *partitionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if p.down.Load() {
+		return nil, errors.New("network is unreachable")
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestServer_Replication(t *testing.T) {
+	option := config.NewOptions()
+	option.ParseFlags()
+	nLogger, err := logger.NewLogger(option.LogLevel())
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	primary := httptest.NewServer(newRouter(storage.NewMemKeeper(), option, nLogger, nil, nil, newHealthState(time.Minute), nil, nil, nil, nil))
+	t.Cleanup(primary.Close)
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	primaryID, primaryToken := registerAndLogin(t, primary, "victor", string(hash))
+	resp := doJSON(t, http.MethodPost, primary.URL+"/api/user/apikeys", primaryToken, map[string]any{"label": "replica", "scopes": []string{models.ScopeRead}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var apiKey struct {
+		Key string `json:"key"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&apiKey))
+	resp.Body.Close()
+
+	// The secondary replicates the vault of the user of the same name, whose id differs there
+	keeper := storage.NewMemKeeper()
+	transport := &partitionTransport{}
+	replicator := replication.New(keeper, replication.NewClient(primary.URL, apiKey.Key, &http.Client{Transport: transport}),
+		primary.URL, "victor", nLogger)
+	secondary := httptest.NewServer(newRouter(keeper, option, nLogger, nil, nil, newHealthState(time.Minute), nil, nil, replicator, nil))
+	t.Cleanup(secondary.Close)
+	adminID, _ := registerAndLogin(t, secondary, "wendy", string(hash))
+	secondaryID, secondaryToken := registerAndLogin(t, secondary, "victor", string(hash))
+	require.NotEqual(t, primaryID, secondaryID)
+
+	checksum := func(srv *httptest.Server, token string) models.VaultChecksum {
+		t.Helper()
+		resp := doJSON(t, http.MethodGet, srv.URL+"/api/vault/checksum", token, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var sum models.VaultChecksum
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&sum))
+		resp.Body.Close()
+		return sum
+	}
+	converged := func() {
+		t.Helper()
+		want, got := checksum(primary, primaryToken), checksum(secondary, secondaryToken)
+		assert.Equal(t, want.Checksum, got.Checksum)
+		assert.Equal(t, want.Entries, got.Entries)
+		assert.Equal(t, secondaryID, got.UserID)
+	}
+	entries := func(srv *httptest.Server, userID int, token, table string) []map[string]string {
+		t.Helper()
+		resp := doJSON(t, http.MethodGet, fmt.Sprintf("%s/getAllData/%s/%d/0001-01-01T00:00:00Z", srv.URL, table, userID), token, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var rows []map[string]string
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&rows))
+		resp.Body.Close()
+		return rows
+	}
+	write := func(method, path string, fields map[string]string) {
+		t.Helper()
+		status, body := readResponse(t, doJSON(t, method, primary.URL+path, primaryToken, fields))
+		require.Equal(t, http.StatusOK, status, body)
+	}
+	entryID := func(i int) string { return fmt.Sprintf("6f1e2a4c-3b5d-4e7f-8a9b-%012d", i) }
+
+	// A burst of changes on the primary across the tables
+	for i := 0; i < 8; i++ {
+		write(http.MethodPost, fmt.Sprintf("/addData/UserCredentials/%d/%s", primaryID, entryID(i)),
+			map[string]string{"login": fmt.Sprintf("login%d", i), "password": "sealed"})
+	}
+	write(http.MethodPost, fmt.Sprintf("/addData/TextData/%d/%s", primaryID, entry1ID), map[string]string{"data": "sealed"})
+	for i := 0; i < 3; i++ {
+		write(http.MethodPut, fmt.Sprintf("/updateData/UserCredentials/%d/%s", primaryID, entryID(i)), map[string]string{"login": "renamed"})
+	}
+	write(http.MethodDelete, fmt.Sprintf("/deleteData/UserCredentials/%d/%s", primaryID, entryID(7)), nil)
+
+	require.NoError(t, replicator.Sync(ctx))
+	converged()
+	replicated := entries(secondary, secondaryID, secondaryToken, "UserCredentials")
+	require.Len(t, replicated, 7)
+	for _, entry := range replicated {
+		if entry["id"] == entryID(0) {
+			assert.Equal(t, "renamed", entry["login"])
+		}
+	}
+	assert.Len(t, entries(secondary, secondaryID, secondaryToken, "TextData"), 1)
+	assert.Equal(t, 9, replicator.Status().Applied)
+
+	// The writes of the user on the secondary are rejected, the reads and the pulls aren't
+	status, _ := readResponse(t, doJSON(t, http.MethodPost, fmt.Sprintf("%s/addData/UserCredentials/%d/%s", secondary.URL, secondaryID, entry2ID),
+		secondaryToken, map[string]string{"login": "local"}))
+	assert.Equal(t, http.StatusConflict, status)
+	status, _ = readResponse(t, doJSON(t, http.MethodDelete, fmt.Sprintf("%s/deleteData/UserCredentials/%d/%s", secondary.URL, secondaryID, entryID(0)),
+		secondaryToken, nil))
+	assert.Equal(t, http.StatusConflict, status)
+	status, _ = readResponse(t, doJSON(t, http.MethodPost, secondary.URL+"/api/sync", secondaryToken, map[string]any{
+		"changes": []map[string]any{{"table": "UserCredentials", "op": "add", "entry_id": entry2ID, "fields": map[string]string{"login": "local"}}},
+	}))
+	assert.Equal(t, http.StatusConflict, status)
+	status, body := readResponse(t, doJSON(t, http.MethodPost, secondary.URL+"/api/sync", secondaryToken, map[string]any{}))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, "renamed")
+
+	// Nothing changed, the next round applies nothing
+	require.NoError(t, replicator.Sync(ctx))
+	assert.Zero(t, replicator.Status().Applied)
+
+	// The primary purges the vault, its tombstones are replicated
+	for _, entry := range entries(primary, primaryID, primaryToken, "UserCredentials") {
+		write(http.MethodDelete, fmt.Sprintf("/deleteData/UserCredentials/%d/%s", primaryID, entry["id"]), nil)
+	}
+	write(http.MethodDelete, fmt.Sprintf("/deleteData/TextData/%d/%s", primaryID, entry1ID), nil)
+	require.NoError(t, replicator.Sync(ctx))
+	converged()
+	assert.Empty(t, entries(secondary, secondaryID, secondaryToken, "UserCredentials"))
+	assert.Empty(t, entries(secondary, secondaryID, secondaryToken, "TextData"))
+
+	// A partition fails the rounds and the lag grows, until the network heals
+	transport.down.Store(true)
+	write(http.MethodPost, fmt.Sprintf("/addData/UserCredentials/%d/%s", primaryID, entry3ID), map[string]string{"login": "during partition"})
+	require.Error(t, replicator.Sync(ctx))
+	partitioned := replicator.Status()
+	assert.False(t, partitioned.Converged)
+	assert.Contains(t, partitioned.LastError, "network is unreachable")
+	time.Sleep(20 * time.Millisecond)
+	require.Error(t, replicator.Sync(ctx))
+	assert.Greater(t, replicator.Status().LagSeconds, partitioned.LagSeconds)
+
+	transport.down.Store(false)
+	require.NoError(t, replicator.Sync(ctx))
+	converged()
+	healed := replicator.Status()
+	assert.True(t, healed.Converged)
+	assert.Empty(t, healed.LastError)
+	assert.Equal(t, 1, healed.Applied)
+	assert.Len(t, entries(secondary, secondaryID, secondaryToken, "UserCredentials"), 1)
+
+	// The admins see the state of the replication, a server which doesn't replicate has none
+	require.NoError(t, keeper.SetUserRole(ctx, adminID, models.RoleAdmin))
+	adminToken := loginAs(t, secondary, "wendy", string(hash))
+	status, body = readResponse(t, doJSON(t, http.MethodGet, secondary.URL+"/api/admin/replication", adminToken, nil))
+	require.Equal(t, http.StatusOK, status)
+	var got models.ReplicationStatus
+	require.NoError(t, json.Unmarshal([]byte(body), &got))
+	assert.Equal(t, primary.URL, got.Primary)
+	assert.Equal(t, "victor", got.Username)
+	assert.True(t, got.Converged)
+	assert.NotEmpty(t, got.Checksum)
+	assert.NotNil(t, got.SyncedAt)
+	assert.NotContains(t, body, apiKey.Key)
+	status, _ = readResponse(t, doJSON(t, http.MethodGet, secondary.URL+"/api/admin/replication", secondaryToken, nil))
+	assert.Equal(t, http.StatusForbidden, status)
+}
@@ -0,0 +1,142 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/config"
+	"github.com/wurt83ow/gophkeeper-server/internal/controllers"
+	"github.com/wurt83ow/gophkeeper-server/internal/egress"
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"github.com/wurt83ow/gophkeeper-server/internal/objstore"
+	"github.com/wurt83ow/gophkeeper-server/internal/storage"
+	"go.uber.org/zap"
+)
+
+// jobBlobReconciliation is the name of the background job deleting the objects of the blob store
+// no file entry points at.
+const jobBlobReconciliation = "blob_reconciliation"
+
+// defaultBlobDir is the directory of the filesystem blob store under the file storage unless one is configured.
+// The dot keeps it apart from the files named by their entry ids.
+const defaultBlobDir = ".blobs"
+
+// reconcileBatchSize is the number of keys looked up in the keeper at once by the reconciliation.
+const reconcileBatchSize = 500
+
+// newBlobStore creates the blob store of the options, nil if the files are kept in the file storage.
+// An S3 compatible store is reached through the egress policy.
+func newBlobStore(option *config.Options, policy *egress.Policy) (objstore.BlobStore, error) {
+	switch option.BlobStore() {
+	case "":
+		return nil, nil
+	case "fs":
+		dir := option.BlobDir()
+		if dir == "" {
+			dir = filepath.Join(option.FileStoragePath(), defaultBlobDir)
+		}
+		store, err := objstore.NewFS(dir)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case "s3":
+		// A transfer takes as long as the file needs, it ends with the request it serves
+		store, err := objstore.NewS3(objstore.S3Config{
+			Endpoint:  option.S3Endpoint(),
+			Region:    option.S3Region(),
+			Bucket:    option.S3Bucket(),
+			AccessKey: option.S3AccessKey(),
+			SecretKey: option.S3SecretKey(),
+			PathStyle: option.S3PathStyle(),
+		}, policy.HTTPClient(egress.ClassObjectStore, 0))
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+
+	return nil, fmt.Errorf("unknown blob store %q, fs or s3 expected", option.BlobStore())
+}
+
+// runBlobReconciliation deletes the objects of the files no entry points at every interval until the context
+// is done: the objects put by an upload failing before its entry was written, and the ones of the deleted users.
+// An object is put before the entry pointing at it is written, so only the objects older than the grace are
+// deleted. In dry-run mode it only logs what it would delete.
+func runBlobReconciliation(ctx context.Context, keeper storage.Keeper, blobs objstore.BlobStore,
+	interval, grace time.Duration, dryRun bool, log *logger.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			orphans, err := orphanedBlobs(ctx, keeper, blobs, time.Now().Add(-grace))
+			if err != nil {
+				log.Error("failed to look up orphaned blobs", zap.Error(err))
+				continue
+			}
+			if dryRun {
+				if len(orphans) > 0 {
+					log.Info("dry run: orphaned blobs would be deleted", zap.String("job", jobBlobReconciliation),
+						zap.Int("blobs", len(orphans)), zap.Strings("sample", orphans[:min(len(orphans), dryRunSample)]))
+				}
+				continue
+			}
+
+			deleted := 0
+			for _, key := range orphans {
+				if err := blobs.Delete(ctx, key); err != nil {
+					log.Warn("failed to delete orphaned blob", zap.String("key", key), zap.Error(err))
+					continue
+				}
+				deleted++
+			}
+			if deleted > 0 {
+				log.Info("orphaned blobs deleted", zap.Int("blobs", deleted))
+			}
+		}
+	}
+}
+
+// orphanedBlobs returns the keys of the objects of the files put before the given time which no entry points at.
+// The objects are all listed before any is deleted, a listing doesn't survive the deletions of some stores.
+func orphanedBlobs(ctx context.Context, keeper storage.Keeper, blobs objstore.BlobStore, before time.Time) ([]string, error) {
+	var orphans, batch []string
+	check := func() error {
+		referenced, err := keeper.ReferencedBlobs(ctx, batch)
+		if err != nil {
+			return err
+		}
+		for _, key := range batch {
+			if !referenced[key] {
+				orphans = append(orphans, key)
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	err := blobs.List(ctx, controllers.FileBlobPrefix, func(info objstore.Info) error {
+		if !info.ModTime.Before(before) {
+			return nil
+		}
+		batch = append(batch, info.Key)
+		if len(batch) == reconcileBatchSize {
+			return check()
+		}
+		return nil
+	})
+	if err == nil && len(batch) > 0 {
+		err = check()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return orphans, nil
+}
@@ -0,0 +1,202 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"github.com/wurt83ow/gophkeeper-server/internal/storage"
+	"go.uber.org/zap"
+)
+
+// The names of the background jobs deleting data, as configured to run in dry-run mode.
+const (
+	jobExpiry       = "expiry"
+	jobAuditPruning = "audit_pruning"
+)
+
+// dryRunSample is the number of identifiers a dry run logs of the rows the job would delete.
+const dryRunSample = 10
+
+// parseDryRunJobs returns the set of the jobs named by the comma-separated list.
+// An unknown name is an error, a misspelled job would otherwise delete for real.
+func parseDryRunJobs(list string) (map[string]bool, error) {
+	jobs := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "":
+		case jobExpiry, jobAuditPruning, jobBlobReconciliation:
+			jobs[name] = true
+		default:
+			return nil, fmt.Errorf("unknown dry-run job %q", name)
+		}
+	}
+
+	return jobs, nil
+}
+
+// runExpiry deletes the expired entries of the keeper every interval until the context is done.
+// The entries become tombstones, so the deletion reaches the clients with their next synchronization.
+// In dry-run mode it only logs what it would delete.
+func runExpiry(ctx context.Context, keeper storage.Keeper, interval time.Duration, dryRun bool, log *logger.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if dryRun {
+				preview, err := keeper.PreviewExpiry(ctx, dryRunSample)
+				if err != nil {
+					log.Error("failed to preview expired entries", zap.Error(err))
+					continue
+				}
+				log.Info("dry run: expired entries would be deleted", zap.String("job", jobExpiry),
+					zap.Int("entries", preview.Count), zap.Strings("sample", preview.Sample))
+				continue
+			}
+
+			expired, err := keeper.ExpireData(ctx)
+			if err != nil {
+				log.Error("failed to delete expired entries", zap.Error(err))
+				continue
+			}
+			if expired > 0 {
+				log.Info("expired entries deleted", zap.Int("entries", expired))
+			}
+		}
+	}
+}
+
+// auditPruneInterval is the interval of deleting the audit events older than the retention.
+const auditPruneInterval = time.Hour
+
+// runAuditPruning deletes the audit events recorded more than retention ago every interval
+// until the context is done. In dry-run mode it only logs what it would delete.
+func runAuditPruning(ctx context.Context, keeper storage.Keeper, interval, retention time.Duration, dryRun bool, log *logger.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			before := time.Now().Add(-retention)
+			if dryRun {
+				preview, err := keeper.PreviewAuditPruning(ctx, before, dryRunSample)
+				if err != nil {
+					log.Error("failed to preview audit pruning", zap.Error(err))
+					continue
+				}
+				log.Info("dry run: audit events would be pruned", zap.String("job", jobAuditPruning),
+					zap.Int("events", preview.Count), zap.Strings("sample", preview.Sample))
+				continue
+			}
+
+			pruned, err := keeper.PruneAuditEvents(ctx, before)
+			if err != nil {
+				log.Error("failed to prune audit events", zap.Error(err))
+				continue
+			}
+			if pruned > 0 {
+				log.Info("audit events pruned", zap.Int("events", pruned))
+			}
+		}
+	}
+}
+
+// jobRevokedTokenPruning is the name of the background job deleting the revocations of the expired tokens.
+const jobRevokedTokenPruning = "revoked_token_pruning"
+
+// revokedTokenPruneInterval is the interval of deleting the revocations of the expired access tokens.
+const revokedTokenPruneInterval = time.Hour
+
+// runRevokedTokenPruning deletes the revocations of the access tokens expired since every interval
+// until the context is done, an expired token is rejected anyway.
+func runRevokedTokenPruning(ctx context.Context, keeper storage.Keeper, interval time.Duration, log *logger.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pruned, err := keeper.PruneRevokedTokens(ctx, time.Now())
+			if err != nil {
+				log.Error("failed to prune revoked tokens", zap.Error(err))
+				continue
+			}
+			if pruned > 0 {
+				log.Info("revoked tokens pruned", zap.Int("tokens", pruned))
+			}
+		}
+	}
+}
+
+// jobUploadPruning is the name of the background job deleting the expired upload sessions.
+const jobUploadPruning = "upload_pruning"
+
+// uploadPruneInterval is the interval of deleting the expired upload sessions and their chunks.
+const uploadPruneInterval = 10 * time.Minute
+
+// runUploadPruning deletes the upload sessions expired since, with their chunks staged under the directory,
+// every interval until the context is done. The staging directories untouched for the ttl are deleted too,
+// they are left of sessions deleted without them, a session expires within the ttl.
+func runUploadPruning(ctx context.Context, keeper storage.Keeper, staging string, interval, ttl time.Duration, log *logger.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pruned, err := keeper.PruneUploadSessions(ctx, time.Now())
+			if err != nil {
+				log.Error("failed to prune upload sessions", zap.Error(err))
+				continue
+			}
+			for _, id := range pruned {
+				if err := os.RemoveAll(filepath.Join(staging, id)); err != nil {
+					log.Warn("failed to delete staged chunks", zap.String("upload_id", id), zap.Error(err))
+				}
+			}
+			if len(pruned) > 0 {
+				log.Info("upload sessions pruned", zap.Int("sessions", len(pruned)))
+			}
+
+			sweepStaging(staging, time.Now().Add(-ttl), log)
+		}
+	}
+}
+
+// sweepStaging deletes the staging directories last modified before the given time.
+func sweepStaging(staging string, before time.Time, log *logger.Logger) {
+	dirs, err := os.ReadDir(staging)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Error("failed to read staged uploads", zap.Error(err))
+		}
+		return
+	}
+
+	for _, dir := range dirs {
+		info, err := dir.Info()
+		if err != nil || !info.ModTime().Before(before) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(staging, dir.Name())); err != nil {
+			log.Warn("failed to delete staged chunks", zap.String("upload_id", dir.Name()), zap.Error(err))
+		}
+	}
+}
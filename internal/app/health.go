@@ -0,0 +1,86 @@
+package app
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"github.com/wurt83ow/gophkeeper-server/internal/storage"
+	"go.uber.org/zap"
+)
+
+// jobHealthCheck is the name of the background job checking the health served to the uptime monitors.
+const jobHealthCheck = "health_check"
+
+// healthStaleChecks is the number of check intervals after which the last check is no longer trusted.
+const healthStaleChecks = 3
+
+// The coarse statuses of the monitor ping.
+const (
+	healthOK          = "ok"
+	healthUnavailable = "unavailable"
+	healthStale       = "stale"
+)
+
+// healthState is the reachability of the keeper as last checked in the background, served to the uptime
+// monitors so that a ping never reaches the keeper. A check older than maxAge isn't trusted: the checks
+// stopped or hang, and the monitors are told the state is stale.
+type healthState struct {
+	maxAge time.Duration
+	now    func() time.Time
+
+	mu        sync.RWMutex
+	up        bool
+	checkedAt time.Time
+}
+
+// newHealthState creates the state of the checks run every interval, stale until the first one.
+func newHealthState(interval time.Duration) *healthState {
+	return &healthState{maxAge: healthStaleChecks * interval, now: time.Now}
+}
+
+// record records the result of a check made now.
+func (h *healthState) record(up bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.up = up
+	h.checkedAt = h.now()
+}
+
+// Status returns whether the keeper was reachable at the last check and the status of the monitor ping.
+// The server is reported down while there is no recent check.
+func (h *healthState) Status() (bool, string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	switch {
+	case h.checkedAt.IsZero() || h.now().Sub(h.checkedAt) > h.maxAge:
+		return false, healthStale
+	case !h.up:
+		return false, healthUnavailable
+	default:
+		return true, healthOK
+	}
+}
+
+// runHealthCheck checks whether the keeper is reachable at once, then every interval until the context is done.
+func runHealthCheck(ctx context.Context, keeper storage.Keeper, state *healthState, interval time.Duration, log *logger.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		up := keeper.Ping()
+		state.record(up)
+		if !up {
+			log.Warn("health check failed, the keeper is unreachable", zap.String("job", jobHealthCheck))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package app
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"go.uber.org/zap"
+)
+
+// stage is a step of the shutdown. The stages stop in their order, each one once the components
+// of the previous one stopped or its timeout expired.
+type stage int
+
+const (
+	// stageServe stops accepting requests and waits for the requests in flight.
+	stageServe stage = iota
+	// stageJobs cancels the background jobs and waits for the batches they are running.
+	stageJobs
+	// stageKeeper waits for the queries in flight and closes the keeper.
+	stageKeeper
+
+	stageCount
+)
+
+var stageNames = [stageCount]string{"serve", "jobs", "keeper"}
+
+func (s stage) String() string {
+	return stageNames[s]
+}
+
+// stageTimeouts are the default timeouts of the stages.
+var stageTimeouts = [stageCount]time.Duration{
+	stageServe:  5 * time.Second,
+	stageJobs:   5 * time.Second,
+	stageKeeper: 5 * time.Second,
+}
+
+// stopFunc stops a component, it returns once the component stopped or ctx is done.
+type stopFunc func(ctx context.Context) error
+
+// component is a part of the server stopped at shutdown.
+type component struct {
+	name string
+	stop stopFunc
+}
+
+// lifecycle stops the components of the server in the order of their stages, so none of them
+// outlives what it depends on: the jobs are stopped before the keeper they query is closed.
+// The components of a stage are stopped concurrently. A stage which doesn't stop within its
+// timeout is left behind, the components still running are logged.
+type lifecycle struct {
+	log      *logger.Logger
+	timeouts [stageCount]time.Duration
+
+	mu     sync.Mutex
+	stages [stageCount][]component
+}
+
+// newLifecycle creates a lifecycle with the default timeouts of the stages.
+func newLifecycle(log *logger.Logger) *lifecycle {
+	return &lifecycle{log: log, timeouts: stageTimeouts}
+}
+
+// register adds a component stopped with the stage.
+func (l *lifecycle) register(s stage, name string, stop stopFunc) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.stages[s] = append(l.stages[s], component{name: name, stop: stop})
+}
+
+// startJob runs the job in the background until the stage of the jobs stops it:
+// its context is canceled and its stop waits for it to return.
+func (l *lifecycle) startJob(ctx context.Context, name string, run func(ctx context.Context)) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		run(ctx)
+	}()
+
+	l.register(stageJobs, name, func(stopCtx context.Context) error {
+		cancel()
+		select {
+		case <-done:
+			return nil
+		case <-stopCtx.Done():
+			return stopCtx.Err()
+		}
+	})
+}
+
+// shutdown stops the registered components stage by stage. It returns once every stage stopped
+// or timed out.
+func (l *lifecycle) shutdown() {
+	for s := stage(0); s < stageCount; s++ {
+		l.mu.Lock()
+		components := append([]component(nil), l.stages[s]...)
+		l.mu.Unlock()
+
+		l.stopStage(s, components)
+	}
+}
+
+// stopped reports a component of a stage which returned from its stop.
+type stopped struct {
+	index int
+	err   error
+}
+
+// stopStage stops the components of the stage concurrently and waits for them until the timeout of the stage.
+func (l *lifecycle) stopStage(s stage, components []component) {
+	if len(components) == 0 {
+		return
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), l.timeouts[s])
+	defer cancel()
+
+	// The channel is buffered, the components stopping after the timeout don't block
+	results := make(chan stopped, len(components))
+	running := make(map[int]bool, len(components))
+	for i, c := range components {
+		running[i] = true
+		go func(i int, stop stopFunc) {
+			results <- stopped{index: i, err: stop(ctx)}
+		}(i, c.stop)
+	}
+
+	for len(running) > 0 {
+		select {
+		case r := <-results:
+			delete(running, r.index)
+			if r.err != nil {
+				l.log.Error("failed to stop component", zap.String("stage", s.String()),
+					zap.String("component", components[r.index].name), zap.Error(r.err))
+			}
+		case <-ctx.Done():
+			names := make([]string, 0, len(running))
+			for i := range running {
+				names = append(names, components[i].name)
+			}
+			sort.Strings(names)
+			l.log.Warn("shutdown stage timed out, moving on", zap.String("stage", s.String()),
+				zap.Duration("timeout", l.timeouts[s]), zap.Strings("running", names))
+			return
+		}
+	}
+
+	l.log.Info("shutdown stage done", zap.String("stage", s.String()), zap.Duration("elapsed", time.Since(start)))
+}
@@ -0,0 +1,75 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLifecycle_Shutdown(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	l := newLifecycle(logger.FromZap(zap.New(core)))
+	l.timeouts = [stageCount]time.Duration{stageServe: time.Second, stageJobs: 100 * time.Millisecond, stageKeeper: time.Second}
+
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, name)
+	}
+
+	// Registered out of order, the stages decide
+	l.register(stageKeeper, "keeper", func(ctx context.Context) error {
+		record("keeper")
+		return nil
+	})
+	l.register(stageServe, "http", func(ctx context.Context) error {
+		record("http")
+		return errors.New("listener already closed")
+	})
+
+	// A slow job persists its checkpoint within the grace period, a hung one ignores the cancellation
+	l.startJob(context.Background(), "slow", func(ctx context.Context) {
+		<-ctx.Done()
+		time.Sleep(20 * time.Millisecond)
+		record("slow")
+	})
+	release := make(chan struct{})
+	defer close(release)
+	l.startJob(context.Background(), "hung", func(ctx context.Context) {
+		<-release
+	})
+
+	start := time.Now()
+	l.shutdown()
+
+	// The keeper is closed after the slow job finished, the hung one only delays it by the timeout
+	assert.Equal(t, []string{"http", "slow", "keeper"}, order)
+	assert.Less(t, time.Since(start), time.Second)
+
+	timedOut := logs.FilterMessage("shutdown stage timed out, moving on").All()
+	require.Len(t, timedOut, 1)
+	assert.Equal(t, "jobs", timedOut[0].ContextMap()["stage"])
+	assert.Equal(t, []interface{}{"hung"}, timedOut[0].ContextMap()["running"])
+
+	failed := logs.FilterMessage("failed to stop component").All()
+	require.Len(t, failed, 1)
+	assert.Equal(t, "http", failed[0].ContextMap()["component"])
+
+	// The stages which stopped in time are reported as done, in order
+	var done []interface{}
+	for _, entry := range logs.FilterMessage("shutdown stage done").All() {
+		done = append(done, entry.ContextMap()["stage"])
+	}
+	assert.Equal(t, []interface{}{"serve", "keeper"}, done)
+}
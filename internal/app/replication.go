@@ -0,0 +1,31 @@
+package app
+
+import (
+	"errors"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/config"
+	"github.com/wurt83ow/gophkeeper-server/internal/egress"
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"github.com/wurt83ow/gophkeeper-server/internal/replication"
+	"github.com/wurt83ow/gophkeeper-server/internal/storage"
+)
+
+// jobReplication is the name of the background job replicating the vault of a user from the primary server.
+const jobReplication = "replication"
+
+// replicationTimeout is the time a request to the primary server has to complete, a pull of a whole vault included.
+const replicationTimeout = time.Minute
+
+// newReplicator creates the replicator of the vault of the user of the options from the primary server,
+// which is reached through the egress policy.
+func newReplicator(keeper storage.Keeper, option *config.Options, policy *egress.Policy, log *logger.Logger) (*replication.Replicator, error) {
+	if option.ReplicationToken() == "" || option.ReplicationUser() == "" {
+		return nil, errors.New("the replication needs the API key and the username of the user on the primary server")
+	}
+
+	client := replication.NewClient(option.ReplicationPrimary(), option.ReplicationToken(),
+		policy.HTTPClient(egress.ClassReplication, replicationTimeout))
+
+	return replication.New(keeper, client, option.ReplicationPrimary(), option.ReplicationUser(), log), nil
+}
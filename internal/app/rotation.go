@@ -0,0 +1,61 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/bdkeeper"
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"go.uber.org/zap"
+)
+
+// jobKeyRotation is the name of the background job re-encrypting the entries with the current key.
+const jobKeyRotation = "key_rotation"
+
+// rotationRetryInterval is the interval of resuming a key rotation which failed.
+const rotationRetryInterval = time.Minute
+
+// keyRotator is implemented by the keepers encrypting the entries, whose keys are rotated while they serve.
+type keyRotator interface {
+	StartRotation(ctx context.Context) error
+	RotateKeys(ctx context.Context, batchSize int, report func(bdkeeper.RotationProgress)) error
+	VerifyRotation(ctx context.Context, sample int) error
+}
+
+// runKeyRotation re-encrypts the entries of the keeper with the current key in batches of batchSize, then
+// checks that sample rows per table decrypt with the current key alone. A failed rotation is resumed from
+// its last batch every retry until the context is done. The entries written meanwhile use the current key.
+func runKeyRotation(ctx context.Context, rotator keyRotator, batchSize, sample int, retry time.Duration, log *logger.Logger) {
+	report := func(p bdkeeper.RotationProgress) {
+		log.Info("key rotation progress", zap.String("table", p.Table), zap.Int("rotated", p.Rotated), zap.Bool("done", p.Done))
+	}
+
+	for {
+		err := rotator.StartRotation(ctx)
+		if err == nil {
+			err = rotator.RotateKeys(ctx, batchSize, report)
+		}
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Error("key rotation failed, resuming later", zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+	}
+
+	// A failed verification is left to the operator, the previous keys stay required
+	if err := rotator.VerifyRotation(ctx, sample); err != nil {
+		if ctx.Err() == nil {
+			log.Error("key rotation verification failed, the previous keys are still needed", zap.Error(err))
+		}
+		return
+	}
+	log.Info("key rotation verified, the previous keys can be removed")
+}
@@ -0,0 +1,107 @@
+package authz
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"go.uber.org/zap"
+)
+
+// apiKeyScheme starts the Authorization header of the requests authenticated by an API key.
+const apiKeyScheme = "ApiKey "
+
+// apiKeyPrefix starts the API keys, so a leaked one is recognized, by secret scanners too.
+const apiKeyPrefix = "gk_"
+
+// monitorTokenPrefix starts the tokens of the uptime monitors, told apart from the API keys.
+const monitorTokenPrefix = "gkm_"
+
+// apiKeySize is the number of random bytes of an API key or a monitor token.
+const apiKeySize = 32
+
+// apiKeyTouchInterval is how often the last use of a key is updated, a busy script doesn't write on every request.
+const apiKeyTouchInterval = time.Minute
+
+// NewAPIKey returns a new random API key. Only its hash is stored, see HashAPIKey.
+func (j *JWTAuthz) NewAPIKey() (string, error) {
+	return newSecret(apiKeyPrefix)
+}
+
+// HashAPIKey returns the hex SHA-256 of an API key, under which it is stored.
+// The keys are random like the refresh tokens, so they are hashed alike.
+func (j *JWTAuthz) HashAPIKey(key string) string {
+	return j.HashRefreshToken(key)
+}
+
+// NewMonitorToken returns a new random token of an uptime monitor. Only its hash is stored, see HashMonitorToken.
+func (j *JWTAuthz) NewMonitorToken() (string, error) {
+	return newSecret(monitorTokenPrefix)
+}
+
+// HashMonitorToken returns the hex SHA-256 of a monitor token, under which it is stored.
+func (j *JWTAuthz) HashMonitorToken(token string) string {
+	return j.HashRefreshToken(token)
+}
+
+// newSecret returns the prefix followed by apiKeySize random bytes in base64.
+func newSecret(prefix string) (string, error) {
+	b := make([]byte, apiKeySize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return prefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// serveAPIKey serves a request authenticated by the API key. A missing or expired key and the key
+// of a disabled user get 401, a key without the scope of the route gets 403.
+func (j *JWTAuthz) serveAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, storage Storage, log Log, token string) {
+	ctx := r.Context()
+
+	key, err := storage.GetAPIKeyByHash(ctx, j.HashAPIKey(token))
+	if errors.Is(err, models.ErrNotFound) {
+		http.Error(w, "Authorization error", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Info("Error occurred getting API key", zap.Error(err))
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if key.ExpiresAt != nil && !time.Now().Before(*key.ExpiresAt) {
+		http.Error(w, "Authorization error", http.StatusUnauthorized)
+		return
+	}
+
+	access, err := storage.GetUserAccess(ctx, key.UserID)
+	if errors.Is(err, models.ErrNotFound) || (err == nil && access.Disabled) {
+		http.Error(w, "Authorization error", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Info("Error occurred getting user access", zap.Error(err))
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// The routes set the scope they require, a route without one isn't open to the keys
+	var keyScope models.Key = "scope"
+	if scope, _ := ctx.Value(keyScope).(string); scope == "" || !key.HasScope(scope) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// The last use is only shown to the user, a failed update doesn't fail the request
+	if key.LastUsedAt == nil || time.Since(*key.LastUsedAt) >= apiKeyTouchInterval {
+		if err := storage.TouchAPIKey(ctx, key.ID); err != nil {
+			log.Info("Error occurred touching API key", zap.Int("api_key_id", key.ID), zap.Error(err))
+		}
+	}
+
+	next.ServeHTTP(w, r.WithContext(withUser(ctx, strconv.Itoa(key.UserID), access.Role)))
+}
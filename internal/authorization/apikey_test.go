@@ -0,0 +1,111 @@
+package authz
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+func TestJWTAuthz_NewAPIKey(t *testing.T) {
+	jwtAuthz := NewJWTAuthz("secret", &MockLogger{})
+
+	key, err := jwtAuthz.NewAPIKey()
+	require.NoError(t, err)
+	other, err := jwtAuthz.NewAPIKey()
+	require.NoError(t, err)
+	assert.NotEqual(t, key, other)
+	assert.True(t, strings.HasPrefix(key, apiKeyPrefix))
+
+	hash := jwtAuthz.HashAPIKey(key)
+	assert.Equal(t, hash, jwtAuthz.HashAPIKey(key))
+	assert.Len(t, hash, 64)
+	assert.NotContains(t, hash, key)
+}
+
+func TestJWTAuthz_NewMonitorToken(t *testing.T) {
+	jwtAuthz := NewJWTAuthz("secret", &MockLogger{})
+
+	token, err := jwtAuthz.NewMonitorToken()
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(token, monitorTokenPrefix))
+	assert.Len(t, jwtAuthz.HashMonitorToken(token), 64)
+
+	// A monitor token isn't an API key
+	key, err := jwtAuthz.NewAPIKey()
+	require.NoError(t, err)
+	assert.False(t, strings.HasPrefix(key, monitorTokenPrefix))
+}
+
+func TestJWTAuthz_Middleware_APIKey(t *testing.T) {
+	jwtAuthz := NewJWTAuthz("secret", &MockLogger{})
+	past := time.Now().Add(-time.Minute)
+	recent := time.Now().Add(-time.Second)
+
+	storage := &MockStorage{
+		roles:    map[int]string{1: models.RoleUser, 2: models.RoleUser},
+		disabled: map[int]bool{2: true},
+		keys:     map[string]models.APIKey{},
+	}
+	newKey := func(key models.APIKey) string {
+		token, err := jwtAuthz.NewAPIKey()
+		require.NoError(t, err)
+		storage.keys[jwtAuthz.HashAPIKey(token)] = key
+		return token
+	}
+	read := newKey(models.APIKey{ID: 1, UserID: 1, Scopes: []string{models.ScopeRead}})
+	write := newKey(models.APIKey{ID: 2, UserID: 1, Scopes: []string{models.ScopeRead, models.ScopeWrite}, LastUsedAt: &recent})
+	expired := newKey(models.APIKey{ID: 3, UserID: 1, Scopes: []string{models.ScopeRead}, ExpiresAt: &past})
+	disabled := newKey(models.APIKey{ID: 4, UserID: 2, Scopes: []string{models.ScopeRead}})
+
+	var userID string
+	handler := jwtAuthz.JWTAuthzMiddleware(storage, &MockLogger{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var keyUserID models.Key = "userID"
+		userID, _ = r.Context().Value(keyUserID).(string)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name  string
+		key   string
+		scope string
+		code  int
+	}{
+		{"read key reads", read, models.ScopeRead, http.StatusOK},
+		{"read key can't write", read, models.ScopeWrite, http.StatusForbidden},
+		{"write key writes", write, models.ScopeWrite, http.StatusOK},
+		{"no key manages the account", write, models.ScopeSession, http.StatusForbidden},
+		{"route without a scope", write, "", http.StatusForbidden},
+		{"expired key", expired, models.ScopeRead, http.StatusUnauthorized},
+		{"key of a disabled user", disabled, models.ScopeRead, http.StatusUnauthorized},
+		{"unknown key", "gk_unknown", models.ScopeRead, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userID = ""
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Authorization", apiKeyScheme+tt.key)
+			if tt.scope != "" {
+				var keyScope models.Key = "scope"
+				req = req.WithContext(context.WithValue(req.Context(), keyScope, tt.scope))
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.code, rr.Code)
+			if tt.code == http.StatusOK {
+				assert.Equal(t, "1", userID)
+			}
+		})
+	}
+
+	// The key used a second ago isn't touched again
+	assert.Equal(t, []int{1}, storage.touched)
+}
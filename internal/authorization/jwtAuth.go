@@ -3,13 +3,23 @@ package authz
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"github.com/wurt83ow/gophkeeper-server/internal/authorization/keys"
+	"github.com/wurt83ow/gophkeeper-server/internal/cache"
 	"github.com/wurt83ow/gophkeeper-server/internal/config"
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
 	"github.com/wurt83ow/gophkeeper-server/internal/models"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -18,11 +28,21 @@ import (
 
 // Storage is an interface representing methods for inserting user data.
 type Storage interface {
+	// GetUserAccess returns the role of the user, whether their account is disabled and the last change of their password.
+	GetUserAccess(ctx context.Context, userID int) (models.UserAccess, error)
+	// GetAPIKeyByHash returns the API key with the given hash, or models.ErrNotFound.
+	GetAPIKeyByHash(ctx context.Context, hash string) (models.APIKey, error)
+	// TouchAPIKey sets the last use of the API key to now.
+	TouchAPIKey(ctx context.Context, id int) error
+	// IsTokenRevoked reports whether the access token with the JWT ID is revoked.
+	IsTokenRevoked(ctx context.Context, jti string) (bool, error)
 }
 
 // CustomClaims represents custom claims for JWT token.
 type CustomClaims struct {
 	Email string `json:"email"`
+	// Role is the role of the user when the token was issued, empty for models.RoleUser
+	Role string `json:"role,omitempty"`
 	jwt.StandardClaims
 }
 
@@ -33,18 +53,56 @@ type Log interface {
 
 // JWTAuthz provides JWT token creation, decoding, and middleware functionality for authentication and authorization.
 type JWTAuthz struct {
-	jwtSigningKey    []byte
-	log              Log
-	jwtSigningMethod *jwt.SigningMethodHMAC
-	defaultCookie    http.Cookie
+	log           Log
+	defaultCookie http.Cookie
+
+	// keys sign the new tokens with the active key and verify the tokens with the key of their ID, see SetKeys
+	keys *keys.Set
+	// issuer and audience are the claims of the tokens, the tokens of others are rejected, see SetIssuer
+	issuer   string
+	audience string
+
+	// accessTTL is the lifetime of the access tokens, see SetAccessTokenTTL
+	accessTTL time.Duration
+	// passwordParams are the parameters of the password hashes, see SetPasswordParams
+	passwordParams Argon2Params
+	// passwordPolicy are the rules of the passwords chosen by the users, see SetPasswordPolicy
+	passwordPolicy PasswordPolicy
+	// usernamePolicy are the rules of the usernames chosen by the users, deniedNames the skeletons
+	// of its denylist, see SetUsernamePolicy
+	usernamePolicy UsernamePolicy
+	deniedNames    map[string]struct{}
+	// revoked caches whether the access tokens are revoked by their JWT ID, see MarkRevoked
+	revoked *cache.Cache[string, bool]
 }
 
+// The revocations of the access tokens are cached in front of the storage, so checking them doesn't
+// add a query to every request. A token revoked through another server is rejected here once its
+// entry expires.
+const (
+	revokedCacheSize = 10000
+	revokedCacheTTL  = 30 * time.Second
+)
+
+// DefaultIssuer is the issuer and the audience of the tokens unless SetIssuer changes them.
+const DefaultIssuer = "gophkeeper"
+
 // NewJWTAuthz creates a new JWTAuthz instance with the provided signing key and logger.
+// The tokens are signed with HMAC-SHA256 and the key, without a key ID, until SetKeys sets a keyset.
 func NewJWTAuthz(signingKey string, log Log) *JWTAuthz {
+	// A keyset of a single key which signs can't fail
+	legacy, _ := keys.NewSet([]keys.Key{
+		keys.NewHMACKey("", []byte(config.GetAsString("JWT_SIGNING_KEY", signingKey))),
+	}, "")
+
 	return &JWTAuthz{
-		jwtSigningKey:    []byte(config.GetAsString("JWT_SIGNING_KEY", signingKey)),
-		log:              log,
-		jwtSigningMethod: jwt.SigningMethodHS256,
+		log:            log,
+		keys:           legacy,
+		issuer:         DefaultIssuer,
+		audience:       DefaultIssuer,
+		passwordParams: DefaultArgon2Params,
+		passwordPolicy: DefaultPasswordPolicy,
+		revoked:        cache.New[string, bool]("revoked_tokens", revokedCacheSize, revokedCacheTTL),
 
 		defaultCookie: http.Cookie{
 			HttpOnly: true,
@@ -52,49 +110,219 @@ func NewJWTAuthz(signingKey string, log Log) *JWTAuthz {
 	}
 }
 
+// SetAccessTokenTTL sets the lifetime of the access tokens, 0 issues tokens that don't expire.
+// Clients renew expired access tokens with their refresh token.
+func (j *JWTAuthz) SetAccessTokenTTL(ttl time.Duration) {
+	j.accessTTL = ttl
+}
+
+// SetKeys sets the keyset signing and verifying the tokens. The tokens of a key which isn't in the keyset,
+// or without a key ID, are rejected: their clients get a token of the active key by refreshing.
+func (j *JWTAuthz) SetKeys(set *keys.Set) {
+	j.keys = set
+}
+
+// SetIssuer sets the issuer and the audience of the tokens, the tokens of others are rejected.
+func (j *JWTAuthz) SetIssuer(issuer, audience string) {
+	j.issuer = issuer
+	j.audience = audience
+}
+
+// AccessTokenTTL returns the lifetime of the access tokens, 0 if they don't expire.
+func (j *JWTAuthz) AccessTokenTTL() time.Duration {
+	return j.accessTTL
+}
+
+// JWTAuthzMiddleware puts the user and the role of the token into the context of the request.
+// The account is looked up on every request, so a disabled account is rejected at once, as is
+// a token of a role the user no longer has: its client gets a token of the new role by refreshing.
+// A token revoked by a logout is rejected too, as is a token issued before the last change of the password.
+// A request with an API key is of its user, within the scopes of the key.
 func (j *JWTAuthz) JWTAuthzMiddleware(storage Storage, log Log) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
-			var userID string
+			var claims *CustomClaims
 			var err error
 
 			jwtToken := r.Header.Get("Authorization")
 
+			// The non-interactive clients authenticate with an API key instead of a token
+			if key, ok := strings.CutPrefix(jwtToken, apiKeyScheme); ok {
+				j.serveAPIKey(w, r, next, storage, log, key)
+				return
+			}
+
 			if jwtToken != "" {
-				userID, err = j.DecodeJWTToUser(jwtToken)
+				claims, err = j.decodeClaims(jwtToken)
 
 				if err != nil {
-					userID = ""
+					claims = nil
 					log.Info("Error occurred decoding JWT token", zap.Error(err))
 				}
 			}
 
-			// If userID is still empty, return an authorization error
-			if userID == "" {
+			// If there are no claims, return an authorization error
+			id, err := strconv.Atoi(claimsUser(claims))
+			if err != nil {
 
 				http.Error(w, "Authorization error", http.StatusUnauthorized)
 				return
 			}
 
-			var keyUserID models.Key = "userID"
-			ctx := r.Context()
-			ctx = context.WithValue(ctx, keyUserID, userID)
-			next.ServeHTTP(w, r.WithContext(ctx))
+			revoked, err := j.isRevoked(r.Context(), storage, claims.Id)
+			if err != nil {
+				log.Info("Error occurred checking token revocation", zap.Error(err))
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if revoked {
+				http.Error(w, "Authorization error", http.StatusUnauthorized)
+				return
+			}
+
+			access, err := storage.GetUserAccess(r.Context(), id)
+			if errors.Is(err, models.ErrNotFound) || (err == nil && (access.Disabled || access.Role != claimsRole(claims) ||
+				issuedBefore(claims, access.PasswordChangedAt))) {
+				http.Error(w, "Authorization error", http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				log.Info("Error occurred getting user access", zap.Error(err))
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(withUser(r.Context(), claims.Email, access.Role)))
 		}
 
 		return http.HandlerFunc(fn)
 	}
 }
 
-// CreateJWTTokenForUser creates a JWT token for the specified user ID.
+// isRevoked reports whether the access token with the JWT ID is revoked, the tokens issued
+// without one can't be.
+func (j *JWTAuthz) isRevoked(ctx context.Context, storage Storage, jti string) (bool, error) {
+	if jti == "" {
+		return false, nil
+	}
+
+	return j.revoked.GetOrLoad(ctx, jti, func(ctx context.Context) (bool, error) {
+		return storage.IsTokenRevoked(ctx, jti)
+	})
+}
+
+// MarkRevoked records in the cache that the access token with the JWT ID was revoked,
+// so this server rejects it at once.
+func (j *JWTAuthz) MarkRevoked(jti string) {
+	j.revoked.Add(jti, true)
+}
+
+// RateLimitKey returns the client whose rate limit the request counts against, without reaching the storage:
+// the user of a valid access token, empty for the other requests, which are counted by address. The token
+// isn't checked for revocation, the requests it is rejected on count against its user all the same. An API
+// key can't be told from a made-up one without the storage, its requests are counted by address too.
+func (j *JWTAuthz) RateLimitKey(r *http.Request) string {
+	token := r.Header.Get("Authorization")
+	if token == "" || strings.HasPrefix(token, apiKeyScheme) {
+		return ""
+	}
+
+	userID, err := j.DecodeJWTToUser(token)
+	if err != nil || userID == "" {
+		return ""
+	}
+
+	return "user:" + userID
+}
+
+// withUser returns the context of a request of the authenticated user of the role.
+func withUser(ctx context.Context, userID string, role string) context.Context {
+	var keyUserID models.Key = "userID"
+	var keyRole models.Key = "role"
+	ctx = context.WithValue(ctx, keyUserID, userID)
+	ctx = context.WithValue(ctx, keyRole, role)
+
+	return logger.WithFields(ctx, zap.String("user_id", userID))
+}
+
+// RequireRole rejects the requests of the users without the role, it runs after JWTAuthzMiddleware.
+func (j *JWTAuthz) RequireRole(role string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			var keyRole models.Key = "role"
+			if got, _ := r.Context().Value(keyRole).(string); got != role {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+// claimsUser returns the user of the claims, empty without claims.
+func claimsUser(claims *CustomClaims) string {
+	if claims == nil {
+		return ""
+	}
+
+	return claims.Email
+}
+
+// claimsRole returns the role of the claims, the tokens issued without one are of models.RoleUser.
+func claimsRole(claims *CustomClaims) string {
+	if claims.Role == "" {
+		return models.RoleUser
+	}
+
+	return claims.Role
+}
+
+// issuedBefore reports whether the token of the claims was issued before the time, the zero time
+// is before every token. The tokens are issued at a whole second, so a token issued within the second
+// of the time isn't before it: the token the client changing the password gets must pass. The tokens
+// issued without the time are before any.
+func issuedBefore(claims *CustomClaims, t time.Time) bool {
+	if t.IsZero() {
+		return false
+	}
+
+	return claims.IssuedAt < t.Unix()
+}
+
+// CreateJWTTokenForUser creates a JWT token for the specified user ID, expiring after the access token TTL.
 func (j *JWTAuthz) CreateJWTTokenForUser(userid string) string {
+	return j.CreateJWTTokenWithRole(userid, models.RoleUser)
+}
+
+// CreateJWTTokenWithRole creates a JWT token for the specified user ID of the role, expiring after the access token TTL.
+// Every token has its own JWT ID, under which it is revoked, and the time it was issued at, which a change
+// of the password ends it from. It is signed with the active key, named by its key ID.
+func (j *JWTAuthz) CreateJWTTokenWithRole(userid string, role string) string {
 	claims := CustomClaims{
-		userid,
-		jwt.StandardClaims{},
+		Email: userid,
+	}
+	claims.Id = uuid.NewString()
+	claims.Issuer = j.issuer
+	claims.Audience = j.audience
+	if role != models.RoleUser {
+		claims.Role = role
+	}
+	now := time.Now()
+	claims.IssuedAt = now.Unix()
+	if j.accessTTL > 0 {
+		claims.ExpiresAt = now.Add(j.accessTTL).Unix()
 	}
 
 	// Encode to token string
-	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(j.jwtSigningKey)
+	key := j.keys.Active()
+	token := jwt.NewWithClaims(key.Method, claims)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
+	tokenString, err := token.SignedString(key.SigningKey())
 	if err != nil {
 		log.Println("Error occurred generating JWT", err)
 		return ""
@@ -105,22 +333,58 @@ func (j *JWTAuthz) CreateJWTTokenForUser(userid string) string {
 
 // DecodeJWTToUser decodes a JWT token to retrieve the user ID.
 func (j *JWTAuthz) DecodeJWTToUser(token string) (string, error) {
+	claims, err := j.decodeClaims(token)
+	if err != nil {
+		return "", err
+	}
+
+	return claims.Email, nil
+}
+
+// DecodeTokenID decodes a JWT token to retrieve its user ID, its JWT ID and its expiry, the zero time
+// for a token which doesn't expire. The JWT ID is empty for the tokens issued without one.
+func (j *JWTAuthz) DecodeTokenID(token string) (userID string, jti string, expiresAt time.Time, err error) {
+	claims, err := j.decodeClaims(token)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	if claims.ExpiresAt != 0 {
+		expiresAt = time.Unix(claims.ExpiresAt, 0)
+	}
+
+	return claims.Email, claims.Id, expiresAt, nil
+}
+
+// decodeClaims decodes a JWT token to retrieve its claims. The token is verified with the key of its key ID
+// and must be of the issuer and the audience.
+func (j *JWTAuthz) decodeClaims(token string) (*CustomClaims, error) {
 	// Decode
 	decodeToken, err := jwt.ParseWithClaims(token, &CustomClaims{}, func(token *jwt.Token) (any, error) {
-		if !(j.jwtSigningMethod == token.Method) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := j.keys.Lookup(kid)
+		if err != nil {
+			return nil, err
+		}
+		if key.Method.Alg() != token.Method.Alg() {
 			// Check our method hasn't changed since issuance
 			return nil, errors.New("signing method mismatch")
 		}
-		return j.jwtSigningKey, nil
+		return key.VerifyingKey(), nil
 	})
+	if err != nil {
+		return nil, err
+	}
 
 	// There's two parts. We might decode it successfully but it might
 	// be the case we aren't Valid so you must check both
 	if decClaims, ok := decodeToken.Claims.(*CustomClaims); ok && decodeToken.Valid {
-		return decClaims.Email, nil
+		if !decClaims.VerifyIssuer(j.issuer, true) || !decClaims.VerifyAudience(j.audience, true) {
+			return nil, errors.New("token of another issuer or audience")
+		}
+		return decClaims, nil
 	}
 
-	return "", err
+	return nil, errors.New("invalid token")
 }
 
 // GetHash computes the SHA-256 hash of the concatenation of email and password.
@@ -136,6 +400,26 @@ func (j *JWTAuthz) GetHash(email string, password string) []byte {
 	return h.Sum(nil)
 }
 
+// refreshTokenSize is the number of random bytes of a refresh token.
+const refreshTokenSize = 32
+
+// NewRefreshToken returns a new random refresh token. Only its hash is stored, see HashRefreshToken.
+func (j *JWTAuthz) NewRefreshToken() (string, error) {
+	b := make([]byte, refreshTokenSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashRefreshToken returns the hex SHA-256 of a refresh token, under which it is stored.
+// The tokens are random, so a plain hash is enough to keep a leaked table from being used.
+func (j *JWTAuthz) HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 // AuthCookie creates an http.Cookie with the specified name and token value.
 func (j *JWTAuthz) AuthCookie(name string, token string) *http.Cookie {
 	d := j.defaultCookie
@@ -148,11 +432,11 @@ func (j *JWTAuthz) AuthCookie(name string, token string) *http.Cookie {
 
 // IsBcryptHash проверяет, является ли данная строка хешем bcrypt.
 func (j *JWTAuthz) IsBcryptHash(s string) bool {
-	_, err := bcrypt.Cost([]byte(s))
-	return err == nil
+	return isBcryptHash(s)
 }
 
-func (j *JWTAuthz) CompareHashAndPassword(hashedPassword, password string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+// isBcryptHash reports whether the string is a bcrypt hash.
+func isBcryptHash(s string) bool {
+	_, err := bcrypt.Cost([]byte(s))
 	return err == nil
 }
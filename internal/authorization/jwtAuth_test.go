@@ -1,11 +1,21 @@
 package authz
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/authorization/keys"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
 	"go.uber.org/zap/zapcore"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -14,6 +24,46 @@ type MockLogger struct{}
 
 func (m *MockLogger) Info(string, ...zapcore.Field) {}
 
+// MockStorage holds the role, the disabled state and the last password change of the users by ID,
+// the API keys by hash and the revoked tokens by JWT ID.
+type MockStorage struct {
+	roles    map[int]string
+	disabled map[int]bool
+	changed  map[int]time.Time
+	keys     map[string]models.APIKey
+	touched  []int
+	revoked  map[string]bool
+	lookups  int
+}
+
+func (m *MockStorage) GetUserAccess(ctx context.Context, userID int) (models.UserAccess, error) {
+	role, ok := m.roles[userID]
+	if !ok {
+		return models.UserAccess{}, models.ErrNotFound
+	}
+
+	return models.UserAccess{Role: role, Disabled: m.disabled[userID], PasswordChangedAt: m.changed[userID]}, nil
+}
+
+func (m *MockStorage) GetAPIKeyByHash(ctx context.Context, hash string) (models.APIKey, error) {
+	key, ok := m.keys[hash]
+	if !ok {
+		return models.APIKey{}, models.ErrNotFound
+	}
+
+	return key, nil
+}
+
+func (m *MockStorage) TouchAPIKey(ctx context.Context, id int) error {
+	m.touched = append(m.touched, id)
+	return nil
+}
+
+func (m *MockStorage) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	m.lookups++
+	return m.revoked[jti], nil
+}
+
 func TestJWTAuthz_CreateJWTTokenForUser(t *testing.T) {
 	jwtAuthz := NewJWTAuthz("secret", &MockLogger{})
 
@@ -32,6 +82,32 @@ func TestJWTAuthz_DecodeJWTToUser(t *testing.T) {
 	assert.Equal(t, "user123", userID)
 }
 
+func TestJWTAuthz_RateLimitKey(t *testing.T) {
+	jwtAuthz := NewJWTAuthz("secret", &MockLogger{})
+	other := NewJWTAuthz("other", &MockLogger{})
+
+	tests := []struct {
+		name          string
+		authorization string
+		key           string
+	}{
+		{"access token", jwtAuthz.CreateJWTTokenForUser("42"), "user:42"},
+		{"token of another key", other.CreateJWTTokenForUser("42"), ""},
+		{"malformed token", "not-a-token", ""},
+		{"API key", apiKeyScheme + "gk_abc", ""},
+		{"anonymous", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			assert.Equal(t, tt.key, jwtAuthz.RateLimitKey(req))
+		})
+	}
+}
+
 func TestJWTAuthz_Middleware(t *testing.T) {
 	jwtAuthz := NewJWTAuthz("secret", &MockLogger{})
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -39,10 +115,11 @@ func TestJWTAuthz_Middleware(t *testing.T) {
 	})
 
 	req := httptest.NewRequest("GET", "/", nil)
-	req.Header.Set("Authorization", jwtAuthz.CreateJWTTokenForUser("user123"))
+	req.Header.Set("Authorization", jwtAuthz.CreateJWTTokenForUser("123"))
 	rr := httptest.NewRecorder()
 
-	middleware := jwtAuthz.JWTAuthzMiddleware(nil, &MockLogger{})(handler)
+	storage := &MockStorage{roles: map[int]string{123: models.RoleUser}}
+	middleware := jwtAuthz.JWTAuthzMiddleware(storage, &MockLogger{})(handler)
 	middleware.ServeHTTP(rr, req)
 
 	assert.Equal(t, http.StatusOK, rr.Code)
@@ -57,12 +134,137 @@ func TestJWTAuthz_Middleware_Unauthorized(t *testing.T) {
 	req := httptest.NewRequest("GET", "/", nil)
 	rr := httptest.NewRecorder()
 
-	middleware := jwtAuthz.JWTAuthzMiddleware(nil, &MockLogger{})(handler)
+	middleware := jwtAuthz.JWTAuthzMiddleware(&MockStorage{}, &MockLogger{})(handler)
 	middleware.ServeHTTP(rr, req)
 
 	assert.Equal(t, http.StatusUnauthorized, rr.Code)
 }
 
+func TestJWTAuthz_Middleware_Access(t *testing.T) {
+	jwtAuthz := NewJWTAuthz("secret", &MockLogger{})
+	storage := &MockStorage{
+		roles:    map[int]string{1: models.RoleUser, 2: models.RoleAdmin, 3: models.RoleUser},
+		disabled: map[int]bool{3: true},
+	}
+
+	var role string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var keyRole models.Key = "role"
+		role, _ = r.Context().Value(keyRole).(string)
+		w.WriteHeader(http.StatusOK)
+	})
+	// The admin route also requires the role
+	admin := jwtAuthz.JWTAuthzMiddleware(storage, &MockLogger{})(jwtAuthz.RequireRole(models.RoleAdmin)(handler))
+	user := jwtAuthz.JWTAuthzMiddleware(storage, &MockLogger{})(handler)
+
+	tests := []struct {
+		name      string
+		token     string
+		userCode  int
+		adminCode int
+	}{
+		{"user", jwtAuthz.CreateJWTTokenForUser("1"), http.StatusOK, http.StatusForbidden},
+		{"admin", jwtAuthz.CreateJWTTokenWithRole("2", models.RoleAdmin), http.StatusOK, http.StatusOK},
+		{"disabled", jwtAuthz.CreateJWTTokenForUser("3"), http.StatusUnauthorized, http.StatusUnauthorized},
+		{"deleted", jwtAuthz.CreateJWTTokenForUser("4"), http.StatusUnauthorized, http.StatusUnauthorized},
+		// The token of a role the user no longer has, or never had, is rejected
+		{"stale role", jwtAuthz.CreateJWTTokenWithRole("1", models.RoleAdmin), http.StatusUnauthorized, http.StatusUnauthorized},
+		{"not a user id", jwtAuthz.CreateJWTTokenForUser("user123"), http.StatusUnauthorized, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, h := range []struct {
+				handler http.Handler
+				code    int
+			}{{user, tt.userCode}, {admin, tt.adminCode}} {
+				role = ""
+				req := httptest.NewRequest("GET", "/", nil)
+				req.Header.Set("Authorization", tt.token)
+				rr := httptest.NewRecorder()
+				h.handler.ServeHTTP(rr, req)
+				assert.Equal(t, h.code, rr.Code)
+				if rr.Code == http.StatusOK {
+					assert.Equal(t, tt.name, role)
+				}
+			}
+		})
+	}
+}
+
+func TestJWTAuthz_Middleware_Revoked(t *testing.T) {
+	jwtAuthz := NewJWTAuthz("secret", &MockLogger{})
+	jwtAuthz.SetAccessTokenTTL(time.Minute)
+	storage := &MockStorage{roles: map[int]string{1: models.RoleUser}, revoked: map[string]bool{}}
+	handler := jwtAuthz.JWTAuthzMiddleware(storage, &MockLogger{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(token string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	revoked := jwtAuthz.CreateJWTTokenForUser("1")
+	live := jwtAuthz.CreateJWTTokenForUser("1")
+	userID, jti, expiresAt, err := jwtAuthz.DecodeTokenID(revoked)
+	require.NoError(t, err)
+	assert.Equal(t, "1", userID)
+	require.NotEmpty(t, jti)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), expiresAt, 2*time.Second)
+
+	// Every token has its own JWT ID, and its revocation is looked up once
+	assert.Equal(t, http.StatusOK, serve(revoked))
+	assert.Equal(t, http.StatusOK, serve(revoked))
+	assert.Equal(t, 1, storage.lookups)
+
+	// A revocation on this server is seen at once, the cached lookup notwithstanding
+	storage.revoked[jti] = true
+	jwtAuthz.MarkRevoked(jti)
+	assert.Equal(t, http.StatusUnauthorized, serve(revoked))
+	assert.Equal(t, http.StatusOK, serve(live))
+
+	// A token revoked elsewhere is rejected once it isn't cached
+	jwtAuthz.revoked.Remove(jti)
+	assert.Equal(t, http.StatusUnauthorized, serve(revoked))
+}
+
+func TestJWTAuthz_Middleware_PasswordChanged(t *testing.T) {
+	jwtAuthz := NewJWTAuthz("secret", &MockLogger{})
+	storage := &MockStorage{roles: map[int]string{1: models.RoleUser, 2: models.RoleUser}, changed: map[int]time.Time{}}
+	handler := jwtAuthz.JWTAuthzMiddleware(storage, &MockLogger{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(token string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// The tokens issued before the last change of the password are rejected, whether they expire or not
+	old := jwtAuthz.CreateJWTTokenForUser("1")
+	other := jwtAuthz.CreateJWTTokenForUser("2")
+	assert.Equal(t, http.StatusOK, serve(old))
+	storage.changed[1] = time.Now().Add(2 * time.Second)
+	assert.Equal(t, http.StatusUnauthorized, serve(old))
+	assert.Equal(t, http.StatusOK, serve(other))
+
+	// As are the tokens issued without the time
+	legacy, err := jwt.NewWithClaims(jwt.SigningMethodHS256, CustomClaims{Email: "1", StandardClaims: jwt.StandardClaims{
+		Issuer: DefaultIssuer, Audience: DefaultIssuer,
+	}}).SignedString([]byte("secret"))
+	require.NoError(t, err)
+	storage.changed[1] = time.Now().Add(-time.Hour)
+	assert.Equal(t, http.StatusUnauthorized, serve(legacy))
+
+	// A token issued within the second of the change passes
+	storage.changed[1] = time.Now()
+	assert.Equal(t, http.StatusOK, serve(jwtAuthz.CreateJWTTokenForUser("1")))
+}
+
 func TestJWTAuthz_GetHash(t *testing.T) {
 	jwtAuthz := NewJWTAuthz("secret", &MockLogger{})
 
@@ -105,3 +307,122 @@ func TestJWTAuthz_CompareHashAndPassword(t *testing.T) {
 
 	assert.True(t, jwtAuthz.CompareHashAndPassword(string(hashedPassword), password))
 }
+
+func TestJWTAuthz_AccessTokenTTL(t *testing.T) {
+	jwtAuthz := NewJWTAuthz("secret", &MockLogger{})
+
+	// Without a TTL the tokens don't expire
+	claims := &CustomClaims{}
+	_, err := jwt.ParseWithClaims(jwtAuthz.CreateJWTTokenForUser("user123"), claims, func(*jwt.Token) (any, error) { return []byte("secret"), nil })
+	require.NoError(t, err)
+	assert.Zero(t, claims.ExpiresAt)
+
+	jwtAuthz.SetAccessTokenTTL(15 * time.Minute)
+	assert.Equal(t, 15*time.Minute, jwtAuthz.AccessTokenTTL())
+	claims = &CustomClaims{}
+	_, err = jwt.ParseWithClaims(jwtAuthz.CreateJWTTokenForUser("user123"), claims, func(*jwt.Token) (any, error) { return []byte("secret"), nil })
+	require.NoError(t, err)
+	assert.InDelta(t, time.Now().Add(15*time.Minute).Unix(), claims.ExpiresAt, 5)
+
+	// An expired token is rejected
+	expired, err := jwt.NewWithClaims(jwt.SigningMethodHS256, CustomClaims{Email: "user123", StandardClaims: jwt.StandardClaims{
+		ExpiresAt: time.Now().Add(-time.Minute).Unix(),
+	}}).SignedString([]byte("secret"))
+	require.NoError(t, err)
+	_, err = jwtAuthz.DecodeJWTToUser(expired)
+	assert.Error(t, err)
+}
+
+func TestJWTAuthz_RefreshToken(t *testing.T) {
+	jwtAuthz := NewJWTAuthz("secret", &MockLogger{})
+
+	token, err := jwtAuthz.NewRefreshToken()
+	require.NoError(t, err)
+	other, err := jwtAuthz.NewRefreshToken()
+	require.NoError(t, err)
+	assert.NotEqual(t, token, other)
+	assert.Len(t, token, 43)
+
+	// The hash is stable and doesn't contain the token
+	hash := jwtAuthz.HashRefreshToken(token)
+	assert.Equal(t, hash, jwtAuthz.HashRefreshToken(token))
+	assert.NotEqual(t, hash, jwtAuthz.HashRefreshToken(other))
+	assert.Len(t, hash, 64)
+	assert.NotContains(t, hash, token)
+}
+
+func TestJWTAuthz_KeyRotation(t *testing.T) {
+	_, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(edPrivate)
+	require.NoError(t, err)
+	newKey, err := keys.ParsePEM("new", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	require.NoError(t, err)
+	oldKey := keys.NewHMACKey("old", []byte("old secret"))
+
+	withKeys := func(active string, set ...keys.Key) *JWTAuthz {
+		keyset, err := keys.NewSet(set, active)
+		require.NoError(t, err)
+		jwtAuthz := NewJWTAuthz("secret", &MockLogger{})
+		jwtAuthz.SetKeys(keyset)
+		return jwtAuthz
+	}
+
+	before := withKeys("old", oldKey)
+	oldToken := before.CreateJWTTokenForUser("user123")
+
+	// During the rotation the new tokens are signed with the new key and the old ones keep working
+	during := withKeys("new", oldKey, newKey)
+	newToken := during.CreateJWTTokenForUser("user123")
+	for _, token := range []string{oldToken, newToken} {
+		userID, err := during.DecodeJWTToUser(token)
+		require.NoError(t, err)
+		assert.Equal(t, "user123", userID)
+	}
+	parsed, _, err := new(jwt.Parser).ParseUnverified(newToken, &CustomClaims{})
+	require.NoError(t, err)
+	assert.Equal(t, "new", parsed.Header["kid"])
+	assert.Equal(t, jwt.SigningMethodEdDSA.Alg(), parsed.Method.Alg())
+
+	// Once the old key is dropped its tokens are rejected, as are the tokens without a key ID
+	after := withKeys("new", newKey)
+	_, err = after.DecodeJWTToUser(oldToken)
+	assert.ErrorContains(t, err, "unknown signing key")
+	_, err = after.DecodeJWTToUser(NewJWTAuthz("secret", &MockLogger{}).CreateJWTTokenForUser("user123"))
+	assert.Error(t, err)
+	_, err = after.DecodeJWTToUser(newToken)
+	assert.NoError(t, err)
+
+	// A token signed under the key ID with another algorithm is rejected
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, CustomClaims{Email: "user123"}).SignedString([]byte("old secret"))
+	require.NoError(t, err)
+	_, err = after.DecodeJWTToUser(forged)
+	assert.Error(t, err)
+}
+
+func TestJWTAuthz_IssuerAudience(t *testing.T) {
+	issuer := NewJWTAuthz("secret", &MockLogger{})
+	token := issuer.CreateJWTTokenForUser("user123")
+
+	claims := &CustomClaims{}
+	_, _, err := new(jwt.Parser).ParseUnverified(token, claims)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultIssuer, claims.Issuer)
+	assert.Equal(t, DefaultIssuer, claims.Audience)
+
+	// The tokens of another issuer or for another audience are rejected, even signed with the same key
+	for _, set := range [][2]string{{"other", DefaultIssuer}, {DefaultIssuer, "other"}} {
+		other := NewJWTAuthz("secret", &MockLogger{})
+		other.SetIssuer(set[0], set[1])
+		_, err := other.DecodeJWTToUser(token)
+		assert.Error(t, err)
+		_, err = issuer.DecodeJWTToUser(other.CreateJWTTokenForUser("user123"))
+		assert.Error(t, err)
+	}
+
+	// A token without the claims is rejected too
+	bare, err := jwt.NewWithClaims(jwt.SigningMethodHS256, CustomClaims{Email: "user123"}).SignedString([]byte("secret"))
+	require.NoError(t, err)
+	_, err = issuer.DecodeJWTToUser(bare)
+	assert.Error(t, err)
+}
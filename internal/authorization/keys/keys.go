@@ -0,0 +1,220 @@
+// Package keys provides the keysets signing and verifying the JWT tokens, so the signing key
+// can be rotated without rejecting the tokens signed before.
+package keys
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// The prefixes of the sources of a key in a keyset spec, a key without one is a base64 HMAC secret.
+const (
+	fileSource = "file:"
+	envSource  = "env:"
+)
+
+// ErrUnknownKey is returned for a key ID which isn't in the keyset.
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// Key is a key signing and verifying the JWT tokens of its ID. An RSA or Ed25519 public key
+// only verifies them.
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+
+	// signing is the key signing the tokens, nil for a public key
+	signing interface{}
+	// verifying is the key verifying the tokens
+	verifying interface{}
+}
+
+// NewHMACKey returns the key of the ID signing the tokens with HMAC-SHA256 and the secret.
+func NewHMACKey(id string, secret []byte) Key {
+	return Key{ID: id, Method: jwt.SigningMethodHS256, signing: secret, verifying: secret}
+}
+
+// ParsePEM returns the key of the ID from a PEM block holding an RSA private or public key, signing
+// the tokens with RS256, or an Ed25519 private or public key, signing them with EdDSA.
+func ParsePEM(id string, data []byte) (Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return Key{}, fmt.Errorf("key %q is not PEM encoded", id)
+	}
+
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return Key{}, fmt.Errorf("key %q: unsupported PEM block %q", id, block.Type)
+	}
+	if err != nil {
+		return Key{}, fmt.Errorf("key %q: %w", id, err)
+	}
+
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		return Key{ID: id, Method: jwt.SigningMethodRS256, signing: k, verifying: &k.PublicKey}, nil
+	case *rsa.PublicKey:
+		return Key{ID: id, Method: jwt.SigningMethodRS256, verifying: k}, nil
+	case ed25519.PrivateKey:
+		return Key{ID: id, Method: jwt.SigningMethodEdDSA, signing: k, verifying: k.Public().(ed25519.PublicKey)}, nil
+	case ed25519.PublicKey:
+		return Key{ID: id, Method: jwt.SigningMethodEdDSA, verifying: k}, nil
+	default:
+		return Key{}, fmt.Errorf("key %q: unsupported key type %T", id, parsed)
+	}
+}
+
+// CanSign reports whether the key signs tokens, a public key only verifies them.
+func (k Key) CanSign() bool {
+	return k.signing != nil
+}
+
+// SigningKey returns the key signing the tokens, as the signing method takes it.
+func (k Key) SigningKey() interface{} {
+	return k.signing
+}
+
+// VerifyingKey returns the key verifying the tokens, as the signing method takes it.
+func (k Key) VerifyingKey() interface{} {
+	return k.verifying
+}
+
+// Set is a keyset: the tokens are signed with its active key and verified with the key of their ID.
+type Set struct {
+	keys   map[string]Key
+	active string
+}
+
+// NewSet returns the keyset of the keys signing with the key of the active ID, which must sign.
+func NewSet(keys []Key, active string) (*Set, error) {
+	set := &Set{keys: make(map[string]Key, len(keys)), active: active}
+	for _, key := range keys {
+		if _, ok := set.keys[key.ID]; ok {
+			return nil, fmt.Errorf("key %q is listed twice", key.ID)
+		}
+		set.keys[key.ID] = key
+	}
+
+	key, ok := set.keys[active]
+	if !ok {
+		return nil, fmt.Errorf("active key %q: %w", active, ErrUnknownKey)
+	}
+	if !key.CanSign() {
+		return nil, fmt.Errorf("active key %q is a public key", active)
+	}
+
+	return set, nil
+}
+
+// Active returns the key signing the new tokens.
+func (s *Set) Active() Key {
+	return s.keys[s.active]
+}
+
+// Lookup returns the key of the ID, or ErrUnknownKey.
+func (s *Set) Lookup(id string) (Key, error) {
+	key, ok := s.keys[id]
+	if !ok {
+		return Key{}, fmt.Errorf("key %q: %w", id, ErrUnknownKey)
+	}
+
+	return key, nil
+}
+
+// IDs returns the IDs of the keys of the keyset in order.
+func (s *Set) IDs() []string {
+	ids := make([]string, 0, len(s.keys))
+	for id := range s.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// Load returns the keyset of the spec signing with the key of the active ID, or with the first key
+// of the spec if active is empty. The spec lists id=source pairs separated by commas, a source is
+// file:<path> of a PEM file, env:<name> of an environment variable holding a PEM block or a base64
+// HMAC secret, or the base64 HMAC secret itself.
+func Load(spec string, active string) (*Set, error) {
+	var keys []Key
+	for i, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, source, ok := strings.Cut(pair, "=")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("signing key %d is not id=source", i+1)
+		}
+		key, err := loadKey(id, source)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys are configured")
+	}
+	if active == "" {
+		active = keys[0].ID
+	}
+
+	return NewSet(keys, active)
+}
+
+// loadKey returns the key of the ID from its source in a keyset spec.
+func loadKey(id, source string) (Key, error) {
+	switch {
+	case strings.HasPrefix(source, fileSource):
+		data, err := os.ReadFile(strings.TrimPrefix(source, fileSource))
+		if err != nil {
+			return Key{}, fmt.Errorf("key %q: %w", id, err)
+		}
+		return ParsePEM(id, data)
+	case strings.HasPrefix(source, envSource):
+		name := strings.TrimPrefix(source, envSource)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return Key{}, fmt.Errorf("key %q: environment variable %s is not set", id, name)
+		}
+		if strings.Contains(value, "-----BEGIN") {
+			return ParsePEM(id, []byte(value))
+		}
+		return parseSecret(id, value)
+	default:
+		return parseSecret(id, source)
+	}
+}
+
+// parseSecret returns the HMAC key of the ID from its base64 secret.
+func parseSecret(id, encoded string) (Key, error) {
+	secret, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return Key{}, fmt.Errorf("key %q is not base64: %w", id, err)
+	}
+	if len(secret) == 0 {
+		return Key{}, fmt.Errorf("key %q is empty", id)
+	}
+
+	return NewHMACKey(id, secret), nil
+}
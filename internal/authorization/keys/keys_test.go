@@ -0,0 +1,126 @@
+package keys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writePEM writes the PEM block of the type into a file of the test and returns its path.
+func writePEM(t *testing.T, name, blockType string, der []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600))
+
+	return path
+}
+
+func TestParsePEM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edDER, err := x509.MarshalPKCS8PrivateKey(edPrivate)
+	require.NoError(t, err)
+	edPublicDER, err := x509.MarshalPKIXPublicKey(edPublic)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		block   string
+		der     []byte
+		method  jwt.SigningMethod
+		canSign bool
+	}{
+		{"rsa private", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), jwt.SigningMethodRS256, true},
+		{"rsa public", "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey), jwt.SigningMethodRS256, false},
+		{"ed25519 private", "PRIVATE KEY", edDER, jwt.SigningMethodEdDSA, true},
+		{"ed25519 public", "PUBLIC KEY", edPublicDER, jwt.SigningMethodEdDSA, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ParsePEM("k1", pem.EncodeToMemory(&pem.Block{Type: tt.block, Bytes: tt.der}))
+			require.NoError(t, err)
+			assert.Equal(t, "k1", key.ID)
+			assert.Equal(t, tt.method, key.Method)
+			assert.Equal(t, tt.canSign, key.CanSign())
+		})
+	}
+
+	_, err = ParsePEM("k1", []byte("not a pem"))
+	assert.Error(t, err)
+	_, err = ParsePEM("k1", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{1}}))
+	assert.Error(t, err)
+}
+
+func TestLoad(t *testing.T) {
+	_, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(edPrivate)
+	require.NoError(t, err)
+	path := writePEM(t, "jwt.pem", "PRIVATE KEY", der)
+	t.Setenv("TEST_JWT_SECRET", "c2Vjb25k")
+
+	set, err := Load("old=c2VjcmV0, file="+fileSource+path+",env="+envSource+"TEST_JWT_SECRET", "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"env", "file", "old"}, set.IDs())
+
+	// Without an active key the first one signs
+	assert.Equal(t, "old", set.Active().ID)
+	assert.Equal(t, []byte("secret"), set.Active().SigningKey())
+	key, err := set.Lookup("file")
+	require.NoError(t, err)
+	assert.Equal(t, jwt.SigningMethodEdDSA, key.Method)
+	key, err = set.Lookup("env")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("second"), key.VerifyingKey())
+	_, err = set.Lookup("dropped")
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	set, err = Load("old=c2VjcmV0,new=bmV3", "new")
+	require.NoError(t, err)
+	assert.Equal(t, "new", set.Active().ID)
+
+	tests := []struct {
+		name   string
+		spec   string
+		active string
+	}{
+		{"empty", " , ", ""},
+		{"not a pair", "c2VjcmV0", ""},
+		{"not base64", "k1=secret!", ""},
+		{"listed twice", "k1=c2VjcmV0,k1=bmV3", ""},
+		{"unknown active key", "k1=c2VjcmV0", "k2"},
+		{"missing file", "k1=file:" + filepath.Join(t.TempDir(), "missing.pem"), ""},
+		{"unset variable", "k1=env:TEST_JWT_UNSET", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(tt.spec, tt.active)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestNewSet_PublicActiveKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	public, err := ParsePEM("k1", pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey)}))
+	require.NoError(t, err)
+
+	// A public key verifies the tokens of another server but can't sign
+	_, err = NewSet([]Key{public}, "k1")
+	assert.Error(t, err)
+	_, err = NewSet([]Key{public, NewHMACKey("k2", []byte("secret"))}, "k2")
+	assert.NoError(t, err)
+}
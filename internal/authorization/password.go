@@ -0,0 +1,152 @@
+package authz
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// argon2Prefix starts the Argon2id password hashes, in the PHC string format:
+// $argon2id$v=19$m=<memory>,t=<time>,p=<parallelism>$<salt>$<key>, base64 without padding.
+const argon2Prefix = "$argon2id$"
+
+// argon2KeyLength is the length of the keys of the Argon2id password hashes in bytes.
+const argon2KeyLength = 32
+
+// The limits of the parameters of the Argon2id hashes. The clients may register any string as their
+// password hash, the limits keep a crafted one from making a login exhaust the server.
+const (
+	maxArgon2Memory = 1 << 20 // 1 GiB
+	maxArgon2Time   = 64
+)
+
+// Argon2Params are the parameters of the Argon2id password hashes. They are encoded in every hash,
+// so a hash made with other parameters is recognized and rehashed at the next login.
+type Argon2Params struct {
+	// Memory is the memory used by a hash in KiB
+	Memory int
+	// Time is the number of passes over the memory
+	Time int
+	// Parallelism is the number of threads
+	Parallelism int
+	// SaltLength is the length of the random salt in bytes
+	SaltLength int
+}
+
+// DefaultArgon2Params are the parameters used until SetPasswordParams is called.
+var DefaultArgon2Params = Argon2Params{Memory: 64 * 1024, Time: 3, Parallelism: 2, SaltLength: 16}
+
+// validate checks that the parameters can hash a password.
+func (p Argon2Params) validate() error {
+	switch {
+	case p.Time < 1 || p.Time > maxArgon2Time:
+		return fmt.Errorf("argon2 time must be between 1 and %d", maxArgon2Time)
+	case p.Parallelism < 1 || p.Parallelism > 255:
+		return errors.New("argon2 parallelism must be between 1 and 255")
+	case p.Memory < 8*p.Parallelism || p.Memory > maxArgon2Memory:
+		return fmt.Errorf("argon2 memory must be between %d and %d KiB", 8*p.Parallelism, maxArgon2Memory)
+	case p.SaltLength < 8:
+		return errors.New("argon2 salt length must be at least 8 bytes")
+	}
+
+	return nil
+}
+
+// argon2Hash is a decoded Argon2id password hash.
+type argon2Hash struct {
+	params    Argon2Params
+	salt, key []byte
+}
+
+// parseArgon2Hash decodes an Argon2id password hash of the current version.
+func parseArgon2Hash(hash string) (argon2Hash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return argon2Hash{}, errors.New("not an argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return argon2Hash{}, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+
+	var h argon2Hash
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.params.Memory, &h.params.Time, &h.params.Parallelism)
+	if err != nil {
+		return argon2Hash{}, fmt.Errorf("malformed argon2 parameters: %w", err)
+	}
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return argon2Hash{}, fmt.Errorf("malformed argon2 salt: %w", err)
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return argon2Hash{}, errors.New("malformed argon2 key")
+	}
+	h.params.SaltLength = len(h.salt)
+	if err := h.params.validate(); err != nil {
+		return argon2Hash{}, err
+	}
+
+	return h, nil
+}
+
+// hashArgon2 returns the Argon2id hash of the password with a new salt.
+func hashArgon2(password string, p Argon2Params) (string, error) {
+	salt := make([]byte, p.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, uint32(p.Time), uint32(p.Memory), uint8(p.Parallelism), argon2KeyLength)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2Prefix, argon2.Version, p.Memory, p.Time, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// SetPasswordParams sets the parameters of the password hashes made from now on.
+// The hashes made with other parameters still verify, NeedsRehash reports them.
+func (j *JWTAuthz) SetPasswordParams(p Argon2Params) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	j.passwordParams = p
+
+	return nil
+}
+
+// HashPassword returns the Argon2id hash of a password.
+func (j *JWTAuthz) HashPassword(password string) (string, error) {
+	return hashArgon2(password, j.passwordParams)
+}
+
+// CompareHashAndPassword reports whether the password matches the hash, recognized by its prefix:
+// an Argon2id hash of any parameters or a bcrypt hash, as stored before Argon2id.
+func (j *JWTAuthz) CompareHashAndPassword(hashedPassword, password string) bool {
+	if !strings.HasPrefix(hashedPassword, argon2Prefix) {
+		return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)) == nil
+	}
+
+	h, err := parseArgon2Hash(hashedPassword)
+	if err != nil {
+		return false
+	}
+	key := argon2.IDKey([]byte(password), h.salt, uint32(h.params.Time), uint32(h.params.Memory),
+		uint8(h.params.Parallelism), uint32(len(h.key)))
+
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+// NeedsRehash reports whether the hash isn't an Argon2id hash with the current parameters,
+// so the password it matched should be hashed again.
+func (j *JWTAuthz) NeedsRehash(hashedPassword string) bool {
+	if !strings.HasPrefix(hashedPassword, argon2Prefix) {
+		return true
+	}
+
+	h, err := parseArgon2Hash(hashedPassword)
+	return err != nil || h.params != j.passwordParams || len(h.key) != argon2KeyLength
+}
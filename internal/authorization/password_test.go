@@ -0,0 +1,80 @@
+package authz
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2Params are cheap parameters keeping the tests fast.
+var testArgon2Params = Argon2Params{Memory: 1024, Time: 1, Parallelism: 1, SaltLength: 16}
+
+func TestJWTAuthz_HashPassword(t *testing.T) {
+	jwtAuthz := NewJWTAuthz("secret", &MockLogger{})
+	require.NoError(t, jwtAuthz.SetPasswordParams(testArgon2Params))
+
+	hash, err := jwtAuthz.HashPassword("password123")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$"))
+	assert.True(t, jwtAuthz.CompareHashAndPassword(hash, "password123"))
+	assert.False(t, jwtAuthz.CompareHashAndPassword(hash, "password124"))
+	assert.False(t, jwtAuthz.NeedsRehash(hash))
+
+	// Every hash gets its own salt
+	again, err := jwtAuthz.HashPassword("password123")
+	require.NoError(t, err)
+	assert.NotEqual(t, hash, again)
+
+	// A tampered or truncated hash never matches
+	assert.False(t, jwtAuthz.CompareHashAndPassword(hash[:len(hash)-4], "password123"))
+	assert.False(t, jwtAuthz.CompareHashAndPassword(strings.Replace(hash, "t=1", "t=2", 1), "password123"))
+}
+
+func TestJWTAuthz_NeedsRehash(t *testing.T) {
+	jwtAuthz := NewJWTAuthz("secret", &MockLogger{})
+	require.NoError(t, jwtAuthz.SetPasswordParams(testArgon2Params))
+
+	// The bcrypt hashes stored before Argon2id still verify and are rehashed
+	legacy, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	assert.True(t, jwtAuthz.CompareHashAndPassword(string(legacy), "password123"))
+	assert.True(t, jwtAuthz.NeedsRehash(string(legacy)))
+
+	hash, err := jwtAuthz.HashPassword("password123")
+	require.NoError(t, err)
+
+	// A bump of any parameter rehashes the hashes made before, which still verify
+	bumps := []Argon2Params{
+		{Memory: 2048, Time: 1, Parallelism: 1, SaltLength: 16},
+		{Memory: 1024, Time: 2, Parallelism: 1, SaltLength: 16},
+		{Memory: 1024, Time: 1, Parallelism: 2, SaltLength: 16},
+		{Memory: 1024, Time: 1, Parallelism: 1, SaltLength: 32},
+	}
+	for _, p := range bumps {
+		require.NoError(t, jwtAuthz.SetPasswordParams(p))
+		assert.True(t, jwtAuthz.NeedsRehash(hash), "%+v", p)
+		assert.True(t, jwtAuthz.CompareHashAndPassword(hash, "password123"), "%+v", p)
+	}
+}
+
+func TestJWTAuthz_SetPasswordParams(t *testing.T) {
+	jwtAuthz := NewJWTAuthz("secret", &MockLogger{})
+
+	for _, p := range []Argon2Params{
+		{Memory: 1024, Time: 0, Parallelism: 1, SaltLength: 16},
+		{Memory: 1024, Time: 1, Parallelism: 0, SaltLength: 16},
+		{Memory: 4, Time: 1, Parallelism: 1, SaltLength: 16},
+		{Memory: 1024, Time: 1, Parallelism: 1, SaltLength: 4},
+		{Memory: 4 << 20, Time: 1, Parallelism: 1, SaltLength: 16},
+	} {
+		assert.Error(t, jwtAuthz.SetPasswordParams(p), "%+v", p)
+	}
+
+	// A registered hash with parameters beyond the limits is rejected before hashing anything
+	crafted := "$argon2id$v=19$m=4194304,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+	assert.False(t, jwtAuthz.CompareHashAndPassword(crafted, "password123"))
+	assert.True(t, jwtAuthz.NeedsRehash(crafted))
+}
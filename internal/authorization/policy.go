@@ -0,0 +1,191 @@
+package authz
+
+import (
+	"bufio"
+	_ "embed"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// The rules of the password policy, as named in the violations.
+const (
+	RuleMinLength        = "min_length"
+	RuleBreached         = "breached"
+	RuleContainsUsername = "contains_username"
+	// RuleHashed rejects a bcrypt hash sent instead of the password, unless the policy accepts them
+	RuleHashed = "hashed"
+)
+
+// The character classes a policy may require, each one is also the rule of its violation.
+const (
+	ClassLower  = "lowercase"
+	ClassUpper  = "uppercase"
+	ClassDigit  = "digit"
+	ClassSymbol = "symbol"
+)
+
+// minUsernameMatch is the length below which a username isn't looked for in the passwords.
+// A password can hardly avoid containing a username of one or two characters.
+const minUsernameMatch = 3
+
+// breachedList holds the most common passwords of the public breaches, one per line.
+//
+//go:embed breached.txt
+var breachedList string
+
+// breached is the set of the passwords of breachedList, in lower case.
+var breached = parseBreached(breachedList)
+
+// parseBreached reads a list of passwords, skipping the empty lines and the comments.
+func parseBreached(list string) map[string]struct{} {
+	set := make(map[string]struct{})
+	scanner := bufio.NewScanner(strings.NewReader(list))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		set[strings.ToLower(line)] = struct{}{}
+	}
+
+	return set
+}
+
+// PasswordPolicy are the rules the passwords chosen by the users follow. The passwords known from
+// the breaches and the ones containing the username are always rejected.
+type PasswordPolicy struct {
+	// MinLength is the minimum length of a password in characters
+	MinLength int
+	// Classes are the character classes a password contains at least one character of
+	Classes []string
+	// AllowHashed accepts the bcrypt hashes the legacy clients send instead of the passwords. They
+	// can't be checked, so they follow none of the rules.
+	AllowHashed bool
+}
+
+// DefaultPasswordPolicy is the policy used until SetPasswordPolicy is called.
+var DefaultPasswordPolicy = PasswordPolicy{MinLength: 8}
+
+// ParseClasses parses a list of character classes separated by commas.
+func ParseClasses(list string) ([]string, error) {
+	var classes []string
+	for _, class := range strings.Split(list, ",") {
+		class = strings.TrimSpace(class)
+		switch class {
+		case "":
+		case ClassLower, ClassUpper, ClassDigit, ClassSymbol:
+			classes = append(classes, class)
+		default:
+			return nil, fmt.Errorf("unknown character class %q", class)
+		}
+	}
+
+	return classes, nil
+}
+
+// validate checks that the policy can be followed.
+func (p PasswordPolicy) validate() error {
+	if p.MinLength < 1 {
+		return errors.New("password minimum length must be at least 1")
+	}
+	for _, class := range p.Classes {
+		if classMatch(class) == nil {
+			return fmt.Errorf("unknown character class %q", class)
+		}
+	}
+
+	return nil
+}
+
+// classMatch returns the function matching the characters of the class, nil for an unknown class.
+func classMatch(class string) func(rune) bool {
+	switch class {
+	case ClassLower:
+		return unicode.IsLower
+	case ClassUpper:
+		return unicode.IsUpper
+	case ClassDigit:
+		return unicode.IsDigit
+	case ClassSymbol:
+		return func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }
+	}
+
+	return nil
+}
+
+// check returns the rules of the policy the password of the user breaks, in the order of the policy.
+func (p PasswordPolicy) check(username, password string) []models.PolicyViolation {
+	if isBcryptHash(password) {
+		if p.AllowHashed {
+			return nil
+		}
+		return []models.PolicyViolation{{
+			Rule:    RuleHashed,
+			Message: "must be sent in plain, a hash of it can't be checked",
+		}}
+	}
+
+	var violations []models.PolicyViolation
+
+	if utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, models.PolicyViolation{
+			Rule:    RuleMinLength,
+			Message: fmt.Sprintf("must be at least %d characters long", p.MinLength),
+		})
+	}
+	for _, class := range p.Classes {
+		if !strings.ContainsFunc(password, classMatch(class)) {
+			violations = append(violations, models.PolicyViolation{
+				Rule:    class,
+				Message: fmt.Sprintf("must contain a %s character", class),
+			})
+		}
+	}
+
+	lower := strings.ToLower(password)
+	if _, ok := breached[lower]; ok {
+		violations = append(violations, models.PolicyViolation{
+			Rule:    RuleBreached,
+			Message: "is one of the most common passwords of the known breaches",
+		})
+	}
+	name := strings.ToLower(strings.TrimSpace(username))
+	if utf8.RuneCountInString(name) >= minUsernameMatch && strings.Contains(lower, name) {
+		violations = append(violations, models.PolicyViolation{
+			Rule:    RuleContainsUsername,
+			Message: "must not contain the username",
+		})
+	}
+
+	return violations
+}
+
+// SetPasswordPolicy sets the policy of the passwords chosen from now on.
+// The passwords chosen before keep working, they are checked again when they are changed.
+func (j *JWTAuthz) SetPasswordPolicy(p PasswordPolicy) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	j.passwordPolicy = p
+
+	return nil
+}
+
+// CheckPassword returns the rules of the password policy a password chosen by the user breaks,
+// none if it follows the policy. It takes the password in plain, before it is hashed. A bcrypt hash
+// breaks RuleHashed, unless the policy accepts them.
+func (j *JWTAuthz) CheckPassword(username, password string) []models.PolicyViolation {
+	return j.passwordPolicy.check(username, password)
+}
+
+// HashedPassword reports whether the password sent by a client is the bcrypt hash a legacy client
+// sends instead of it, stored and compared as it is. It is false for every password unless the
+// policy accepts the hashes, they are then taken as passwords in plain.
+func (j *JWTAuthz) HashedPassword(password string) bool {
+	return j.passwordPolicy.AllowHashed && isBcryptHash(password)
+}
@@ -0,0 +1,97 @@
+package authz
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// rules returns the rules of the violations.
+func rules(violations []models.PolicyViolation) []string {
+	var names []string
+	for _, v := range violations {
+		names = append(names, v.Rule)
+	}
+
+	return names
+}
+
+func TestJWTAuthz_CheckPassword(t *testing.T) {
+	jwtAuthz := NewJWTAuthz("secret", &MockLogger{})
+
+	// The default policy only asks for a length, beside the breaches and the username
+	assert.Empty(t, jwtAuthz.CheckPassword("alice", "correct horse battery"))
+	assert.Equal(t, []string{RuleMinLength, RuleBreached}, rules(jwtAuthz.CheckPassword("alice", "1234")))
+	assert.Equal(t, []string{RuleBreached}, rules(jwtAuthz.CheckPassword("alice", "Password123")))
+	assert.Equal(t, []string{RuleContainsUsername}, rules(jwtAuthz.CheckPassword("Alice", "my-ALICE-2024")))
+
+	// A username too short to avoid isn't looked for, the length counts characters, not bytes
+	assert.Empty(t, jwtAuthz.CheckPassword("al", "totally-alright"))
+	assert.Equal(t, []string{RuleMinLength}, rules(jwtAuthz.CheckPassword("alice", "пароль")))
+	assert.Empty(t, jwtAuthz.CheckPassword("alice", "пароль-ёж"))
+
+	require.NoError(t, jwtAuthz.SetPasswordPolicy(PasswordPolicy{
+		MinLength: 10,
+		Classes:   []string{ClassLower, ClassUpper, ClassDigit, ClassSymbol},
+	}))
+	assert.Empty(t, jwtAuthz.CheckPassword("alice", "Tr0ub4dor&3x"))
+
+	// Every rule broken is listed, with a message for the user
+	violations := jwtAuthz.CheckPassword("alice", "ALICE")
+	assert.Equal(t, []string{RuleMinLength, ClassLower, ClassDigit, ClassSymbol, RuleContainsUsername}, rules(violations))
+	assert.Equal(t, "must be at least 10 characters long", violations[0].Message)
+	assert.Equal(t, "must contain a lowercase character", violations[1].Message)
+}
+
+func TestJWTAuthz_HashedPassword(t *testing.T) {
+	jwtAuthz := NewJWTAuthz("secret", &MockLogger{})
+	hash, err := bcrypt.GenerateFromPassword([]byte("a"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	// A hash can't be checked, it is rejected unless the policy accepts the hashes of the legacy clients
+	assert.Equal(t, []string{RuleHashed}, rules(jwtAuthz.CheckPassword("alice", string(hash))))
+	assert.False(t, jwtAuthz.HashedPassword(string(hash)))
+
+	require.NoError(t, jwtAuthz.SetPasswordPolicy(PasswordPolicy{MinLength: 8, AllowHashed: true}))
+	assert.Empty(t, jwtAuthz.CheckPassword("alice", string(hash)))
+	assert.True(t, jwtAuthz.HashedPassword(string(hash)))
+
+	// A password in plain follows the policy all the same
+	assert.Equal(t, []string{RuleMinLength}, rules(jwtAuthz.CheckPassword("alice", "a")))
+	assert.False(t, jwtAuthz.HashedPassword("correct horse battery"))
+}
+
+func TestJWTAuthz_SetPasswordPolicy(t *testing.T) {
+	jwtAuthz := NewJWTAuthz("secret", &MockLogger{})
+
+	assert.Error(t, jwtAuthz.SetPasswordPolicy(PasswordPolicy{MinLength: 0}))
+	assert.Error(t, jwtAuthz.SetPasswordPolicy(PasswordPolicy{MinLength: 8, Classes: []string{"emoji"}}))
+
+	// A rejected policy leaves the current one in place
+	assert.Equal(t, []string{RuleMinLength}, rules(jwtAuthz.CheckPassword("alice", "short")))
+}
+
+func TestParseClasses(t *testing.T) {
+	classes, err := ParseClasses(" digit, symbol,,")
+	require.NoError(t, err)
+	assert.Equal(t, []string{ClassDigit, ClassSymbol}, classes)
+
+	classes, err = ParseClasses("")
+	require.NoError(t, err)
+	assert.Empty(t, classes)
+
+	_, err = ParseClasses("digit,emoji")
+	assert.Error(t, err)
+}
+
+func TestBreachedList(t *testing.T) {
+	// The comments of the list aren't passwords, the entries match whatever their case
+	for password := range breached {
+		assert.NotEqual(t, "#", password[:1])
+	}
+	assert.Contains(t, breached, "qwerty")
+	assert.Contains(t, breached, "p@ssw0rd")
+}
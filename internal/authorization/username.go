@@ -0,0 +1,178 @@
+package authz
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// reservedList holds the usernames reserved by the server, one per line.
+//
+//go:embed reserved.txt
+var reservedList string
+
+// reserved is the set of the skeletons of the usernames of reservedList.
+var reserved = skeletons(parseList(reservedList))
+
+// parseList reads a list of names, one per line, skipping the empty lines and the comments.
+func parseList(list string) []string {
+	var names []string
+	for _, line := range strings.Split(list, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			names = append(names, line)
+		}
+	}
+
+	return names
+}
+
+// skeletons returns the set of the skeletons of the usernames, see models.UsernameSkeleton.
+func skeletons(names []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		if skeleton := models.UsernameSkeleton(name); skeleton != "" {
+			set[skeleton] = struct{}{}
+		}
+	}
+
+	return set
+}
+
+// ParseUsernames parses a list of usernames separated by commas.
+func ParseUsernames(list string) []string {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// UsernameChecker is an external service moderating the usernames chosen by the users, e.g. rejecting the offensive ones.
+type UsernameChecker interface {
+	// CheckUsername returns why the username is rejected, empty if it is accepted.
+	// It returns an error if the service can't tell.
+	CheckUsername(ctx context.Context, username string) (string, error)
+}
+
+// UsernamePolicy are the rules the usernames chosen by the users follow, besides being unique.
+// The usernames reserved by the server are always rejected. The usernames are compared by their skeleton,
+// so the lookalikes of a rejected username are rejected too.
+type UsernamePolicy struct {
+	// Denylist are the usernames rejected besides the reserved ones
+	Denylist []string
+	// Checker is the external moderation service asked once the other rules passed, nil if there is none
+	Checker UsernameChecker
+	// FailClosed rejects the usernames while the checker can't tell, they are accepted otherwise
+	FailClosed bool
+}
+
+// SetUsernamePolicy sets the policy of the usernames chosen from now on.
+// The users registered before keep their username, see ReservedUsername.
+func (j *JWTAuthz) SetUsernamePolicy(p UsernamePolicy) {
+	j.usernamePolicy = p
+	j.deniedNames = skeletons(p.Denylist)
+}
+
+// ReservedUsername returns the violation of the username if it has no letter or digit, or if it is reserved or denied,
+// nil otherwise. Unlike CheckUsername it doesn't ask the external checker, so it can check the existing users.
+func (j *JWTAuthz) ReservedUsername(username string) *models.PolicyViolation {
+	skeleton := models.UsernameSkeleton(username)
+	if skeleton == "" {
+		return &models.PolicyViolation{Rule: models.RuleUsernameInvalid, Message: "must contain a letter or a digit"}
+	}
+
+	_, isReserved := reserved[skeleton]
+	_, isDenied := j.deniedNames[skeleton]
+	if isReserved || isDenied {
+		return &models.PolicyViolation{Rule: models.RuleUsernameReserved, Message: "is reserved, or looks like a reserved username"}
+	}
+
+	return nil
+}
+
+// CheckUsername returns the violation of the username policy by a username chosen by a user, nil if it follows it.
+// The external checker is asked last. If it fails its error is returned, with a violation only if the policy fails closed.
+func (j *JWTAuthz) CheckUsername(ctx context.Context, username string) (*models.PolicyViolation, error) {
+	if violation := j.ReservedUsername(username); violation != nil {
+		return violation, nil
+	}
+
+	checker := j.usernamePolicy.Checker
+	if checker == nil {
+		return nil, nil
+	}
+
+	reason, err := checker.CheckUsername(ctx, username)
+	if err != nil {
+		if j.usernamePolicy.FailClosed {
+			return &models.PolicyViolation{Rule: models.RuleUsernameUnchecked, Message: "can't be checked at the moment, try again later"}, err
+		}
+		return nil, err
+	}
+	if reason != "" {
+		return &models.PolicyViolation{Rule: models.RuleUsernameRejected, Message: reason}, nil
+	}
+
+	return nil, nil
+}
+
+// HTTPUsernameChecker asks an external moderation service over HTTP. It posts {"username"} to the URL,
+// which answers 200 with {"allowed", "reason"}. Any other answer is a failure of the service.
+type HTTPUsernameChecker struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPUsernameChecker creates a checker asking the service at the URL with the client of the egress policy,
+// whose timeout is the time the service has to answer.
+func NewHTTPUsernameChecker(url string, client *http.Client) *HTTPUsernameChecker {
+	return &HTTPUsernameChecker{url: url, client: client}
+}
+
+// CheckUsername asks the service whether the username is allowed, it returns the reason given if it isn't.
+func (c *HTTPUsernameChecker) CheckUsername(ctx context.Context, username string) (string, error) {
+	body, err := json.Marshal(map[string]string{"username": username})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("username checker: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("username checker: unexpected status %d", resp.StatusCode)
+	}
+
+	var verdict struct {
+		Allowed bool   `json:"allowed"`
+		Reason  string `json:"reason"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&verdict); err != nil {
+		return "", fmt.Errorf("username checker: %w", err)
+	}
+	if verdict.Allowed {
+		return "", nil
+	}
+	if verdict.Reason == "" {
+		return "is not allowed", nil
+	}
+
+	return verdict.Reason, nil
+}
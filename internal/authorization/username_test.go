@@ -0,0 +1,131 @@
+package authz
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// stubChecker is an external checker rejecting the usernames of reasons, or failing with err.
+type stubChecker struct {
+	reasons map[string]string
+	err     error
+	calls   int
+}
+
+func (c *stubChecker) CheckUsername(_ context.Context, username string) (string, error) {
+	c.calls++
+	return c.reasons[username], c.err
+}
+
+// rule returns the rule of the violation, empty if there is none.
+func rule(violation *models.PolicyViolation) string {
+	if violation == nil {
+		return ""
+	}
+
+	return violation.Rule
+}
+
+func TestJWTAuthz_ReservedUsername(t *testing.T) {
+	jwtAuthz := NewJWTAuthz("secret", &MockLogger{})
+
+	// The reserved usernames and their lookalikes are rejected, whatever the case, the accents or the separators
+	for _, username := range []string{"admin", "Admin", "аdmin", "_admin_", "ad.min", "ａｄｍｉｎ", "admín", "adm1n", "r00t", "suppοrt"} {
+		assert.Equal(t, models.RuleUsernameReserved, rule(jwtAuthz.ReservedUsername(username)), username)
+	}
+	assert.Equal(t, models.RuleUsernameInvalid, rule(jwtAuthz.ReservedUsername("___")))
+	assert.Nil(t, jwtAuthz.ReservedUsername("alice"))
+	assert.Nil(t, jwtAuthz.ReservedUsername("administrators-club"))
+
+	// The denylist of the configuration extends the reserved usernames
+	assert.Nil(t, jwtAuthz.ReservedUsername("acme"))
+	jwtAuthz.SetUsernamePolicy(UsernamePolicy{Denylist: ParseUsernames(" acme, ceo ,,")})
+	assert.Equal(t, models.RuleUsernameReserved, rule(jwtAuthz.ReservedUsername("ACME")))
+	assert.Equal(t, models.RuleUsernameReserved, rule(jwtAuthz.ReservedUsername("ce0")))
+	assert.Equal(t, models.RuleUsernameReserved, rule(jwtAuthz.ReservedUsername("admin")))
+}
+
+func TestJWTAuthz_CheckUsername(t *testing.T) {
+	ctx := context.Background()
+	jwtAuthz := NewJWTAuthz("secret", &MockLogger{})
+	checker := &stubChecker{reasons: map[string]string{"rude": "is offensive"}}
+	jwtAuthz.SetUsernamePolicy(UsernamePolicy{Checker: checker})
+
+	// The checker is only asked once the reserved usernames passed
+	violation, err := jwtAuthz.CheckUsername(ctx, "root")
+	require.NoError(t, err)
+	assert.Equal(t, models.RuleUsernameReserved, rule(violation))
+	assert.Zero(t, checker.calls)
+
+	violation, err = jwtAuthz.CheckUsername(ctx, "rude")
+	require.NoError(t, err)
+	assert.Equal(t, &models.PolicyViolation{Rule: models.RuleUsernameRejected, Message: "is offensive"}, violation)
+	violation, err = jwtAuthz.CheckUsername(ctx, "alice")
+	require.NoError(t, err)
+	assert.Nil(t, violation)
+
+	// A failed checker lets the usernames through, unless the policy fails closed
+	checker.err = errors.New("unreachable")
+	violation, err = jwtAuthz.CheckUsername(ctx, "alice")
+	assert.Error(t, err)
+	assert.Nil(t, violation)
+
+	jwtAuthz.SetUsernamePolicy(UsernamePolicy{Checker: checker, FailClosed: true})
+	violation, err = jwtAuthz.CheckUsername(ctx, "alice")
+	assert.Error(t, err)
+	assert.Equal(t, models.RuleUsernameUnchecked, rule(violation))
+}
+
+func TestHTTPUsernameChecker(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Username string `json:"username"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+
+		switch req.Username {
+		case "rude":
+			w.Write([]byte(`{"allowed": false, "reason": "is offensive"}`))
+		case "quiet":
+			w.Write([]byte(`{"allowed": false}`))
+		case "slow":
+			time.Sleep(200 * time.Millisecond)
+			w.Write([]byte(`{"allowed": true}`))
+		case "broken":
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.Write([]byte(`{"allowed": true}`))
+		}
+	}))
+	defer srv.Close()
+
+	client := srv.Client()
+	client.Timeout = 100 * time.Millisecond
+	checker := NewHTTPUsernameChecker(srv.URL, client)
+
+	reason, err := checker.CheckUsername(ctx, "alice")
+	require.NoError(t, err)
+	assert.Empty(t, reason)
+	reason, err = checker.CheckUsername(ctx, "rude")
+	require.NoError(t, err)
+	assert.Equal(t, "is offensive", reason)
+	reason, err = checker.CheckUsername(ctx, "quiet")
+	require.NoError(t, err)
+	assert.Equal(t, "is not allowed", reason)
+
+	// An error status and a service too slow to answer are failures, not verdicts
+	_, err = checker.CheckUsername(ctx, "broken")
+	assert.Error(t, err)
+	_, err = checker.CheckUsername(ctx, "slow")
+	assert.Error(t, err)
+}
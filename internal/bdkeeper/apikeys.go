@@ -0,0 +1,162 @@
+package bdkeeper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// apiKeysTable holds the API keys of the users. Like the refresh tokens it has no row-level security policy,
+// a key is looked up by its hash before its user is known, and it is always read from the primary.
+const apiKeysTable = "api_keys"
+
+// CreateAPIKey stores an API key created by a user and returns it with its id and its creation time.
+func (bdk *BDKeeper) CreateAPIKey(ctx context.Context, key models.APIKey) (_ models.APIKey, err error) {
+	defer bdk.observe("create_api_key", apiKeysTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return models.APIKey{}, err
+	}
+	defer leave()
+
+	var expiresAt interface{}
+	if key.ExpiresAt != nil {
+		expiresAt = bdk.dialect.timeArg(key.ExpiresAt.UTC())
+	}
+	query := fmt.Sprintf(`INSERT INTO api_keys (key_hash, user_id, label, scopes, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, %s, $5) RETURNING id, created_at`, bdk.dialect.now())
+	err = bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query),
+		key.Hash, key.UserID, key.Label, strings.Join(key.Scopes, ","), expiresAt).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		return models.APIKey{}, fmt.Errorf("failed to create api key: %w", err)
+	}
+	key.CreatedAt = key.CreatedAt.UTC()
+
+	return key, nil
+}
+
+// apiKeyColumns are the columns of an API key read by scanAPIKey.
+const apiKeyColumns = `id, key_hash, user_id, label, scopes, created_at, last_used_at, expires_at`
+
+// scanAPIKey reads an API key of apiKeyColumns.
+func scanAPIKey(row interface{ Scan(...any) error }) (models.APIKey, error) {
+	var key models.APIKey
+	var scopes string
+	var lastUsedAt, expiresAt sql.NullTime
+	if err := row.Scan(&key.ID, &key.Hash, &key.UserID, &key.Label, &scopes, &key.CreatedAt, &lastUsedAt, &expiresAt); err != nil {
+		return models.APIKey{}, err
+	}
+	key.Scopes = strings.Split(scopes, ",")
+	key.CreatedAt = key.CreatedAt.UTC()
+	if lastUsedAt.Valid {
+		at := lastUsedAt.Time.UTC()
+		key.LastUsedAt = &at
+	}
+	if expiresAt.Valid {
+		at := expiresAt.Time.UTC()
+		key.ExpiresAt = &at
+	}
+
+	return key, nil
+}
+
+// GetAPIKeyByHash returns the API key with the given hash, expired or not, or models.ErrNotFound.
+func (bdk *BDKeeper) GetAPIKeyByHash(ctx context.Context, hash string) (_ models.APIKey, err error) {
+	defer bdk.observe("get_api_key", apiKeysTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return models.APIKey{}, err
+	}
+	defer leave()
+
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE key_hash = $1`
+	key, err := scanAPIKey(bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.APIKey{}, models.ErrNotFound
+	}
+	if err != nil {
+		return models.APIKey{}, fmt.Errorf("failed to get api key: %w", err)
+	}
+
+	return key, nil
+}
+
+// ListAPIKeys returns the API keys of the user, oldest first.
+func (bdk *BDKeeper) ListAPIKeys(ctx context.Context, userID int) (_ []models.APIKey, err error) {
+	defer bdk.observe("list_api_keys", apiKeysTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE user_id = $1 ORDER BY id`
+	rows, err := bdk.ex.QueryContext(ctx, bdk.dialect.rebind(query), userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list api keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := make([]models.APIKey, 0)
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan api key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows encountered an error: %w", err)
+	}
+
+	return keys, nil
+}
+
+// TouchAPIKey sets the last use of the API key to now.
+func (bdk *BDKeeper) TouchAPIKey(ctx context.Context, id int) (err error) {
+	defer bdk.observe("touch_api_key", apiKeysTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+
+	query := fmt.Sprintf(`UPDATE api_keys SET last_used_at = %s WHERE id = $1`, bdk.dialect.now())
+	if _, err := bdk.ex.ExecContext(ctx, bdk.dialect.rebind(query), id); err != nil {
+		return fmt.Errorf("failed to touch api key: %w", err)
+	}
+
+	return nil
+}
+
+// RevokeAPIKey deletes the API key of the user, or returns models.ErrNotFound.
+// The key is rejected from its next request on.
+func (bdk *BDKeeper) RevokeAPIKey(ctx context.Context, userID int, id int) (err error) {
+	defer bdk.observe("revoke_api_key", apiKeysTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+
+	query := `DELETE FROM api_keys WHERE id = $1 AND user_id = $2`
+	res, err := bdk.ex.ExecContext(ctx, bdk.dialect.rebind(query), id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke api key: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return models.ErrNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,187 @@
+package bdkeeper
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"go.uber.org/zap"
+)
+
+// auditTable holds the audit events. It has no row-level security policy, the failed logins
+// of unknown accounts belong to no user, so the reads select the rows of the user themselves.
+const auditTable = "audit_log"
+
+// AddAuditEvent records an event in the audit log, with the client carried by the context
+// if the event names none. Called on a WithTx view, the event is written once the transaction
+// ends, outside of it, and recorded as failed if the transaction is rolled back.
+func (bdk *BDKeeper) AddAuditEvent(ctx context.Context, ev models.AuditEvent) (err error) {
+	defer bdk.observe("add_audit_event", auditTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+
+	return bdk.addAuditEvent(ctx, ev)
+}
+
+// addAuditEvent runs AddAuditEvent on the keeper or view.
+func (bdk *BDKeeper) addAuditEvent(ctx context.Context, ev models.AuditEvent) error {
+	ev = withClient(ctx, ev)
+	if bdk.tx != nil {
+		bdk.tx.audit = append(bdk.tx.audit, ev)
+		return nil
+	}
+
+	return bdk.insertAuditEvent(ctx, ev)
+}
+
+// insertAuditEvent writes the event to the audit log outside of any transaction.
+func (bdk *BDKeeper) insertAuditEvent(ctx context.Context, ev models.AuditEvent) error {
+	// The failed attempts of unknown accounts have no user
+	userID := sql.NullInt64{Int64: int64(ev.UserID), Valid: ev.UserID != 0}
+
+	query := fmt.Sprintf(`INSERT INTO audit_log (user_id, action, table_name, entry_id, remote_addr, user_agent, success,
+		operator, detail, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, %s)`, bdk.dialect.now())
+	_, err := bdk.ex.ExecContext(ctx, bdk.dialect.rebind(query),
+		userID, string(ev.Action), ev.Table, ev.EntryID, ev.RemoteAddr, ev.UserAgent, ev.Success, ev.Operator, ev.Detail)
+	if err != nil {
+		return fmt.Errorf("failed to add audit event: %w", err)
+	}
+
+	return nil
+}
+
+// withClient fills in the client of the event from the context.
+func withClient(ctx context.Context, ev models.AuditEvent) models.AuditEvent {
+	if ev.RemoteAddr == "" && ev.UserAgent == "" {
+		c := models.ClientFrom(ctx)
+		ev.RemoteAddr, ev.UserAgent = c.RemoteAddr, c.UserAgent
+	}
+
+	return ev
+}
+
+// audit records a data change of a user whose outcome is *err, it is deferred by the public methods.
+// The audit log must not fail the change, so a failed write is logged and the change goes on.
+func (bdk *BDKeeper) audit(ctx context.Context, action models.AuditAction, table string, userID int, entryID string, err *error) {
+	bdk.recordAudit(ctx, models.AuditEvent{
+		UserID:  userID,
+		Action:  action,
+		Table:   table,
+		EntryID: entryID,
+		Success: *err == nil,
+	})
+}
+
+// recordAudit adds the event to the audit log, logging a failure instead of returning it.
+// The event is written even if the request was canceled, its outcome is known by then.
+func (bdk *BDKeeper) recordAudit(ctx context.Context, ev models.AuditEvent) {
+	if err := bdk.addAuditEvent(context.WithoutCancel(ctx), ev); err != nil {
+		bdk.log.Warn("failed to write audit event", logger.ContextFields(ctx,
+			zap.String("action", string(ev.Action)),
+			zap.Int("user_id", ev.UserID),
+			zap.Error(err),
+		)...)
+	}
+}
+
+// flushAudit writes the events recorded by a transaction view once the transaction has ended,
+// as failed unless it committed.
+func (bdk *BDKeeper) flushAudit(ctx context.Context, events []models.AuditEvent, committed bool) {
+	for _, ev := range events {
+		ev.Success = ev.Success && committed
+		bdk.recordAudit(ctx, ev)
+	}
+}
+
+// GetAuditEvents returns up to limit audit events of the user recorded since the given time,
+// newest first. A limit of 0 or less returns all of them.
+func (bdk *BDKeeper) GetAuditEvents(ctx context.Context, userID int, since time.Time, limit int) (_ []models.AuditEvent, err error) {
+	defer bdk.observe("get_audit_events", auditTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	query := `SELECT id, action, table_name, entry_id, remote_addr, user_agent, success, created_at
+		FROM audit_log WHERE user_id = $1 AND created_at >= $2 ORDER BY id DESC`
+	args := []interface{}{userID, bdk.dialect.timeArg(since.UTC())}
+	if limit > 0 {
+		query += " LIMIT $3"
+		args = append(args, limit)
+	}
+
+	rows, err := bdk.ex.QueryContext(ctx, bdk.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get audit events: %w", err)
+	}
+	defer rows.Close()
+
+	events := make([]models.AuditEvent, 0)
+	for rows.Next() {
+		ev := models.AuditEvent{UserID: userID}
+		var action string
+		if err := rows.Scan(&ev.ID, &action, &ev.Table, &ev.EntryID, &ev.RemoteAddr, &ev.UserAgent, &ev.Success, &ev.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan audit event: %w", err)
+		}
+		ev.Action = models.AuditAction(action)
+		events = append(events, ev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows encountered an error: %w", err)
+	}
+
+	return events, nil
+}
+
+// PruneAuditEvents deletes the audit events recorded before the given time and returns their number.
+func (bdk *BDKeeper) PruneAuditEvents(ctx context.Context, before time.Time) (_ int, err error) {
+	defer bdk.observe("prune_audit_events", auditTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer leave()
+
+	sel := bdk.auditPruneSelection(before)
+	res, err := bdk.ex.ExecContext(ctx, bdk.dialect.rebind(fmt.Sprintf("DELETE FROM %s WHERE %s", sel.ident, sel.where)), sel.args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune audit events: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+// PreviewAuditPruning is the dry run of PruneAuditEvents: it returns the number of the events
+// PruneAuditEvents would delete and up to sample of their identifiers, without changing anything.
+func (bdk *BDKeeper) PreviewAuditPruning(ctx context.Context, before time.Time, sample int) (_ models.JobPreview, err error) {
+	defer bdk.observe("preview_audit_pruning", auditTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return models.JobPreview{}, err
+	}
+	defer leave()
+
+	return bdk.previewJob(ctx, []jobSelection{bdk.auditPruneSelection(before)}, sample)
+}
+
+// auditPruneSelection selects the audit events recorded before the given time.
+func (bdk *BDKeeper) auditPruneSelection(before time.Time) jobSelection {
+	return jobSelection{
+		table: auditTable,
+		ident: quoteIdent(auditTable),
+		where: "created_at < $1",
+		args:  []interface{}{bdk.dialect.timeArg(before.UTC())},
+	}
+}
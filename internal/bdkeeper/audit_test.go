@@ -0,0 +1,55 @@
+package bdkeeper
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+func TestBDKeeper_AuditChanges(t *testing.T) {
+	bdk := newSQLiteBDKeeper(t)
+	ctx := context.Background()
+	userID := addTestUser(t, bdk)
+	table := "UserCredentials"
+
+	_, err := bdk.ApplyChanges(ctx, userID, []models.Change{
+		{Table: table, Op: models.ChangeAdd, EntryID: "added", Fields: map[string]string{"login": "alice", "password": "secret"}},
+		{Table: table, Op: models.ChangeUpdate, EntryID: "missing", Fields: map[string]string{"login": "bob"}},
+	})
+	require.NoError(t, err)
+	_, err = bdk.BulkInsert(ctx, table, userID, credentialRows("bulk", 3))
+	require.NoError(t, err)
+
+	// Every change of the batch is recorded, the skipped ones as failed
+	events, err := bdk.GetAuditEvents(ctx, userID, time.Time{}, 0)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	assert.Equal(t, models.AuditBulkInsert, events[0].Action)
+	assert.True(t, events[0].Success)
+	assert.Equal(t, models.AuditUpdate, events[1].Action)
+	assert.False(t, events[1].Success)
+	assert.Equal(t, models.AuditAdd, events[2].Action)
+	assert.Equal(t, "added", events[2].EntryID)
+	assert.True(t, events[2].Success)
+}
+
+func TestBDKeeper_AuditFailureKeepsChange(t *testing.T) {
+	bdk := newSQLiteBDKeeper(t)
+	ctx := context.Background()
+	userID := addTestUser(t, bdk)
+
+	_, err := bdk.conn.ExecContext(ctx, "DROP TABLE audit_log")
+	require.NoError(t, err)
+
+	// The change goes through although its event can't be written
+	_, _, err = bdk.AddData(ctx, "UserCredentials", userID, "entry", map[string]string{"login": "alice", "password": "secret"})
+	require.NoError(t, err)
+	_, err = bdk.GetData(ctx, "UserCredentials", userID, "entry", false)
+	require.NoError(t, err)
+
+	assert.Error(t, bdk.AddAuditEvent(ctx, models.AuditEvent{UserID: userID, Action: models.AuditLogin}))
+}
@@ -0,0 +1,286 @@
+package bdkeeper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"go.uber.org/zap"
+)
+
+// backfillBatchSize is the number of rows filled in by a transaction of a data migration.
+const backfillBatchSize = 500
+
+// dataMigration fills in the rows stored before a schema migration, which the migration can't do
+// in a single statement: the values are computed by the server, or the tables are too large to be
+// locked until they are all updated. It runs right after the schema migration of its version, see
+// migrateUp, so the later schema migrations rely on the rows it filled. The rows are filled in
+// batches in the order of their ids, each in its own transaction recording the last id, so an
+// interrupted migration resumes where it stopped.
+type dataMigration struct {
+	name    string
+	version uint
+	tables  []string
+	// fill fills in the batch of rows of the table following lastID, and returns the last id
+	// of the batch, the number of rows filled in and whether the table is done
+	fill func(bdk *BDKeeper, ctx context.Context, table, lastID string, batchSize int) (string, int, bool, error)
+}
+
+// legacyDataTables are the data tables created before the data migrations, the later ones
+// are created with the columns filled in.
+var legacyDataTables = []string{"UserCredentials", "CreditCardData", "TextData", models.FilesTable}
+
+// dataMigrations are the data migrations in the order of their versions.
+var dataMigrations = []dataMigration{
+	{name: "payload_sizes", version: 17, tables: legacyDataTables, fill: (*BDKeeper).fillPayloadSizes},
+	{name: "sync_columns", version: 28, tables: legacyDataTables, fill: (*BDKeeper).fillSyncColumns},
+	{name: "username_skeletons", version: 33, tables: []string{usersTable}, fill: (*BDKeeper).fillSkeletons},
+}
+
+// migrateUp applies the schema migrations up to the latest version, stopping after the version
+// of every data migration to run it. A failed data migration stops the schema migrations too.
+// The servers starting together may fill in the same batch, which the batches tolerate, since
+// they only fill in the rows which are still NULL.
+func (bdk *BDKeeper) migrateUp(ctx context.Context, m *migrate.Migrate, batchSize int) error {
+	if err := bdk.createBackfillTable(ctx); err != nil {
+		return err
+	}
+
+	// The data migrations read the columns of the tables before the later schema migrations change them
+	defer func() {
+		for _, table := range models.DataTables {
+			bdk.columns.Remove(table)
+		}
+	}()
+
+	for _, dm := range dataMigrations {
+		version, _, err := m.Version()
+		if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+			return err
+		}
+		if version < dm.version {
+			if err := m.Migrate(dm.version); err != nil {
+				return err
+			}
+		}
+		if err := bdk.runDataMigration(ctx, dm, batchSize); err != nil {
+			return err
+		}
+	}
+
+	// An up-to-date schema is the usual case at startup, not a failure
+	if err := m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return err
+	}
+
+	return nil
+}
+
+// createBackfillTable creates the table of the progress of the data migrations. It is kept out of
+// the schema migrations, which the data migrations interleave.
+func (bdk *BDKeeper) createBackfillTable(ctx context.Context) error {
+	query := `CREATE TABLE IF NOT EXISTS DataMigrations (
+		name TEXT NOT NULL,
+		table_name TEXT NOT NULL,
+		last_id TEXT NOT NULL,
+		filled INTEGER NOT NULL DEFAULT 0,
+		done BOOLEAN NOT NULL DEFAULT FALSE,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (name, table_name)
+	)`
+	if _, err := bdk.ex.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create the data migrations table: %w", err)
+	}
+
+	return nil
+}
+
+// runDataMigration fills in the tables of the data migration which aren't done yet, resuming
+// after the last id recorded.
+func (bdk *BDKeeper) runDataMigration(ctx context.Context, dm dataMigration, batchSize int) error {
+	if batchSize <= 0 {
+		return errors.New("batch size must be positive")
+	}
+
+	for _, table := range dm.tables {
+		lastID, filled, done, err := bdk.backfillCursor(ctx, dm.name, table)
+		if err != nil {
+			return err
+		}
+		if done {
+			continue
+		}
+
+		for !done {
+			err := bdk.inTx(ctx, func(view *BDKeeper) error {
+				var n int
+				var err error
+				lastID, n, done, err = dm.fill(view, ctx, table, lastID, batchSize)
+				if err != nil {
+					return err
+				}
+				filled += n
+
+				return view.saveBackfillCursor(ctx, dm.name, table, lastID, filled, done)
+			})
+			if err != nil {
+				return fmt.Errorf("failed to run the data migration %s of %s: %w", dm.name, table, err)
+			}
+			bdk.log.Debug("data migration batch done",
+				zap.String("migration", dm.name), zap.String("table", table), zap.Int("filled", filled))
+		}
+		bdk.log.Info("data migration done",
+			zap.String("migration", dm.name), zap.String("table", table), zap.Int("filled", filled))
+	}
+
+	return nil
+}
+
+// backfillCursor returns the last id filled in by the data migration in the table, the number of
+// rows filled in so far and whether the table is done.
+func (bdk *BDKeeper) backfillCursor(ctx context.Context, name, table string) (string, int, bool, error) {
+	var lastID string
+	var filled int
+	var done bool
+	query := `SELECT last_id, filled, done FROM DataMigrations WHERE name = $1 AND table_name = $2`
+	err := bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), name, table).Scan(&lastID, &filled, &done)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", 0, false, nil
+	}
+	if err != nil {
+		return "", 0, false, fmt.Errorf("failed to read the data migration progress: %w", err)
+	}
+
+	return lastID, filled, done, nil
+}
+
+// saveBackfillCursor records the progress of the data migration in the table.
+func (bdk *BDKeeper) saveBackfillCursor(ctx context.Context, name, table, lastID string, filled int, done bool) error {
+	query := fmt.Sprintf(`INSERT INTO DataMigrations (name, table_name, last_id, filled, done, updated_at)
+		VALUES ($1, $2, $3, $4, $5, %[1]s)
+		ON CONFLICT (name, table_name) DO UPDATE SET last_id = $3, filled = $4, done = $5, updated_at = %[1]s`, bdk.dialect.now())
+	_, err := bdk.ex.ExecContext(ctx, bdk.dialect.rebind(query), name, table, lastID, filled, done)
+	if err != nil {
+		return fmt.Errorf("failed to save the data migration progress: %w", err)
+	}
+
+	return nil
+}
+
+// fillPayloadSizes sets the payload sizes of the entries stored before they were kept, from their
+// stored columns like writeDerived. The keeper has no key yet when it migrates, so the encrypted
+// values count as their ciphertext and the size is overestimated until the next change of the entry.
+func (bdk *BDKeeper) fillPayloadSizes(ctx context.Context, table, lastID string, batchSize int) (string, int, bool, error) {
+	schema, err := bdk.tableColumns(ctx, bdk.ex, table)
+	if err != nil {
+		return "", 0, false, err
+	}
+	tbl, err := bdk.tableIdent(ctx, bdk.ex, table)
+	if err != nil {
+		return "", 0, false, err
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s IS NULL AND id > $1 ORDER BY id LIMIT $2",
+		schema.selectList(schema.names), tbl, schema.column(payloadSizeColumn))
+	rows, err := bdk.ex.QueryContext(ctx, bdk.dialect.rebind(query), lastID, batchSize)
+	if err != nil {
+		return "", 0, false, err
+	}
+	data, err := scanRows(rows, schema.names)
+	rows.Close()
+	if err != nil {
+		return "", 0, false, err
+	}
+	if len(data) == 0 {
+		return lastID, 0, true, nil
+	}
+
+	update := bdk.dialect.rebind(fmt.Sprintf("UPDATE %s SET %s = $1 WHERE id = $2", tbl, schema.column(payloadSizeColumn)))
+	for _, row := range data {
+		if _, err := bdk.ex.ExecContext(ctx, update, models.EntrySize(row), row["id"]); err != nil {
+			return "", 0, false, fmt.Errorf("failed to write the payload size: %w", err)
+		}
+	}
+
+	return data[len(data)-1]["id"], len(data), len(data) < batchSize, nil
+}
+
+// fillSyncColumns sets the NULL synchronization columns of the entries stored before they had
+// their defaults, so the schema migration which follows can enforce them. The entries aren't
+// deleted, and they are updated at the time of the migration, so every client pulls them with its
+// next incremental synchronization: the tables keep no creation time to restore, and a fixed epoch
+// would keep them out of the incremental synchronizations for good.
+func (bdk *BDKeeper) fillSyncColumns(ctx context.Context, table, lastID string, batchSize int) (string, int, bool, error) {
+	tbl, err := bdk.tableIdent(ctx, bdk.ex, table)
+	if err != nil {
+		return "", 0, false, err
+	}
+
+	const legacy = "(deleted IS NULL OR updated_at IS NULL)"
+	ids, err := bdk.sampleIDs(ctx, jobSelection{table: table, ident: tbl, where: "id > $1 AND " + legacy, args: []interface{}{lastID}}, batchSize)
+	if err != nil {
+		return "", 0, false, err
+	}
+	if len(ids) == 0 {
+		return lastID, 0, true, nil
+	}
+
+	last := ids[len(ids)-1]
+	query := fmt.Sprintf("UPDATE %s SET deleted = COALESCE(deleted, FALSE), updated_at = COALESCE(updated_at, %s) WHERE id > $1 AND id <= $2 AND %s",
+		tbl, bdk.dialect.now(), legacy)
+	if _, err := bdk.ex.ExecContext(ctx, bdk.dialect.rebind(query), lastID, last); err != nil {
+		return "", 0, false, fmt.Errorf("failed to fill the synchronization columns: %w", err)
+	}
+
+	return last, len(ids), len(ids) < batchSize, nil
+}
+
+// fillSkeletons sets the skeletons of the usernames of the users registered before they were stored.
+// The skeletons are computed by the server, so the schema migration adding them can't.
+func (bdk *BDKeeper) fillSkeletons(ctx context.Context, _, lastID string, batchSize int) (string, int, bool, error) {
+	var after int
+	if lastID != "" {
+		var err error
+		if after, err = strconv.Atoi(lastID); err != nil {
+			return "", 0, false, fmt.Errorf("invalid user id %q: %w", lastID, err)
+		}
+	}
+
+	query := `SELECT id, username FROM Users WHERE username_skeleton IS NULL AND id > $1 ORDER BY id LIMIT $2`
+	rows, err := bdk.ex.QueryContext(ctx, bdk.dialect.rebind(query), after, batchSize)
+	if err != nil {
+		return "", 0, false, err
+	}
+	var ids []int
+	var names []string
+	for rows.Next() {
+		var id int
+		var username string
+		if err := rows.Scan(&id, &username); err != nil {
+			rows.Close()
+			return "", 0, false, err
+		}
+		ids = append(ids, id)
+		names = append(names, username)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", 0, false, err
+	}
+	if len(ids) == 0 {
+		return lastID, 0, true, nil
+	}
+
+	update := bdk.dialect.rebind(`UPDATE Users SET username_skeleton = $1 WHERE id = $2`)
+	for i, id := range ids {
+		if _, err := bdk.ex.ExecContext(ctx, update, models.UsernameSkeleton(names[i]), id); err != nil {
+			return "", 0, false, err
+		}
+	}
+
+	return strconv.Itoa(ids[len(ids)-1]), len(ids), len(ids) < batchSize, nil
+}
@@ -9,54 +9,134 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/golang-migrate/migrate/v4"
-	"github.com/golang-migrate/migrate/v4/database/postgres"
 	_ "github.com/golang-migrate/migrate/v4/source/file" // registers a migrate driver.
 	_ "github.com/jackc/pgx/v5/stdlib"                   // registers a pgx driver.
+	"github.com/wurt83ow/gophkeeper-server/internal/cache"
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"github.com/wurt83ow/gophkeeper-server/internal/storage"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	_ "modernc.org/sqlite" // registers a sqlite driver.
 )
 
-// Log represents a logging interface.
+// Log represents a leveled logging interface.
+// Failures of the database are logged as errors, recoverable problems as warnings
+// and the statements as debug traces.
 type Log interface {
+	Debug(string, ...zapcore.Field)
 	Info(string, ...zapcore.Field)
+	Warn(string, ...zapcore.Field)
+	Error(string, ...zapcore.Field)
 }
 
+// The zap-backed logger of the server is the default implementation of Log.
+var _ Log = (*logger.Logger)(nil)
+
 // BDKeeper represents a database keeper.
 type BDKeeper struct {
 	conn *sql.DB
-	log  Log
+	// ex runs the queries, the connection pool or the transaction of a WithTx view
+	ex           execer
+	tx           *txState
+	log          Log
+	dialect      dialect
+	historyLimit int
+
+	// rls scopes the data operations to the user of the context, see EnableRowLevelSecurity
+	rls        bool
+	bypassRole string
+
+	// metrics observes the public methods, it may be nil
+	metrics Metrics
+
+	// sealer encrypts the sensitive columns, see EnableEncryption, it may be nil
+	sealer *sealer
+
+	// verifyReads compares the entries read with their checksums, see EnableReadVerification
+	verifyReads bool
+
+	// legacySync reads the NULL synchronization columns of the rows stored before their defaults,
+	// set by the startup check while the migrations haven't enforced them, see checkColumns
+	legacySync bool
+
+	// skeletons stores and compares the skeletons of the usernames, set by the startup check
+	// once the migrations added their column, see checkColumns
+	skeletons bool
+
+	// replica serves the plain reads of the users who didn't write lately, see SetReadReplica
+	replica      *sql.DB
+	recentWrites *cache.Cache[writer, struct{}]
+
+	// columns caches the column names of the tables, the schema only changes with migrations at startup
+	columns *cache.Cache[string, *tableSchema]
+
+	// notifier notifies the other instances of the changes, see EnableChangeNotifications, it may be nil
+	notifier *notifier
+
+	// drain tracks the operations in flight, see Shutdown
+	drain *drain
 }
 
+// columnsCacheSize bounds the number of tables whose columns are cached.
+const columnsCacheSize = 64
+
+// errNoColumns is returned by the loader of the columns cache for a table which doesn't exist,
+// so it isn't cached.
+var errNoColumns = errors.New("table has no columns")
+
+// execer is implemented by both *sql.DB and *sql.Tx, so queries can run inside or outside a transaction.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+// BDKeeper implements the storage.Keeper interface.
+var _ storage.Keeper = (*BDKeeper)(nil)
+
 // NewBDKeeper creates a new BDKeeper instance.
+// A DSN of the form sqlite:///path/to/db selects the SQLite backend, any other DSN is passed to PostgreSQL.
 func NewBDKeeper(dsn func() string, log Log, db *sql.DB) (*BDKeeper, error) {
 	addr := dsn()
 	if addr == "" && db == nil {
-		log.Info("database dsn is empty")
+		log.Error("database dsn is empty")
 		return nil, errors.New("database dsn is empty")
 	}
 
+	d, addr := dialectFor(addr)
+
 	// If a database is passed, use it, otherwise connect to a new database.
 	var conn *sql.DB
+	var m *migrate.Migrate
 	if db != nil {
 		conn = db
 	} else {
 		var err error
-		conn, err = sql.Open("pgx", dsn())
+		conn, err = sql.Open(d.driverName(), addr)
 		if err != nil {
-			log.Info("Unable to connect to database: ", zap.Error(err))
+			log.Error("Unable to connect to database: ", zap.Error(err))
 			return nil, err
 		}
-		driver, err := postgres.WithInstance(conn, new(postgres.Config))
+
+		// SQLite allows a single writer, so serialize access instead of failing with "database is locked"
+		if _, ok := d.(sqliteDialect); ok {
+			conn.SetMaxOpenConns(1)
+		}
+
+		driver, migrations, err := d.migrationDriver(conn)
 		if err != nil {
-			log.Info("error getting driver: ", zap.Error(err))
+			log.Error("error getting driver: ", zap.Error(err))
 			return nil, err
 		}
 
 		dir, err := os.Getwd()
 		if err != nil {
-			log.Info("error getting getwd: ", zap.Error(err))
+			log.Warn("error getting getwd: ", zap.Error(err))
 		}
 
 		// Fix error test path
@@ -67,47 +147,81 @@ func NewBDKeeper(dsn func() string, log Log, db *sql.DB) (*BDKeeper, error) {
 			path = "../../"
 		}
 
-		m, err := migrate.NewWithDatabaseInstance(
-			fmt.Sprintf("file://%smigrations", path),
-			"postgres",
+		m, err = migrate.NewWithDatabaseInstance(
+			fmt.Sprintf("file://%s%s", path, migrations),
+			d.driverName(),
 			driver)
 		if err != nil {
-			log.Info("Error creating migration instance : ", zap.Error(err))
+			log.Error("Error creating migration instance : ", zap.Error(err))
 			return nil, err
 		}
-
-		err = m.Up()
-		if err != nil {
-			log.Info("Error while performing migration: ", zap.Error(err))
-		}
 	}
 
 	log.Info("Connected!")
 
-	return &BDKeeper{
-		conn: conn,
-		log:  log,
-	}, nil
+	bdk := &BDKeeper{
+		conn:         conn,
+		ex:           traceExecer{ex: conn, log: log},
+		log:          log,
+		dialect:      d,
+		historyLimit: DefaultHistoryLimit,
+		columns:      cache.New[string, *tableSchema]("table_columns", columnsCacheSize, 0),
+		drain:        newDrain(),
+	}
+
+	// Migrate and check the schema the migrations left behind, a passed database is managed by the caller
+	if db == nil {
+		if err := bdk.migrateUp(context.Background(), m, backfillBatchSize); err != nil {
+			log.Error("Error while performing migration: ", zap.Error(err))
+		}
+		if err := bdk.checkColumns(context.Background()); err != nil {
+			log.Error("error checking columns: ", zap.Error(err))
+		}
+	}
+
+	return bdk, nil
 }
 
-// Ping checks the connectivity to the PostgreSQL database and returns true if successful, otherwise false.
+// Ping checks the connectivity to the PostgreSQL database and its read replica, if any,
+// and returns true if successful, otherwise false. A keeper shutting down isn't reachable.
 func (bdk *BDKeeper) Ping() bool {
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	ctx, leave, err := bdk.enter(context.Background())
+	if err != nil {
+		return false
+	}
+	defer leave()
+
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
 	defer cancel()
 
-	if err := bdk.conn.PingContext(ctx); err != nil {
-		return false
+	start := time.Now()
+	err = bdk.conn.PingContext(ctx)
+	if err == nil {
+		err = bdk.pingReplica(ctx)
 	}
+	bdk.observe("ping", "", start, &err)
 
-	return true
+	return err == nil
 }
 
-// Close closes the connection to the PostgreSQL database and returns true if successful, otherwise false.
+// Close closes the connections to the PostgreSQL database and its read replica, if any,
+// and returns true if successful, otherwise false. It doesn't wait for the operations in flight,
+// see Shutdown.
+// A transaction view doesn't own the connection, closing it does nothing and returns false.
 func (bdk *BDKeeper) Close() bool {
+	if bdk.tx != nil {
+		return false
+	}
+
 	bdk.log.Info("Stop database")
 	err := bdk.conn.Close()
+	if bdk.replica != nil {
+		if rerr := bdk.replica.Close(); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
 	if err != nil {
-		bdk.log.Info("Error closing database connection: ", zap.Error(err))
+		bdk.log.Error("Error closing database connection: ", zap.Error(err))
 		return false
 	}
 	bdk.log.Info("All SQL queries are completed")
@@ -115,16 +229,24 @@ func (bdk *BDKeeper) Close() bool {
 }
 
 // UserExists checks if a user exists in the database.
-func (bdk *BDKeeper) UserExists(ctx context.Context, username string) (bool, error) {
+func (bdk *BDKeeper) UserExists(ctx context.Context, username string) (_ bool, err error) {
+	defer bdk.observe("user_exists", usersTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer leave()
+	r := bdk.reader(accountWriter(username))
+
 	// Query to check if the user exists in the database.
 	query := `SELECT COUNT(*) FROM Users WHERE username = $1;`
 
 	// Execute the query.
-	row := bdk.conn.QueryRowContext(ctx, query, username)
+	row := r.ex.QueryRowContext(ctx, r.dialect.rebind(query), username)
 
 	// Get the result.
 	var count int
-	err := row.Scan(&count)
+	err = row.Scan(&count)
 	if err != nil {
 		return false, err
 	}
@@ -133,27 +255,74 @@ func (bdk *BDKeeper) UserExists(ctx context.Context, username string) (bool, err
 	return count > 0, nil
 }
 
+// UsernameTaken reports whether a user has the username or a lookalike of it, a username of the same skeleton.
+func (bdk *BDKeeper) UsernameTaken(ctx context.Context, username string) (_ bool, err error) {
+	defer bdk.observe("username_taken", usersTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer leave()
+
+	// The primary is asked, a user registered a moment ago takes the username at once
+	query := `SELECT COUNT(*) FROM Users WHERE username = $1`
+	args := []interface{}{username}
+	if bdk.skeletons {
+		query += ` OR username_skeleton = $2`
+		args = append(args, models.UsernameSkeleton(username))
+	}
+
+	var count int
+	err = bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), args...).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
 // AddUser adds a new user to the database.
-func (bdk *BDKeeper) AddUser(ctx context.Context, username string, hashedPassword string) error {
-	// Query to add a new user to the database.
+func (bdk *BDKeeper) AddUser(ctx context.Context, username string, hashedPassword string) (err error) {
+	defer bdk.observe("add_user", usersTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	bdk.wrote(accountWriter(username))
+
+	// Query to add a new user to the database, with the skeleton its lookalikes are found by.
 	query := `INSERT INTO Users (username, password) VALUES ($1, $2);`
+	args := []interface{}{username, hashedPassword}
+	if bdk.skeletons {
+		query = `INSERT INTO Users (username, password, username_skeleton) VALUES ($1, $2, $3);`
+		args = append(args, models.UsernameSkeleton(username))
+	}
 
 	// Execute the query.
-	_, err := bdk.conn.ExecContext(ctx, query, username, hashedPassword)
+	_, err = bdk.ex.ExecContext(ctx, bdk.dialect.rebind(query), args...)
 	return err
 }
 
 // GetPassword retrieves the hashed password of a user from the database.
-func (bdk *BDKeeper) GetPassword(ctx context.Context, username string) (string, error) {
+func (bdk *BDKeeper) GetPassword(ctx context.Context, username string) (_ string, err error) {
+	defer bdk.observe("get_password", usersTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer leave()
+	r := bdk.reader(accountWriter(username))
+
 	// Query to retrieve the hashed password of a user from the database.
 	query := `SELECT password FROM Users WHERE username = $1;`
 
 	// Execute the query.
-	row := bdk.conn.QueryRowContext(ctx, query, username)
+	row := r.ex.QueryRowContext(ctx, r.dialect.rebind(query), username)
 
 	// Get the result.
 	var password string
-	err := row.Scan(&password)
+	err = row.Scan(&password)
 	if err != nil {
 		return "", err
 	}
@@ -163,16 +332,24 @@ func (bdk *BDKeeper) GetPassword(ctx context.Context, username string) (string,
 }
 
 // GetUserID retrieves the user ID of a user from the database.
-func (bdk *BDKeeper) GetUserID(ctx context.Context, username string) (int, error) {
+func (bdk *BDKeeper) GetUserID(ctx context.Context, username string) (_ int, err error) {
+	defer bdk.observe("get_user_id", usersTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer leave()
+	r := bdk.reader(accountWriter(username))
+
 	// Query to retrieve the user ID of a user from the database.
 	query := `SELECT id FROM Users WHERE username = $1;`
 
 	// Execute the query.
-	row := bdk.conn.QueryRowContext(ctx, query, username)
+	row := r.ex.QueryRowContext(ctx, r.dialect.rebind(query), username)
 
 	// Get the result.
 	var id int
-	err := row.Scan(&id)
+	err = row.Scan(&id)
 	if err != nil {
 		return 0, err
 	}
@@ -181,18 +358,138 @@ func (bdk *BDKeeper) GetUserID(ctx context.Context, username string) (int, error
 	return id, nil
 }
 
-// AddData adds data to a table in the database.
-func (bdk *BDKeeper) AddData(ctx context.Context, table string, user_id int, entry_id string, data map[string]string) error {
+// UpdatePassword replaces the hashed password of a user and revokes all their refresh tokens
+// in one transaction, so the sessions opened with the old password end with it. The time of the
+// change ends their access tokens, see GetUserAccess.
+// It returns models.ErrNotFound if the user doesn't exist.
+func (bdk *BDKeeper) UpdatePassword(ctx context.Context, userID int, hashedPassword string) (err error) {
+	defer bdk.observe("update_password", usersTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	bdk.wrote(userWriter(userID))
+
+	return bdk.inTx(ctx, func(view *BDKeeper) error {
+		// The logins read the password by name, they must not see the old one on the replica
+		var username string
+		query := `UPDATE Users SET password = $1, password_changed_at = $2 WHERE id = $3 RETURNING username`
+		err := view.ex.QueryRowContext(ctx, view.dialect.rebind(query), hashedPassword, view.dialect.timeArg(time.Now().UTC()), userID).Scan(&username)
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update password: %w", err)
+		}
+		bdk.wrote(accountWriter(username))
+
+		query = `UPDATE refresh_tokens SET revoked = TRUE WHERE user_id = $1 AND revoked = FALSE`
+		if _, err := view.ex.ExecContext(ctx, view.dialect.rebind(query), userID); err != nil {
+			return fmt.Errorf("failed to revoke refresh tokens: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// RehashPassword replaces the hashed password of a user with another hash of the same password,
+// the sessions go on. The hash is replaced only if it is still oldHash, so a concurrent password
+// change isn't undone. It reports whether it was replaced.
+func (bdk *BDKeeper) RehashPassword(ctx context.Context, userID int, oldHash, newHash string) (_ bool, err error) {
+	defer bdk.observe("rehash_password", usersTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer leave()
+	bdk.wrote(userWriter(userID))
+
+	var username string
+	query := `UPDATE Users SET password = $1 WHERE id = $2 AND password = $3 RETURNING username`
+	err = bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), newHash, userID, oldHash).Scan(&username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to rehash password: %w", err)
+	}
+	bdk.wrote(accountWriter(username))
+
+	return true, nil
+}
+
+// AddData adds data to a table in the database. An entry without an id gets a new one.
+// It returns the id of the entry and the 'updated_at' value assigned to it by the database.
+func (bdk *BDKeeper) AddData(ctx context.Context, table string, user_id int, entry_id string, data map[string]string) (_ string, _ time.Time, err error) {
+	if entry_id == "" {
+		entry_id = models.NewEntryID()
+	}
+	defer bdk.observe("add_data", table, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer leave()
+	defer bdk.audit(ctx, models.AuditAdd, table, user_id, entry_id, &err)
+	bdk.wrote(userWriter(user_id))
+
+	// The entry is added in a transaction with its checksum
+	var updatedAt time.Time
+	err = bdk.inTx(ctx, func(view *BDKeeper) (err error) {
+		updatedAt, err = view.addData(ctx, view.ex, table, user_id, entry_id, data)
+		return err
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	bdk.changed(ctx, user_id, models.VaultEvent{Table: table, EntryID: entry_id, UpdatedAt: updatedAt})
+
+	return entry_id, updatedAt, nil
+}
+
+// addData adds data to a table using the given execer.
+func (bdk *BDKeeper) addData(ctx context.Context, ex execer, table string, user_id int, entry_id string, data map[string]string) (time.Time, error) {
+	data, err := models.NormalizeFields(data)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := models.CheckServerFields(data); err != nil {
+		return time.Time{}, err
+	}
+	if err := models.DeriveSshFields(table, data); err != nil {
+		return time.Time{}, err
+	}
+	if err := bdk.entryFolder(ctx, user_id, data[models.FolderField]); err != nil {
+		return time.Time{}, err
+	}
+	schema, err := bdk.tableColumns(ctx, ex, table)
+	if err != nil {
+		return time.Time{}, err
+	}
+	tbl, err := bdk.tableIdent(ctx, ex, table)
+	if err != nil {
+		return time.Time{}, err
+	}
+
 	keys := make([]string, 0, len(data)+2)        // +2 for user_id and entry_id
 	values := make([]interface{}, 0, len(data)+2) // +2 for user_id and entry_id
 
 	// Add user_id and entry_id to the beginning of the lists of keys and values
-	keys = append(keys, "user_id", "id")
+	keys = append(keys, schema.column("user_id"), schema.column("id"))
 	values = append(values, user_id, entry_id)
 
 	for key, value := range data {
-		keys = append(keys, key)
-		values = append(values, value)
+		// The derived and the blob columns are always assigned by the server
+		if derivedColumns[key] || blobColumns[key] {
+			continue
+		}
+		arg, err := bdk.fieldArg(table, key, value)
+		if err != nil {
+			return time.Time{}, err
+		}
+		keys = append(keys, schema.column(key))
+		values = append(values, arg)
 	}
 
 	// Create placeholders for values
@@ -201,63 +498,538 @@ func (bdk *BDKeeper) AddData(ctx context.Context, table string, user_id int, ent
 		placeholders[i] = "$" + strconv.Itoa(i+1)
 	}
 
-	stmt, err := bdk.conn.Prepare(fmt.Sprintf("INSERT INTO %s(%s) VALUES(%s)", table, strings.Join(keys, ","), strings.Join(placeholders, ",")))
+	// Use the database clock, so the timestamps of all writes are ordered regardless of the server clocks
+	keys = append(keys, schema.column("updated_at"))
+	placeholders = append(placeholders, bdk.dialect.now())
+
+	query := fmt.Sprintf("INSERT INTO %s(%s) VALUES(%s) RETURNING updated_at", tbl, strings.Join(keys, ","), strings.Join(placeholders, ","))
+	stmt, err := ex.PrepareContext(ctx, bdk.dialect.rebind(query))
 	if err != nil {
-		return err
+		return time.Time{}, err
 	}
-	_, err = stmt.ExecContext(ctx, values...)
+	defer stmt.Close()
 
-	return err
+	var updatedAt time.Time
+	if err := stmt.QueryRowContext(ctx, values...).Scan(&updatedAt); err != nil {
+		return time.Time{}, err
+	}
+
+	return updatedAt, bdk.writeDerived(ctx, ex, table, user_id, []string{entry_id})
 }
 
-// UpdateData updates data in a table in the database.
-func (bdk *BDKeeper) UpdateData(ctx context.Context, table string, user_id int, entry_id string, data map[string]string) error {
-	setClauses := make([]string, 0, len(data))
+// fieldArg validates the value of an entry field sent by a client and converts it to a query argument.
+// The sensitive fields are encrypted if encryption is enabled.
+func (bdk *BDKeeper) fieldArg(table, key, value string) (interface{}, error) {
+	switch {
+	case key == models.TagsField:
+		tags, err := models.ParseTags(value)
+		if err != nil {
+			return nil, err
+		}
+		return bdk.dialect.tagsArg(tags), nil
+	case models.IsClientTimeField(key):
+		return models.NormalizeClientTime(key, value, time.Now())
+	case key == models.ExpiresAtField:
+		expiresAt, err := models.ParseExpiresAt(value)
+		if err != nil || expiresAt.IsZero() {
+			return nil, err
+		}
+		return bdk.dialect.timeArg(expiresAt), nil
+	case key == models.PreviewField:
+		// The preview is plaintext by design, it is never encrypted
+		return models.ParsePreview(table, value)
+	case key == models.FolderField:
+		folderID, err := models.ParseFolderID(value)
+		if err != nil || folderID == "" {
+			return nil, err
+		}
+		return folderID, nil
+	case models.IsOtpField(table, key):
+		value, err := models.ParseOtpField(key, value)
+		switch {
+		case err != nil:
+			return nil, err
+		case key == models.OtpSecretField:
+			return bdk.sealField(table, key, value)
+		case value == "":
+			// NULL is the default of the authenticator apps
+			return nil, nil
+		case key == models.OtpDigitsField || key == models.OtpPeriodField:
+			return strconv.Atoi(value)
+		}
+		return value, nil
+	}
+
+	return bdk.sealField(table, key, value)
+}
+
+// notExpired returns the condition excluding the entries whose expires_at has passed,
+// as seen by the database clock.
+func (bdk *BDKeeper) notExpired() string {
+	return fmt.Sprintf("(%s IS NULL OR %s > %s)", models.ExpiresAtField, models.ExpiresAtField, bdk.dialect.now())
+}
+
+// notDeleted returns the condition matching the entries which aren't deleted. While the synchronization
+// columns aren't enforced, a NULL deleted of a legacy row counts as false.
+func (bdk *BDKeeper) notDeleted() string {
+	if bdk.legacySync {
+		return "COALESCE(deleted, FALSE) = FALSE"
+	}
+
+	return "deleted = false"
+}
+
+// updatedAfter returns the condition matching the entries updated after the time in the placeholder.
+// While the synchronization columns aren't enforced, a NULL updated_at of a legacy row counts as now,
+// so the row is in every incremental synchronization until it is back-filled.
+func (bdk *BDKeeper) updatedAfter(placeholder string) string {
+	if bdk.legacySync {
+		return fmt.Sprintf("COALESCE(updated_at, %s) > %s", bdk.dialect.now(), placeholder)
+	}
+
+	return "updated_at > " + placeholder
+}
+
+// UpdateData updates data in a table in the database and refreshes the 'updated_at' field.
+// The prior version of the entry is kept in the history. An entry of another user shared with the user
+// is updated if the share permits it, otherwise it fails with models.ErrReadOnlyShare.
+// It returns the new 'updated_at' value, or models.ErrNotFound if the user has no such entry.
+func (bdk *BDKeeper) UpdateData(ctx context.Context, table string, user_id int, entry_id string, data map[string]string) (_ time.Time, err error) {
+	defer bdk.observe("update_data", table, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer leave()
+	defer bdk.audit(ctx, models.AuditUpdate, table, user_id, entry_id, &err)
+	bdk.wrote(userWriter(user_id))
+
+	var updatedAt time.Time
+	owner := user_id
+	err = bdk.inTx(ctx, func(view *BDKeeper) (err error) {
+		if owner, err = view.writableEntry(ctx, table, user_id, entry_id); err != nil {
+			return err
+		}
+		return view.asTenant(ctx, owner, func() (err error) {
+			updatedAt, err = view.updateData(ctx, view.ex, table, owner, entry_id, data)
+			return err
+		})
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	bdk.wrote(userWriter(owner))
+	bdk.changed(ctx, owner, models.VaultEvent{Table: table, EntryID: entry_id, UpdatedAt: updatedAt})
+
+	return updatedAt, nil
+}
+
+// updateData updates data in a table using the given execer, or returns models.ErrNotFound if the user
+// has no such entry.
+func (bdk *BDKeeper) updateData(ctx context.Context, ex execer, table string, user_id int, entry_id string, data map[string]string) (time.Time, error) {
+	data, err := models.NormalizeFields(data)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := models.CheckServerFields(data); err != nil {
+		return time.Time{}, err
+	}
+	if err := models.DeriveSshFields(table, data); err != nil {
+		return time.Time{}, err
+	}
+	if err := bdk.entryFolder(ctx, user_id, data[models.FolderField]); err != nil {
+		return time.Time{}, err
+	}
+	schema, err := bdk.tableColumns(ctx, ex, table)
+	if err != nil {
+		return time.Time{}, err
+	}
+	tbl, err := bdk.tableIdent(ctx, ex, table)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if err := bdk.saveVersion(ctx, ex, table, user_id, entry_id); err != nil {
+		return time.Time{}, err
+	}
+
+	setClauses := make([]string, 0, len(data)+1)
 	values := make([]interface{}, 0, len(data)+2) // +2 для user_id и id
 
 	i := 1
 	for key, value := range data {
-		setClauses = append(setClauses, key+" = $"+strconv.Itoa(i))
-		values = append(values, value)
+		// The derived and the blob columns are always assigned by the server, the display timestamps are kept as created
+		if derivedColumns[key] || blobColumns[key] || models.IsClientTimeField(key) {
+			continue
+		}
+		arg, err := bdk.fieldArg(table, key, value)
+		if err != nil {
+			return time.Time{}, err
+		}
+		setClauses = append(setClauses, schema.column(key)+" = $"+strconv.Itoa(i))
+		values = append(values, arg)
 		i++
 	}
 
+	// A new expiry revives an entry deleted because the previous one passed,
+	// the condition sees the values before the update
+	if _, ok := data[models.ExpiresAtField]; ok {
+		setClauses = append(setClauses, fmt.Sprintf("deleted = CASE WHEN %s THEN deleted ELSE FALSE END", bdk.notExpired()))
+	}
+
+	// Refresh updated_at so the change is picked up by the next synchronization
+	setClauses = append(setClauses, "updated_at = "+bdk.dialect.nextTime("updated_at"))
+
 	// Add user_id and id to the end of the list of values
 	values = append(values, user_id, entry_id)
 
-	stmt, err := bdk.conn.Prepare(fmt.Sprintf("UPDATE %s SET %s WHERE user_id = $%d AND id = $%d", table, strings.Join(setClauses, ","), i, i+1))
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE user_id = $%d AND id = $%d RETURNING updated_at", tbl, strings.Join(setClauses, ","), i, i+1)
+	stmt, err := ex.PrepareContext(ctx, bdk.dialect.rebind(query))
 	if err != nil {
-		return err
+		return time.Time{}, err
 	}
-	_, err = stmt.ExecContext(ctx, values...)
-	return err
+	defer stmt.Close()
+
+	updatedAt, err := scanUpdatedAt(stmt.QueryRowContext(ctx, values...))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return updatedAt, bdk.writeDerived(ctx, ex, table, user_id, []string{entry_id})
 }
 
 // DeleteData marks data as deleted in a table in the database and updates the 'updated_at' field.
-func (bdk *BDKeeper) DeleteData(ctx context.Context, table string, user_id int, entry_id string) error {
+// The prior version of the entry is kept in the history. An entry of another user shared with the user
+// is deleted if the share permits it, otherwise it fails with models.ErrReadOnlyShare.
+// It returns the new 'updated_at' value, or models.ErrNotFound if the user has no such entry.
+func (bdk *BDKeeper) DeleteData(ctx context.Context, table string, user_id int, entry_id string) (_ time.Time, err error) {
+	defer bdk.observe("delete_data", table, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer leave()
+	defer bdk.audit(ctx, models.AuditDelete, table, user_id, entry_id, &err)
+	bdk.wrote(userWriter(user_id))
+
+	var updatedAt time.Time
+	owner := user_id
+	err = bdk.inTx(ctx, func(view *BDKeeper) (err error) {
+		if owner, err = view.writableEntry(ctx, table, user_id, entry_id); err != nil {
+			return err
+		}
+		return view.asTenant(ctx, owner, func() (err error) {
+			updatedAt, err = view.deleteData(ctx, view.ex, table, owner, entry_id)
+			return err
+		})
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	bdk.wrote(userWriter(owner))
+	bdk.changed(ctx, owner, models.VaultEvent{Table: table, EntryID: entry_id, UpdatedAt: updatedAt})
+
+	return updatedAt, nil
+}
+
+// deleteData marks data as deleted in a table using the given execer, or returns models.ErrNotFound
+// if the user has no such entry.
+func (bdk *BDKeeper) deleteData(ctx context.Context, ex execer, table string, user_id int, entry_id string) (time.Time, error) {
 	// Check user_id and table
 	if user_id == 0 || table == "" {
-		return errors.New("user_id and table must be specified")
+		return time.Time{}, errors.New("user_id and table must be specified")
 	}
 
 	// Check entry_id
 	if entry_id == "" {
-		return errors.New("entry_id must be specified")
+		return time.Time{}, errors.New("entry_id must be specified")
+	}
+	tbl, err := bdk.tableIdent(ctx, ex, table)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if err := bdk.saveVersion(ctx, ex, table, user_id, entry_id); err != nil {
+		return time.Time{}, err
 	}
 
 	// Prepare the query to update the record's deleted flag and 'updated_at' field
-	updateQuery := fmt.Sprintf("UPDATE %s SET deleted = TRUE, updated_at = $1 WHERE user_id = $2 AND id = $3", table)
-	args := []interface{}{time.Now().UTC(), user_id, entry_id}
+	updateQuery := fmt.Sprintf("UPDATE %s SET deleted = TRUE, updated_at = %s WHERE user_id = $1 AND id = $2 RETURNING updated_at", tbl, bdk.dialect.nextTime("updated_at"))
 
 	// Execute the query to update the record's deleted flag and 'updated_at' field
-	_, err := bdk.conn.ExecContext(ctx, updateQuery, args...)
-	return err
+	return scanUpdatedAt(ex.QueryRowContext(ctx, bdk.dialect.rebind(updateQuery), user_id, entry_id))
+}
+
+// UndeleteData restores data marked as deleted in a table in the database and updates the 'updated_at' field.
+// The deleted version of the entry is kept in the history. It returns models.ErrNotFound if the user has no such entry.
+func (bdk *BDKeeper) UndeleteData(ctx context.Context, table string, user_id int, entry_id string) (_ time.Time, err error) {
+	defer bdk.observe("undelete_data", table, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer leave()
+	defer bdk.audit(ctx, models.AuditUndelete, table, user_id, entry_id, &err)
+	bdk.wrote(userWriter(user_id))
+
+	var updatedAt time.Time
+	err = bdk.inTx(ctx, func(view *BDKeeper) (err error) {
+		updatedAt, err = view.undeleteData(ctx, table, user_id, entry_id)
+		return err
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	bdk.changed(ctx, user_id, models.VaultEvent{Table: table, EntryID: entry_id, UpdatedAt: updatedAt})
+
+	return updatedAt, nil
+}
+
+// undeleteData runs UndeleteData on the view of a transaction.
+func (bdk *BDKeeper) undeleteData(ctx context.Context, table string, user_id int, entry_id string) (time.Time, error) {
+	tbl, err := bdk.tableIdent(ctx, bdk.ex, table)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if err := bdk.saveVersion(ctx, bdk.ex, table, user_id, entry_id); err != nil {
+		return time.Time{}, err
+	}
+
+	// Prepare the query to reset the record's deleted flag and move 'updated_at' forward,
+	// so the entry is picked up by the next synchronization
+	query := fmt.Sprintf("UPDATE %s SET deleted = FALSE, updated_at = %s WHERE user_id = $1 AND id = $2 RETURNING updated_at", tbl, bdk.dialect.nextTime("updated_at"))
+
+	var updatedAt time.Time
+	err = bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), user_id, entry_id).Scan(&updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, models.ErrNotFound
+	}
+
+	return updatedAt, err
+}
+
+// scanUpdatedAt returns the 'updated_at' value returned by an UPDATE statement.
+// An update that matched no entry isn't an error and yields the zero time.
+func scanUpdatedAt(row *sql.Row) (time.Time, error) {
+	var updatedAt time.Time
+	err := row.Scan(&updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, models.ErrNotFound
+	}
+
+	return updatedAt, err
+}
+
+// GetData retrieves a single entry of the user from a table in the database.
+// It returns models.ErrNotFound if the user has no such entry, or it has expired and inclExpired is false.
+func (bdk *BDKeeper) GetData(ctx context.Context, table string, userID int, entryID string, inclExpired bool) (_ map[string]string, err error) {
+	defer bdk.observe("get_data", table, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	return scoped(ctx, bdk.reader(userWriter(userID)), func(view *BDKeeper) (map[string]string, error) {
+		return view.getData(ctx, table, userID, entryID, inclExpired)
+	})
+}
+
+// getData runs GetData on the keeper or view.
+func (bdk *BDKeeper) getData(ctx context.Context, table string, userID int, entryID string, inclExpired bool) (map[string]string, error) {
+	schema, err := bdk.tableColumns(ctx, bdk.ex, table)
+	if err != nil {
+		return nil, err
+	}
+	tbl, err := bdk.tableIdent(ctx, bdk.ex, table)
+	if err != nil {
+		return nil, err
+	}
+
+	var condition string
+	if !inclExpired {
+		condition = " AND " + bdk.notExpired()
+	}
+
+	cols := bdk.withChecksum(schema, schema.names)
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE user_id = $1 AND id = $2%s", schema.selectList(cols), tbl, condition)
+	rows, err := bdk.ex.QueryContext(ctx, bdk.dialect.rebind(query), userID, entryID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	data, err := scanRows(rows, cols)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, models.ErrNotFound
+	}
+	if err := bdk.openRows(table, data); err != nil {
+		return nil, err
+	}
+	bdk.checkReads(ctx, table, userID, cols, data)
+
+	return data[0], nil
+}
+
+// GetAllData retrieves the data of the user selected by the query from a table in the database,
+// sorted by the order of the query. The columns of the query, its filter and its order are validated
+// against the table, so an unknown one fails with models.ErrUnknownColumn.
+func (bdk *BDKeeper) GetAllData(ctx context.Context, table string, userID int, q models.DataQuery) (_ []map[string]string, err error) {
+	defer bdk.observe("get_all_data", table, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	return scoped(ctx, bdk.reader(userWriter(userID)), func(view *BDKeeper) ([]map[string]string, error) {
+		return view.getAllData(ctx, table, userID, q)
+	})
 }
 
-// GetAllData retrieves all data from a table in the database.
-func (bdk *BDKeeper) GetAllData(ctx context.Context, table string, userID int, lastSync time.Time, inclDel bool) ([]map[string]string, error) {
-	// Get all columns of the table
-	rows, err := bdk.conn.QueryContext(ctx, fmt.Sprintf(`SELECT column_name FROM information_schema.columns WHERE table_name = '%s'`, strings.ToLower(table)))
+// getAllData runs GetAllData on the keeper or view.
+func (bdk *BDKeeper) getAllData(ctx context.Context, table string, userID int, q models.DataQuery) ([]map[string]string, error) {
+	query, args, cols, err := bdk.allDataQuery(ctx, table, userID, q)
+	if err != nil {
+		return nil, err
+	}
+
+	// Execute the query to fetch all data from the table for the given user ID considering the condition
+	rows, err := bdk.ex.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	data, err := scanRows(rows, cols)
+	if err != nil {
+		return nil, err
+	}
+	if err := bdk.openRows(table, data); err != nil {
+		return nil, err
+	}
+	bdk.checkReads(ctx, table, userID, cols, data)
+
+	var warnings int
+	for _, row := range data {
+		if row[models.DataWarning] == models.WarningInvalidUTF8 {
+			warnings++
+		}
+	}
+	if warnings > 0 {
+		bdk.log.Warn("entries with invalid encoding returned", logger.ContextFields(ctx,
+			zap.String("table", table), zap.Int("user_id", userID), zap.Int("entries", warnings))...)
+	}
+
+	return data, nil
+}
+
+// allDataQuery builds the query of GetAllData and returns it with its arguments and the selected columns.
+// The conditions compare the bare columns, so the indexes on (user_id, updated_at) serve synchronization.
+func (bdk *BDKeeper) allDataQuery(ctx context.Context, table string, userID int, q models.DataQuery) (string, []interface{}, []string, error) {
+	// Get the projected columns of the table
+	schema, err := bdk.tableColumns(ctx, bdk.ex, table)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	tbl, err := bdk.tableIdent(ctx, bdk.ex, table)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	filter, err := q.Filter.Validate(schema.names)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	order, err := q.OrderBy.Validate(schema.names)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if err := bdk.checkEncryptedQuery(filter, order); err != nil {
+		return "", nil, nil, err
+	}
+	cols, err := models.ProjectColumns(schema.names, q.Columns)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	cols = bdk.withChecksum(schema, cols)
+
+	// Build the condition for the query
+	var condition string
+	args := []interface{}{userID}
+	if !q.InclDeleted {
+		condition += " AND " + bdk.notDeleted()
+	}
+	if !q.InclExpired {
+		condition += " AND " + bdk.notExpired()
+	}
+	if !q.LastSync.IsZero() {
+		args = append(args, bdk.dialect.timeArg(q.LastSync.UTC()))
+		condition += " AND " + bdk.updatedAfter(fmt.Sprintf("$%d", len(args)))
+	}
+	if tag := models.NormalizeTag(q.Tag); tag != "" {
+		args = append(args, tag)
+		condition += " AND " + bdk.dialect.hasTag(models.TagsField, fmt.Sprintf("$%d", len(args)))
+	}
+	if q.Folder != "" {
+		folderID := q.Folder
+		if folderID == models.RootFolder {
+			folderID = ""
+		}
+		args = append(args, folderID)
+		condition += fmt.Sprintf(" AND COALESCE(%s, '') = $%d", schema.column(models.FolderField), len(args))
+	}
+	filterCond, args, err := bdk.filterCondition(schema, filter, args)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	condition += filterCond
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE user_id = $1%s ORDER BY %s",
+		schema.selectList(cols), tbl, condition, orderClause(schema, order))
+
+	return bdk.dialect.rebind(query), args, cols, nil
+}
+
+// orderClause returns the ORDER BY expressions of the validated order, with the id as the tiebreaker.
+func orderClause(schema *tableSchema, o models.Order) string {
+	dir := "ASC"
+	if o.Desc {
+		dir = "DESC"
+	}
+
+	clause := fmt.Sprintf("%s %s NULLS LAST", schema.column(o.Column), dir)
+	if o.Column != "id" {
+		clause += fmt.Sprintf(", %s %s", schema.column("id"), dir)
+	}
+
+	return clause
+}
+
+// tableColumns returns the columns of the table, reading them from the database once.
+// A table which doesn't exist has no columns.
+func (bdk *BDKeeper) tableColumns(ctx context.Context, ex execer, table string) (*tableSchema, error) {
+	schema, err := bdk.columns.GetOrLoad(ctx, table, func(ctx context.Context) (*tableSchema, error) {
+		cols, err := bdk.readColumns(ctx, ex, table)
+		if err == nil && len(cols) == 0 {
+			return nil, errNoColumns
+		}
+		return newTableSchema(cols), err
+	})
+	if errors.Is(err, errNoColumns) {
+		return newTableSchema(nil), nil
+	}
+
+	return schema, err
+}
+
+// readColumns queries the column names of the table from the database.
+func (bdk *BDKeeper) readColumns(ctx context.Context, ex execer, table string) ([]string, error) {
+	colsQuery, colsArgs := bdk.dialect.columnsQuery(table)
+	rows, err := ex.QueryContext(ctx, bdk.dialect.rebind(colsQuery), colsArgs...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get columns: %w", err)
 	}
@@ -275,22 +1047,16 @@ func (bdk *BDKeeper) GetAllData(ctx context.Context, table string, userID int, l
 		return nil, fmt.Errorf("rows encountered an error: %w", err)
 	}
 
-	// Build the condition for the query
-	var condition string
-	if !inclDel {
-		condition += " AND deleted = false"
-	}
-	if !lastSync.IsZero() {
-		condition += fmt.Sprintf(" AND updated_at > '%s'", lastSync.Format(time.RFC3339))
-	}
+	return cols, nil
+}
 
-	// Execute the query to fetch all data from the table for the given user ID considering the condition
-	query := fmt.Sprintf("SELECT %s FROM %s WHERE user_id = $1%s", strings.Join(cols, ","), table, condition)
-	rows, err = bdk.conn.QueryContext(ctx, query, userID)
+// scanRows reads the rows selected with the given columns into maps of column values.
+func scanRows(rows *sql.Rows, cols []string) ([]map[string]string, error) {
+	// Boolean columns are normalized to "true"/"false" whatever the database returns
+	types, err := rows.ColumnTypes()
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute query: %w", err)
+		return nil, fmt.Errorf("failed to get column types: %w", err)
 	}
-	defer rows.Close()
 
 	values := make([]interface{}, len(cols))
 	for i := range values {
@@ -306,7 +1072,17 @@ func (bdk *BDKeeper) GetAllData(ctx context.Context, table string, userID int, l
 		row := make(map[string]string)
 		for i, column := range cols {
 			if ns, ok := values[i].(*sql.NullString); ok {
-				row[column] = ns.String
+				row[column] = formatValue(types[i], ns.String)
+			}
+			if column == models.TagsField {
+				row[column] = models.FormatTags(storedTags(row[column]))
+			}
+
+			// Legacy clients stored some fields with invalid UTF-8, the entry is returned
+			// with a warning instead of failing the clients decoding the whole response
+			if !utf8.ValidString(row[column]) {
+				row[column] = strings.ToValidUTF8(row[column], string(utf8.RuneError))
+				row[models.DataWarning] = models.WarningInvalidUTF8
 			}
 		}
 		data = append(data, row)
@@ -317,3 +1093,31 @@ func (bdk *BDKeeper) GetAllData(ctx context.Context, table string, userID int, l
 
 	return data, nil
 }
+
+// formatValue returns the string representation of a scanned column value.
+func formatValue(ct *sql.ColumnType, value string) string {
+	switch strings.ToUpper(ct.DatabaseTypeName()) {
+	case "BOOL", "BOOLEAN":
+		if b, err := strconv.ParseBool(value); err == nil {
+			return strconv.FormatBool(b)
+		}
+	}
+
+	return value
+}
+
+// storedTags returns the tags held by the tags column, either a PostgreSQL array
+// such as {work,"home office"} or a SQLite list such as ,work,home office,.
+// Tags never contain quotes, braces or commas, so the formats are parsed alike.
+func storedTags(value string) []string {
+	value = strings.Trim(value, "{}")
+
+	var tags []string
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.Trim(tag, `"`); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
@@ -3,11 +3,15 @@ package bdkeeper
 import (
 	"context"
 	"database/sql"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
 	"github.com/wurt83ow/gophkeeper-server/internal/config"
 	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
 )
 
 // Функция для создания экземпляра BDKeeper с помощью NewBDKeeper
@@ -31,6 +35,24 @@ func newTestBDKeeper(t *testing.T, db *sql.DB) *BDKeeper {
 	return bdk
 }
 
+// Функция для ожидания запроса столбцов таблицы, они запрашиваются один раз и кешируются
+func expectColumns(mock sqlmock.Sqlmock, table string, cols ...string) {
+	rows := sqlmock.NewRows([]string{"column_name"})
+	for _, col := range cols {
+		rows.AddRow(col)
+	}
+	mock.ExpectQuery("SELECT column_name FROM information_schema.columns WHERE table_name = (.+)").
+		WithArgs(strings.ToLower(table)).
+		WillReturnRows(rows)
+}
+
+// expectNoShare ожидает проверку того, что запись не предоставлена пользователю другим владельцем.
+func expectNoShare(mock sqlmock.Sqlmock, userID int, table, entryID string) {
+	mock.ExpectQuery("SELECT owner_id, permission FROM shared_entries(.+)").
+		WithArgs(userID, table, entryID).
+		WillReturnRows(sqlmock.NewRows([]string{"owner_id", "permission"}))
+}
+
 func TestBDKeeper_Ping(t *testing.T) {
 	// Инициализация sqlmock
 	db, mock, err := sqlmock.New()
@@ -199,6 +221,10 @@ func TestBDKeeper_GetUserID(t *testing.T) {
 	}
 }
 
+// dbNow is the time of the mocked database clock, which runs an hour behind the Go clock.
+// The write methods must return it rather than anything derived from time.Now.
+var dbNow = time.Now().UTC().Add(-time.Hour).Truncate(time.Microsecond)
+
 func TestBDKeeper_AddData(t *testing.T) {
 	// Инициализация sqlmock
 	db, mock, err := sqlmock.New()
@@ -209,19 +235,28 @@ func TestBDKeeper_AddData(t *testing.T) {
 
 	// Создание экземпляра BDKeeper через функцию newTestBDKeeper
 	bdk := newTestBDKeeper(t, db)
-	// Ожидание вызова Prepare
-	mock.ExpectPrepare("INSERT INTO testTable(.+) VALUES(.+)")
 
-	// Ожидание вызова ExecContext для добавления данных
-	mock.ExpectExec("INSERT INTO testTable(.+) VALUES(.+)").
-		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	// Запись добавляется в транзакции вместе с контрольной суммой, у таблицы ее нет
+	mock.ExpectBegin()
+
+	// Имена полей сопоставляются со столбцами таблицы
+	expectColumns(mock, "TextData", "id", "user_id", "key1", "key2", "updated_at")
+
+	// Ожидание вызова Prepare, идентификаторы столбцов заключены в кавычки
+	mock.ExpectPrepare(`INSERT INTO "textdata"\("user_id","id",(.+),"updated_at"\) VALUES(.+) RETURNING updated_at`)
+
+	// Ожидание вызова QueryContext для добавления данных, время задает только база данных
+	mock.ExpectQuery("INSERT INTO \"textdata\"(.+) VALUES(.+) RETURNING updated_at").
+		WithArgs(1, "entry_id", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"updated_at"}).AddRow(dbNow))
+	mock.ExpectCommit()
 
 	// Добавление новых данных
-	err = bdk.AddData(context.Background(), "testTable", 1, "entry_id", map[string]string{"key1": "value1", "key2": "value2"})
+	_, updatedAt, err := bdk.AddData(context.Background(), "TextData", 1, "entry_id", map[string]string{"key1": "value1", "key2": "value2"})
 	if err != nil {
 		t.Fatalf("Ошибка при добавлении данных: %v", err)
 	}
+	assert.True(t, dbNow.Equal(updatedAt))
 
 	// Проверяем, что все ожидания выполнены
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -240,18 +275,29 @@ func TestBDKeeper_UpdateData(t *testing.T) {
 	// Создание экземпляра BDKeeper через функцию newTestBDKeeper
 	bdk := newTestBDKeeper(t, db)
 
+	// История версий проверяется в history_test.go
+	bdk.SetHistoryLimit(0)
+
+	// Обновление выполняется в транзакции вместе с сохранением версии
+	mock.ExpectBegin()
+	expectNoShare(mock, 1, "TextData", "entryID")
+	expectColumns(mock, "TextData", "id", "user_id", "key1", "key2", "updated_at")
+
 	// Ожидание вызова Prepare
-	mock.ExpectPrepare("UPDATE testTable SET(.+) WHERE user_id = (.+) AND id = (.+)")
+	mock.ExpectPrepare("UPDATE \"textdata\" SET(.+)updated_at = GREATEST\\(\\(now\\(\\) AT TIME ZONE 'UTC'\\)(.+)\\) WHERE user_id = (.+) AND id = (.+) RETURNING updated_at")
 
-	// Ожидание вызова ExecContext для обновления данных
-	mock.ExpectExec("UPDATE testTable SET(.+) WHERE user_id = (.+) AND id = (.+)").
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	// Ожидание вызова QueryContext для обновления данных, время задает только база данных
+	mock.ExpectQuery("UPDATE \"textdata\" SET(.+) WHERE user_id = (.+) AND id = (.+) RETURNING updated_at").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), 1, "entryID").
+		WillReturnRows(sqlmock.NewRows([]string{"updated_at"}).AddRow(dbNow))
+	mock.ExpectCommit()
 
 	// Обновление данных
-	err = bdk.UpdateData(context.Background(), "testTable", 1, "entryID", map[string]string{"key1": "value1", "key2": "value2"})
+	updatedAt, err := bdk.UpdateData(context.Background(), "TextData", 1, "entryID", map[string]string{"key1": "value1", "key2": "value2"})
 	if err != nil {
 		t.Fatalf("Ошибка при обновлении данных: %v", err)
 	}
+	assert.True(t, dbNow.Equal(updatedAt))
 
 	// Проверяем, что все ожидания выполнены
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -270,20 +316,167 @@ func TestBDKeeper_DeleteData(t *testing.T) {
 	// Создание экземпляра BDKeeper через функцию newTestBDKeeper
 	bdk := newTestBDKeeper(t, db)
 
-	// Не ожидаем вызов Query
-	mock.ExpectQuery("SELECT COUNT(.+) FROM testTable WHERE user_id = (.+) AND id = (.+)").
-		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	// История версий проверяется в history_test.go
+	bdk.SetHistoryLimit(0)
 
-	// Ожидание вызова ExecContext для удаления данных
-	mock.ExpectExec("DELETE FROM testTable WHERE user_id = (.+) AND id = (.+)").
+	// Ожидание вызова QueryContext для пометки данных как удаленных, время задает только база данных
+	mock.ExpectBegin()
+	expectNoShare(mock, 1, "TextData", "entryID")
+	expectColumns(mock, "TextData", "id", "user_id", "deleted", "updated_at")
+	mock.ExpectQuery("UPDATE \"textdata\" SET deleted = TRUE, updated_at = (.+) WHERE user_id = (.+) AND id = (.+) RETURNING updated_at").
 		WithArgs(1, "entryID").
-		WillReturnResult(sqlmock.NewResult(1, 1))
+		WillReturnRows(sqlmock.NewRows([]string{"updated_at"}).AddRow(dbNow))
+	mock.ExpectCommit()
 
 	// Удаление данных
-	err = bdk.DeleteData(context.Background(), "testTable", 1, "entryID")
+	updatedAt, err := bdk.DeleteData(context.Background(), "TextData", 1, "entryID")
 	if err != nil {
 		t.Fatalf("Ошибка при удалении данных: %v", err)
 	}
+	assert.True(t, dbNow.Equal(updatedAt))
+
+	// Удаление отсутствующей записи возвращает ErrNotFound
+	mock.ExpectBegin()
+	expectNoShare(mock, 1, "TextData", "missing")
+	mock.ExpectQuery("UPDATE \"textdata\" SET deleted = TRUE(.+) RETURNING updated_at").
+		WithArgs(1, "missing").
+		WillReturnRows(sqlmock.NewRows([]string{"updated_at"}))
+	mock.ExpectRollback()
+
+	updatedAt, err = bdk.DeleteData(context.Background(), "TextData", 1, "missing")
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	assert.True(t, updatedAt.IsZero())
+
+	// Проверяем, что все ожидания выполнены
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Не выполнены ожидания: %s", err)
+	}
+}
+
+func TestBDKeeper_UndeleteData(t *testing.T) {
+	// Инициализация sqlmock
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error initializing mock database: %v", err)
+	}
+	defer db.Close()
+
+	// Создание экземпляра BDKeeper через функцию newTestBDKeeper
+	bdk := newTestBDKeeper(t, db)
+
+	// История версий проверяется в history_test.go
+	bdk.SetHistoryLimit(0)
+
+	// Ожидание вызова QueryContext для снятия пометки об удалении
+	mock.ExpectBegin()
+	expectColumns(mock, "TextData", "id", "user_id", "deleted", "updated_at")
+	mock.ExpectQuery("UPDATE \"textdata\" SET deleted = FALSE, updated_at = (.+) WHERE user_id = (.+) AND id = (.+) RETURNING updated_at").
+		WithArgs(1, "entryID").
+		WillReturnRows(sqlmock.NewRows([]string{"updated_at"}).AddRow(dbNow))
+	mock.ExpectCommit()
+
+	// Восстановление данных
+	updatedAt, err := bdk.UndeleteData(context.Background(), "TextData", 1, "entryID")
+	if err != nil {
+		t.Fatalf("Ошибка при восстановлении данных: %v", err)
+	}
+	assert.True(t, dbNow.Equal(updatedAt))
+
+	// Восстановление отсутствующей записи возвращает ErrNotFound
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE \"textdata\" SET deleted = FALSE(.+) RETURNING updated_at").
+		WithArgs(1, "missing").
+		WillReturnRows(sqlmock.NewRows([]string{"updated_at"}))
+	mock.ExpectRollback()
+
+	_, err = bdk.UndeleteData(context.Background(), "TextData", 1, "missing")
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	// Проверяем, что все ожидания выполнены
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Не выполнены ожидания: %s", err)
+	}
+}
+
+func TestBDKeeper_GetAllDataColumns(t *testing.T) {
+	// Инициализация sqlmock
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error initializing mock database: %v", err)
+	}
+	defer db.Close()
+
+	// Создание экземпляра BDKeeper через функцию newTestBDKeeper
+	bdk := newTestBDKeeper(t, db)
+
+	// Столбцы таблицы запрашиваются у базы только один раз
+	expectColumns(mock, "TextData", "id", "user_id", "secret", "meta_info", "deleted", "updated_at")
+
+	// Без проекции выбираются все столбцы
+	mock.ExpectQuery(`SELECT "id","user_id","secret","meta_info","deleted","updated_at" FROM "textdata" WHERE user_id = (.+)`).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "secret", "meta_info", "deleted", "updated_at"}))
+
+	_, err = bdk.GetAllData(context.Background(), "TextData", 1, models.DataQuery{})
+	if err != nil {
+		t.Fatalf("Ошибка при получении данных: %v", err)
+	}
+
+	// В проекцию всегда добавляются id, updated_at и deleted
+	mock.ExpectQuery(`SELECT "id","meta_info","deleted","updated_at" FROM "textdata" WHERE user_id = (.+)`).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "meta_info", "deleted", "updated_at"}).
+			AddRow("entryID", "meta", false, dbNow))
+
+	data, err := bdk.GetAllData(context.Background(), "TextData", 1, models.DataQuery{Columns: []string{"meta_info"}})
+	if err != nil {
+		t.Fatalf("Ошибка при получении данных: %v", err)
+	}
+	assert.Equal(t, []map[string]string{{"id": "entryID", "meta_info": "meta", "deleted": "false", "updated_at": dbNow.Format(time.RFC3339Nano)}}, data)
+
+	// Неизвестный столбец отклоняется без запроса к базе
+	_, err = bdk.GetAllData(context.Background(), "TextData", 1, models.DataQuery{Columns: []string{"password"}})
+	assert.ErrorIs(t, err, models.ErrUnknownColumn)
+
+	// Проверяем, что все ожидания выполнены
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Не выполнены ожидания: %s", err)
+	}
+}
+
+func TestBDKeeper_GetAllDataFilter(t *testing.T) {
+	// Инициализация sqlmock
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error initializing mock database: %v", err)
+	}
+	defer db.Close()
+
+	// Создание экземпляра BDKeeper через функцию newTestBDKeeper
+	bdk := newTestBDKeeper(t, db)
+
+	expectColumns(mock, "TextData", "id", "user_id", "meta_info", "deleted", "updated_at", "expires_at")
+
+	// Значения фильтра передаются только аргументами, в запрос попадают проверенные имена столбцов
+	injection := "x' OR '1'='1"
+	mock.ExpectQuery("SELECT (.+) FROM \"textdata\" WHERE user_id = \\$1 AND deleted = false AND (.+) AND \"meta_info\" ILIKE \\$2 AND \"meta_info\" <> \\$3 AND \"deleted\" = \\$4 ORDER BY (.+)$").
+		WithArgs(1, "%bank%", injection, false).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "meta_info", "deleted", "updated_at", "expires_at"}))
+
+	_, err = bdk.GetAllData(context.Background(), "TextData", 1, models.DataQuery{Filter: models.Filter{
+		{Column: "META_INFO", Op: "ilike", Value: "%bank%"},
+		{Column: "meta_info", Op: models.FilterNe, Value: injection},
+		{Column: "deleted", Op: models.FilterEq, Value: "false"},
+	}})
+	if err != nil {
+		t.Fatalf("Ошибка при получении данных: %v", err)
+	}
+
+	// Имя столбца с SQL отклоняется без запроса к базе
+	_, err = bdk.GetAllData(context.Background(), "TextData", 1, models.DataQuery{Filter: models.Filter{
+		{Column: "meta_info = meta_info OR 1=1 --", Op: models.FilterEq, Value: "x"},
+	}})
+	assert.ErrorIs(t, err, models.ErrUnknownColumn)
 
 	// Проверяем, что все ожидания выполнены
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -0,0 +1,215 @@
+package bdkeeper
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"github.com/wurt83ow/gophkeeper-server/internal/metrics"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"github.com/wurt83ow/gophkeeper-server/internal/storage"
+)
+
+// BenchmarkKeeper measures the hot paths of the keepers with every side effect the server enables:
+// metrics, history, encryption and read verification. It runs on the in-memory keeper, SQLite and,
+// if TEST_DATABASE_URI is set, PostgreSQL, so the Go overhead shows apart from the database time.
+// The entries are seeded from a fixed seed, the runs of two versions compare with cmd/benchgate:
+//
+//	go test ./internal/bdkeeper -run '^$' -bench BenchmarkKeeper -count 6 > new.txt
+//	go run ./cmd/benchgate -baseline internal/bdkeeper/testdata/bench-baseline.txt -new new.txt -threshold 15%
+const (
+	// benchSeed seeds the contents of the entries, the same on every run
+	benchSeed = 1
+	// benchEntries is the number of the entries seeded, all of them are read by the incremental sync
+	benchEntries = 1000
+	// benchBatch is the number of the changes of a batch
+	benchBatch = 100
+	// benchBulkRows is the number of the rows of a bulk insert
+	benchBulkRows = 1000
+	// benchHistory is the number of the prior versions kept per entry
+	benchHistory = 10
+)
+
+// benchTable is the table benchmarked, its entries have the most fields.
+const benchTable = "UserCredentials"
+
+// benchKeeper is a keeper benchmarked, bulk is nil if it can't insert in bulk.
+type benchKeeper struct {
+	name   string
+	keeper storage.Keeper
+	bulk   func(ctx context.Context, table string, userID int, rows []map[string]string) ([]string, error)
+}
+
+// benchKeepers returns the keepers to benchmark, set up as the server sets them up.
+func benchKeepers(b *testing.B) []benchKeeper {
+	mk := storage.NewMemKeeper()
+	mk.SetHistoryLimit(benchHistory)
+	keepers := []benchKeeper{{name: "memory", keeper: mk}}
+
+	nLogger, err := logger.NewLogger("error")
+	require.NoError(b, err)
+	open := func(name, dsn string) {
+		bdk, err := NewBDKeeper(func() string { return dsn }, nLogger, nil)
+		require.NoError(b, err)
+		b.Cleanup(func() { bdk.Close() })
+
+		m, err := metrics.NewStorage(prometheus.NewRegistry())
+		require.NoError(b, err)
+		bdk.SetMetrics(m)
+		bdk.SetHistoryLimit(benchHistory)
+		require.NoError(b, bdk.EnableEncryption("bench", testEncryptionKey))
+		bdk.EnableReadVerification()
+
+		keepers = append(keepers, benchKeeper{name: name, keeper: bdk, bulk: bdk.BulkInsert})
+	}
+
+	open("sqlite", sqliteScheme+b.TempDir()+"/gkeeper.db")
+	if dsn := os.Getenv("TEST_DATABASE_URI"); dsn != "" {
+		open("postgres", dsn)
+	}
+
+	return keepers
+}
+
+// benchRows returns n credentials whose contents depend on the source only. They have the ids prefix-0
+// to prefix-n, or none if the prefix is empty, as the updates of an entry don't carry its id.
+func benchRows(rnd *rand.Rand, prefix string, n int) []map[string]string {
+	text := func(min, max int) string {
+		const letters = "abcdefghijklmnopqrstuvwxyz0123456789 "
+		s := make([]byte, min+rnd.Intn(max-min+1))
+		for i := range s {
+			s[i] = letters[rnd.Intn(len(letters))]
+		}
+		return string(s)
+	}
+
+	rows := make([]map[string]string, n)
+	for i := range rows {
+		rows[i] = map[string]string{
+			"login":     text(8, 24),
+			"password":  text(16, 32),
+			"meta_info": text(20, 200),
+		}
+		if prefix != "" {
+			rows[i]["id"] = fmt.Sprintf("%s-%d", prefix, i)
+		}
+	}
+
+	return rows
+}
+
+// benchSeeded is the vault of the user the benchmarks run on.
+type benchSeeded struct {
+	userID int
+	ids    []string
+	// cursor is the synchronization the seeded entries were all written after
+	cursor time.Time
+}
+
+// seedBench adds a user with benchEntries entries to the keeper, in batches as a client pushes them.
+func seedBench(b *testing.B, k storage.Keeper) benchSeeded {
+	ctx := context.Background()
+	userID := addTestUser(b, k)
+	prefix := fmt.Sprintf("bench-%d-%d", userID, time.Now().UnixNano())
+
+	// The cursor is the time of the database, the seeded entries are written after it
+	_, cursor, err := k.AddData(ctx, benchTable, userID, prefix+"-cursor", benchRows(rand.New(rand.NewSource(0)), "", 1)[0])
+	require.NoError(b, err)
+
+	seeded := benchSeeded{userID: userID, cursor: cursor}
+	rows := benchRows(rand.New(rand.NewSource(benchSeed)), prefix, benchEntries)
+	for start := 0; start < len(rows); start += benchBatch {
+		changes := make([]models.Change, 0, benchBatch)
+		for _, row := range rows[start:min(start+benchBatch, len(rows))] {
+			changes = append(changes, models.Change{Table: benchTable, Op: models.ChangeAdd, EntryID: row["id"], Fields: row})
+			seeded.ids = append(seeded.ids, row["id"])
+		}
+		_, err := k.ApplyChanges(ctx, userID, changes)
+		require.NoError(b, err)
+	}
+
+	return seeded
+}
+
+func BenchmarkKeeper(b *testing.B) {
+	ctx := context.Background()
+	// The client versions of the batched updates are never behind the server
+	clientVersion := time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, k := range benchKeepers(b) {
+		seeded := seedBench(b, k.keeper)
+		rnd := rand.New(rand.NewSource(benchSeed))
+
+		b.Run(k.name+"/PointRead", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := k.keeper.GetData(ctx, benchTable, seeded.userID, seeded.ids[i%len(seeded.ids)], false); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(k.name+"/SyncRead", func(b *testing.B) {
+			q := models.DataQuery{LastSync: seeded.cursor, InclDeleted: true}
+			for i := 0; i < b.N; i++ {
+				data, err := k.keeper.GetAllData(ctx, benchTable, seeded.userID, q)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(data) != benchEntries {
+					b.Fatalf("synchronized %d entries, want %d", len(data), benchEntries)
+				}
+			}
+		})
+
+		b.Run(k.name+"/Write", func(b *testing.B) {
+			rows := benchRows(rnd, "", b.N)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := k.keeper.UpdateData(ctx, benchTable, seeded.userID, seeded.ids[i%len(seeded.ids)], rows[i]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(k.name+"/Batch", func(b *testing.B) {
+			rows := benchRows(rnd, "", benchBatch)
+			changes := make([]models.Change, benchBatch)
+			for i := range changes {
+				changes[i] = models.Change{Table: benchTable, Op: models.ChangeUpdate, EntryID: seeded.ids[i], Fields: rows[i], UpdatedAt: clientVersion}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				results, err := k.keeper.ApplyChanges(ctx, seeded.userID, changes)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if results[0].Status != models.ChangeApplied {
+					b.Fatalf("change %s", results[0].Status)
+				}
+			}
+		})
+
+		if k.bulk == nil {
+			continue
+		}
+		b.Run(k.name+"/BulkInsert", func(b *testing.B) {
+			prefix := fmt.Sprintf("bulk-%d-%d", seeded.userID, time.Now().UnixNano())
+			rows := make([][]map[string]string, b.N)
+			for i := range rows {
+				rows[i] = benchRows(rnd, fmt.Sprintf("%s-%d", prefix, i), benchBulkRows)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := k.bulk(ctx, benchTable, seeded.userID, rows[i]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
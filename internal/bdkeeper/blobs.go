@@ -0,0 +1,332 @@
+package bdkeeper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// The columns of the files holding the object of their contents in the blob store, see WriteFileBlob.
+const (
+	blobKeyColumn    = "blob_key"
+	blobSizeColumn   = "blob_size"
+	blobSHA256Column = "blob_sha256"
+)
+
+// blobColumns are kept by the server like the derived columns, the clients never read or write them.
+var blobColumns = map[string]bool{blobKeyColumn: true, blobSizeColumn: true, blobSHA256Column: true}
+
+// referencedBatchSize is the number of keys looked up at once by ReferencedBlobs.
+const referencedBatchSize = 500
+
+// errNoBlobColumns is the error of the blob methods on a database whose migrations didn't add the blob columns.
+var errNoBlobColumns = errors.New("the files have no blob columns, the migrations are behind")
+
+// WriteFileBlob writes the file entry of the user with the fields, adding it unless the user has it,
+// and points it at the contents of the checksum of the blob, stored once for all the entries, in one
+// transaction. A blob without a key points it at the stored contents, or returns models.ErrBlobNotStored.
+// It returns the keys of the objects no entry points at any more, which the caller deletes.
+func (bdk *BDKeeper) WriteFileBlob(ctx context.Context, user_id int, entry_id string, fields map[string]string, blob models.FileBlob) (_ []string, _ time.Time, err error) {
+	defer bdk.observe("write_file_blob", models.FilesTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer leave()
+	bdk.wrote(userWriter(user_id))
+
+	action := models.AuditUpdate
+	defer func() { bdk.audit(ctx, action, models.FilesTable, user_id, entry_id, &err) }()
+
+	var released []string
+	var updatedAt time.Time
+	err = bdk.inTx(ctx, func(view *BDKeeper) (err error) {
+		released = nil
+		_, err = view.fileBlob(ctx, user_id, entry_id)
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			action = models.AuditAdd
+			updatedAt, err = view.addData(ctx, view.ex, models.FilesTable, user_id, entry_id, fields)
+		case err == nil:
+			updatedAt, err = view.updateData(ctx, view.ex, models.FilesTable, user_id, entry_id, fields)
+		}
+		if err != nil {
+			return err
+		}
+		// The row of the entry is locked by its write, its blob is read again
+		previous, err := view.fileBlob(ctx, user_id, entry_id)
+		if err != nil {
+			return err
+		}
+
+		// The stored contents are locked in the order of their checksums, so concurrent writes can't deadlock,
+		// and a reference to the same contents is taken before the previous one is dropped
+		var stored models.FileBlob
+		if previous.Key != "" && previous.SHA256 < blob.SHA256 {
+			if released, err = view.releaseBlob(ctx, previous, released); err != nil {
+				return err
+			}
+		}
+		if stored, err = view.refBlob(ctx, blob); err != nil {
+			return err
+		}
+		if blob.Key != "" && blob.Key != stored.Key {
+			// The same contents were stored meanwhile, the object put for them isn't needed
+			released = append(released, blob.Key)
+		}
+		if previous.Key != "" && previous.SHA256 >= blob.SHA256 {
+			if released, err = view.releaseBlob(ctx, previous, released); err != nil {
+				return err
+			}
+		}
+
+		return view.setFileBlob(ctx, user_id, entry_id, stored)
+	})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	bdk.changed(ctx, user_id, models.VaultEvent{Table: models.FilesTable, EntryID: entry_id, UpdatedAt: updatedAt})
+
+	return released, updatedAt, nil
+}
+
+// GetFileBlob returns the blob of the file entry of the user, the zero one if its file is kept on disk,
+// or models.ErrNotFound if the user has no such entry.
+func (bdk *BDKeeper) GetFileBlob(ctx context.Context, user_id int, entry_id string) (_ models.FileBlob, err error) {
+	defer bdk.observe("get_file_blob", models.FilesTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return models.FileBlob{}, err
+	}
+	defer leave()
+
+	return scoped(ctx, bdk.reader(userWriter(user_id)), func(view *BDKeeper) (models.FileBlob, error) {
+		return view.fileBlob(ctx, user_id, entry_id)
+	})
+}
+
+// ReferencedBlobs returns which of the keys of the blob store the file entries of any user point at,
+// the deleted ones included, or which hold stored contents. It reads the primary: a key missed on a lagging
+// replica would be deleted.
+func (bdk *BDKeeper) ReferencedBlobs(ctx context.Context, keys []string) (_ map[string]bool, err error) {
+	defer bdk.observe("referenced_blobs", models.FilesTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	if bdk.rls {
+		ctx = withBypass(ctx)
+	}
+
+	return scoped(ctx, bdk, func(view *BDKeeper) (map[string]bool, error) {
+		referenced := make(map[string]bool)
+		for start := 0; start < len(keys); start += referencedBatchSize {
+			batch := keys[start:min(start+referencedBatchSize, len(keys))]
+			if err := view.referencedBlobs(ctx, batch, referenced); err != nil {
+				return nil, err
+			}
+		}
+		return referenced, nil
+	})
+}
+
+// referencedBlobs adds the keys of the batch the file entries point at to referenced.
+func (bdk *BDKeeper) referencedBlobs(ctx context.Context, keys []string, referenced map[string]bool) error {
+	schema, tbl, err := bdk.blobTable(ctx)
+	if err != nil {
+		return err
+	}
+
+	placeholders := make([]string, len(keys))
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		placeholders[i] = "$" + strconv.Itoa(i+1)
+		args[i] = key
+	}
+	key, in := schema.column(blobKeyColumn), strings.Join(placeholders, ",")
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s IN (%s) UNION SELECT blob_key FROM blobs WHERE blob_key IN (%s)",
+		key, tbl, key, in, in)
+	rows, err := bdk.ex.QueryContext(ctx, bdk.dialect.rebind(query), args...)
+	if err != nil {
+		return fmt.Errorf("failed to look up blobs: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return fmt.Errorf("failed to scan blob key: %w", err)
+		}
+		referenced[key] = true
+	}
+
+	return rows.Err()
+}
+
+// refBlob counts one more reference to the stored contents of the checksum of the blob, storing them
+// with the key of the blob unless they are, and returns the stored blob. A blob without a key is only
+// counted if its contents are stored, models.ErrBlobNotStored is returned otherwise.
+func (bdk *BDKeeper) refBlob(ctx context.Context, blob models.FileBlob) (models.FileBlob, error) {
+	var query string
+	args := []interface{}{blob.SHA256}
+	if blob.Key == "" {
+		query = `UPDATE blobs SET refcount = refcount + 1 WHERE hash = $1 RETURNING blob_key, size`
+	} else {
+		// The upsert counts concurrent uploads of the same contents without losing any of them
+		query = fmt.Sprintf(`INSERT INTO blobs (hash, blob_key, size, refcount, created_at) VALUES ($1, $2, $3, 1, %s)
+			ON CONFLICT (hash) DO UPDATE SET refcount = blobs.refcount + 1 RETURNING blob_key, size`, bdk.dialect.now())
+		args = append(args, blob.Key, blob.Size)
+	}
+
+	stored := models.FileBlob{SHA256: blob.SHA256}
+	err := bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), args...).Scan(&stored.Key, &stored.Size)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.FileBlob{}, models.ErrBlobNotStored
+	}
+	if err != nil {
+		return models.FileBlob{}, fmt.Errorf("failed to reference blob: %w", err)
+	}
+
+	return stored, nil
+}
+
+// releaseBlobs drops count references to the stored contents of the blob, deleting them once no entry points
+// at them, and adds the key of their object to released then. The object of a blob whose contents aren't
+// counted is only pointed at by its entry.
+func (bdk *BDKeeper) releaseBlobs(ctx context.Context, blob models.FileBlob, count int, released []string) ([]string, error) {
+	query := `UPDATE blobs SET refcount = refcount - $1 WHERE hash = $2 AND blob_key = $3 RETURNING refcount`
+	var refcount int64
+	err := bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), count, blob.SHA256, blob.Key).Scan(&refcount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return append(released, blob.Key), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to release blob: %w", err)
+	}
+	if refcount > 0 {
+		return released, nil
+	}
+
+	query = `DELETE FROM blobs WHERE hash = $1 AND refcount <= 0`
+	if _, err := bdk.ex.ExecContext(ctx, bdk.dialect.rebind(query), blob.SHA256); err != nil {
+		return nil, fmt.Errorf("failed to delete blob: %w", err)
+	}
+
+	return append(released, blob.Key), nil
+}
+
+// releaseBlob drops the reference of an entry to the stored contents of the blob, see releaseBlobs.
+func (bdk *BDKeeper) releaseBlob(ctx context.Context, blob models.FileBlob, released []string) ([]string, error) {
+	return bdk.releaseBlobs(ctx, blob, 1, released)
+}
+
+// deleteUserFiles deletes the file entries of the user and drops their references to the stored contents.
+// The objects no entry points at any more are left to the reconciliation of the store.
+func (bdk *BDKeeper) deleteUserFiles(ctx context.Context, userID int) error {
+	schema, tbl, err := bdk.blobTable(ctx)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE user_id = $1 RETURNING %s", tbl, schema.selectList([]string{blobKeyColumn, blobSHA256Column}))
+	rows, err := bdk.ex.QueryContext(ctx, bdk.dialect.rebind(query), userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete entries of %s: %w", models.FilesTable, err)
+	}
+	counts := make(map[models.FileBlob]int)
+	for rows.Next() {
+		var key, sum sql.NullString
+		if err := rows.Scan(&key, &sum); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan blob: %w", err)
+		}
+		if key.Valid {
+			counts[models.FileBlob{Key: key.String, SHA256: sum.String}]++
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("rows encountered an error: %w", err)
+	}
+
+	// In the order of their checksums, as WriteFileBlob locks them
+	blobs := make([]models.FileBlob, 0, len(counts))
+	for blob := range counts {
+		blobs = append(blobs, blob)
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].SHA256 < blobs[j].SHA256 })
+	for _, blob := range blobs {
+		if _, err := bdk.releaseBlobs(ctx, blob, counts[blob], nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fileBlob reads the blob of the file entry of the user on the keeper or view.
+func (bdk *BDKeeper) fileBlob(ctx context.Context, userID int, entryID string) (models.FileBlob, error) {
+	schema, tbl, err := bdk.blobTable(ctx)
+	if err != nil {
+		return models.FileBlob{}, err
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE user_id = $1 AND id = $2", schema.selectList([]string{blobKeyColumn, blobSizeColumn, blobSHA256Column}), tbl)
+	var key, sum sql.NullString
+	var size sql.NullInt64
+	err = bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), userID, entryID).Scan(&key, &size, &sum)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.FileBlob{}, models.ErrNotFound
+	}
+	if err != nil {
+		return models.FileBlob{}, fmt.Errorf("failed to read blob: %w", err)
+	}
+
+	return models.FileBlob{Key: key.String, Size: size.Int64, SHA256: sum.String}, nil
+}
+
+// setFileBlob points the file entry of the user at the blob on the view.
+func (bdk *BDKeeper) setFileBlob(ctx context.Context, userID int, entryID string, blob models.FileBlob) error {
+	schema, tbl, err := bdk.blobTable(ctx)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("UPDATE %s SET %s = $1, %s = $2, %s = $3 WHERE user_id = $4 AND id = $5", tbl,
+		schema.column(blobKeyColumn), schema.column(blobSizeColumn), schema.column(blobSHA256Column))
+	// The zero blob moves the file back to the disk, its columns are NULL again
+	key := sql.NullString{String: blob.Key, Valid: blob.Key != ""}
+	size := sql.NullInt64{Int64: blob.Size, Valid: blob.Key != ""}
+	sum := sql.NullString{String: blob.SHA256, Valid: blob.Key != ""}
+	if _, err := bdk.ex.ExecContext(ctx, bdk.dialect.rebind(query), key, size, sum, userID, entryID); err != nil {
+		return fmt.Errorf("failed to write blob: %w", err)
+	}
+
+	return nil
+}
+
+// blobTable returns the schema and the quoted identifier of the files, which must have the blob columns.
+func (bdk *BDKeeper) blobTable(ctx context.Context) (*tableSchema, identifier, error) {
+	schema, err := bdk.tableColumns(ctx, bdk.ex, models.FilesTable)
+	if err != nil {
+		return nil, "", err
+	}
+	if !schema.blob {
+		return nil, "", errNoBlobColumns
+	}
+	tbl, err := bdk.tableIdent(ctx, bdk.ex, models.FilesTable)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return schema, tbl, nil
+}
@@ -0,0 +1,293 @@
+package bdkeeper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+const (
+	// bulkLookupSize is the number of ids checked for existence by a single query.
+	bulkLookupSize = 1000
+	// bulkInsertSize is the number of rows inserted by a single statement when the copy protocol isn't available.
+	bulkInsertSize = 500
+)
+
+// errCopyUnsupported indicates that the connection doesn't support the copy protocol.
+var errCopyUnsupported = errors.New("copy protocol is not supported")
+
+// BulkInsert adds the rows of a user to a table in a single round trip where possible.
+// Every row must contain an "id" field, the field names are matched regardless of the case. Rows whose id already exists in the table or
+// is repeated within rows are not inserted, their ids are returned instead.
+func (bdk *BDKeeper) BulkInsert(ctx context.Context, table string, userID int, rows []map[string]string) (_ []string, err error) {
+	defer bdk.observe("bulk_insert", table, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	defer bdk.audit(ctx, models.AuditBulkInsert, table, userID, "", &err)
+	bdk.wrote(userWriter(userID))
+
+	return scoped(ctx, bdk, func(view *BDKeeper) ([]string, error) {
+		return view.bulkInsert(ctx, table, userID, rows)
+	})
+}
+
+// bulkInsert runs BulkInsert on the keeper or view.
+func (bdk *BDKeeper) bulkInsert(ctx context.Context, table string, userID int, rows []map[string]string) ([]string, error) {
+	if userID == 0 || table == "" {
+		return nil, errors.New("user_id and table must be specified")
+	}
+
+	normalized := make([]map[string]string, len(rows))
+	ids := make([]string, 0, len(rows))
+	for i, row := range rows {
+		row, err := models.NormalizeFields(row)
+		if err != nil {
+			return nil, err
+		}
+		if err := models.DeriveSshFields(table, row); err != nil {
+			return nil, err
+		}
+		normalized[i] = row
+
+		if row["id"] == "" {
+			return nil, errors.New("entry_id must be specified")
+		}
+		ids = append(ids, row["id"])
+	}
+
+	rows = normalized
+
+	tbl, err := bdk.tableIdent(ctx, bdk.ex, table)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := bdk.existingIDs(ctx, tbl, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip rows with the ids that are taken, including by an earlier row of the batch
+	var duplicates []string
+	fresh := make([]map[string]string, 0, len(rows))
+	for _, row := range rows {
+		if existing[row["id"]] {
+			duplicates = append(duplicates, row["id"])
+			continue
+		}
+		existing[row["id"]] = true
+		fresh = append(fresh, row)
+	}
+
+	if len(fresh) == 0 {
+		return duplicates, nil
+	}
+
+	// The columns are the union of the fields of all rows, missing fields are inserted as NULL
+	colSet := make(map[string]bool)
+	for _, row := range fresh {
+		for key := range row {
+			colSet[key] = true
+		}
+	}
+	delete(colSet, "user_id")
+	for col := range derivedColumns {
+		delete(colSet, col)
+	}
+	for col := range blobColumns {
+		delete(colSet, col)
+	}
+
+	cols := make([]string, 0, len(colSet)+1)
+	cols = append(cols, "user_id")
+	for col := range colSet {
+		cols = append(cols, col)
+	}
+	sort.Strings(cols[1:])
+
+	schema, err := bdk.tableColumns(ctx, bdk.ex, table)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([][]interface{}, len(fresh))
+	for i, row := range fresh {
+		values[i] = make([]interface{}, len(cols))
+		values[i][0] = userID
+		for j, col := range cols[1:] {
+			if value, ok := row[col]; ok {
+				if values[i][j+1], err = bdk.fieldArg(table, col, value); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	// The rows are inserted with the columns as stored in the database
+	rawCols := make([]string, len(cols))
+	for i, col := range cols {
+		rawCols[i] = schema.rawName(col)
+	}
+
+	folders := make(map[string]bool)
+	for _, row := range fresh {
+		if row[models.FolderField] != "" {
+			folders[row[models.FolderField]] = true
+		}
+	}
+	if len(folders) > 0 {
+		// The folders are checked in the transaction of the insert, which the copy protocol can't run in
+		err = bdk.inTx(ctx, func(view *BDKeeper) error {
+			for folder := range folders {
+				if err := view.entryFolder(ctx, userID, folder); err != nil {
+					return err
+				}
+			}
+			return view.insertRows(ctx, tbl, rawCols, values)
+		})
+	} else {
+		err = bdk.copyRows(ctx, table, rawCols, values)
+		if errors.Is(err, errCopyUnsupported) {
+			err = bdk.insertRows(ctx, tbl, rawCols, values)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The derived columns are computed from the rows as stored, the copy protocol can't run in a transaction
+	if schema.derived() {
+		inserted := make([]string, len(fresh))
+		for i, row := range fresh {
+			inserted[i] = row["id"]
+		}
+		err = bdk.inTx(ctx, func(view *BDKeeper) error {
+			return view.writeDerived(ctx, view.ex, table, userID, inserted)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return duplicates, nil
+}
+
+// existingIDs returns the set of the ids that are already present in the table.
+func (bdk *BDKeeper) existingIDs(ctx context.Context, table identifier, ids []string) (map[string]bool, error) {
+	existing := make(map[string]bool)
+
+	for start := 0; start < len(ids); start += bulkLookupSize {
+		end := start + bulkLookupSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		args := make([]interface{}, 0, end-start)
+		placeholders := make([]string, 0, end-start)
+		for _, id := range ids[start:end] {
+			args = append(args, id)
+			placeholders = append(placeholders, "$"+strconv.Itoa(len(args)))
+		}
+
+		query := fmt.Sprintf("SELECT id FROM %s WHERE id IN (%s)", table, strings.Join(placeholders, ","))
+		rows, err := bdk.ex.QueryContext(ctx, bdk.dialect.rebind(query), args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check existing ids: %w", err)
+		}
+
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan id: %w", err)
+			}
+			existing[id] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("rows encountered an error: %w", err)
+		}
+	}
+
+	return existing, nil
+}
+
+// copyRows loads the rows using the PostgreSQL copy protocol.
+// It returns errCopyUnsupported if the underlying connection isn't a pgx one, or the keeper
+// is a transaction view, since database/sql doesn't expose the connection of a transaction.
+func (bdk *BDKeeper) copyRows(ctx context.Context, table string, cols []string, values [][]interface{}) error {
+	if bdk.tx != nil {
+		return errCopyUnsupported
+	}
+
+	conn, err := bdk.conn.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn interface{}) error {
+		pc, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return errCopyUnsupported
+		}
+
+		// Unquoted table names are folded to lower case by PostgreSQL, while pgx quotes them.
+		// The column names are the stored ones already
+		_, err := pc.Conn().CopyFrom(ctx, pgx.Identifier{strings.ToLower(table)}, cols, pgx.CopyFromRows(values))
+		return err
+	})
+}
+
+// insertRows adds the rows with multi-row INSERT statements inside a single transaction,
+// or a savepoint of the transaction of a view.
+func (bdk *BDKeeper) insertRows(ctx context.Context, table identifier, cols []string, values [][]interface{}) error {
+	return bdk.inTx(ctx, func(view *BDKeeper) error {
+		for start := 0; start < len(values); start += bulkInsertSize {
+			end := start + bulkInsertSize
+			if end > len(values) {
+				end = len(values)
+			}
+
+			if err := insertChunk(ctx, view.ex, bdk.dialect, table, cols, values[start:end]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// insertChunk adds the rows with a single multi-row INSERT statement.
+func insertChunk(ctx context.Context, ex execer, d dialect, table identifier, cols []string, values [][]interface{}) error {
+	args := make([]interface{}, 0, len(values)*len(cols))
+	tuples := make([]string, 0, len(values))
+	for _, row := range values {
+		placeholders := make([]string, len(row))
+		for i, value := range row {
+			args = append(args, value)
+			placeholders[i] = "$" + strconv.Itoa(len(args))
+		}
+		tuples = append(tuples, "("+strings.Join(placeholders, ",")+")")
+	}
+
+	quoted := make([]string, len(cols))
+	for i, col := range cols {
+		quoted[i] = string(quoteIdent(col))
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s(%s) VALUES %s", table, strings.Join(quoted, ","), strings.Join(tuples, ","))
+	_, err := ex.ExecContext(ctx, d.rebind(query), args...)
+
+	return err
+}
@@ -0,0 +1,155 @@
+package bdkeeper
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"github.com/wurt83ow/gophkeeper-server/internal/storage"
+)
+
+// addTestUser registers a user with a unique name and returns its ID.
+func addTestUser(t testing.TB, bdk storage.Keeper) int {
+	ctx := context.Background()
+	username := fmt.Sprintf("user-%d", time.Now().UnixNano())
+
+	require.NoError(t, bdk.AddUser(ctx, username, "hashedPassword"))
+	userID, err := bdk.GetUserID(ctx, username)
+	require.NoError(t, err)
+
+	return userID
+}
+
+// credentialRows returns n UserCredentials rows with ids starting with prefix.
+func credentialRows(prefix string, n int) []map[string]string {
+	rows := make([]map[string]string, n)
+	for i := range rows {
+		rows[i] = map[string]string{
+			"id":        fmt.Sprintf("%s-%d", prefix, i),
+			"login":     "login",
+			"password":  "password",
+			"meta_info": "meta",
+		}
+	}
+
+	return rows
+}
+
+func TestBDKeeper_BulkInsert(t *testing.T) {
+	bdk := newSQLiteBDKeeper(t)
+	ctx := context.Background()
+	userID := addTestUser(t, bdk)
+
+	taken := credentialRows("x", 1)[0]
+	delete(taken, "id")
+	_, _, err := bdk.AddData(ctx, "UserCredentials", userID, "taken", taken)
+	require.NoError(t, err)
+
+	rows := credentialRows("bulk", 3)
+	rows = append(rows, map[string]string{"id": "taken", "login": "l", "password": "p"})
+	rows = append(rows, map[string]string{"id": "bulk-0", "login": "l", "password": "p"})
+
+	duplicates, err := bdk.BulkInsert(ctx, "UserCredentials", userID, rows)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"taken", "bulk-0"}, duplicates)
+
+	data, err := bdk.GetAllData(ctx, "UserCredentials", userID, models.DataQuery{})
+	require.NoError(t, err)
+	assert.Len(t, data, 4)
+
+	_, err = bdk.BulkInsert(ctx, "UserCredentials", userID, []map[string]string{{"login": "l"}})
+	assert.Error(t, err)
+}
+
+func TestBDKeeper_BulkInsertFallback(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error initializing mock database: %v", err)
+	}
+	defer db.Close()
+
+	bdk := newTestBDKeeper(t, db)
+
+	expectColumns(mock, "TextData", "id", "user_id", "key1")
+
+	mock.ExpectQuery(`SELECT id FROM "textdata" WHERE id IN \(\$1,\$2\)`).
+		WithArgs("a", "b").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("b"))
+
+	// sqlmock doesn't speak the copy protocol, so a multi-row INSERT is used
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO "textdata"\("user_id","id","key1"\) VALUES \(\$1,\$2,\$3\)`).
+		WithArgs(1, "a", "value1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	duplicates, err := bdk.BulkInsert(context.Background(), "TextData", 1, []map[string]string{
+		{"id": "a", "KEY1": "value1"},
+		{"id": "b", "key1": "value2"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b"}, duplicates)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+// benchmarkKeepers returns the keepers to benchmark: SQLite and, if configured, PostgreSQL.
+func benchmarkKeepers(b *testing.B) map[string]*BDKeeper {
+	nLogger, err := logger.NewLogger("error")
+	require.NoError(b, err)
+
+	keepers := make(map[string]*BDKeeper)
+
+	dsn := sqliteScheme + b.TempDir() + "/gkeeper.db"
+	bdk, err := NewBDKeeper(func() string { return dsn }, nLogger, nil)
+	require.NoError(b, err)
+	b.Cleanup(func() { bdk.Close() })
+	keepers["sqlite"] = bdk
+
+	if dsn := os.Getenv("TEST_DATABASE_URI"); dsn != "" {
+		bdk, err := NewBDKeeper(func() string { return dsn }, nLogger, nil)
+		require.NoError(b, err)
+		b.Cleanup(func() { bdk.Close() })
+		keepers["postgres"] = bdk
+	}
+
+	return keepers
+}
+
+func BenchmarkBulkInsert(b *testing.B) {
+	const rowsPerOp = 1000
+	ctx := context.Background()
+
+	for name, bdk := range benchmarkKeepers(b) {
+		userID := addTestUser(b, bdk)
+
+		b.Run(name+"/AddData", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				prefix := fmt.Sprintf("loop-%d-%d", time.Now().UnixNano(), i)
+				for _, row := range credentialRows(prefix, rowsPerOp) {
+					if _, _, err := bdk.AddData(ctx, "UserCredentials", userID, row["id"], row); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+
+		b.Run(name+"/BulkInsert", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				prefix := fmt.Sprintf("bulk-%d-%d", time.Now().UnixNano(), i)
+				if _, err := bdk.BulkInsert(ctx, "UserCredentials", userID, credentialRows(prefix, rowsPerOp)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
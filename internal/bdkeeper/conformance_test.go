@@ -0,0 +1,58 @@
+package bdkeeper
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"github.com/wurt83ow/gophkeeper-server/internal/storage"
+	"github.com/wurt83ow/gophkeeper-server/internal/storage/storagetest"
+)
+
+// newSQLiteBDKeeper creates a BDKeeper backed by a fresh SQLite database.
+func newSQLiteBDKeeper(t *testing.T) *BDKeeper {
+	nLogger, err := logger.NewLogger("info")
+	if err != nil {
+		t.Fatalf("Error creating logger: %v", err)
+	}
+
+	dsn := sqliteScheme + filepath.Join(t.TempDir(), "gkeeper.db")
+	bdk, err := NewBDKeeper(func() string { return dsn }, nLogger, nil)
+	if err != nil {
+		t.Fatalf("Error creating BDKeeper: %v", err)
+	}
+	t.Cleanup(func() { bdk.Close() })
+
+	return bdk
+}
+
+func TestBDKeeper_SQLiteConformance(t *testing.T) {
+	bdk := newSQLiteBDKeeper(t)
+
+	storagetest.RunKeeperTests(t, func(t *testing.T) storage.Keeper {
+		return bdk
+	})
+}
+
+func TestBDKeeper_Conformance(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URI")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URI is not set")
+	}
+
+	nLogger, err := logger.NewLogger("info")
+	if err != nil {
+		t.Fatalf("Error creating logger: %v", err)
+	}
+
+	bdk, err := NewBDKeeper(func() string { return dsn }, nLogger, nil)
+	if err != nil {
+		t.Fatalf("Error creating BDKeeper: %v", err)
+	}
+	defer bdk.Close()
+
+	storagetest.RunKeeperTests(t, func(t *testing.T) storage.Keeper {
+		return bdk
+	})
+}
@@ -0,0 +1,170 @@
+package bdkeeper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// devicesTable holds the devices of the users. It is only read by the user of the token,
+// so like the refresh tokens it has no row-level security policy.
+const devicesTable = "devices"
+
+// RegisterDevice registers the device of the user, or marks a registered one as seen now.
+// An empty name keeps the name the device was registered with.
+func (bdk *BDKeeper) RegisterDevice(ctx context.Context, userID int, deviceID, name string) (err error) {
+	defer bdk.observe("register_device", devicesTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	bdk.wrote(userWriter(userID))
+
+	query := fmt.Sprintf(`INSERT INTO devices (user_id, device_id, name, last_seen_at) VALUES ($1, $2, $3, %[1]s)
+		ON CONFLICT (user_id, device_id) DO UPDATE SET last_seen_at = %[1]s,
+			name = CASE WHEN excluded.name = '' THEN devices.name ELSE excluded.name END`, bdk.dialect.now())
+	if _, err := bdk.ex.ExecContext(ctx, bdk.dialect.rebind(query), userID, deviceID, name); err != nil {
+		return fmt.Errorf("failed to register device: %w", err)
+	}
+
+	return nil
+}
+
+// TouchDevice marks the registered device of the user as seen now, or returns models.ErrNotFound.
+func (bdk *BDKeeper) TouchDevice(ctx context.Context, userID int, deviceID string) (err error) {
+	defer bdk.observe("touch_device", devicesTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	bdk.wrote(userWriter(userID))
+
+	query := fmt.Sprintf(`UPDATE devices SET last_seen_at = %s WHERE user_id = $1 AND device_id = $2`, bdk.dialect.now())
+	res, err := bdk.ex.ExecContext(ctx, bdk.dialect.rebind(query), userID, deviceID)
+	if err != nil {
+		return fmt.Errorf("failed to touch device: %w", err)
+	}
+
+	return requireAffected(res)
+}
+
+// GetDevices returns the devices of the user, the most recently seen first.
+func (bdk *BDKeeper) GetDevices(ctx context.Context, userID int) (_ []models.Device, err error) {
+	defer bdk.observe("get_devices", devicesTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	query := `SELECT device_id, name, last_seen_at, last_sync_at FROM devices WHERE user_id = $1
+		ORDER BY last_seen_at DESC, device_id`
+	rows, err := bdk.reader(userWriter(userID)).ex.QueryContext(ctx, bdk.dialect.rebind(query), userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get devices: %w", err)
+	}
+	defer rows.Close()
+
+	devices := make([]models.Device, 0)
+	for rows.Next() {
+		d := models.Device{UserID: userID}
+		var lastSyncAt sql.NullTime
+		if err := rows.Scan(&d.DeviceID, &d.Name, &d.LastSeenAt, &lastSyncAt); err != nil {
+			return nil, fmt.Errorf("failed to scan device: %w", err)
+		}
+		d.LastSeenAt = d.LastSeenAt.UTC()
+		if lastSyncAt.Valid {
+			at := lastSyncAt.Time.UTC()
+			d.LastSyncAt = &at
+		}
+		devices = append(devices, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows encountered an error: %w", err)
+	}
+
+	return devices, nil
+}
+
+// SetDeviceLastSync moves the synchronization checkpoint of the registered device of the user forward to at,
+// a checkpoint already later is kept. It returns models.ErrNotFound if the device isn't registered.
+func (bdk *BDKeeper) SetDeviceLastSync(ctx context.Context, userID int, deviceID string, at time.Time) (err error) {
+	defer bdk.observe("set_device_last_sync", devicesTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	bdk.wrote(userWriter(userID))
+
+	return bdk.inTx(ctx, func(view *BDKeeper) error {
+		var lastSyncAt sql.NullTime
+		query := `SELECT last_sync_at FROM devices WHERE user_id = $1 AND device_id = $2`
+		err := view.ex.QueryRowContext(ctx, view.dialect.rebind(query), userID, deviceID).Scan(&lastSyncAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get device: %w", err)
+		}
+		if lastSyncAt.Valid && !at.After(lastSyncAt.Time) {
+			return nil
+		}
+
+		query = `UPDATE devices SET last_sync_at = $1 WHERE user_id = $2 AND device_id = $3`
+		if _, err := view.ex.ExecContext(ctx, view.dialect.rebind(query), view.dialect.timeArg(at.UTC()), userID, deviceID); err != nil {
+			return fmt.Errorf("failed to set device last sync: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// RevokeDevice deletes the device of the user and revokes its refresh tokens in one transaction,
+// or returns models.ErrNotFound. The device has to log in again.
+func (bdk *BDKeeper) RevokeDevice(ctx context.Context, userID int, deviceID string) (err error) {
+	defer bdk.observe("revoke_device", devicesTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	bdk.wrote(userWriter(userID))
+
+	return bdk.inTx(ctx, func(view *BDKeeper) error {
+		query := `DELETE FROM devices WHERE user_id = $1 AND device_id = $2`
+		res, err := view.ex.ExecContext(ctx, view.dialect.rebind(query), userID, deviceID)
+		if err != nil {
+			return fmt.Errorf("failed to delete device: %w", err)
+		}
+		if err := requireAffected(res); err != nil {
+			return err
+		}
+
+		query = `UPDATE refresh_tokens SET revoked = TRUE WHERE user_id = $1 AND device_id = $2 AND revoked = FALSE`
+		if _, err := view.ex.ExecContext(ctx, view.dialect.rebind(query), userID, deviceID); err != nil {
+			return fmt.Errorf("failed to revoke refresh tokens: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// requireAffected returns models.ErrNotFound if the statement changed no row.
+func requireAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return models.ErrNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,256 @@
+package bdkeeper
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/database/sqlite"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// sqliteScheme is the DSN prefix selecting the SQLite backend, e.g. sqlite:///path/to/db.
+const sqliteScheme = "sqlite://"
+
+// sqliteTimeFormat is the fixed-width format of timestamps stored in SQLite,
+// which keeps their text representation ordered chronologically.
+const sqliteTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// placeholderRe matches the PostgreSQL-style $n placeholders.
+var placeholderRe = regexp.MustCompile(`\$(\d+)`)
+
+// dialect describes the SQL differences between the supported databases.
+type dialect interface {
+	// driverName returns the name of the database/sql driver.
+	driverName() string
+	// rebind converts the $n placeholders of the query to the placeholders of the database.
+	rebind(query string) string
+	// columnsQuery returns the query listing the column names of the table and its arguments.
+	columnsQuery(table string) (string, []interface{})
+	// syncConstraintsQuery returns the query reporting whether the database keeps the synchronization
+	// columns of the table from being NULL, with a default for each, and its arguments.
+	syncConstraintsQuery(table string) (string, []interface{})
+	// timeArg converts the time to a query argument comparable with stored timestamps.
+	timeArg(t time.Time) interface{}
+	// now returns the SQL expression of the current UTC time of the database.
+	now() string
+	// matchTerm returns the condition matching the column against the search term in the placeholder.
+	matchTerm(column, placeholder string) string
+	// nextTime returns the SQL expression of the current UTC time of the database, but
+	// later than the value of the column, so that every update moves the timestamp forward.
+	nextTime(column string) string
+	// tagsArg converts the tags to a query argument stored in the tags column.
+	tagsArg(tags []string) interface{}
+	// hasTag returns the condition matching the entries whose tags column holds the tag in the placeholder.
+	hasTag(column, placeholder string) string
+	// ilike returns the condition matching the column against the LIKE pattern in the placeholder, ignoring the case.
+	ilike(column, placeholder string) string
+	// migrationDriver returns the migrate driver of the connection and the name of the migrations directory.
+	migrationDriver(conn *sql.DB) (database.Driver, string, error)
+	// snapshotTx returns the options of a transaction working on a consistent snapshot, nil for the default ones.
+	snapshotTx(readOnly bool) *sql.TxOptions
+	// readOnly returns the statements making a new transaction read only and bounding its statements
+	// to the timeout, and the statements restoring its connection once the transaction ended.
+	readOnly(timeout time.Duration) (begin []string, end []string)
+	// isSerializationFailure reports whether the error aborted a transaction because of a concurrent one.
+	isSerializationFailure(err error) bool
+	// isIndexLimit reports whether the error rejected a write because its value exceeds a limit of an index.
+	isIndexLimit(err error) bool
+}
+
+// postgresDialect is the dialect of PostgreSQL.
+type postgresDialect struct{}
+
+func (postgresDialect) driverName() string {
+	return "pgx"
+}
+
+func (postgresDialect) rebind(query string) string {
+	return query
+}
+
+func (postgresDialect) columnsQuery(table string) (string, []interface{}) {
+	return `SELECT column_name FROM information_schema.columns WHERE table_name = $1`,
+		[]interface{}{strings.ToLower(table)}
+}
+
+func (postgresDialect) syncConstraintsQuery(table string) (string, []interface{}) {
+	return `SELECT count(*) = 2 FROM information_schema.columns WHERE table_name = $1
+		AND column_name IN ('deleted', 'updated_at') AND is_nullable = 'NO' AND column_default IS NOT NULL`,
+		[]interface{}{strings.ToLower(table)}
+}
+
+func (postgresDialect) timeArg(t time.Time) interface{} {
+	return t
+}
+
+func (postgresDialect) now() string {
+	return "(now() AT TIME ZONE 'UTC')"
+}
+
+// The expression must stay in line with the indexes of the search text migration.
+func (postgresDialect) matchTerm(column, placeholder string) string {
+	return fmt.Sprintf("to_tsvector('simple', coalesce(%s, '')) @@ plainto_tsquery('simple', %s)", column, placeholder)
+}
+
+func (d postgresDialect) nextTime(column string) string {
+	return fmt.Sprintf("GREATEST(%s, %s + interval '1 microsecond')", d.now(), column)
+}
+
+// pgx encodes the slice as a text array, also for the copy protocol.
+func (postgresDialect) tagsArg(tags []string) interface{} {
+	return tags
+}
+
+// The containment operator uses the GIN index of the tags migration.
+func (postgresDialect) hasTag(column, placeholder string) string {
+	return fmt.Sprintf("%s @> ARRAY[%s]::text[]", column, placeholder)
+}
+
+func (postgresDialect) ilike(column, placeholder string) string {
+	return fmt.Sprintf("%s ILIKE %s", column, placeholder)
+}
+
+func (postgresDialect) migrationDriver(conn *sql.DB) (database.Driver, string, error) {
+	driver, err := postgres.WithInstance(conn, new(postgres.Config))
+	return driver, "migrations", err
+}
+
+func (postgresDialect) snapshotTx(readOnly bool) *sql.TxOptions {
+	return &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: readOnly}
+}
+
+func (postgresDialect) readOnly(timeout time.Duration) ([]string, []string) {
+	return []string{
+		"SET TRANSACTION READ ONLY",
+		fmt.Sprintf("SET LOCAL statement_timeout = %d", timeout.Milliseconds()),
+	}, nil
+}
+
+// serializationFailure is the SQLSTATE of a transaction aborted by a concurrent one.
+const serializationFailure = "40001"
+
+func (postgresDialect) isSerializationFailure(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == serializationFailure
+}
+
+// programLimitExceeded is the SQLSTATE of a value too large for an index,
+// e.g. a string too long for tsvector.
+const programLimitExceeded = "54000"
+
+func (postgresDialect) isIndexLimit(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == programLimitExceeded
+}
+
+// sqliteDialect is the dialect of SQLite.
+type sqliteDialect struct{}
+
+func (sqliteDialect) driverName() string {
+	return "sqlite"
+}
+
+func (sqliteDialect) rebind(query string) string {
+	return placeholderRe.ReplaceAllString(query, "?$1")
+}
+
+func (sqliteDialect) columnsQuery(table string) (string, []interface{}) {
+	return `SELECT name FROM pragma_table_info($1)`, []interface{}{table}
+}
+
+// SQLite can't add NOT NULL to a column, the migration rejects the NULL values with triggers.
+func (sqliteDialect) syncConstraintsQuery(table string) (string, []interface{}) {
+	return `SELECT (SELECT count(*) FROM pragma_table_info($1)
+			WHERE name IN ('deleted', 'updated_at') AND dflt_value IS NOT NULL) = 2
+		AND (SELECT count(*) FROM sqlite_master WHERE type = 'trigger' AND tbl_name = $1 COLLATE NOCASE
+			AND name LIKE '%\_sync\_%\_not\_null' ESCAPE '\') = 2`, []interface{}{table}
+}
+
+func (sqliteDialect) timeArg(t time.Time) interface{} {
+	return t.UTC().Format(sqliteTimeFormat)
+}
+
+func (sqliteDialect) now() string {
+	return "strftime('%Y-%m-%dT%H:%M:%fZ', 'now')"
+}
+
+// SQLite has no built-in full-text search without extra tables, so terms are matched
+// as case-insensitive substrings. The caller passes the terms in lower case.
+func (sqliteDialect) matchTerm(column, placeholder string) string {
+	return fmt.Sprintf("instr(lower(coalesce(%s, '')), %s) > 0", column, placeholder)
+}
+
+// SQLite timestamps have a millisecond precision, writes within the same millisecond would get equal ones.
+// Some parsed milliseconds are truncated, e.g. .569 is read back as .568, so the step is
+// a millisecond and a half to always land on a later millisecond.
+func (d sqliteDialect) nextTime(column string) string {
+	return fmt.Sprintf("MAX(%s, strftime('%%Y-%%m-%%dT%%H:%%M:%%fZ', %s, '+0.0015 seconds'))", d.now(), column)
+}
+
+// SQLite has no arrays, the tags are stored as a list delimited by commas on both ends,
+// so a tag is matched as a whole by looking for it between two commas.
+func (sqliteDialect) tagsArg(tags []string) interface{} {
+	if len(tags) == 0 {
+		return ""
+	}
+
+	return "," + strings.Join(tags, ",") + ","
+}
+
+func (sqliteDialect) hasTag(column, placeholder string) string {
+	return fmt.Sprintf("instr(%s, ',' || %s || ',') > 0", column, placeholder)
+}
+
+// The LIKE of SQLite already ignores the case, of ASCII letters only.
+func (sqliteDialect) ilike(column, placeholder string) string {
+	return fmt.Sprintf("%s LIKE %s", column, placeholder)
+}
+
+func (sqliteDialect) migrationDriver(conn *sql.DB) (database.Driver, string, error) {
+	driver, err := sqlite.WithInstance(conn, new(sqlite.Config))
+	return driver, "migrations/sqlite", err
+}
+
+// snapshotTx returns the default options, SQLite transactions are serializable.
+func (sqliteDialect) snapshotTx(readOnly bool) *sql.TxOptions {
+	return nil
+}
+
+// SQLite has no read-only transactions, the connection is made read only for the transaction.
+// The timeout is left to the context, which interrupts the statement.
+func (sqliteDialect) readOnly(timeout time.Duration) ([]string, []string) {
+	return []string{"PRAGMA query_only = ON"}, []string{"PRAGMA query_only = OFF"}
+}
+
+// isSerializationFailure reports false, SQLite serializes the writers instead of aborting them.
+func (sqliteDialect) isSerializationFailure(err error) bool {
+	return false
+}
+
+// isIndexLimit reports false, SQLite has no index on the search text.
+func (sqliteDialect) isIndexLimit(err error) bool {
+	return false
+}
+
+// dialectFor returns the dialect selected by the DSN and the DSN to pass to the driver.
+func dialectFor(dsn string) (dialect, string) {
+	if path, ok := strings.CutPrefix(dsn, sqliteScheme); ok {
+		if !strings.Contains(path, "_pragma=foreign_keys") {
+			sep := "?"
+			if strings.Contains(path, "?") {
+				sep = "&"
+			}
+			path += sep + "_pragma=foreign_keys(1)"
+		}
+
+		return sqliteDialect{}, path
+	}
+
+	return postgresDialect{}, dsn
+}
@@ -0,0 +1,108 @@
+package bdkeeper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrShuttingDown is returned by the operations started once Shutdown was called.
+var ErrShuttingDown = errors.New("keeper is shutting down")
+
+// drain tracks the operations in flight so Shutdown can wait for them.
+// It is shared by the keeper and its views.
+type drain struct {
+	mu      sync.Mutex
+	closing bool
+	active  int
+	wg      sync.WaitGroup
+
+	// stop cancels the operations still running when the deadline of Shutdown is reached
+	stop    context.Context
+	stopAll context.CancelFunc
+}
+
+func newDrain() *drain {
+	d := new(drain)
+	d.stop, d.stopAll = context.WithCancel(context.Background())
+
+	return d
+}
+
+// running returns the number of the operations in flight.
+func (d *drain) running() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.active
+}
+
+// enter admits an operation of the keeper and returns its context, canceled if Shutdown
+// gives up waiting for it, and the function ending it. Once Shutdown was called, it fails
+// with ErrShuttingDown. The operations of a WithTx view run inside the one which opened
+// the transaction, they are always admitted.
+func (bdk *BDKeeper) enter(ctx context.Context) (context.Context, func(), error) {
+	if bdk.tx != nil {
+		return ctx, func() {}, nil
+	}
+
+	d := bdk.drain
+	d.mu.Lock()
+	if d.closing {
+		d.mu.Unlock()
+		return ctx, func() {}, ErrShuttingDown
+	}
+	d.active++
+	d.wg.Add(1)
+	d.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	unwatch := context.AfterFunc(d.stop, cancel)
+
+	return ctx, func() {
+		unwatch()
+		cancel()
+		d.mu.Lock()
+		d.active--
+		d.mu.Unlock()
+		d.wg.Done()
+	}, nil
+}
+
+// Shutdown stops the keeper gracefully: the operations started from now on fail with ErrShuttingDown,
+// the ones in flight are waited for, then the connections are closed as Close does.
+// If ctx is done first, the operations still running are canceled and the error of ctx is returned.
+// A transaction view doesn't own the connection, shutting it down fails.
+func (bdk *BDKeeper) Shutdown(ctx context.Context) error {
+	if bdk.tx != nil {
+		return errors.New("a transaction view can't be shut down")
+	}
+
+	d := bdk.drain
+	d.mu.Lock()
+	d.closing = true
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("%d operations still running: %w", d.running(), ctx.Err())
+		bdk.log.Warn("canceling the operations still running")
+		d.stopAll()
+		<-done
+	}
+
+	if !bdk.Close() && err == nil {
+		err = errors.New("failed to close the database")
+	}
+
+	return err
+}
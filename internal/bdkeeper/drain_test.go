@@ -0,0 +1,103 @@
+package bdkeeper
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"github.com/wurt83ow/gophkeeper-server/internal/storage"
+)
+
+// slowUserExists starts a UserExists call whose query takes the given time
+// and waits until it is in flight, the pool is expected to be closed after it.
+func slowUserExists(t *testing.T, bdk *BDKeeper, mock sqlmock.Sqlmock, delay time.Duration) <-chan error {
+	mock.ExpectQuery("SELECT COUNT(.+) FROM Users WHERE username = (.+)").
+		WillDelayFor(delay).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectClose()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := bdk.UserExists(context.Background(), "testUser")
+		done <- err
+	}()
+	require.Eventually(t, func() bool { return bdk.drain.running() == 1 }, time.Second, time.Millisecond)
+
+	return done
+}
+
+func TestBDKeeper_Shutdown(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	bdk := newTestBDKeeper(t, db)
+
+	done := slowUserExists(t, bdk, mock, 100*time.Millisecond)
+
+	// The query in flight finishes within the deadline, the pool is closed after it
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, bdk.Shutdown(ctx))
+	require.NoError(t, <-done)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	// No new work is accepted
+	_, err = bdk.UserExists(context.Background(), "testUser")
+	assert.ErrorIs(t, err, ErrShuttingDown)
+	_, _, err = bdk.AddData(context.Background(), "TextData", 1, "", map[string]string{"data": "x"})
+	assert.ErrorIs(t, err, ErrShuttingDown)
+	assert.False(t, bdk.Ping())
+}
+
+func TestBDKeeper_ShutdownDeadline(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	bdk := newTestBDKeeper(t, db)
+
+	done := slowUserExists(t, bdk, mock, time.Minute)
+
+	// The query still running at the deadline is canceled instead of holding the shutdown up
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = bdk.Shutdown(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Error(t, <-done)
+	assert.Zero(t, bdk.drain.running())
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestBDKeeper_ShutdownViews(t *testing.T) {
+	bdk := newSQLiteBDKeeper(t)
+	ctx := context.Background()
+	userID := addTestUser(t, bdk)
+
+	// The transaction begun before the shutdown ends, its operations aren't rejected
+	inTx := make(chan struct{})
+	resume := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- bdk.WithTx(ctx, func(tx storage.Keeper) error {
+			close(inTx)
+			<-resume
+			_, _, err := tx.AddData(ctx, "UserCredentials", userID, "", map[string]string{"login": "l", "password": "p"})
+			return err
+		})
+	}()
+	<-inTx
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- bdk.Shutdown(ctx) }()
+	require.Eventually(t, func() bool {
+		_, err := bdk.GetAllData(ctx, "UserCredentials", userID, models.DataQuery{})
+		return err != nil
+	}, time.Second, time.Millisecond)
+
+	close(resume)
+	require.NoError(t, <-done)
+	require.NoError(t, <-shutdown)
+}
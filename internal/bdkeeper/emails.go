@@ -0,0 +1,218 @@
+package bdkeeper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// emailTokensTable holds the tokens mailed to the users. Like the refresh tokens it has no row-level
+// security policy, a token is looked up by its hash before its user is known.
+const emailTokensTable = "email_tokens"
+
+// SetUserEmail sets the email of the user, unverified, or clears it if it is empty. The tokens mailed
+// to the previous email are void. It returns models.ErrEmailTaken if another user has the email,
+// or models.ErrNotFound if the user doesn't exist.
+func (bdk *BDKeeper) SetUserEmail(ctx context.Context, userID int, email string) (err error) {
+	defer bdk.observe("set_user_email", usersTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	bdk.wrote(userWriter(userID))
+
+	var value interface{}
+	if email != "" {
+		value = email
+	}
+
+	return bdk.inTx(ctx, func(view *BDKeeper) error {
+		if email != "" {
+			var other int
+			query := `SELECT id FROM Users WHERE email = $1 AND id <> $2`
+			err := view.ex.QueryRowContext(ctx, view.dialect.rebind(query), email, userID).Scan(&other)
+			if err == nil {
+				return models.ErrEmailTaken
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("failed to check email: %w", err)
+			}
+		}
+
+		var username string
+		query := `UPDATE Users SET email = $1, email_verified = FALSE WHERE id = $2 RETURNING username`
+		err := view.ex.QueryRowContext(ctx, view.dialect.rebind(query), value, userID).Scan(&username)
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set user email: %w", err)
+		}
+		bdk.wrote(accountWriter(username))
+
+		query = `DELETE FROM email_tokens WHERE user_id = $1`
+		if _, err := view.ex.ExecContext(ctx, view.dialect.rebind(query), userID); err != nil {
+			return fmt.Errorf("failed to delete email tokens: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// SetUserLanguage sets the language the user is mailed in, empty for the default one,
+// or returns models.ErrNotFound if the user doesn't exist.
+func (bdk *BDKeeper) SetUserLanguage(ctx context.Context, userID int, language string) (err error) {
+	defer bdk.observe("set_user_language", usersTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	bdk.wrote(userWriter(userID))
+
+	var username string
+	query := `UPDATE Users SET language = $1 WHERE id = $2 RETURNING username`
+	err = bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), language, userID).Scan(&username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set user language: %w", err)
+	}
+	bdk.wrote(accountWriter(username))
+
+	return nil
+}
+
+// userEmailColumns are the columns of the email of a user read by scanUserEmail.
+const userEmailColumns = `id, username, email, email_verified, language`
+
+// scanUserEmail reads the email of a user of userEmailColumns.
+func scanUserEmail(row *sql.Row) (models.UserEmail, error) {
+	var u models.UserEmail
+	var email sql.NullString
+	err := row.Scan(&u.UserID, &u.Username, &email, &u.Verified, &u.Language)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.UserEmail{}, models.ErrNotFound
+	}
+	if err != nil {
+		return models.UserEmail{}, fmt.Errorf("failed to get user email: %w", err)
+	}
+	u.Email = email.String
+
+	return u, nil
+}
+
+// GetUserEmail returns the email of the user, or models.ErrNotFound if the user doesn't exist.
+func (bdk *BDKeeper) GetUserEmail(ctx context.Context, userID int) (_ models.UserEmail, err error) {
+	defer bdk.observe("get_user_email", usersTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return models.UserEmail{}, err
+	}
+	defer leave()
+
+	query := `SELECT ` + userEmailColumns + ` FROM Users WHERE id = $1`
+	return scanUserEmail(bdk.reader(userWriter(userID)).ex.QueryRowContext(ctx, bdk.dialect.rebind(query), userID))
+}
+
+// FindUserByEmail returns the user with the email, or models.ErrNotFound. It always reads the primary,
+// the user may have just set it.
+func (bdk *BDKeeper) FindUserByEmail(ctx context.Context, email string) (_ models.UserEmail, err error) {
+	defer bdk.observe("find_user_by_email", usersTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return models.UserEmail{}, err
+	}
+	defer leave()
+
+	query := `SELECT ` + userEmailColumns + ` FROM Users WHERE email = $1`
+	return scanUserEmail(bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), email))
+}
+
+// VerifyUserEmail marks the email of the user as verified if it is still the given one,
+// or returns models.ErrNotFound.
+func (bdk *BDKeeper) VerifyUserEmail(ctx context.Context, userID int, email string) (err error) {
+	defer bdk.observe("verify_user_email", usersTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	bdk.wrote(userWriter(userID))
+
+	query := `UPDATE Users SET email_verified = TRUE WHERE id = $1 AND email = $2`
+	res, err := bdk.ex.ExecContext(ctx, bdk.dialect.rebind(query), userID, email)
+	if err != nil {
+		return fmt.Errorf("failed to verify user email: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return models.ErrNotFound
+	}
+
+	return nil
+}
+
+// CreateEmailToken stores a token mailed to a user. The expired tokens of the user are deleted with it.
+func (bdk *BDKeeper) CreateEmailToken(ctx context.Context, token models.EmailToken) (err error) {
+	defer bdk.observe("create_email_token", emailTokensTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+
+	return bdk.inTx(ctx, func(view *BDKeeper) error {
+		query := fmt.Sprintf(`DELETE FROM email_tokens WHERE user_id = $1 AND expires_at <= %s`, view.dialect.now())
+		if _, err := view.ex.ExecContext(ctx, view.dialect.rebind(query), token.UserID); err != nil {
+			return fmt.Errorf("failed to delete expired email tokens: %w", err)
+		}
+
+		query = `INSERT INTO email_tokens (token_hash, user_id, purpose, email, expires_at) VALUES ($1, $2, $3, $4, $5)`
+		_, err := view.ex.ExecContext(ctx, view.dialect.rebind(query),
+			token.Hash, token.UserID, token.Purpose, token.Email, view.dialect.timeArg(token.ExpiresAt.UTC()))
+		if err != nil {
+			return fmt.Errorf("failed to create email token: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// ConsumeEmailToken deletes the token of the purpose with the given hash and returns it,
+// or returns models.ErrNotFound if there is none or it has expired. A token is used once,
+// of two concurrent uses only one finds it.
+func (bdk *BDKeeper) ConsumeEmailToken(ctx context.Context, hash, purpose string) (_ models.EmailToken, err error) {
+	defer bdk.observe("consume_email_token", emailTokensTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return models.EmailToken{}, err
+	}
+	defer leave()
+
+	token := models.EmailToken{Hash: hash, Purpose: purpose}
+	query := `DELETE FROM email_tokens WHERE token_hash = $1 AND purpose = $2 RETURNING user_id, email, expires_at`
+	err = bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), hash, purpose).Scan(&token.UserID, &token.Email, &token.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.EmailToken{}, models.ErrNotFound
+	}
+	if err != nil {
+		return models.EmailToken{}, fmt.Errorf("failed to consume email token: %w", err)
+	}
+	token.ExpiresAt = token.ExpiresAt.UTC()
+	if !time.Now().Before(token.ExpiresAt) {
+		return models.EmailToken{}, models.ErrNotFound
+	}
+
+	return token, nil
+}
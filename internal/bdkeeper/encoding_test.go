@@ -0,0 +1,38 @@
+package bdkeeper
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+func TestBDKeeper_InvalidUTF8(t *testing.T) {
+	bdk := newSQLiteBDKeeper(t)
+	ctx := context.Background()
+	userID := addTestUser(t, bdk)
+
+	_, _, err := bdk.AddData(ctx, "UserCredentials", userID, "clean", map[string]string{"login": "alice", "password": "p"})
+	require.NoError(t, err)
+
+	// Seed a row the way legacy clients did, bypassing the API
+	_, err = bdk.conn.ExecContext(ctx, `INSERT INTO UserCredentials (id, user_id, login, password, meta_info) VALUES (?, ?, ?, ?, ?)`,
+		"legacy", userID, "bob\xff", "p", "caf\xc3")
+	require.NoError(t, err)
+
+	data, err := bdk.GetAllData(ctx, "UserCredentials", userID, models.DataQuery{})
+	require.NoError(t, err)
+	require.Len(t, data, 2)
+
+	rows := make(map[string]map[string]string)
+	for _, row := range data {
+		rows[row["id"]] = row
+	}
+
+	assert.Equal(t, "bob�", rows["legacy"]["login"])
+	assert.Equal(t, "caf�", rows["legacy"]["meta_info"])
+	assert.Equal(t, models.WarningInvalidUTF8, rows["legacy"][models.DataWarning])
+	assert.NotContains(t, rows["clean"], models.DataWarning)
+}
@@ -0,0 +1,189 @@
+package bdkeeper
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// EncryptionKeySize is the size of the AES-256 keys encrypting the sensitive columns.
+const EncryptionKeySize = 32
+
+// sealedPrefix starts every encrypted value, the values without it are read as stored.
+// It is followed by the id of the key, a colon and the base64 of the nonce and the ciphertext.
+const sealedPrefix = "gkenc:v1:"
+
+// encryptedColumns are the columns of the data tables encrypted when encryption is enabled.
+var encryptedColumns = map[string]bool{
+	"password":        true,
+	"card_number":     true,
+	"expiration_date": true,
+	"cvv":             true,
+	"data":            true,
+	"meta_info":       true,
+	"secret":          true,
+	"private_key":     true,
+}
+
+// keyIDPattern restricts the key ids to the characters that can't be confused with the separators.
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// sealer encrypts the sensitive columns with the current key and decrypts them with any known key.
+type sealer struct {
+	keyID string
+	keys  map[string]cipher.AEAD
+}
+
+// EnableEncryption encrypts the sensitive columns of the data tables with AES-256-GCM before they
+// are written and decrypts them when they are read. Every value gets a random nonce and records
+// the id of its key, the values written before encryption was enabled are read as stored.
+// Encrypted columns can't be filtered or sorted by the database, meta_info is then searched by the keeper.
+func (bdk *BDKeeper) EnableEncryption(keyID string, key []byte) error {
+	s := &sealer{keys: make(map[string]cipher.AEAD)}
+	if err := s.addKey(keyID, key); err != nil {
+		return err
+	}
+	s.keyID = keyID
+
+	bdk.sealer = s
+
+	return nil
+}
+
+// addKey makes the key known for decryption.
+func (s *sealer) addKey(keyID string, key []byte) error {
+	if !keyIDPattern.MatchString(keyID) {
+		return fmt.Errorf("encryption key id %q must be 1 to 32 letters, digits, '-' or '_'", keyID)
+	}
+	if len(key) != EncryptionKeySize {
+		return fmt.Errorf("encryption key must be %d bytes, got %d", EncryptionKeySize, len(key))
+	}
+	if _, ok := s.keys[keyID]; ok {
+		return fmt.Errorf("encryption key %q is given twice", keyID)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	s.keys[keyID] = aead
+
+	return nil
+}
+
+// seal encrypts the value of the column with the current key.
+// The table and the column are authenticated, so a value can't be moved to another column.
+func (s *sealer) seal(table, column, value string) (string, error) {
+	aead := s.keys[s.keyID]
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(value)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), associatedData(table, column))
+
+	return sealedPrefix + s.keyID + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts the stored value of the column, a value without the prefix is returned as is.
+func (s *sealer) open(table, column, stored string) (string, error) {
+	keyID, encoded, ok := parseSealed(stored)
+	if !ok {
+		return stored, nil
+	}
+
+	aead, ok := s.keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("unknown encryption key %q", keyID)
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed encrypted value")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, associatedData(table, column))
+	if err != nil {
+		return "", err
+	}
+
+	return string(plain), nil
+}
+
+// parseSealed splits an encrypted value into the id of its key and its encoded ciphertext.
+func parseSealed(stored string) (keyID, encoded string, ok bool) {
+	rest, ok := strings.CutPrefix(stored, sealedPrefix)
+	if !ok {
+		return "", "", false
+	}
+
+	return strings.Cut(rest, ":")
+}
+
+// associatedData binds a ciphertext to its column, table names are case-insensitive in queries.
+func associatedData(table, column string) []byte {
+	return []byte(strings.ToLower(table) + "." + column)
+}
+
+// sealField encrypts the value of a sensitive column if encryption is enabled.
+func (bdk *BDKeeper) sealField(table, column, value string) (string, error) {
+	if bdk.sealer == nil || !encryptedColumns[column] {
+		return value, nil
+	}
+
+	return bdk.sealer.seal(table, column, value)
+}
+
+// openRows decrypts the sensitive columns of the rows read from the table in place.
+// The encrypted values are decrypted even if encryption has been disabled since,
+// as long as the key is known, so a value without its key fails the read.
+func (bdk *BDKeeper) openRows(table string, rows []map[string]string) error {
+	for _, row := range rows {
+		for column, value := range row {
+			if !encryptedColumns[column] || !strings.HasPrefix(value, sealedPrefix) {
+				continue
+			}
+			if bdk.sealer == nil {
+				return fmt.Errorf("failed to decrypt %s of entry %s: encryption is disabled", column, row["id"])
+			}
+
+			plain, err := bdk.sealer.open(table, column, value)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt %s of entry %s: %w", column, row["id"], err)
+			}
+			row[column] = plain
+		}
+	}
+
+	return nil
+}
+
+// checkEncryptedQuery rejects the filters and orders on the encrypted columns,
+// the database only sees their ciphertexts.
+func (bdk *BDKeeper) checkEncryptedQuery(filter models.Filter, order models.Order) error {
+	if bdk.sealer == nil {
+		return nil
+	}
+
+	for _, c := range filter {
+		if encryptedColumns[c.Column] {
+			return fmt.Errorf("%w: %s is encrypted and can't be filtered", models.ErrInvalidQuery, c.Column)
+		}
+	}
+	if encryptedColumns[order.Column] {
+		return fmt.Errorf("%w: %s is encrypted and can't be sorted", models.ErrInvalidQuery, order.Column)
+	}
+
+	return nil
+}
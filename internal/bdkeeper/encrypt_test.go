@@ -0,0 +1,107 @@
+package bdkeeper
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// testEncryptionKey is a valid AES-256 key.
+var testEncryptionKey = bytes.Repeat([]byte{7}, EncryptionKeySize)
+
+// storedValue reads the column of an entry as stored in the database.
+func storedValue(t *testing.T, bdk *BDKeeper, table, column, entryID string) string {
+	var value string
+	err := bdk.conn.QueryRowContext(context.Background(),
+		"SELECT "+column+" FROM "+table+" WHERE id = ?", entryID).Scan(&value)
+	require.NoError(t, err)
+
+	return value
+}
+
+func TestBDKeeper_Encryption(t *testing.T) {
+	bdk := newSQLiteBDKeeper(t)
+	ctx := context.Background()
+	userID := addTestUser(t, bdk)
+	table := "UserCredentials"
+
+	assert.Error(t, bdk.EnableEncryption("k1", testEncryptionKey[:16]))
+	assert.Error(t, bdk.EnableEncryption("k:1", testEncryptionKey))
+
+	// An entry written before encryption is enabled is still read as stored
+	_, _, err := bdk.AddData(ctx, table, userID, "legacy", map[string]string{"login": "l", "password": "old secret", "meta_info": "legacy bank"})
+	require.NoError(t, err)
+
+	require.NoError(t, bdk.EnableEncryption("k1", testEncryptionKey))
+	_, _, err = bdk.AddData(ctx, table, userID, "sealed", map[string]string{"login": "alice", "password": "secret", "meta_info": "Work mail"})
+	require.NoError(t, err)
+
+	// The sensitive columns are stored encrypted with the id of the key, the others as sent
+	stored := storedValue(t, bdk, table, "password", "sealed")
+	assert.True(t, strings.HasPrefix(stored, sealedPrefix+"k1:"))
+	assert.NotContains(t, stored, "secret")
+	assert.Equal(t, "alice", storedValue(t, bdk, table, "login", "sealed"))
+
+	// The search text of the encrypted meta information isn't stored, the legacy one is still indexed
+	assert.Empty(t, storedValue(t, bdk, table, "coalesce(search_text, '')", "sealed"))
+	assert.Equal(t, "legacy bank", storedValue(t, bdk, table, "search_text", "legacy"))
+
+	// The same value gets a new nonce every time
+	_, _, err = bdk.AddData(ctx, table, userID, "sealed-2", map[string]string{"login": "alice", "password": "secret"})
+	require.NoError(t, err)
+	assert.NotEqual(t, stored, storedValue(t, bdk, table, "password", "sealed-2"))
+
+	data, err := bdk.GetData(ctx, table, userID, "sealed", false)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", data["password"])
+	assert.Equal(t, "Work mail", data["meta_info"])
+
+	all, err := bdk.GetAllData(ctx, table, userID, models.DataQuery{})
+	require.NoError(t, err)
+	passwords := make(map[string]string)
+	for _, row := range all {
+		passwords[row["id"]] = row["password"]
+	}
+	assert.Equal(t, map[string]string{"legacy": "old secret", "sealed": "secret", "sealed-2": "secret"}, passwords)
+
+	// The history keeps the encrypted values and returns them decrypted
+	_, err = bdk.UpdateData(ctx, table, userID, "sealed", map[string]string{"password": "newer"})
+	require.NoError(t, err)
+	history, err := bdk.GetDataHistory(ctx, table, userID, "sealed", 0)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, "secret", history[0].Snapshot["password"])
+
+	// The encrypted meta information is still searched, encrypted or not
+	found, err := bdk.SearchData(ctx, userID, "work", nil, 10, false)
+	require.NoError(t, err)
+	require.Len(t, found[table], 1)
+	assert.Equal(t, "sealed", found[table][0]["id"])
+	found, err = bdk.SearchData(ctx, userID, "bank", nil, 10, false)
+	require.NoError(t, err)
+	assert.Len(t, found[table], 1)
+
+	// The database can't compare the ciphertexts
+	_, err = bdk.GetAllData(ctx, table, userID, models.DataQuery{
+		Filter: models.Filter{{Column: "password", Op: models.FilterEq, Value: "secret"}},
+	})
+	assert.ErrorIs(t, err, models.ErrInvalidQuery)
+	_, err = bdk.GetAllData(ctx, table, userID, models.DataQuery{OrderBy: models.Order{Column: "meta_info"}})
+	assert.ErrorIs(t, err, models.ErrInvalidQuery)
+
+	// A value moved to another column or tampered with fails the read
+	_, err = bdk.conn.ExecContext(ctx, "UPDATE UserCredentials SET meta_info = password WHERE id = 'sealed'")
+	require.NoError(t, err)
+	_, err = bdk.GetData(ctx, table, userID, "sealed", false)
+	assert.Error(t, err)
+
+	// Without the key the encrypted values can't be read
+	require.NoError(t, bdk.EnableEncryption("k2", bytes.Repeat([]byte{8}, EncryptionKeySize)))
+	_, err = bdk.GetData(ctx, table, userID, "sealed-2", false)
+	assert.ErrorContains(t, err, `unknown encryption key "k1"`)
+}
@@ -0,0 +1,97 @@
+package bdkeeper
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// ExpireData marks the entries of all data tables whose expires_at has passed as deleted,
+// so the deletion reaches the clients with the next synchronization like any other.
+// The database clock decides which entries have expired. It returns the number of deleted entries.
+func (bdk *BDKeeper) ExpireData(ctx context.Context) (_ int, err error) {
+	defer bdk.observe("expire_data", "", time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer leave()
+
+	if bdk.rls {
+		ctx = withBypass(ctx)
+	}
+
+	return scoped(ctx, bdk, func(view *BDKeeper) (int, error) {
+		return view.expireData(ctx)
+	})
+}
+
+// PreviewExpiry is the dry run of ExpireData: it returns the number of the entries ExpireData
+// would delete and up to sample of their identifiers, without changing anything.
+func (bdk *BDKeeper) PreviewExpiry(ctx context.Context, sample int) (_ models.JobPreview, err error) {
+	defer bdk.observe("preview_expiry", "", time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return models.JobPreview{}, err
+	}
+	defer leave()
+
+	if bdk.rls {
+		ctx = withBypass(ctx)
+	}
+
+	return scoped(ctx, bdk, func(view *BDKeeper) (models.JobPreview, error) {
+		selections, err := view.expirySelections(ctx)
+		if err != nil {
+			return models.JobPreview{}, err
+		}
+		return view.previewJob(ctx, selections, sample)
+	})
+}
+
+// expirySelections selects the live entries of every data table whose expires_at has passed.
+func (bdk *BDKeeper) expirySelections(ctx context.Context) ([]jobSelection, error) {
+	selections := make([]jobSelection, 0, len(models.DataTables))
+	for _, table := range models.DataTables {
+		ident, err := bdk.tableIdent(ctx, bdk.ex, table)
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, jobSelection{
+			table: table,
+			ident: ident,
+			where: fmt.Sprintf("deleted = false AND %s <= %s", models.ExpiresAtField, bdk.dialect.now()),
+		})
+	}
+
+	return selections, nil
+}
+
+// expireData runs ExpireData on the keeper or view.
+func (bdk *BDKeeper) expireData(ctx context.Context) (int, error) {
+	selections, err := bdk.expirySelections(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var expired int
+	for _, sel := range selections {
+		query := fmt.Sprintf("UPDATE %s SET deleted = TRUE, updated_at = %s WHERE %s",
+			sel.ident, bdk.dialect.nextTime("updated_at"), sel.where)
+
+		res, err := bdk.ex.ExecContext(ctx, query, sel.args...)
+		if err != nil {
+			return expired, fmt.Errorf("failed to expire %s: %w", sel.table, err)
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return expired, err
+		}
+		expired += int(n)
+	}
+
+	return expired, nil
+}
@@ -0,0 +1,75 @@
+package bdkeeper
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// exportPageSize is the number of entries ExportData reads with a query.
+var exportPageSize = 500
+
+// ExportData calls fn with each entry of the user in the table which isn't deleted, the expired ones included,
+// by id. The entries are read a page at a time, each page after the last id of the previous one, and fn is
+// called once the page is read: an export to a slow client holds neither the table in memory nor a connection,
+// which SQLite has only one of.
+func (bdk *BDKeeper) ExportData(ctx context.Context, table string, userID int, fn func(entry map[string]string) error) (err error) {
+	defer bdk.observe("export_data", table, time.Now(), &err)
+
+	var after string
+	for {
+		page, err := bdk.exportPage(ctx, table, userID, after)
+		if err != nil {
+			return err
+		}
+		for _, row := range page {
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+		if len(page) < exportPageSize {
+			return nil
+		}
+		after = page[len(page)-1]["id"]
+	}
+}
+
+// exportPage reads the page of the entries of ExportData following the id after, the first one if it is empty.
+func (bdk *BDKeeper) exportPage(ctx context.Context, table string, userID int, after string) ([]map[string]string, error) {
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	q := models.DataQuery{InclExpired: true, OrderBy: models.Order{Column: "id"}}
+	if after != "" {
+		q.Filter = models.Filter{{Column: "id", Op: models.FilterGt, Value: after}}
+	}
+
+	return scoped(ctx, bdk.reader(userWriter(userID)), func(view *BDKeeper) ([]map[string]string, error) {
+		query, args, cols, err := view.allDataQuery(ctx, table, userID, q)
+		if err != nil {
+			return nil, err
+		}
+
+		rows, err := view.ex.QueryContext(ctx, fmt.Sprintf("%s LIMIT %d", query, exportPageSize), args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute query: %w", err)
+		}
+		defer rows.Close()
+
+		data, err := scanRows(rows, cols)
+		if err != nil {
+			return nil, err
+		}
+		if err := view.openRows(table, data); err != nil {
+			return nil, err
+		}
+		view.checkReads(ctx, table, userID, cols, data)
+
+		return data, nil
+	})
+}
@@ -0,0 +1,38 @@
+package bdkeeper
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBDKeeper_ExportPages(t *testing.T) {
+	bdk := newSQLiteBDKeeper(t)
+	ctx := context.Background()
+
+	defer func(size int) { exportPageSize = size }(exportPageSize)
+	exportPageSize = 2
+
+	// The pages follow each other by id, a full last page is followed by an empty one
+	for _, n := range []int{4, 5} {
+		userID := addTestUser(t, bdk)
+		var want []string
+		for i := n; i > 0; i-- {
+			id := fmt.Sprintf("entry-%d-%02d", n, i)
+			_, _, err := bdk.AddData(ctx, "UserCredentials", userID, id, map[string]string{"login": id, "password": "p"})
+			require.NoError(t, err)
+			want = append([]string{id}, want...)
+		}
+
+		var got []string
+		err := bdk.ExportData(ctx, "UserCredentials", userID, func(entry map[string]string) error {
+			got = append(got, entry["id"])
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+}
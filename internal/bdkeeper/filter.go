@@ -0,0 +1,58 @@
+package bdkeeper
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// filterCondition translates the validated filter to placeholders appended to args and
+// returns the condition, starting with " AND ", together with the arguments.
+// The values are always passed as arguments, only the validated and quoted column names are part of the query.
+func (bdk *BDKeeper) filterCondition(schema *tableSchema, f models.Filter, args []interface{}) (string, []interface{}, error) {
+	var condition string
+	for _, c := range f {
+		arg, err := bdk.filterArg(c)
+		if err != nil {
+			return "", nil, err
+		}
+		args = append(args, arg)
+		placeholder := fmt.Sprintf("$%d", len(args))
+
+		if c.Op == models.FilterILike {
+			condition += " AND " + bdk.dialect.ilike(schema.column(c.Column), placeholder)
+			continue
+		}
+
+		// Only the operators accepted by Validate reach the query
+		op := string(c.Op)
+		if c.Op == models.FilterNe {
+			op = "<>"
+		}
+		condition += fmt.Sprintf(" AND %s %s %s", schema.column(c.Column), op, placeholder)
+	}
+
+	return condition, args, nil
+}
+
+// filterArg converts the value of the validated condition to an argument comparable with its column.
+func (bdk *BDKeeper) filterArg(c models.Condition) (interface{}, error) {
+	switch {
+	case c.Column == "deleted":
+		deleted, err := strconv.ParseBool(c.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s must be true or false", models.ErrInvalidQuery, c.Column)
+		}
+		return deleted, nil
+	case models.IsTimeColumn(c.Column):
+		t, err := time.Parse(time.RFC3339Nano, c.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s must be an RFC 3339 timestamp", models.ErrInvalidQuery, c.Column)
+		}
+		return bdk.dialect.timeArg(t.UTC()), nil
+	}
+
+	return c.Value, nil
+}
@@ -0,0 +1,365 @@
+package bdkeeper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// foldersTable holds the folders of the users. It is only read by the user of the token,
+// so like the devices it has no row-level security policy.
+const foldersTable = "folders"
+
+// CreateFolder creates the folder of its user and returns it with its 'updated_at'. It returns
+// models.ErrInvalidFolder if the parent isn't a folder of the user or the id is taken, and
+// models.ErrFolderExists if the parent has a folder with the name already.
+func (bdk *BDKeeper) CreateFolder(ctx context.Context, folder models.Folder) (_ models.Folder, err error) {
+	defer bdk.observe("create_folder", foldersTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return models.Folder{}, err
+	}
+	defer leave()
+	defer bdk.audit(ctx, models.AuditCreateFolder, "", folder.UserID, folder.ID, &err)
+	bdk.wrote(userWriter(folder.UserID))
+
+	if folder, err = folder.Validate(); err != nil {
+		return models.Folder{}, err
+	}
+
+	err = bdk.inTx(ctx, func(view *BDKeeper) error {
+		// The ids are unique across the users
+		var taken int
+		query := `SELECT 1 FROM folders WHERE id = $1`
+		err := view.ex.QueryRowContext(ctx, view.dialect.rebind(query), folder.ID).Scan(&taken)
+		if err == nil {
+			return fmt.Errorf("%w: the id is taken", models.ErrInvalidFolder)
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("failed to get folder: %w", err)
+		}
+		if err := view.checkFolder(ctx, folder); err != nil {
+			return err
+		}
+
+		query = fmt.Sprintf(`INSERT INTO folders (id, user_id, name, name_key, parent_id, updated_at, deleted)
+			VALUES ($1, $2, $3, $4, $5, %s, FALSE) RETURNING updated_at`, view.dialect.now())
+		err = view.ex.QueryRowContext(ctx, view.dialect.rebind(query), folder.ID, folder.UserID, folder.Name,
+			models.FolderNameKey(folder.Name), folder.ParentID).Scan(&folder.UpdatedAt)
+		if err != nil {
+			return fmt.Errorf("failed to create folder: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return models.Folder{}, err
+	}
+	folder.UpdatedAt = folder.UpdatedAt.UTC()
+	bdk.changed(ctx, folder.UserID, models.VaultEvent{UpdatedAt: folder.UpdatedAt})
+
+	return folder, nil
+}
+
+// UpdateFolder renames the folder of its user or moves it to another parent and returns it with its new
+// 'updated_at', or models.ErrNotFound. A move inside the folder itself fails with models.ErrInvalidFolder.
+func (bdk *BDKeeper) UpdateFolder(ctx context.Context, folder models.Folder) (_ models.Folder, err error) {
+	defer bdk.observe("update_folder", foldersTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return models.Folder{}, err
+	}
+	defer leave()
+	defer bdk.audit(ctx, models.AuditUpdateFolder, "", folder.UserID, folder.ID, &err)
+	bdk.wrote(userWriter(folder.UserID))
+
+	if folder, err = folder.Validate(); err != nil {
+		return models.Folder{}, err
+	}
+
+	err = bdk.inTx(ctx, func(view *BDKeeper) error {
+		if _, err := view.liveFolder(ctx, folder.UserID, folder.ID); err != nil {
+			return err
+		}
+		if err := view.checkFolder(ctx, folder); err != nil {
+			return err
+		}
+
+		query := fmt.Sprintf(`UPDATE folders SET name = $1, name_key = $2, parent_id = $3, updated_at = %s
+			WHERE user_id = $4 AND id = $5 RETURNING updated_at`, view.dialect.nextTime("updated_at"))
+		err := view.ex.QueryRowContext(ctx, view.dialect.rebind(query), folder.Name, models.FolderNameKey(folder.Name),
+			folder.ParentID, folder.UserID, folder.ID).Scan(&folder.UpdatedAt)
+		if err != nil {
+			return fmt.Errorf("failed to update folder: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return models.Folder{}, err
+	}
+	folder.UpdatedAt = folder.UpdatedAt.UTC()
+	bdk.changed(ctx, folder.UserID, models.VaultEvent{UpdatedAt: folder.UpdatedAt})
+
+	return folder, nil
+}
+
+// DeleteFolder deletes the folder of the user and returns its new 'updated_at', or models.ErrNotFound.
+// A folder holding entries or other folders fails with models.ErrFolderNotEmpty, unless moveChildren is set,
+// then they are moved to its parent, in the same transaction. The deleted entries in the folder don't keep it
+// from being deleted, they are moved with the others. Like a renamed tag, a moved entry gets a new 'updated_at'
+// for the other devices to pick it up, but no version is kept in the history.
+func (bdk *BDKeeper) DeleteFolder(ctx context.Context, userID int, folderID string, moveChildren bool) (_ time.Time, err error) {
+	defer bdk.observe("delete_folder", foldersTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer leave()
+	defer bdk.audit(ctx, models.AuditDeleteFolder, "", userID, folderID, &err)
+	bdk.wrote(userWriter(userID))
+
+	var updatedAt time.Time
+	err = bdk.inTx(ctx, func(view *BDKeeper) error {
+		parentID, err := view.liveFolder(ctx, userID, folderID)
+		if err != nil {
+			return err
+		}
+
+		var children, conflicts int
+		query := `SELECT COUNT(*), COUNT(p.id) FROM folders c
+			LEFT JOIN folders p ON p.user_id = c.user_id AND p.parent_id = $1 AND p.name_key = c.name_key
+				AND p.deleted = FALSE AND p.id <> $2
+			WHERE c.user_id = $3 AND c.parent_id = $2 AND c.deleted = FALSE`
+		err = view.ex.QueryRowContext(ctx, view.dialect.rebind(query), parentID, folderID, userID).Scan(&children, &conflicts)
+		if err != nil {
+			return fmt.Errorf("failed to get subfolders: %w", err)
+		}
+		entries := 0
+		for _, table := range models.DataTables {
+			n, err := view.countFolderEntries(ctx, table, userID, folderID)
+			if err != nil {
+				return err
+			}
+			entries += n
+		}
+		if children+entries > 0 && !moveChildren {
+			return models.ErrFolderNotEmpty
+		}
+		if conflicts > 0 {
+			return fmt.Errorf("%w: a subfolder is named like a folder of the parent", models.ErrFolderExists)
+		}
+
+		query = fmt.Sprintf(`UPDATE folders SET parent_id = $1, updated_at = %s WHERE user_id = $2 AND parent_id = $3 AND deleted = FALSE`,
+			view.dialect.nextTime("updated_at"))
+		if _, err := view.ex.ExecContext(ctx, view.dialect.rebind(query), parentID, userID, folderID); err != nil {
+			return fmt.Errorf("failed to move subfolders: %w", err)
+		}
+		for _, table := range models.DataTables {
+			if err := view.moveFolderEntries(ctx, table, userID, folderID, parentID); err != nil {
+				return err
+			}
+		}
+
+		query = fmt.Sprintf(`UPDATE folders SET deleted = TRUE, updated_at = %s WHERE user_id = $1 AND id = $2 RETURNING updated_at`,
+			view.dialect.nextTime("updated_at"))
+		if err := view.ex.QueryRowContext(ctx, view.dialect.rebind(query), userID, folderID).Scan(&updatedAt); err != nil {
+			return fmt.Errorf("failed to delete folder: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	updatedAt = updatedAt.UTC()
+	// The entries moved may be of any table
+	bdk.changed(ctx, userID, models.VaultEvent{UpdatedAt: updatedAt})
+
+	return updatedAt, nil
+}
+
+// countFolderEntries returns the number of the entries of the user in the folder which aren't deleted.
+func (bdk *BDKeeper) countFolderEntries(ctx context.Context, table string, userID int, folderID string) (int, error) {
+	schema, err := bdk.tableColumns(ctx, bdk.ex, table)
+	if err != nil {
+		return 0, err
+	}
+	tbl, err := bdk.tableIdent(ctx, bdk.ex, table)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE user_id = $1 AND %s = $2 AND %s",
+		tbl, schema.column(models.FolderField), bdk.notDeleted())
+	if err := bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), userID, folderID).Scan(&n); err != nil {
+		return 0, fmt.Errorf("failed to count entries of %s: %w", table, err)
+	}
+
+	return n, nil
+}
+
+// moveFolderEntries moves the entries of the user in the table from the folder to its parent, NULL at the top.
+func (bdk *BDKeeper) moveFolderEntries(ctx context.Context, table string, userID int, folderID, parentID string) error {
+	schema, err := bdk.tableColumns(ctx, bdk.ex, table)
+	if err != nil {
+		return err
+	}
+	tbl, err := bdk.tableIdent(ctx, bdk.ex, table)
+	if err != nil {
+		return err
+	}
+	column := schema.column(models.FolderField)
+
+	query := fmt.Sprintf("SELECT id FROM %s WHERE user_id = $1 AND %s = $2", tbl, column)
+	rows, err := bdk.ex.QueryContext(ctx, bdk.dialect.rebind(query), userID, folderID)
+	if err != nil {
+		return fmt.Errorf("failed to find entries of %s: %w", table, err)
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan entry of %s: %w", table, err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("rows encountered an error: %w", err)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var parent interface{}
+	if parentID != "" {
+		parent = parentID
+	}
+	query = fmt.Sprintf("UPDATE %s SET %s = $1, updated_at = %s WHERE user_id = $2 AND %s = $3",
+		tbl, column, bdk.dialect.nextTime("updated_at"), column)
+	if _, err := bdk.ex.ExecContext(ctx, bdk.dialect.rebind(query), parent, userID, folderID); err != nil {
+		return fmt.Errorf("failed to move entries of %s: %w", table, err)
+	}
+
+	// The checksums cover the folder, so the derived columns are written again
+	return bdk.writeDerived(ctx, bdk.ex, table, userID, ids)
+}
+
+// liveFolder returns the parent of the folder of the user which isn't deleted, or models.ErrNotFound.
+func (bdk *BDKeeper) liveFolder(ctx context.Context, userID int, folderID string) (string, error) {
+	var parentID string
+	query := `SELECT parent_id FROM folders WHERE user_id = $1 AND id = $2 AND deleted = FALSE`
+	err := bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), userID, folderID).Scan(&parentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", models.ErrNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get folder: %w", err)
+	}
+
+	return parentID, nil
+}
+
+// entryFolder checks that the folder of an entry written by a client is a folder of the user which isn't
+// deleted, in the transaction of the write. An entry outside the folders passes.
+func (bdk *BDKeeper) entryFolder(ctx context.Context, userID int, value string) error {
+	folderID, err := models.ParseFolderID(value)
+	if err != nil || folderID == "" {
+		return err
+	}
+	_, err = bdk.liveFolder(ctx, userID, folderID)
+	if errors.Is(err, models.ErrNotFound) {
+		return fmt.Errorf("%w: %s isn't a folder of the user", models.ErrInvalidChange, models.FolderField)
+	}
+
+	return err
+}
+
+// checkFolder checks that the parent of the folder is a folder of its user which isn't inside it, and that
+// the parent has no other folder with its name. The parents are read one at a time up to the top.
+func (bdk *BDKeeper) checkFolder(ctx context.Context, folder models.Folder) error {
+	parentID := folder.ParentID
+	for depth := 0; parentID != ""; depth++ {
+		if parentID == folder.ID {
+			return fmt.Errorf("%w: a folder can't be moved inside itself", models.ErrInvalidFolder)
+		}
+		if depth == models.MaxFolderDepth {
+			return fmt.Errorf("%w: folders can't be nested more than %d deep", models.ErrInvalidFolder, models.MaxFolderDepth)
+		}
+		var err error
+		parentID, err = bdk.liveFolder(ctx, folder.UserID, parentID)
+		if errors.Is(err, models.ErrNotFound) {
+			return fmt.Errorf("%w: the parent folder doesn't exist", models.ErrInvalidFolder)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	var found int
+	query := `SELECT 1 FROM folders WHERE user_id = $1 AND parent_id = $2 AND name_key = $3 AND id <> $4 AND deleted = FALSE`
+	err := bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), folder.UserID, folder.ParentID,
+		models.FolderNameKey(folder.Name), folder.ID).Scan(&found)
+	if err == nil {
+		return models.ErrFolderExists
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to get folder: %w", err)
+	}
+
+	return nil
+}
+
+// GetFolders returns the folders of the user changed since the given time, the deleted ones included,
+// or all the folders which aren't deleted if the time is zero, ordered by name.
+func (bdk *BDKeeper) GetFolders(ctx context.Context, userID int, since time.Time) (_ []models.Folder, err error) {
+	defer bdk.observe("get_folders", foldersTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	return scoped(ctx, bdk.reader(userWriter(userID)), func(view *BDKeeper) ([]models.Folder, error) {
+		return view.folders(ctx, userID, since)
+	})
+}
+
+// folders runs GetFolders on the keeper or view.
+func (bdk *BDKeeper) folders(ctx context.Context, userID int, since time.Time) ([]models.Folder, error) {
+	query := `SELECT id, name, parent_id, updated_at, deleted FROM folders WHERE user_id = $1 AND deleted = FALSE
+		ORDER BY name_key, id`
+	args := []interface{}{userID}
+	if !since.IsZero() {
+		query = `SELECT id, name, parent_id, updated_at, deleted FROM folders WHERE user_id = $1 AND updated_at > $2
+			ORDER BY name_key, id`
+		args = append(args, bdk.dialect.timeArg(since.UTC()))
+	}
+	rows, err := bdk.ex.QueryContext(ctx, bdk.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get folders: %w", err)
+	}
+	defer rows.Close()
+
+	folders := make([]models.Folder, 0)
+	for rows.Next() {
+		f := models.Folder{UserID: userID}
+		if err := rows.Scan(&f.ID, &f.Name, &f.ParentID, &f.UpdatedAt, &f.Deleted); err != nil {
+			return nil, fmt.Errorf("failed to scan folder: %w", err)
+		}
+		f.UpdatedAt = f.UpdatedAt.UTC()
+		folders = append(folders, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows encountered an error: %w", err)
+	}
+
+	return folders, nil
+}
@@ -0,0 +1,125 @@
+package bdkeeper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// DefaultHistoryLimit is the default number of prior versions retained per entry.
+const DefaultHistoryLimit = 10
+
+// SetHistoryLimit sets the number of prior versions retained per entry, 0 disables the history.
+// Older versions are pruned on the next write of the entry.
+func (bdk *BDKeeper) SetHistoryLimit(limit int) {
+	bdk.historyLimit = limit
+}
+
+// GetDataHistory returns up to limit prior versions of an entry of the user, newest first.
+// A limit of 0 or less returns all retained versions.
+func (bdk *BDKeeper) GetDataHistory(ctx context.Context, table string, userID int, entryID string, limit int) (_ []models.EntryVersion, err error) {
+	defer bdk.observe("get_data_history", table, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	return scoped(ctx, bdk, func(view *BDKeeper) ([]models.EntryVersion, error) {
+		return view.getDataHistory(ctx, table, userID, entryID, limit)
+	})
+}
+
+// getDataHistory runs GetDataHistory on the keeper or view.
+func (bdk *BDKeeper) getDataHistory(ctx context.Context, table string, userID int, entryID string, limit int) ([]models.EntryVersion, error) {
+	query := `SELECT snapshot, changed_at FROM EntryHistory WHERE table_name = $1 AND user_id = $2 AND entry_id = $3 ORDER BY id DESC`
+	args := []interface{}{table, userID, entryID}
+	if limit > 0 {
+		query += " LIMIT $4"
+		args = append(args, limit)
+	}
+
+	rows, err := bdk.ex.QueryContext(ctx, bdk.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get history: %w", err)
+	}
+	defer rows.Close()
+
+	versions := make([]models.EntryVersion, 0)
+	for rows.Next() {
+		var (
+			snapshot  string
+			changedAt time.Time
+		)
+		if err := rows.Scan(&snapshot, &changedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan version: %w", err)
+		}
+
+		v := models.EntryVersion{ChangedAt: changedAt}
+		if err := json.Unmarshal([]byte(snapshot), &v.Snapshot); err != nil {
+			return nil, fmt.Errorf("failed to decode snapshot: %w", err)
+		}
+		// The snapshots keep the stored values, encrypted ones included
+		if err := bdk.openRows(table, []map[string]string{v.Snapshot}); err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows encountered an error: %w", err)
+	}
+
+	return versions, nil
+}
+
+// saveVersion stores the current state of an entry in the history before it is changed
+// and prunes the versions above the limit. A missing entry has no state and is ignored.
+func (bdk *BDKeeper) saveVersion(ctx context.Context, ex execer, table string, userID int, entryID string) error {
+	if bdk.historyLimit <= 0 {
+		return nil
+	}
+
+	schema, err := bdk.tableColumns(ctx, ex, table)
+	if err != nil {
+		return err
+	}
+	tbl, err := bdk.tableIdent(ctx, ex, table)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE user_id = $1 AND id = $2", schema.selectList(schema.names), tbl)
+	rows, err := ex.QueryContext(ctx, bdk.dialect.rebind(query), userID, entryID)
+	if err != nil {
+		return fmt.Errorf("failed to get entry: %w", err)
+	}
+	data, err := scanRows(rows, schema.names)
+	rows.Close()
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	snapshot, err := json.Marshal(data[0])
+	if err != nil {
+		return err
+	}
+
+	insert := fmt.Sprintf("INSERT INTO EntryHistory (table_name, entry_id, user_id, snapshot, changed_at) VALUES ($1, $2, $3, $4, %s)", bdk.dialect.now())
+	if _, err := ex.ExecContext(ctx, bdk.dialect.rebind(insert), table, entryID, userID, string(snapshot)); err != nil {
+		return fmt.Errorf("failed to save version: %w", err)
+	}
+
+	prune := `DELETE FROM EntryHistory WHERE table_name = $1 AND user_id = $2 AND entry_id = $3 AND id NOT IN
+		(SELECT id FROM EntryHistory WHERE table_name = $1 AND user_id = $2 AND entry_id = $3 ORDER BY id DESC LIMIT $4)`
+	if _, err := ex.ExecContext(ctx, bdk.dialect.rebind(prune), table, userID, entryID, bdk.historyLimit); err != nil {
+		return fmt.Errorf("failed to prune history: %w", err)
+	}
+
+	return nil
+}
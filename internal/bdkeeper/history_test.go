@@ -0,0 +1,43 @@
+package bdkeeper
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBDKeeper_HistoryPruning(t *testing.T) {
+	bdk := newSQLiteBDKeeper(t)
+	bdk.SetHistoryLimit(3)
+	ctx := context.Background()
+	userID := addTestUser(t, bdk)
+
+	_, _, err := bdk.AddData(ctx, "UserCredentials", userID, "entry", map[string]string{"login": "v0", "password": "p"})
+	require.NoError(t, err)
+
+	for i := 1; i <= 5; i++ {
+		_, err = bdk.UpdateData(ctx, "UserCredentials", userID, "entry", map[string]string{"login": "v" + strconv.Itoa(i)})
+		require.NoError(t, err)
+	}
+
+	// Only the newest versions within the limit are retained
+	versions, err := bdk.GetDataHistory(ctx, "UserCredentials", userID, "entry", 0)
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+	assert.Equal(t, "v4", versions[0].Snapshot["login"])
+	assert.Equal(t, "v3", versions[1].Snapshot["login"])
+	assert.Equal(t, "v2", versions[2].Snapshot["login"])
+
+	// A disabled history keeps what is retained but saves nothing new
+	bdk.SetHistoryLimit(0)
+	_, err = bdk.UpdateData(ctx, "UserCredentials", userID, "entry", map[string]string{"login": "v6"})
+	require.NoError(t, err)
+
+	versions, err = bdk.GetDataHistory(ctx, "UserCredentials", userID, "entry", 0)
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+	assert.Equal(t, "v4", versions[0].Snapshot["login"])
+}
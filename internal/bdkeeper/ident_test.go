@@ -0,0 +1,217 @@
+package bdkeeper
+
+import (
+	"context"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/fs"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// tableKeyword matches the end of SQL text followed by the name of a table.
+var tableKeyword = regexp.MustCompile(`(?i)\b(FROM|INTO|UPDATE|JOIN|TABLE)\s*$`)
+
+// formatVerb matches a verb of a format string, with its explicit argument index if any.
+var formatVerb = regexp.MustCompile(`%(?:\[(\d+)\])?[-+# 0]*\d*(?:\.\d+)?([a-zA-Z%])`)
+
+// emptyImporter stands for the imported packages, the check only needs the types of the package itself.
+type emptyImporter struct{}
+
+func (emptyImporter) Import(path string) (*types.Package, error) {
+	pkg := types.NewPackage(path, path[strings.LastIndex(path, "/")+1:])
+	pkg.MarkComplete()
+
+	return pkg, nil
+}
+
+// rawTableNames returns the places of the files putting a table name into SQL text
+// with fmt.Sprintf or a concatenation without it being an identifier.
+func rawTableNames(t *testing.T, fset *token.FileSet, files []*ast.File) []string {
+	info := &types.Info{Types: make(map[ast.Expr]types.TypeAndValue)}
+	conf := types.Config{Importer: emptyImporter{}, Error: func(error) {}}
+	pkg, _ := conf.Check("bdkeeper", fset, files, info)
+	obj := pkg.Scope().Lookup("identifier")
+	require.NotNil(t, obj, "the identifier type is missing")
+	ident := obj.Type()
+
+	var problems []string
+	check := func(expr ast.Expr) {
+		if tv, ok := info.Types[expr]; !ok || !types.Identical(tv.Type, ident) {
+			problems = append(problems, fset.Position(expr.Pos()).String())
+		}
+	}
+
+	for _, file := range files {
+		ast.Inspect(file, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.CallExpr:
+				format, ok := sprintfFormat(n)
+				if !ok {
+					return true
+				}
+				next := 0
+				for _, m := range formatVerb.FindAllStringSubmatchIndex(format, -1) {
+					if format[m[4]:m[5]] == "%" {
+						continue
+					}
+					if m[2] >= 0 {
+						next, _ = strconv.Atoi(format[m[2]:m[3]])
+						next--
+					}
+					if format[m[4]:m[5]] == "s" && tableKeyword.MatchString(format[:m[0]]) && next+1 < len(n.Args) {
+						check(n.Args[next+1])
+					}
+					next++
+				}
+			case *ast.BinaryExpr:
+				if n.Op == token.ADD && tableKeyword.MatchString(trailingText(n.X)) {
+					check(n.Y)
+				}
+			}
+			return true
+		})
+	}
+
+	return problems
+}
+
+// sprintfFormat returns the format of a fmt.Sprintf call with a literal format.
+func sprintfFormat(call *ast.CallExpr) (string, bool) {
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "Sprintf" || len(call.Args) == 0 {
+		return "", false
+	}
+	if pkg, ok := sel.X.(*ast.Ident); !ok || pkg.Name != "fmt" {
+		return "", false
+	}
+
+	return trailingText(call.Args[0]), true
+}
+
+// trailingText returns the string literal ending the expression, if any.
+func trailingText(expr ast.Expr) string {
+	switch e := expr.(type) {
+	case *ast.BasicLit:
+		if e.Kind == token.STRING {
+			text, _ := strconv.Unquote(e.Value)
+			return text
+		}
+	case *ast.BinaryExpr:
+		return trailingText(e.Y)
+	case *ast.ParenExpr:
+		return trailingText(e.X)
+	}
+
+	return ""
+}
+
+func TestNoRawTableNames(t *testing.T) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", func(fi fs.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	require.NoError(t, err)
+
+	var files []*ast.File
+	for _, file := range pkgs["bdkeeper"].Files {
+		files = append(files, file)
+	}
+	assert.Empty(t, rawTableNames(t, fset, files), "table names must be quoted with tableIdent or quoteIdent")
+
+	// The check itself finds the raw names
+	bad := `package bdkeeper
+
+import "fmt"
+
+type identifier string
+
+func queries(table string, tbl identifier) []string {
+	return []string{
+		fmt.Sprintf("SELECT id FROM %s WHERE id = $1", table),
+		"DELETE FROM " + table,
+		fmt.Sprintf("UPDATE %[2]s SET note = %[1]s", table, tbl),
+		fmt.Sprintf("SELECT %s FROM %s", table, tbl),
+		"DELETE FROM " + string(tbl),
+	}
+}
+`
+	file, err := parser.ParseFile(fset, "bad.go", bad, 0)
+	require.NoError(t, err)
+	problems := rawTableNames(t, fset, []*ast.File{file})
+	assert.Equal(t, []string{"bad.go:9:50", "bad.go:10:20", "bad.go:13:20"}, problems)
+}
+
+func TestQuoteIdent(t *testing.T) {
+	tests := []struct {
+		parts []string
+		want  identifier
+	}{
+		{[]string{"UserCredentials"}, `"UserCredentials"`},
+		{[]string{`a"b`}, `"a""b"`},
+		{[]string{`"`}, `""""`},
+		{[]string{`x"; DROP TABLE Users; --`}, `"x""; DROP TABLE Users; --"`},
+		{[]string{"заметки;ü"}, `"заметки;ü"`},
+		{[]string{"public", "UserCredentials"}, `"public"."UserCredentials"`},
+		{[]string{"my.schema", `t"1`}, `"my.schema"."t""1"`},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, quoteIdent(tt.parts...))
+	}
+}
+
+func TestBDKeeper_TableIdent(t *testing.T) {
+	bdk := newSQLiteBDKeeper(t)
+	ctx := context.Background()
+	userID := addTestUser(t, bdk)
+
+	tbl, err := bdk.tableIdent(ctx, bdk.ex, "UserCredentials")
+	require.NoError(t, err)
+	assert.Equal(t, identifier(`"usercredentials"`), tbl)
+
+	// A name which isn't a table never reaches a query
+	for _, table := range []string{
+		"",
+		"Missing",
+		`UserCredentials"; DROP TABLE Users; --`,
+		"UserCredentials; DELETE FROM Users",
+		"UserCredentials --",
+		"ＵserCredentials",
+	} {
+		_, err := bdk.tableIdent(ctx, bdk.ex, table)
+		assert.ErrorIs(t, err, models.ErrInvalidQuery, table)
+		_, err = bdk.GetAllData(ctx, table, userID, models.DataQuery{})
+		assert.ErrorIs(t, err, models.ErrInvalidQuery, table)
+	}
+
+	// Nor does a table of the database which doesn't hold entries
+	for _, table := range []string{"Users", foldersTable, sharedEntriesTable, uploadSessionsTable, historyTable} {
+		_, err := bdk.tableIdent(ctx, bdk.ex, table)
+		assert.ErrorIs(t, err, models.ErrInvalidQuery, table)
+		_, _, err = bdk.AddData(ctx, table, userID, "entry", map[string]string{"name": "value"})
+		assert.ErrorIs(t, err, models.ErrInvalidQuery, table)
+	}
+
+	// A column with quotes, semicolons and non-ASCII letters in its name works as any other
+	column := `va"l; --ü`
+	_, err = bdk.conn.ExecContext(ctx, `ALTER TABLE TextData ADD COLUMN "va""l; --ü" TEXT`)
+	require.NoError(t, err)
+	bdk.columns.Remove("TextData")
+
+	_, _, err = bdk.AddData(ctx, "TextData", userID, "entry", map[string]string{"data": "text", column: "value"})
+	require.NoError(t, err)
+	data, err := bdk.GetData(ctx, "TextData", userID, "entry", false)
+	require.NoError(t, err)
+	assert.Equal(t, "value", data[column])
+
+	// The users are still there
+	addTestUser(t, bdk)
+}
@@ -0,0 +1,118 @@
+package bdkeeper
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// seedSyncRows adds entries of several users, so that reading one user's entries by a scan
+// of the table is clearly worse than an index lookup.
+func seedSyncRows(t *testing.T, bdk *BDKeeper) int {
+	ctx := context.Background()
+	prefix := fmt.Sprintf("plan-%d", time.Now().UnixNano())
+
+	var userID int
+	for u := 0; u < 5; u++ {
+		userID = addTestUser(t, bdk)
+		_, err := bdk.BulkInsert(ctx, "UserCredentials", userID, credentialRows(fmt.Sprintf("%s-%d", prefix, u), 200))
+		require.NoError(t, err)
+	}
+
+	return userID
+}
+
+// syncQuery returns the query GetAllData runs for a synchronization since lastSync.
+func syncQuery(t *testing.T, bdk *BDKeeper, userID int, lastSync time.Time) (string, []interface{}) {
+	query, args, _, err := bdk.allDataQuery(context.Background(), "UserCredentials", userID, models.DataQuery{LastSync: lastSync})
+	require.NoError(t, err)
+
+	return query, args
+}
+
+// queryPlan returns the lines of the plan of the query.
+func queryPlan(t *testing.T, conn *sql.Conn, explain string, args ...interface{}) string {
+	rows, err := conn.QueryContext(context.Background(), explain, args...)
+	require.NoError(t, err)
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	require.NoError(t, err)
+
+	var plan []string
+	for rows.Next() {
+		values := make([]interface{}, len(cols))
+		for i := range values {
+			values[i] = new(sql.NullString)
+		}
+		require.NoError(t, rows.Scan(values...))
+		// The detail is the last column of both the SQLite and the PostgreSQL plans
+		plan = append(plan, values[len(values)-1].(*sql.NullString).String)
+	}
+	require.NoError(t, rows.Err())
+
+	return strings.Join(plan, "\n")
+}
+
+func TestBDKeeper_SyncQueryPlanSQLite(t *testing.T) {
+	bdk := newSQLiteBDKeeper(t)
+	userID := seedSyncRows(t, bdk)
+	ctx := context.Background()
+
+	conn, err := bdk.conn.Conn(ctx)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "ANALYZE")
+	require.NoError(t, err)
+
+	query, args := syncQuery(t, bdk, userID, time.Now().Add(-time.Minute))
+	plan := queryPlan(t, conn, "EXPLAIN QUERY PLAN "+query, args...)
+
+	assert.Contains(t, plan, "user_credentials_user_updated_idx", plan)
+	assert.NotContains(t, plan, "SCAN UserCredentials", plan)
+}
+
+func TestBDKeeper_SyncQueryPlanPostgres(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URI")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URI is not set")
+	}
+
+	nLogger, err := logger.NewLogger("info")
+	require.NoError(t, err)
+	bdk, err := NewBDKeeper(func() string { return dsn }, nLogger, nil)
+	require.NoError(t, err)
+	defer bdk.Close()
+
+	userID := seedSyncRows(t, bdk)
+	ctx := context.Background()
+
+	conn, err := bdk.conn.Conn(ctx)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "ANALYZE UserCredentials")
+	require.NoError(t, err)
+
+	// The test table is small compared to a production vault, so a sequential scan
+	// is only ruled out to see which index the query can use
+	_, err = conn.ExecContext(ctx, "SET enable_seqscan = off")
+	require.NoError(t, err)
+	defer conn.ExecContext(ctx, "RESET enable_seqscan")
+
+	query, args := syncQuery(t, bdk, userID, time.Now().Add(-time.Minute))
+	plan := queryPlan(t, conn, "EXPLAIN "+query, args...)
+
+	assert.Contains(t, plan, "user_credentials_user_updated_idx", plan)
+	assert.NotContains(t, plan, "Seq Scan", plan)
+}
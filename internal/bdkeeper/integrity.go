@@ -0,0 +1,246 @@
+package bdkeeper
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"go.uber.org/zap"
+)
+
+// checksumColumn holds the checksum of the payload of an entry, see payloadChecksum.
+// The entries stored before it was added have none until their next change.
+const checksumColumn = "checksum"
+
+// payloadSizeColumn holds the size of an entry as a synchronization sends it, see models.EntrySize,
+// so the pending changes of a user are estimated without reading them.
+const payloadSizeColumn = "payload_size"
+
+// derivedColumns are the columns computed by the server from the payload of an entry
+// on every change, the clients never write them.
+var derivedColumns = map[string]bool{checksumColumn: true, payloadSizeColumn: true, searchTextColumn: true}
+
+// unchecksummed are the columns left out of the checksum, the bookkeeping changed
+// by deletion, expiry and synchronization without touching the payload.
+var unchecksummed = map[string]bool{"updated_at": true, "deleted": true}
+
+// verifyBatchSize is the number of entries read at once by VerifyIntegrity.
+const verifyBatchSize = 500
+
+// EnableReadVerification makes GetData and GetAllData compare the entries read with all their
+// columns with their checksums. An entry which doesn't match is still returned, with
+// models.WarningChecksumMismatch in its models.DataWarning field, and logged.
+func (bdk *BDKeeper) EnableReadVerification() {
+	bdk.verifyReads = true
+}
+
+// payloadChecksum returns the hex SHA-256 of the canonical serialization of the entry:
+// the decrypted values of its columns but the unchecksummed ones, sorted by name, with the
+// name and the value each prefixed by its length. Empty values are left out, so an empty
+// and a NULL field hash alike, as do the entries stored before a column was added.
+func payloadChecksum(row map[string]string, cols []string) string {
+	names := make([]string, 0, len(cols))
+	for _, col := range cols {
+		if !unchecksummed[col] && row[col] != "" {
+			names = append(names, col)
+		}
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%d:%s%d:%s", len(name), name, len(row[name]), row[name])
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeDerived stores the checksums, the payload sizes and the search texts of the entries of the user.
+// The entries are read back the way the reads return them, so the verification compares like with like.
+func (bdk *BDKeeper) writeDerived(ctx context.Context, ex execer, table string, userID int, ids []string) error {
+	schema, err := bdk.tableColumns(ctx, ex, table)
+	if err != nil || !schema.derived() {
+		return err
+	}
+	tbl, err := bdk.tableIdent(ctx, ex, table)
+	if err != nil {
+		return err
+	}
+
+	var sets []string
+	if schema.checksum {
+		sets = append(sets, schema.column(checksumColumn)+" = $"+strconv.Itoa(len(sets)+1))
+	}
+	if schema.size {
+		sets = append(sets, schema.column(payloadSizeColumn)+" = $"+strconv.Itoa(len(sets)+1))
+	}
+	if schema.search {
+		sets = append(sets, schema.column(searchTextColumn)+" = $"+strconv.Itoa(len(sets)+1))
+	}
+	update := bdk.dialect.rebind(fmt.Sprintf("UPDATE %s SET %s WHERE user_id = $%d AND id = $%d",
+		tbl, strings.Join(sets, ", "), len(sets)+1, len(sets)+2))
+	for start := 0; start < len(ids); start += bulkLookupSize {
+		end := min(start+bulkLookupSize, len(ids))
+
+		args := []interface{}{userID}
+		placeholders := make([]string, 0, end-start)
+		for _, id := range ids[start:end] {
+			args = append(args, id)
+			placeholders = append(placeholders, "$"+strconv.Itoa(len(args)))
+		}
+
+		query := fmt.Sprintf("SELECT %s FROM %s WHERE user_id = $1 AND id IN (%s)",
+			schema.selectList(schema.names), tbl, strings.Join(placeholders, ","))
+		rows, err := ex.QueryContext(ctx, bdk.dialect.rebind(query), args...)
+		if err != nil {
+			return fmt.Errorf("failed to read entries back: %w", err)
+		}
+		data, err := scanRows(rows, schema.names)
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		if err := bdk.openRows(table, data); err != nil {
+			return err
+		}
+
+		for _, row := range data {
+			var args []interface{}
+			if schema.checksum {
+				args = append(args, payloadChecksum(row, schema.names))
+			}
+			if schema.size {
+				args = append(args, models.EntrySize(row))
+			}
+			if schema.search {
+				args = append(args, bdk.searchTextArg(table, row))
+			}
+			_, err := ex.ExecContext(ctx, update, append(args, userID, row["id"])...)
+			if bdk.dialect.isIndexLimit(err) {
+				return fmt.Errorf("%w: entry %s: %s is too long to index", models.ErrInvalidChange, row["id"], models.SearchColumn)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to write derived columns: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// VerifyIntegrity recomputes the checksums of the entries of the user in the data table,
+// or of the entries of all users if userID is 0, and returns the ids of the entries not matching
+// their stored checksums, including those which can't be decrypted. The entries without
+// a checksum, unchanged since before the checksums were added, are skipped.
+func (bdk *BDKeeper) VerifyIntegrity(ctx context.Context, table string, userID int) (_ []string, err error) {
+	defer bdk.observe("verify_integrity", table, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	if !models.IsDataTable(table) {
+		return nil, fmt.Errorf("%w: table %q has no checksums", models.ErrInvalidQuery, table)
+	}
+	if userID == 0 && bdk.rls {
+		ctx = withBypass(ctx)
+	}
+
+	return scoped(ctx, bdk, func(view *BDKeeper) ([]string, error) {
+		return view.verifyIntegrity(ctx, table, userID)
+	})
+}
+
+// verifyIntegrity runs VerifyIntegrity on the keeper or view, reading the entries in batches
+// in the order of their ids.
+func (bdk *BDKeeper) verifyIntegrity(ctx context.Context, table string, userID int) ([]string, error) {
+	schema, err := bdk.tableColumns(ctx, bdk.ex, table)
+	if err != nil {
+		return nil, err
+	}
+	if !schema.checksum {
+		return nil, fmt.Errorf("table %s has no checksum column", table)
+	}
+	tbl, err := bdk.tableIdent(ctx, bdk.ex, table)
+	if err != nil {
+		return nil, err
+	}
+
+	cols := append(schema.names[:len(schema.names):len(schema.names)], checksumColumn)
+	condition := schema.column(checksumColumn) + " IS NOT NULL AND id > $1"
+	if userID != 0 {
+		condition += " AND user_id = $2"
+	}
+	query := bdk.dialect.rebind(fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY id LIMIT %d",
+		schema.selectList(cols), tbl, condition, verifyBatchSize))
+
+	mismatches := make([]string, 0)
+	var last string
+	for {
+		args := []interface{}{last}
+		if userID != 0 {
+			args = append(args, userID)
+		}
+
+		rows, err := bdk.ex.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read entries: %w", err)
+		}
+		data, err := scanRows(rows, cols)
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, row := range data {
+			// A value which can't be decrypted was corrupted as well
+			if err := bdk.openRows(table, []map[string]string{row}); err != nil || row[checksumColumn] != payloadChecksum(row, schema.names) {
+				mismatches = append(mismatches, row["id"])
+			}
+		}
+		if len(data) < verifyBatchSize {
+			return mismatches, nil
+		}
+		last = data[len(data)-1]["id"]
+	}
+}
+
+// withChecksum returns the columns to read with the checksum column added,
+// if the reads are verified and the columns are the whole payload of the entries.
+func (bdk *BDKeeper) withChecksum(schema *tableSchema, cols []string) []string {
+	if !bdk.verifyReads || !schema.checksum || len(cols) != len(schema.names) {
+		return cols
+	}
+
+	return append(cols[:len(cols):len(cols)], checksumColumn)
+}
+
+// checkReads compares the decrypted entries read with the columns of withChecksum with their
+// checksums, marks those which don't match with a warning and removes the checksums.
+func (bdk *BDKeeper) checkReads(ctx context.Context, table string, userID int, cols []string, rows []map[string]string) {
+	if len(cols) == 0 || cols[len(cols)-1] != checksumColumn {
+		return
+	}
+
+	var mismatches []string
+	for _, row := range rows {
+		stored := row[checksumColumn]
+		delete(row, checksumColumn)
+		if stored != "" && stored != payloadChecksum(row, cols[:len(cols)-1]) {
+			row[models.DataWarning] = models.WarningChecksumMismatch
+			mismatches = append(mismatches, row["id"])
+		}
+	}
+	if len(mismatches) > 0 {
+		bdk.log.Warn("entries not matching their checksums returned", logger.ContextFields(ctx,
+			zap.String("table", table), zap.Int("user_id", userID), zap.Strings("entries", mismatches))...)
+	}
+}
@@ -0,0 +1,184 @@
+package bdkeeper
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+func TestPayloadChecksum(t *testing.T) {
+	cols := []string{"id", "user_id", "login", "meta_info", "updated_at", "deleted"}
+	row := map[string]string{"id": "e", "user_id": "1", "login": "alice", "meta_info": "", "updated_at": "t1", "deleted": "false"}
+
+	// The bookkeeping columns and the empty values don't count, the order of the columns doesn't either
+	same := map[string]string{"login": "alice", "user_id": "1", "id": "e", "updated_at": "t2", "deleted": "true"}
+	assert.Equal(t, payloadChecksum(row, cols), payloadChecksum(same, []string{"updated_at", "login", "id", "user_id", "deleted", "meta_info"}))
+
+	// The lengths keep the values from running into each other
+	assert.NotEqual(t, payloadChecksum(map[string]string{"a": "bc"}, []string{"a", "ab"}),
+		payloadChecksum(map[string]string{"ab": "c"}, []string{"a", "ab"}))
+	assert.NotEqual(t, payloadChecksum(row, cols), payloadChecksum(map[string]string{"id": "e", "user_id": "2", "login": "alice"}, cols))
+}
+
+func TestBDKeeper_VerifyIntegrity(t *testing.T) {
+	bdk := newSQLiteBDKeeper(t)
+	ctx := context.Background()
+	userID := addTestUser(t, bdk)
+	otherID := addTestUser(t, bdk)
+	table := "UserCredentials"
+	require.NoError(t, bdk.EnableEncryption("k1", testEncryptionKey))
+
+	_, _, err := bdk.AddData(ctx, table, userID, "added", map[string]string{"login": "alice", "password": "secret", "checksum": "forged"})
+	require.NoError(t, err)
+	_, err = bdk.BulkInsert(ctx, table, userID, credentialRows("bulk", 3))
+	require.NoError(t, err)
+	_, err = bdk.ApplyChanges(ctx, userID, []models.Change{
+		{Table: table, Op: models.ChangeAdd, EntryID: "synced", Fields: map[string]string{"login": "bob", "password": "pw"}},
+		{Table: table, Op: models.ChangeUpdate, EntryID: "bulk-0", Fields: map[string]string{"login": "carol"}, UpdatedAt: time.Now().Add(time.Hour)},
+	})
+	require.NoError(t, err)
+	_, err = bdk.UpdateData(ctx, table, userID, "added", map[string]string{"meta_info": "mail"})
+	require.NoError(t, err)
+	_, _, err = bdk.AddData(ctx, table, otherID, "other", map[string]string{"login": "dave", "password": "pw"})
+	require.NoError(t, err)
+
+	// Every write stores the checksum, the one sent by the client is ignored
+	assert.Len(t, storedValue(t, bdk, table, checksumColumn, "added"), 64)
+	assert.Len(t, storedValue(t, bdk, table, checksumColumn, "bulk-2"), 64)
+	data, err := bdk.GetData(ctx, table, userID, "added", false)
+	require.NoError(t, err)
+	assert.NotContains(t, data, checksumColumn)
+
+	// Deletion, expiry and key rotation don't change the payload
+	_, err = bdk.DeleteData(ctx, table, userID, "bulk-1")
+	require.NoError(t, err)
+	_, err = bdk.UpdateData(ctx, table, userID, "bulk-2", map[string]string{models.ExpiresAtField: time.Now().Add(-time.Minute).Format(time.RFC3339)})
+	require.NoError(t, err)
+	_, err = bdk.ExpireData(ctx)
+	require.NoError(t, err)
+	require.NoError(t, bdk.EnableEncryption("k2", bytes.Repeat([]byte{9}, EncryptionKeySize)))
+	require.NoError(t, bdk.AddDecryptionKey("k1", testEncryptionKey))
+	require.NoError(t, bdk.RotateKeys(ctx, 2, nil))
+
+	// A NULL restored as an empty value still matches
+	_, err = bdk.conn.ExecContext(ctx, "UPDATE UserCredentials SET meta_info = '' WHERE id = 'synced'")
+	require.NoError(t, err)
+
+	mismatches, err := bdk.VerifyIntegrity(ctx, table, userID)
+	require.NoError(t, err)
+	assert.Empty(t, mismatches)
+
+	// A changed value, a tampered ciphertext and an entry moved to another user are found
+	_, err = bdk.conn.ExecContext(ctx, "UPDATE UserCredentials SET login = 'mallory' WHERE id = 'bulk-0'")
+	require.NoError(t, err)
+	_, err = bdk.conn.ExecContext(ctx, "UPDATE UserCredentials SET password = meta_info WHERE id = 'added'")
+	require.NoError(t, err)
+	_, err = bdk.conn.ExecContext(ctx, "UPDATE UserCredentials SET user_id = ? WHERE id = 'other'", userID)
+	require.NoError(t, err)
+
+	// An entry without a checksum, stored before they were added, is skipped
+	_, err = bdk.conn.ExecContext(ctx, "UPDATE UserCredentials SET checksum = NULL, login = 'x' WHERE id = 'synced'")
+	require.NoError(t, err)
+
+	mismatches, err = bdk.VerifyIntegrity(ctx, table, userID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"added", "bulk-0", "other"}, mismatches)
+	mismatches, err = bdk.VerifyIntegrity(ctx, table, otherID)
+	require.NoError(t, err)
+	assert.Empty(t, mismatches)
+	mismatches, err = bdk.VerifyIntegrity(ctx, table, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"added", "bulk-0", "other"}, mismatches)
+
+	_, err = bdk.VerifyIntegrity(ctx, "Users", userID)
+	assert.ErrorIs(t, err, models.ErrInvalidQuery)
+}
+
+func TestBDKeeper_ReadVerification(t *testing.T) {
+	bdk := newSQLiteBDKeeper(t)
+	ctx := context.Background()
+	userID := addTestUser(t, bdk)
+	table := "UserCredentials"
+
+	_, err := bdk.BulkInsert(ctx, table, userID, credentialRows("entry", 2))
+	require.NoError(t, err)
+	_, err = bdk.conn.ExecContext(ctx, "UPDATE UserCredentials SET login = 'mallory' WHERE id = 'entry-1'")
+	require.NoError(t, err)
+
+	// Without the verification the entry is returned as stored
+	data, err := bdk.GetData(ctx, table, userID, "entry-1", false)
+	require.NoError(t, err)
+	assert.NotContains(t, data, models.DataWarning)
+
+	bdk.EnableReadVerification()
+	data, err = bdk.GetData(ctx, table, userID, "entry-1", false)
+	require.NoError(t, err)
+	assert.Equal(t, models.WarningChecksumMismatch, data[models.DataWarning])
+	assert.Equal(t, "mallory", data["login"])
+	assert.NotContains(t, data, checksumColumn)
+	data, err = bdk.GetData(ctx, table, userID, "entry-0", false)
+	require.NoError(t, err)
+	assert.NotContains(t, data, models.DataWarning)
+
+	warnings := func(q models.DataQuery) map[string]string {
+		all, err := bdk.GetAllData(ctx, table, userID, q)
+		require.NoError(t, err)
+		require.Len(t, all, 2)
+		found := make(map[string]string)
+		for _, row := range all {
+			assert.NotContains(t, row, checksumColumn)
+			found[row["id"]] = row[models.DataWarning]
+		}
+		return found
+	}
+	assert.Equal(t, map[string]string{"entry-0": "", "entry-1": models.WarningChecksumMismatch}, warnings(models.DataQuery{}))
+
+	// A projection lacks the payload to verify
+	assert.Equal(t, map[string]string{"entry-0": "", "entry-1": ""}, warnings(models.DataQuery{Columns: models.ListColumns}))
+}
+
+func TestBDKeeper_UnchangedUpdate(t *testing.T) {
+	bdk := newSQLiteBDKeeper(t)
+	ctx := context.Background()
+	userID := addTestUser(t, bdk)
+	table := "UserCredentials"
+	require.NoError(t, bdk.EnableEncryption("k1", testEncryptionKey))
+
+	fields := map[string]string{"login": "alice", "password": "secret", "meta_info": "Work mail"}
+	for _, id := range []string{"sealed", "legacy", "tampered"} {
+		_, _, err := bdk.AddData(ctx, table, userID, id, fields)
+		require.NoError(t, err)
+	}
+	_, err := bdk.conn.ExecContext(ctx, "UPDATE UserCredentials SET checksum = NULL WHERE id = 'legacy'")
+	require.NoError(t, err)
+	_, err = bdk.conn.ExecContext(ctx, "UPDATE UserCredentials SET login = 'mallory' WHERE id = 'tampered'")
+	require.NoError(t, err)
+
+	status := func(id string, fields map[string]string) models.ChangeStatus {
+		results, err := bdk.ApplyChanges(ctx, userID, []models.Change{
+			{Table: table, Op: models.ChangeUpdate, EntryID: id, Fields: fields, UpdatedAt: time.Now()},
+		})
+		require.NoError(t, err)
+		return results[0].Status
+	}
+
+	// The encrypted fields are compared decrypted, the entries without a checksum by their fields
+	sealed := storedValue(t, bdk, table, "password", "sealed")
+	assert.Equal(t, models.ChangeUnchanged, status("sealed", fields))
+	assert.Equal(t, sealed, storedValue(t, bdk, table, "password", "sealed"))
+	assert.Equal(t, models.ChangeUnchanged, status("legacy", fields))
+
+	// An entry changed behind the server doesn't match its checksum, the update writes it again
+	assert.Equal(t, models.ChangeApplied, status("tampered", map[string]string{"login": "mallory"}))
+
+	// A column the table doesn't have fails the update as before
+	_, err = bdk.ApplyChanges(ctx, userID, []models.Change{
+		{Table: table, Op: models.ChangeUpdate, EntryID: "sealed", Fields: map[string]string{"nickname": ""}, UpdatedAt: time.Now()},
+	})
+	assert.Error(t, err)
+}
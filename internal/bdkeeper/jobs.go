@@ -0,0 +1,69 @@
+package bdkeeper
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// jobSelection is a set of rows a background job changes: the table and the condition
+// selecting the rows. The job and its dry run share it, so the preview selects what the job changes.
+type jobSelection struct {
+	table string
+	// ident is the quoted identifier of the table
+	ident identifier
+	where string
+	args  []interface{}
+}
+
+// previewJob counts the rows of the selections and returns the identifiers of up to sample
+// of them, as table/id, without changing anything.
+func (bdk *BDKeeper) previewJob(ctx context.Context, selections []jobSelection, sample int) (models.JobPreview, error) {
+	preview := models.JobPreview{Sample: make([]string, 0)}
+	for _, sel := range selections {
+		var n int
+		query := bdk.dialect.rebind(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", sel.ident, sel.where))
+		if err := bdk.ex.QueryRowContext(ctx, query, sel.args...).Scan(&n); err != nil {
+			return preview, fmt.Errorf("failed to count %s: %w", sel.table, err)
+		}
+		preview.Count += n
+
+		if n == 0 || len(preview.Sample) >= sample {
+			continue
+		}
+		ids, err := bdk.sampleIDs(ctx, sel, sample-len(preview.Sample))
+		if err != nil {
+			return preview, err
+		}
+		for _, id := range ids {
+			preview.Sample = append(preview.Sample, sel.table+"/"+id)
+		}
+	}
+
+	return preview, nil
+}
+
+// sampleIDs returns the ids of up to limit rows of the selection, in the order of the ids.
+func (bdk *BDKeeper) sampleIDs(ctx context.Context, sel jobSelection, limit int) ([]string, error) {
+	query := bdk.dialect.rebind(fmt.Sprintf("SELECT id FROM %s WHERE %s ORDER BY id LIMIT %d", sel.ident, sel.where, limit))
+	rows, err := bdk.ex.QueryContext(ctx, query, sel.args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sample %s: %w", sel.table, err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan id: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows encountered an error: %w", err)
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,57 @@
+package bdkeeper
+
+import (
+	"context"
+	"math/bits"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// timingBucket returns the power of two bucket of the duration, close timings share a bucket or neighbor one.
+func timingBucket(d time.Duration) int {
+	return bits.Len64(uint64(d))
+}
+
+// medianDuration returns the median time of the runs of fn.
+func medianDuration(runs int, fn func()) time.Duration {
+	durations := make([]time.Duration, runs)
+	for i := range durations {
+		start := time.Now()
+		fn()
+		durations[i] = time.Since(start)
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+	return durations[runs/2]
+}
+
+func TestBDKeeper_ForeignEntryTiming(t *testing.T) {
+	bdk := newSQLiteBDKeeper(t)
+	ctx := context.Background()
+	owner, prober := addTestUser(t, bdk), addTestUser(t, bdk)
+	table := "UserCredentials"
+
+	_, _, err := bdk.AddData(ctx, table, owner, "foreign", map[string]string{"login": "alice", "password": "secret"})
+	require.NoError(t, err)
+
+	// The entry of another user is filtered out by the same lookup as a missing one
+	get := func(entryID string) func() {
+		return func() {
+			_, err := bdk.GetData(ctx, table, prober, entryID, false)
+			require.ErrorIs(t, err, models.ErrNotFound)
+		}
+	}
+	get("foreign")()
+	get("missing")()
+
+	const runs = 200
+	foreign := medianDuration(runs, get("foreign"))
+	missing := medianDuration(runs, get("missing"))
+	assert.InDelta(t, timingBucket(missing), timingBucket(foreign), 1,
+		"foreign entry took %s, missing entry %s", foreign, missing)
+}
@@ -0,0 +1,97 @@
+package bdkeeper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// RecordFailedLogin counts a failed login of the account and locks it once its consecutive failures
+// reach maxFailures, for models.LockoutDuration. It returns the end of the lockout it started,
+// the zero time if the account isn't locked, or models.ErrNotFound if there is no such account.
+func (bdk *BDKeeper) RecordFailedLogin(ctx context.Context, username string, maxFailures int) (_ time.Time, err error) {
+	defer bdk.observe("record_failed_login", usersTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer leave()
+
+	var lockedUntil time.Time
+	err = bdk.inTx(ctx, func(view *BDKeeper) error {
+		// The counter is incremented in the database, so concurrent failures all count
+		var failures int
+		query := `UPDATE Users SET failed_attempts = failed_attempts + 1 WHERE username = $1 RETURNING failed_attempts`
+		err := view.ex.QueryRowContext(ctx, view.dialect.rebind(query), username).Scan(&failures)
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to record failed login: %w", err)
+		}
+
+		lockFor := models.LockoutDuration(failures, maxFailures)
+		if lockFor == 0 {
+			return nil
+		}
+		lockedUntil = time.Now().Add(lockFor).UTC()
+		query = `UPDATE Users SET locked_until = $1 WHERE username = $2`
+		if _, err := view.ex.ExecContext(ctx, view.dialect.rebind(query), view.dialect.timeArg(lockedUntil), username); err != nil {
+			return fmt.Errorf("failed to lock account: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return lockedUntil, nil
+}
+
+// ResetFailedLogins clears the failed logins of the account after a successful one.
+func (bdk *BDKeeper) ResetFailedLogins(ctx context.Context, username string) (err error) {
+	defer bdk.observe("reset_failed_logins", usersTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+
+	query := `UPDATE Users SET failed_attempts = 0, locked_until = NULL WHERE username = $1 AND failed_attempts > 0`
+	if _, err := bdk.ex.ExecContext(ctx, bdk.dialect.rebind(query), username); err != nil {
+		return fmt.Errorf("failed to reset failed logins: %w", err)
+	}
+
+	return nil
+}
+
+// IsLocked reports whether the account is locked and until when. An unknown account is never locked.
+// It always reads the primary, a lockout must stop the next attempt at once.
+func (bdk *BDKeeper) IsLocked(ctx context.Context, username string) (_ bool, _ time.Time, err error) {
+	defer bdk.observe("is_locked", usersTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	defer leave()
+
+	var lockedUntil sql.NullTime
+	query := `SELECT locked_until FROM Users WHERE username = $1`
+	err = bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), username).Scan(&lockedUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, time.Time{}, nil
+	}
+	if err != nil {
+		return false, time.Time{}, fmt.Errorf("failed to get lockout: %w", err)
+	}
+	if !lockedUntil.Valid || !lockedUntil.Time.After(time.Now()) {
+		return false, time.Time{}, nil
+	}
+
+	return true, lockedUntil.Time, nil
+}
@@ -0,0 +1,88 @@
+package bdkeeper
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// loginHistoryTable holds the login attempts on the accounts of the users.
+const loginHistoryTable = "login_history"
+
+// RecordLogin adds a login attempt to the login history of its user, a successful one also becomes
+// their last login. The history keeps the last keep attempts of the user, a keep of 0 or less keeps all.
+func (bdk *BDKeeper) RecordLogin(ctx context.Context, ev models.LoginEvent, keep int) (err error) {
+	defer bdk.observe("record_login", loginHistoryTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	bdk.wrote(userWriter(ev.UserID))
+
+	return bdk.inTx(ctx, func(view *BDKeeper) error {
+		query := fmt.Sprintf(`INSERT INTO login_history (user_id, at, ip, user_agent, success) VALUES ($1, %s, $2, $3, $4)`, view.dialect.now())
+		if _, err := view.ex.ExecContext(ctx, view.dialect.rebind(query), ev.UserID, ev.IP, ev.UserAgent, ev.Success); err != nil {
+			return fmt.Errorf("failed to record login: %w", err)
+		}
+
+		if ev.Success {
+			query = fmt.Sprintf(`UPDATE Users SET last_login_at = %s WHERE id = $1`, view.dialect.now())
+			if _, err := view.ex.ExecContext(ctx, view.dialect.rebind(query), ev.UserID); err != nil {
+				return fmt.Errorf("failed to update last login: %w", err)
+			}
+		}
+
+		// The attempts older than the last keep ones are deleted, the subquery finds none if there are fewer
+		if keep <= 0 {
+			return nil
+		}
+		query = `DELETE FROM login_history WHERE user_id = $1 AND id <=
+			(SELECT id FROM login_history WHERE user_id = $1 ORDER BY id DESC LIMIT 1 OFFSET $2)`
+		if _, err := view.ex.ExecContext(ctx, view.dialect.rebind(query), ev.UserID, keep); err != nil {
+			return fmt.Errorf("failed to prune login history: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// GetLoginHistory returns up to limit login attempts of the user, newest first.
+// A limit of 0 or less returns all of them.
+func (bdk *BDKeeper) GetLoginHistory(ctx context.Context, userID int, limit int) (_ []models.LoginEvent, err error) {
+	defer bdk.observe("get_login_history", loginHistoryTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	query := `SELECT at, ip, user_agent, success FROM login_history WHERE user_id = $1 ORDER BY id DESC`
+	args := []interface{}{userID}
+	if limit > 0 {
+		query += " LIMIT $2"
+		args = append(args, limit)
+	}
+
+	rows, err := bdk.reader(userWriter(userID)).ex.QueryContext(ctx, bdk.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get login history: %w", err)
+	}
+	defer rows.Close()
+
+	events := make([]models.LoginEvent, 0)
+	for rows.Next() {
+		ev := models.LoginEvent{UserID: userID}
+		if err := rows.Scan(&ev.At, &ev.IP, &ev.UserAgent, &ev.Success); err != nil {
+			return nil, fmt.Errorf("failed to scan login: %w", err)
+		}
+		events = append(events, ev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows encountered an error: %w", err)
+	}
+
+	return events, nil
+}
@@ -0,0 +1,82 @@
+package bdkeeper
+
+import (
+	"errors"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// Metrics observes the storage operations of the keeper.
+// The operation labels are the snake-case names of the public methods, e.g. get_all_data.
+// The table is empty for the operations spanning several tables and Users for the user operations.
+type Metrics interface {
+	ObserveQuery(op, table string, d time.Duration, err error)
+	// ObserveRetry counts a transaction run again after a concurrent one aborted it,
+	// or, if exhausted is set, one failing with models.ErrRetrySync.
+	ObserveRetry(op string, exhausted bool)
+	// ObserveTruncation counts an entry of the table whose search text was cut at models.MaxSearchText.
+	ObserveTruncation(table string)
+	// ObservePartialFailure counts a table which failed in a read of the operation in the partial mode,
+	// the other tables being returned.
+	ObservePartialFailure(op, table string)
+	// ObserveUnchanged counts an update of an entry of the table skipped because it changed nothing.
+	ObserveUnchanged(table string)
+}
+
+// usersTable is the table label of the user operations.
+const usersTable = "Users"
+
+// SetMetrics sets the observer of the storage operations, nil disables the observation.
+func (bdk *BDKeeper) SetMetrics(m Metrics) {
+	bdk.metrics = m
+}
+
+// observe reports the operation started at start with the error *errp to the metrics, if set.
+// It is deferred by the public methods with a pointer to their named error result,
+// so the happy path costs nothing but reading the clock.
+func (bdk *BDKeeper) observe(op, table string, start time.Time, errp *error) {
+	if bdk.metrics == nil {
+		return
+	}
+
+	bdk.metrics.ObserveQuery(op, table, time.Since(start), *errp)
+
+	// A method called on a view fails with the transaction, which is reported by the outer method
+	if bdk.tx == nil && errors.Is(*errp, models.ErrRetrySync) {
+		bdk.metrics.ObserveRetry(op, true)
+	}
+}
+
+// observeRetry reports a retry of the operation to the metrics, if set.
+func (bdk *BDKeeper) observeRetry(op string, exhausted bool) {
+	if bdk.metrics != nil {
+		bdk.metrics.ObserveRetry(op, exhausted)
+	}
+}
+
+// observeTruncation reports a search text cut in the table to the metrics, if set.
+func (bdk *BDKeeper) observeTruncation(table string) {
+	if bdk.metrics != nil {
+		bdk.metrics.ObserveTruncation(table)
+	}
+}
+
+// observePartialFailure reports a table failed in a partial read to the metrics, if set.
+func (bdk *BDKeeper) observePartialFailure(op, table string) {
+	if bdk.metrics != nil {
+		bdk.metrics.ObservePartialFailure(op, table)
+	}
+}
+
+// observeUnchanged reports the unchanged updates of a batch to the metrics, if set.
+func (bdk *BDKeeper) observeUnchanged(results []models.ChangeResult) {
+	if bdk.metrics == nil {
+		return
+	}
+	for _, r := range results {
+		if r.Status == models.ChangeUnchanged {
+			bdk.metrics.ObserveUnchanged(r.Table)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package bdkeeper
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"github.com/wurt83ow/gophkeeper-server/internal/storage"
+)
+
+// observation is a storage operation reported to the metrics.
+type observation struct {
+	op, table string
+	failed    bool
+}
+
+// recordingMetrics keeps the observed operations.
+type recordingMetrics struct {
+	observed  []observation
+	retries   []retryObservation
+	truncated []string
+	partial   []observation
+	unchanged []string
+}
+
+func (m *recordingMetrics) ObserveQuery(op, table string, d time.Duration, err error) {
+	m.observed = append(m.observed, observation{op: op, table: table, failed: err != nil})
+}
+
+func (m *recordingMetrics) ObserveRetry(op string, exhausted bool) {
+	m.retries = append(m.retries, retryObservation{op: op, exhausted: exhausted})
+}
+
+func (m *recordingMetrics) ObserveTruncation(table string) {
+	m.truncated = append(m.truncated, table)
+}
+
+func (m *recordingMetrics) ObservePartialFailure(op, table string) {
+	m.partial = append(m.partial, observation{op: op, table: table, failed: true})
+}
+
+func (m *recordingMetrics) ObserveUnchanged(table string) {
+	m.unchanged = append(m.unchanged, table)
+}
+
+// retryObservation is a retry reported to the metrics.
+type retryObservation struct {
+	op        string
+	exhausted bool
+}
+
+func TestBDKeeper_Metrics(t *testing.T) {
+	bdk := newSQLiteBDKeeper(t)
+	ctx := context.Background()
+	userID := addTestUser(t, bdk)
+
+	m := &recordingMetrics{}
+	bdk.SetMetrics(m)
+
+	_, _, err := bdk.AddData(ctx, "UserCredentials", userID, "entry", map[string]string{"login": "alice", "password": "p"})
+	require.NoError(t, err)
+	_, err = bdk.GetData(ctx, "UserCredentials", userID, "missing", false)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	require.NoError(t, bdk.WithTx(ctx, func(tx storage.Keeper) error {
+		_, err := tx.GetAllData(ctx, "UserCredentials", userID, models.DataQuery{})
+		return err
+	}))
+	_, err = bdk.GetUserID(ctx, "nobody")
+	assert.Error(t, err)
+
+	// Every public method reports itself once, the methods called inside a transaction included
+	assert.Equal(t, []observation{
+		{op: "add_data", table: "UserCredentials"},
+		{op: "get_data", table: "UserCredentials", failed: true},
+		{op: "get_all_data", table: "UserCredentials"},
+		{op: "with_tx"},
+		{op: "get_user_id", table: "Users", failed: true},
+	}, m.observed)
+
+	// Without metrics nothing is reported
+	bdk.SetMetrics(nil)
+	_, err = bdk.GetAllData(ctx, "UserCredentials", userID, models.DataQuery{})
+	require.NoError(t, err)
+	assert.Len(t, m.observed, 5)
+}
+
+func TestBDKeeper_MetricsTruncation(t *testing.T) {
+	bdk := newSQLiteBDKeeper(t)
+	ctx := context.Background()
+	userID := addTestUser(t, bdk)
+
+	m := &recordingMetrics{}
+	bdk.SetMetrics(m)
+
+	long := strings.Repeat("a", models.MaxSearchText+1)
+	_, _, err := bdk.AddData(ctx, "TextData", userID, "short", map[string]string{"data": "d", "meta_info": "notes"})
+	require.NoError(t, err)
+	_, _, err = bdk.AddData(ctx, "TextData", userID, "long", map[string]string{"data": "d", "meta_info": long})
+	require.NoError(t, err)
+
+	// Only the text cut at the cap is counted, and it is stored cut and marked
+	assert.Equal(t, []string{"TextData"}, m.truncated)
+	stored := storedValue(t, bdk, "TextData", "search_text", "long")
+	assert.Equal(t, long[:models.MaxSearchText]+models.SearchTruncated, stored)
+	assert.Equal(t, long, storedValue(t, bdk, "TextData", "meta_info", "long"))
+}
+
+func TestBDKeeper_MetricsUnchanged(t *testing.T) {
+	bdk := newSQLiteBDKeeper(t)
+	ctx := context.Background()
+	userID := addTestUser(t, bdk)
+
+	m := &recordingMetrics{}
+	bdk.SetMetrics(m)
+
+	_, updatedAt, err := bdk.AddData(ctx, "UserCredentials", userID, "entry", map[string]string{"login": "alice", "password": "p"})
+	require.NoError(t, err)
+	update := func(login string) models.Change {
+		return models.Change{Table: "UserCredentials", Op: models.ChangeUpdate, EntryID: "entry",
+			Fields: map[string]string{"login": login, "password": "p"}, UpdatedAt: updatedAt}
+	}
+
+	// The updates changing nothing are counted once the batch commits, the others aren't
+	results, err := bdk.ApplyChanges(ctx, userID, []models.Change{update("alice"), update("alice")})
+	require.NoError(t, err)
+	assert.Equal(t, models.ChangeUnchanged, results[0].Status)
+	assert.Equal(t, []string{"UserCredentials", "UserCredentials"}, m.unchanged)
+	_, err = bdk.Sync(ctx, userID, time.Time{}, []models.Change{update("alicf")})
+	require.NoError(t, err)
+	assert.Len(t, m.unchanged, 2)
+}
+
+// nopMetrics discards the observations.
+type nopMetrics struct{}
+
+func (nopMetrics) ObserveQuery(string, string, time.Duration, error) {}
+
+func (nopMetrics) ObserveRetry(string, bool) {}
+
+func (nopMetrics) ObserveTruncation(string) {}
+
+func (nopMetrics) ObservePartialFailure(string, string) {}
+
+func (nopMetrics) ObserveUnchanged(string) {}
+
+func TestBDKeeper_ObserveAllocs(t *testing.T) {
+	bdk := &BDKeeper{}
+
+	observe := func() {
+		var err error
+		defer bdk.observe("get_data", "UserCredentials", time.Now(), &err)
+	}
+
+	// The hook doesn't allocate, whether metrics are set or not
+	assert.Zero(t, testing.AllocsPerRun(100, observe))
+	bdk.SetMetrics(nopMetrics{})
+	assert.Zero(t, testing.AllocsPerRun(100, observe))
+}
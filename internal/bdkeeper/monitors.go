@@ -0,0 +1,145 @@
+package bdkeeper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// monitorTokensTable holds the tokens of the uptime monitors. They are of no user, so the table has no
+// row-level security policy, and a token is always read from the primary.
+const monitorTokensTable = "monitor_tokens"
+
+// CreateMonitorToken stores a monitor token created by an admin and returns it with its id and its creation time.
+func (bdk *BDKeeper) CreateMonitorToken(ctx context.Context, token models.MonitorToken) (_ models.MonitorToken, err error) {
+	defer bdk.observe("create_monitor_token", monitorTokensTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return models.MonitorToken{}, err
+	}
+	defer leave()
+
+	query := fmt.Sprintf(`INSERT INTO monitor_tokens (token_hash, name, created_at)
+		VALUES ($1, $2, %s) RETURNING id, created_at`, bdk.dialect.now())
+	err = bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), token.Hash, token.Name).Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return models.MonitorToken{}, fmt.Errorf("failed to create monitor token: %w", err)
+	}
+	token.CreatedAt = token.CreatedAt.UTC()
+
+	return token, nil
+}
+
+// monitorTokenColumns are the columns of a monitor token read by scanMonitorToken.
+const monitorTokenColumns = `id, token_hash, name, created_at, last_used_at`
+
+// scanMonitorToken reads a monitor token of monitorTokenColumns.
+func scanMonitorToken(row interface{ Scan(...any) error }) (models.MonitorToken, error) {
+	var token models.MonitorToken
+	var lastUsedAt sql.NullTime
+	if err := row.Scan(&token.ID, &token.Hash, &token.Name, &token.CreatedAt, &lastUsedAt); err != nil {
+		return models.MonitorToken{}, err
+	}
+	token.CreatedAt = token.CreatedAt.UTC()
+	if lastUsedAt.Valid {
+		at := lastUsedAt.Time.UTC()
+		token.LastUsedAt = &at
+	}
+
+	return token, nil
+}
+
+// GetMonitorTokenByHash returns the monitor token with the given hash, or models.ErrNotFound.
+func (bdk *BDKeeper) GetMonitorTokenByHash(ctx context.Context, hash string) (_ models.MonitorToken, err error) {
+	defer bdk.observe("get_monitor_token", monitorTokensTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return models.MonitorToken{}, err
+	}
+	defer leave()
+
+	query := `SELECT ` + monitorTokenColumns + ` FROM monitor_tokens WHERE token_hash = $1`
+	token, err := scanMonitorToken(bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.MonitorToken{}, models.ErrNotFound
+	}
+	if err != nil {
+		return models.MonitorToken{}, fmt.Errorf("failed to get monitor token: %w", err)
+	}
+
+	return token, nil
+}
+
+// ListMonitorTokens returns the monitor tokens, oldest first.
+func (bdk *BDKeeper) ListMonitorTokens(ctx context.Context) (_ []models.MonitorToken, err error) {
+	defer bdk.observe("list_monitor_tokens", monitorTokensTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	query := `SELECT ` + monitorTokenColumns + ` FROM monitor_tokens ORDER BY id`
+	rows, err := bdk.ex.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list monitor tokens: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := make([]models.MonitorToken, 0)
+	for rows.Next() {
+		token, err := scanMonitorToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan monitor token: %w", err)
+		}
+		tokens = append(tokens, token)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows encountered an error: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// TouchMonitorToken sets the last use of the monitor token to now.
+func (bdk *BDKeeper) TouchMonitorToken(ctx context.Context, id int) (err error) {
+	defer bdk.observe("touch_monitor_token", monitorTokensTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+
+	query := fmt.Sprintf(`UPDATE monitor_tokens SET last_used_at = %s WHERE id = $1`, bdk.dialect.now())
+	if _, err := bdk.ex.ExecContext(ctx, bdk.dialect.rebind(query), id); err != nil {
+		return fmt.Errorf("failed to touch monitor token: %w", err)
+	}
+
+	return nil
+}
+
+// RevokeMonitorToken deletes the monitor token and returns it, or returns models.ErrNotFound.
+// The token is rejected from its next probe on.
+func (bdk *BDKeeper) RevokeMonitorToken(ctx context.Context, id int) (_ models.MonitorToken, err error) {
+	defer bdk.observe("revoke_monitor_token", monitorTokensTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return models.MonitorToken{}, err
+	}
+	defer leave()
+
+	query := `DELETE FROM monitor_tokens WHERE id = $1 RETURNING ` + monitorTokenColumns
+	token, err := scanMonitorToken(bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.MonitorToken{}, models.ErrNotFound
+	}
+	if err != nil {
+		return models.MonitorToken{}, fmt.Errorf("failed to revoke monitor token: %w", err)
+	}
+
+	return token, nil
+}
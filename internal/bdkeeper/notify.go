@@ -0,0 +1,205 @@
+package bdkeeper
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"go.uber.org/zap"
+)
+
+// changesChannel is the PostgreSQL channel the instances of the server notify each other of their changes on.
+const changesChannel = "gophkeeper_changes"
+
+// noticeEvents is the number of events sent by a single notification,
+// a larger batch is split so the payload stays under the 8000 bytes PostgreSQL accepts.
+const noticeEvents = 32
+
+// The listener connects again after listenBackoff once it failed, waiting twice as long after every
+// further failure up to listenBackoffMax. They are variables so the tests don't wait as long.
+var (
+	listenBackoff    = time.Second
+	listenBackoffMax = 30 * time.Second
+)
+
+// errNotifyUnsupported is returned on a database without notifications, such as SQLite.
+var errNotifyUnsupported = fmt.Errorf("notifications need PostgreSQL: %w", errors.ErrUnsupported)
+
+// ChangeSubscriber receives the changes committed by the other instances of the server, see ListenChanges.
+type ChangeSubscriber interface {
+	// Publish is called with the changes made by the session of the device to the vault of the user.
+	Publish(ctx context.Context, userID int, deviceID string, events []models.VaultEvent)
+}
+
+// notifier sends the changes of the keeper to the other instances, see EnableChangeNotifications.
+type notifier struct {
+	// instance tells the notifications of this keeper apart from those of the other instances
+	instance string
+}
+
+// changeNotice is the payload of a notification.
+type changeNotice struct {
+	Instance string              `json:"instance"`
+	UserID   int                 `json:"user_id"`
+	DeviceID string              `json:"device_id,omitempty"`
+	Events   []models.VaultEvent `json:"events"`
+}
+
+// EnableChangeNotifications makes the keeper notify the other instances of the server sharing the database
+// of the data changes once they are committed, see ListenChanges. It needs PostgreSQL.
+func (bdk *BDKeeper) EnableChangeNotifications() error {
+	if _, ok := bdk.dialect.(postgresDialect); !ok {
+		return errNotifyUnsupported
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Errorf("failed to generate the instance id: %w", err)
+	}
+	bdk.notifier = &notifier{instance: hex.EncodeToString(id)}
+
+	return nil
+}
+
+// changed notifies the other instances of the changes made to the vault of the user, if enabled.
+// The changes of a transaction view are held until the transaction commits and dropped if it doesn't.
+// A failed notification is only logged, the changes are made already.
+func (bdk *BDKeeper) changed(ctx context.Context, userID int, events ...models.VaultEvent) {
+	if bdk.notifier == nil || len(events) == 0 {
+		return
+	}
+
+	notice := changeNotice{
+		Instance: bdk.notifier.instance,
+		UserID:   userID,
+		DeviceID: models.ClientFrom(ctx).DeviceID,
+		Events:   events,
+	}
+	if bdk.tx != nil {
+		bdk.tx.notices = append(bdk.tx.notices, notice)
+		return
+	}
+
+	bdk.notify(ctx, []changeNotice{notice})
+}
+
+// notify sends the notices, the larger ones in several notifications.
+// They are sent even if the request was canceled, the changes are committed by then.
+func (bdk *BDKeeper) notify(ctx context.Context, notices []changeNotice) {
+	for _, notice := range notices {
+		events := notice.Events
+		for len(events) > 0 {
+			n := min(len(events), noticeEvents)
+			notice.Events, events = events[:n], events[n:]
+			if err := bdk.sendNotice(context.WithoutCancel(ctx), notice); err != nil {
+				bdk.log.Warn("failed to notify the changes", logger.ContextFields(ctx,
+					zap.Int("user_id", notice.UserID),
+					zap.Error(err),
+				)...)
+			}
+		}
+	}
+}
+
+// sendNotice sends a notification of the changes.
+func (bdk *BDKeeper) sendNotice(ctx context.Context, notice changeNotice) (err error) {
+	defer bdk.observe("notify_changes", "", time.Now(), &err)
+
+	payload, err := json.Marshal(notice)
+	if err != nil {
+		return err
+	}
+	_, err = bdk.conn.ExecContext(ctx, `SELECT pg_notify($1, $2)`, changesChannel, string(payload))
+	return err
+}
+
+// ListenChanges passes the changes notified by the other instances of the server to the subscriber
+// until the context is done, and routes the reads of their users to the primary meanwhile, as the replica
+// may lag behind them. A failed listener connects again with a growing backoff; the changes notified
+// in between are missed.
+func (bdk *BDKeeper) ListenChanges(ctx context.Context, sub ChangeSubscriber) error {
+	if _, ok := bdk.dialect.(postgresDialect); !ok {
+		return errNotifyUnsupported
+	}
+
+	instance := ""
+	if bdk.notifier != nil {
+		instance = bdk.notifier.instance
+	}
+	receive := func(payload string) {
+		var notice changeNotice
+		if err := json.Unmarshal([]byte(payload), &notice); err != nil {
+			bdk.log.Warn("failed to decode a change notification", zap.Error(err))
+			return
+		}
+		if notice.Instance == instance {
+			return
+		}
+
+		bdk.wrote(userWriter(notice.UserID))
+		sub.Publish(ctx, notice.UserID, notice.DeviceID, notice.Events)
+	}
+
+	backoff := listenBackoff
+	for {
+		err := bdk.listen(ctx, func() { backoff = listenBackoff }, receive)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, errors.ErrUnsupported) {
+			return err
+		}
+		bdk.log.Warn("change listener failed, listening again", zap.Duration("retry_in", backoff), zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, listenBackoffMax)
+	}
+}
+
+// listen calls fn with the payloads notified on the channel until the context is done or the connection fails,
+// listening is called once the channel is listened to. It holds a connection of its own all along,
+// which is discarded afterwards rather than returned to the pool while listening.
+func (bdk *BDKeeper) listen(ctx context.Context, listening func(), fn func(payload string)) error {
+	conn, err := bdk.conn.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var listenErr error
+	conn.Raw(func(driverConn interface{}) error {
+		pc, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			listenErr = errNotifyUnsupported
+			return nil
+		}
+
+		if _, listenErr = pc.Conn().Exec(ctx, "LISTEN "+changesChannel); listenErr != nil {
+			return driver.ErrBadConn
+		}
+		bdk.log.Info("listening for the changes of the other instances")
+		listening()
+		for {
+			n, err := pc.Conn().WaitForNotification(ctx)
+			if err != nil {
+				listenErr = err
+				return driver.ErrBadConn
+			}
+			fn(n.Payload)
+		}
+	})
+
+	return listenErr
+}
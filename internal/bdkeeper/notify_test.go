@@ -0,0 +1,158 @@
+package bdkeeper
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"github.com/wurt83ow/gophkeeper-server/internal/storage"
+)
+
+func TestBDKeeper_NotifyUnsupported(t *testing.T) {
+	bdk := newSQLiteBDKeeper(t)
+
+	// SQLite has no notifications, the changes stay on the instance
+	assert.ErrorIs(t, bdk.EnableChangeNotifications(), errors.ErrUnsupported)
+	assert.ErrorIs(t, bdk.ListenChanges(context.Background(), make(noticeRecorder)), errors.ErrUnsupported)
+}
+
+// notice is a batch of changes passed to a subscriber.
+type notice struct {
+	userID   int
+	deviceID string
+	events   []models.VaultEvent
+}
+
+// noticeRecorder is a subscriber sending the changes it is passed to the channel.
+type noticeRecorder chan notice
+
+func (r noticeRecorder) Publish(_ context.Context, userID int, deviceID string, events []models.VaultEvent) {
+	r <- notice{userID: userID, deviceID: deviceID, events: events}
+}
+
+// next returns the next changes passed to the subscriber.
+func (r noticeRecorder) next(t *testing.T) notice {
+	t.Helper()
+	select {
+	case n := <-r:
+		return n
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change notified")
+		return notice{}
+	}
+}
+
+// listeners returns the backends listening to the changes.
+func listeners(t *testing.T, bdk *BDKeeper) []int {
+	rows, err := bdk.conn.Query(`SELECT pid FROM pg_stat_activity
+		WHERE datname = current_database() AND query = 'LISTEN ' || $1 AND state = 'idle'`, changesChannel)
+	require.NoError(t, err)
+	defer rows.Close()
+
+	var pids []int
+	for rows.Next() {
+		var pid int
+		require.NoError(t, rows.Scan(&pid))
+		pids = append(pids, pid)
+	}
+	require.NoError(t, rows.Err())
+
+	return pids
+}
+
+func TestBDKeeper_ChangeNotifications(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URI")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URI is not set")
+	}
+
+	backoff := listenBackoff
+	listenBackoff = 10 * time.Millisecond
+	t.Cleanup(func() { listenBackoff = backoff })
+
+	nLogger, err := logger.NewLogger("info")
+	require.NoError(t, err)
+
+	// Two instances of the server share the database
+	var keepers [2]*BDKeeper
+	var recorders [2]noticeRecorder
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for i := range keepers {
+		bdk, err := NewBDKeeper(func() string { return dsn }, nLogger, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { bdk.Close() })
+		require.NoError(t, bdk.EnableChangeNotifications())
+		keepers[i], recorders[i] = bdk, make(noticeRecorder, 16)
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.ErrorIs(t, keepers[i].ListenChanges(ctx, recorders[i]), context.Canceled)
+		}(i)
+	}
+	defer wg.Wait()
+	defer cancel()
+	first, second := keepers[0], keepers[1]
+	require.Eventually(t, func() bool { return len(listeners(t, first)) >= 2 }, 5*time.Second, 10*time.Millisecond)
+
+	userID := addTestUser(t, first)
+	laptop := models.WithClient(ctx, models.Client{DeviceID: "laptop"})
+
+	// A change committed by an instance reaches the other one along with the device which made it
+	id, updatedAt, err := first.AddData(laptop, "TextData", userID, "", map[string]string{"data": "d", "meta_info": "wifi"})
+	require.NoError(t, err)
+	n := recorders[1].next(t)
+	assert.Equal(t, userID, n.userID)
+	assert.Equal(t, "laptop", n.deviceID)
+	require.Len(t, n.events, 1)
+	assert.Equal(t, "TextData", n.events[0].Table)
+	assert.Equal(t, id, n.events[0].EntryID)
+	assert.True(t, updatedAt.Equal(n.events[0].UpdatedAt))
+
+	// The instance doesn't hear its own changes, the first notification it gets is the other instance's
+	_, err = second.UpdateData(ctx, "TextData", userID, id, map[string]string{"data": "e", "meta_info": "wifi"})
+	require.NoError(t, err)
+	n = recorders[0].next(t)
+	assert.Empty(t, n.deviceID)
+	assert.Equal(t, id, n.events[0].EntryID)
+
+	// The changes of a transaction are notified once it commits, not if it rolls back
+	err = first.WithTx(ctx, func(tx storage.Keeper) error {
+		if _, err := tx.DeleteData(ctx, "TextData", userID, id); err != nil {
+			return err
+		}
+		return errors.New("abort")
+	})
+	require.EqualError(t, err, "abort")
+	var deletedAt time.Time
+	require.NoError(t, first.WithTx(ctx, func(tx storage.Keeper) (err error) {
+		deletedAt, err = tx.DeleteData(ctx, "TextData", userID, id)
+		return err
+	}))
+	n = recorders[1].next(t)
+	require.Len(t, n.events, 1)
+	assert.True(t, deletedAt.Equal(n.events[0].UpdatedAt))
+
+	// A listener whose connection is lost listens again
+	pids := listeners(t, first)
+	for _, pid := range pids {
+		_, err := first.conn.Exec(`SELECT pg_terminate_backend($1)`, pid)
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		again := listeners(t, first)
+		return len(again) >= 2 && !assert.ObjectsAreEqual(pids, again)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, err = first.UndeleteData(ctx, "TextData", userID, id)
+	require.NoError(t, err)
+	assert.Equal(t, userID, recorders[1].next(t).userID)
+}
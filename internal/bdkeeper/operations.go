@@ -0,0 +1,148 @@
+package bdkeeper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// userOperationsTable holds the operations of the users on their vaults. It is only read by the user of the token,
+// so like the devices it has no row-level security policy.
+const userOperationsTable = "user_operations"
+
+// operationColumns are the columns of an operation read by scanOperation.
+const operationColumns = "id, user_id, kind, device_id, status, expected_seconds, started_at, expires_at, finished_at"
+
+// StartUserOperation starts the operation of the user, running until its ExpiresAt unless extended, and returns it
+// with its status and its start time. A running operation of the user which expired fails first. It returns
+// models.ErrOperationRunning if another one is still running.
+func (bdk *BDKeeper) StartUserOperation(ctx context.Context, op models.UserOperation) (_ models.UserOperation, err error) {
+	defer bdk.observe("start_user_operation", userOperationsTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return models.UserOperation{}, err
+	}
+	defer leave()
+	bdk.wrote(userWriter(op.UserID))
+
+	err = bdk.inTx(ctx, func(view *BDKeeper) error {
+		if _, err := view.failExpiredOperations(ctx, op.UserID); err != nil {
+			return err
+		}
+
+		// The conflict with the running operation of the user inserts nothing
+		query := fmt.Sprintf(`INSERT INTO user_operations (id, user_id, kind, device_id, status, expected_seconds, started_at, expires_at)
+			VALUES ($1, $2, $3, $4, $5, $6, %s, $7) ON CONFLICT (user_id) WHERE status = 'running' DO NOTHING
+			RETURNING %s`, view.dialect.now(), operationColumns)
+		row := view.ex.QueryRowContext(ctx, view.dialect.rebind(query), op.ID, op.UserID, op.Kind, op.DeviceID,
+			models.OperationRunning, op.ExpectedSeconds, view.dialect.timeArg(op.ExpiresAt.UTC()))
+		op, err = scanOperation(row)
+		if errors.Is(err, models.ErrNotFound) {
+			return models.ErrOperationRunning
+		}
+
+		return err
+	})
+
+	return op, err
+}
+
+// GetRunningOperation returns the running operation of the user, or models.ErrNotFound. A running operation
+// which expired fails and isn't returned. It is read from the primary, a fence has to be seen at once.
+// It runs on every write, so it only writes once the operation looks expired.
+func (bdk *BDKeeper) GetRunningOperation(ctx context.Context, userID int) (_ models.UserOperation, err error) {
+	defer bdk.observe("get_running_operation", userOperationsTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return models.UserOperation{}, err
+	}
+	defer leave()
+
+	query := fmt.Sprintf(`SELECT %s FROM user_operations WHERE user_id = $1 AND status = $2`, operationColumns)
+	op, err := scanOperation(bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), userID, models.OperationRunning))
+	if err != nil || op.ExpiresAt.After(time.Now()) {
+		return op, err
+	}
+
+	// The clock of the database decides, the operation keeps running if it isn't expired there yet
+	bdk.wrote(userWriter(userID))
+	failed, err := bdk.failExpiredOperations(ctx, userID)
+	if err != nil {
+		return models.UserOperation{}, err
+	}
+	if failed == 0 {
+		return op, nil
+	}
+
+	return models.UserOperation{}, models.ErrNotFound
+}
+
+// UpdateUserOperation moves the running operation of the user with the id to the status and returns it.
+// An operation still running is extended until expiresAt, a completed or failed one is finished now.
+// It returns models.ErrNotFound if the user has no such operation running, an expired one included.
+func (bdk *BDKeeper) UpdateUserOperation(ctx context.Context, userID int, id, status string, expiresAt time.Time) (op models.UserOperation, err error) {
+	defer bdk.observe("update_user_operation", userOperationsTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return models.UserOperation{}, err
+	}
+	defer leave()
+	bdk.wrote(userWriter(userID))
+
+	err = bdk.inTx(ctx, func(view *BDKeeper) error {
+		if _, err := view.failExpiredOperations(ctx, userID); err != nil {
+			return err
+		}
+
+		query := fmt.Sprintf(`UPDATE user_operations SET status = $1, finished_at = %s
+			WHERE user_id = $2 AND id = $3 AND status = $4 RETURNING %s`, view.dialect.now(), operationColumns)
+		args := []interface{}{status, userID, id, models.OperationRunning}
+		if status == models.OperationRunning {
+			query = fmt.Sprintf(`UPDATE user_operations SET expires_at = $1
+				WHERE user_id = $2 AND id = $3 AND status = $4 RETURNING %s`, operationColumns)
+			args[0] = view.dialect.timeArg(expiresAt.UTC())
+		}
+		op, err = scanOperation(view.ex.QueryRowContext(ctx, view.dialect.rebind(query), args...))
+		return err
+	})
+
+	return op, err
+}
+
+// failExpiredOperations fails the running operations of the user which expired, as finished when they expired,
+// and returns their number.
+func (bdk *BDKeeper) failExpiredOperations(ctx context.Context, userID int) (int64, error) {
+	query := fmt.Sprintf(`UPDATE user_operations SET status = $1, finished_at = expires_at
+		WHERE user_id = $2 AND status = $3 AND expires_at <= %s`, bdk.dialect.now())
+	res, err := bdk.ex.ExecContext(ctx, bdk.dialect.rebind(query), models.OperationFailed, userID, models.OperationRunning)
+	if err != nil {
+		return 0, fmt.Errorf("failed to expire operations: %w", err)
+	}
+
+	return res.RowsAffected()
+}
+
+// scanOperation scans the operationColumns of the row, models.ErrNotFound if there is none.
+func scanOperation(row *sql.Row) (models.UserOperation, error) {
+	var op models.UserOperation
+	var finishedAt sql.NullTime
+	err := row.Scan(&op.ID, &op.UserID, &op.Kind, &op.DeviceID, &op.Status, &op.ExpectedSeconds,
+		&op.StartedAt, &op.ExpiresAt, &finishedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.UserOperation{}, models.ErrNotFound
+	}
+	if err != nil {
+		return models.UserOperation{}, fmt.Errorf("failed to scan operation: %w", err)
+	}
+	op.StartedAt, op.ExpiresAt = op.StartedAt.UTC(), op.ExpiresAt.UTC()
+	if finishedAt.Valid {
+		at := finishedAt.Time.UTC()
+		op.FinishedAt = &at
+	}
+
+	return op, nil
+}
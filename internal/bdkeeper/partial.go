@@ -0,0 +1,51 @@
+package bdkeeper
+
+import (
+	"context"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"go.uber.org/zap"
+)
+
+// readTables runs fn for each of the tables on the snapshot view, for the operation op.
+// Unless partial is set the first table which fails fails the read. In the partial mode each table
+// is read in a savepoint of its own, so a failed one doesn't abort the snapshot, and the failed tables
+// are reported to the metrics and returned in a *models.PartialError once the others were read.
+// A snapshot aborted by a concurrent transaction and a canceled context still fail the read,
+// the other tables wouldn't be read either.
+func (bdk *BDKeeper) readTables(ctx context.Context, op string, tables []string, partial bool, fn func(view *BDKeeper, table string) error) error {
+	if !partial {
+		for _, table := range tables {
+			if err := fn(bdk, table); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	failed := make(map[string]error)
+	for _, table := range tables {
+		err := bdk.inSavepoint(ctx, func(view *BDKeeper) error {
+			return fn(view, table)
+		})
+		if err == nil {
+			continue
+		}
+		if bdk.dialect.isSerializationFailure(err) || ctx.Err() != nil {
+			return err
+		}
+
+		bdk.log.Warn("table failed in a partial read",
+			logger.ContextFields(ctx, zap.String("op", op), zap.String("table", table), zap.Error(err))...)
+		bdk.observePartialFailure(op, table)
+		failed[table] = err
+	}
+
+	if len(failed) > 0 {
+		return &models.PartialError{Tables: failed}
+	}
+
+	return nil
+}
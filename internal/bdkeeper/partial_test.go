@@ -0,0 +1,65 @@
+package bdkeeper
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// breakTable makes the queries of the table fail, as a corrupted table would.
+func breakTable(t *testing.T, bdk *BDKeeper, table string) {
+	_, err := bdk.conn.ExecContext(context.Background(), "ALTER TABLE "+table+" RENAME TO "+table+"_broken")
+	require.NoError(t, err)
+}
+
+func TestBDKeeper_PartialReads(t *testing.T) {
+	bdk := newSQLiteBDKeeper(t)
+	ctx := context.Background()
+	userID := addTestUser(t, bdk)
+
+	_, _, err := bdk.AddData(ctx, "UserCredentials", userID, "router", map[string]string{"login": "admin", "password": "p", "meta_info": "wifi"})
+	require.NoError(t, err)
+	_, _, err = bdk.AddData(ctx, "TextData", userID, "note", map[string]string{"data": "d", "meta_info": "wifi"})
+	require.NoError(t, err)
+	breakTable(t, bdk, "TextData")
+
+	m := &recordingMetrics{}
+	bdk.SetMetrics(m)
+
+	// Without the partial mode the broken table fails the whole read
+	_, err = bdk.SearchData(ctx, userID, "wifi", nil, 0, false)
+	assert.Error(t, err)
+	_, err = bdk.PendingData(ctx, userID, time.Time{}, false)
+	assert.Error(t, err)
+	assert.Empty(t, m.partial)
+
+	// In the partial mode the other tables are still read, the broken one is reported
+	results, err := bdk.SearchData(ctx, userID, "wifi", nil, 0, true)
+	var partialErr *models.PartialError
+	require.ErrorAs(t, err, &partialErr)
+	assert.Len(t, partialErr.Tables, 1)
+	assert.Error(t, partialErr.Tables["TextData"])
+	require.Len(t, results["UserCredentials"], 1)
+	assert.Equal(t, "router", results["UserCredentials"][0]["id"])
+
+	pending, err := bdk.PendingData(ctx, userID, time.Time{}, true)
+	require.ErrorAs(t, err, &partialErr)
+	assert.Len(t, partialErr.Tables, 1)
+	assert.Contains(t, partialErr.Tables, "TextData")
+	assert.Len(t, pending, len(models.DataTables)-1)
+	assert.Equal(t, 1, pending["UserCredentials"].Entries)
+
+	// The failures are counted by operation and table
+	assert.Equal(t, []observation{
+		{op: "search_data", table: "TextData", failed: true},
+		{op: "pending_data", table: "TextData", failed: true},
+	}, m.partial)
+
+	// With no table failing, the partial mode reads as the normal one
+	_, err = bdk.SearchData(ctx, userID, "wifi", []string{"UserCredentials"}, 0, true)
+	assert.NoError(t, err)
+}
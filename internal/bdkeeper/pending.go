@@ -0,0 +1,82 @@
+package bdkeeper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// PendingData estimates what a synchronization of the user from the cursor would download, per data table:
+// the entries selected as GetAllData selects them for the synchronization and the sum of their stored sizes,
+// the deleted entries counting models.TombstoneSize. The zero cursor estimates a full download, without
+// the deleted entries. No entry data is read. If partial is set, the tables which fail are returned
+// in a *models.PartialError along with the estimates of the others.
+func (bdk *BDKeeper) PendingData(ctx context.Context, userID int, since time.Time, partial bool) (_ map[string]models.PendingSize, err error) {
+	defer bdk.observe("pending_data", "", time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	// The tables are estimated on one snapshot, so the total is consistent across them
+	var results map[string]models.PendingSize
+	err = bdk.inSnapshot(ctx, "pending_data", func(view *BDKeeper) error {
+		results = make(map[string]models.PendingSize, len(models.DataTables))
+		return view.readTables(ctx, "pending_data", models.DataTables, partial, func(view *BDKeeper, table string) error {
+			pending, err := view.pendingTable(ctx, table, userID, since)
+			if err != nil {
+				return err
+			}
+			results[table] = pending
+
+			return nil
+		})
+	})
+	var partialErr *models.PartialError
+	if err != nil && !errors.As(err, &partialErr) {
+		return nil, err
+	}
+
+	return results, err
+}
+
+// pendingTable sums the sizes of the entries of the user in the table updated after the cursor.
+// An entry without a stored size counts as empty.
+func (bdk *BDKeeper) pendingTable(ctx context.Context, table string, userID int, since time.Time) (models.PendingSize, error) {
+	schema, err := bdk.tableColumns(ctx, bdk.ex, table)
+	if err != nil {
+		return models.PendingSize{}, err
+	}
+	tbl, err := bdk.tableIdent(ctx, bdk.ex, table)
+	if err != nil {
+		return models.PendingSize{}, err
+	}
+
+	args := []interface{}{userID}
+	conditions := []string{"user_id = $1", bdk.notExpired()}
+	if since.IsZero() {
+		conditions = append(conditions, bdk.notDeleted())
+	} else {
+		args = append(args, bdk.dialect.timeArg(since.UTC()))
+		conditions = append(conditions, bdk.updatedAfter("$2"))
+	}
+	size := "0"
+	if schema.size {
+		size = "COALESCE(" + schema.column(payloadSizeColumn) + ", 0)"
+	}
+
+	query := fmt.Sprintf("SELECT COUNT(*), COALESCE(SUM(CASE WHEN deleted THEN %d ELSE %s END), 0) FROM %s WHERE %s",
+		models.TombstoneSize, size, tbl, strings.Join(conditions, " AND "))
+	var pending models.PendingSize
+	err = bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), args...).Scan(&pending.Entries, &pending.Bytes)
+	if err != nil {
+		return models.PendingSize{}, fmt.Errorf("failed to estimate %s: %w", table, err)
+	}
+
+	return pending, nil
+}
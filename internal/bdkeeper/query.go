@@ -0,0 +1,215 @@
+package bdkeeper
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"go.uber.org/zap"
+)
+
+// ErrNotReadOnly is returned for an operator query which isn't a single read statement.
+var ErrNotReadOnly = errors.New("only a single read-only statement may be run")
+
+// Redacted replaces the values of the sensitive columns in the results of the operator queries.
+const Redacted = "[REDACTED]"
+
+// readCommands are the commands of the statements an operator query may run. A statement hiding
+// a write behind one of them, e.g. in a WITH clause, is still rejected by the read-only transaction.
+var readCommands = map[string]bool{
+	"SELECT":  true,
+	"WITH":    true,
+	"VALUES":  true,
+	"TABLE":   true,
+	"EXPLAIN": true,
+	"SHOW":    true,
+}
+
+// secretColumns hold the hashes of the tokens and the API keys, they are redacted from the results
+// of the operator queries with the encrypted columns.
+var secretColumns = []string{"token_hash", "key_hash"}
+
+// OperatorQuery is an ad-hoc read query run by an operator, see RunOperatorQuery.
+type OperatorQuery struct {
+	SQL      string
+	Operator string
+	// Timeout bounds the run of the query, MaxRows the rows returned, 0 returns them all
+	Timeout time.Duration
+	MaxRows int
+	// Redact are the columns redacted in addition to the sensitive columns of the keeper
+	Redact []string
+}
+
+// QueryResult is the result of an operator query. A value is nil for NULL, a string or a number.
+// Truncated reports whether the query returned more than its maximum rows.
+type QueryResult struct {
+	Columns   []string
+	Rows      [][]interface{}
+	Truncated bool
+}
+
+// RunOperatorQuery runs the read query of an operator in a read-only transaction across the users
+// and returns up to its maximum rows. The values of the sensitive columns, the encrypted ones, the
+// hashes of the tokens and the columns of q.Redact, are replaced by Redacted. The columns are matched
+// by their name in the result, so a query renaming one escapes the redaction, but the text of every
+// query is recorded in the audit log with the operator. No result is returned if it can't be recorded.
+func (bdk *BDKeeper) RunOperatorQuery(ctx context.Context, q OperatorQuery) (_ QueryResult, err error) {
+	defer bdk.observe("operator_query", "", time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	defer leave()
+
+	result, err := bdk.runOperatorQuery(ctx, q)
+
+	ev := models.AuditEvent{
+		Action:   models.AuditOperatorQuery,
+		Operator: q.Operator,
+		Detail:   q.SQL,
+		Success:  err == nil,
+	}
+	if auditErr := bdk.insertAuditEvent(ctx, ev); auditErr != nil {
+		return QueryResult{}, errors.Join(err, auditErr)
+	}
+
+	return result, err
+}
+
+// runOperatorQuery runs the query of RunOperatorQuery on a connection of its own, which the read-only
+// settings of the dialect may change for the transaction.
+func (bdk *BDKeeper) runOperatorQuery(ctx context.Context, q OperatorQuery) (QueryResult, error) {
+	if !isReadStatement(q.SQL) {
+		return QueryResult{}, ErrNotReadOnly
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, q.Timeout)
+	defer cancel()
+
+	conn, err := bdk.conn.Conn(ctx)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	defer conn.Close()
+
+	begin, end := bdk.dialect.readOnly(q.Timeout)
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	defer func() {
+		// Nothing is committed, and the connection is restored even once the context is done
+		_ = tx.Rollback()
+		for _, stmt := range end {
+			if _, err := conn.ExecContext(context.Background(), stmt); err != nil {
+				bdk.log.Error("failed to restore the connection of an operator query", zap.Error(err))
+				// The connection can't be returned to the pool while it is read only
+				_ = conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+			}
+		}
+	}()
+
+	for _, stmt := range begin {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return QueryResult{}, fmt.Errorf("failed to make the transaction read only: %w", err)
+		}
+	}
+	if bdk.rls {
+		if err := bdk.setTenant(withBypass(ctx), tx); err != nil {
+			return QueryResult{}, err
+		}
+	}
+
+	rows, err := tx.QueryContext(ctx, q.SQL)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	defer rows.Close()
+
+	return bdk.readQueryResult(rows, q)
+}
+
+// readQueryResult reads up to the maximum rows of the query, redacting the sensitive columns.
+func (bdk *BDKeeper) readQueryResult(rows *sql.Rows, q OperatorQuery) (QueryResult, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return QueryResult{}, err
+	}
+
+	redact := make(map[string]bool)
+	for column := range encryptedColumns {
+		redact[column] = true
+	}
+	for _, column := range append(append([]string{}, secretColumns...), q.Redact...) {
+		redact[strings.ToLower(strings.TrimSpace(column))] = true
+	}
+
+	result := QueryResult{Columns: columns, Rows: [][]interface{}{}}
+	for rows.Next() {
+		if q.MaxRows > 0 && len(result.Rows) == q.MaxRows {
+			result.Truncated = true
+			break
+		}
+
+		values := make([]interface{}, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return QueryResult{}, err
+		}
+		for i, column := range columns {
+			switch v := values[i].(type) {
+			case []byte:
+				values[i] = string(v)
+			case time.Time:
+				values[i] = v.UTC().Format(time.RFC3339Nano)
+			}
+			if values[i] != nil && redact[strings.ToLower(column)] {
+				values[i] = Redacted
+			}
+		}
+		result.Rows = append(result.Rows, values)
+	}
+
+	return result, rows.Err()
+}
+
+// isReadStatement reports whether the query is a single statement of a read command. A semicolon
+// anywhere but at the end rejects the query, even within a string literal or a comment.
+func isReadStatement(query string) bool {
+	query = strings.TrimSuffix(strings.TrimSpace(query), ";")
+	if strings.Contains(query, ";") {
+		return false
+	}
+
+	return readCommands[strings.ToUpper(command(query))]
+}
+
+// command returns the first word of the statement, after its leading comments and parentheses.
+func command(query string) string {
+	for {
+		query = strings.TrimLeft(query, "( \t\r\n")
+		switch {
+		case strings.HasPrefix(query, "--"):
+			_, query, _ = strings.Cut(query, "\n")
+		case strings.HasPrefix(query, "/*"):
+			_, query, _ = strings.Cut(query, "*/")
+		default:
+			end := strings.IndexFunc(query, func(r rune) bool {
+				return !unicode.IsLetter(r)
+			})
+			if end < 0 {
+				return query
+			}
+			return query[:end]
+		}
+	}
+}
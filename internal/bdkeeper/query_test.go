@@ -0,0 +1,133 @@
+package bdkeeper
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// operatorQueries returns the audited operator queries, the oldest first.
+func operatorQueries(t *testing.T, bdk *BDKeeper) []models.AuditEvent {
+	t.Helper()
+
+	rows, err := bdk.conn.Query(`SELECT operator, detail, success FROM audit_log WHERE action = ? ORDER BY id`,
+		string(models.AuditOperatorQuery))
+	require.NoError(t, err)
+	defer rows.Close()
+
+	var events []models.AuditEvent
+	for rows.Next() {
+		var ev models.AuditEvent
+		require.NoError(t, rows.Scan(&ev.Operator, &ev.Detail, &ev.Success))
+		events = append(events, ev)
+	}
+	require.NoError(t, rows.Err())
+
+	return events
+}
+
+func TestBDKeeper_RunOperatorQuery(t *testing.T) {
+	bdk := newSQLiteBDKeeper(t)
+	ctx := context.Background()
+	userID := addTestUser(t, bdk)
+	for i := 0; i < 3; i++ {
+		_, _, err := bdk.AddData(ctx, "UserCredentials", userID, fmt.Sprintf("entry-%d", i),
+			map[string]string{"login": fmt.Sprintf("login-%d", i), "password": "secret"})
+		require.NoError(t, err)
+	}
+	query := func(sql string, maxRows int, redact ...string) (QueryResult, error) {
+		return bdk.RunOperatorQuery(ctx, OperatorQuery{
+			SQL: sql, Operator: "alice", Timeout: time.Second, MaxRows: maxRows, Redact: redact,
+		})
+	}
+
+	// The sensitive columns are redacted, as are the configured ones
+	result, err := query("SELECT login, password, id FROM UserCredentials ORDER BY login", 10, "login")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"login", "password", "id"}, result.Columns)
+	require.Len(t, result.Rows, 3)
+	assert.Equal(t, []interface{}{Redacted, Redacted, "entry-0"}, result.Rows[0])
+	assert.False(t, result.Truncated)
+
+	result, err = query("SELECT username, password FROM Users", 10)
+	require.NoError(t, err)
+	require.Len(t, result.Rows, 1)
+	assert.Equal(t, Redacted, result.Rows[0][1])
+	assert.NotEqual(t, Redacted, result.Rows[0][0])
+
+	// The rows over the limit are dropped
+	result, err = query("-- the entries\nSELECT id FROM UserCredentials ORDER BY id;", 2)
+	require.NoError(t, err)
+	assert.Equal(t, [][]interface{}{{"entry-0"}, {"entry-1"}}, result.Rows)
+	assert.True(t, result.Truncated)
+
+	// The writes are rejected, before they run or by the read-only transaction
+	for _, sql := range []string{
+		"UPDATE UserCredentials SET login = 'mallory'",
+		"/* a read */ DELETE FROM UserCredentials",
+		"SELECT 1; DELETE FROM UserCredentials",
+		"",
+	} {
+		_, err := query(sql, 10)
+		assert.ErrorIs(t, err, ErrNotReadOnly, sql)
+	}
+	_, err = query("WITH x AS (SELECT 1) UPDATE UserCredentials SET login = 'mallory'", 10)
+	assert.Error(t, err)
+	result, err = query("SELECT count(*) FROM UserCredentials WHERE login = 'mallory'", 10)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), result.Rows[0][0])
+
+	// The connection is writable again for the keeper
+	_, _, err = bdk.AddData(ctx, "UserCredentials", userID, "entry-3", map[string]string{"login": "login-3", "password": "secret"})
+	require.NoError(t, err)
+
+	// Every query is audited with its operator, the rejected ones as failed
+	events := operatorQueries(t, bdk)
+	require.Len(t, events, 9)
+	assert.Equal(t, "alice", events[0].Operator)
+	assert.Equal(t, "SELECT login, password, id FROM UserCredentials ORDER BY login", events[0].Detail)
+	assert.True(t, events[0].Success)
+	assert.Equal(t, "UPDATE UserCredentials SET login = 'mallory'", events[3].Detail)
+	assert.False(t, events[3].Success)
+	assert.False(t, events[7].Success)
+}
+
+func TestBDKeeper_RunOperatorQueryUnaudited(t *testing.T) {
+	bdk := newSQLiteBDKeeper(t)
+	ctx := context.Background()
+
+	_, err := bdk.conn.ExecContext(ctx, "DROP TABLE audit_log")
+	require.NoError(t, err)
+
+	// A query which can't be audited returns no result
+	result, err := bdk.RunOperatorQuery(ctx, OperatorQuery{SQL: "SELECT 1", Operator: "alice", Timeout: time.Second})
+	assert.Error(t, err)
+	assert.Empty(t, result.Rows)
+}
+
+func TestIsReadStatement(t *testing.T) {
+	tests := []struct {
+		query string
+		read  bool
+	}{
+		{"SELECT 1", true},
+		{"select\n1;", true},
+		{"(SELECT 1) UNION (SELECT 2)", true},
+		{"WITH x AS (SELECT 1) SELECT * FROM x", true},
+		{"-- comment\n/* block */ EXPLAIN SELECT 1", true},
+		{"INSERT INTO Users VALUES (1)", false},
+		{"SELECT 1; SELECT 2", false},
+		{"SELECT ';'", false},
+		{"/* SELECT */ DROP TABLE Users", false},
+		{"SELECTX 1", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.read, isReadStatement(tt.query), tt.query)
+	}
+}
@@ -0,0 +1,105 @@
+package bdkeeper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/cache"
+)
+
+// recentWritesSize bounds the number of users whose writes are remembered, see SetReadReplica.
+const recentWritesSize = 1 << 16
+
+// writer identifies the user of a write, by id for the data and by name for the account.
+type writer struct {
+	id   int
+	name string
+}
+
+// SetReadReplica routes the plain reads of the keeper, GetData, GetAllData, GetPassword,
+// GetUserID and UserExists, to a read replica at dsn, while the writes stay on the primary.
+// A replica lags behind the primary, so the reads of a user who wrote within the last
+// window are still served by the primary and the user reads their own writes.
+// The writes are remembered in-process, another instance of the server doesn't see them.
+// A window of 0 or less routes all plain reads to the replica.
+// An empty dsn leaves all queries on the primary. Read replicas require PostgreSQL.
+func (bdk *BDKeeper) SetReadReplica(dsn string, window time.Duration) error {
+	if dsn == "" {
+		return nil
+	}
+
+	d, addr := dialectFor(dsn)
+	_, primaryPostgres := bdk.dialect.(postgresDialect)
+	if _, ok := d.(postgresDialect); !ok || !primaryPostgres {
+		return errors.New("read replicas require PostgreSQL")
+	}
+
+	replica, err := sql.Open(d.driverName(), addr)
+	if err != nil {
+		return err
+	}
+
+	return bdk.setReplica(replica, window)
+}
+
+// setReplica uses the database replica for the reads, the keeper owns it from now on.
+func (bdk *BDKeeper) setReplica(replica *sql.DB, window time.Duration) error {
+	if bdk.replica != nil {
+		replica.Close()
+		return errors.New("read replica is already set")
+	}
+
+	bdk.replica = replica
+	if window > 0 {
+		bdk.recentWrites = cache.New[writer, struct{}]("recent_writes", recentWritesSize, window)
+	}
+
+	return nil
+}
+
+// wrote remembers a write of the user, so their reads stay on the primary for a while.
+func (bdk *BDKeeper) wrote(w writer) {
+	if bdk.recentWrites != nil {
+		bdk.recentWrites.Add(w, struct{}{})
+	}
+}
+
+// reader returns the keeper the reads of the user run on: a copy using the replica,
+// or the keeper itself if it has no replica, is a transaction view or the user just wrote.
+func (bdk *BDKeeper) reader(w writer) *BDKeeper {
+	if bdk.replica == nil || bdk.tx != nil {
+		return bdk
+	}
+	if bdk.recentWrites != nil {
+		if _, ok := bdk.recentWrites.Get(w); ok {
+			return bdk
+		}
+	}
+
+	r := *bdk
+	r.conn = bdk.replica
+	r.ex = traceExecer{ex: bdk.replica, log: bdk.log}
+
+	return &r
+}
+
+// pingReplica checks the connectivity to the read replica, if any.
+func (bdk *BDKeeper) pingReplica(ctx context.Context) error {
+	if bdk.replica == nil {
+		return nil
+	}
+
+	return bdk.replica.PingContext(ctx)
+}
+
+// userWriter identifies a user by id.
+func userWriter(userID int) writer {
+	return writer{id: userID}
+}
+
+// accountWriter identifies a user by name.
+func accountWriter(username string) writer {
+	return writer{name: username}
+}
@@ -0,0 +1,78 @@
+package bdkeeper
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBDKeeper_ReadReplica(t *testing.T) {
+	// Инициализация sqlmock для основной базы и реплики
+	db, primary, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatalf("Error initializing mock database: %v", err)
+	}
+	defer db.Close()
+	replicaDB, replica, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatalf("Error initializing mock database: %v", err)
+	}
+
+	// Создание экземпляра BDKeeper через функцию newTestBDKeeper
+	bdk := newTestBDKeeper(t, db)
+	window := 50 * time.Millisecond
+	require.NoError(t, bdk.setReplica(replicaDB, window))
+	otherDB, _, err := sqlmock.New()
+	require.NoError(t, err)
+	assert.Error(t, bdk.setReplica(otherDB, window))
+	assert.Error(t, newSQLiteBDKeeper(t).SetReadReplica("postgres://replica/db", window))
+
+	ctx := context.Background()
+	userRow := func() *sqlmock.Rows { return sqlmock.NewRows([]string{"id"}).AddRow(7) }
+
+	// Чтение выполняется на реплике
+	replica.ExpectQuery("SELECT id FROM Users WHERE username = (.+)").WithArgs("alice").WillReturnRows(userRow())
+	_, err = bdk.GetUserID(ctx, "alice")
+	require.NoError(t, err)
+
+	// После записи чтения пользователя выполняются на основной базе, чтобы он видел свои изменения
+	primary.ExpectExec("INSERT INTO Users").WithArgs("alice", "hash").WillReturnResult(sqlmock.NewResult(7, 1))
+	primary.ExpectQuery("SELECT id FROM Users WHERE username = (.+)").WithArgs("alice").WillReturnRows(userRow())
+	require.NoError(t, bdk.AddUser(ctx, "alice", "hash"))
+	_, err = bdk.GetUserID(ctx, "alice")
+	require.NoError(t, err)
+
+	// Чтения других пользователей остаются на реплике
+	replica.ExpectQuery("SELECT COUNT(.+) FROM Users WHERE username = (.+)").WithArgs("bob").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	exists, err := bdk.UserExists(ctx, "bob")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	// По истечении окна чтения возвращаются на реплику
+	time.Sleep(2 * window)
+	replica.ExpectQuery("SELECT password FROM Users WHERE username = (.+)").WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow("hash"))
+	_, err = bdk.GetPassword(ctx, "alice")
+	require.NoError(t, err)
+
+	// Ping и Close охватывают обе базы
+	primary.ExpectPing()
+	replica.ExpectPing()
+	assert.True(t, bdk.Ping())
+
+	primary.ExpectClose()
+	replica.ExpectClose()
+	assert.True(t, bdk.Close())
+
+	// Проверяем, что все ожидания выполнены
+	for _, mock := range []sqlmock.Sqlmock{primary, replica} {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Не выполнены ожидания: %s", err)
+		}
+	}
+}
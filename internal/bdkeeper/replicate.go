@@ -0,0 +1,142 @@
+package bdkeeper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// replicaIgnored are the fields of a replicated entry which aren't written as columns: the identity of the entry,
+// its version written apart, the warnings of the read on the primary and the URL of the contents of a file.
+var replicaIgnored = map[string]bool{"id": true, "user_id": true, "updated_at": true, "deleted": true, models.DataWarning: true, models.ContentURLField: true}
+
+// ReplicateData stores the entries of the table as read from the primary server of a replication, keeping their ids,
+// 'updated_at' and deleted flags, in a transaction. The entries already at their version are skipped, a version
+// replaced is kept in the history. It returns the number of the entries changed.
+func (bdk *BDKeeper) ReplicateData(ctx context.Context, table string, userID int, rows []map[string]string) (_ int, err error) {
+	defer bdk.observe("replicate_data", table, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer leave()
+	defer bdk.audit(ctx, models.AuditReplicate, table, userID, "", &err)
+	bdk.wrote(userWriter(userID))
+
+	var replicated int
+	var latest time.Time
+	err = bdk.inTx(ctx, func(view *BDKeeper) error {
+		replicated, latest = 0, time.Time{}
+		for _, row := range rows {
+			changed, err := view.replicateEntry(ctx, view.ex, table, userID, row)
+			if err != nil {
+				return fmt.Errorf("entry %s/%s: %w", table, row["id"], err)
+			}
+			if !changed.IsZero() {
+				replicated++
+				if changed.After(latest) {
+					latest = changed
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if replicated > 0 {
+		bdk.changed(ctx, userID, models.VaultEvent{Table: table, UpdatedAt: latest})
+	}
+
+	return replicated, nil
+}
+
+// replicateEntry stores a replicated entry using the given execer. It returns the 'updated_at' of the entry
+// if it changed, the zero time if it was at its version already.
+func (bdk *BDKeeper) replicateEntry(ctx context.Context, ex execer, table string, userID int, row map[string]string) (time.Time, error) {
+	id := row["id"]
+	if id == "" {
+		return time.Time{}, errors.New("entry_id must be specified")
+	}
+	updatedAt, err := time.Parse(time.RFC3339Nano, row["updated_at"])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: invalid updated_at: %v", models.ErrInvalidChange, err)
+	}
+	updatedAt = updatedAt.UTC()
+	deleted, _ := strconv.ParseBool(row["deleted"])
+
+	fields, err := models.NormalizeFields(row)
+	if err != nil {
+		return time.Time{}, err
+	}
+	schema, err := bdk.tableColumns(ctx, ex, table)
+	if err != nil {
+		return time.Time{}, err
+	}
+	tbl, err := bdk.tableIdent(ctx, ex, table)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// The version stored on the replica, a legacy row has none
+	var owner int
+	var storedAt sql.NullTime
+	var storedDeleted sql.NullBool
+	query := fmt.Sprintf("SELECT user_id, updated_at, deleted FROM %s WHERE id = $1", tbl)
+	err = ex.QueryRowContext(ctx, bdk.dialect.rebind(query), id).Scan(&owner, &storedAt, &storedDeleted)
+	exists := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, fmt.Errorf("failed to get entry version: %w", err)
+	}
+	if exists && owner != userID {
+		// Entry ids are unique across all users
+		return time.Time{}, fmt.Errorf("%w: the entry belongs to another user", models.ErrInvalidChange)
+	}
+	if exists && storedAt.Valid && storedAt.Time.Equal(updatedAt) && storedDeleted.Bool == deleted {
+		return time.Time{}, nil
+	}
+
+	// The entry is written anew, so the columns the primary left NULL are NULL here too
+	if exists {
+		if err := bdk.saveVersion(ctx, ex, table, userID, id); err != nil {
+			return time.Time{}, err
+		}
+		query := fmt.Sprintf("DELETE FROM %s WHERE user_id = $1 AND id = $2", tbl)
+		if _, err := ex.ExecContext(ctx, bdk.dialect.rebind(query), userID, id); err != nil {
+			return time.Time{}, fmt.Errorf("failed to replace entry: %w", err)
+		}
+	}
+
+	keys := []string{schema.column("user_id"), schema.column("id"), schema.column("updated_at"), schema.column("deleted")}
+	values := []interface{}{userID, id, bdk.dialect.timeArg(updatedAt), deleted}
+	for key, value := range fields {
+		// An empty field is a NULL column on the primary, the derived columns are computed here
+		// and the blobs of the primary aren't in the store of the replica
+		if replicaIgnored[key] || derivedColumns[key] || blobColumns[key] || value == "" {
+			continue
+		}
+		arg, err := bdk.fieldArg(table, key, value)
+		if err != nil {
+			return time.Time{}, err
+		}
+		keys = append(keys, schema.column(key))
+		values = append(values, arg)
+	}
+
+	placeholders := make([]string, len(values))
+	for i := range values {
+		placeholders[i] = "$" + strconv.Itoa(i+1)
+	}
+	query = fmt.Sprintf("INSERT INTO %s(%s) VALUES(%s)", tbl, strings.Join(keys, ","), strings.Join(placeholders, ","))
+	if _, err := ex.ExecContext(ctx, bdk.dialect.rebind(query), values...); err != nil {
+		return time.Time{}, fmt.Errorf("failed to replicate entry: %w", err)
+	}
+
+	return updatedAt, bdk.writeDerived(ctx, ex, table, userID, []string{id})
+}
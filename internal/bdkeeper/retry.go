@@ -0,0 +1,69 @@
+package bdkeeper
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"github.com/wurt83ow/gophkeeper-server/internal/storage"
+	"go.uber.org/zap"
+)
+
+// snapshotRetries is the number of times a read-only snapshot aborted by a concurrent
+// transaction is run again before models.ErrRetrySync is returned.
+const snapshotRetries = 3
+
+// retryBackoff is the delay before the first retry, it doubles with every retry.
+const retryBackoff = 10 * time.Millisecond
+
+// WithSnapshot runs fn with a read-only view of the keeper whose methods see a single
+// consistent snapshot of all tables, e.g. to read several tables for a synchronization.
+// On PostgreSQL a snapshot aborted by a concurrent transaction is run again from the start
+// a bounded number of times, fn must therefore have no effects besides reading the view.
+// Called on a view, WithSnapshot runs fn on the transaction of the view.
+func (bdk *BDKeeper) WithSnapshot(ctx context.Context, fn func(tx storage.Keeper) error) (err error) {
+	defer bdk.observe("with_snapshot", "", time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+
+	return bdk.inSnapshot(ctx, "with_snapshot", func(view *BDKeeper) error {
+		return fn(view)
+	})
+}
+
+// inSnapshot runs fn with a view on a read-only snapshot transaction, retrying the whole
+// transaction with a jittered backoff while it is aborted by concurrent ones.
+// Each retry is reported to the metrics under the operation op.
+func (bdk *BDKeeper) inSnapshot(ctx context.Context, op string, fn func(view *BDKeeper) error) error {
+	if bdk.tx != nil {
+		return fn(bdk)
+	}
+
+	opts := bdk.dialect.snapshotTx(true)
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		err := bdk.inTxWith(ctx, opts, fn)
+		if !errors.Is(err, models.ErrRetrySync) || attempt == snapshotRetries {
+			return err
+		}
+
+		bdk.log.Warn("retrying snapshot aborted by a concurrent transaction",
+			logger.ContextFields(ctx, zap.String("op", op), zap.Int("attempt", attempt+1), zap.Error(err))...)
+		bdk.observeRetry(op, false)
+
+		// Half of the delay is random, so the concurrent transactions don't collide again
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,170 @@
+package bdkeeper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"github.com/wurt83ow/gophkeeper-server/internal/storage"
+)
+
+// errSerialization is the error of PostgreSQL for a transaction aborted by a concurrent one.
+var errSerialization = &pgconn.PgError{Code: serializationFailure, Message: "could not serialize access due to concurrent update"}
+
+func TestBDKeeper_WithSnapshotRetry(t *testing.T) {
+	// Инициализация sqlmock
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error initializing mock database: %v", err)
+	}
+	defer db.Close()
+
+	// Создание экземпляра BDKeeper через функцию newTestBDKeeper
+	bdk := newTestBDKeeper(t, db)
+	m := &recordingMetrics{}
+	bdk.SetMetrics(m)
+
+	// Снимок, прерванный параллельной транзакцией, выполняется заново целиком
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM Users`).WillReturnError(errSerialization)
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM Users`).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectCommit()
+
+	calls := 0
+	err = bdk.WithSnapshot(context.Background(), func(tx storage.Keeper) error {
+		calls++
+		_, err := tx.UserExists(context.Background(), "alice")
+		return err
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, []retryObservation{{op: "with_snapshot"}}, m.retries)
+
+	// После исчерпания попыток возвращается models.ErrRetrySync
+	for i := 0; i <= snapshotRetries; i++ {
+		mock.ExpectBegin()
+		mock.ExpectQuery(`SELECT COUNT\(\*\) FROM Users`).WillReturnError(errSerialization)
+		mock.ExpectRollback()
+	}
+
+	m.retries = nil
+	err = bdk.WithSnapshot(context.Background(), func(tx storage.Keeper) error {
+		_, err := tx.UserExists(context.Background(), "alice")
+		return err
+	})
+	assert.ErrorIs(t, err, models.ErrRetrySync)
+	assert.Len(t, m.retries, snapshotRetries+1)
+	assert.Equal(t, retryObservation{op: "with_snapshot", exhausted: true}, m.retries[snapshotRetries])
+
+	// Проверяем, что все ожидания выполнены
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Не выполнены ожидания: %s", err)
+	}
+}
+
+func TestBDKeeper_ApplyChangesRetrySync(t *testing.T) {
+	// Инициализация sqlmock
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error initializing mock database: %v", err)
+	}
+	defer db.Close()
+
+	// Создание экземпляра BDKeeper через функцию newTestBDKeeper
+	bdk := newTestBDKeeper(t, db)
+	m := &recordingMetrics{}
+	bdk.SetMetrics(m)
+
+	// Пакет изменений не повторяется, клиент отправляет его заново
+	mock.ExpectBegin()
+	expectColumns(mock, "TextData", "id", "user_id", "deleted", "updated_at")
+	mock.ExpectQuery("SELECT updated_at FROM \"textdata\"").
+		WithArgs(1, "entryID").
+		WillReturnError(errSerialization)
+	mock.ExpectRollback()
+
+	_, err = bdk.ApplyChanges(context.Background(), 1, []models.Change{
+		{Op: models.ChangeDelete, Table: "TextData", EntryID: "entryID", UpdatedAt: dbNow},
+	})
+	assert.ErrorIs(t, err, models.ErrRetrySync)
+	assert.Equal(t, []retryObservation{{op: "apply_changes", exhausted: true}}, m.retries)
+
+	// Проверяем, что все ожидания выполнены
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Не выполнены ожидания: %s", err)
+	}
+}
+
+func TestBDKeeper_SnapshotStressPostgres(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URI")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URI is not set")
+	}
+
+	nLogger, err := logger.NewLogger("info")
+	require.NoError(t, err)
+	bdk, err := NewBDKeeper(func() string { return dsn }, nLogger, nil)
+	require.NoError(t, err)
+	defer bdk.Close()
+
+	ctx := context.Background()
+	userID := addTestUser(t, bdk)
+	table, entryID := "UserCredentials", fmt.Sprintf("contended-%d", time.Now().UnixNano())
+	_, _, err = bdk.AddData(ctx, table, userID, entryID, map[string]string{"login": "alice", "password": "p"})
+	require.NoError(t, err)
+
+	// Writers update the same entry while readers take snapshots of several tables
+	const workers, rounds = 8, 20
+	errs := make(chan error, 2*workers*rounds)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				_, err := bdk.ApplyChanges(ctx, userID, []models.Change{{
+					Op: models.ChangeUpdate, Table: table, EntryID: entryID,
+					Fields:    map[string]string{"login": fmt.Sprintf("w%d-%d", w, i)},
+					UpdatedAt: time.Now().Add(time.Hour),
+				}})
+				errs <- err
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				errs <- bdk.WithSnapshot(ctx, func(tx storage.Keeper) error {
+					for _, tbl := range models.DataTables {
+						if _, err := tx.GetAllData(ctx, tbl, userID, models.DataQuery{InclDeleted: true}); err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	// No serialization failure reaches the callers untyped
+	for err := range errs {
+		if err == nil || errors.Is(err, models.ErrRetrySync) {
+			continue
+		}
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package bdkeeper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// tenantSetting is the PostgreSQL setting read by the row-level security policies
+// of the data tables, it must stay in line with the row-level security migration.
+const tenantSetting = "app.current_user_id"
+
+// errNoTenant is returned by the data methods of a keeper enforcing row-level security
+// if the context carries no authenticated user.
+var errNoTenant = errors.New("row-level security: no authenticated user in the context")
+
+// bypassKey marks the context of a background job reading the entries of all users.
+type bypassKey struct{}
+
+// EnableRowLevelSecurity makes every data operation run in a transaction that first sets
+// app.current_user_id to the user authenticated in the context, so the row-level security
+// policies of the data tables reject the rows of other users even if a wrong user_id is passed.
+// The policies only apply if the keeper connects with a role that doesn't own the tables.
+// The background jobs crossing users switch to bypassRole, a role with BYPASSRLS
+// the connecting role is a member of. Row-level security requires PostgreSQL.
+func (bdk *BDKeeper) EnableRowLevelSecurity(bypassRole string) error {
+	if _, ok := bdk.dialect.(postgresDialect); !ok {
+		return errors.New("row-level security requires PostgreSQL")
+	}
+	if bypassRole == "" {
+		return errors.New("row-level security requires a bypass role for the background jobs")
+	}
+
+	bdk.rls = true
+	bdk.bypassRole = bypassRole
+
+	return nil
+}
+
+// scoped runs fn with a transaction view carrying the user of the context if the keeper
+// enforces row-level security and isn't a view already, otherwise with the keeper itself.
+func scoped[T any](ctx context.Context, bdk *BDKeeper, fn func(view *BDKeeper) (T, error)) (T, error) {
+	if !bdk.rls || bdk.tx != nil {
+		return fn(bdk)
+	}
+
+	var result T
+	err := bdk.inTx(ctx, func(view *BDKeeper) (err error) {
+		result, err = fn(view)
+		return err
+	})
+
+	return result, err
+}
+
+// withBypass marks the context of a background job, whose transactions switch to the bypass role.
+func withBypass(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassKey{}, true)
+}
+
+// setTenant scopes the new transaction to the user authenticated in the context,
+// or to the bypass role for a background job.
+func (bdk *BDKeeper) setTenant(ctx context.Context, tx *sql.Tx) error {
+	if bypass, _ := ctx.Value(bypassKey{}).(bool); bypass {
+		_, err := tx.ExecContext(ctx, "SET LOCAL ROLE "+string(quoteIdent(bdk.bypassRole)))
+		return err
+	}
+
+	var keyUserID models.Key = "userID"
+	value, _ := ctx.Value(keyUserID).(string)
+	if _, err := strconv.Atoi(value); err != nil {
+		return errNoTenant
+	}
+
+	// The setting is local to the transaction, so it doesn't leak to the next user of the connection
+	_, err := tx.ExecContext(ctx, "SELECT set_config($1, $2, true)", tenantSetting, value)
+	return err
+}
+
+// asBypass runs fn with the transaction view switched to the bypass role, for a read of the rows of other users
+// which the user reaches through their shares, then scopes it back. Without row-level security fn just runs.
+func (bdk *BDKeeper) asBypass(ctx context.Context, fn func() error) error {
+	if !bdk.rls || bdk.tx == nil {
+		return fn()
+	}
+
+	if err := bdk.setTenant(withBypass(ctx), bdk.tx.tx); err != nil {
+		return err
+	}
+	err := fn()
+	if _, resetErr := bdk.tx.tx.ExecContext(ctx, "SET LOCAL ROLE NONE"); err == nil {
+		err = resetErr
+	}
+	if resetErr := bdk.setTenant(ctx, bdk.tx.tx); err == nil {
+		err = resetErr
+	}
+
+	return err
+}
+
+// asTenant runs fn with the transaction view scoped to another user, the owner of an entry shared with the user
+// of the context, then scopes it back. Without row-level security fn just runs.
+func (bdk *BDKeeper) asTenant(ctx context.Context, userID int, fn func() error) error {
+	if !bdk.rls || bdk.tx == nil {
+		return fn()
+	}
+
+	if _, err := bdk.tx.tx.ExecContext(ctx, "SELECT set_config($1, $2, true)", tenantSetting, strconv.Itoa(userID)); err != nil {
+		return err
+	}
+	err := fn()
+	if resetErr := bdk.setTenant(ctx, bdk.tx.tx); err == nil {
+		err = resetErr
+	}
+
+	return err
+}
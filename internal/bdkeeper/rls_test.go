@@ -0,0 +1,195 @@
+package bdkeeper
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// userContext returns a context carrying the user like the one built by the JWT middleware.
+func userContext(userID int) context.Context {
+	var keyUserID models.Key = "userID"
+	return context.WithValue(context.Background(), keyUserID, strconv.Itoa(userID))
+}
+
+func TestBDKeeper_RowLevelSecurity(t *testing.T) {
+	// Инициализация sqlmock
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error initializing mock database: %v", err)
+	}
+	defer db.Close()
+
+	// Создание экземпляра BDKeeper через функцию newTestBDKeeper
+	bdk := newTestBDKeeper(t, db)
+	bdk.SetHistoryLimit(0)
+	assert.Error(t, bdk.EnableRowLevelSecurity(""))
+	require.NoError(t, bdk.EnableRowLevelSecurity("gophkeeper_bypass"))
+
+	// Запрос выполняется в транзакции, в которой сначала задается пользователь из контекста
+	mock.ExpectBegin()
+	mock.ExpectExec(`SELECT set_config\(\$1, \$2, true\)`).
+		WithArgs(tenantSetting, "7").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	expectColumns(mock, "TextData", "id", "user_id", "deleted", "updated_at", "expires_at")
+	mock.ExpectQuery("UPDATE \"textdata\" SET deleted = FALSE(.+) RETURNING updated_at").
+		WithArgs(7, "entryID").
+		WillReturnRows(sqlmock.NewRows([]string{"updated_at"}).AddRow(dbNow))
+	mock.ExpectCommit()
+
+	_, err = bdk.UndeleteData(userContext(7), "TextData", 7, "entryID")
+	require.NoError(t, err)
+
+	// Без пользователя в контексте запрос не выполняется
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	_, err = bdk.UndeleteData(context.Background(), "TextData", 7, "entryID")
+	assert.ErrorIs(t, err, errNoTenant)
+
+	// Фоновая задача переключается на роль, обходящую политики
+	mock.ExpectBegin()
+	mock.ExpectExec(`SET LOCAL ROLE "gophkeeper_bypass"`).WillReturnResult(sqlmock.NewResult(0, 0))
+	for _, table := range models.DataTables {
+		if table != "TextData" { // read above
+			expectColumns(mock, table, "id", "user_id", "deleted", "updated_at", "expires_at")
+		}
+	}
+	for range models.DataTables {
+		mock.ExpectExec("UPDATE (.+) SET deleted = TRUE(.+)").WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+
+	expired, err := bdk.ExpireData(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, len(models.DataTables), expired)
+
+	// Проверяем, что все ожидания выполнены
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Не выполнены ожидания: %s", err)
+	}
+
+	// SQLite не поддерживает политики строк
+	assert.Error(t, newSQLiteBDKeeper(t).EnableRowLevelSecurity("gophkeeper_bypass"))
+}
+
+func TestBDKeeper_RowLevelSecurityPostgres(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URI")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URI is not set")
+	}
+	appURL, err := url.Parse(dsn)
+	if err != nil || appURL.Scheme == "" {
+		t.Skip("TEST_DATABASE_URI is not a URL")
+	}
+
+	nLogger, err := logger.NewLogger("info")
+	require.NoError(t, err)
+	owner, err := NewBDKeeper(func() string { return dsn }, nLogger, nil)
+	require.NoError(t, err)
+	defer owner.Close()
+
+	// The application connects with a role that doesn't own the tables, so the policies apply,
+	// and may switch to the bypass role for the background jobs
+	ctx := context.Background()
+	for _, stmt := range []string{
+		`DO $$ BEGIN
+			IF NOT EXISTS (SELECT FROM pg_roles WHERE rolname = 'gophkeeper_rls_app') THEN
+				CREATE ROLE gophkeeper_rls_app LOGIN PASSWORD 'rls';
+			END IF;
+			IF NOT EXISTS (SELECT FROM pg_roles WHERE rolname = 'gophkeeper_rls_bypass') THEN
+				CREATE ROLE gophkeeper_rls_bypass NOLOGIN BYPASSRLS;
+			END IF;
+		END $$`,
+		`GRANT USAGE ON SCHEMA public TO gophkeeper_rls_app, gophkeeper_rls_bypass`,
+		`GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO gophkeeper_rls_app, gophkeeper_rls_bypass`,
+		`GRANT USAGE, SELECT ON ALL SEQUENCES IN SCHEMA public TO gophkeeper_rls_app, gophkeeper_rls_bypass`,
+		`GRANT gophkeeper_rls_bypass TO gophkeeper_rls_app`,
+	} {
+		_, err := owner.conn.ExecContext(ctx, stmt)
+		require.NoError(t, err)
+	}
+
+	appURL.User = url.UserPassword("gophkeeper_rls_app", "rls")
+	db, err := sql.Open("pgx", appURL.String())
+	require.NoError(t, err)
+	app, err := NewBDKeeper(func() string { return appURL.String() }, nLogger, db)
+	require.NoError(t, err)
+	defer app.Close()
+	require.NoError(t, app.EnableRowLevelSecurity("gophkeeper_rls_bypass"))
+
+	alice, bob := addTestUser(t, owner), addTestUser(t, owner)
+	aliceCtx, bobCtx := userContext(alice), userContext(bob)
+	table, entryID := "UserCredentials", fmt.Sprintf("bob-%d", time.Now().UnixNano())
+
+	_, _, err = app.AddData(bobCtx, table, bob, entryID, map[string]string{"login": "bob", "password": "p"})
+	require.NoError(t, err)
+
+	// A request of Alice passing the user id of Bob by mistake sees none of his rows
+	_, err = app.GetData(aliceCtx, table, bob, entryID, true)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	data, err := app.GetAllData(aliceCtx, table, bob, models.DataQuery{InclDeleted: true, InclExpired: true})
+	require.NoError(t, err)
+	assert.Empty(t, data)
+
+	found, err := app.SearchData(aliceCtx, bob, "bob", nil, 10, false)
+	require.NoError(t, err)
+	assert.Empty(t, found[table])
+
+	updatedAt, err := app.UpdateData(aliceCtx, table, bob, entryID, map[string]string{"login": "mallory"})
+	require.NoError(t, err)
+	assert.True(t, updatedAt.IsZero())
+
+	_, err = app.DeleteData(aliceCtx, table, bob, entryID)
+	require.NoError(t, err)
+
+	// Nor can it write rows of Bob
+	_, _, err = app.AddData(aliceCtx, table, bob, "planted", map[string]string{"login": "mallory", "password": "p"})
+	assert.Error(t, err)
+
+	data, err = app.GetAllData(bobCtx, table, bob, models.DataQuery{})
+	require.NoError(t, err)
+	require.Len(t, data, 1)
+	assert.Equal(t, "bob", data[0]["login"])
+
+	// An entry of Bob shared with Alice is pulled by her, the entry is read past the policies through the share
+	_, err = app.ShareEntry(bobCtx, models.Share{OwnerID: bob, GranteeID: alice, Table: table, EntryID: entryID, Permission: models.ShareRead})
+	require.NoError(t, err)
+	shared, err := app.GetSharedWithUser(aliceCtx, alice, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, shared, 1)
+	assert.Equal(t, "bob", shared[0].Fields["login"])
+	result, err := app.Sync(aliceCtx, alice, time.Time{}, nil)
+	require.NoError(t, err)
+	require.Len(t, result.Shared, 1)
+	assert.Equal(t, entryID, result.Shared[0].EntryID)
+
+	// Without an authenticated user nothing is read
+	_, err = app.GetAllData(ctx, table, bob, models.DataQuery{})
+	assert.ErrorIs(t, err, errNoTenant)
+
+	// The expiry job reaches the entries of all users through the bypass role
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	_, _, err = app.AddData(bobCtx, table, bob, entryID+"-expiring", map[string]string{"login": "bob", "password": "p", models.ExpiresAtField: past})
+	require.NoError(t, err)
+
+	expired, err := app.ExpireData(ctx)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, expired, 1)
+
+	data, err = app.GetAllData(bobCtx, table, bob, models.DataQuery{})
+	require.NoError(t, err)
+	assert.Len(t, data, 1)
+}
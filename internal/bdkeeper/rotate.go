@@ -0,0 +1,638 @@
+package bdkeeper
+
+import (
+	"context"
+	"crypto/cipher"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// historyTable is the table of the prior versions, whose snapshots hold encrypted values too.
+const historyTable = "EntryHistory"
+
+// errEncryptionDisabled is returned by the key rotation of a keeper without encryption.
+var errEncryptionDisabled = errors.New("encryption is disabled")
+
+// RotationProgress reports the re-encryption of a table after a batch.
+type RotationProgress struct {
+	Table string
+	// Rotated is the number of rows re-encrypted so far, including by interrupted runs
+	Rotated int
+	Done    bool
+}
+
+// AddDecryptionKey makes a previous key known, so the values it encrypted are still read
+// while RotateKeys re-encrypts them with the current key. It requires EnableEncryption.
+func (bdk *BDKeeper) AddDecryptionKey(keyID string, key []byte) error {
+	if bdk.sealer == nil {
+		return errEncryptionDisabled
+	}
+
+	return bdk.sealer.addKey(keyID, key)
+}
+
+// RotateKeys re-encrypts the sensitive columns of all data tables and of the history with
+// the current key, including the values stored before encryption was enabled. The rows are
+// rotated in batches of batchSize, each in its own transaction recording the progress of
+// the table, so an interrupted rotation resumes where it stopped. report, if set, is called
+// after every batch. The server may run meanwhile, provided it has the same current key
+// and knows the previous ones: a row it changes during the rotation is already under the
+// current key and is skipped.
+func (bdk *BDKeeper) RotateKeys(ctx context.Context, batchSize int, report func(RotationProgress)) error {
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+
+	if bdk.sealer == nil {
+		return errEncryptionDisabled
+	}
+	if batchSize <= 0 {
+		return errors.New("batch size must be positive")
+	}
+	if bdk.rls {
+		ctx = withBypass(ctx)
+	}
+
+	for _, table := range rotationTables() {
+		progress, lastID, err := bdk.rotationCursor(ctx, table)
+		if err != nil {
+			return err
+		}
+
+		for !progress.Done {
+			err := bdk.inTx(ctx, func(view *BDKeeper) error {
+				var rotated int
+				var err error
+				if table == historyTable {
+					lastID, rotated, progress.Done, err = view.rotateHistory(ctx, lastID, batchSize)
+				} else {
+					lastID, rotated, progress.Done, err = view.rotateTable(ctx, table, lastID, batchSize)
+				}
+				if err != nil {
+					return err
+				}
+				progress.Rotated += rotated
+
+				return view.saveRotationCursor(ctx, progress, lastID)
+			})
+			if err != nil {
+				return fmt.Errorf("failed to rotate %s: %w", table, err)
+			}
+
+			if report != nil {
+				report(progress)
+			}
+		}
+	}
+
+	return nil
+}
+
+// rotationTables returns the tables re-encrypted by a rotation, in the order they are rotated.
+func rotationTables() []string {
+	return append(append([]string(nil), models.DataTables...), historyTable)
+}
+
+// rotationCursor returns the progress of the table under the current key and the last
+// rotated id, the progress made under another key is started over.
+func (bdk *BDKeeper) rotationCursor(ctx context.Context, table string) (RotationProgress, string, error) {
+	progress := RotationProgress{Table: table}
+
+	var keyID, lastID string
+	query := `SELECT key_id, last_id, rotated, done FROM KeyRotation WHERE table_name = $1`
+	err := bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), table).Scan(&keyID, &lastID, &progress.Rotated, &progress.Done)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && keyID != bdk.sealer.keyID) {
+		return RotationProgress{Table: table}, "", nil
+	}
+	if err != nil {
+		return progress, "", fmt.Errorf("failed to read the rotation progress: %w", err)
+	}
+
+	return progress, lastID, nil
+}
+
+// saveRotationCursor records the progress of the table under the current key.
+func (bdk *BDKeeper) saveRotationCursor(ctx context.Context, progress RotationProgress, lastID string) error {
+	query := fmt.Sprintf(`INSERT INTO KeyRotation (table_name, key_id, last_id, rotated, done, updated_at)
+		VALUES ($1, $2, $3, $4, $5, %[1]s)
+		ON CONFLICT (table_name) DO UPDATE SET key_id = $2, last_id = $3, rotated = $4, done = $5, updated_at = %[1]s`, bdk.dialect.now())
+	_, err := bdk.ex.ExecContext(ctx, bdk.dialect.rebind(query), progress.Table, bdk.sealer.keyID, lastID, progress.Rotated, progress.Done)
+	if err != nil {
+		return fmt.Errorf("failed to save the rotation progress: %w", err)
+	}
+
+	return nil
+}
+
+// rotateTable re-encrypts the batch of rows of a data table following lastID in the order of the ids.
+// It returns the last id of the batch, the number of re-encrypted rows and whether the table is done.
+func (bdk *BDKeeper) rotateTable(ctx context.Context, table, lastID string, batchSize int) (string, int, bool, error) {
+	schema, err := bdk.tableColumns(ctx, bdk.ex, table)
+	if err != nil {
+		return "", 0, false, err
+	}
+	tbl, err := bdk.tableIdent(ctx, bdk.ex, table)
+	if err != nil {
+		return "", 0, false, err
+	}
+	cols := []string{"id"}
+	for _, name := range schema.names {
+		if encryptedColumns[name] {
+			cols = append(cols, name)
+		}
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE id > $1 ORDER BY id LIMIT $2", schema.selectList(cols), tbl)
+	rows, err := bdk.ex.QueryContext(ctx, bdk.dialect.rebind(query), lastID, batchSize)
+	if err != nil {
+		return "", 0, false, err
+	}
+	data, err := scanStored(rows, len(cols))
+	rows.Close()
+	if err != nil {
+		return "", 0, false, err
+	}
+	if len(data) == 0 {
+		return lastID, 0, true, nil
+	}
+
+	var rotated int
+	for _, row := range data {
+		var setClauses, conditions []string
+		var args []interface{}
+		for i, col := range cols[1:] {
+			stored := row[i+1]
+			if !stored.Valid {
+				continue
+			}
+			value, changed, err := bdk.sealer.reseal(table, col, stored.String)
+			if err != nil {
+				return "", 0, false, fmt.Errorf("entry %s: %w", row[0].String, err)
+			}
+			if !changed {
+				continue
+			}
+
+			args = append(args, value, stored.String)
+			setClauses = append(setClauses, fmt.Sprintf("%s = $%d", schema.column(col), len(args)-1))
+			conditions = append(conditions, fmt.Sprintf("%s = $%d", schema.column(col), len(args)))
+			// The search text of a legacy plaintext value is dropped with it
+			if col == models.SearchColumn && schema.search {
+				setClauses = append(setClauses, schema.column(searchTextColumn)+" = NULL")
+			}
+		}
+		if len(setClauses) == 0 {
+			continue
+		}
+
+		// The stored values are compared, so a concurrent write isn't overwritten,
+		// and updated_at is kept, the content of the entry doesn't change
+		args = append(args, row[0].String)
+		update := fmt.Sprintf("UPDATE %s SET %s WHERE id = $%d AND %s",
+			tbl, strings.Join(setClauses, ", "), len(args), strings.Join(conditions, " AND "))
+		res, err := bdk.ex.ExecContext(ctx, bdk.dialect.rebind(update), args...)
+		if err != nil {
+			return "", 0, false, fmt.Errorf("entry %s: %w", row[0].String, err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			rotated++
+		}
+	}
+
+	return data[len(data)-1][0].String, rotated, len(data) < batchSize, nil
+}
+
+// rotateHistory re-encrypts the snapshots of the batch of versions following lastID.
+// The versions are never changed once stored, so they are updated without comparing them.
+func (bdk *BDKeeper) rotateHistory(ctx context.Context, lastID string, batchSize int) (string, int, bool, error) {
+	after, _ := strconv.Atoi(lastID)
+
+	query := `SELECT id, table_name, snapshot FROM EntryHistory WHERE id > $1 ORDER BY id LIMIT $2`
+	rows, err := bdk.ex.QueryContext(ctx, bdk.dialect.rebind(query), after, batchSize)
+	if err != nil {
+		return "", 0, false, err
+	}
+	data, err := scanStored(rows, 3)
+	rows.Close()
+	if err != nil {
+		return "", 0, false, err
+	}
+	if len(data) == 0 {
+		return lastID, 0, true, nil
+	}
+
+	var rotated int
+	for _, row := range data {
+		id, table := row[0].String, row[1].String
+
+		var snapshot map[string]string
+		if err := json.Unmarshal([]byte(row[2].String), &snapshot); err != nil {
+			return "", 0, false, fmt.Errorf("version %s: failed to decode snapshot: %w", id, err)
+		}
+
+		var changed bool
+		for col, stored := range snapshot {
+			if !encryptedColumns[col] {
+				continue
+			}
+			value, resealed, err := bdk.sealer.reseal(table, col, stored)
+			if err != nil {
+				return "", 0, false, fmt.Errorf("version %s: %w", id, err)
+			}
+			snapshot[col] = value
+			changed = changed || resealed
+		}
+		if !changed {
+			continue
+		}
+
+		encoded, err := json.Marshal(snapshot)
+		if err != nil {
+			return "", 0, false, err
+		}
+		update := `UPDATE EntryHistory SET snapshot = $1 WHERE id = $2`
+		versionID, err := strconv.Atoi(id)
+		if err != nil {
+			return "", 0, false, fmt.Errorf("version %s: %w", id, err)
+		}
+		if _, err := bdk.ex.ExecContext(ctx, bdk.dialect.rebind(update), string(encoded), versionID); err != nil {
+			return "", 0, false, fmt.Errorf("version %s: %w", id, err)
+		}
+		rotated++
+	}
+
+	return data[len(data)-1][0].String, rotated, len(data) < batchSize, nil
+}
+
+// VerifyRotation checks a random sample of up to sample rows of every data table and of the history:
+// their sensitive values must be encrypted with the current key and decrypt with it alone. It returns the first
+// problem found. Once the rotation is done and the sample passes, the rotation started by StartRotation is
+// recorded as verified, and the previous keys may be removed from the configuration.
+func (bdk *BDKeeper) VerifyRotation(ctx context.Context, sample int) error {
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+
+	if bdk.sealer == nil {
+		return errEncryptionDisabled
+	}
+	if bdk.rls {
+		ctx = withBypass(ctx)
+	}
+
+	return bdk.inTx(ctx, func(view *BDKeeper) error {
+		verifier := view.sealer.currentOnly()
+		for _, table := range models.DataTables {
+			schema, err := view.tableColumns(ctx, view.ex, table)
+			if err != nil {
+				return err
+			}
+			tbl, err := view.tableIdent(ctx, view.ex, table)
+			if err != nil {
+				return err
+			}
+
+			query := fmt.Sprintf("SELECT %s FROM %s ORDER BY random() LIMIT $1", schema.selectList(schema.names), tbl)
+			rows, err := view.ex.QueryContext(ctx, view.dialect.rebind(query), sample)
+			if err != nil {
+				return err
+			}
+			data, err := scanRows(rows, schema.names)
+			rows.Close()
+			if err != nil {
+				return err
+			}
+
+			for _, row := range data {
+				if err := verifier.verify(table, row); err != nil {
+					return fmt.Errorf("%s entry %s: %w", table, row["id"], err)
+				}
+			}
+		}
+
+		query := `SELECT id, table_name, snapshot FROM EntryHistory ORDER BY random() LIMIT $1`
+		rows, err := view.ex.QueryContext(ctx, view.dialect.rebind(query), sample)
+		if err != nil {
+			return err
+		}
+		data, err := scanStored(rows, 3)
+		rows.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, row := range data {
+			var snapshot map[string]string
+			if err := json.Unmarshal([]byte(row[2].String), &snapshot); err != nil {
+				return fmt.Errorf("version %s: failed to decode snapshot: %w", row[0].String, err)
+			}
+			if err := verifier.verify(row[1].String, snapshot); err != nil {
+				return fmt.Errorf("version %s: %w", row[0].String, err)
+			}
+		}
+
+		return view.markRotationVerified(ctx)
+	})
+}
+
+// markRotationVerified records the rotation to the current key as verified if every table is done.
+func (bdk *BDKeeper) markRotationVerified(ctx context.Context) error {
+	for _, table := range rotationTables() {
+		progress, _, err := bdk.rotationCursor(ctx, table)
+		if err != nil {
+			return err
+		}
+		if !progress.Done {
+			return nil
+		}
+	}
+
+	query := fmt.Sprintf(`UPDATE KeyRotationJobs SET verified_at = %s WHERE key_id = $1 AND verified_at IS NULL`, bdk.dialect.now())
+	if _, err := bdk.ex.ExecContext(ctx, bdk.dialect.rebind(query), bdk.sealer.keyID); err != nil {
+		return fmt.Errorf("failed to record the verification of the rotation: %w", err)
+	}
+
+	return nil
+}
+
+// StartRotation records the rotation to the current key from the previous keys made known by AddDecryptionKey,
+// before RotateKeys runs. A rotation to the same key started before keeps its previous keys too, the values
+// may still be encrypted with any of them. Until the rotation is verified, CheckRotationKeys requires them all.
+func (bdk *BDKeeper) StartRotation(ctx context.Context) error {
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+
+	if bdk.sealer == nil {
+		return errEncryptionDisabled
+	}
+
+	return bdk.inTx(ctx, func(view *BDKeeper) error {
+		previous := view.sealer.previousKeys()
+
+		var stored string
+		query := `SELECT previous_keys FROM KeyRotationJobs WHERE key_id = $1`
+		err := view.ex.QueryRowContext(ctx, view.dialect.rebind(query), view.sealer.keyID).Scan(&stored)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("failed to read the rotation: %w", err)
+		}
+		if err == nil {
+			previous = mergeKeyIDs(splitKeyIDs(stored), previous)
+			query = `UPDATE KeyRotationJobs SET previous_keys = $1 WHERE key_id = $2`
+		} else {
+			query = `INSERT INTO KeyRotationJobs (previous_keys, key_id) VALUES ($1, $2)`
+		}
+
+		_, err = view.ex.ExecContext(ctx, view.dialect.rebind(query), strings.Join(previous, ","), view.sealer.keyID)
+		if err != nil {
+			return fmt.Errorf("failed to record the rotation: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// RotationStatus returns the progress of the rotation to the current key started by StartRotation,
+// or models.ErrNotFound if there is none or encryption is disabled.
+func (bdk *BDKeeper) RotationStatus(ctx context.Context) (_ models.RotationStatus, err error) {
+	defer bdk.observe("rotation_status", "", time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return models.RotationStatus{}, err
+	}
+	defer leave()
+
+	if bdk.sealer == nil {
+		return models.RotationStatus{}, models.ErrNotFound
+	}
+	if bdk.rls {
+		ctx = withBypass(ctx)
+	}
+
+	status := models.RotationStatus{KeyID: bdk.sealer.keyID, Tables: make([]models.RotationTable, 0)}
+	var previous string
+	var verifiedAt sql.NullTime
+	query := `SELECT previous_keys, started_at, verified_at FROM KeyRotationJobs WHERE key_id = $1`
+	err = bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), status.KeyID).Scan(&previous, &status.StartedAt, &verifiedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.RotationStatus{}, models.ErrNotFound
+	}
+	if err != nil {
+		return models.RotationStatus{}, fmt.Errorf("failed to read the rotation: %w", err)
+	}
+	status.PreviousKeys = splitKeyIDs(previous)
+	status.StartedAt = status.StartedAt.UTC()
+	if verifiedAt.Valid {
+		at := verifiedAt.Time.UTC()
+		status.VerifiedAt, status.Verified = &at, true
+	}
+
+	var checked, total int
+	status.Done = true
+	for _, table := range rotationTables() {
+		progress, err := bdk.rotationTableStatus(ctx, table)
+		if err != nil {
+			return models.RotationStatus{}, err
+		}
+		status.Tables = append(status.Tables, progress)
+		status.Done = status.Done && progress.Done
+		checked += progress.Checked
+		total += progress.Total
+	}
+
+	switch {
+	case status.Done:
+		status.Percent = 100
+	case total > 0:
+		// The rows written meanwhile may be counted before the rotation reaches them
+		status.Percent = min(checked*100/total, 99)
+	}
+
+	return status, nil
+}
+
+// rotationTableStatus counts the rows of the table and the ones the rotation to the current key has passed.
+func (bdk *BDKeeper) rotationTableStatus(ctx context.Context, table string) (models.RotationTable, error) {
+	progress, lastID, err := bdk.rotationCursor(ctx, table)
+	if err != nil {
+		return models.RotationTable{}, err
+	}
+	status := models.RotationTable{Table: table, Rotated: progress.Rotated, Done: progress.Done}
+
+	tbl := internalIdent(historyTable)
+	var after interface{} = lastID
+	if table == historyTable {
+		after, _ = strconv.Atoi(lastID)
+	} else if tbl, err = bdk.tableIdent(ctx, bdk.ex, table); err != nil {
+		return models.RotationTable{}, err
+	}
+
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s", tbl)
+	if err := bdk.ex.QueryRowContext(ctx, query).Scan(&status.Total); err != nil {
+		return models.RotationTable{}, fmt.Errorf("failed to count %s: %w", table, err)
+	}
+	switch {
+	case status.Done:
+		status.Checked = status.Total
+	case lastID != "":
+		query = fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id <= $1", tbl)
+		if err := bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), after).Scan(&status.Checked); err != nil {
+			return models.RotationTable{}, fmt.Errorf("failed to count %s: %w", table, err)
+		}
+	}
+
+	return status, nil
+}
+
+// CheckRotationKeys is the self check of the encryption keys, run when the keeper is opened: every key
+// a rotation not verified yet may still need must be known, so the previous keys can't be removed from
+// the configuration until the rotation is done and verified.
+func (bdk *BDKeeper) CheckRotationKeys(ctx context.Context) error {
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+
+	query := `SELECT key_id, previous_keys FROM KeyRotationJobs WHERE verified_at IS NULL ORDER BY key_id`
+	rows, err := bdk.ex.QueryContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to read the rotations: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var keyID, previous string
+		if err := rows.Scan(&keyID, &previous); err != nil {
+			return fmt.Errorf("failed to scan rotation: %w", err)
+		}
+
+		var missing []string
+		for _, id := range append([]string{keyID}, splitKeyIDs(previous)...) {
+			if bdk.sealer == nil || bdk.sealer.keys[id] == nil {
+				missing = append(missing, id)
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("the rotation to encryption key %q isn't verified, keys %s are still needed",
+				keyID, strings.Join(missing, ", "))
+		}
+	}
+
+	return rows.Err()
+}
+
+// splitKeyIDs returns the key ids of a comma-separated list.
+func splitKeyIDs(list string) []string {
+	var ids []string
+	for _, id := range strings.Split(list, ",") {
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// mergeKeyIDs returns the sorted union of the key ids.
+func mergeKeyIDs(a, b []string) []string {
+	ids := append(append([]string(nil), a...), b...)
+	sort.Strings(ids)
+
+	return slices.Compact(ids)
+}
+
+// previousKeys returns the sorted ids of the keys known for decryption only.
+func (s *sealer) previousKeys() []string {
+	ids := make([]string, 0, len(s.keys))
+	for id := range s.keys {
+		if id != s.keyID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// currentOnly returns a sealer knowing the current key alone, the values it opens decrypt once
+// the previous keys are removed.
+func (s *sealer) currentOnly() *sealer {
+	return &sealer{keyID: s.keyID, keys: map[string]cipher.AEAD{s.keyID: s.keys[s.keyID]}}
+}
+
+// reseal returns the stored value of the column encrypted with the current key and whether it changed.
+func (s *sealer) reseal(table, column, stored string) (string, bool, error) {
+	if keyID, _, ok := parseSealed(stored); ok && keyID == s.keyID {
+		return stored, false, nil
+	}
+
+	plain, err := s.open(table, column, stored)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to decrypt %s: %w", column, err)
+	}
+	sealed, err := s.seal(table, column, plain)
+	if err != nil {
+		return "", false, err
+	}
+
+	return sealed, true, nil
+}
+
+// verify checks that the sensitive values of the row are encrypted with the current key and decrypt.
+func (s *sealer) verify(table string, row map[string]string) error {
+	for column, stored := range row {
+		if !encryptedColumns[column] || stored == "" {
+			continue
+		}
+
+		keyID, _, ok := parseSealed(stored)
+		if !ok {
+			return fmt.Errorf("%s isn't encrypted", column)
+		}
+		if keyID != s.keyID {
+			return fmt.Errorf("%s is encrypted with key %q", column, keyID)
+		}
+		if _, err := s.open(table, column, stored); err != nil {
+			return fmt.Errorf("failed to decrypt %s: %w", column, err)
+		}
+	}
+
+	return nil
+}
+
+// scanStored scans the rows of n columns as stored, without the normalization of scanRows.
+func scanStored(rows *sql.Rows, n int) ([][]sql.NullString, error) {
+	var data [][]sql.NullString
+	for rows.Next() {
+		row := make([]sql.NullString, n)
+		dest := make([]interface{}, n)
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		data = append(data, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows encountered an error: %w", err)
+	}
+
+	return data, nil
+}
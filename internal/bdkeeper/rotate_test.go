@@ -0,0 +1,167 @@
+package bdkeeper
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+func TestBDKeeper_RotateKeys(t *testing.T) {
+	bdk := newSQLiteBDKeeper(t)
+	ctx := context.Background()
+	userID := addTestUser(t, bdk)
+	table := "UserCredentials"
+	newKey := bytes.Repeat([]byte{9}, EncryptionKeySize)
+
+	assert.ErrorIs(t, bdk.RotateKeys(ctx, 10, nil), errEncryptionDisabled)
+	assert.ErrorIs(t, bdk.AddDecryptionKey("k1", testEncryptionKey), errEncryptionDisabled)
+
+	// A legacy plaintext entry, entries under the old key and a version in the history
+	_, _, err := bdk.AddData(ctx, table, userID, "entry-0", map[string]string{"login": "l", "password": "plain", "meta_info": "plain notes"})
+	require.NoError(t, err)
+	require.NoError(t, bdk.EnableEncryption("k1", testEncryptionKey))
+	for i := 1; i < 5; i++ {
+		_, _, err := bdk.AddData(ctx, table, userID, fmt.Sprintf("entry-%d", i), map[string]string{"login": "l", "password": fmt.Sprintf("secret-%d", i)})
+		require.NoError(t, err)
+	}
+	_, err = bdk.UpdateData(ctx, table, userID, "entry-1", map[string]string{"password": "changed"})
+	require.NoError(t, err)
+
+	// The server is restarted with the new key, still reading the values of the old one
+	require.NoError(t, bdk.EnableEncryption("k2", newKey))
+	require.NoError(t, bdk.AddDecryptionKey("k1", testEncryptionKey))
+	assert.Error(t, bdk.AddDecryptionKey("k2", newKey))
+	data, err := bdk.GetData(ctx, table, userID, "entry-2", false)
+	require.NoError(t, err)
+	assert.Equal(t, "secret-2", data["password"])
+	assert.Error(t, bdk.VerifyRotation(ctx, 10))
+
+	// An interrupted rotation resumes after the last rotated batch
+	stopCtx, stop := context.WithCancel(ctx)
+	err = bdk.RotateKeys(stopCtx, 2, func(p RotationProgress) { stop() })
+	require.ErrorIs(t, err, context.Canceled)
+
+	var reports []RotationProgress
+	require.NoError(t, bdk.RotateKeys(ctx, 2, func(p RotationProgress) { reports = append(reports, p) }))
+	assert.Equal(t, RotationProgress{Table: table, Rotated: 4}, reports[0])
+	final := make(map[string]RotationProgress)
+	for _, p := range reports {
+		final[p.Table] = p
+	}
+	assert.Equal(t, RotationProgress{Table: table, Rotated: 5, Done: true}, final[table])
+	assert.Equal(t, RotationProgress{Table: historyTable, Rotated: 1, Done: true}, final[historyTable])
+
+	// Every value is under the new key and still reads the same
+	for i := 0; i < 5; i++ {
+		assert.True(t, strings.HasPrefix(storedValue(t, bdk, table, "password", fmt.Sprintf("entry-%d", i)), sealedPrefix+"k2:"))
+	}
+	require.NoError(t, bdk.VerifyRotation(ctx, 10))
+
+	// The search text of the legacy meta information is dropped once it is encrypted
+	assert.Empty(t, storedValue(t, bdk, table, "coalesce(search_text, '')", "entry-0"))
+
+	all, err := bdk.GetAllData(ctx, table, userID, models.DataQuery{})
+	require.NoError(t, err)
+	require.Len(t, all, 5)
+	history, err := bdk.GetDataHistory(ctx, table, userID, "entry-1", 0)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, "secret-1", history[0].Snapshot["password"])
+
+	// A finished rotation has nothing left to do, the old key can be dropped
+	reports = nil
+	require.NoError(t, bdk.RotateKeys(ctx, 2, func(p RotationProgress) { reports = append(reports, p) }))
+	assert.Empty(t, reports)
+	require.NoError(t, bdk.EnableEncryption("k2", newKey))
+	_, err = bdk.GetData(ctx, table, userID, "entry-3", false)
+	require.NoError(t, err)
+}
+
+func TestBDKeeper_RotationJob(t *testing.T) {
+	bdk := newSQLiteBDKeeper(t)
+	ctx := context.Background()
+	userID := addTestUser(t, bdk)
+	table := "UserCredentials"
+	newKey := bytes.Repeat([]byte{9}, EncryptionKeySize)
+
+	// A database seeded under the old key, with a version in the history
+	require.NoError(t, bdk.EnableEncryption("k1", testEncryptionKey))
+	for i := 0; i < 6; i++ {
+		_, _, err := bdk.AddData(ctx, table, userID, fmt.Sprintf("entry-%d", i), map[string]string{"login": "l", "password": fmt.Sprintf("secret-%d", i)})
+		require.NoError(t, err)
+	}
+	_, err := bdk.UpdateData(ctx, table, userID, "entry-0", map[string]string{"password": "changed"})
+	require.NoError(t, err)
+	_, err = bdk.RotationStatus(ctx)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	// The server restarted with the new key and the old one records the rotation
+	require.NoError(t, bdk.EnableEncryption("k2", newKey))
+	require.NoError(t, bdk.AddDecryptionKey("k1", testEncryptionKey))
+	require.NoError(t, bdk.StartRotation(ctx))
+	require.NoError(t, bdk.CheckRotationKeys(ctx))
+
+	// The rotation is interrupted midway
+	stopCtx, stop := context.WithCancel(ctx)
+	batches := 0
+	err = bdk.RotateKeys(stopCtx, 2, func(p RotationProgress) {
+		if batches++; batches == 2 {
+			stop()
+		}
+	})
+	require.ErrorIs(t, err, context.Canceled)
+
+	status, err := bdk.RotationStatus(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "k2", status.KeyID)
+	assert.Equal(t, []string{"k1"}, status.PreviousKeys)
+	assert.False(t, status.Done)
+	assert.False(t, status.Verified)
+	assert.Equal(t, 4*100/7, status.Percent)
+	assert.Equal(t, models.RotationTable{Table: table, Rotated: 4, Checked: 4, Total: 6}, status.Tables[0])
+
+	// The entries written during the rotation use the new key
+	_, _, err = bdk.AddData(ctx, table, userID, "entry-new", map[string]string{"login": "l", "password": "fresh"})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(storedValue(t, bdk, table, "password", "entry-new"), sealedPrefix+"k2:"))
+
+	// The old key can't be dropped before the rotation is verified
+	require.NoError(t, bdk.EnableEncryption("k2", newKey))
+	err = bdk.CheckRotationKeys(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "k1")
+
+	// The rotation resumes after its last batch
+	require.NoError(t, bdk.AddDecryptionKey("k1", testEncryptionKey))
+	require.NoError(t, bdk.StartRotation(ctx))
+	require.NoError(t, bdk.RotateKeys(ctx, 2, nil))
+	require.NoError(t, bdk.VerifyRotation(ctx, 100))
+
+	status, err = bdk.RotationStatus(ctx)
+	require.NoError(t, err)
+	assert.True(t, status.Done)
+	assert.True(t, status.Verified)
+	assert.NotNil(t, status.VerifiedAt)
+	assert.Equal(t, 100, status.Percent)
+	assert.Equal(t, models.RotationTable{Table: table, Rotated: 6, Checked: 7, Total: 7, Done: true}, status.Tables[0])
+
+	// Every row decrypts with the new key alone
+	require.NoError(t, bdk.EnableEncryption("k2", newKey))
+	require.NoError(t, bdk.CheckRotationKeys(ctx))
+	all, err := bdk.GetAllData(ctx, table, userID, models.DataQuery{})
+	require.NoError(t, err)
+	require.Len(t, all, 7)
+	for _, row := range all {
+		assert.True(t, strings.HasPrefix(storedValue(t, bdk, table, "password", row["id"]), sealedPrefix+"k2:"))
+	}
+	history, err := bdk.GetDataHistory(ctx, table, userID, "entry-0", 0)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, "secret-0", history[0].Snapshot["password"])
+}
@@ -0,0 +1,210 @@
+package bdkeeper
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"go.uber.org/zap"
+)
+
+// tableSchema holds the columns of a table. Clients name the columns in lower case,
+// while a column created with a quoted identifier keeps its case in the database.
+type tableSchema struct {
+	// names are the normalized column names in the order of the table
+	names []string
+	// raw maps the normalized names to the names stored in the database
+	raw map[string]string
+	// mixedCase lists the stored names which aren't in lower case
+	mixedCase []string
+	// duplicates lists the stored names which differ from an earlier column only by case
+	duplicates []string
+	// checksum reports whether the table has the checksum column, which isn't one of the names
+	checksum bool
+	// size reports whether the table has the payload size column, which isn't one of the names either
+	size bool
+	// search reports whether the table has the search text column, which isn't one of the names either
+	search bool
+	// blob reports whether the table has the blob columns of the files, which aren't names either
+	blob bool
+}
+
+// newTableSchema creates the schema of a table from the stored column names.
+// Of the columns differing only by case the first one is used. The checksum, the payload size,
+// the search text and the blob columns are kept by the server, so they are left out of the names the clients
+// read and write.
+func newTableSchema(raw []string) *tableSchema {
+	s := &tableSchema{raw: make(map[string]string, len(raw))}
+	for _, col := range raw {
+		name := strings.ToLower(col)
+		if name == checksumColumn {
+			s.checksum = true
+			continue
+		}
+		if name == payloadSizeColumn {
+			s.size = true
+			continue
+		}
+		if name == searchTextColumn {
+			s.search = true
+			continue
+		}
+		if blobColumns[name] {
+			s.blob = true
+			continue
+		}
+		if name != col {
+			s.mixedCase = append(s.mixedCase, col)
+		}
+		if _, ok := s.raw[name]; ok {
+			s.duplicates = append(s.duplicates, col)
+			continue
+		}
+		s.raw[name] = col
+		s.names = append(s.names, name)
+	}
+
+	return s
+}
+
+// known reports whether the table has columns, that is whether it exists.
+func (s *tableSchema) known() bool {
+	return len(s.names) > 0 || s.derived()
+}
+
+// derived reports whether the table has any of the columns derived from the payload of the entries.
+func (s *tableSchema) derived() bool {
+	return s.checksum || s.size || s.search
+}
+
+// column returns the quoted identifier of the column with the normalized name.
+// A name unknown to the table is quoted as given, so the database reports it.
+func (s *tableSchema) column(name string) string {
+	if col, ok := s.raw[name]; ok {
+		return string(quoteIdent(col))
+	}
+
+	return string(quoteIdent(name))
+}
+
+// rawName returns the stored name of the column with the normalized name.
+func (s *tableSchema) rawName(name string) string {
+	if col, ok := s.raw[name]; ok {
+		return col
+	}
+
+	return name
+}
+
+// selectList returns the quoted identifiers of the columns with the normalized names, separated by commas.
+func (s *tableSchema) selectList(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = s.column(name)
+	}
+
+	return strings.Join(quoted, ",")
+}
+
+// identifier is a quoted SQL identifier, safe to put into a query as it is.
+// The table names of the queries are of this type, which ident_test.go checks.
+type identifier string
+
+// quoteIdent quotes the identifier for PostgreSQL and SQLite, doubling the quotes inside it.
+// Several parts are qualified names, such as a schema and a table, each part is quoted on its own.
+func quoteIdent(parts ...string) identifier {
+	quoted := make([]string, len(parts))
+	for i, part := range parts {
+		quoted[i] = `"` + strings.ReplaceAll(part, `"`, `""`) + `"`
+	}
+
+	return identifier(strings.Join(quoted, "."))
+}
+
+// tableIdent returns the quoted identifier of the data table, which must exist in the database: a name
+// which isn't one of models.DataTables, or isn't in the columns cache yet, is rejected before it gets near
+// a query. The table names of the entry paths reach the keeper as the clients send them, so the other
+// tables of the database, the users' or the folders', are never taken for data tables.
+// PostgreSQL folds the unquoted names of the migrations to lower case, so the quoted
+// identifier is in lower case too, SQLite doesn't mind the case of identifiers.
+func (bdk *BDKeeper) tableIdent(ctx context.Context, ex execer, table string) (identifier, error) {
+	if !models.IsDataTable(table) {
+		return "", fmt.Errorf("%w: unknown table %q", models.ErrInvalidQuery, table)
+	}
+	schema, err := bdk.tableColumns(ctx, ex, table)
+	if err != nil {
+		return "", err
+	}
+	if !schema.known() {
+		return "", fmt.Errorf("%w: unknown table %q", models.ErrInvalidQuery, table)
+	}
+
+	return quoteIdent(strings.ToLower(table)), nil
+}
+
+// internalTables are the tables of the rows of the users other than the data tables: those of the folder,
+// the share and the upload code, and the bookkeeping of the keeper. They are named by the keeper only, never
+// by a request, and are quoted by internalIdent.
+var internalTables = map[string]bool{
+	historyTable: true, auditTable: true, refreshTokensTable: true, loginHistoryTable: true, apiKeysTable: true,
+	emailTokensTable: true, devicesTable: true, userOperationsTable: true, uploadSessionsTable: true,
+	foldersTable: true, sharedEntriesTable: true,
+}
+
+// internalIdent returns the quoted identifier of one of the internalTables, in lower case like tableIdent's.
+// Another name is a bug of the keeper, it panics rather than reaching a query.
+func internalIdent(table string) identifier {
+	if !internalTables[table] {
+		panic(fmt.Sprintf("bdkeeper: %q is not an internal table", table))
+	}
+
+	return quoteIdent(strings.ToLower(table))
+}
+
+// checkColumns logs a warning for every data table with mixed-case columns, which only
+// work because the identifiers are quoted, and with columns differing only by case,
+// of which clients can only reach the first one. It also checks that the synchronization columns
+// can't be NULL: until the migrations enforce it, the synchronizations read the NULL values of
+// the legacy rows as not deleted and updated now. The usernames are compared by their skeletons
+// once the migrations added the column.
+func (bdk *BDKeeper) checkColumns(ctx context.Context) error {
+	// The column names of the users are read afresh, they aren't cached as the data tables' are
+	users, err := bdk.readColumns(ctx, bdk.ex, usersTable)
+	if err != nil {
+		return err
+	}
+	bdk.skeletons = slices.ContainsFunc(users, func(col string) bool {
+		return strings.EqualFold(col, "username_skeleton")
+	})
+
+	bdk.legacySync = false
+	for _, table := range models.DataTables {
+		schema, err := bdk.tableColumns(ctx, bdk.ex, table)
+		if err != nil {
+			return err
+		}
+		if len(schema.mixedCase) > 0 {
+			bdk.log.Warn("table has mixed-case columns",
+				zap.String("table", table), zap.Strings("columns", schema.mixedCase))
+		}
+		if len(schema.duplicates) > 0 {
+			bdk.log.Warn("table has columns differing only by case, they are ignored",
+				zap.String("table", table), zap.Strings("columns", schema.duplicates))
+		}
+
+		var enforced bool
+		query, args := bdk.dialect.syncConstraintsQuery(table)
+		if err := bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), args...).Scan(&enforced); err != nil {
+			return fmt.Errorf("failed to check the synchronization columns of %s: %w", table, err)
+		}
+		if !enforced {
+			bdk.log.Warn("table has nullable synchronization columns, they are read as not deleted and updated now",
+				zap.String("table", table))
+			bdk.legacySync = true
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,376 @@
+package bdkeeper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"go.uber.org/zap/zapcore"
+)
+
+// recordingLog keeps the messages logged by the keeper, prefixed with their level.
+type recordingLog struct {
+	messages []string
+}
+
+func (l *recordingLog) Debug(msg string, _ ...zapcore.Field) {}
+
+func (l *recordingLog) Info(msg string, _ ...zapcore.Field) {
+	l.messages = append(l.messages, "info: "+msg)
+}
+
+func (l *recordingLog) Warn(msg string, _ ...zapcore.Field) {
+	l.messages = append(l.messages, "warn: "+msg)
+}
+
+func (l *recordingLog) Error(msg string, _ ...zapcore.Field) {
+	l.messages = append(l.messages, "error: "+msg)
+}
+
+func TestBDKeeper_MixedCaseColumn(t *testing.T) {
+	ctx := context.Background()
+	dsn := sqliteScheme + filepath.Join(t.TempDir(), "gkeeper.db")
+
+	// A legacy migration created a quoted mixed-case column
+	bdk, err := NewBDKeeper(func() string { return dsn }, &recordingLog{}, nil)
+	require.NoError(t, err)
+	_, err = bdk.conn.ExecContext(ctx, `ALTER TABLE UserCredentials ADD COLUMN "LegacyNote" TEXT`)
+	require.NoError(t, err)
+	require.True(t, bdk.Close())
+
+	// The startup check flags it
+	log := &recordingLog{}
+	bdk, err = NewBDKeeper(func() string { return dsn }, log, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { bdk.Close() })
+	assert.Contains(t, log.messages, "warn: table has mixed-case columns")
+	// The up-to-date schema isn't reported as a failed migration
+	assert.NotContains(t, log.messages, "error: Error while performing migration: ")
+
+	userID := addTestUser(t, bdk)
+
+	// The column is reached by its name in any case and returned in lower case
+	_, _, err = bdk.AddData(ctx, "UserCredentials", userID, "entry", map[string]string{"login": "alice", "password": "p", "LegacyNote": "first"})
+	require.NoError(t, err)
+
+	row, err := bdk.GetData(ctx, "UserCredentials", userID, "entry", false)
+	require.NoError(t, err)
+	assert.Equal(t, "first", row["legacynote"])
+
+	_, err = bdk.UpdateData(ctx, "UserCredentials", userID, "entry", map[string]string{"legacynote": "second"})
+	require.NoError(t, err)
+
+	_, err = bdk.BulkInsert(ctx, "UserCredentials", userID, []map[string]string{{"id": "bulk", "login": "bob", "password": "p", "LEGACYNOTE": "bulk"}})
+	require.NoError(t, err)
+
+	data, err := bdk.GetAllData(ctx, "UserCredentials", userID, models.DataQuery{
+		Columns: []string{"LegacyNote"},
+		Filter:  models.Filter{{Column: "legacynote", Op: models.FilterEq, Value: "second"}},
+	})
+	require.NoError(t, err)
+	require.Len(t, data, 1)
+	assert.Equal(t, "entry", data[0]["id"])
+	assert.Equal(t, "second", data[0]["legacynote"])
+
+	versions, err := bdk.GetDataHistory(ctx, "UserCredentials", userID, "entry", 0)
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+	assert.Equal(t, "first", versions[0].Snapshot["legacynote"])
+
+	_, err = bdk.DeleteData(ctx, "UserCredentials", userID, "entry")
+	require.NoError(t, err)
+
+	// Names differing only by case are the same field
+	_, _, err = bdk.AddData(ctx, "UserCredentials", userID, "duplicate", map[string]string{"login": "a", "Login": "b"})
+	assert.ErrorIs(t, err, models.ErrInvalidChange)
+	_, err = bdk.UpdateData(ctx, "UserCredentials", userID, "bulk", map[string]string{"legacynote": "a", "LegacyNote": "b"})
+	assert.ErrorIs(t, err, models.ErrInvalidChange)
+	_, err = bdk.BulkInsert(ctx, "UserCredentials", userID, []map[string]string{{"id": "x", "ID": "y"}})
+	assert.ErrorIs(t, err, models.ErrInvalidChange)
+}
+
+func TestBDKeeper_QuotedColumns(t *testing.T) {
+	// Инициализация sqlmock
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error initializing mock database: %v", err)
+	}
+	defer db.Close()
+
+	// Создание экземпляра BDKeeper через функцию newTestBDKeeper
+	bdk := newTestBDKeeper(t, db)
+	bdk.SetHistoryLimit(0)
+
+	// PostgreSQL сохраняет регистр столбца, созданного в кавычках
+	mock.ExpectBegin()
+	expectColumns(mock, "TextData", "id", "user_id", "LegacyNote", "updated_at")
+
+	mock.ExpectPrepare(`INSERT INTO "textdata"\("user_id","id","LegacyNote","updated_at"\) VALUES(.+) RETURNING updated_at`)
+	mock.ExpectQuery(`INSERT INTO "textdata"(.+) RETURNING updated_at`).
+		WithArgs(1, "entryID", "note").
+		WillReturnRows(sqlmock.NewRows([]string{"updated_at"}).AddRow(dbNow))
+	mock.ExpectCommit()
+
+	_, _, err = bdk.AddData(context.Background(), "TextData", 1, "entryID", map[string]string{"legacynote": "note"})
+	require.NoError(t, err)
+
+	// Неизвестное поле заключается в кавычки, так что его имя не может изменить запрос
+	mock.ExpectBegin()
+	expectNoShare(mock, 1, "TextData", "entryID")
+	mock.ExpectPrepare(`UPDATE "textdata" SET "x"" = 1; drop table users; --" = \$1,(.+)`).WillReturnError(assert.AnError)
+	mock.ExpectRollback()
+
+	_, err = bdk.UpdateData(context.Background(), "TextData", 1, "entryID", map[string]string{`x" = 1; DROP TABLE users; --`: "v"})
+	assert.ErrorIs(t, err, assert.AnError)
+
+	// Проверяем, что все ожидания выполнены
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Не выполнены ожидания: %s", err)
+	}
+}
+
+func TestTableSchema(t *testing.T) {
+	schema := newTableSchema([]string{"id", "Note", "note", "meta_info"})
+
+	assert.Equal(t, []string{"id", "note", "meta_info"}, schema.names)
+	assert.Equal(t, []string{"Note"}, schema.mixedCase)
+	assert.Equal(t, []string{"note"}, schema.duplicates)
+	assert.Equal(t, `"Note"`, schema.column("note"))
+	assert.Equal(t, `"unknown"`, schema.column("unknown"))
+	assert.Equal(t, `"id","Note"`, schema.selectList([]string{"id", "note"}))
+	assert.False(t, schema.checksum)
+
+	// The checksum column is kept by the server, the clients don't see it
+	schema = newTableSchema([]string{"id", "Checksum", "meta_info"})
+	assert.Equal(t, []string{"id", "meta_info"}, schema.names)
+	assert.True(t, schema.checksum)
+}
+
+func TestBDKeeper_LegacySyncColumns(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "gkeeper.db")
+	conn, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	conn.SetMaxOpenConns(1)
+
+	// The schema before the back-fill, migrated step by step below
+	driver, dir, err := sqliteDialect{}.migrationDriver(conn)
+	require.NoError(t, err)
+	m, err := migrate.NewWithDatabaseInstance("file://../../"+dir, "sqlite", driver)
+	require.NoError(t, err)
+	require.NoError(t, m.Migrate(27))
+
+	log := &recordingLog{}
+	bdk, err := NewBDKeeper(func() string { return sqliteScheme + path }, log, conn)
+	require.NoError(t, err)
+	t.Cleanup(func() { bdk.Close() })
+	userID := addTestUser(t, bdk)
+	lastSync := time.Now().Add(-time.Second)
+
+	// Rows stored by the legacy clients, bypassing the API
+	_, err = conn.ExecContext(ctx, `INSERT INTO UserCredentials (id, user_id, login, password, meta_info, deleted, updated_at)
+		VALUES ('legacy', ?1, 'alice', 'p', '', NULL, NULL), ('legacy-deleted', ?1, 'bob', 'p', '', NULL, '2020-01-01T00:00:00.000Z'),
+			('legacy-updated', ?1, 'carol', 'p', '', FALSE, NULL)`, userID)
+	require.NoError(t, err)
+	legacy := []string{"legacy", "legacy-deleted", "legacy-updated"}
+	// The rows without an update time have to reach the clients which synchronized already
+	unsynced := []string{"legacy", "legacy-updated"}
+
+	synced := func(since time.Time) []string {
+		data, err := bdk.GetAllData(ctx, "UserCredentials", userID, models.DataQuery{LastSync: since})
+		require.NoError(t, err)
+		ids := make([]string, 0, len(data))
+		for _, row := range data {
+			ids = append(ids, row["id"])
+		}
+		return ids
+	}
+	assertSynced := func(stage string) {
+		// A full synchronization pulls every row, an incremental one those without a time or updated since
+		assert.ElementsMatch(t, legacy, synced(time.Time{}), stage)
+		assert.ElementsMatch(t, unsynced, synced(lastSync), stage)
+		// The tables created by the later migrations don't exist yet, only the legacy rows' is estimated
+		pending, err := bdk.pendingTable(ctx, "UserCredentials", userID, time.Time{})
+		require.NoError(t, err)
+		assert.Equal(t, 3, pending.Entries, stage)
+	}
+
+	// Before the back-fill the check finds the columns nullable and the rows are read defensively
+	require.NoError(t, bdk.checkColumns(ctx))
+	assert.True(t, bdk.legacySync)
+	assert.Contains(t, log.messages, "warn: table has nullable synchronization columns, they are read as not deleted and updated now")
+	assertSynced("before")
+
+	// An interrupted back-fill leaves the columns nullable and the rows it didn't reach legacy
+	require.NoError(t, bdk.createBackfillTable(ctx))
+	require.NoError(t, m.Migrate(28))
+	syncColumns := dataMigrationNamed(t, "sync_columns")
+	interrupted := syncColumns
+	interrupted.fill = func(bdk *BDKeeper, ctx context.Context, table, lastID string, batchSize int) (string, int, bool, error) {
+		if lastID != "" {
+			return "", 0, false, errors.New("interrupted")
+		}
+		return syncColumns.fill(bdk, ctx, table, lastID, batchSize)
+	}
+	require.Error(t, bdk.runDataMigration(ctx, interrupted, 1))
+	var nulls int
+	require.NoError(t, conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM UserCredentials WHERE deleted IS NULL OR updated_at IS NULL`).Scan(&nulls))
+	assert.Equal(t, 2, nulls)
+	require.NoError(t, bdk.checkColumns(ctx))
+	assert.True(t, bdk.legacySync)
+	assertSynced("during")
+
+	// The back-fill resumes after the last batch, then the columns are enforced and read as they are
+	require.NoError(t, bdk.migrateUp(ctx, m, 1))
+	var filled int
+	var done bool
+	require.NoError(t, conn.QueryRowContext(ctx, `SELECT filled, done FROM DataMigrations WHERE name = 'sync_columns' AND table_name = 'UserCredentials'`).Scan(&filled, &done))
+	assert.Equal(t, 3, filled)
+	assert.True(t, done)
+	log.messages = nil
+	require.NoError(t, bdk.checkColumns(ctx))
+	assert.False(t, bdk.legacySync)
+	assert.Empty(t, log.messages)
+	assertSynced("after")
+
+	// A NULL synchronization column is rejected, an omitted one gets its default
+	_, err = conn.ExecContext(ctx, `INSERT INTO UserCredentials (id, user_id, login, password, deleted) VALUES ('null', ?1, 'dave', 'p', NULL)`, userID)
+	assert.Error(t, err)
+	_, err = conn.ExecContext(ctx, `UPDATE UserCredentials SET updated_at = NULL WHERE id = 'legacy'`)
+	assert.Error(t, err)
+	_, err = conn.ExecContext(ctx, `INSERT INTO UserCredentials (id, user_id, login, password) VALUES ('default', ?1, 'dave', 'p')`, userID)
+	require.NoError(t, err)
+	assert.Contains(t, synced(time.Time{}), "default")
+}
+
+// dataMigrationNamed returns the data migration with the name.
+func dataMigrationNamed(t *testing.T, name string) dataMigration {
+	t.Helper()
+	for _, dm := range dataMigrations {
+		if dm.name == name {
+			return dm
+		}
+	}
+	t.Fatalf("no data migration %s", name)
+	return dataMigration{}
+}
+
+func TestBDKeeper_UsernameSkeletons(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "gkeeper.db")
+	conn, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	conn.SetMaxOpenConns(1)
+
+	driver, dir, err := sqliteDialect{}.migrationDriver(conn)
+	require.NoError(t, err)
+	m, err := migrate.NewWithDatabaseInstance("file://../../"+dir, "sqlite", driver)
+	require.NoError(t, err)
+	require.NoError(t, m.Migrate(32))
+
+	bdk, err := NewBDKeeper(func() string { return sqliteScheme + path }, &recordingLog{}, conn)
+	require.NoError(t, err)
+	t.Cleanup(func() { bdk.Close() })
+
+	// Before the migration only the usernames themselves are compared
+	require.NoError(t, bdk.checkColumns(ctx))
+	assert.False(t, bdk.skeletons)
+	require.NoError(t, bdk.AddUser(ctx, "Support", "hash"))
+	taken, err := bdk.UsernameTaken(ctx, "Support")
+	require.NoError(t, err)
+	assert.True(t, taken)
+	taken, err = bdk.UsernameTaken(ctx, "supp0rt")
+	require.NoError(t, err)
+	assert.False(t, taken)
+
+	// The users registered before get their skeleton at startup, their lookalikes are taken from then on
+	require.NoError(t, bdk.migrateUp(ctx, m, 1))
+	require.NoError(t, bdk.checkColumns(ctx))
+	assert.True(t, bdk.skeletons)
+	for _, lookalike := range []string{"supp0rt", "ЅUPPORT", "_support_"} {
+		taken, err = bdk.UsernameTaken(ctx, lookalike)
+		require.NoError(t, err)
+		assert.True(t, taken, lookalike)
+	}
+
+	require.NoError(t, bdk.AddUser(ctx, "a1ice", "hash"))
+	taken, err = bdk.UsernameTaken(ctx, "alice")
+	require.NoError(t, err)
+	assert.True(t, taken)
+	taken, err = bdk.UsernameTaken(ctx, "bob")
+	require.NoError(t, err)
+	assert.False(t, taken)
+}
+
+func TestBDKeeper_DataMigrations(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "gkeeper.db")
+	conn, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	conn.SetMaxOpenConns(1)
+
+	driver, dir, err := sqliteDialect{}.migrationDriver(conn)
+	require.NoError(t, err)
+	m, err := migrate.NewWithDatabaseInstance("file://../../"+dir, "sqlite", driver)
+	require.NoError(t, err)
+	require.NoError(t, m.Migrate(16))
+
+	bdk, err := NewBDKeeper(func() string { return sqliteScheme + path }, &recordingLog{}, conn)
+	require.NoError(t, err)
+	t.Cleanup(func() { bdk.Close() })
+
+	// Rows stored before the payload sizes, the synchronization defaults and the skeletons
+	_, err = conn.ExecContext(ctx, `INSERT INTO Users (id, username, password) VALUES (1, 'Support', 'hash'), (2, 'a1ice', 'hash')`)
+	require.NoError(t, err)
+	_, err = conn.ExecContext(ctx, `INSERT INTO UserCredentials (id, user_id, login, password, deleted, updated_at)
+		VALUES ('a', 1, 'alice', 'p', NULL, NULL), ('b', 1, 'bob', 'p', FALSE, NULL), ('c', 2, 'carol', 'p', NULL, NULL)`)
+	require.NoError(t, err)
+
+	// Every data migration runs after its schema version, in batches of a row
+	require.NoError(t, bdk.migrateUp(ctx, m, 1))
+	version, dirty, err := m.Version()
+	require.NoError(t, err)
+	assert.False(t, dirty)
+	assert.Greater(t, version, dataMigrations[len(dataMigrations)-1].version)
+
+	var unfilled int
+	require.NoError(t, conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM UserCredentials
+		WHERE payload_size IS NULL OR payload_size = 0 OR deleted IS NULL OR updated_at IS NULL`).Scan(&unfilled))
+	assert.Zero(t, unfilled)
+	var skeleton string
+	require.NoError(t, conn.QueryRowContext(ctx, `SELECT username_skeleton FROM Users WHERE id = 1`).Scan(&skeleton))
+	assert.Equal(t, models.UsernameSkeleton("Support"), skeleton)
+
+	progress := func() map[string]int {
+		rows, err := conn.QueryContext(ctx, `SELECT name, table_name, filled FROM DataMigrations WHERE done`)
+		require.NoError(t, err)
+		defer rows.Close()
+		filled := make(map[string]int)
+		for rows.Next() {
+			var name, table string
+			var n int
+			require.NoError(t, rows.Scan(&name, &table, &n))
+			filled[name+"/"+table] = n
+		}
+		require.NoError(t, rows.Err())
+		return filled
+	}
+	filled := progress()
+	assert.Equal(t, 3, filled["payload_sizes/UserCredentials"])
+	assert.Equal(t, 0, filled["payload_sizes/TextData"])
+	assert.Equal(t, 3, filled["sync_columns/UserCredentials"])
+	assert.Equal(t, 2, filled["username_skeletons/Users"])
+	assert.Len(t, filled, 2*len(legacyDataTables)+1)
+
+	// The migrations done don't run again
+	require.NoError(t, bdk.migrateUp(ctx, m, 1))
+	assert.Equal(t, filled, progress())
+}
@@ -0,0 +1,182 @@
+package bdkeeper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// searchTextColumn holds the text of the search column of an entry as it is indexed, see models.SearchText.
+// The full-text index is built on it rather than on the search column, so a large meta information
+// can't exceed the limits of the index. It is NULL when the search column is encrypted,
+// the database mustn't see the plaintext.
+const searchTextColumn = "search_text"
+
+// SearchData returns the entries of the user whose meta information matches every term of the query,
+// grouped by table. Only the given tables are searched, or all data tables if none are given.
+// Deleted and expired entries are never returned. The limit applies to each table, 0 or less means no limit.
+// If partial is set, the tables which fail are returned in a *models.PartialError along with the results of the others.
+func (bdk *BDKeeper) SearchData(ctx context.Context, userID int, query string, tables []string, limit int, partial bool) (_ map[string][]map[string]string, err error) {
+	defer bdk.observe("search_data", "", time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	// The tables are searched on one snapshot, so the results are consistent across them
+	var results map[string][]map[string]string
+	err = bdk.inSnapshot(ctx, "search_data", func(view *BDKeeper) (err error) {
+		results, err = view.searchData(ctx, userID, query, tables, limit, partial)
+		return err
+	})
+
+	return results, err
+}
+
+// searchData runs SearchData on the keeper or view.
+func (bdk *BDKeeper) searchData(ctx context.Context, userID int, query string, tables []string, limit int, partial bool) (map[string][]map[string]string, error) {
+	terms, tables, err := searchArgs(query, tables)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[string][]map[string]string)
+	err = bdk.readTables(ctx, "search_data", tables, partial, func(view *BDKeeper, table string) error {
+		rows, err := view.searchTable(ctx, table, userID, terms, limit)
+		if err != nil {
+			return err
+		}
+		if len(rows) > 0 {
+			results[table] = rows
+		}
+
+		return nil
+	})
+	var partialErr *models.PartialError
+	if err != nil && !errors.As(err, &partialErr) {
+		return nil, err
+	}
+
+	return results, err
+}
+
+// searchTable returns the entries of the user in the table matching all terms, most recently updated first.
+// The database only sees the ciphertext of an encrypted search column, the terms are then
+// matched against the decrypted entries of the user.
+func (bdk *BDKeeper) searchTable(ctx context.Context, table string, userID int, terms []string, limit int) ([]map[string]string, error) {
+	schema, err := bdk.tableColumns(ctx, bdk.ex, table)
+	if err != nil {
+		return nil, err
+	}
+	tbl, err := bdk.tableIdent(ctx, bdk.ex, table)
+	if err != nil {
+		return nil, err
+	}
+	inProcess := bdk.searchInProcess()
+	column := models.SearchColumn
+	if schema.search {
+		column = searchTextColumn
+	}
+
+	args := []interface{}{userID}
+	conditions := []string{"user_id = $1", "deleted = false", bdk.notExpired()}
+	if !inProcess {
+		for _, term := range terms {
+			args = append(args, term)
+			conditions = append(conditions, bdk.dialect.matchTerm(schema.column(column), "$"+strconv.Itoa(len(args))))
+		}
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY updated_at DESC",
+		schema.selectList(schema.names), tbl, strings.Join(conditions, " AND "))
+	if limit > 0 && !inProcess {
+		args = append(args, limit)
+		query += " LIMIT $" + strconv.Itoa(len(args))
+	}
+
+	rows, err := bdk.ex.QueryContext(ctx, bdk.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	data, err := scanRows(rows, schema.names)
+	if err != nil {
+		return nil, err
+	}
+	if err := bdk.openRows(table, data); err != nil {
+		return nil, err
+	}
+	if !inProcess {
+		return data, nil
+	}
+
+	matched := data[:0]
+	for _, row := range data {
+		text, _ := models.SearchText(models.SearchSource(row))
+		if matchesTerms(text, terms) && (limit <= 0 || len(matched) < limit) {
+			matched = append(matched, row)
+		}
+	}
+
+	return matched, nil
+}
+
+// searchInProcess reports whether the database only sees the ciphertext of the search column.
+func (bdk *BDKeeper) searchInProcess() bool {
+	return bdk.sealer != nil && encryptedColumns[models.SearchColumn]
+}
+
+// searchTextArg returns the value of the search text column of the decrypted entry, its search column followed
+// by its preview, NULL if the search column is encrypted or both are empty. The texts cut at models.MaxSearchText are reported to the metrics.
+func (bdk *BDKeeper) searchTextArg(table string, row map[string]string) interface{} {
+	source := models.SearchSource(row)
+	if bdk.searchInProcess() || source == "" {
+		return nil
+	}
+
+	text, truncated := models.SearchText(source)
+	if truncated {
+		bdk.observeTruncation(table)
+	}
+
+	return text
+}
+
+// matchesTerms reports whether the text contains all lower case terms, ignoring its case.
+func matchesTerms(text string, terms []string) bool {
+	text = strings.ToLower(text)
+	for _, term := range terms {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// searchArgs splits the query into lower case terms and checks the tables to search.
+func searchArgs(query string, tables []string) ([]string, []string, error) {
+	terms := strings.Fields(strings.ToLower(query))
+	if len(terms) == 0 {
+		return nil, nil, fmt.Errorf("%w: the query is empty", models.ErrInvalidQuery)
+	}
+
+	if len(tables) == 0 {
+		return terms, models.DataTables, nil
+	}
+
+	for _, table := range tables {
+		if !models.IsDataTable(table) {
+			return nil, nil, fmt.Errorf("%w: table %q can't be searched", models.ErrInvalidQuery, table)
+		}
+	}
+
+	return terms, tables, nil
+}
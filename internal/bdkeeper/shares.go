@@ -0,0 +1,247 @@
+package bdkeeper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// sharedEntriesTable holds the shares of the entries with other users. It is read by the grantees of the shares,
+// not only by the owners, so like the blobs it has no row-level security policy.
+const sharedEntriesTable = "shared_entries"
+
+// ShareEntry shares the entry of the owner of the share with its grantee and returns the share with its times.
+// A share of the entry with the grantee already is changed to the permission, a revoked one is granted again.
+// It returns models.ErrNotFound if the owner has no such entry, it is deleted or the grantee doesn't exist.
+func (bdk *BDKeeper) ShareEntry(ctx context.Context, share models.Share) (_ models.Share, err error) {
+	defer bdk.observe("share_entry", sharedEntriesTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return models.Share{}, err
+	}
+	defer leave()
+	defer bdk.auditShare(ctx, models.AuditShare, share.OwnerID, share.GranteeID, share.Table, share.EntryID, &err)
+	bdk.wrote(userWriter(share.OwnerID))
+	bdk.wrote(userWriter(share.GranteeID))
+
+	if err := share.Validate(); err != nil {
+		return models.Share{}, err
+	}
+
+	err = bdk.inTx(ctx, func(view *BDKeeper) error {
+		tbl, err := view.tableIdent(ctx, view.ex, share.Table)
+		if err != nil {
+			return err
+		}
+		var found int
+		query := fmt.Sprintf("SELECT 1 FROM %s WHERE user_id = $1 AND id = $2 AND %s", tbl, view.notDeleted())
+		err = view.ex.QueryRowContext(ctx, view.dialect.rebind(query), share.OwnerID, share.EntryID).Scan(&found)
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get entry: %w", err)
+		}
+		query = `SELECT 1 FROM Users WHERE id = $1`
+		err = view.ex.QueryRowContext(ctx, view.dialect.rebind(query), share.GranteeID).Scan(&found)
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get grantee: %w", err)
+		}
+
+		// A revoked share granted again is a new one
+		query = fmt.Sprintf(`INSERT INTO shared_entries (owner_id, grantee_id, table_name, entry_id, permission, created_at, updated_at, revoked)
+			VALUES ($1, $2, $3, $4, $5, %s, %s, FALSE)
+			ON CONFLICT (grantee_id, table_name, entry_id) DO UPDATE SET owner_id = excluded.owner_id,
+				permission = excluded.permission, updated_at = %s, revoked = FALSE,
+				created_at = CASE WHEN shared_entries.revoked THEN excluded.created_at ELSE shared_entries.created_at END
+			RETURNING created_at, updated_at`, view.dialect.now(), view.dialect.now(), view.dialect.nextTime("shared_entries.updated_at"))
+		err = view.ex.QueryRowContext(ctx, view.dialect.rebind(query), share.OwnerID, share.GranteeID, share.Table,
+			share.EntryID, share.Permission).Scan(&share.CreatedAt, &share.UpdatedAt)
+		if err != nil {
+			return fmt.Errorf("failed to share entry: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return models.Share{}, err
+	}
+	share.CreatedAt, share.UpdatedAt = share.CreatedAt.UTC(), share.UpdatedAt.UTC()
+
+	return share, nil
+}
+
+// RevokeShare revokes the share of the entry of the owner with the grantee, or returns models.ErrNotFound.
+// The share is kept as revoked, so the grantee drops the entry on their next sync.
+func (bdk *BDKeeper) RevokeShare(ctx context.Context, ownerID, granteeID int, table, entryID string) (err error) {
+	defer bdk.observe("revoke_share", sharedEntriesTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	defer bdk.auditShare(ctx, models.AuditRevokeShare, ownerID, granteeID, table, entryID, &err)
+	bdk.wrote(userWriter(granteeID))
+
+	query := fmt.Sprintf(`UPDATE shared_entries SET revoked = TRUE, updated_at = %s
+		WHERE owner_id = $1 AND grantee_id = $2 AND table_name = $3 AND entry_id = $4 AND revoked = FALSE`,
+		bdk.dialect.nextTime("updated_at"))
+	res, err := bdk.ex.ExecContext(ctx, bdk.dialect.rebind(query), ownerID, granteeID, table, entryID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke share: %w", err)
+	}
+
+	return requireAffected(res)
+}
+
+// auditShare records the share or the revocation of a share of an entry for its owner, with the grantee as detail.
+func (bdk *BDKeeper) auditShare(ctx context.Context, action models.AuditAction, ownerID, granteeID int, table, entryID string, err *error) {
+	bdk.recordAudit(ctx, models.AuditEvent{
+		UserID:  ownerID,
+		Action:  action,
+		Table:   table,
+		EntryID: entryID,
+		Detail:  strconv.Itoa(granteeID),
+		Success: *err == nil,
+	})
+}
+
+// GetSharedWithUser returns the entries shared with the user which changed since the given time, the share or
+// the entry, ordered by table and id. The revoked shares and the deleted entries are returned as removed,
+// unless the time is zero.
+func (bdk *BDKeeper) GetSharedWithUser(ctx context.Context, userID int, since time.Time) (_ []models.SharedEntry, err error) {
+	defer bdk.observe("get_shared_with_user", sharedEntriesTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	return scoped(ctx, bdk.reader(userWriter(userID)), func(view *BDKeeper) ([]models.SharedEntry, error) {
+		return view.sharedWith(ctx, userID, since)
+	})
+}
+
+// sharedWith runs GetSharedWithUser on the keeper or view. The shares and the entries which changed are found
+// with one query per table, joining the entries of the owners, and only those entries are read.
+func (bdk *BDKeeper) sharedWith(ctx context.Context, userID int, since time.Time) ([]models.SharedEntry, error) {
+	// The shares are listed in the order of their tables
+	tables := slices.Clone(models.DataTables)
+	slices.Sort(tables)
+
+	var entries []models.SharedEntry
+	var entryTimes []sql.NullTime
+	for _, table := range tables {
+		tbl, err := bdk.tableIdent(ctx, bdk.ex, table)
+		if err != nil {
+			return nil, err
+		}
+		args := []interface{}{userID, table}
+		condition := "s.revoked = FALSE AND COALESCE(e.deleted, TRUE) = FALSE"
+		if !since.IsZero() {
+			args = append(args, bdk.dialect.timeArg(since.UTC()))
+			entryUpdated := "e.updated_at"
+			if bdk.legacySync {
+				entryUpdated = fmt.Sprintf("COALESCE(e.updated_at, %s)", bdk.dialect.now())
+			}
+			condition = fmt.Sprintf("(s.updated_at > $3 OR %s > $3)", entryUpdated)
+		}
+		query := fmt.Sprintf(`SELECT s.owner_id, s.entry_id, s.permission, s.created_at, s.updated_at, s.revoked,
+				COALESCE(u.username, ''), e.updated_at, COALESCE(e.deleted, TRUE)
+			FROM shared_entries s LEFT JOIN %s e ON e.user_id = s.owner_id AND e.id = s.entry_id
+				LEFT JOIN Users u ON u.id = s.owner_id
+			WHERE s.grantee_id = $1 AND s.table_name = $2 AND %s ORDER BY s.entry_id`, tbl, condition)
+
+		// The entries of the owners are out of sight of the user, only their times are read here
+		err = bdk.asBypass(ctx, func() error {
+			rows, err := bdk.ex.QueryContext(ctx, bdk.dialect.rebind(query), args...)
+			if err != nil {
+				return fmt.Errorf("failed to get shares: %w", err)
+			}
+			defer rows.Close()
+			for rows.Next() {
+				e := models.SharedEntry{Share: models.Share{GranteeID: userID, Table: table}}
+				var entryAt sql.NullTime
+				var entryDeleted bool
+				if err := rows.Scan(&e.OwnerID, &e.EntryID, &e.Permission, &e.CreatedAt, &e.UpdatedAt, &e.Removed,
+					&e.Owner, &entryAt, &entryDeleted); err != nil {
+					return fmt.Errorf("failed to scan share: %w", err)
+				}
+				e.CreatedAt, e.UpdatedAt = e.CreatedAt.UTC(), e.UpdatedAt.UTC()
+				e.Removed = e.Removed || entryDeleted
+				entries = append(entries, e)
+				entryTimes = append(entryTimes, entryAt)
+			}
+			if err := rows.Err(); err != nil {
+				return fmt.Errorf("rows encountered an error: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	shared := make([]models.SharedEntry, 0, len(entries))
+	for i, e := range entries {
+		if at := entryTimes[i]; at.Valid && at.Time.After(e.UpdatedAt) {
+			e.UpdatedAt = at.Time.UTC()
+		}
+		if !e.Removed {
+			var fields map[string]string
+			err := bdk.asTenant(ctx, e.OwnerID, func() (err error) {
+				fields, err = bdk.getData(ctx, e.Table, e.OwnerID, e.EntryID, true)
+				return err
+			})
+			if err != nil && !errors.Is(err, models.ErrNotFound) {
+				return nil, err
+			}
+			// The entry changed since the query, the read is the latest
+			if at, err := time.Parse(time.RFC3339Nano, fields["updated_at"]); err == nil && at.After(e.UpdatedAt) {
+				e.UpdatedAt = at
+			}
+			if fields == nil || fields["deleted"] == "true" {
+				e.Removed = true
+			} else {
+				e.Fields = fields
+			}
+		}
+		// The first sync has nothing to remove
+		if e.Removed && since.IsZero() {
+			continue
+		}
+		shared = append(shared, e)
+	}
+
+	return shared, nil
+}
+
+// writableEntry returns the owner of the entry written by the user: the user, unless the entry of another user
+// is shared with them, or models.ErrReadOnlyShare if it is shared read-only.
+func (bdk *BDKeeper) writableEntry(ctx context.Context, table string, userID int, entryID string) (int, error) {
+	var ownerID int
+	var permission string
+	query := `SELECT owner_id, permission FROM shared_entries
+		WHERE grantee_id = $1 AND table_name = $2 AND entry_id = $3 AND revoked = FALSE`
+	err := bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), userID, table, entryID).Scan(&ownerID, &permission)
+	if errors.Is(err, sql.ErrNoRows) {
+		return userID, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get share: %w", err)
+	}
+	if permission != models.ShareWrite {
+		return 0, models.ErrReadOnlyShare
+	}
+
+	return ownerID, nil
+}
@@ -0,0 +1,333 @@
+package bdkeeper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// ApplyChanges applies a batch of client changes of a user in a single transaction.
+// Updates and deletes of entries modified on the server after the client's version are
+// skipped and reported as conflicts. Any other failure rolls back the whole batch.
+// On PostgreSQL the batch runs under REPEATABLE READ, so the versions it checks can't change
+// before it commits. A batch aborted by a concurrent one fails with models.ErrRetrySync.
+func (bdk *BDKeeper) ApplyChanges(ctx context.Context, userID int, changes []models.Change) (_ []models.ChangeResult, err error) {
+	defer bdk.observe("apply_changes", "", time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	bdk.wrote(userWriter(userID))
+
+	results := make([]models.ChangeResult, 0, len(changes))
+	err = bdk.inTxWith(ctx, bdk.dialect.snapshotTx(false), func(view *BDKeeper) error {
+		for i, c := range changes {
+			status, updatedAt, err := view.applyChange(ctx, view.ex, userID, c)
+			if err != nil {
+				return fmt.Errorf("change %d (%s %s/%s): %w", i, c.Op, c.Table, c.EntryID, err)
+			}
+
+			results = append(results, models.ChangeResult{
+				Table:     c.Table,
+				EntryID:   c.EntryID,
+				Status:    status,
+				UpdatedAt: updatedAt,
+			})
+		}
+
+		return nil
+	})
+	bdk.auditChanges(ctx, userID, changes, results, err)
+	if err != nil {
+		return nil, err
+	}
+	bdk.changed(ctx, userID, models.AppliedEvents(results)...)
+	bdk.observeUnchanged(results)
+
+	return results, nil
+}
+
+// Sync applies a batch of client changes like ApplyChanges and, in the same transaction, reads the entries
+// of the user changed since lastSync from every data table, the deleted ones too unless it is the first sync,
+// and the entries shared with the user and the folders of the user which changed since.
+// No change committed in between is missed by the client or sent back to it, and the server versions
+// of the conflicting changes are returned along with them.
+func (bdk *BDKeeper) Sync(ctx context.Context, userID int, lastSync time.Time, changes []models.Change) (_ models.SyncResult, err error) {
+	defer bdk.observe("sync", "", time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return models.SyncResult{}, err
+	}
+	defer leave()
+	bdk.wrote(userWriter(userID))
+
+	var result models.SyncResult
+	results := make([]models.ChangeResult, 0, len(changes))
+	err = bdk.inTxWith(ctx, bdk.dialect.snapshotTx(false), func(view *BDKeeper) error {
+		for i, c := range changes {
+			status, updatedAt, err := view.applyChange(ctx, view.ex, userID, c)
+			if err != nil {
+				return fmt.Errorf("change %d (%s %s/%s): %w", i, c.Op, c.Table, c.EntryID, err)
+			}
+
+			results = append(results, models.ChangeResult{
+				Table:     c.Table,
+				EntryID:   c.EntryID,
+				Status:    status,
+				UpdatedAt: updatedAt,
+			})
+		}
+		result = models.NewSyncResult(lastSync, results)
+
+		for i, r := range results {
+			if r.Status != models.ChangeConflict {
+				continue
+			}
+			server, err := view.getData(ctx, r.Table, userID, r.EntryID, true)
+			if err != nil {
+				return fmt.Errorf("conflict %s/%s: %w", r.Table, r.EntryID, err)
+			}
+			result.Conflicts = append(result.Conflicts, models.SyncConflict{
+				Table: r.Table, EntryID: r.EntryID, Client: changes[i], Server: server,
+			})
+		}
+
+		for _, table := range models.DataTables {
+			rows, err := view.getAllData(ctx, table, userID, models.DataQuery{LastSync: lastSync, InclDeleted: !lastSync.IsZero()})
+			if err != nil {
+				return err
+			}
+			result.Pull(table, rows)
+		}
+
+		shared, err := view.sharedWith(ctx, userID, lastSync)
+		if err != nil {
+			return err
+		}
+		result.PullShared(shared)
+
+		folders, err := view.folders(ctx, userID, lastSync)
+		if err != nil {
+			return err
+		}
+		result.PullFolders(folders)
+
+		return nil
+	})
+	bdk.auditChanges(ctx, userID, changes, results, err)
+	if err != nil {
+		return models.SyncResult{}, err
+	}
+	bdk.changed(ctx, userID, models.AppliedEvents(results)...)
+	bdk.observeUnchanged(results)
+
+	return result, nil
+}
+
+// auditChanges records the changes of a batch in the audit log, those which were skipped
+// or rolled back with the batch as failed.
+func (bdk *BDKeeper) auditChanges(ctx context.Context, userID int, changes []models.Change, results []models.ChangeResult, err error) {
+	for i, c := range changes {
+		// Nothing was written for an unchanged entry
+		if err == nil && results[i].Status == models.ChangeUnchanged {
+			continue
+		}
+		applied := err == nil && i < len(results) && results[i].Status == models.ChangeApplied
+		bdk.recordAudit(ctx, models.AuditEvent{
+			UserID:  userID,
+			Action:  models.AuditAction(c.Op),
+			Table:   c.Table,
+			EntryID: c.EntryID,
+			Success: applied,
+		})
+	}
+}
+
+// applyChange applies a single change using the given execer.
+// It returns the status of the change and the resulting 'updated_at' value of the entry.
+func (bdk *BDKeeper) applyChange(ctx context.Context, ex execer, userID int, c models.Change) (models.ChangeStatus, time.Time, error) {
+	if c.Table == "" || c.EntryID == "" {
+		return "", time.Time{}, fmt.Errorf("%w: table and entry_id must be specified", models.ErrInvalidChange)
+	}
+	if err := models.CheckServerFields(c.Fields); err != nil {
+		return "", time.Time{}, err
+	}
+
+	switch c.Op {
+	case models.ChangeAdd:
+		updatedAt, err := bdk.addData(ctx, ex, c.Table, userID, c.EntryID, c.Fields)
+		return models.ChangeApplied, updatedAt, err
+	case models.ChangeUpdate, models.ChangeDelete:
+	default:
+		return "", time.Time{}, fmt.Errorf("%w: unknown operation %q", models.ErrInvalidChange, c.Op)
+	}
+
+	updatedAt, err := bdk.entryUpdatedAt(ctx, ex, c.Table, userID, c.EntryID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.ChangeNotFound, time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	// A client resending an entry as it is gets the version it already has, whatever version it sends
+	if c.Op == models.ChangeUpdate {
+		unchanged, err := bdk.unchangedUpdate(ctx, ex, c.Table, userID, c.EntryID, c.Fields)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		if unchanged {
+			return models.ChangeUnchanged, updatedAt, nil
+		}
+	}
+	if updatedAt.After(c.UpdatedAt) {
+		return models.ChangeConflict, updatedAt, nil
+	}
+
+	if c.Op == models.ChangeUpdate {
+		updatedAt, err = bdk.updateData(ctx, ex, c.Table, userID, c.EntryID, c.Fields)
+	} else {
+		updatedAt, err = bdk.deleteData(ctx, ex, c.Table, userID, c.EntryID)
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return models.ChangeApplied, updatedAt, nil
+}
+
+// entryUpdatedAt returns the 'updated_at' field of an entry of the user.
+func (bdk *BDKeeper) entryUpdatedAt(ctx context.Context, ex execer, table string, userID int, entryID string) (time.Time, error) {
+	tbl, err := bdk.tableIdent(ctx, ex, table)
+	if err != nil {
+		return time.Time{}, err
+	}
+	query := fmt.Sprintf("SELECT updated_at FROM %s WHERE user_id = $1 AND id = $2", tbl)
+
+	var updatedAt time.Time
+	err = ex.QueryRowContext(ctx, bdk.dialect.rebind(query), userID, entryID).Scan(&updatedAt)
+
+	return updatedAt, err
+}
+
+// unchangedUpdate reports whether the update of the entry of the user would store the fields it already has:
+// the checksum of the entry with the fields of the update written over it is the one stored with the entry.
+// An update without fields touches the entry, and one of a deleted entry or which the write rejects
+// is applied, or fails, as before.
+func (bdk *BDKeeper) unchangedUpdate(ctx context.Context, ex execer, table string, userID int, entryID string, data map[string]string) (bool, error) {
+	if len(data) == 0 {
+		return false, nil
+	}
+	data, err := models.NormalizeFields(data)
+	if err != nil || models.DeriveSshFields(table, data) != nil {
+		return false, nil
+	}
+	schema, err := bdk.tableColumns(ctx, ex, table)
+	if err != nil {
+		return false, err
+	}
+	tbl, err := bdk.tableIdent(ctx, ex, table)
+	if err != nil {
+		return false, err
+	}
+
+	cols := schema.names
+	if schema.checksum {
+		cols = append(cols[:len(cols):len(cols)], checksumColumn)
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE user_id = $1 AND id = $2", schema.selectList(cols), tbl)
+	rows, err := ex.QueryContext(ctx, bdk.dialect.rebind(query), userID, entryID)
+	if err != nil {
+		return false, fmt.Errorf("failed to read the entry: %w", err)
+	}
+	found, err := scanRows(rows, cols)
+	rows.Close()
+	if err != nil || len(found) == 0 {
+		return false, err
+	}
+	if err := bdk.openRows(table, found); err != nil {
+		return false, err
+	}
+
+	row := found[0]
+	stored := row[checksumColumn]
+	delete(row, checksumColumn)
+	if row["deleted"] == "true" || row[models.DataWarning] != "" {
+		return false, nil
+	}
+	// The entries stored before the checksums were added have none until their next change
+	if stored == "" {
+		stored = payloadChecksum(row, schema.names)
+	}
+
+	updated := make(map[string]string, len(row))
+	for key, value := range row {
+		updated[key] = value
+	}
+	for key, value := range data {
+		// The timestamp, the derived and the blob columns are assigned by the server, the display timestamps are kept as created
+		if key == "updated_at" || derivedColumns[key] || blobColumns[key] || models.IsClientTimeField(key) {
+			continue
+		}
+		if _, ok := schema.raw[key]; !ok {
+			return false, nil
+		}
+		value, ok := readValue(table, key, value, row[key])
+		if !ok {
+			return false, nil
+		}
+		updated[key] = value
+	}
+
+	return payloadChecksum(updated, schema.names) == stored, nil
+}
+
+// readValue returns the value of a field of an update as a read of the entry returns it once written,
+// given the current value. ok is false if the value is rejected or can't be compared.
+func readValue(table, key, value, current string) (_ string, ok bool) {
+	if models.IsOtpField(table, key) {
+		value, err := models.ParseOtpField(key, value)
+		return value, err == nil
+	}
+
+	switch key {
+	case models.TagsField:
+		tags, err := models.ParseTags(value)
+		if err != nil {
+			return "", false
+		}
+		return models.FormatTags(tags), true
+	case models.ExpiresAtField:
+		// The databases format the times their own way, the instants are compared
+		expiresAt, err := models.ParseExpiresAt(value)
+		if err != nil {
+			return "", false
+		}
+		if expiresAt.IsZero() {
+			return "", true
+		}
+		currentAt, err := models.ParseExpiresAt(current)
+		if err != nil || !currentAt.Equal(expiresAt) {
+			return "", false
+		}
+		return current, true
+	case models.PreviewField:
+		preview, err := models.ParsePreview(table, value)
+		if err != nil {
+			return "", false
+		}
+		return preview, true
+	case models.FolderField:
+		folderID, err := models.ParseFolderID(value)
+		if err != nil {
+			return "", false
+		}
+		return folderID, true
+	}
+
+	return value, true
+}
@@ -0,0 +1,115 @@
+package bdkeeper
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// RenameTag renames the tag from to the tag to on all the entries of the user, in one transaction, and returns
+// the number of entries changed. An entry with both tags keeps one of them. The rename is metadata, so the
+// 'updated_at' of the entries moves for the other devices to pick it up, but no version is kept in the history.
+// Tags are matched case-insensitively, a rename to the same tag changes nothing.
+func (bdk *BDKeeper) RenameTag(ctx context.Context, userID int, from, to string) (_ int, err error) {
+	defer bdk.observe("rename_tag", "", time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer leave()
+	defer bdk.audit(ctx, models.AuditRenameTag, "", userID, "", &err)
+
+	if from, err = models.ParseTag(from); err != nil {
+		return 0, err
+	}
+	if to, err = models.ParseTag(to); err != nil {
+		return 0, err
+	}
+	if from == to {
+		return 0, nil
+	}
+	bdk.wrote(userWriter(userID))
+
+	var renamed int
+	err = bdk.inTx(ctx, func(view *BDKeeper) error {
+		renamed = 0
+		for _, table := range models.DataTables {
+			n, err := view.renameTag(ctx, table, userID, from, to)
+			if err != nil {
+				return err
+			}
+			renamed += n
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	// The entries renamed may be of any table
+	if renamed > 0 {
+		bdk.changed(ctx, userID, models.VaultEvent{UpdatedAt: time.Now().UTC()})
+	}
+
+	return renamed, nil
+}
+
+// renameTag renames the tag on the entries of the user in the table, the database may have no array functions,
+// so the tags of each entry are rewritten from the ones read in the transaction.
+func (bdk *BDKeeper) renameTag(ctx context.Context, table string, userID int, from, to string) (int, error) {
+	schema, err := bdk.tableColumns(ctx, bdk.ex, table)
+	if err != nil {
+		return 0, err
+	}
+	tbl, err := bdk.tableIdent(ctx, bdk.ex, table)
+	if err != nil {
+		return 0, err
+	}
+	column := schema.column(models.TagsField)
+
+	query := fmt.Sprintf("SELECT id, %s FROM %s WHERE user_id = $1 AND %s", column, tbl, bdk.dialect.hasTag(column, "$2"))
+	rows, err := bdk.ex.QueryContext(ctx, bdk.dialect.rebind(query), userID, from)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find tag in %s: %w", table, err)
+	}
+	tagged := make(map[string][]string)
+	var ids []string
+	for rows.Next() {
+		var id string
+		var tags sql.NullString
+		if err := rows.Scan(&id, &tags); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan tags of %s: %w", table, err)
+		}
+		tagged[id] = storedTags(tags.String)
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("rows encountered an error: %w", err)
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	query = fmt.Sprintf("UPDATE %s SET %s = $1, updated_at = %s WHERE user_id = $2 AND id = $3",
+		tbl, column, bdk.dialect.nextTime("updated_at"))
+	stmt, err := bdk.ex.PrepareContext(ctx, bdk.dialect.rebind(query))
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	for _, id := range ids {
+		tags, _ := models.RenameTag(tagged[id], from, to)
+		if _, err := stmt.ExecContext(ctx, bdk.dialect.tagsArg(tags), userID, id); err != nil {
+			return 0, fmt.Errorf("failed to rename tag in %s: %w", table, err)
+		}
+	}
+
+	// The checksums cover the tags, so the derived columns are written again
+	return len(ids), bdk.writeDerived(ctx, bdk.ex, table, userID, ids)
+}
@@ -0,0 +1,174 @@
+package bdkeeper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// refreshTokensTable holds the refresh tokens. Like the audit log it has no row-level security policy,
+// a token is looked up by its hash before its user is known. The tokens are always read from the primary,
+// a revocation must be seen at once.
+const refreshTokensTable = "refresh_tokens"
+
+// StoreRefreshToken stores a refresh token issued to a device of a user.
+func (bdk *BDKeeper) StoreRefreshToken(ctx context.Context, tok models.RefreshToken) (err error) {
+	defer bdk.observe("store_refresh_token", refreshTokensTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+
+	// A token stored without a version is of the first one, the column defaults to it too
+	if tok.ProtocolVersion == 0 {
+		tok.ProtocolVersion = models.ProtocolV1
+	}
+	query := `INSERT INTO refresh_tokens (token_hash, user_id, device_id, family_id, expires_at, revoked, protocol_version)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	_, err = bdk.ex.ExecContext(ctx, bdk.dialect.rebind(query), tok.Hash, tok.UserID, tok.DeviceID, tok.FamilyID,
+		bdk.dialect.timeArg(tok.ExpiresAt.UTC()), tok.Revoked, tok.ProtocolVersion)
+	if err != nil {
+		return fmt.Errorf("failed to store refresh token: %w", err)
+	}
+
+	return nil
+}
+
+// GetRefreshToken returns the refresh token with the given hash, revoked or not, or models.ErrNotFound.
+func (bdk *BDKeeper) GetRefreshToken(ctx context.Context, hash string) (_ models.RefreshToken, err error) {
+	defer bdk.observe("get_refresh_token", refreshTokensTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return models.RefreshToken{}, err
+	}
+	defer leave()
+
+	query := `SELECT user_id, device_id, family_id, expires_at, revoked, protocol_version
+		FROM refresh_tokens WHERE token_hash = $1`
+	tok := models.RefreshToken{Hash: hash}
+	err = bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), hash).
+		Scan(&tok.UserID, &tok.DeviceID, &tok.FamilyID, &tok.ExpiresAt, &tok.Revoked, &tok.ProtocolVersion)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.RefreshToken{}, models.ErrNotFound
+	}
+	if err != nil {
+		return models.RefreshToken{}, fmt.Errorf("failed to get refresh token: %w", err)
+	}
+
+	return tok, nil
+}
+
+// RevokeRefreshToken revokes the refresh token with the given hash. It reports whether this call
+// revoked it, false if the token was revoked already or doesn't exist, so of two concurrent
+// refreshes with the same token only one succeeds.
+func (bdk *BDKeeper) RevokeRefreshToken(ctx context.Context, hash string) (_ bool, err error) {
+	defer bdk.observe("revoke_refresh_token", refreshTokensTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer leave()
+
+	query := `UPDATE refresh_tokens SET revoked = TRUE WHERE token_hash = $1 AND revoked = FALSE`
+	res, err := bdk.ex.ExecContext(ctx, bdk.dialect.rebind(query), hash)
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke refresh token: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+// RevokeRefreshTokenFamily revokes all the refresh tokens of the family, ending the session of the device.
+func (bdk *BDKeeper) RevokeRefreshTokenFamily(ctx context.Context, familyID string) (err error) {
+	defer bdk.observe("revoke_refresh_token_family", refreshTokensTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+
+	query := `UPDATE refresh_tokens SET revoked = TRUE WHERE family_id = $1 AND revoked = FALSE`
+	if _, err := bdk.ex.ExecContext(ctx, bdk.dialect.rebind(query), familyID); err != nil {
+		return fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+
+	return nil
+}
+
+// revokedTokensTable holds the access tokens revoked before they expire, by their JWT ID.
+// Like the refresh tokens it is always read from the primary.
+const revokedTokensTable = "revoked_tokens"
+
+// RevokeToken revokes the access token with the JWT ID until it expires at expiresAt, the zero time
+// for a token which doesn't expire. Revoking a token twice keeps the first revocation.
+func (bdk *BDKeeper) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) (err error) {
+	defer bdk.observe("revoke_token", revokedTokensTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+
+	var expires interface{}
+	if !expiresAt.IsZero() {
+		expires = bdk.dialect.timeArg(expiresAt.UTC())
+	}
+	query := `INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING`
+	if _, err := bdk.ex.ExecContext(ctx, bdk.dialect.rebind(query), jti, expires); err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+
+	return nil
+}
+
+// IsTokenRevoked reports whether the access token with the JWT ID is revoked.
+func (bdk *BDKeeper) IsTokenRevoked(ctx context.Context, jti string) (_ bool, err error) {
+	defer bdk.observe("is_token_revoked", revokedTokensTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer leave()
+
+	var revoked bool
+	query := `SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1)`
+	if err := bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), jti).Scan(&revoked); err != nil {
+		return false, fmt.Errorf("failed to check revoked token: %w", err)
+	}
+
+	return revoked, nil
+}
+
+// PruneRevokedTokens deletes the revocations of the tokens expired before the given time and returns
+// their number, an expired token is rejected anyway.
+func (bdk *BDKeeper) PruneRevokedTokens(ctx context.Context, before time.Time) (_ int, err error) {
+	defer bdk.observe("prune_revoked_tokens", revokedTokensTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer leave()
+
+	query := `DELETE FROM revoked_tokens WHERE expires_at IS NOT NULL AND expires_at < $1`
+	res, err := bdk.ex.ExecContext(ctx, bdk.dialect.rebind(query), bdk.dialect.timeArg(before.UTC()))
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune revoked tokens: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
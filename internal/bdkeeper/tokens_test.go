@@ -0,0 +1,27 @@
+package bdkeeper
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBDKeeper_UpdatePasswordAtomic(t *testing.T) {
+	bdk := newSQLiteBDKeeper(t)
+	ctx := context.Background()
+	userID := addTestUser(t, bdk)
+
+	var username string
+	require.NoError(t, bdk.conn.QueryRowContext(ctx, "SELECT username FROM Users WHERE id = ?", userID).Scan(&username))
+
+	// The password stays if the sessions can't be revoked with it
+	_, err := bdk.conn.ExecContext(ctx, "DROP TABLE refresh_tokens")
+	require.NoError(t, err)
+	assert.Error(t, bdk.UpdatePassword(ctx, userID, "newHash"))
+
+	password, err := bdk.GetPassword(ctx, username)
+	require.NoError(t, err)
+	assert.Equal(t, "hashedPassword", password)
+}
@@ -0,0 +1,57 @@
+package bdkeeper
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"go.uber.org/zap"
+)
+
+// traceExecer logs every statement run through it at debug level with the fields of the context.
+// The arguments aren't logged, they hold the secrets of the users.
+type traceExecer struct {
+	ex  execer
+	log Log
+}
+
+func (t traceExecer) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	res, err := t.ex.ExecContext(ctx, query, args...)
+	t.trace(ctx, query, start, err)
+
+	return res, err
+}
+
+func (t traceExecer) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := t.ex.QueryContext(ctx, query, args...)
+	t.trace(ctx, query, start, err)
+
+	return rows, err
+}
+
+// QueryRowContext traces the statement without its error, which is only known once the row is scanned.
+func (t traceExecer) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	start := time.Now()
+	row := t.ex.QueryRowContext(ctx, query, args...)
+	t.trace(ctx, query, start, nil)
+
+	return row
+}
+
+// PrepareContext traces the preparation, the statement itself runs outside the execer.
+func (t traceExecer) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	start := time.Now()
+	stmt, err := t.ex.PrepareContext(ctx, query)
+	t.trace(ctx, query, start, err)
+
+	return stmt, err
+}
+
+// trace logs the statement, its duration and its error, if any.
+func (t traceExecer) trace(ctx context.Context, query string, start time.Time, err error) {
+	t.log.Debug("query", logger.ContextFields(ctx,
+		zap.String("query", query), zap.Duration("duration", time.Since(start)), zap.Error(err))...)
+}
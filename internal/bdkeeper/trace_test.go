@@ -0,0 +1,42 @@
+package bdkeeper
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// traceLog keeps the fields of the debug traces.
+type traceLog struct {
+	recordingLog
+	traces [][]zapcore.Field
+}
+
+func (l *traceLog) Debug(msg string, fields ...zapcore.Field) {
+	l.traces = append(l.traces, fields)
+}
+
+func TestBDKeeper_QueryTrace(t *testing.T) {
+	bdk := newSQLiteBDKeeper(t)
+	log := &traceLog{}
+	bdk.log, bdk.ex = log, traceExecer{ex: bdk.conn, log: log}
+
+	ctx := logger.WithFields(context.Background(), zap.String("request_id", "r1"))
+	_, err := bdk.UserExists(ctx, "secret-name")
+	require.NoError(t, err)
+
+	// The trace carries the fields of the request but not the arguments of the statement
+	require.Len(t, log.traces, 1)
+	trace := log.traces[0]
+	assert.Equal(t, zap.String("request_id", "r1"), trace[0])
+	assert.Equal(t, "query", trace[1].Key)
+	assert.Contains(t, trace[1].String, "FROM Users")
+	for _, f := range trace {
+		assert.NotContains(t, f.String, "secret-name")
+	}
+}
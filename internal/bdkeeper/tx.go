@@ -0,0 +1,135 @@
+package bdkeeper
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"github.com/wurt83ow/gophkeeper-server/internal/storage"
+)
+
+// txState is the transaction shared by a WithTx view and the views nested in it.
+type txState struct {
+	tx *sql.Tx
+	// savepoints is the number of savepoints created so far, it names the next one
+	savepoints int
+	// audit holds the audit events of the transaction, written once it ends
+	audit []models.AuditEvent
+	// notices holds the changes of the transaction, notified once it commits
+	notices []changeNotice
+}
+
+// WithTx runs fn with a view of the keeper whose methods run on a single transaction.
+// The transaction is committed if fn returns nil and rolled back if it returns an error or panics.
+// Called on a view, WithTx runs fn in a savepoint of the outer transaction instead,
+// so only the changes of fn are undone on failure.
+func (bdk *BDKeeper) WithTx(ctx context.Context, fn func(tx storage.Keeper) error) (err error) {
+	defer bdk.observe("with_tx", "", time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+
+	return bdk.inTx(ctx, func(view *BDKeeper) error {
+		return fn(view)
+	})
+}
+
+// inTx runs fn with a view of the keeper on a new transaction,
+// or with the keeper itself on a savepoint if it is already a transaction view.
+func (bdk *BDKeeper) inTx(ctx context.Context, fn func(view *BDKeeper) error) error {
+	return bdk.inTxWith(ctx, nil, fn)
+}
+
+// inTxWith runs fn like inTx, a new transaction is started with the options.
+// A transaction aborted because of a concurrent one fails with models.ErrRetrySync.
+func (bdk *BDKeeper) inTxWith(ctx context.Context, opts *sql.TxOptions, fn func(view *BDKeeper) error) error {
+	if bdk.tx != nil {
+		return bdk.inSavepoint(ctx, fn)
+	}
+
+	err := bdk.runTx(ctx, opts, fn)
+	if bdk.dialect.isSerializationFailure(err) {
+		return fmt.Errorf("%w: %w", models.ErrRetrySync, err)
+	}
+
+	return err
+}
+
+// runTx runs fn with a view of the keeper on a new transaction with the options.
+func (bdk *BDKeeper) runTx(ctx context.Context, opts *sql.TxOptions, fn func(view *BDKeeper) error) error {
+	tx, err := bdk.conn.BeginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+	if bdk.rls {
+		if err := bdk.setTenant(ctx, tx); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	view := *bdk
+	view.ex = traceExecer{ex: tx, log: bdk.log}
+	view.tx = &txState{tx: tx}
+
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback()
+			bdk.flushAudit(ctx, view.tx.audit, false)
+			panic(p)
+		}
+	}()
+
+	err = fn(&view)
+	if err != nil {
+		_ = tx.Rollback()
+	} else {
+		err = tx.Commit()
+	}
+	bdk.flushAudit(ctx, view.tx.audit, err == nil)
+	if err == nil {
+		bdk.notify(ctx, view.tx.notices)
+	}
+
+	return err
+}
+
+// inSavepoint runs fn on a savepoint of the transaction of the view.
+// Unlike a failed statement outside one, a failed statement inside a savepoint
+// doesn't abort the whole PostgreSQL transaction once the savepoint is rolled back.
+func (bdk *BDKeeper) inSavepoint(ctx context.Context, fn func(view *BDKeeper) error) error {
+	bdk.tx.savepoints++
+	name := fmt.Sprintf("sp_%d", bdk.tx.savepoints)
+	// The audit events of fn fail with it and its changes aren't notified
+	events := len(bdk.tx.audit)
+	notices := len(bdk.tx.notices)
+
+	if _, err := bdk.tx.tx.ExecContext(ctx, "SAVEPOINT "+name); err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			_, _ = bdk.tx.tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+name)
+			panic(p)
+		}
+	}()
+
+	if err := fn(bdk); err != nil {
+		for i := events; i < len(bdk.tx.audit); i++ {
+			bdk.tx.audit[i].Success = false
+		}
+		bdk.tx.notices = bdk.tx.notices[:notices]
+		if _, rbErr := bdk.tx.tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+name); rbErr != nil {
+			return fmt.Errorf("%w (rollback to savepoint: %v)", err, rbErr)
+		}
+		return err
+	}
+
+	_, err := bdk.tx.tx.ExecContext(ctx, "RELEASE SAVEPOINT "+name)
+	return err
+}
@@ -0,0 +1,83 @@
+package bdkeeper
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/storage"
+)
+
+func TestBDKeeper_WithTx(t *testing.T) {
+	// Инициализация sqlmock
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error initializing mock database: %v", err)
+	}
+	defer db.Close()
+
+	// Создание экземпляра BDKeeper через функцию newTestBDKeeper
+	bdk := newTestBDKeeper(t, db)
+	bdk.SetHistoryLimit(0)
+	ctx := context.Background()
+	errAbort := errors.New("abort")
+
+	// Методы представления выполняются в одной транзакции, вложенные транзакции используют точки сохранения
+	mock.ExpectBegin()
+	mock.ExpectExec("SAVEPOINT sp_1").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectNoShare(mock, 1, "TextData", "entryID")
+	expectColumns(mock, "TextData", "id", "user_id", "deleted", "updated_at")
+	mock.ExpectQuery("UPDATE \"textdata\" SET deleted = TRUE(.+) RETURNING updated_at").
+		WithArgs(1, "entryID").
+		WillReturnRows(sqlmock.NewRows([]string{"updated_at"}).AddRow(dbNow))
+	mock.ExpectExec("RELEASE SAVEPOINT sp_1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("SAVEPOINT sp_2").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("SAVEPOINT sp_3").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectNoShare(mock, 1, "TextData", "other")
+	mock.ExpectQuery("UPDATE \"textdata\" SET deleted = TRUE(.+) RETURNING updated_at").
+		WithArgs(1, "other").
+		WillReturnError(assert.AnError)
+	mock.ExpectExec("ROLLBACK TO SAVEPOINT sp_3").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ROLLBACK TO SAVEPOINT sp_2").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	err = bdk.WithTx(ctx, func(tx storage.Keeper) error {
+		if _, err := tx.DeleteData(ctx, "TextData", 1, "entryID"); err != nil {
+			return err
+		}
+
+		err := tx.WithTx(ctx, func(tx storage.Keeper) error {
+			_, err := tx.DeleteData(ctx, "TextData", 1, "other")
+			return err
+		})
+		assert.ErrorIs(t, err, assert.AnError)
+
+		// Представление не закрывает соединение
+		assert.False(t, tx.Close())
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Ошибка функции откатывает транзакцию
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	err = bdk.WithTx(ctx, func(tx storage.Keeper) error { return errAbort })
+	assert.ErrorIs(t, err, errAbort)
+
+	// Паника откатывает транзакцию и передается дальше
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	assert.PanicsWithValue(t, "boom", func() {
+		_ = bdk.WithTx(ctx, func(tx storage.Keeper) error { panic("boom") })
+	})
+
+	// Проверяем, что все ожидания выполнены
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Не выполнены ожидания: %s", err)
+	}
+}
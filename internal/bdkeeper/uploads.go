@@ -0,0 +1,157 @@
+package bdkeeper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// uploadSessionsTable holds the chunked uploads of the files of the users, their chunks are staged on disk.
+// It is only read by the user of the token, so like the operations it has no row-level security policy.
+const uploadSessionsTable = "upload_sessions"
+
+// uploadSessionColumns are the columns of an upload session read by scanUploadSession.
+const uploadSessionColumns = "id, user_id, entry_id, size, created_at, expires_at"
+
+// CreateUploadSession creates the upload session of the user and returns it with its creation time.
+func (bdk *BDKeeper) CreateUploadSession(ctx context.Context, session models.UploadSession) (_ models.UploadSession, err error) {
+	defer bdk.observe("create_upload_session", uploadSessionsTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return models.UploadSession{}, err
+	}
+	defer leave()
+	bdk.wrote(userWriter(session.UserID))
+
+	query := fmt.Sprintf(`INSERT INTO upload_sessions (id, user_id, entry_id, size, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, %s, $5) RETURNING %s`, bdk.dialect.now(), uploadSessionColumns)
+	row := bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), session.ID, session.UserID, session.EntryID,
+		session.Size, bdk.dialect.timeArg(session.ExpiresAt.UTC()))
+
+	return scanUploadSession(row)
+}
+
+// GetUploadSession returns the upload session of the user, or models.ErrNotFound if it is missing or expired.
+// It is read from the primary, the chunks of a session follow its creation at once.
+func (bdk *BDKeeper) GetUploadSession(ctx context.Context, userID int, id string) (_ models.UploadSession, err error) {
+	defer bdk.observe("get_upload_session", uploadSessionsTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return models.UploadSession{}, err
+	}
+	defer leave()
+
+	query := fmt.Sprintf(`SELECT %s FROM upload_sessions WHERE user_id = $1 AND id = $2 AND expires_at > %s`,
+		uploadSessionColumns, bdk.dialect.now())
+
+	return scanUploadSession(bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), userID, id))
+}
+
+// DeleteUploadSession deletes the upload session of the user, or returns models.ErrNotFound.
+func (bdk *BDKeeper) DeleteUploadSession(ctx context.Context, userID int, id string) (err error) {
+	defer bdk.observe("delete_upload_session", uploadSessionsTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	bdk.wrote(userWriter(userID))
+
+	query := `DELETE FROM upload_sessions WHERE user_id = $1 AND id = $2`
+	res, err := bdk.ex.ExecContext(ctx, bdk.dialect.rebind(query), userID, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete upload session: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return models.ErrNotFound
+	}
+
+	return nil
+}
+
+// FileEntryTaken reports whether another user has a file entry with the id, deleted or not. The files of all
+// the users are stored by the ids of their entries, so such an id can't name a file of the user.
+func (bdk *BDKeeper) FileEntryTaken(ctx context.Context, userID int, entryID string) (_ bool, err error) {
+	defer bdk.observe("file_entry_taken", models.FilesTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer leave()
+
+	// The entries of the other users are out of the sight of the user
+	if bdk.rls {
+		ctx = withBypass(ctx)
+	}
+
+	return scoped(ctx, bdk, func(view *BDKeeper) (bool, error) {
+		tbl, err := view.tableIdent(ctx, view.ex, models.FilesTable)
+		if err != nil {
+			return false, err
+		}
+		var found int
+		query := fmt.Sprintf("SELECT 1 FROM %s WHERE id = $1 AND user_id <> $2", tbl)
+		err = view.ex.QueryRowContext(ctx, view.dialect.rebind(query), entryID, userID).Scan(&found)
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to get entry: %w", err)
+		}
+
+		return true, nil
+	})
+}
+
+// PruneUploadSessions deletes the upload sessions expired before the given time and returns their ids,
+// for their chunks to be deleted as well.
+func (bdk *BDKeeper) PruneUploadSessions(ctx context.Context, before time.Time) (_ []string, err error) {
+	defer bdk.observe("prune_upload_sessions", uploadSessionsTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	query := `DELETE FROM upload_sessions WHERE expires_at < $1 RETURNING id`
+	rows, err := bdk.ex.QueryContext(ctx, bdk.dialect.rebind(query), bdk.dialect.timeArg(before.UTC()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prune upload sessions: %w", err)
+	}
+	defer rows.Close()
+
+	var pruned []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan upload session: %w", err)
+		}
+		pruned = append(pruned, id)
+	}
+
+	return pruned, rows.Err()
+}
+
+// scanUploadSession scans the uploadSessionColumns of the row, models.ErrNotFound if there is none.
+func scanUploadSession(row *sql.Row) (models.UploadSession, error) {
+	var session models.UploadSession
+	err := row.Scan(&session.ID, &session.UserID, &session.EntryID, &session.Size, &session.CreatedAt, &session.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.UploadSession{}, models.ErrNotFound
+	}
+	if err != nil {
+		return models.UploadSession{}, fmt.Errorf("failed to scan upload session: %w", err)
+	}
+	session.CreatedAt, session.ExpiresAt = session.CreatedAt.UTC(), session.ExpiresAt.UTC()
+
+	return session, nil
+}
@@ -0,0 +1,293 @@
+package bdkeeper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// GetUserAccess returns the role of the user, whether their account is disabled and the last change
+// of their password, or models.ErrNotFound. It always reads the primary, a disabled account must be
+// rejected at once.
+func (bdk *BDKeeper) GetUserAccess(ctx context.Context, userID int) (_ models.UserAccess, err error) {
+	defer bdk.observe("get_user_access", usersTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return models.UserAccess{}, err
+	}
+	defer leave()
+
+	var access models.UserAccess
+	var changedAt sql.NullTime
+	query := `SELECT role, disabled, password_changed_at FROM Users WHERE id = $1`
+	err = bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), userID).Scan(&access.Role, &access.Disabled, &changedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.UserAccess{}, models.ErrNotFound
+	}
+	if err != nil {
+		return models.UserAccess{}, fmt.Errorf("failed to get user access: %w", err)
+	}
+	if changedAt.Valid {
+		access.PasswordChangedAt = changedAt.Time
+	}
+
+	return access, nil
+}
+
+// ListUsers returns up to limit users with an id greater than afterID, by id, with the number and
+// the stored size of their live entries. The users and their usage are read on one snapshot.
+func (bdk *BDKeeper) ListUsers(ctx context.Context, afterID int, limit int) (_ []models.UserSummary, err error) {
+	defer bdk.observe("list_users", usersTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	// The usage sums the entries of every user of the page
+	if bdk.rls {
+		ctx = withBypass(ctx)
+	}
+
+	var users []models.UserSummary
+	err = bdk.inSnapshot(ctx, "list_users", func(view *BDKeeper) error {
+		var err error
+		if users, err = view.listUsers(ctx, afterID, limit); err != nil || len(users) == 0 {
+			return err
+		}
+
+		byID := make(map[int]*models.UserSummary, len(users))
+		for i := range users {
+			byID[users[i].ID] = &users[i]
+		}
+		for _, table := range models.DataTables {
+			if err := view.addUsage(ctx, table, afterID, users[len(users)-1].ID, byID); err != nil {
+				return err
+			}
+		}
+
+		return view.addFileUsage(ctx, afterID, users[len(users)-1].ID, byID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// listUsers reads the accounts of a page of ListUsers.
+func (bdk *BDKeeper) listUsers(ctx context.Context, afterID int, limit int) ([]models.UserSummary, error) {
+	query := `SELECT id, username, role, disabled, last_login_at FROM Users WHERE id > $1 ORDER BY id LIMIT $2`
+	rows, err := bdk.ex.QueryContext(ctx, bdk.dialect.rebind(query), afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	defer rows.Close()
+
+	users := make([]models.UserSummary, 0)
+	for rows.Next() {
+		var u models.UserSummary
+		var lastLogin sql.NullTime
+		if err := rows.Scan(&u.ID, &u.Username, &u.Role, &u.Disabled, &lastLogin); err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		if lastLogin.Valid {
+			at := lastLogin.Time.UTC()
+			u.LastLoginAt = &at
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows encountered an error: %w", err)
+	}
+
+	return users, nil
+}
+
+// addUsage adds the live entries of the table of the users with an id in (afterID, lastID] to their usage.
+func (bdk *BDKeeper) addUsage(ctx context.Context, table string, afterID, lastID int, users map[int]*models.UserSummary) error {
+	schema, err := bdk.tableColumns(ctx, bdk.ex, table)
+	if err != nil {
+		return err
+	}
+	tbl, err := bdk.tableIdent(ctx, bdk.ex, table)
+	if err != nil {
+		return err
+	}
+	size := "0"
+	if schema.size {
+		size = "COALESCE(" + schema.column(payloadSizeColumn) + ", 0)"
+	}
+
+	query := fmt.Sprintf(`SELECT user_id, COUNT(*), COALESCE(SUM(%s), 0) FROM %s
+		WHERE user_id > $1 AND user_id <= $2 AND deleted = false GROUP BY user_id`, size, tbl)
+	rows, err := bdk.ex.QueryContext(ctx, bdk.dialect.rebind(query), afterID, lastID)
+	if err != nil {
+		return fmt.Errorf("failed to sum usage of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID, entries int
+		var bytes int64
+		if err := rows.Scan(&userID, &entries, &bytes); err != nil {
+			return fmt.Errorf("failed to scan usage of %s: %w", table, err)
+		}
+		if u, ok := users[userID]; ok {
+			u.Entries += entries
+			u.Bytes += bytes
+		}
+	}
+
+	return rows.Err()
+}
+
+// addFileUsage adds the size of the files of the live entries in the blob store of the users with an id
+// in (afterID, lastID] to their usage, once per entry as the logical one and once per contents as the physical one.
+func (bdk *BDKeeper) addFileUsage(ctx context.Context, afterID, lastID int, users map[int]*models.UserSummary) error {
+	schema, tbl, err := bdk.blobTable(ctx)
+	if err != nil {
+		return err
+	}
+
+	size, sum := schema.column(blobSizeColumn), schema.column(blobSHA256Column)
+	query := fmt.Sprintf(`SELECT user_id, COALESCE(SUM(entries * size), 0), COALESCE(SUM(size), 0) FROM (
+			SELECT user_id, COUNT(*) AS entries, MAX(%s) AS size FROM %s
+			WHERE user_id > $1 AND user_id <= $2 AND deleted = false AND %s IS NOT NULL GROUP BY user_id, %s
+		) AS files GROUP BY user_id`, size, tbl, schema.column(blobKeyColumn), sum)
+	rows, err := bdk.ex.QueryContext(ctx, bdk.dialect.rebind(query), afterID, lastID)
+	if err != nil {
+		return fmt.Errorf("failed to sum file usage: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID int
+		var logical, physical int64
+		if err := rows.Scan(&userID, &logical, &physical); err != nil {
+			return fmt.Errorf("failed to scan file usage: %w", err)
+		}
+		if u, ok := users[userID]; ok {
+			u.LogicalFileBytes += logical
+			u.PhysicalFileBytes += physical
+		}
+	}
+
+	return rows.Err()
+}
+
+// SetUserDisabled disables or enables the account of the user, or returns models.ErrNotFound.
+// Disabling it also revokes all of their refresh tokens, an enabled user logs in again.
+func (bdk *BDKeeper) SetUserDisabled(ctx context.Context, userID int, disabled bool) (err error) {
+	defer bdk.observe("set_user_disabled", usersTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	bdk.wrote(userWriter(userID))
+
+	return bdk.inTx(ctx, func(view *BDKeeper) error {
+		var username string
+		query := `UPDATE Users SET disabled = $1 WHERE id = $2 RETURNING username`
+		err := view.ex.QueryRowContext(ctx, view.dialect.rebind(query), disabled, userID).Scan(&username)
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set user disabled: %w", err)
+		}
+		bdk.wrote(accountWriter(username))
+		if !disabled {
+			return nil
+		}
+
+		query = `UPDATE refresh_tokens SET revoked = TRUE WHERE user_id = $1 AND revoked = FALSE`
+		if _, err := view.ex.ExecContext(ctx, view.dialect.rebind(query), userID); err != nil {
+			return fmt.Errorf("failed to revoke refresh tokens: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// userTables are the tables other than the data tables holding rows of the users, deleted with them.
+var userTables = []string{historyTable, auditTable, refreshTokensTable, loginHistoryTable, apiKeysTable, emailTokensTable, devicesTable, userOperationsTable, uploadSessionsTable, foldersTable}
+
+// DeleteUser deletes the account of the user with their entries, their history, their audit events,
+// their refresh tokens, their API keys, their email tokens, their devices, their operations, their uploads,
+// their folders, their logins and the shares with them, in one transaction, or returns models.ErrNotFound. The shares of their
+// entries are revoked.
+func (bdk *BDKeeper) DeleteUser(ctx context.Context, userID int) (err error) {
+	defer bdk.observe("delete_user", usersTable, time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	bdk.wrote(userWriter(userID))
+
+	// The rows of the user are deleted on behalf of the admin
+	if bdk.rls {
+		ctx = withBypass(ctx)
+	}
+
+	return bdk.inTx(ctx, func(view *BDKeeper) error {
+		var username string
+		query := `SELECT username FROM Users WHERE id = $1`
+		err := view.ex.QueryRowContext(ctx, view.dialect.rebind(query), userID).Scan(&username)
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get user: %w", err)
+		}
+		bdk.wrote(accountWriter(username))
+
+		for _, table := range models.DataTables {
+			// The files drop their references to the contents they share with the files of other users
+			if table == models.FilesTable {
+				if err := view.deleteUserFiles(ctx, userID); err != nil {
+					return err
+				}
+				continue
+			}
+			tbl, err := view.tableIdent(ctx, view.ex, table)
+			if err != nil {
+				return err
+			}
+			if _, err := view.ex.ExecContext(ctx, view.dialect.rebind(fmt.Sprintf("DELETE FROM %s WHERE user_id = $1", tbl)), userID); err != nil {
+				return fmt.Errorf("failed to delete entries of %s: %w", table, err)
+			}
+		}
+		// The tables are fixed, their names are folded to lower case as tableIdent does
+		for _, table := range userTables {
+			query := fmt.Sprintf("DELETE FROM %s WHERE user_id = $1", internalIdent(table))
+			if _, err := view.ex.ExecContext(ctx, view.dialect.rebind(query), userID); err != nil {
+				return fmt.Errorf("failed to delete rows of %s: %w", table, err)
+			}
+		}
+
+		// The grantees of the entries of the user drop them on their next sync
+		query = fmt.Sprintf(`UPDATE shared_entries SET revoked = TRUE, updated_at = %s WHERE owner_id = $1 AND revoked = FALSE`,
+			view.dialect.nextTime("updated_at"))
+		if _, err := view.ex.ExecContext(ctx, view.dialect.rebind(query), userID); err != nil {
+			return fmt.Errorf("failed to revoke shares: %w", err)
+		}
+		query = `DELETE FROM shared_entries WHERE grantee_id = $1`
+		if _, err := view.ex.ExecContext(ctx, view.dialect.rebind(query), userID); err != nil {
+			return fmt.Errorf("failed to delete shares: %w", err)
+		}
+
+		query = `DELETE FROM Users WHERE id = $1`
+		if _, err := view.ex.ExecContext(ctx, view.dialect.rebind(query), userID); err != nil {
+			return fmt.Errorf("failed to delete user: %w", err)
+		}
+
+		return nil
+	})
+}
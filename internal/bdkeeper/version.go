@@ -0,0 +1,57 @@
+package bdkeeper
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// GetUserDataVersion returns the version of the entries of the user across the data tables with a single
+// aggregate query, no entry data is read. The entries expired by the database clock are counted,
+// so the version changes once an entry expires even though no row was written.
+func (bdk *BDKeeper) GetUserDataVersion(ctx context.Context, userID int) (_ models.DataVersion, err error) {
+	defer bdk.observe("get_user_data_version", "", time.Now(), &err)
+	ctx, leave, err := bdk.enter(ctx)
+	if err != nil {
+		return models.DataVersion{}, err
+	}
+	defer leave()
+
+	return scoped(ctx, bdk.reader(userWriter(userID)), func(view *BDKeeper) (models.DataVersion, error) {
+		return view.getUserDataVersion(ctx, userID)
+	})
+}
+
+// getUserDataVersion runs GetUserDataVersion on the keeper or view.
+func (bdk *BDKeeper) getUserDataVersion(ctx context.Context, userID int) (models.DataVersion, error) {
+	selects := make([]string, 0, len(models.DataTables))
+	for _, table := range models.DataTables {
+		tbl, err := bdk.tableIdent(ctx, bdk.ex, table)
+		if err != nil {
+			return models.DataVersion{}, err
+		}
+		selects = append(selects, fmt.Sprintf("SELECT updated_at, CASE WHEN %s THEN 0 ELSE 1 END AS expired FROM %s WHERE user_id = $1",
+			bdk.notExpired(), tbl))
+	}
+	query := fmt.Sprintf("SELECT MAX(updated_at), COUNT(*), COALESCE(SUM(expired), 0) FROM (%s) entries",
+		strings.Join(selects, " UNION ALL "))
+
+	// The latest time is scanned as text, SQLite returns the aggregate of its text timestamps untyped
+	var version models.DataVersion
+	var updatedAt sql.NullString
+	err := bdk.ex.QueryRowContext(ctx, bdk.dialect.rebind(query), userID).Scan(&updatedAt, &version.Entries, &version.Expired)
+	if err != nil {
+		return models.DataVersion{}, fmt.Errorf("failed to get the data version: %w", err)
+	}
+	if updatedAt.Valid {
+		if version.UpdatedAt, err = time.Parse(time.RFC3339Nano, updatedAt.String); err != nil {
+			return models.DataVersion{}, fmt.Errorf("failed to parse the data version: %w", err)
+		}
+	}
+
+	return version, nil
+}
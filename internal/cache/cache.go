@@ -0,0 +1,195 @@
+// Package cache provides a bounded in-process cache shared by the components of the server.
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// Stats describes the usage of a cache.
+type Stats struct {
+	Name      string
+	Entries   int
+	Hits      int64
+	Misses    int64
+	Evictions int64
+}
+
+// entry is a cached value with its key, so an evicted list element can be removed from the map.
+type entry[K comparable, V any] struct {
+	key       K
+	value     V
+	expiresAt time.Time
+}
+
+// call is a load in progress, concurrent loads of the same key wait for it.
+type call[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+// Cache is an LRU cache holding up to a maximum number of entries, optionally for a limited time.
+// It is safe for concurrent use.
+type Cache[K comparable, V any] struct {
+	name       string
+	maxEntries int
+	ttl        time.Duration
+	now        func() time.Time
+
+	mu        sync.Mutex
+	order     *list.List
+	items     map[K]*list.Element
+	calls     map[K]*call[V]
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+// New creates a new instance of Cache with the specified name and bounds.
+// A maxEntries of 0 or less leaves the number of entries unbounded, a ttl of 0 keeps them until evicted.
+func New[K comparable, V any](name string, maxEntries int, ttl time.Duration) *Cache[K, V] {
+	return &Cache[K, V]{
+		name:       name,
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		now:        time.Now,
+		order:      list.New(),
+		items:      make(map[K]*list.Element),
+		calls:      make(map[K]*call[V]),
+	}
+}
+
+// Get returns the value cached for the key and whether it was found.
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.get(key)
+}
+
+// Add caches the value for the key, evicting the least recently used entry if the cache is full.
+func (c *Cache[K, V]) Add(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.add(key, value)
+}
+
+// Remove drops the value cached for the key.
+func (c *Cache[K, V]) Remove(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.order.Remove(el)
+		delete(c.items, key)
+	}
+}
+
+// GetOrLoad returns the value cached for the key or loads and caches it.
+// Concurrent calls for the same key share a single load, a failed load isn't cached.
+// A caller stops waiting for the load of another one when its context is done.
+func (c *Cache[K, V]) GetOrLoad(ctx context.Context, key K, load func(context.Context) (V, error)) (V, error) {
+	c.mu.Lock()
+	if v, ok := c.get(key); ok {
+		c.mu.Unlock()
+		return v, nil
+	}
+	if cl, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+
+		select {
+		case <-cl.done:
+			return cl.value, cl.err
+		case <-ctx.Done():
+			var zero V
+			return zero, ctx.Err()
+		}
+	}
+
+	cl := &call[V]{done: make(chan struct{})}
+	c.calls[key] = cl
+	c.mu.Unlock()
+
+	cl.value, cl.err = load(ctx)
+
+	c.mu.Lock()
+	if cl.err == nil {
+		c.add(key, cl.value)
+	}
+	delete(c.calls, key)
+	c.mu.Unlock()
+	close(cl.done)
+
+	return cl.value, cl.err
+}
+
+// Len returns the number of cached entries, including expired ones not evicted yet.
+func (c *Cache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+// Stats returns the name of the cache, its number of entries and its hit, miss and eviction counts.
+func (c *Cache[K, V]) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return Stats{
+		Name:      c.name,
+		Entries:   c.order.Len(),
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
+
+// get looks the key up and counts the hit or miss, the caller must hold the lock.
+func (c *Cache[K, V]) get(key K) (V, bool) {
+	el, ok := c.items[key]
+	if ok {
+		e := el.Value.(*entry[K, V])
+		if e.expiresAt.IsZero() || c.now().Before(e.expiresAt) {
+			c.order.MoveToFront(el)
+			c.hits++
+			return e.value, true
+		}
+
+		// An expired entry is dropped, it doesn't count as an eviction
+		c.order.Remove(el)
+		delete(c.items, key)
+	}
+
+	c.misses++
+	var zero V
+	return zero, false
+}
+
+// add caches the value and evicts the entries over the limit, the caller must hold the lock.
+func (c *Cache[K, V]) add(key K, value V) {
+	var expiresAt time.Time
+	if c.ttl > 0 {
+		expiresAt = c.now().Add(c.ttl)
+	}
+
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*entry[K, V])
+		e.value, e.expiresAt = value, expiresAt
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&entry[K, V]{key: key, value: value, expiresAt: expiresAt})
+
+	for c.maxEntries > 0 && c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*entry[K, V]).key)
+		c.evictions++
+	}
+}
@@ -0,0 +1,151 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache_EvictionOrder(t *testing.T) {
+	c := New[string, int]("test", 2, 0)
+
+	c.Add("a", 1)
+	c.Add("b", 2)
+
+	// Reading "a" makes "b" the least recently used entry
+	v, ok := c.Get("a")
+	require.True(t, ok)
+	assert.Equal(t, 1, v)
+
+	c.Add("c", 3)
+
+	_, ok = c.Get("b")
+	assert.False(t, ok)
+	_, ok = c.Get("a")
+	assert.True(t, ok)
+	_, ok = c.Get("c")
+	assert.True(t, ok)
+	assert.Equal(t, 2, c.Len())
+
+	// Replacing a value doesn't evict anything
+	c.Add("c", 4)
+	v, _ = c.Get("c")
+	assert.Equal(t, 4, v)
+	assert.Equal(t, 2, c.Len())
+
+	c.Remove("a")
+	_, ok = c.Get("a")
+	assert.False(t, ok)
+	assert.Equal(t, 1, c.Len())
+}
+
+func TestCache_TTL(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := New[string, int]("test", 0, time.Minute)
+	c.now = func() time.Time { return now }
+
+	c.Add("a", 1)
+
+	now = now.Add(59 * time.Second)
+	_, ok := c.Get("a")
+	assert.True(t, ok)
+
+	now = now.Add(time.Second)
+	_, ok = c.Get("a")
+	assert.False(t, ok)
+	assert.Equal(t, 0, c.Len())
+
+	// An expired entry is loaded again
+	v, err := c.GetOrLoad(context.Background(), "a", func(context.Context) (int, error) { return 2, nil })
+	require.NoError(t, err)
+	assert.Equal(t, 2, v)
+}
+
+func TestCache_GetOrLoad(t *testing.T) {
+	c := New[string, int]("test", 10, 0)
+
+	var loads int32
+	release := make(chan struct{})
+	load := func(context.Context) (int, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return 42, nil
+	}
+
+	// Concurrent loaders of the same key share one load
+	var wg sync.WaitGroup
+	results := make([]int, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, err := c.GetOrLoad(context.Background(), "answer", load)
+			assert.NoError(t, err)
+			results[i] = v
+		}(i)
+	}
+
+	// Wait for the first load to start before releasing it
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&loads) == 1 }, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&loads))
+	for _, v := range results {
+		assert.Equal(t, 42, v)
+	}
+
+	// Failed loads aren't cached
+	errLoad := errors.New("load failed")
+	_, err := c.GetOrLoad(context.Background(), "broken", func(context.Context) (int, error) { return 0, errLoad })
+	assert.ErrorIs(t, err, errLoad)
+	_, ok := c.Get("broken")
+	assert.False(t, ok)
+}
+
+func TestCache_GetOrLoadCanceled(t *testing.T) {
+	c := New[string, int]("test", 10, 0)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	go func() {
+		_, _ = c.GetOrLoad(context.Background(), "slow", func(context.Context) (int, error) {
+			close(started)
+			<-release
+			return 1, nil
+		})
+	}()
+	<-started
+
+	// A waiter gives up when its context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := c.GetOrLoad(ctx, "slow", func(context.Context) (int, error) { return 2, nil })
+	assert.ErrorIs(t, err, context.Canceled)
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		v, ok := c.Get("slow")
+		return ok && v == 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestCache_Stats(t *testing.T) {
+	c := New[int, int]("numbers", 2, 0)
+
+	c.Add(1, 1)
+	c.Add(2, 2)
+	c.Add(3, 3)
+
+	c.Get(1)
+	c.Get(2)
+	c.Get(3)
+
+	assert.Equal(t, Stats{Name: "numbers", Entries: 2, Hits: 2, Misses: 1, Evictions: 1}, c.Stats())
+}
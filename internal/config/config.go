@@ -8,13 +8,88 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"time"
 )
 
 // Options represents the configuration options.
 type Options struct {
 	flagRunAddr, flagDataBaseDSN, flagLogLevel,
-	flagHTTPSCertFile, flagHTTPSKeyFile, flagJWTSigningKey, flagFileStoragePath string
-	flagEnableHTTPS bool
+	flagHTTPSCertFile, flagHTTPSKeyFile, flagJWTSigningKey, flagFileStoragePath, flagRLSBypassRole string
+	flagEnableHTTPS      bool
+	flagShedMaxInFlight  int
+	flagShedMaxLatency   time.Duration
+	flagHistoryVersions  int
+	flagExpiryInterval   time.Duration
+	flagRowLevelSecurity bool
+	flagReadDSN          string
+	flagReadAfterWrite   time.Duration
+	flagEncryptionKey    string
+	flagEncryptionKeyID  string
+	flagPreviousKeys     string
+	flagAuditRetention   time.Duration
+	flagDryRunJobs       string
+	flagVerifyReads      bool
+	flagAccessTokenTTL   time.Duration
+	flagRefreshTokenTTL  time.Duration
+	flagLoginMaxFailures int
+	flagLoginIPLimit     int
+	flagLoginHistory     int
+	flagArgon2Memory     int
+	flagArgon2Time       int
+	flagArgon2Threads    int
+	flagArgon2SaltLen    int
+	flagPasswordMinLen   int
+	flagPasswordClasses  string
+	flagLegacyHashed     bool
+	flagSMTPAddr         string
+	flagSMTPUsername     string
+	flagSMTPPassword     string
+	flagSMTPFrom         string
+	flagMailTemplates    string
+	flagVerifyTokenTTL   time.Duration
+	flagResetTokenTTL    time.Duration
+	flagRotationBatch    int
+	flagRotationSample   int
+	flagPlainPreviews    bool
+	flagJWTKeys          string
+	flagJWTActiveKey     string
+	flagJWTIssuer        string
+	flagJWTAudience      string
+	flagMonitorInterval  time.Duration
+	flagMonitorRateLimit int
+	flagAuthRateLimit    int
+	flagAuthRateBurst    int
+	flagDataRateLimit    int
+	flagDataRateBurst    int
+	flagExportRateLimit  int
+	flagExportRateBurst  int
+	flagReservedNames    string
+	flagNameCheckerURL   string
+	flagNameCheckerTTL   time.Duration
+	flagNameFailClosed   bool
+	flagEventsRelay      bool
+	flagEgressAllow      string
+	flagEgressProxy      string
+	flagCompressMinSize  int
+	flagMaxDecompressed  int
+	flagReencryptTimeout time.Duration
+	flagImportMaxSize    int
+	flagUploadSessionTTL time.Duration
+	flagUploadChunkSize  int
+	flagReplPrimary      string
+	flagReplToken        string
+	flagReplUser         string
+	flagReplInterval     time.Duration
+	flagBlobStore        string
+	flagBlobDir          string
+	flagS3Endpoint       string
+	flagS3Region         string
+	flagS3Bucket         string
+	flagS3AccessKey      string
+	flagS3SecretKey      string
+	flagS3PathStyle      bool
+	flagBlobGCInterval   time.Duration
+	flagBlobGCGrace      time.Duration
 }
 
 // NewOptions creates a new instance of Options.
@@ -25,13 +100,88 @@ func NewOptions() *Options {
 // ParseFlags handles command line arguments and stores their values in the corresponding variables.
 func (o *Options) ParseFlags() {
 	regStringVar(&o.flagRunAddr, "a", ":8080", "address and port to run server")
-	regStringVar(&o.flagDataBaseDSN, "d", "", "")
+	regStringVar(&o.flagDataBaseDSN, "d", "", "database DSN, postgres://... or sqlite:///path/to/db")
 	regStringVar(&o.flagLogLevel, "l", "info", "log level")
 	regStringVar(&o.flagHTTPSCertFile, "r", "server.crt", "path to https cert file")
 	regStringVar(&o.flagHTTPSKeyFile, "k", "server.key", "path to https key file")
 	regBoolVar(&o.flagEnableHTTPS, "s", false, "enable https")
 	regStringVar(&o.flagJWTSigningKey, "j", "test_key", "jwt signing key")
 	regStringVar(&o.flagFileStoragePath, "n", "", "file storage path")
+	regIntVar(&o.flagShedMaxInFlight, "c", 256, "in-flight requests above which load is shed, 0 disables")
+	regDurationVar(&o.flagShedMaxLatency, "t", time.Second, "p95 request latency above which load is shed, 0 disables")
+	regIntVar(&o.flagHistoryVersions, "v", 10, "prior versions retained per entry, 0 disables the history")
+	regDurationVar(&o.flagExpiryInterval, "x", time.Minute, "interval of deleting the expired entries, 0 disables")
+	regBoolVar(&o.flagRowLevelSecurity, "e", false, "enforce PostgreSQL row-level security per user")
+	regStringVar(&o.flagRLSBypassRole, "b", "", "role with BYPASSRLS used by the background jobs under row-level security")
+	regStringVar(&o.flagReadDSN, "o", "", "DSN of a PostgreSQL read replica serving the reads, empty reads from the primary")
+	regDurationVar(&o.flagReadAfterWrite, "w", 5*time.Second, "time after a write of a user during which their reads stay on the primary")
+	regStringVar(&o.flagEncryptionKey, "m", "", "base64 of the 32-byte key encrypting the sensitive columns, empty disables the encryption")
+	regStringVar(&o.flagEncryptionKeyID, "i", "1", "id of the encryption key, stored with the encrypted values")
+	regStringVar(&o.flagPreviousKeys, "g", "", "previous encryption keys still read during a rotation, as id=base64 pairs separated by commas")
+	regDurationVar(&o.flagAuditRetention, "u", 90*24*time.Hour, "time the audit events are kept, 0 keeps them forever")
+	regStringVar(&o.flagDryRunJobs, "y", "", "background jobs only reporting what they would delete, separated by commas: expiry, audit_pruning")
+	regBoolVar(&o.flagVerifyReads, "f", false, "compare the entries read with their checksums, marking the mismatching ones with a data warning")
+	regDurationVar(&o.flagAccessTokenTTL, "q", 15*time.Minute, "lifetime of the access tokens, renewed with a refresh token, 0 issues tokens that don't expire")
+	regDurationVar(&o.flagRefreshTokenTTL, "z", 30*24*time.Hour, "lifetime of the refresh tokens, each refresh issues a new one")
+	regIntVar(&o.flagLoginMaxFailures, "p", 5, "consecutive failed logins locking an account for 1, 5, then 15 minutes, 0 disables")
+	regIntVar(&o.flagLoginIPLimit, "login-ip-limit", 20, "failed logins from an address per minute above which its logins are rejected, 0 disables")
+	regIntVar(&o.flagLoginHistory, "login-history", 100, "login attempts kept in the login history of each user, 0 keeps them all")
+	regIntVar(&o.flagArgon2Memory, "argon2-memory", 64*1024, "memory of the Argon2id password hashes in KiB, a change rehashes the passwords at login")
+	regIntVar(&o.flagArgon2Time, "argon2-time", 3, "iterations of the Argon2id password hashes")
+	regIntVar(&o.flagArgon2Threads, "argon2-parallelism", 2, "threads of the Argon2id password hashes")
+	regIntVar(&o.flagArgon2SaltLen, "argon2-salt-length", 16, "salt length of the Argon2id password hashes in bytes")
+	regIntVar(&o.flagPasswordMinLen, "password-min-length", 8, "minimum length of the passwords chosen in plain, in characters")
+	regStringVar(&o.flagPasswordClasses, "password-classes", "", "character classes the passwords chosen in plain contain, separated by commas: lowercase, uppercase, digit, symbol")
+	regBoolVar(&o.flagLegacyHashed, "legacy-hashed-passwords", false, "accept the bcrypt hashes the legacy clients send as the passwords, unchecked by the password policy")
+	regStringVar(&o.flagSMTPAddr, "smtp-addr", "", "host:port of the SMTP server sending the account emails, empty disables the emails")
+	regStringVar(&o.flagSMTPUsername, "smtp-username", "", "username of the SMTP server, empty sends without authentication")
+	regStringVar(&o.flagSMTPPassword, "smtp-password", "", "password of the SMTP server")
+	regStringVar(&o.flagSMTPFrom, "smtp-from", "gophkeeper@localhost", "sender address of the account emails")
+	regStringVar(&o.flagMailTemplates, "mail-templates", "", "directory of the templates overriding the default ones of the emails, as <language>/<notification>.txt and .html")
+	regDurationVar(&o.flagVerifyTokenTTL, "verify-token-ttl", 24*time.Hour, "lifetime of the tokens mailed to verify an email")
+	regDurationVar(&o.flagResetTokenTTL, "reset-token-ttl", time.Hour, "lifetime of the tokens mailed to reset a password")
+	regIntVar(&o.flagRotationBatch, "rotation-batch", 500, "rows re-encrypted per transaction by the key rotation run while previous keys are configured")
+	regIntVar(&o.flagRotationSample, "rotation-sample", 100, "rows per table checked to decrypt with the current key alone once the key rotation is done")
+	regBoolVar(&o.flagPlainPreviews, "plaintext-previews", true, "accept the plaintext previews of the notes, false rejects them where no metadata may be stored in plain")
+	regStringVar(&o.flagJWTKeys, "jwt-keys", "", "keys signing the access tokens as id=source pairs separated by commas, a source is file:<pem>, env:<name> or a base64 secret, empty signs with -j")
+	regStringVar(&o.flagJWTActiveKey, "jwt-active-key", "", "id of the key of -jwt-keys signing the new access tokens, empty is the first one")
+	regStringVar(&o.flagJWTIssuer, "jwt-issuer", "gophkeeper", "issuer of the access tokens, the tokens of other issuers are rejected")
+	regStringVar(&o.flagJWTAudience, "jwt-audience", "gophkeeper", "audience of the access tokens, the tokens of other audiences are rejected")
+	regDurationVar(&o.flagMonitorInterval, "monitor-check-interval", 10*time.Second, "interval of the health checks whose result the monitor ping serves, 0 disables them and the ping reports stale")
+	regIntVar(&o.flagMonitorRateLimit, "monitor-rate-limit", 60, "monitor pings per minute per token above which they are rejected, 0 disables")
+	regIntVar(&o.flagAuthRateLimit, "auth-rate-limit", 30, "requests per minute per client to the authentication routes, 0 disables the limit")
+	regIntVar(&o.flagAuthRateBurst, "auth-rate-burst", 10, "requests a client may make at once to the authentication routes")
+	regIntVar(&o.flagDataRateLimit, "data-rate-limit", 600, "requests per minute per client to the data routes, 0 disables the limit")
+	regIntVar(&o.flagDataRateBurst, "data-rate-burst", 100, "requests a client may make at once to the data routes")
+	regIntVar(&o.flagExportRateLimit, "export-rate-limit", 6, "vault exports and imports per hour per client, 0 disables the limit")
+	regIntVar(&o.flagExportRateBurst, "export-rate-burst", 2, "vault exports and imports a client may make at once")
+	regStringVar(&o.flagReservedNames, "reserved-usernames", "", "usernames rejected at registration besides the ones reserved by the server, separated by commas")
+	regStringVar(&o.flagNameCheckerURL, "username-checker-url", "", "URL of an external service moderating the usernames at registration, empty disables it")
+	regDurationVar(&o.flagNameCheckerTTL, "username-checker-timeout", 2*time.Second, "time the external username checker has to answer")
+	regBoolVar(&o.flagNameFailClosed, "username-checker-fail-closed", false, "reject the registrations while the external username checker is unavailable, false accepts them")
+	regBoolVar(&o.flagEventsRelay, "events-relay", false, "notify the server instances sharing the database of each other's vault changes with PostgreSQL LISTEN/NOTIFY")
+	regStringVar(&o.flagEgressAllow, "egress-allow", "", "destinations the outbound connections may reach per class, as class=cidr,host;class=..., the private addresses are denied unless listed")
+	regStringVar(&o.flagEgressProxy, "egress-proxy", "", "URL of the proxy the outbound HTTP requests go through, empty connects directly")
+	regIntVar(&o.flagCompressMinSize, "compress-min-size", 1024, "size in bytes from which the responses are gzipped for the clients accepting it")
+	regIntVar(&o.flagMaxDecompressed, "max-decompressed-size", 32<<20, "size in bytes a gzipped push body may have once decompressed, a larger one is rejected with 413")
+	regDurationVar(&o.flagReencryptTimeout, "reencrypt-timeout", 10*time.Minute, "time a re-encryption of a vault may go without a heartbeat before its write fence expires and it fails")
+	regIntVar(&o.flagImportMaxSize, "import-max-size", 64<<20, "size in bytes an import body may have, a larger one is rejected with 413")
+	regDurationVar(&o.flagUploadSessionTTL, "upload-session-ttl", 24*time.Hour, "time a chunked upload may take until it is committed, its session and its chunks are deleted after")
+	regIntVar(&o.flagUploadChunkSize, "upload-chunk-max-size", 16<<20, "size in bytes a chunk of a chunked upload may have, a larger one is rejected with 413")
+	regStringVar(&o.flagReplPrimary, "replication-primary", "", "URL of the primary server the vault of -replication-user is replicated from, empty disables the replication")
+	regStringVar(&o.flagReplToken, "replication-token", "", "API key of the user on the primary server, with the read scope")
+	regStringVar(&o.flagReplUser, "replication-user", "", "username of the user whose vault is replicated, registered on both servers")
+	regDurationVar(&o.flagReplInterval, "replication-interval", time.Minute, "interval of the rounds of the replication from the primary server")
+	regStringVar(&o.flagBlobStore, "blob-store", "", "store of the contents of the files uploaded in chunks, fs or s3, empty keeps them in the file storage path")
+	regStringVar(&o.flagBlobDir, "blob-dir", "", "directory of the fs blob store, empty is the blobs directory of the file storage path")
+	regStringVar(&o.flagS3Endpoint, "s3-endpoint", "", "URL of the S3 or MinIO endpoint of the s3 blob store, e.g. https://s3.eu-central-1.amazonaws.com")
+	regStringVar(&o.flagS3Region, "s3-region", "us-east-1", "region the requests to the s3 blob store are signed for")
+	regStringVar(&o.flagS3Bucket, "s3-bucket", "", "bucket of the s3 blob store")
+	regStringVar(&o.flagS3AccessKey, "s3-access-key", "", "access key id of the s3 blob store")
+	regStringVar(&o.flagS3SecretKey, "s3-secret-key", "", "secret access key of the s3 blob store")
+	regBoolVar(&o.flagS3PathStyle, "s3-path-style", false, "address the bucket of the s3 blob store in the path rather than the host name, as MinIO does")
+	regDurationVar(&o.flagBlobGCInterval, "blob-gc-interval", time.Hour, "interval of deleting the objects of the blob store no file entry points at, 0 disables it")
+	regDurationVar(&o.flagBlobGCGrace, "blob-gc-grace", 24*time.Hour, "age from which an object of the blob store no file entry points at is deleted")
 
 	// parse the arguments passed to the server into registered variables
 	flag.Parse()
@@ -75,6 +225,531 @@ func (o *Options) ParseFlags() {
 		}
 	}
 
+	if envShedMaxInFlight := os.Getenv("SHED_MAX_IN_FLIGHT"); envShedMaxInFlight != "" {
+		maxInFlight, err := strconv.Atoi(envShedMaxInFlight)
+		if err == nil {
+			o.flagShedMaxInFlight = maxInFlight
+		} else {
+			fmt.Println("Failed to parse SHED_MAX_IN_FLIGHT as an integer value:", err)
+		}
+	}
+
+	if envShedMaxLatency := os.Getenv("SHED_MAX_LATENCY"); envShedMaxLatency != "" {
+		maxLatency, err := time.ParseDuration(envShedMaxLatency)
+		if err == nil {
+			o.flagShedMaxLatency = maxLatency
+		} else {
+			fmt.Println("Failed to parse SHED_MAX_LATENCY as a duration value:", err)
+		}
+	}
+
+	if envHistoryVersions := os.Getenv("HISTORY_VERSIONS"); envHistoryVersions != "" {
+		historyVersions, err := strconv.Atoi(envHistoryVersions)
+		if err == nil {
+			o.flagHistoryVersions = historyVersions
+		} else {
+			fmt.Println("Failed to parse HISTORY_VERSIONS as an integer value:", err)
+		}
+	}
+
+	if envExpiryInterval := os.Getenv("EXPIRY_INTERVAL"); envExpiryInterval != "" {
+		expiryInterval, err := time.ParseDuration(envExpiryInterval)
+		if err == nil {
+			o.flagExpiryInterval = expiryInterval
+		} else {
+			fmt.Println("Failed to parse EXPIRY_INTERVAL as a duration value:", err)
+		}
+	}
+
+	if envRowLevelSecurity := os.Getenv("ROW_LEVEL_SECURITY"); envRowLevelSecurity != "" {
+		rowLevelSecurity, err := strconv.ParseBool(envRowLevelSecurity)
+		if err == nil {
+			o.flagRowLevelSecurity = rowLevelSecurity
+		} else {
+			fmt.Println("Failed to parse ROW_LEVEL_SECURITY as a boolean value:", err)
+		}
+	}
+
+	if envRLSBypassRole := os.Getenv("RLS_BYPASS_ROLE"); envRLSBypassRole != "" {
+		o.flagRLSBypassRole = envRLSBypassRole
+	}
+
+	if envReadDSN := os.Getenv("DATABASE_READ_URI"); envReadDSN != "" {
+		o.flagReadDSN = envReadDSN
+	}
+
+	if envReadAfterWrite := os.Getenv("READ_AFTER_WRITE_WINDOW"); envReadAfterWrite != "" {
+		readAfterWrite, err := time.ParseDuration(envReadAfterWrite)
+		if err == nil {
+			o.flagReadAfterWrite = readAfterWrite
+		} else {
+			fmt.Println("Failed to parse READ_AFTER_WRITE_WINDOW as a duration value:", err)
+		}
+	}
+
+	if envEncryptionKey := os.Getenv("ENCRYPTION_KEY"); envEncryptionKey != "" {
+		o.flagEncryptionKey = envEncryptionKey
+	}
+
+	if envEncryptionKeyID := os.Getenv("ENCRYPTION_KEY_ID"); envEncryptionKeyID != "" {
+		o.flagEncryptionKeyID = envEncryptionKeyID
+	}
+
+	if envPreviousKeys := os.Getenv("ENCRYPTION_PREVIOUS_KEYS"); envPreviousKeys != "" {
+		o.flagPreviousKeys = envPreviousKeys
+	}
+
+	if envAuditRetention := os.Getenv("AUDIT_RETENTION"); envAuditRetention != "" {
+		auditRetention, err := time.ParseDuration(envAuditRetention)
+		if err == nil {
+			o.flagAuditRetention = auditRetention
+		} else {
+			fmt.Println("Failed to parse AUDIT_RETENTION as a duration value:", err)
+		}
+	}
+
+	if envDryRunJobs := os.Getenv("DRY_RUN_JOBS"); envDryRunJobs != "" {
+		o.flagDryRunJobs = envDryRunJobs
+	}
+
+	if envVerifyReads := os.Getenv("VERIFY_READS"); envVerifyReads != "" {
+		verifyReads, err := strconv.ParseBool(envVerifyReads)
+		if err == nil {
+			o.flagVerifyReads = verifyReads
+		} else {
+			fmt.Println("Failed to parse VERIFY_READS as a boolean value:", err)
+		}
+	}
+
+	if envAccessTokenTTL := os.Getenv("ACCESS_TOKEN_TTL"); envAccessTokenTTL != "" {
+		accessTokenTTL, err := time.ParseDuration(envAccessTokenTTL)
+		if err == nil {
+			o.flagAccessTokenTTL = accessTokenTTL
+		} else {
+			fmt.Println("Failed to parse ACCESS_TOKEN_TTL as a duration value:", err)
+		}
+	}
+
+	if envRefreshTokenTTL := os.Getenv("REFRESH_TOKEN_TTL"); envRefreshTokenTTL != "" {
+		refreshTokenTTL, err := time.ParseDuration(envRefreshTokenTTL)
+		if err == nil {
+			o.flagRefreshTokenTTL = refreshTokenTTL
+		} else {
+			fmt.Println("Failed to parse REFRESH_TOKEN_TTL as a duration value:", err)
+		}
+	}
+
+	if envLoginMaxFailures := os.Getenv("LOGIN_MAX_FAILURES"); envLoginMaxFailures != "" {
+		loginMaxFailures, err := strconv.Atoi(envLoginMaxFailures)
+		if err == nil {
+			o.flagLoginMaxFailures = loginMaxFailures
+		} else {
+			fmt.Println("Failed to parse LOGIN_MAX_FAILURES as an integer value:", err)
+		}
+	}
+
+	if envLoginIPLimit := os.Getenv("LOGIN_IP_LIMIT"); envLoginIPLimit != "" {
+		loginIPLimit, err := strconv.Atoi(envLoginIPLimit)
+		if err == nil {
+			o.flagLoginIPLimit = loginIPLimit
+		} else {
+			fmt.Println("Failed to parse LOGIN_IP_LIMIT as an integer value:", err)
+		}
+	}
+
+	if envLoginHistory := os.Getenv("LOGIN_HISTORY"); envLoginHistory != "" {
+		loginHistory, err := strconv.Atoi(envLoginHistory)
+		if err == nil {
+			o.flagLoginHistory = loginHistory
+		} else {
+			fmt.Println("Failed to parse LOGIN_HISTORY as an integer value:", err)
+		}
+	}
+
+	if envArgon2Memory := os.Getenv("ARGON2_MEMORY"); envArgon2Memory != "" {
+		argon2Memory, err := strconv.Atoi(envArgon2Memory)
+		if err == nil {
+			o.flagArgon2Memory = argon2Memory
+		} else {
+			fmt.Println("Failed to parse ARGON2_MEMORY as an integer value:", err)
+		}
+	}
+
+	if envArgon2Time := os.Getenv("ARGON2_TIME"); envArgon2Time != "" {
+		argon2Time, err := strconv.Atoi(envArgon2Time)
+		if err == nil {
+			o.flagArgon2Time = argon2Time
+		} else {
+			fmt.Println("Failed to parse ARGON2_TIME as an integer value:", err)
+		}
+	}
+
+	if envArgon2Parallelism := os.Getenv("ARGON2_PARALLELISM"); envArgon2Parallelism != "" {
+		argon2Parallelism, err := strconv.Atoi(envArgon2Parallelism)
+		if err == nil {
+			o.flagArgon2Threads = argon2Parallelism
+		} else {
+			fmt.Println("Failed to parse ARGON2_PARALLELISM as an integer value:", err)
+		}
+	}
+
+	if envArgon2SaltLength := os.Getenv("ARGON2_SALT_LENGTH"); envArgon2SaltLength != "" {
+		argon2SaltLength, err := strconv.Atoi(envArgon2SaltLength)
+		if err == nil {
+			o.flagArgon2SaltLen = argon2SaltLength
+		} else {
+			fmt.Println("Failed to parse ARGON2_SALT_LENGTH as an integer value:", err)
+		}
+	}
+
+	if envPasswordMinLength := os.Getenv("PASSWORD_MIN_LENGTH"); envPasswordMinLength != "" {
+		passwordMinLength, err := strconv.Atoi(envPasswordMinLength)
+		if err == nil {
+			o.flagPasswordMinLen = passwordMinLength
+		} else {
+			fmt.Println("Failed to parse PASSWORD_MIN_LENGTH as an integer value:", err)
+		}
+	}
+
+	if envPasswordClasses := os.Getenv("PASSWORD_CLASSES"); envPasswordClasses != "" {
+		o.flagPasswordClasses = envPasswordClasses
+	}
+
+	if envLegacyHashed := os.Getenv("LEGACY_HASHED_PASSWORDS"); envLegacyHashed != "" {
+		legacyHashed, err := strconv.ParseBool(envLegacyHashed)
+		if err == nil {
+			o.flagLegacyHashed = legacyHashed
+		} else {
+			fmt.Println("Failed to parse LEGACY_HASHED_PASSWORDS as a boolean value:", err)
+		}
+	}
+
+	if envSMTPAddr := os.Getenv("SMTP_ADDR"); envSMTPAddr != "" {
+		o.flagSMTPAddr = envSMTPAddr
+	}
+
+	if envSMTPUsername := os.Getenv("SMTP_USERNAME"); envSMTPUsername != "" {
+		o.flagSMTPUsername = envSMTPUsername
+	}
+
+	if envSMTPPassword := os.Getenv("SMTP_PASSWORD"); envSMTPPassword != "" {
+		o.flagSMTPPassword = envSMTPPassword
+	}
+
+	if envSMTPFrom := os.Getenv("SMTP_FROM"); envSMTPFrom != "" {
+		o.flagSMTPFrom = envSMTPFrom
+	}
+
+	if envMailTemplates := os.Getenv("MAIL_TEMPLATES"); envMailTemplates != "" {
+		o.flagMailTemplates = envMailTemplates
+	}
+
+	if envVerifyTokenTTL := os.Getenv("VERIFY_TOKEN_TTL"); envVerifyTokenTTL != "" {
+		verifyTokenTTL, err := time.ParseDuration(envVerifyTokenTTL)
+		if err == nil {
+			o.flagVerifyTokenTTL = verifyTokenTTL
+		} else {
+			fmt.Println("Failed to parse VERIFY_TOKEN_TTL as a duration value:", err)
+		}
+	}
+
+	if envResetTokenTTL := os.Getenv("RESET_TOKEN_TTL"); envResetTokenTTL != "" {
+		resetTokenTTL, err := time.ParseDuration(envResetTokenTTL)
+		if err == nil {
+			o.flagResetTokenTTL = resetTokenTTL
+		} else {
+			fmt.Println("Failed to parse RESET_TOKEN_TTL as a duration value:", err)
+		}
+	}
+
+	if envRotationBatch := os.Getenv("ROTATION_BATCH"); envRotationBatch != "" {
+		rotationBatch, err := strconv.Atoi(envRotationBatch)
+		if err == nil {
+			o.flagRotationBatch = rotationBatch
+		} else {
+			fmt.Println("Failed to parse ROTATION_BATCH as an integer value:", err)
+		}
+	}
+
+	if envRotationSample := os.Getenv("ROTATION_SAMPLE"); envRotationSample != "" {
+		rotationSample, err := strconv.Atoi(envRotationSample)
+		if err == nil {
+			o.flagRotationSample = rotationSample
+		} else {
+			fmt.Println("Failed to parse ROTATION_SAMPLE as an integer value:", err)
+		}
+	}
+
+	if envPlainPreviews := os.Getenv("PLAINTEXT_PREVIEWS"); envPlainPreviews != "" {
+		plainPreviews, err := strconv.ParseBool(envPlainPreviews)
+		if err == nil {
+			o.flagPlainPreviews = plainPreviews
+		} else {
+			fmt.Println("Failed to parse PLAINTEXT_PREVIEWS as a boolean value:", err)
+		}
+	}
+
+	if envJWTKeys := os.Getenv("JWT_KEYS"); envJWTKeys != "" {
+		o.flagJWTKeys = envJWTKeys
+	}
+
+	if envJWTActiveKey := os.Getenv("JWT_ACTIVE_KEY"); envJWTActiveKey != "" {
+		o.flagJWTActiveKey = envJWTActiveKey
+	}
+
+	if envJWTIssuer := os.Getenv("JWT_ISSUER"); envJWTIssuer != "" {
+		o.flagJWTIssuer = envJWTIssuer
+	}
+
+	if envJWTAudience := os.Getenv("JWT_AUDIENCE"); envJWTAudience != "" {
+		o.flagJWTAudience = envJWTAudience
+	}
+
+	if envMonitorInterval := os.Getenv("MONITOR_CHECK_INTERVAL"); envMonitorInterval != "" {
+		monitorInterval, err := time.ParseDuration(envMonitorInterval)
+		if err == nil {
+			o.flagMonitorInterval = monitorInterval
+		} else {
+			fmt.Println("Failed to parse MONITOR_CHECK_INTERVAL as a duration value:", err)
+		}
+	}
+
+	if envMonitorRateLimit := os.Getenv("MONITOR_RATE_LIMIT"); envMonitorRateLimit != "" {
+		monitorRateLimit, err := strconv.Atoi(envMonitorRateLimit)
+		if err == nil {
+			o.flagMonitorRateLimit = monitorRateLimit
+		} else {
+			fmt.Println("Failed to parse MONITOR_RATE_LIMIT as an integer value:", err)
+		}
+	}
+
+	if envAuthRateLimit := os.Getenv("AUTH_RATE_LIMIT"); envAuthRateLimit != "" {
+		authRateLimit, err := strconv.Atoi(envAuthRateLimit)
+		if err == nil {
+			o.flagAuthRateLimit = authRateLimit
+		} else {
+			fmt.Println("Failed to parse AUTH_RATE_LIMIT as an integer value:", err)
+		}
+	}
+
+	if envAuthRateBurst := os.Getenv("AUTH_RATE_BURST"); envAuthRateBurst != "" {
+		authRateBurst, err := strconv.Atoi(envAuthRateBurst)
+		if err == nil {
+			o.flagAuthRateBurst = authRateBurst
+		} else {
+			fmt.Println("Failed to parse AUTH_RATE_BURST as an integer value:", err)
+		}
+	}
+
+	if envDataRateLimit := os.Getenv("DATA_RATE_LIMIT"); envDataRateLimit != "" {
+		dataRateLimit, err := strconv.Atoi(envDataRateLimit)
+		if err == nil {
+			o.flagDataRateLimit = dataRateLimit
+		} else {
+			fmt.Println("Failed to parse DATA_RATE_LIMIT as an integer value:", err)
+		}
+	}
+
+	if envDataRateBurst := os.Getenv("DATA_RATE_BURST"); envDataRateBurst != "" {
+		dataRateBurst, err := strconv.Atoi(envDataRateBurst)
+		if err == nil {
+			o.flagDataRateBurst = dataRateBurst
+		} else {
+			fmt.Println("Failed to parse DATA_RATE_BURST as an integer value:", err)
+		}
+	}
+
+	if envExportRateLimit := os.Getenv("EXPORT_RATE_LIMIT"); envExportRateLimit != "" {
+		exportRateLimit, err := strconv.Atoi(envExportRateLimit)
+		if err == nil {
+			o.flagExportRateLimit = exportRateLimit
+		} else {
+			fmt.Println("Failed to parse EXPORT_RATE_LIMIT as an integer value:", err)
+		}
+	}
+
+	if envExportRateBurst := os.Getenv("EXPORT_RATE_BURST"); envExportRateBurst != "" {
+		exportRateBurst, err := strconv.Atoi(envExportRateBurst)
+		if err == nil {
+			o.flagExportRateBurst = exportRateBurst
+		} else {
+			fmt.Println("Failed to parse EXPORT_RATE_BURST as an integer value:", err)
+		}
+	}
+
+	if envReservedNames := os.Getenv("RESERVED_USERNAMES"); envReservedNames != "" {
+		o.flagReservedNames = envReservedNames
+	}
+
+	if envNameCheckerURL := os.Getenv("USERNAME_CHECKER_URL"); envNameCheckerURL != "" {
+		o.flagNameCheckerURL = envNameCheckerURL
+	}
+
+	if envNameCheckerTTL := os.Getenv("USERNAME_CHECKER_TIMEOUT"); envNameCheckerTTL != "" {
+		nameCheckerTTL, err := time.ParseDuration(envNameCheckerTTL)
+		if err == nil {
+			o.flagNameCheckerTTL = nameCheckerTTL
+		} else {
+			fmt.Println("Failed to parse USERNAME_CHECKER_TIMEOUT as a duration value:", err)
+		}
+	}
+
+	if envNameFailClosed := os.Getenv("USERNAME_CHECKER_FAIL_CLOSED"); envNameFailClosed != "" {
+		nameFailClosed, err := strconv.ParseBool(envNameFailClosed)
+		if err == nil {
+			o.flagNameFailClosed = nameFailClosed
+		} else {
+			fmt.Println("Failed to parse USERNAME_CHECKER_FAIL_CLOSED as a boolean value:", err)
+		}
+	}
+
+	if envEventsRelay := os.Getenv("EVENTS_RELAY"); envEventsRelay != "" {
+		eventsRelay, err := strconv.ParseBool(envEventsRelay)
+		if err == nil {
+			o.flagEventsRelay = eventsRelay
+		} else {
+			fmt.Println("Failed to parse EVENTS_RELAY as a boolean value:", err)
+		}
+	}
+
+	if envEgressAllow := os.Getenv("EGRESS_ALLOW"); envEgressAllow != "" {
+		o.flagEgressAllow = envEgressAllow
+	}
+
+	if envEgressProxy := os.Getenv("EGRESS_PROXY"); envEgressProxy != "" {
+		o.flagEgressProxy = envEgressProxy
+	}
+
+	if envCompressMinSize := os.Getenv("COMPRESS_MIN_SIZE"); envCompressMinSize != "" {
+		compressMinSize, err := strconv.Atoi(envCompressMinSize)
+		if err == nil {
+			o.flagCompressMinSize = compressMinSize
+		} else {
+			fmt.Println("Failed to parse COMPRESS_MIN_SIZE as an integer value:", err)
+		}
+	}
+
+	if envMaxDecompressed := os.Getenv("MAX_DECOMPRESSED_SIZE"); envMaxDecompressed != "" {
+		maxDecompressed, err := strconv.Atoi(envMaxDecompressed)
+		if err == nil {
+			o.flagMaxDecompressed = maxDecompressed
+		} else {
+			fmt.Println("Failed to parse MAX_DECOMPRESSED_SIZE as an integer value:", err)
+		}
+	}
+
+	if envReencryptTimeout := os.Getenv("REENCRYPT_TIMEOUT"); envReencryptTimeout != "" {
+		reencryptTimeout, err := time.ParseDuration(envReencryptTimeout)
+		if err == nil {
+			o.flagReencryptTimeout = reencryptTimeout
+		} else {
+			fmt.Println("Failed to parse REENCRYPT_TIMEOUT as a duration value:", err)
+		}
+	}
+
+	if envImportMaxSize := os.Getenv("IMPORT_MAX_SIZE"); envImportMaxSize != "" {
+		importMaxSize, err := strconv.Atoi(envImportMaxSize)
+		if err == nil {
+			o.flagImportMaxSize = importMaxSize
+		} else {
+			fmt.Println("Failed to parse IMPORT_MAX_SIZE as an integer value:", err)
+		}
+	}
+
+	if envUploadSessionTTL := os.Getenv("UPLOAD_SESSION_TTL"); envUploadSessionTTL != "" {
+		uploadSessionTTL, err := time.ParseDuration(envUploadSessionTTL)
+		if err == nil {
+			o.flagUploadSessionTTL = uploadSessionTTL
+		} else {
+			fmt.Println("Failed to parse UPLOAD_SESSION_TTL as a duration value:", err)
+		}
+	}
+
+	if envUploadChunkSize := os.Getenv("UPLOAD_CHUNK_MAX_SIZE"); envUploadChunkSize != "" {
+		uploadChunkSize, err := strconv.Atoi(envUploadChunkSize)
+		if err == nil {
+			o.flagUploadChunkSize = uploadChunkSize
+		} else {
+			fmt.Println("Failed to parse UPLOAD_CHUNK_MAX_SIZE as an integer value:", err)
+		}
+	}
+
+	if envReplPrimary := os.Getenv("REPLICATION_PRIMARY"); envReplPrimary != "" {
+		o.flagReplPrimary = envReplPrimary
+	}
+
+	if envReplToken := os.Getenv("REPLICATION_TOKEN"); envReplToken != "" {
+		o.flagReplToken = envReplToken
+	}
+
+	if envReplUser := os.Getenv("REPLICATION_USER"); envReplUser != "" {
+		o.flagReplUser = envReplUser
+	}
+
+	if envReplInterval := os.Getenv("REPLICATION_INTERVAL"); envReplInterval != "" {
+		replInterval, err := time.ParseDuration(envReplInterval)
+		if err == nil {
+			o.flagReplInterval = replInterval
+		} else {
+			fmt.Println("Failed to parse REPLICATION_INTERVAL as a duration value:", err)
+		}
+	}
+
+	if envBlobStore := os.Getenv("BLOB_STORE"); envBlobStore != "" {
+		o.flagBlobStore = envBlobStore
+	}
+
+	if envBlobDir := os.Getenv("BLOB_DIR"); envBlobDir != "" {
+		o.flagBlobDir = envBlobDir
+	}
+
+	if envS3Endpoint := os.Getenv("S3_ENDPOINT"); envS3Endpoint != "" {
+		o.flagS3Endpoint = envS3Endpoint
+	}
+
+	if envS3Region := os.Getenv("S3_REGION"); envS3Region != "" {
+		o.flagS3Region = envS3Region
+	}
+
+	if envS3Bucket := os.Getenv("S3_BUCKET"); envS3Bucket != "" {
+		o.flagS3Bucket = envS3Bucket
+	}
+
+	if envS3AccessKey := os.Getenv("S3_ACCESS_KEY"); envS3AccessKey != "" {
+		o.flagS3AccessKey = envS3AccessKey
+	}
+
+	if envS3SecretKey := os.Getenv("S3_SECRET_KEY"); envS3SecretKey != "" {
+		o.flagS3SecretKey = envS3SecretKey
+	}
+
+	if envS3PathStyle := os.Getenv("S3_PATH_STYLE"); envS3PathStyle != "" {
+		s3PathStyle, err := strconv.ParseBool(envS3PathStyle)
+		if err == nil {
+			o.flagS3PathStyle = s3PathStyle
+		} else {
+			fmt.Println("Failed to parse S3_PATH_STYLE as a boolean value:", err)
+		}
+	}
+
+	if envBlobGCInterval := os.Getenv("BLOB_GC_INTERVAL"); envBlobGCInterval != "" {
+		blobGCInterval, err := time.ParseDuration(envBlobGCInterval)
+		if err == nil {
+			o.flagBlobGCInterval = blobGCInterval
+		} else {
+			fmt.Println("Failed to parse BLOB_GC_INTERVAL as a duration value:", err)
+		}
+	}
+
+	if envBlobGCGrace := os.Getenv("BLOB_GC_GRACE"); envBlobGCGrace != "" {
+		blobGCGrace, err := time.ParseDuration(envBlobGCGrace)
+		if err == nil {
+			o.flagBlobGCGrace = blobGCGrace
+		} else {
+			fmt.Println("Failed to parse BLOB_GC_GRACE as a duration value:", err)
+		}
+	}
+
 }
 
 // RunAddr returns the configured address and port to run the server.
@@ -133,6 +808,385 @@ func (o *Options) EnableHTTPS() bool {
 	return getBoolFlag("s")
 }
 
+// ShedMaxInFlight returns the number of in-flight requests above which load is shed.
+func (o *Options) ShedMaxInFlight() int {
+	return getIntFlag("c")
+}
+
+// ShedMaxLatency returns the p95 request latency above which load is shed.
+func (o *Options) ShedMaxLatency() time.Duration {
+	return getDurationFlag("t")
+}
+
+// HistoryVersions returns the number of prior versions retained per entry.
+func (o *Options) HistoryVersions() int {
+	return getIntFlag("v")
+}
+
+// ExpiryInterval returns the interval of deleting the expired entries.
+func (o *Options) ExpiryInterval() time.Duration {
+	return getDurationFlag("x")
+}
+
+// RowLevelSecurity returns whether the data operations are scoped to the user by row-level security.
+func (o *Options) RowLevelSecurity() bool {
+	return getBoolFlag("e")
+}
+
+// RLSBypassRole returns the role used by the background jobs under row-level security.
+func (o *Options) RLSBypassRole() string {
+	return getStringFlag("b")
+}
+
+// ReadDataBaseDSN returns the configured DSN of the read replica, empty if there is none.
+func (o *Options) ReadDataBaseDSN() string {
+	return getStringFlag("o")
+}
+
+// ReadAfterWriteWindow returns the time after a write of a user during which their reads stay on the primary.
+func (o *Options) ReadAfterWriteWindow() time.Duration {
+	return getDurationFlag("w")
+}
+
+// EncryptionKey returns the base64 of the key encrypting the sensitive columns, empty if encryption is disabled.
+func (o *Options) EncryptionKey() string {
+	return getStringFlag("m")
+}
+
+// EncryptionKeyID returns the id of the encryption key.
+func (o *Options) EncryptionKeyID() string {
+	return getStringFlag("i")
+}
+
+// PreviousEncryptionKeys returns the previous encryption keys still read during a rotation,
+// as id=base64 pairs separated by commas.
+func (o *Options) PreviousEncryptionKeys() string {
+	return getStringFlag("g")
+}
+
+// AuditRetention returns the time the audit events are kept, 0 if they are kept forever.
+func (o *Options) AuditRetention() time.Duration {
+	return getDurationFlag("u")
+}
+
+// DryRunJobs returns the background jobs run in dry-run mode, separated by commas.
+func (o *Options) DryRunJobs() string {
+	return getStringFlag("y")
+}
+
+// VerifyReads returns whether the entries read are compared with their checksums.
+func (o *Options) VerifyReads() bool {
+	return getBoolFlag("f")
+}
+
+// AccessTokenTTL returns the lifetime of the access tokens, 0 if they don't expire.
+func (o *Options) AccessTokenTTL() time.Duration {
+	return getDurationFlag("q")
+}
+
+// RefreshTokenTTL returns the lifetime of the refresh tokens.
+func (o *Options) RefreshTokenTTL() time.Duration {
+	return getDurationFlag("z")
+}
+
+// LoginMaxFailures returns the consecutive failed logins locking an account, 0 if accounts aren't locked.
+func (o *Options) LoginMaxFailures() int {
+	return getIntFlag("p")
+}
+
+// LoginIPLimit returns the failed logins from an address per minute above which its logins are rejected,
+// 0 if they aren't limited.
+func (o *Options) LoginIPLimit() int {
+	return getIntFlag("login-ip-limit")
+}
+
+// LoginHistory returns the login attempts kept in the login history of each user, 0 if they are all kept.
+func (o *Options) LoginHistory() int {
+	return getIntFlag("login-history")
+}
+
+// Argon2Memory returns the memory of the Argon2id password hashes in KiB.
+func (o *Options) Argon2Memory() int {
+	return getIntFlag("argon2-memory")
+}
+
+// Argon2Time returns the iterations of the Argon2id password hashes.
+func (o *Options) Argon2Time() int {
+	return getIntFlag("argon2-time")
+}
+
+// Argon2Parallelism returns the threads of the Argon2id password hashes.
+func (o *Options) Argon2Parallelism() int {
+	return getIntFlag("argon2-parallelism")
+}
+
+// Argon2SaltLength returns the salt length of the Argon2id password hashes in bytes.
+func (o *Options) Argon2SaltLength() int {
+	return getIntFlag("argon2-salt-length")
+}
+
+// PasswordMinLength returns the minimum length of the passwords chosen in plain, in characters.
+func (o *Options) PasswordMinLength() int {
+	return getIntFlag("password-min-length")
+}
+
+// PasswordClasses returns the character classes the passwords chosen in plain contain, separated by commas.
+func (o *Options) PasswordClasses() string {
+	return getStringFlag("password-classes")
+}
+
+// LegacyHashedPasswords reports whether the bcrypt hashes the legacy clients send as the passwords are accepted.
+func (o *Options) LegacyHashedPasswords() bool {
+	return getBoolFlag("legacy-hashed-passwords")
+}
+
+// SMTPAddr returns the host:port of the SMTP server sending the account emails, empty if the emails are disabled.
+func (o *Options) SMTPAddr() string {
+	return getStringFlag("smtp-addr")
+}
+
+// SMTPUsername returns the username of the SMTP server, empty if it is used without authentication.
+func (o *Options) SMTPUsername() string {
+	return getStringFlag("smtp-username")
+}
+
+// SMTPPassword returns the password of the SMTP server.
+func (o *Options) SMTPPassword() string {
+	return getStringFlag("smtp-password")
+}
+
+// SMTPFrom returns the sender address of the account emails.
+func (o *Options) SMTPFrom() string {
+	return getStringFlag("smtp-from")
+}
+
+// MailTemplates returns the directory of the templates overriding the default ones of the emails, empty if none.
+func (o *Options) MailTemplates() string {
+	return getStringFlag("mail-templates")
+}
+
+// VerifyTokenTTL returns the lifetime of the tokens mailed to verify an email.
+func (o *Options) VerifyTokenTTL() time.Duration {
+	return getDurationFlag("verify-token-ttl")
+}
+
+// ResetTokenTTL returns the lifetime of the tokens mailed to reset a password.
+func (o *Options) ResetTokenTTL() time.Duration {
+	return getDurationFlag("reset-token-ttl")
+}
+
+// RotationBatch returns the number of rows re-encrypted per transaction by the key rotation.
+func (o *Options) RotationBatch() int {
+	return getIntFlag("rotation-batch")
+}
+
+// RotationSample returns the number of rows per table verified once the key rotation is done.
+func (o *Options) RotationSample() int {
+	return getIntFlag("rotation-sample")
+}
+
+// PlaintextPreviews returns whether the notes may have a plaintext preview.
+func (o *Options) PlaintextPreviews() bool {
+	return getBoolFlag("plaintext-previews")
+}
+
+// JWTKeys returns the keyset signing the access tokens, empty if they are signed with JWTSigningKey.
+func (o *Options) JWTKeys() string {
+	return getStringFlag("jwt-keys")
+}
+
+// JWTActiveKey returns the id of the key of JWTKeys signing the new access tokens, empty for the first one.
+func (o *Options) JWTActiveKey() string {
+	return getStringFlag("jwt-active-key")
+}
+
+// JWTIssuer returns the issuer of the access tokens.
+func (o *Options) JWTIssuer() string {
+	return getStringFlag("jwt-issuer")
+}
+
+// JWTAudience returns the audience of the access tokens.
+func (o *Options) JWTAudience() string {
+	return getStringFlag("jwt-audience")
+}
+
+// MonitorCheckInterval returns the interval of the health checks whose result the monitor ping serves.
+func (o *Options) MonitorCheckInterval() time.Duration {
+	return getDurationFlag("monitor-check-interval")
+}
+
+// MonitorRateLimit returns the monitor pings per minute per token above which they are rejected, 0 if unlimited.
+func (o *Options) MonitorRateLimit() int {
+	return getIntFlag("monitor-rate-limit")
+}
+
+// AuthRateLimit returns the requests per minute per client to the authentication routes, 0 if unlimited.
+func (o *Options) AuthRateLimit() int {
+	return getIntFlag("auth-rate-limit")
+}
+
+// AuthRateBurst returns the requests a client may make at once to the authentication routes.
+func (o *Options) AuthRateBurst() int {
+	return getIntFlag("auth-rate-burst")
+}
+
+// DataRateLimit returns the requests per minute per client to the data routes, 0 if unlimited.
+func (o *Options) DataRateLimit() int {
+	return getIntFlag("data-rate-limit")
+}
+
+// DataRateBurst returns the requests a client may make at once to the data routes.
+func (o *Options) DataRateBurst() int {
+	return getIntFlag("data-rate-burst")
+}
+
+// ExportRateLimit returns the vault exports and imports per hour per client, 0 if unlimited.
+func (o *Options) ExportRateLimit() int {
+	return getIntFlag("export-rate-limit")
+}
+
+// ExportRateBurst returns the vault exports and imports a client may make at once.
+func (o *Options) ExportRateBurst() int {
+	return getIntFlag("export-rate-burst")
+}
+
+// ReservedUsernames returns the usernames rejected at registration besides the ones reserved by the server, separated by commas.
+func (o *Options) ReservedUsernames() string {
+	return getStringFlag("reserved-usernames")
+}
+
+// UsernameCheckerURL returns the URL of the external service moderating the usernames, empty if there is none.
+func (o *Options) UsernameCheckerURL() string {
+	return getStringFlag("username-checker-url")
+}
+
+// UsernameCheckerTimeout returns the time the external username checker has to answer.
+func (o *Options) UsernameCheckerTimeout() time.Duration {
+	return getDurationFlag("username-checker-timeout")
+}
+
+// UsernameCheckerFailClosed reports whether the registrations are rejected while the external username checker is unavailable.
+func (o *Options) UsernameCheckerFailClosed() bool {
+	return getBoolFlag("username-checker-fail-closed")
+}
+
+// EventsRelay reports whether the server instances sharing the database notify each other of their vault changes.
+func (o *Options) EventsRelay() bool {
+	return getBoolFlag("events-relay")
+}
+
+// EgressAllow returns the destinations the outbound connections may reach per class, as class=cidr,host;class=...
+func (o *Options) EgressAllow() string {
+	return getStringFlag("egress-allow")
+}
+
+// EgressProxy returns the URL of the proxy of the outbound HTTP requests, empty if they connect directly.
+func (o *Options) EgressProxy() string {
+	return getStringFlag("egress-proxy")
+}
+
+// CompressMinSize returns the size in bytes from which the responses are gzipped.
+func (o *Options) CompressMinSize() int {
+	return getIntFlag("compress-min-size")
+}
+
+// MaxDecompressedSize returns the size in bytes a gzipped push body may have once decompressed.
+func (o *Options) MaxDecompressedSize() int {
+	return getIntFlag("max-decompressed-size")
+}
+
+// ReencryptTimeout returns the time a re-encryption of a vault may go without a heartbeat before it fails.
+func (o *Options) ReencryptTimeout() time.Duration {
+	return getDurationFlag("reencrypt-timeout")
+}
+
+// ImportMaxSize returns the size in bytes an import body may have.
+func (o *Options) ImportMaxSize() int {
+	return getIntFlag("import-max-size")
+}
+
+// UploadSessionTTL returns the time a chunked upload may take until it is committed.
+func (o *Options) UploadSessionTTL() time.Duration {
+	return getDurationFlag("upload-session-ttl")
+}
+
+// UploadChunkMaxSize returns the size in bytes a chunk of a chunked upload may have.
+func (o *Options) UploadChunkMaxSize() int {
+	return getIntFlag("upload-chunk-max-size")
+}
+
+// ReplicationPrimary returns the URL of the primary server the vault of ReplicationUser is replicated from,
+// empty if the server doesn't replicate one.
+func (o *Options) ReplicationPrimary() string {
+	return getStringFlag("replication-primary")
+}
+
+// ReplicationToken returns the API key of the replicated user on the primary server.
+func (o *Options) ReplicationToken() string {
+	return getStringFlag("replication-token")
+}
+
+// ReplicationUser returns the username of the user whose vault is replicated.
+func (o *Options) ReplicationUser() string {
+	return getStringFlag("replication-user")
+}
+
+// ReplicationInterval returns the interval of the rounds of the replication.
+func (o *Options) ReplicationInterval() time.Duration {
+	return getDurationFlag("replication-interval")
+}
+
+// BlobStore returns the store of the contents of the files, "fs" or "s3",
+// empty if they are kept in the file storage path under the ids of their entries.
+func (o *Options) BlobStore() string {
+	return getStringFlag("blob-store")
+}
+
+// BlobDir returns the directory of the fs blob store, empty for the default one.
+func (o *Options) BlobDir() string {
+	return getStringFlag("blob-dir")
+}
+
+// S3Endpoint returns the URL of the endpoint of the s3 blob store.
+func (o *Options) S3Endpoint() string {
+	return getStringFlag("s3-endpoint")
+}
+
+// S3Region returns the region the requests to the s3 blob store are signed for.
+func (o *Options) S3Region() string {
+	return getStringFlag("s3-region")
+}
+
+// S3Bucket returns the bucket of the s3 blob store.
+func (o *Options) S3Bucket() string {
+	return getStringFlag("s3-bucket")
+}
+
+// S3AccessKey returns the access key id of the s3 blob store.
+func (o *Options) S3AccessKey() string {
+	return getStringFlag("s3-access-key")
+}
+
+// S3SecretKey returns the secret access key of the s3 blob store.
+func (o *Options) S3SecretKey() string {
+	return getStringFlag("s3-secret-key")
+}
+
+// S3PathStyle reports whether the bucket of the s3 blob store is addressed in the path of the requests.
+func (o *Options) S3PathStyle() bool {
+	return getBoolFlag("s3-path-style")
+}
+
+// BlobGCInterval returns the interval of deleting the objects no file entry points at, 0 if it is disabled.
+func (o *Options) BlobGCInterval() time.Duration {
+	return getDurationFlag("blob-gc-interval")
+}
+
+// BlobGCGrace returns the age from which an object no file entry points at is deleted.
+func (o *Options) BlobGCGrace() time.Duration {
+	return getDurationFlag("blob-gc-grace")
+}
+
 // regStringVar registers a string flag with the specified name, default value, and usage string.
 func regStringVar(p *string, name string, value string, usage string) {
 	if flag.Lookup(name) == nil {
@@ -147,6 +1201,20 @@ func regBoolVar(p *bool, name string, value bool, usage string) {
 	}
 }
 
+// regIntVar registers an int flag with the specified name, default value, and usage string.
+func regIntVar(p *int, name string, value int, usage string) {
+	if flag.Lookup(name) == nil {
+		flag.IntVar(p, name, value, usage)
+	}
+}
+
+// regDurationVar registers a duration flag with the specified name, default value, and usage string.
+func regDurationVar(p *time.Duration, name string, value time.Duration, usage string) {
+	if flag.Lookup(name) == nil {
+		flag.DurationVar(p, name, value, usage)
+	}
+}
+
 // getStringFlag retrieves the string value of the specified flag.
 func getStringFlag(name string) string {
 	return flag.Lookup(name).Value.(flag.Getter).Get().(string)
@@ -157,6 +1225,16 @@ func getBoolFlag(name string) bool {
 	return flag.Lookup(name).Value.(flag.Getter).Get().(bool)
 }
 
+// getIntFlag retrieves the int value of the specified flag.
+func getIntFlag(name string) int {
+	return flag.Lookup(name).Value.(flag.Getter).Get().(int)
+}
+
+// getDurationFlag retrieves the duration value of the specified flag.
+func getDurationFlag(name string) time.Duration {
+	return flag.Lookup(name).Value.(flag.Getter).Get().(time.Duration)
+}
+
 // GetAsString reads an environment variable or returns a default value.
 func GetAsString(key string, defaultValue string) string {
 	if value, exists := os.LookupEnv(key); exists {
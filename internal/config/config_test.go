@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -16,6 +17,33 @@ func TestOptions_ParseFlags(t *testing.T) {
 	testArgs := []string{
 		"app", "-a", ":8080", "-d", "testdb_env", "-l", "info",
 		"-n", "test777", "-j", "test_key_env", "-r", "/path/to/cert_env.pem", "-k", "/path/to/key_env.pem", "-s",
+		"-c", "64", "-t", "250ms", "-v", "5", "-x", "30s",
+		"-e", "-b", "gophkeeper_bypass", "-o", "postgres://replica/db", "-w", "2s",
+		"-m", "a2V5", "-i", "k2", "-g", "k1=b2xk", "-u", "720h",
+		"-y", "expiry,audit_pruning", "-f", "-q", "5m", "-z", "168h",
+		"-p", "3", "-login-ip-limit", "50", "-login-history", "30",
+		"-argon2-memory", "19456", "-argon2-time", "2", "-argon2-parallelism", "1", "-argon2-salt-length", "32",
+		"-password-min-length", "12", "-password-classes", "digit,symbol", "-legacy-hashed-passwords",
+		"-smtp-addr", "smtp.example.com:587", "-smtp-username", "keeper", "-smtp-password", "secret",
+		"-smtp-from", "keeper@example.com", "-mail-templates", "/etc/gophkeeper/templates",
+		"-verify-token-ttl", "48h", "-reset-token-ttl", "30m",
+		"-rotation-batch", "200", "-rotation-sample", "20", "-plaintext-previews=false",
+		"-jwt-keys", "k1=c2VjcmV0,k2=file:/path/to/jwt.pem", "-jwt-active-key", "k2",
+		"-jwt-issuer", "keeper.example.com", "-jwt-audience", "keeper-clients",
+		"-monitor-check-interval", "5s", "-monitor-rate-limit", "12",
+		"-auth-rate-limit", "20", "-auth-rate-burst", "5", "-data-rate-limit", "300", "-data-rate-burst", "50",
+		"-export-rate-limit", "3", "-export-rate-burst", "1",
+		"-reserved-usernames", "billing,helpdesk", "-username-checker-url", "https://moderation.example.com/check",
+		"-username-checker-timeout", "500ms", "-username-checker-fail-closed",
+		"-events-relay", "-egress-allow", "smtp=10.0.0.0/8", "-egress-proxy", "http://proxy.internal:3128",
+		"-compress-min-size", "2048", "-max-decompressed-size", "1048576",
+		"-reencrypt-timeout", "2m", "-import-max-size", "1048576",
+		"-upload-session-ttl", "6h", "-upload-chunk-max-size", "4194304",
+		"-replication-primary", "https://primary.example.com", "-replication-token", "gk_replica",
+		"-replication-user", "alice", "-replication-interval", "30s",
+		"-blob-store", "s3", "-blob-dir", "/var/lib/gophkeeper/blobs", "-s3-endpoint", "http://minio:9000",
+		"-s3-region", "eu-central-1", "-s3-bucket", "vault-files", "-s3-access-key", "keeper",
+		"-s3-secret-key", "s3cret", "-s3-path-style", "-blob-gc-interval", "30m", "-blob-gc-grace", "48h",
 	}
 	os.Args = testArgs
 
@@ -44,6 +72,81 @@ func TestOptions_ParseFlags(t *testing.T) {
 	assert.Equal(t, "/path/to/cert_env.pem", options.HTTPSCertFile())
 	assert.Equal(t, "/path/to/key_env.pem", options.HTTPSKeyFile())
 	assert.True(t, options.EnableHTTPS())
+	assert.Equal(t, 64, options.ShedMaxInFlight())
+	assert.Equal(t, 250*time.Millisecond, options.ShedMaxLatency())
+	assert.Equal(t, 5, options.HistoryVersions())
+	assert.Equal(t, 30*time.Second, options.ExpiryInterval())
+	assert.True(t, options.RowLevelSecurity())
+	assert.Equal(t, "gophkeeper_bypass", options.RLSBypassRole())
+	assert.Equal(t, "postgres://replica/db", options.ReadDataBaseDSN())
+	assert.Equal(t, 2*time.Second, options.ReadAfterWriteWindow())
+	assert.Equal(t, "a2V5", options.EncryptionKey())
+	assert.Equal(t, "k2", options.EncryptionKeyID())
+	assert.Equal(t, "k1=b2xk", options.PreviousEncryptionKeys())
+	assert.Equal(t, 720*time.Hour, options.AuditRetention())
+	assert.Equal(t, "expiry,audit_pruning", options.DryRunJobs())
+	assert.True(t, options.VerifyReads())
+	assert.Equal(t, 5*time.Minute, options.AccessTokenTTL())
+	assert.Equal(t, 168*time.Hour, options.RefreshTokenTTL())
+	assert.Equal(t, 3, options.LoginMaxFailures())
+	assert.Equal(t, 50, options.LoginIPLimit())
+	assert.Equal(t, 19456, options.Argon2Memory())
+	assert.Equal(t, 2, options.Argon2Time())
+	assert.Equal(t, 1, options.Argon2Parallelism())
+	assert.Equal(t, 32, options.Argon2SaltLength())
+	assert.Equal(t, 30, options.LoginHistory())
+	assert.Equal(t, 12, options.PasswordMinLength())
+	assert.Equal(t, "digit,symbol", options.PasswordClasses())
+	assert.True(t, options.LegacyHashedPasswords())
+	assert.Equal(t, "smtp.example.com:587", options.SMTPAddr())
+	assert.Equal(t, "keeper", options.SMTPUsername())
+	assert.Equal(t, "secret", options.SMTPPassword())
+	assert.Equal(t, "keeper@example.com", options.SMTPFrom())
+	assert.Equal(t, "/etc/gophkeeper/templates", options.MailTemplates())
+	assert.Equal(t, 48*time.Hour, options.VerifyTokenTTL())
+	assert.Equal(t, 30*time.Minute, options.ResetTokenTTL())
+	assert.Equal(t, 200, options.RotationBatch())
+	assert.Equal(t, 20, options.RotationSample())
+	assert.False(t, options.PlaintextPreviews())
+	assert.Equal(t, "k1=c2VjcmV0,k2=file:/path/to/jwt.pem", options.JWTKeys())
+	assert.Equal(t, "k2", options.JWTActiveKey())
+	assert.Equal(t, "keeper.example.com", options.JWTIssuer())
+	assert.Equal(t, "keeper-clients", options.JWTAudience())
+	assert.Equal(t, 5*time.Second, options.MonitorCheckInterval())
+	assert.Equal(t, 12, options.MonitorRateLimit())
+	assert.Equal(t, 20, options.AuthRateLimit())
+	assert.Equal(t, 5, options.AuthRateBurst())
+	assert.Equal(t, 300, options.DataRateLimit())
+	assert.Equal(t, 50, options.DataRateBurst())
+	assert.Equal(t, 3, options.ExportRateLimit())
+	assert.Equal(t, 1, options.ExportRateBurst())
+	assert.Equal(t, "billing,helpdesk", options.ReservedUsernames())
+	assert.Equal(t, "https://moderation.example.com/check", options.UsernameCheckerURL())
+	assert.Equal(t, 500*time.Millisecond, options.UsernameCheckerTimeout())
+	assert.True(t, options.UsernameCheckerFailClosed())
+	assert.True(t, options.EventsRelay())
+	assert.Equal(t, "smtp=10.0.0.0/8", options.EgressAllow())
+	assert.Equal(t, "http://proxy.internal:3128", options.EgressProxy())
+	assert.Equal(t, 2048, options.CompressMinSize())
+	assert.Equal(t, 1048576, options.MaxDecompressedSize())
+	assert.Equal(t, 2*time.Minute, options.ReencryptTimeout())
+	assert.Equal(t, 1048576, options.ImportMaxSize())
+	assert.Equal(t, 6*time.Hour, options.UploadSessionTTL())
+	assert.Equal(t, 4194304, options.UploadChunkMaxSize())
+	assert.Equal(t, "https://primary.example.com", options.ReplicationPrimary())
+	assert.Equal(t, "gk_replica", options.ReplicationToken())
+	assert.Equal(t, "alice", options.ReplicationUser())
+	assert.Equal(t, 30*time.Second, options.ReplicationInterval())
+	assert.Equal(t, "s3", options.BlobStore())
+	assert.Equal(t, "/var/lib/gophkeeper/blobs", options.BlobDir())
+	assert.Equal(t, "http://minio:9000", options.S3Endpoint())
+	assert.Equal(t, "eu-central-1", options.S3Region())
+	assert.Equal(t, "vault-files", options.S3Bucket())
+	assert.Equal(t, "keeper", options.S3AccessKey())
+	assert.Equal(t, "s3cret", options.S3SecretKey())
+	assert.True(t, options.S3PathStyle())
+	assert.Equal(t, 30*time.Minute, options.BlobGCInterval())
+	assert.Equal(t, 48*time.Hour, options.BlobGCGrace())
 
 	// Reset the environment variables
 	os.Unsetenv("RUN_ADDRESS")
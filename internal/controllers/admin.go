@@ -0,0 +1,208 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"go.uber.org/zap"
+)
+
+// The pages of the users listed to the admins are bounded, the default page is sent if no limit is given.
+const (
+	defaultAdminUsersLimit = 50
+	maxAdminUsersLimit     = 500
+)
+
+// errSelfAdmin is the response to an admin disabling or deleting their own account,
+// which would leave them locked out, possibly with no admin left.
+var errSelfAdmin = errors.New("admins can't disable or delete their own account")
+
+// adminUsersResponse is a page of the users, Next is the after of the next page if there may be one.
+type adminUsersResponse struct {
+	Users []models.UserSummary `json:"users"`
+	Next  *int                 `json:"next,omitempty"`
+}
+
+// flaggedUser is a user whose username breaks the username policy, registered before it did.
+type flaggedUser struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	models.PolicyViolation
+}
+
+// (GET /api/admin/jobs/rotation)
+func (h *BaseController) GetApiAdminJobsRotation(w http.ResponseWriter, r *http.Request) {
+	// The progress is read from the database, so it covers the rotation run by any server or by rotatekeys
+	status, err := h.storage.RotationStatus(r.Context())
+	if errors.Is(err, models.ErrNotFound) {
+		writeNotFound(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, status)
+}
+
+// (GET /api/admin/users)
+func (h *BaseController) GetApiAdminUsers(w http.ResponseWriter, r *http.Request, params GetApiAdminUsersParams) {
+	afterID := 0
+	if params.After != nil {
+		afterID = *params.After
+	}
+	limit := defaultAdminUsersLimit
+	if params.Limit != nil && *params.Limit > 0 {
+		limit = min(*params.Limit, maxAdminUsersLimit)
+	}
+
+	users, err := h.storage.ListUsers(r.Context(), afterID, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// A full page may be followed by another one, the client asks for it until a page has no next
+	response := adminUsersResponse{Users: users}
+	if len(users) == limit {
+		response.Next = &users[len(users)-1].ID
+	}
+
+	writeJSON(w, response)
+}
+
+// (GET /api/admin/users/flagged)
+func (h *BaseController) GetApiAdminUsersFlagged(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	// The users keep their username, the report lists those now reserved and those looking like the username
+	// of a user registered before them. The external checker isn't asked, it would be asked for every user.
+	flagged := []flaggedUser{}
+	firstBySkeleton := make(map[string]string)
+	for afterID := 0; ; {
+		users, err := h.storage.ListUsers(ctx, afterID, maxAdminUsersLimit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		for _, user := range users {
+			if violation := h.authz.ReservedUsername(user.Username); violation != nil {
+				flagged = append(flagged, flaggedUser{ID: user.ID, Username: user.Username, PolicyViolation: *violation})
+				continue
+			}
+
+			skeleton := models.UsernameSkeleton(user.Username)
+			if first, ok := firstBySkeleton[skeleton]; ok {
+				flagged = append(flagged, flaggedUser{ID: user.ID, Username: user.Username, PolicyViolation: models.PolicyViolation{
+					Rule:    models.RuleUsernameTaken,
+					Message: "looks like the username " + first,
+				}})
+				continue
+			}
+			firstBySkeleton[skeleton] = user.Username
+		}
+
+		if len(users) < maxAdminUsersLimit {
+			break
+		}
+		afterID = users[len(users)-1].ID
+	}
+
+	writeJSON(w, map[string]interface{}{"users": flagged})
+}
+
+// (POST /api/admin/users/{id}/disable)
+func (h *BaseController) PostApiAdminUsersIdDisable(w http.ResponseWriter, r *http.Request, id int) {
+	h.setUserDisabled(w, r, id, true)
+}
+
+// (POST /api/admin/users/{id}/enable)
+func (h *BaseController) PostApiAdminUsersIdEnable(w http.ResponseWriter, r *http.Request, id int) {
+	h.setUserDisabled(w, r, id, false)
+}
+
+// setUserDisabled disables or enables the account of the user for the admin from the token.
+// A disabled user is rejected at their next request, their sessions are ended.
+func (h *BaseController) setUserDisabled(w http.ResponseWriter, r *http.Request, id int, disabled bool) {
+	ctx := r.Context()
+	adminID, err := userIDFromContext(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if disabled && id == adminID {
+		http.Error(w, errSelfAdmin.Error(), http.StatusBadRequest)
+		return
+	}
+	action := models.AuditEnableUser
+	if disabled {
+		action = models.AuditDisableUser
+	}
+
+	err = h.storage.SetUserDisabled(ctx, id, disabled)
+	if errors.Is(err, models.ErrNotFound) {
+		writeNotFound(w)
+		return
+	}
+	if err != nil {
+		h.auditEntry(ctx, action, adminID, id, false)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.auditEntry(ctx, action, adminID, id, true)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// (DELETE /api/admin/users/{id})
+func (h *BaseController) DeleteApiAdminUsersId(w http.ResponseWriter, r *http.Request, id int) {
+	ctx := r.Context()
+	adminID, err := userIDFromContext(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if id == adminID {
+		http.Error(w, errSelfAdmin.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The entries go with the account, the files the user sent are left on the disk
+	err = h.storage.DeleteUser(ctx, id)
+	if errors.Is(err, models.ErrNotFound) {
+		writeNotFound(w)
+		return
+	}
+	if err != nil {
+		h.auditEntry(ctx, models.AuditDeleteUser, adminID, id, false)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.auditEntry(ctx, models.AuditDeleteUser, adminID, id, true)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// auditEntry records an action of the user on an account or an API key, the audit event names it by its id.
+// An admin's action goes to the audit log of the admin, the audit log of the user may be deleted with them.
+// An id of 0, of a key that failed to be created, names nothing. A failed write is only logged.
+func (h *BaseController) auditEntry(ctx context.Context, action models.AuditAction, userID, id int, success bool) {
+	entryID := ""
+	if id > 0 {
+		entryID = strconv.Itoa(id)
+	}
+	err := h.storage.AddAuditEvent(ctx, models.AuditEvent{
+		UserID:  userID,
+		Action:  action,
+		EntryID: entryID,
+		Success: success,
+	})
+	if err != nil {
+		h.log.Warn("failed to write audit event", zap.String("action", string(action)), zap.Error(err))
+	}
+}
@@ -0,0 +1,136 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// maxAPIKeyLabel bounds the label of an API key, it only names the key in the list of the user.
+const maxAPIKeyLabel = 100
+
+// createdAPIKey is the response to the creation of an API key, the only one carrying the key itself.
+type createdAPIKey struct {
+	models.APIKey
+	Key string `json:"key"`
+}
+
+// apiKeyScopes returns the scopes of a new API key, read and write in this order, or an error.
+// The scopes of an offline session are not granted to keys, and a key writing entries also reads them.
+func apiKeyScopes(scopes []string) ([]string, error) {
+	read, write := false, false
+	for _, scope := range scopes {
+		switch scope {
+		case models.ScopeRead:
+			read = true
+		case models.ScopeWrite:
+			read, write = true, true
+		default:
+			return nil, errors.New("unknown scope " + scope + ", a key may only read and write")
+		}
+	}
+	if !read {
+		return nil, errors.New("a key needs a scope")
+	}
+	if write {
+		return []string{models.ScopeRead, models.ScopeWrite}, nil
+	}
+
+	return []string{models.ScopeRead}, nil
+}
+
+// (GET /api/user/apikeys)
+func (h *BaseController) GetApiUserApikeys(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	keys, err := h.storage.ListAPIKeys(ctx, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, keys)
+}
+
+// (POST /api/user/apikeys)
+func (h *BaseController) PostApiUserApikeys(w http.ResponseWriter, r *http.Request) {
+	var requestBody PostApiUserApikeysJSONRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(requestBody.Label) > maxAPIKeyLabel {
+		http.Error(w, "the label is too long", http.StatusBadRequest)
+		return
+	}
+	scopes, err := apiKeyScopes(requestBody.Scopes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if requestBody.ExpiresAt != nil && !requestBody.ExpiresAt.After(time.Now()) {
+		http.Error(w, "the expiry is in the past", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Only the hash is stored, the key is shown once and can't be recovered
+	secret, err := h.authz.NewAPIKey()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	key, err := h.storage.CreateAPIKey(ctx, models.APIKey{
+		UserID:    userID,
+		Hash:      h.authz.HashAPIKey(secret),
+		Label:     requestBody.Label,
+		Scopes:    scopes,
+		ExpiresAt: requestBody.ExpiresAt,
+	})
+	if err != nil {
+		h.auditEntry(ctx, models.AuditCreateAPIKey, userID, 0, false)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.auditEntry(ctx, models.AuditCreateAPIKey, userID, key.ID, true)
+
+	writeJSON(w, createdAPIKey{APIKey: key, Key: secret})
+}
+
+// (DELETE /api/user/apikeys/{id})
+func (h *BaseController) DeleteApiUserApikeysId(w http.ResponseWriter, r *http.Request, id int) {
+	ctx := r.Context()
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	err = h.storage.RevokeAPIKey(ctx, userID, id)
+	if errors.Is(err, models.ErrNotFound) {
+		writeNotFound(w)
+		return
+	}
+	if err != nil {
+		h.auditEntry(ctx, models.AuditRevokeAPIKey, userID, id, false)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.auditEntry(ctx, models.AuditRevokeAPIKey, userID, id, true)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -5,27 +5,221 @@ package controllers
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
 	"github.com/oapi-codegen/runtime"
+	"github.com/wurt83ow/gophkeeper-server/internal/cache"
+	"github.com/wurt83ow/gophkeeper-server/internal/egress"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"github.com/wurt83ow/gophkeeper-server/internal/objstore"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
+// RouteScope is the key of the scope a route requires, in the context of its requests.
+const RouteScope models.Key = "scope"
+
+// RoutePulls is the key marking the write routes which pull the changes along with pushing them, in the context
+// of their requests. A device whose writes are fenced still pulls with them, see WriteFence.
+const RoutePulls models.Key = "pulls"
+
 // PostAddDataTableUserIDEntryIDJSONBody defines parameters for PostAddDataTableUserIDEntryID.
 type PostAddDataTableUserIDEntryIDJSONBody map[string]string
 
+// PostApiSyncJSONBody defines parameters for PostApiSync.
+type PostApiSyncJSONBody struct {
+	LastSync time.Time       `json:"last_sync"`
+	Changes  []models.Change `json:"changes"`
+}
+
+// PostApiSyncPushJSONBody defines parameters for PostApiSyncPush.
+type PostApiSyncPushJSONBody struct {
+	Changes []models.Change `json:"changes"`
+}
+
+// PostApiDataTagsRenameJSONBody defines parameters for PostApiDataTagsRename.
+type PostApiDataTagsRenameJSONBody struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// GetApiAdminUsersParams defines parameters for GetApiAdminUsers.
+type GetApiAdminUsersParams struct {
+	After *int `form:"after,omitempty" json:"after,omitempty"`
+	Limit *int `form:"limit,omitempty" json:"limit,omitempty"`
+}
+
+// PostApiAdminMonitorsJSONBody defines parameters for PostApiAdminMonitors.
+type PostApiAdminMonitorsJSONBody struct {
+	Name string `json:"name"`
+}
+
+// GetApiAuditParams defines parameters for GetApiAudit.
+type GetApiAuditParams struct {
+	Since *time.Time `form:"since,omitempty" json:"since,omitempty"`
+	Limit *int       `form:"limit,omitempty" json:"limit,omitempty"`
+}
+
+// GetApiDataPendingParams defines parameters for GetApiDataPending.
+type GetApiDataPendingParams struct {
+	Cursor  *time.Time `form:"cursor,omitempty" json:"cursor,omitempty"`
+	Partial *bool      `form:"partial,omitempty" json:"partial,omitempty"`
+}
+
+// GetApiExportParams defines parameters for GetApiExport.
+type GetApiExportParams struct {
+	Format *string `form:"format,omitempty" json:"format,omitempty"`
+}
+
+// PostApiFilesIdUploadJSONBody defines parameters for PostApiFilesIdUpload.
+type PostApiFilesIdUploadJSONBody struct {
+	Size int64 `json:"size"`
+}
+
+// PostApiFilesIdUploadUploadIdCommitJSONBody defines parameters for PostApiFilesIdUploadUploadIdCommit.
+type PostApiFilesIdUploadUploadIdCommitJSONBody struct {
+	Chunks int               `json:"chunks"`
+	Fields map[string]string `json:"fields,omitempty"`
+	Sha256 string            `json:"sha256"`
+}
+
+// PostApiFoldersJSONBody defines parameters for PostApiFolders.
+type PostApiFoldersJSONBody struct {
+	Id       string `json:"id,omitempty"`
+	Name     string `json:"name"`
+	ParentId string `json:"parent_id,omitempty"`
+}
+
+// DeleteApiFoldersIdParams defines parameters for DeleteApiFoldersId.
+type DeleteApiFoldersIdParams struct {
+	MoveChildren *bool `form:"move_children,omitempty" json:"move_children,omitempty"`
+}
+
+// PutApiFoldersIdJSONBody defines parameters for PutApiFoldersId.
+type PutApiFoldersIdJSONBody struct {
+	Name     string `json:"name"`
+	ParentId string `json:"parent_id,omitempty"`
+}
+
+// PostApiImportParams defines parameters for PostApiImport.
+type PostApiImportParams struct {
+	Format *string `form:"format,omitempty" json:"format,omitempty"`
+}
+
+// GetApiSearchParams defines parameters for GetApiSearch.
+type GetApiSearchParams struct {
+	Q       string    `form:"q" json:"q"`
+	Table   *[]string `form:"table,omitempty" json:"table,omitempty"`
+	Limit   *int      `form:"limit,omitempty" json:"limit,omitempty"`
+	Partial *bool     `form:"partial,omitempty" json:"partial,omitempty"`
+}
+
+// GetApiSshkeysParams defines parameters for GetApiSshkeys.
+type GetApiSshkeysParams struct {
+	Fingerprint string `form:"fingerprint" json:"fingerprint"`
+}
+
+// GetApiUserVerifyParams defines parameters for GetApiUserVerify.
+type GetApiUserVerifyParams struct {
+	Token string `form:"token" json:"token"`
+}
+
+// GetApiTableParams defines parameters for GetApiTable.
+type GetApiTableParams struct {
+	Tag            *string   `form:"tag,omitempty" json:"tag,omitempty"`
+	Folder         *string   `form:"folder,omitempty" json:"folder,omitempty"`
+	IncludeExpired *bool     `form:"include_expired,omitempty" json:"include_expired,omitempty"`
+	Columns        *[]string `form:"columns,omitempty" json:"columns,omitempty"`
+	Sort           *string   `form:"sort,omitempty" json:"sort,omitempty"`
+	Dir            *string   `form:"dir,omitempty" json:"dir,omitempty"`
+}
+
+// GetApiTableIdHistoryParams defines parameters for GetApiTableIdHistory.
+type GetApiTableIdHistoryParams struct {
+	Limit *int `form:"limit,omitempty" json:"limit,omitempty"`
+}
+
+// PostApiTableIdSharesJSONBody defines parameters for PostApiTableIdShares.
+type PostApiTableIdSharesJSONBody struct {
+	Grantee    string `json:"grantee"`
+	Permission string `json:"permission,omitempty"`
+}
+
+// PostApiUserApikeysJSONBody defines parameters for PostApiUserApikeys.
+type PostApiUserApikeysJSONBody struct {
+	Label     string     `json:"label"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// PostApiUserLogoutJSONBody defines parameters for PostApiUserLogout.
+type PostApiUserLogoutJSONBody struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// PostApiUserPasswordJSONBody defines parameters for PostApiUserPassword.
+type PostApiUserPasswordJSONBody struct {
+	CurrentPassword string `json:"current_password"`
+	DeviceID        string `json:"device_id,omitempty"`
+	NewPassword     string `json:"new_password"`
+	Username        string `json:"username"`
+}
+
+// PostApiUserReencryptJSONBody defines parameters for PostApiUserReencrypt.
+type PostApiUserReencryptJSONBody struct {
+	ExpectedSeconds int `json:"expected_seconds"`
+}
+
+// PutApiUserReencryptIdJSONBody defines parameters for PutApiUserReencryptId.
+type PutApiUserReencryptIdJSONBody struct {
+	Status string `json:"status"`
+}
+
+// PostApiUserRefreshJSONBody defines parameters for PostApiUserRefresh.
+type PostApiUserRefreshJSONBody struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// PutApiUserEmailJSONBody defines parameters for PutApiUserEmail.
+type PutApiUserEmailJSONBody struct {
+	Email string `json:"email"`
+}
+
+// PutApiUserLanguageJSONBody defines parameters for PutApiUserLanguage.
+type PutApiUserLanguageJSONBody struct {
+	Language string `json:"language"`
+}
+
+// PostApiUserResetRequestJSONBody defines parameters for PostApiUserResetRequest.
+type PostApiUserResetRequestJSONBody struct {
+	Email string `json:"email"`
+}
+
+// PostApiUserResetJSONBody defines parameters for PostApiUserReset.
+type PostApiUserResetJSONBody struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
 // PostLoginJSONBody defines parameters for PostLogin.
 type PostLoginJSONBody struct {
-	Password string `json:"password,omitempty"`
-	Username string `json:"username,omitempty"`
+	DeviceID   string `json:"device_id,omitempty"`
+	DeviceName string `json:"device_name,omitempty"`
+	Password   string `json:"password,omitempty"`
+	Username   string `json:"username,omitempty"`
 }
 
 // PostRegisterJSONBody defines parameters for PostRegister.
@@ -40,6 +234,63 @@ type PutUpdateDataTableUserIDEntryIDJSONBody map[string]string
 // PostAddDataTableUserIDEntryIDJSONRequestBody defines body for PostAddDataTableUserIDEntryID for application/json ContentType.
 type PostAddDataTableUserIDEntryIDJSONRequestBody PostAddDataTableUserIDEntryIDJSONBody
 
+// PostApiAdminMonitorsJSONRequestBody defines body for PostApiAdminMonitors for application/json ContentType.
+type PostApiAdminMonitorsJSONRequestBody PostApiAdminMonitorsJSONBody
+
+// PostApiDataTagsRenameJSONRequestBody defines body for PostApiDataTagsRename for application/json ContentType.
+type PostApiDataTagsRenameJSONRequestBody PostApiDataTagsRenameJSONBody
+
+// PostApiSyncJSONRequestBody defines body for PostApiSync for application/json ContentType.
+type PostApiSyncJSONRequestBody PostApiSyncJSONBody
+
+// PostApiSyncPushJSONRequestBody defines body for PostApiSyncPush for application/json ContentType.
+type PostApiSyncPushJSONRequestBody PostApiSyncPushJSONBody
+
+// PostApiTableIdSharesJSONRequestBody defines body for PostApiTableIdShares for application/json ContentType.
+type PostApiTableIdSharesJSONRequestBody PostApiTableIdSharesJSONBody
+
+// PostApiUserApikeysJSONRequestBody defines body for PostApiUserApikeys for application/json ContentType.
+type PostApiUserApikeysJSONRequestBody PostApiUserApikeysJSONBody
+
+// PostApiUserLogoutJSONRequestBody defines body for PostApiUserLogout for application/json ContentType.
+type PostApiUserLogoutJSONRequestBody PostApiUserLogoutJSONBody
+
+// PostApiUserPasswordJSONRequestBody defines body for PostApiUserPassword for application/json ContentType.
+type PostApiUserPasswordJSONRequestBody PostApiUserPasswordJSONBody
+
+// PostApiFilesIdUploadJSONRequestBody defines body for PostApiFilesIdUpload for application/json ContentType.
+type PostApiFilesIdUploadJSONRequestBody PostApiFilesIdUploadJSONBody
+
+// PostApiFilesIdUploadUploadIdCommitJSONRequestBody defines body for PostApiFilesIdUploadUploadIdCommit for application/json ContentType.
+type PostApiFilesIdUploadUploadIdCommitJSONRequestBody PostApiFilesIdUploadUploadIdCommitJSONBody
+
+// PostApiFoldersJSONRequestBody defines body for PostApiFolders for application/json ContentType.
+type PostApiFoldersJSONRequestBody PostApiFoldersJSONBody
+
+// PutApiFoldersIdJSONRequestBody defines body for PutApiFoldersId for application/json ContentType.
+type PutApiFoldersIdJSONRequestBody PutApiFoldersIdJSONBody
+
+// PostApiUserReencryptJSONRequestBody defines body for PostApiUserReencrypt for application/json ContentType.
+type PostApiUserReencryptJSONRequestBody PostApiUserReencryptJSONBody
+
+// PutApiUserReencryptIdJSONRequestBody defines body for PutApiUserReencryptId for application/json ContentType.
+type PutApiUserReencryptIdJSONRequestBody PutApiUserReencryptIdJSONBody
+
+// PostApiUserRefreshJSONRequestBody defines body for PostApiUserRefresh for application/json ContentType.
+type PostApiUserRefreshJSONRequestBody PostApiUserRefreshJSONBody
+
+// PutApiUserEmailJSONRequestBody defines body for PutApiUserEmail for application/json ContentType.
+type PutApiUserEmailJSONRequestBody PutApiUserEmailJSONBody
+
+// PutApiUserLanguageJSONRequestBody defines body for PutApiUserLanguage for application/json ContentType.
+type PutApiUserLanguageJSONRequestBody PutApiUserLanguageJSONBody
+
+// PostApiUserResetRequestJSONRequestBody defines body for PostApiUserResetRequest for application/json ContentType.
+type PostApiUserResetRequestJSONRequestBody PostApiUserResetRequestJSONBody
+
+// PostApiUserResetJSONRequestBody defines body for PostApiUserReset for application/json ContentType.
+type PostApiUserResetJSONRequestBody PostApiUserResetJSONBody
+
 // PostLoginJSONRequestBody defines body for PostLogin for application/json ContentType.
 type PostLoginJSONRequestBody PostLoginJSONBody
 
@@ -52,9 +303,180 @@ type PutUpdateDataTableUserIDEntryIDJSONRequestBody PutUpdateDataTableUserIDEntr
 // ServerInterface represents all server handlers.
 type ServerInterface interface {
 
+	// (POST /addData/{table}/{userID})
+	PostAddDataTableUserID(w http.ResponseWriter, r *http.Request, table string, userID int)
+
 	// (POST /addData/{table}/{userID}/{entryID})
 	PostAddDataTableUserIDEntryID(w http.ResponseWriter, r *http.Request, table string, userID int, entryID string)
 
+	// (GET /api/admin/jobs/rotation)
+	GetApiAdminJobsRotation(w http.ResponseWriter, r *http.Request)
+
+	// (GET /api/admin/monitors)
+	GetApiAdminMonitors(w http.ResponseWriter, r *http.Request)
+
+	// (POST /api/admin/monitors)
+	PostApiAdminMonitors(w http.ResponseWriter, r *http.Request)
+
+	// (DELETE /api/admin/monitors/{id})
+	DeleteApiAdminMonitorsId(w http.ResponseWriter, r *http.Request, id int)
+
+	// (GET /api/admin/replication)
+	GetApiAdminReplication(w http.ResponseWriter, r *http.Request)
+
+	// (GET /api/admin/users)
+	GetApiAdminUsers(w http.ResponseWriter, r *http.Request, params GetApiAdminUsersParams)
+
+	// (GET /api/admin/users/flagged)
+	GetApiAdminUsersFlagged(w http.ResponseWriter, r *http.Request)
+
+	// (DELETE /api/admin/users/{id})
+	DeleteApiAdminUsersId(w http.ResponseWriter, r *http.Request, id int)
+
+	// (POST /api/admin/users/{id}/disable)
+	PostApiAdminUsersIdDisable(w http.ResponseWriter, r *http.Request, id int)
+
+	// (POST /api/admin/users/{id}/enable)
+	PostApiAdminUsersIdEnable(w http.ResponseWriter, r *http.Request, id int)
+
+	// (GET /api/audit)
+	GetApiAudit(w http.ResponseWriter, r *http.Request, params GetApiAuditParams)
+
+	// (GET /api/data/pending)
+	GetApiDataPending(w http.ResponseWriter, r *http.Request, params GetApiDataPendingParams)
+
+	// (POST /api/data/tags/rename)
+	PostApiDataTagsRename(w http.ResponseWriter, r *http.Request)
+
+	// (GET /api/events)
+	GetApiEvents(w http.ResponseWriter, r *http.Request)
+
+	// (GET /api/export)
+	GetApiExport(w http.ResponseWriter, r *http.Request, params GetApiExportParams)
+
+	// (GET /api/files/{id}/content)
+	GetApiFilesIdContent(w http.ResponseWriter, r *http.Request, id string)
+
+	// (POST /api/files/{id}/upload)
+	PostApiFilesIdUpload(w http.ResponseWriter, r *http.Request, id string)
+
+	// (DELETE /api/files/{id}/upload/{uploadId})
+	DeleteApiFilesIdUploadUploadId(w http.ResponseWriter, r *http.Request, id string, uploadId string)
+
+	// (GET /api/files/{id}/upload/{uploadId})
+	GetApiFilesIdUploadUploadId(w http.ResponseWriter, r *http.Request, id string, uploadId string)
+
+	// (POST /api/files/{id}/upload/{uploadId}/commit)
+	PostApiFilesIdUploadUploadIdCommit(w http.ResponseWriter, r *http.Request, id string, uploadId string)
+
+	// (PUT /api/files/{id}/upload/{uploadId}/{chunk})
+	PutApiFilesIdUploadUploadIdChunk(w http.ResponseWriter, r *http.Request, id string, uploadId string, chunk int)
+
+	// (GET /api/folders)
+	GetApiFolders(w http.ResponseWriter, r *http.Request)
+
+	// (POST /api/folders)
+	PostApiFolders(w http.ResponseWriter, r *http.Request)
+
+	// (DELETE /api/folders/{id})
+	DeleteApiFoldersId(w http.ResponseWriter, r *http.Request, id string, params DeleteApiFoldersIdParams)
+
+	// (PUT /api/folders/{id})
+	PutApiFoldersId(w http.ResponseWriter, r *http.Request, id string)
+
+	// (POST /api/import)
+	PostApiImport(w http.ResponseWriter, r *http.Request, params PostApiImportParams)
+
+	// (GET /api/monitor/ping)
+	GetApiMonitorPing(w http.ResponseWriter, r *http.Request)
+
+	// (GET /api/search)
+	GetApiSearch(w http.ResponseWriter, r *http.Request, params GetApiSearchParams)
+
+	// (GET /api/shares)
+	GetApiShares(w http.ResponseWriter, r *http.Request)
+
+	// (GET /api/sshkeys)
+	GetApiSshkeys(w http.ResponseWriter, r *http.Request, params GetApiSshkeysParams)
+
+	// (POST /api/sync)
+	PostApiSync(w http.ResponseWriter, r *http.Request)
+
+	// (POST /api/sync/push)
+	PostApiSyncPush(w http.ResponseWriter, r *http.Request)
+
+	// (GET /api/user/apikeys)
+	GetApiUserApikeys(w http.ResponseWriter, r *http.Request)
+
+	// (POST /api/user/apikeys)
+	PostApiUserApikeys(w http.ResponseWriter, r *http.Request)
+
+	// (DELETE /api/user/apikeys/{id})
+	DeleteApiUserApikeysId(w http.ResponseWriter, r *http.Request, id int)
+
+	// (GET /api/user/devices)
+	GetApiUserDevices(w http.ResponseWriter, r *http.Request)
+
+	// (DELETE /api/user/devices/{deviceID})
+	DeleteApiUserDevicesDeviceID(w http.ResponseWriter, r *http.Request, deviceID string)
+
+	// (GET /api/user/email)
+	GetApiUserEmail(w http.ResponseWriter, r *http.Request)
+
+	// (PUT /api/user/email)
+	PutApiUserEmail(w http.ResponseWriter, r *http.Request)
+
+	// (GET /api/user/language)
+	GetApiUserLanguage(w http.ResponseWriter, r *http.Request)
+
+	// (PUT /api/user/language)
+	PutApiUserLanguage(w http.ResponseWriter, r *http.Request)
+
+	// (GET /api/user/logins)
+	GetApiUserLogins(w http.ResponseWriter, r *http.Request)
+
+	// (POST /api/user/logout)
+	PostApiUserLogout(w http.ResponseWriter, r *http.Request)
+
+	// (POST /api/user/password)
+	PostApiUserPassword(w http.ResponseWriter, r *http.Request)
+
+	// (POST /api/user/reencrypt)
+	PostApiUserReencrypt(w http.ResponseWriter, r *http.Request)
+
+	// (PUT /api/user/reencrypt/{id})
+	PutApiUserReencryptId(w http.ResponseWriter, r *http.Request, id string)
+
+	// (POST /api/user/refresh)
+	PostApiUserRefresh(w http.ResponseWriter, r *http.Request)
+
+	// (POST /api/user/reset)
+	PostApiUserReset(w http.ResponseWriter, r *http.Request)
+
+	// (POST /api/user/reset/request)
+	PostApiUserResetRequest(w http.ResponseWriter, r *http.Request)
+
+	// (GET /api/user/verify)
+	GetApiUserVerify(w http.ResponseWriter, r *http.Request, params GetApiUserVerifyParams)
+
+	// (GET /api/vault/checksum)
+	GetApiVaultChecksum(w http.ResponseWriter, r *http.Request)
+
+	// (GET /api/{table})
+	GetApiTable(w http.ResponseWriter, r *http.Request, table string, params GetApiTableParams)
+
+	// (GET /api/{table}/{id}/history)
+	GetApiTableIdHistory(w http.ResponseWriter, r *http.Request, table string, id string, params GetApiTableIdHistoryParams)
+
+	// (POST /api/{table}/{id}/restore)
+	PostApiTableIdRestore(w http.ResponseWriter, r *http.Request, table string, id string)
+
+	// (POST /api/{table}/{id}/shares)
+	PostApiTableIdShares(w http.ResponseWriter, r *http.Request, table string, id string)
+
+	// (DELETE /api/{table}/{id}/shares/{grantee})
+	DeleteApiTableIdSharesGrantee(w http.ResponseWriter, r *http.Request, table string, id string, grantee string)
+
 	// (DELETE /deleteData/{table}/{userID}/{entryID})
 	DeleteDeleteDataTableUserIDEntryID(w http.ResponseWriter, r *http.Request, table string, userID int, entryID string)
 
@@ -92,13 +514,79 @@ type Unimplemented struct{}
 
 type Storage interface {
 	UserExists(ctx context.Context, username string) (bool, error)
+	UsernameTaken(ctx context.Context, username string) (bool, error)
 	AddUser(ctx context.Context, username string, hashedPassword string) error
 	GetPassword(ctx context.Context, username string) (string, error)
 	GetUserID(ctx context.Context, username string) (int, error)
-	AddData(ctx context.Context, table string, user_id int, entry_id string, data map[string]string) error
-	UpdateData(ctx context.Context, table string, user_id int, entry_id string, data map[string]string) error
-	DeleteData(ctx context.Context, table string, user_id int, entry_id string) error
-	GetAllData(ctx context.Context, table string, user_id int, last_sync time.Time, incl_del bool) ([]map[string]string, error)
+	UpdatePassword(ctx context.Context, user_id int, hashedPassword string) error
+	RehashPassword(ctx context.Context, user_id int, oldHash, newHash string) (bool, error)
+	RecordFailedLogin(ctx context.Context, username string, maxFailures int) (time.Time, error)
+	ResetFailedLogins(ctx context.Context, username string) error
+	IsLocked(ctx context.Context, username string) (bool, time.Time, error)
+	RecordLogin(ctx context.Context, ev models.LoginEvent, keep int) error
+	GetLoginHistory(ctx context.Context, user_id int, limit int) ([]models.LoginEvent, error)
+	GetUserAccess(ctx context.Context, user_id int) (models.UserAccess, error)
+	ListUsers(ctx context.Context, afterID int, limit int) ([]models.UserSummary, error)
+	SetUserDisabled(ctx context.Context, user_id int, disabled bool) error
+	DeleteUser(ctx context.Context, user_id int) error
+	AddData(ctx context.Context, table string, user_id int, entry_id string, data map[string]string) (string, time.Time, error)
+	UpdateData(ctx context.Context, table string, user_id int, entry_id string, data map[string]string) (time.Time, error)
+	DeleteData(ctx context.Context, table string, user_id int, entry_id string) (time.Time, error)
+	GetData(ctx context.Context, table string, user_id int, entry_id string, incl_expired bool) (map[string]string, error)
+	GetAllData(ctx context.Context, table string, user_id int, q models.DataQuery) ([]map[string]string, error)
+	ExportData(ctx context.Context, table string, user_id int, fn func(entry map[string]string) error) error
+	PendingData(ctx context.Context, user_id int, since time.Time, partial bool) (map[string]models.PendingSize, error)
+	GetUserDataVersion(ctx context.Context, user_id int) (models.DataVersion, error)
+	UndeleteData(ctx context.Context, table string, user_id int, entry_id string) (time.Time, error)
+	GetDataHistory(ctx context.Context, table string, user_id int, entry_id string, limit int) ([]models.EntryVersion, error)
+	RenameTag(ctx context.Context, user_id int, from, to string) (int, error)
+	SearchData(ctx context.Context, user_id int, query string, tables []string, limit int, partial bool) (map[string][]map[string]string, error)
+	ApplyChanges(ctx context.Context, user_id int, changes []models.Change) ([]models.ChangeResult, error)
+	Sync(ctx context.Context, user_id int, lastSync time.Time, changes []models.Change) (models.SyncResult, error)
+	AddAuditEvent(ctx context.Context, ev models.AuditEvent) error
+	GetAuditEvents(ctx context.Context, user_id int, since time.Time, limit int) ([]models.AuditEvent, error)
+	StoreRefreshToken(ctx context.Context, tok models.RefreshToken) error
+	GetRefreshToken(ctx context.Context, hash string) (models.RefreshToken, error)
+	RevokeRefreshToken(ctx context.Context, hash string) (bool, error)
+	RevokeRefreshTokenFamily(ctx context.Context, familyID string) error
+	RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error
+	CreateAPIKey(ctx context.Context, key models.APIKey) (models.APIKey, error)
+	ListAPIKeys(ctx context.Context, user_id int) ([]models.APIKey, error)
+	RevokeAPIKey(ctx context.Context, user_id int, id int) error
+	CreateMonitorToken(ctx context.Context, token models.MonitorToken) (models.MonitorToken, error)
+	GetMonitorTokenByHash(ctx context.Context, hash string) (models.MonitorToken, error)
+	ListMonitorTokens(ctx context.Context) ([]models.MonitorToken, error)
+	TouchMonitorToken(ctx context.Context, id int) error
+	RevokeMonitorToken(ctx context.Context, id int) (models.MonitorToken, error)
+	SetUserEmail(ctx context.Context, user_id int, email string) error
+	SetUserLanguage(ctx context.Context, user_id int, language string) error
+	GetUserEmail(ctx context.Context, user_id int) (models.UserEmail, error)
+	FindUserByEmail(ctx context.Context, email string) (models.UserEmail, error)
+	VerifyUserEmail(ctx context.Context, user_id int, email string) error
+	CreateEmailToken(ctx context.Context, token models.EmailToken) error
+	ConsumeEmailToken(ctx context.Context, hash, purpose string) (models.EmailToken, error)
+	RegisterDevice(ctx context.Context, user_id int, device_id, name string) error
+	TouchDevice(ctx context.Context, user_id int, device_id string) error
+	GetDevices(ctx context.Context, user_id int) ([]models.Device, error)
+	SetDeviceLastSync(ctx context.Context, user_id int, device_id string, at time.Time) error
+	RevokeDevice(ctx context.Context, user_id int, device_id string) error
+	StartUserOperation(ctx context.Context, op models.UserOperation) (models.UserOperation, error)
+	GetRunningOperation(ctx context.Context, user_id int) (models.UserOperation, error)
+	UpdateUserOperation(ctx context.Context, user_id int, id, status string, expiresAt time.Time) (models.UserOperation, error)
+	CreateUploadSession(ctx context.Context, session models.UploadSession) (models.UploadSession, error)
+	GetUploadSession(ctx context.Context, user_id int, id string) (models.UploadSession, error)
+	DeleteUploadSession(ctx context.Context, user_id int, id string) error
+	FileEntryTaken(ctx context.Context, user_id int, entry_id string) (bool, error)
+	WriteFileBlob(ctx context.Context, user_id int, entry_id string, fields map[string]string, blob models.FileBlob) ([]string, time.Time, error)
+	GetFileBlob(ctx context.Context, user_id int, entry_id string) (models.FileBlob, error)
+	ShareEntry(ctx context.Context, share models.Share) (models.Share, error)
+	RevokeShare(ctx context.Context, owner_id, grantee_id int, table, entry_id string) error
+	GetSharedWithUser(ctx context.Context, user_id int, since time.Time) ([]models.SharedEntry, error)
+	CreateFolder(ctx context.Context, folder models.Folder) (models.Folder, error)
+	UpdateFolder(ctx context.Context, folder models.Folder) (models.Folder, error)
+	DeleteFolder(ctx context.Context, user_id int, folder_id string, moveChildren bool) (time.Time, error)
+	GetFolders(ctx context.Context, user_id int, since time.Time) ([]models.Folder, error)
+	RotationStatus(ctx context.Context) (models.RotationStatus, error)
 }
 
 // Options represents an interface for parsing command line options.
@@ -110,20 +598,84 @@ type Options interface {
 	RunAddr() string
 
 	FileStoragePath() string
+
+	// RefreshTokenTTL returns the lifetime of the refresh tokens.
+	RefreshTokenTTL() time.Duration
+
+	// LoginMaxFailures returns the consecutive failed logins locking an account, 0 if accounts aren't locked.
+	LoginMaxFailures() int
+
+	// LoginIPLimit returns the failed logins from an address per minute above which its logins are rejected.
+	LoginIPLimit() int
+
+	// LoginHistory returns the login attempts kept per user, 0 if they are all kept.
+	LoginHistory() int
+
+	// VerifyTokenTTL returns the lifetime of the tokens mailed to verify an email.
+	VerifyTokenTTL() time.Duration
+
+	// ResetTokenTTL returns the lifetime of the tokens mailed to reset a password.
+	ResetTokenTTL() time.Duration
+	// ReencryptTimeout returns the time a re-encryption of a vault may go without a heartbeat before it fails.
+	ReencryptTimeout() time.Duration
+	// ImportMaxSize returns the size in bytes an import body may have.
+	ImportMaxSize() int
+	// UploadSessionTTL returns the time a chunked upload may take until it is committed.
+	UploadSessionTTL() time.Duration
+	// UploadChunkMaxSize returns the size in bytes a chunk of a chunked upload may have.
+	UploadChunkMaxSize() int
+
+	// PlaintextPreviews returns whether the notes may have a plaintext preview.
+	PlaintextPreviews() bool
+
+	// MonitorRateLimit returns the monitor pings per minute per token above which they are rejected.
+	MonitorRateLimit() int
 }
 
 // Log represents an interface for logging functionality.
 type Log interface {
 	// Info logs an informational message with optional fields.
 	Info(string, ...zapcore.Field)
+	// Warn logs a recoverable problem with optional fields.
+	Warn(string, ...zapcore.Field)
 }
 
 // Authz represents an interface for user authorization functionality.
 type Authz interface {
-	// CreateJWTTokenForUser creates a JWT token for a specified user ID.
-	CreateJWTTokenForUser(userID string) string
-	IsBcryptHash(s string) bool
+	// CreateJWTTokenWithRole creates a JWT token for a specified user ID of the role.
+	CreateJWTTokenWithRole(userID string, role string) string
+	// AccessTokenTTL returns the lifetime of the tokens of CreateJWTTokenWithRole, 0 if they don't expire.
+	AccessTokenTTL() time.Duration
+	// DecodeTokenID returns the user ID, the JWT ID and the expiry of a valid access token.
+	DecodeTokenID(token string) (userID string, jti string, expiresAt time.Time, err error)
+	// MarkRevoked makes the access tokens of the JWT ID rejected at once.
+	MarkRevoked(jti string)
+	// NewRefreshToken returns a new random refresh token.
+	NewRefreshToken() (string, error)
+	// HashRefreshToken returns the hash under which a refresh token is stored.
+	HashRefreshToken(token string) string
+	// NewAPIKey returns a new random API key.
+	NewAPIKey() (string, error)
+	// HashAPIKey returns the hash under which an API key is stored.
+	HashAPIKey(key string) string
+	// NewMonitorToken returns a new random token of an uptime monitor.
+	NewMonitorToken() (string, error)
+	// HashMonitorToken returns the hash under which a monitor token is stored.
+	HashMonitorToken(token string) string
+	// HashedPassword reports whether a password is the bcrypt hash a legacy client sends instead of it, if those are accepted.
+	HashedPassword(password string) bool
+	// HashPassword returns the hash of a password, stored instead of it.
+	HashPassword(password string) (string, error)
 	CompareHashAndPassword(hashedPassword, password string) bool
+	// NeedsRehash reports whether a hash is of an older format or parameters than HashPassword makes.
+	NeedsRehash(hashedPassword string) bool
+	// CheckPassword returns the rules of the password policy a plain password chosen by the user breaks.
+	CheckPassword(username, password string) []models.PolicyViolation
+	// CheckUsername returns the violation of the username policy by a username chosen by the user, nil if it follows it.
+	// It returns the error of the external checker too, with a violation only if the policy fails closed.
+	CheckUsername(ctx context.Context, username string) (*models.PolicyViolation, error)
+	// ReservedUsername returns the violation of the username if it is reserved or denied, without the external checker.
+	ReservedUsername(username string) *models.PolicyViolation
 }
 
 // BaseController represents a basic controller for handling user requests.
@@ -133,6 +685,27 @@ type BaseController struct {
 	options Options
 	log     Log
 	authz   Authz
+	logins  *loginLimiter
+	mailer  Mailer
+	health  Health
+	events  Events
+
+	// replication is the replication of a vault from a primary server, see SetReplication
+	replication Replication
+
+	// blobs stores the contents of the files uploaded in chunks, see SetBlobStore
+	blobs objstore.BlobStore
+
+	// monitorTokens caches the monitor tokens by hash and pings limits their pings, see GetApiMonitorPing
+	monitorTokens *cache.Cache[string, models.MonitorToken]
+	pings         *pingLimiter
+
+	// historyDiffs caches the changes between the versions of the entries, see diffHistory
+	historyDiffs *cache.Cache[historyDiffKey, []models.FieldChange]
+
+	// dummyHash is the hash of the logins to unknown accounts, see dummyPasswordHash
+	dummyHash     string
+	dummyHashOnce sync.Once
 }
 
 // Example usage:
@@ -147,13 +720,40 @@ func NewBaseController(storage Storage, options Options, log Log, authz Authz) *
 		options: options,
 		log:     log,
 		authz:   authz,
+		logins:  newLoginLimiter(options.LoginIPLimit()),
+
+		monitorTokens: cache.New[string, models.MonitorToken]("monitor_tokens", monitorTokensCacheSize, monitorTokensCacheTTL),
+		pings:         newPingLimiter(options.MonitorRateLimit()),
+
+		historyDiffs: cache.New[historyDiffKey, []models.FieldChange]("history_diffs", historyDiffsCacheSize, 0),
 	}
 
 	return instance
 }
 
+// (POST /addData/{table}/{userID})
+func (h *BaseController) PostAddDataTableUserID(w http.ResponseWriter, r *http.Request, table string, userID int) {
+	// The storage assigns the id of the entry
+	h.addData(w, r, table, userID, "")
+}
+
 // (POST /addData/{table}/{userID}/{entryID})
 func (h *BaseController) PostAddDataTableUserIDEntryID(w http.ResponseWriter, r *http.Request, table string, userID int, entryID string) {
+	h.addData(w, r, table, userID, entryID)
+}
+
+// addData adds the entry of the request body, with a new id if entryID is empty.
+func (h *BaseController) addData(w http.ResponseWriter, r *http.Request, table string, userID int, entryID string) {
+	if !ownsPath(r, userID) {
+		writeNotFound(w)
+		return
+	}
+	if !validTable(w, table) {
+		return
+	}
+	if entryID != "" && !validEntryID(w, entryID) {
+		return
+	}
 
 	// Parse and decode the request body into a new 'map[string]string' value
 	var requestBody map[string]string
@@ -162,247 +762,3019 @@ func (h *BaseController) PostAddDataTableUserIDEntryID(w http.ResponseWriter, r
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if !h.allowedFields(w, requestBody) {
+		return
+	}
 
 	// Call the 'AddData' method with the userID, table, and data from the request body
-	err = h.storage.AddData(r.Context(), table, userID, entryID, requestBody)
+	entryID, updatedAt, err := h.storage.AddData(r.Context(), table, userID, entryID, requestBody)
+	if errors.Is(err, models.ErrInvalidChange) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// If everything goes well, respond with a status of '200 OK'
-	w.WriteHeader(http.StatusOK)
-}
+	h.publish(r, userID, models.VaultEvent{Table: table, EntryID: entryID, UpdatedAt: updatedAt})
 
-// (DELETE /deleteData/{table}/{userID}/{entryID})
-func (h *BaseController) DeleteDeleteDataTableUserIDEntryID(w http.ResponseWriter, r *http.Request, table string, userID int, entryID string) {
-	// Call the 'DeleteData' method with the userID, table, and entryID
-	err := h.storage.DeleteData(r.Context(), table, userID, entryID)
+	// If everything goes well, respond with the id of the entry and the timestamp assigned by the storage
+	responseBytes, err := json.Marshal(map[string]interface{}{
+		"id":         entryID,
+		"updated_at": updatedAt,
+	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// If everything goes well, respond with a status of '200 OK'
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	w.Write(responseBytes)
 }
 
-func (h *BaseController) GetGetAllDataTableUserID(w http.ResponseWriter, r *http.Request, table string, userID int, lastSyncStr string) {
-	// Преобразуйте lastSync обратно в time.Time
-	lastSync, err := time.Parse(time.RFC3339, lastSyncStr)
+// searchLimit is the default and the maximum number of search results returned per table.
+const searchLimit = 100
+
+// Audit pages are bounded, the default page is sent if no limit is given.
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// (GET /api/audit)
+func (h *BaseController) GetApiAudit(w http.ResponseWriter, r *http.Request, params GetApiAuditParams) {
+	userID, err := userIDFromContext(r.Context())
 	if err != nil {
-		http.Error(w, "Неверный формат lastSync: "+err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
-	inclDel := !lastSync.IsZero()
 
-	// Получение данных из БД
-	data, err := h.storage.GetAllData(r.Context(), table, userID, lastSync, inclDel)
+	var since time.Time
+	if params.Since != nil {
+		since = *params.Since
+	}
+	limit := defaultAuditLimit
+	if params.Limit != nil && *params.Limit > 0 {
+		limit = min(*params.Limit, maxAuditLimit)
+	}
+
+	// Only the events of the user from the token are returned
+	events, err := h.storage.GetAuditEvents(r.Context(), userID, since, limit)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	// Преобразование данных в JSON
-	jsonData, err := json.Marshal(data)
+
+	responseBytes, err := json.Marshal(events)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Отправка данных
+	// Send the events, newest first
 	w.Header().Set("Content-Type", "application/json")
-	w.Write(jsonData)
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseBytes)
 }
 
-// (GET /getData/{table}/{userID}/{entryID})
-func (h *BaseController) GetGetDataTableUserIDEntryID(w http.ResponseWriter, r *http.Request, table string, userID int, entryID string) {
-	w.WriteHeader(http.StatusNotImplemented)
+// pendingResponse is the estimate of a synchronization per table, with its total.
+type pendingResponse struct {
+	models.PendingSize
+	Tables map[string]models.PendingSize `json:"tables"`
 }
 
-// (GET /getFile/{userID}/{entryID})
-func (h *BaseController) GetGetFileUserIDEntryID(w http.ResponseWriter, r *http.Request, userID int, entryID string) {
+// partialPendingResponse is the estimate of a synchronization in the partial mode, with the total of the estimated tables.
+type partialPendingResponse struct {
+	models.PendingSize
+	partialResponse
+}
 
-	// Путь к файлу
-	filePath := filepath.Join(h.options.FileStoragePath(), entryID)
-	// Проверка существования файла
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		http.Error(w, "Файл не найден", http.StatusNotFound)
+// (GET /api/data/pending)
+func (h *BaseController) GetApiDataPending(w http.ResponseWriter, r *http.Request, params GetApiDataPendingParams) {
+	userID, err := userIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	// Отправка файла
-	http.ServeFile(w, r, filePath)
-}
+	if _, ok := h.syncDevice(w, r, userID); !ok {
+		return
+	}
 
-// (GET /getPassword/{username})
-func (h *BaseController) GetGetPasswordUsername(w http.ResponseWriter, r *http.Request, username string) {
-	w.WriteHeader(http.StatusNotImplemented)
-}
+	// The cursor is the lastSync of the synchronization, none estimates a full download
+	var since time.Time
+	if params.Cursor != nil {
+		since = *params.Cursor
+	}
 
-// (GET /getUserID/{username})
-func (h *BaseController) GetGetUserIDUsername(w http.ResponseWriter, r *http.Request, username string) {
-	// Получаем UserID из базы данных
-	userID, err := h.storage.GetUserID(r.Context(), username)
+	// In the partial mode the tables which failed are reported, the others are still estimated
+	partial := params.Partial != nil && *params.Partial
+	tables, err := h.storage.PendingData(r.Context(), userID, since, partial)
+	var partialErr *models.PartialError
+	if partial && errors.As(err, &partialErr) {
+		err = nil
+	}
+	if errors.Is(err, models.ErrRetrySync) {
+		writeRetrySync(w)
+		return
+	}
 	if err != nil {
-		// Если произошла ошибка, отправляем статус 500 и сообщение об ошибке
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Преобразуем UserID в JSON
-	userIDJSON, err := json.Marshal(userID)
+	var total models.PendingSize
+	for _, pending := range tables {
+		total.Entries += pending.Entries
+		total.Bytes += pending.Bytes
+	}
+	if partial {
+		// The total is of the tables which were estimated
+		writeJSON(w, partialPendingResponse{PendingSize: total, partialResponse: newPartialResponse(models.DataTables, tables, partialErr)})
+		return
+	}
+
+	response := pendingResponse{PendingSize: total, Tables: tables}
+
+	responseBytes, err := json.Marshal(response)
 	if err != nil {
-		// Если произошла ошибка, отправляем статус 500 и сообщение об ошибке
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Устанавливаем заголовок Content-Type и отправляем UserID в ответе
+	// Send the estimate, no entry data is read
 	w.Header().Set("Content-Type", "application/json")
-	w.Write(userIDJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseBytes)
 }
 
-// (POST /login)
-func (h *BaseController) PostLogin(w http.ResponseWriter, r *http.Request) {
-	// Parse and decode the request body into a new 'PostLoginJSONRequestBody' value
-	var requestBody PostLoginJSONRequestBody
-	err := json.NewDecoder(r.Body).Decode(&requestBody)
+// (POST /api/data/tags/rename)
+func (h *BaseController) PostApiDataTagsRename(w http.ResponseWriter, r *http.Request) {
+	var requestBody PostApiDataTagsRenameJSONRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	userID, err := userIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// The entries are renamed on the server at once, the devices pick them up with their next synchronization
+	renamed, err := h.storage.RenameTag(r.Context(), userID, requestBody.From, requestBody.To)
+	if errors.Is(err, models.ErrInvalidChange) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, models.ErrRetrySync) {
+		writeRetrySync(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The entries renamed may be of any table
+	if renamed > 0 {
+		h.publish(r, userID, models.VaultEvent{UpdatedAt: time.Now().UTC()})
+	}
+
+	writeJSON(w, map[string]int{"renamed": renamed})
+}
+
+// (GET /api/search)
+func (h *BaseController) GetApiSearch(w http.ResponseWriter, r *http.Request, params GetApiSearchParams) {
+	userID, err := userIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	limit := searchLimit
+	if params.Limit != nil && *params.Limit > 0 && *params.Limit < searchLimit {
+		limit = *params.Limit
+	}
+
+	var tables []string
+	if params.Table != nil {
+		tables = *params.Table
+	}
+
+	// Call the 'SearchData' method with the userID from the token, so results never include other users' data.
+	// In the partial mode the tables which failed are reported, the others are still searched
+	partial := params.Partial != nil && *params.Partial
+	results, err := h.storage.SearchData(r.Context(), userID, params.Q, tables, limit, partial)
+	var partialErr *models.PartialError
+	if partial && errors.As(err, &partialErr) {
+		err = nil
+	}
+	if errors.Is(err, models.ErrInvalidQuery) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, models.ErrRetrySync) {
+		writeRetrySync(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if partial {
+		if len(tables) == 0 {
+			tables = models.DataTables
+		}
+		// The tables without matches are listed too, with no entries
+		for _, table := range tables {
+			if results[table] == nil {
+				results[table] = []map[string]string{}
+			}
+		}
+		writeJSON(w, newPartialResponse(tables, results, partialErr))
+		return
+	}
+
+	// Convert the matching entries to JSON
+	responseBytes, err := json.Marshal(results)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Send the matching entries grouped by table
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseBytes)
+}
+
+// (POST /api/sync/push)
+func (h *BaseController) PostApiSyncPush(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if _, ok := h.syncDevice(w, r, userID); !ok {
+		return
+	}
+
+	// Parse and decode the request body into a new 'PostApiSyncPushJSONRequestBody' value
+	var requestBody PostApiSyncPushJSONRequestBody
+	err = json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !h.validChanges(w, requestBody.Changes) {
+		return
+	}
+
+	// Apply all changes as one unit, a failure of any of them rolls back the whole batch
+	results, err := h.storage.ApplyChanges(r.Context(), userID, requestBody.Changes)
+	if errors.Is(err, models.ErrInvalidChange) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, models.ErrRetrySync) {
+		// Nothing of the batch was applied, the client pushes it again as is
+		writeRetrySync(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.publish(r, userID, models.AppliedEvents(results)...)
+
+	// Convert the per-change results to JSON
+	responseBytes, err := json.Marshal(map[string]interface{}{
+		"results": results,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Send the results so the client can reconcile its state
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseBytes)
+}
+
+// (POST /api/sync)
+func (h *BaseController) PostApiSync(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	deviceID, ok := h.syncDevice(w, r, userID)
+	if !ok {
+		return
+	}
+
+	var requestBody PostApiSyncJSONRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.validChanges(w, requestBody.Changes) {
+		return
+	}
+	// A device fenced by the re-encryption on another one still pulls, but pushes nothing
+	if op, ok := fencedBy(r.Context()); ok && len(requestBody.Changes) > 0 {
+		writeLocked(w, http.StatusLocked, errVaultLocked, op)
+		return
+	}
+	if isReplica(r.Context()) && len(requestBody.Changes) > 0 {
+		http.Error(w, errReadOnlyReplica.Error(), http.StatusConflict)
+		return
+	}
+
+	// Push and pull in one transaction, the client doesn't miss what changed on the server in between
+	result, err := h.storage.Sync(r.Context(), userID, requestBody.LastSync, requestBody.Changes)
+	if errors.Is(err, models.ErrInvalidChange) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, models.ErrRetrySync) {
+		// Nothing of the batch was applied, the client syncs again as is
+		writeRetrySync(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.publish(r, userID, models.AppliedEvents(result.Results)...)
+	withContentURLs(models.FilesTable, result.Changes[models.FilesTable])
+
+	// The device is synchronized up to the watermark
+	if deviceID != "" && result.Watermark.After(requestBody.LastSync) {
+		if err := h.storage.SetDeviceLastSync(r.Context(), userID, deviceID, result.Watermark); err != nil {
+			h.log.Warn("failed to set device last sync", zap.Int("userID", userID), zap.String("deviceID", deviceID), zap.Error(err))
+		}
+	}
+
+	writeJSON(w, result)
+}
+
+// validChanges rejects a batch of changes with a malformed entry id or a field the entries can't have.
+func (h *BaseController) validChanges(w http.ResponseWriter, changes []models.Change) bool {
+	for _, c := range changes {
+		if !validEntryID(w, c.EntryID) || !h.allowedFields(w, c.Fields) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// (GET /api/{table})
+func (h *BaseController) GetApiTable(w http.ResponseWriter, r *http.Request, table string, params GetApiTableParams) {
+	userID, err := userIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if !validTable(w, table) {
+		return
+	}
+
+	// The list returns a light projection unless the client asks for other columns,
+	// the full entry is returned by getData
+	query := models.DataQuery{Columns: models.TableListColumns(table)}
+	if params.Tag != nil {
+		query.Tag = *params.Tag
+	}
+	if params.Folder != nil {
+		// The entries outside of any folder are asked for as the root
+		query.Folder = *params.Folder
+		if query.Folder != models.RootFolder {
+			if _, err := models.ParseFolderID(query.Folder); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if params.IncludeExpired != nil {
+		query.InclExpired = *params.IncludeExpired
+	}
+	if params.Columns != nil {
+		query.Columns = *params.Columns
+	}
+
+	var sortColumn, dir string
+	if params.Sort != nil {
+		sortColumn = *params.Sort
+	}
+	if params.Dir != nil {
+		dir = *params.Dir
+	}
+	query.OrderBy, err = models.ParseOrder(sortColumn, dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// A polling client which has the entries already doesn't download them again
+	if h.notModified(w, r, userID) {
+		return
+	}
+
+	// Call the 'GetAllData' method with the userID from the token, the filters are applied by the storage
+	data, err := h.storage.GetAllData(r.Context(), table, userID, query)
+	if errors.Is(err, models.ErrUnknownColumn) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if data == nil {
+		data = []map[string]string{}
+	}
+
+	// Convert the entries to JSON
+	responseBytes, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Send the entries of the table
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseBytes)
+}
+
+// (GET /api/{table}/{id}/history)
+func (h *BaseController) GetApiTableIdHistory(w http.ResponseWriter, r *http.Request, table string, id string, params GetApiTableIdHistoryParams) {
+	userID, err := userIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if !validTable(w, table) {
+		return
+	}
+	if !validEntryID(w, id) {
+		return
+	}
+
+	var limit int
+	if params.Limit != nil {
+		limit = *params.Limit
+	}
+
+	// Call the 'GetDataHistory' method with the userID from the token, table, and entry id
+	versions, err := h.storage.GetDataHistory(r.Context(), table, userID, id, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := h.diffHistory(r.Context(), table, userID, id, versions); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Convert the versions to JSON
+	responseBytes, err := json.Marshal(versions)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Send the prior versions of the entry, newest first
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseBytes)
+}
+
+// (POST /api/{table}/{id}/restore)
+func (h *BaseController) PostApiTableIdRestore(w http.ResponseWriter, r *http.Request, table string, id string) {
+	userID, err := userIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if !validTable(w, table) {
+		return
+	}
+	if !validEntryID(w, id) {
+		return
+	}
+
+	// Call the 'UndeleteData' method with the userID from the token, table, and entry id
+	updatedAt, err := h.storage.UndeleteData(r.Context(), table, userID, id)
+	if errors.Is(err, models.ErrNotFound) {
+		writeNotFound(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.publish(r, userID, models.VaultEvent{Table: table, EntryID: id, UpdatedAt: updatedAt})
+
+	// If everything goes well, respond with the timestamp assigned by the storage
+	writeUpdatedAt(w, updatedAt)
+}
+
+// (DELETE /deleteData/{table}/{userID}/{entryID})
+func (h *BaseController) DeleteDeleteDataTableUserIDEntryID(w http.ResponseWriter, r *http.Request, table string, userID int, entryID string) {
+	if !ownsPath(r, userID) {
+		writeNotFound(w)
+		return
+	}
+	if !validTable(w, table) {
+		return
+	}
+
+	if !validEntryID(w, entryID) {
+		return
+	}
+
+	// Call the 'DeleteData' method with the userID, table, and entryID
+	updatedAt, err := h.storage.DeleteData(r.Context(), table, userID, entryID)
+	if errors.Is(err, models.ErrNotFound) {
+		writeNotFound(w)
+		return
+	}
+	if errors.Is(err, models.ErrReadOnlyShare) {
+		writeReadOnlyShare(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.publish(r, userID, models.VaultEvent{Table: table, EntryID: entryID, UpdatedAt: updatedAt})
+
+	// If everything goes well, respond with the timestamp assigned by the storage
+	writeUpdatedAt(w, updatedAt)
+}
+
+func (h *BaseController) GetGetAllDataTableUserID(w http.ResponseWriter, r *http.Request, table string, userID int, lastSyncStr string) {
+	if !ownsPath(r, userID) {
+		writeNotFound(w)
+		return
+	}
+	if !validTable(w, table) {
+		return
+	}
+
+	// Преобразуйте lastSync обратно в time.Time
+	lastSync, err := time.Parse(time.RFC3339, lastSyncStr)
+	if err != nil {
+		http.Error(w, "Неверный формат lastSync: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	inclDel := !lastSync.IsZero()
+	deviceID, ok := h.syncDevice(w, r, userID)
+	if !ok {
+		return
+	}
+	if h.notModified(w, r, userID) {
+		return
+	}
+
+	// Получение данных из БД
+	data, err := h.storage.GetAllData(r.Context(), table, userID, models.DataQuery{LastSync: lastSync, InclDeleted: inclDel})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The pull succeeded, the device is synchronized up to the latest entry it got
+	if checkpoint := syncCheckpoint(data, lastSync); deviceID != "" && !checkpoint.IsZero() {
+		if err := h.storage.SetDeviceLastSync(r.Context(), userID, deviceID, checkpoint); err != nil {
+			h.log.Warn("failed to set device last sync", zap.Int("userID", userID), zap.String("deviceID", deviceID), zap.Error(err))
+		}
+	}
+	withContentURLs(table, data)
+	// Преобразование данных в JSON
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Отправка данных
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+// (GET /getData/{table}/{userID}/{entryID})
+func (h *BaseController) GetGetDataTableUserIDEntryID(w http.ResponseWriter, r *http.Request, table string, userID int, entryID string) {
+	if !ownsPath(r, userID) {
+		writeNotFound(w)
+		return
+	}
+	if !validTable(w, table) {
+		return
+	}
+	if !validEntryID(w, entryID) {
+		return
+	}
+
+	// Получение записи из БД, the storage filters by the user in the same lookup
+	data, err := h.storage.GetData(r.Context(), table, userID, entryID, false)
+	if errors.Is(err, models.ErrNotFound) {
+		writeNotFound(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Преобразование данных в JSON
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Отправка данных
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+// (GET /getFile/{userID}/{entryID})
+func (h *BaseController) GetGetFileUserIDEntryID(w http.ResponseWriter, r *http.Request, userID int, entryID string) {
+	if !ownsPath(r, userID) {
+		writeNotFound(w)
+		return
+	}
+
+	// The file is on disk unless it was uploaded into the blob store
+	file, err := h.openFile(r.Context(), userID, entryID)
+	if errors.Is(err, models.ErrNotFound) {
+		writeNotFound(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	// Отправка файла
+	http.ServeContent(w, r, entryID, time.Time{}, file)
+}
+
+// (GET /getPassword/{username})
+func (h *BaseController) GetGetPasswordUsername(w http.ResponseWriter, r *http.Request, username string) {
+	w.WriteHeader(http.StatusNotImplemented)
+}
+
+// (GET /getUserID/{username})
+func (h *BaseController) GetGetUserIDUsername(w http.ResponseWriter, r *http.Request, username string) {
+	// Получаем UserID из базы данных
+	userID, err := h.storage.GetUserID(r.Context(), username)
+	if err != nil {
+		// Если произошла ошибка, отправляем статус 500 и сообщение об ошибке
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Преобразуем UserID в JSON
+	userIDJSON, err := json.Marshal(userID)
+	if err != nil {
+		// Если произошла ошибка, отправляем статус 500 и сообщение об ошибке
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Устанавливаем заголовок Content-Type и отправляем UserID в ответе
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(userIDJSON)
+}
+
+// (POST /login)
+func (h *BaseController) PostLogin(w http.ResponseWriter, r *http.Request) {
+	// Parse and decode the request body into a new 'PostLoginJSONRequestBody' value
+	var requestBody PostLoginJSONRequestBody
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	addr := clientAddr(r)
+
+	// The logins from an address with too many failures and to a locked account are rejected
+	// before the password is checked, so they can't go on guessing it
+	if retry := h.logins.retryAfter(addr); retry > 0 {
+		writeTooManyLogins(w, retry)
+		return
+	}
+	locked, lockedUntil, err := h.storage.IsLocked(ctx, requestBody.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if locked {
+		writeTooManyLogins(w, time.Until(lockedUntil))
+		return
+	}
+
+	// Попытка получить хешированный пароль пользователя из локальной базы данных.
+	// An unknown account is checked against a dummy hash, so it fails like a wrong password
+	// and takes as long, and doesn't reveal which usernames exist
+	hashedPassword, err := h.storage.GetPassword(ctx, requestBody.Username)
+	known := err == nil
+	if !known {
+		hashedPassword = h.dummyPasswordHash()
+	}
+
+	if !h.passwordMatches(hashedPassword, requestBody.Password) || !known {
+		h.failedLogin(ctx, addr, requestBody.Username)
+		http.Error(w, errUnauthorized.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	userID, err := h.storage.GetUserID(ctx, requestBody.Username)
+	if err != nil {
+		h.auditFailedLogin(ctx, requestBody.Username)
+		http.Error(w, errUnauthorized.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// A disabled account fails with the right password too, it doesn't count towards a lockout
+	access, err := h.storage.GetUserAccess(ctx, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if access.Disabled {
+		h.auditAuth(ctx, models.AuditLogin, userID, false)
+		h.recordLogin(ctx, userID, addr, false)
+		http.Error(w, errDisabled.Error(), http.StatusForbidden)
+		return
+	}
+	h.auditAuth(ctx, models.AuditLogin, userID, true)
+	h.recordLogin(ctx, userID, addr, true)
+	if err := h.storage.ResetFailedLogins(ctx, requestBody.Username); err != nil {
+		h.log.Warn("failed to reset failed logins", zap.Int("user_id", userID), zap.Error(err))
+	}
+	h.rehashPassword(ctx, userID, hashedPassword, requestBody.Password)
+
+	// A login starts a new family of refresh tokens for the device, a client without a device id gets one
+	deviceID := requestBody.DeviceID
+	if deviceID == "" {
+		deviceID = uuid.NewString()
+	}
+	response, err := h.issueTokens(ctx, userID, access.Role, deviceID, uuid.NewString())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response["userID"] = userID
+	h.registerDevice(ctx, userID, deviceID, requestBody.DeviceName)
+
+	// Send the tokens and userID to the client in the response
+	writeJSON(w, response)
+}
+
+// (POST /api/user/refresh)
+func (h *BaseController) PostApiUserRefresh(w http.ResponseWriter, r *http.Request) {
+	var requestBody PostApiUserRefreshJSONRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	hash := h.authz.HashRefreshToken(requestBody.RefreshToken)
+	tok, err := h.storage.GetRefreshToken(ctx, hash)
+	if errors.Is(err, models.ErrNotFound) {
+		http.Error(w, errUnauthorized.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The token is rotated, only one refresh succeeds with it. A token presented again after its rotation
+	// was copied from the client, so the whole family is revoked and the thief and the client both log in again
+	rotated, err := h.storage.RevokeRefreshToken(ctx, hash)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !rotated {
+		if err := h.storage.RevokeRefreshTokenFamily(ctx, tok.FamilyID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h.log.Warn("reused refresh token, revoking its family",
+			zap.Int("user_id", tok.UserID), zap.String("device_id", tok.DeviceID))
+		h.auditAuth(ctx, models.AuditRefresh, tok.UserID, false)
+		http.Error(w, errUnauthorized.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !time.Now().Before(tok.ExpiresAt) {
+		http.Error(w, errUnauthorized.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// The new access token is of the current role of the user
+	access, err := h.storage.GetUserAccess(ctx, tok.UserID)
+	if errors.Is(err, models.ErrNotFound) {
+		http.Error(w, errUnauthorized.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if access.Disabled {
+		http.Error(w, errDisabled.Error(), http.StatusForbidden)
+		return
+	}
+
+	response, err := h.issueTokens(ctx, tok.UserID, access.Role, tok.DeviceID, tok.FamilyID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// A device logged in before the devices were kept is registered by its next refresh
+	h.registerDevice(ctx, tok.UserID, tok.DeviceID, "")
+
+	writeJSON(w, response)
+}
+
+// (POST /api/user/password)
+func (h *BaseController) PostApiUserPassword(w http.ResponseWriter, r *http.Request) {
+	var requestBody PostApiUserPasswordJSONRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if requestBody.NewPassword == "" {
+		http.Error(w, "new password is empty", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	tokenUserID, err := userIDFromContext(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// The current password is checked as a login is, an unknown account or the account of another user
+	// fail like a wrong password
+	hashedPassword, err := h.storage.GetPassword(ctx, requestBody.Username)
+	known := err == nil
+	if !known {
+		hashedPassword = h.dummyPasswordHash()
+	}
+	if !h.passwordMatches(hashedPassword, requestBody.CurrentPassword) || !known {
+		h.auditAuth(ctx, models.AuditPasswordChange, tokenUserID, false)
+		http.Error(w, errUnauthorized.Error(), http.StatusUnauthorized)
+		return
+	}
+	userID, err := h.storage.GetUserID(ctx, requestBody.Username)
+	if err != nil || userID != tokenUserID {
+		h.auditAuth(ctx, models.AuditPasswordChange, tokenUserID, false)
+		http.Error(w, errUnauthorized.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// The new password follows the policy and is hashed here, as when registering
+	newHash := requestBody.NewPassword
+	if violations := h.authz.CheckPassword(requestBody.Username, newHash); len(violations) > 0 {
+		h.auditAuth(ctx, models.AuditPasswordChange, userID, false)
+		writeWeakPassword(w, violations)
+		return
+	}
+	if !h.authz.HashedPassword(newHash) {
+		if newHash, err = h.authz.HashPassword(newHash); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// The new password ends every session, the client changing it gets a new one
+	err = h.storage.UpdatePassword(ctx, userID, newHash)
+	if errors.Is(err, models.ErrNotFound) {
+		http.Error(w, errUnauthorized.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		h.auditAuth(ctx, models.AuditPasswordChange, userID, false)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.auditAuth(ctx, models.AuditPasswordChange, userID, true)
+
+	deviceID := requestBody.DeviceID
+	if deviceID == "" {
+		deviceID = uuid.NewString()
+	}
+	response, err := h.issueTokens(ctx, userID, roleFromContext(ctx), deviceID, uuid.NewString())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response["userID"] = userID
+	h.registerDevice(ctx, userID, deviceID, "")
+
+	writeJSON(w, response)
+}
+
+// loginHistoryLimit is the number of the last login attempts returned to a user.
+const loginHistoryLimit = 20
+
+// (GET /api/user/logins)
+func (h *BaseController) GetApiUserLogins(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Only the attempts on the account of the user from the token are returned, newest first
+	logins, err := h.storage.GetLoginHistory(r.Context(), userID, loginHistoryLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, logins)
+}
+
+// (POST /api/user/logout)
+func (h *BaseController) PostApiUserLogout(w http.ResponseWriter, r *http.Request) {
+	// The body is optional, a client may only revoke its access token
+	var requestBody PostApiUserLogoutJSONRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	userID := 0
+	loggedOut := false
+
+	// The access token of the request is revoked until it expires, so it can't be used after the logout.
+	// A token issued without a JWT ID can't be revoked and lasts until it expires
+	if token := r.Header.Get("Authorization"); token != "" {
+		tokenUserID, jti, expiresAt, err := h.authz.DecodeTokenID(token)
+		if err != nil {
+			http.Error(w, errUnauthorized.Error(), http.StatusUnauthorized)
+			return
+		}
+		if jti != "" {
+			if err := h.storage.RevokeToken(ctx, jti, expiresAt); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			h.authz.MarkRevoked(jti)
+		}
+		userID, _ = strconv.Atoi(tokenUserID)
+		loggedOut = true
+	}
+
+	if requestBody.RefreshToken != "" {
+		tok, err := h.storage.GetRefreshToken(ctx, h.authz.HashRefreshToken(requestBody.RefreshToken))
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, errUnauthorized.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// The session of the device ends, the tokens rotated from the presented one with it
+		if err := h.storage.RevokeRefreshTokenFamily(ctx, tok.FamilyID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		userID = tok.UserID
+		loggedOut = true
+	}
+
+	if !loggedOut {
+		http.Error(w, errUnauthorized.Error(), http.StatusUnauthorized)
+		return
+	}
+	h.auditAuth(ctx, models.AuditLogout, userID, true)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// (POST /register)
+func (h *BaseController) PostRegister(w http.ResponseWriter, r *http.Request) {
+	// Parse and decode the request body into a new 'PostRegisterJSONBody' value
+	var requestBody PostRegisterJSONBody
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+
+	if !h.checkUsername(w, r, requestBody.Username) {
+		h.auditAuth(ctx, models.AuditRegister, 0, false)
+		return
+	}
+
+	// The password follows the policy and is hashed here, the legacy clients may send its bcrypt hash
+	// if the server accepts those
+	password := requestBody.Password
+	if violations := h.authz.CheckPassword(requestBody.Username, password); len(violations) > 0 {
+		h.auditAuth(ctx, models.AuditRegister, 0, false)
+		writeWeakPassword(w, violations)
+		return
+	}
+	if !h.authz.HashedPassword(password) {
+		if password, err = h.authz.HashPassword(password); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Call the 'AddUser' method with the username and password from the request body
+	err = h.storage.AddUser(ctx, requestBody.Username, password)
+	if err != nil {
+		h.auditAuth(ctx, models.AuditRegister, 0, false)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The new account is known by now, even if the lookup fails the registration went through
+	userID, _ := h.storage.GetUserID(ctx, requestBody.Username)
+	h.auditAuth(ctx, models.AuditRegister, userID, true)
+
+	// The emails are in the language of the client until the user picks one
+	if language := models.PreferredLanguage(r.Header.Get("Accept-Language")); language != "" && userID != 0 {
+		if err := h.storage.SetUserLanguage(ctx, userID, language); err != nil {
+			h.log.Warn("failed to set user language", zap.Int("userID", userID), zap.Error(err))
+		}
+	}
+
+	// If everything goes well, respond with a status of '200 OK'
+	w.WriteHeader(http.StatusOK)
+}
+
+// (POST /sendFile/{userID})
+// (POST /sendFile/{userID})
+func (h *BaseController) PostSendFileUserID(w http.ResponseWriter, r *http.Request, userID int, fileName string) {
+	if !ownsPath(r, userID) {
+		writeNotFound(w)
+		return
+	}
+
+	// Чтение файла из тела запроса
+	file, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Ошибка при чтении файла", http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+
+	// Сохранение файла на сервере
+	path := filepath.Join(h.options.FileStoragePath(), fileName)
+	err = os.WriteFile(path, file, 0644)
+	if err != nil {
+		http.Error(w, "Ошибка при сохранении файла", http.StatusInternalServerError)
+		return
+	}
+
+	// Отправка ответа
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Файл успешно сохранен")
+}
+
+// (PUT /updateData/{table}/{userID}/{entryID})
+func (h *BaseController) PutUpdateDataTableUserIDEntryID(w http.ResponseWriter, r *http.Request, table string, userID int, entryID string) {
+	if !ownsPath(r, userID) {
+		writeNotFound(w)
+		return
+	}
+	if !validTable(w, table) {
+		return
+	}
+	if !validEntryID(w, entryID) {
+		return
+	}
+
+	// Parse and decode the request body into a new 'map[string]string' value
+	var requestBody map[string]string
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.allowedFields(w, requestBody) {
+		return
+	}
+
+	// Call the 'UpdateData' method with the userID, table, entryID, and data from the request body
+	updatedAt, err := h.storage.UpdateData(r.Context(), table, userID, entryID, requestBody)
+	if errors.Is(err, models.ErrNotFound) {
+		writeNotFound(w)
+		return
+	}
+	if errors.Is(err, models.ErrInvalidChange) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, models.ErrReadOnlyShare) {
+		writeReadOnlyShare(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.publish(r, userID, models.VaultEvent{Table: table, EntryID: entryID, UpdatedAt: updatedAt})
+
+	// If everything goes well, respond with the timestamp assigned by the storage
+	writeUpdatedAt(w, updatedAt)
+}
+
+// auditAuth records an authentication attempt in the audit log, userID is 0 for an unknown account.
+// The audit log must not fail the attempt, so a failed write is only logged.
+func (h *BaseController) auditAuth(ctx context.Context, action models.AuditAction, userID int, success bool) {
+	err := h.storage.AddAuditEvent(ctx, models.AuditEvent{UserID: userID, Action: action, Success: success})
+	if err != nil {
+		h.log.Warn("failed to write audit event", zap.String("action", string(action)), zap.Error(err))
+	}
+}
+
+// errUnauthorized is the response to every failed login, whatever failed.
+var errUnauthorized = errors.New("Unauthorized")
+
+// errDisabled is the response to the logins and the refreshes of a disabled account.
+var errDisabled = errors.New("account is disabled")
+
+// fallbackDummyHash is a bcrypt hash compared with if no dummy hash can be made.
+const fallbackDummyHash = "$2a$10$PyIA3bQ2.olDre/s6DhUJeIttgwhVCMp4FvKrhypHv.D9w8V1YxJC"
+
+// dummyPasswordHash returns the hash the password of a login to an unknown account is compared with.
+// It is made like the hashes of the accounts, once, so a comparison with it takes as long as with theirs.
+func (h *BaseController) dummyPasswordHash() string {
+	h.dummyHashOnce.Do(func() {
+		hash, err := h.authz.HashPassword(uuid.NewString())
+		if err != nil {
+			hash = fallbackDummyHash
+		}
+		h.dummyHash = hash
+	})
+
+	return h.dummyHash
+}
+
+// passwordMatches reports whether the password sent by a client matches the stored hash.
+// The legacy clients may send the bcrypt hash itself if the server accepts those, it is then compared
+// in constant time like any secret.
+func (h *BaseController) passwordMatches(hashedPassword, password string) bool {
+	if h.authz.HashedPassword(password) {
+		return subtle.ConstantTimeCompare([]byte(hashedPassword), []byte(password)) == 1
+	}
+
+	// Сравнение хешированного пароля с хешем введенного пароля
+	return h.authz.CompareHashAndPassword(hashedPassword, password)
+}
+
+// rehashPassword stores a new hash of the password of a successful login if its stored hash is of an older
+// format or parameters, so the stored hashes converge without a reset. Only a password sent in plain
+// can be hashed again, the hash sent by a client stays its password. The login succeeds either way.
+func (h *BaseController) rehashPassword(ctx context.Context, userID int, hashedPassword, password string) {
+	if h.authz.HashedPassword(password) || !h.authz.NeedsRehash(hashedPassword) {
+		return
+	}
+
+	newHash, err := h.authz.HashPassword(password)
+	if err == nil {
+		_, err = h.storage.RehashPassword(ctx, userID, hashedPassword, newHash)
+	}
+	if err != nil {
+		h.log.Warn("failed to rehash password", zap.Int("user_id", userID), zap.Error(err))
+	}
+}
+
+// auditFailedLogin records a failed login, under the account if it exists, so its owner sees the attempt.
+func (h *BaseController) auditFailedLogin(ctx context.Context, username string) {
+	userID, _ := h.storage.GetUserID(ctx, username)
+	h.auditAuth(ctx, models.AuditLogin, userID, false)
+}
+
+// issueTokens creates an access token of the role and stores a new refresh token of the family for the device
+// of the user. It returns the response fields of both, with the protocol versions the server speaks.
+func (h *BaseController) issueTokens(ctx context.Context, userID int, role, deviceID, familyID string) (map[string]interface{}, error) {
+	refreshToken, err := h.authz.NewRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	err = h.storage.StoreRefreshToken(ctx, models.RefreshToken{
+		Hash:      h.authz.HashRefreshToken(refreshToken),
+		UserID:    userID,
+		DeviceID:  deviceID,
+		FamilyID:  familyID,
+		ExpiresAt: time.Now().Add(h.options.RefreshTokenTTL()),
+		// The device of the token speaks the version negotiated for the request
+		ProtocolVersion: models.ProtocolFromContext(ctx),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"token":         h.authz.CreateJWTTokenWithRole(strconv.Itoa(userID), role),
+		"expires_in":    int(h.authz.AccessTokenTTL().Seconds()),
+		"refresh_token": refreshToken,
+		"device_id":     deviceID,
+		"protocol":      models.ServerProtocol,
+		"capabilities":  models.ServerCapabilities,
+	}, nil
+}
+
+// partialResponse is the response of a read across the data tables in the partial mode.
+// Partial is set if some of the tables failed, they carry their error instead of their data.
+type partialResponse struct {
+	Partial bool                          `json:"partial"`
+	Tables  map[string]models.TableResult `json:"tables"`
+}
+
+// newPartialResponse returns the response of the tables read in the partial mode with their results,
+// those failed in err with their error. err is nil if no table failed.
+func newPartialResponse[T any](tables []string, results map[string]T, err *models.PartialError) partialResponse {
+	response := partialResponse{Tables: make(map[string]models.TableResult, len(tables))}
+	for _, table := range tables {
+		if err != nil && err.Tables[table] != nil {
+			response.Partial = true
+			response.Tables[table] = models.TableResult{
+				Status: models.TableFailed,
+				Error:  &models.TableError{Message: err.Tables[table].Error()},
+			}
+			continue
+		}
+		response.Tables[table] = models.TableResult{Status: models.TableOK, Data: results[table]}
+	}
+
+	return response
+}
+
+// writeJSON responds with the value encoded as JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	responseBytes, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseBytes)
+}
+
+// writeNotFound responds to a request for an entry the user from the token doesn't have.
+// A missing entry and an entry of another user get the same response, so it doesn't tell them apart.
+func writeNotFound(w http.ResponseWriter) {
+	http.Error(w, models.ErrNotFound.Error(), http.StatusNotFound)
+}
+
+// ownsPath reports whether the user of a legacy path is the user from the token. Another user is
+// rejected before any lookup, so the response doesn't depend on the entries of that user.
+func ownsPath(r *http.Request, userID int) bool {
+	tokenUserID, err := userIDFromContext(r.Context())
+	return err == nil && tokenUserID == userID
+}
+
+// validTable checks the table of a request, responding with 400 unless it holds the entries of users:
+// the other tables of the database, the users' or the folders', aren't reached through the entry routes.
+func validTable(w http.ResponseWriter, table string) bool {
+	if !models.IsDataTable(table) {
+		http.Error(w, "unknown table "+table, http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+// validEntryID checks the entry id of a request, responding with 400 if it isn't a UUID.
+func validEntryID(w http.ResponseWriter, entryID string) bool {
+	if err := models.ValidateEntryID(entryID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+// errPreviewForbidden is the response to an entry with a preview where no metadata may be stored in plain.
+var errPreviewForbidden = errors.New("this server doesn't store plaintext previews")
+
+// allowedFields checks the fields of an entry against the plaintext metadata policy, responding with 400
+// if the entry has a preview and the server doesn't store them. The URL of the contents of a file is dropped,
+// the clients may send an entry back as they got it.
+func (h *BaseController) allowedFields(w http.ResponseWriter, fields map[string]string) bool {
+	delete(fields, models.ContentURLField)
+	if h.options.PlaintextPreviews() {
+		return true
+	}
+	for key := range fields {
+		if strings.EqualFold(key, models.PreviewField) {
+			http.Error(w, errPreviewForbidden.Error(), http.StatusBadRequest)
+			return false
+		}
+	}
+
+	return true
+}
+
+// writeUpdatedAt responds with the 'updated_at' value of a written entry.
+// Clients store it as the watermark of their next synchronization.
+func writeUpdatedAt(w http.ResponseWriter, updatedAt time.Time) {
+	responseBytes, err := json.Marshal(map[string]time.Time{
+		"updated_at": updatedAt,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseBytes)
+}
+
+// writeWeakPassword rejects a password breaking the password policy, the response lists the rules it breaks.
+func writeWeakPassword(w http.ResponseWriter, violations []models.PolicyViolation) {
+	responseBytes, err := json.Marshal(map[string]interface{}{
+		"error":      "the password doesn't follow the password policy",
+		"violations": violations,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(responseBytes)
+}
+
+// checkUsername checks a username chosen by the user against the username policy, then against the usernames
+// taken, lookalikes included. If it is rejected the response is written and false is returned.
+func (h *BaseController) checkUsername(w http.ResponseWriter, r *http.Request, username string) bool {
+	ctx := r.Context()
+
+	violation, err := h.authz.CheckUsername(ctx, username)
+	if err != nil {
+		h.log.Warn("failed to check username", zap.String("username", username), zap.Error(err), egress.Field(err))
+	}
+	if violation != nil {
+		status := http.StatusBadRequest
+		if violation.Rule == models.RuleUsernameUnchecked {
+			status = http.StatusServiceUnavailable
+		}
+		writeUsernameRejected(w, status, *violation)
+		return false
+	}
+
+	taken, err := h.storage.UsernameTaken(ctx, username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if taken {
+		writeUsernameRejected(w, http.StatusConflict, models.PolicyViolation{
+			Rule:    models.RuleUsernameTaken,
+			Message: "is taken, or looks like a username taken",
+		})
+		return false
+	}
+
+	return true
+}
+
+// writeUsernameRejected responds to a username rejected by the username policy,
+// the code is the rule broken so the clients can tell the rejections apart.
+func writeUsernameRejected(w http.ResponseWriter, status int, violation models.PolicyViolation) {
+	responseBytes, err := json.Marshal(map[string]interface{}{
+		"error": "the username " + violation.Message,
+		"code":  violation.Rule,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(responseBytes)
+}
+
+// writeRetrySync responds to a request aborted by a concurrent synchronization of the user.
+// Clients retry it after the delay of the 'Retry-After' header.
+func writeRetrySync(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, models.ErrRetrySync.Error(), http.StatusConflict)
+}
+
+// roleFromContext returns the role of the user authenticated by the JWT middleware.
+func roleFromContext(ctx context.Context) string {
+	var keyRole models.Key = "role"
+
+	role, _ := ctx.Value(keyRole).(string)
+	return role
+}
+
+// userIDFromContext returns the ID of the user authenticated by the JWT middleware.
+func userIDFromContext(ctx context.Context) (int, error) {
+	var keyUserID models.Key = "userID"
+
+	value, _ := ctx.Value(keyUserID).(string)
+	userID, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.New("Authorization error")
+	}
+
+	return userID, nil
+}
+
+// ServerInterfaceWrapper converts contexts to parameters.
+type ServerInterfaceWrapper struct {
+	Handler            ServerInterface
+	HandlerMiddlewares []MiddlewareFunc
+	// AdminMiddlewares guard the admin operations, they run after HandlerMiddlewares
+	AdminMiddlewares []MiddlewareFunc
+	ErrorHandlerFunc func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+type MiddlewareFunc func(http.Handler) http.Handler
+
+// PostAddDataTableUserID operation middleware
+func (siw *ServerInterfaceWrapper) PostAddDataTableUserID(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeWrite)
+
+	var err error
+
+	// ------------- Path parameter "table" -------------
+	var table string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "table", chi.URLParam(r, "table"), &table, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "table", Err: err})
+		return
+	}
+
+	// ------------- Path parameter "userID" -------------
+	var userID int
+
+	err = runtime.BindStyledParameterWithOptions("simple", "userID", chi.URLParam(r, "userID"), &userID, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "userID", Err: err})
+		return
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PostAddDataTableUserID(w, r, table, userID)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// PostAddDataTableUserIDEntryID operation middleware
+func (siw *ServerInterfaceWrapper) PostAddDataTableUserIDEntryID(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeWrite)
+
+	var err error
+
+	// ------------- Path parameter "table" -------------
+	var table string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "table", chi.URLParam(r, "table"), &table, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "table", Err: err})
+		return
+	}
+
+	// ------------- Path parameter "userID" -------------
+	var userID int
+
+	err = runtime.BindStyledParameterWithOptions("simple", "userID", chi.URLParam(r, "userID"), &userID, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "userID", Err: err})
+		return
+	}
+
+	// ------------- Path parameter "entryID" -------------
+	var entryID string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "entryID", chi.URLParam(r, "entryID"), &entryID, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "entryID", Err: err})
+		return
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PostAddDataTableUserIDEntryID(w, r, table, userID, entryID)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// GetApiAdminJobsRotation operation middleware
+func (siw *ServerInterfaceWrapper) GetApiAdminJobsRotation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeSession)
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetApiAdminJobsRotation(w, r)
+	}))
+
+	for _, middleware := range siw.AdminMiddlewares {
+		handler = middleware(handler)
+	}
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// GetApiAdminMonitors operation middleware
+func (siw *ServerInterfaceWrapper) GetApiAdminMonitors(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeSession)
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetApiAdminMonitors(w, r)
+	}))
+
+	for _, middleware := range siw.AdminMiddlewares {
+		handler = middleware(handler)
+	}
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// PostApiAdminMonitors operation middleware
+func (siw *ServerInterfaceWrapper) PostApiAdminMonitors(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeSession)
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PostApiAdminMonitors(w, r)
+	}))
+
+	for _, middleware := range siw.AdminMiddlewares {
+		handler = middleware(handler)
+	}
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// DeleteApiAdminMonitorsId operation middleware
+func (siw *ServerInterfaceWrapper) DeleteApiAdminMonitorsId(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeSession)
+
+	var err error
+
+	// ------------- Path parameter "id" -------------
+	var id int
+
+	err = runtime.BindStyledParameterWithOptions("simple", "id", chi.URLParam(r, "id"), &id, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
+		return
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.DeleteApiAdminMonitorsId(w, r, id)
+	}))
+
+	for _, middleware := range siw.AdminMiddlewares {
+		handler = middleware(handler)
+	}
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// GetApiAdminReplication operation middleware
+func (siw *ServerInterfaceWrapper) GetApiAdminReplication(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeSession)
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetApiAdminReplication(w, r)
+	}))
+
+	for _, middleware := range siw.AdminMiddlewares {
+		handler = middleware(handler)
+	}
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// GetApiAdminUsers operation middleware
+func (siw *ServerInterfaceWrapper) GetApiAdminUsers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeSession)
+
+	var err error
+
+	// Parameter object where we will unmarshal all parameters from the context
+	var params GetApiAdminUsersParams
+
+	// ------------- Optional query parameter "after" -------------
+
+	err = runtime.BindQueryParameter("form", true, false, "after", r.URL.Query(), &params.After)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "after", Err: err})
+		return
+	}
+
+	// ------------- Optional query parameter "limit" -------------
+
+	err = runtime.BindQueryParameter("form", true, false, "limit", r.URL.Query(), &params.Limit)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "limit", Err: err})
+		return
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetApiAdminUsers(w, r, params)
+	}))
+
+	for _, middleware := range siw.AdminMiddlewares {
+		handler = middleware(handler)
+	}
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// GetApiAdminUsersFlagged operation middleware
+func (siw *ServerInterfaceWrapper) GetApiAdminUsersFlagged(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeSession)
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetApiAdminUsersFlagged(w, r)
+	}))
+
+	for _, middleware := range siw.AdminMiddlewares {
+		handler = middleware(handler)
+	}
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// DeleteApiAdminUsersId operation middleware
+func (siw *ServerInterfaceWrapper) DeleteApiAdminUsersId(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeSession)
+
+	var err error
+
+	// ------------- Path parameter "id" -------------
+	var id int
+
+	err = runtime.BindStyledParameterWithOptions("simple", "id", chi.URLParam(r, "id"), &id, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
+		return
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.DeleteApiAdminUsersId(w, r, id)
+	}))
+
+	for _, middleware := range siw.AdminMiddlewares {
+		handler = middleware(handler)
+	}
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// PostApiAdminUsersIdDisable operation middleware
+func (siw *ServerInterfaceWrapper) PostApiAdminUsersIdDisable(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeSession)
+
+	var err error
+
+	// ------------- Path parameter "id" -------------
+	var id int
+
+	err = runtime.BindStyledParameterWithOptions("simple", "id", chi.URLParam(r, "id"), &id, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
+		return
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PostApiAdminUsersIdDisable(w, r, id)
+	}))
+
+	for _, middleware := range siw.AdminMiddlewares {
+		handler = middleware(handler)
+	}
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// PostApiAdminUsersIdEnable operation middleware
+func (siw *ServerInterfaceWrapper) PostApiAdminUsersIdEnable(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeSession)
+
+	var err error
+
+	// ------------- Path parameter "id" -------------
+	var id int
+
+	err = runtime.BindStyledParameterWithOptions("simple", "id", chi.URLParam(r, "id"), &id, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
+		return
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PostApiAdminUsersIdEnable(w, r, id)
+	}))
+
+	for _, middleware := range siw.AdminMiddlewares {
+		handler = middleware(handler)
+	}
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// GetApiAudit operation middleware
+func (siw *ServerInterfaceWrapper) GetApiAudit(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeRead)
+
+	var err error
+
+	// Parameter object where we will unmarshal all parameters from the context
+	var params GetApiAuditParams
+
+	// ------------- Optional query parameter "since" -------------
+
+	err = runtime.BindQueryParameter("form", true, false, "since", r.URL.Query(), &params.Since)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "since", Err: err})
+		return
+	}
+
+	// ------------- Optional query parameter "limit" -------------
+
+	err = runtime.BindQueryParameter("form", true, false, "limit", r.URL.Query(), &params.Limit)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "limit", Err: err})
+		return
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetApiAudit(w, r, params)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// GetApiDataPending operation middleware
+func (siw *ServerInterfaceWrapper) GetApiDataPending(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeRead)
+
+	var err error
+
+	// Parameter object where we will unmarshal all parameters from the context
+	var params GetApiDataPendingParams
+
+	// ------------- Optional query parameter "cursor" -------------
+
+	err = runtime.BindQueryParameter("form", true, false, "cursor", r.URL.Query(), &params.Cursor)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "cursor", Err: err})
+		return
+	}
+
+	// ------------- Optional query parameter "partial" -------------
+
+	err = runtime.BindQueryParameter("form", true, false, "partial", r.URL.Query(), &params.Partial)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "partial", Err: err})
+		return
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetApiDataPending(w, r, params)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// PostApiDataTagsRename operation middleware
+func (siw *ServerInterfaceWrapper) PostApiDataTagsRename(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeWrite)
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PostApiDataTagsRename(w, r)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// GetApiEvents operation middleware
+func (siw *ServerInterfaceWrapper) GetApiEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeRead)
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetApiEvents(w, r)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// GetApiExport operation middleware
+func (siw *ServerInterfaceWrapper) GetApiExport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeRead)
+
+	var err error
+
+	// Parameter object where we will unmarshal all parameters from the context
+	var params GetApiExportParams
+
+	// ------------- Optional query parameter "format" -------------
+
+	err = runtime.BindQueryParameter("form", true, false, "format", r.URL.Query(), &params.Format)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "format", Err: err})
+		return
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetApiExport(w, r, params)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// GetApiFilesIdContent operation middleware
+func (siw *ServerInterfaceWrapper) GetApiFilesIdContent(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeRead)
+
+	var err error
+
+	// ------------- Path parameter "id" -------------
+	var id string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "id", chi.URLParam(r, "id"), &id, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
+		return
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetApiFilesIdContent(w, r, id)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// PostApiFilesIdUpload operation middleware
+func (siw *ServerInterfaceWrapper) PostApiFilesIdUpload(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeWrite)
+
+	var err error
+
+	// ------------- Path parameter "id" -------------
+	var id string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "id", chi.URLParam(r, "id"), &id, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
+		return
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PostApiFilesIdUpload(w, r, id)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// DeleteApiFilesIdUploadUploadId operation middleware
+func (siw *ServerInterfaceWrapper) DeleteApiFilesIdUploadUploadId(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeWrite)
+
+	var err error
+
+	// ------------- Path parameter "id" -------------
+	var id string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "id", chi.URLParam(r, "id"), &id, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
+		return
+	}
+
+	// ------------- Path parameter "uploadId" -------------
+	var uploadId string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "uploadId", chi.URLParam(r, "uploadId"), &uploadId, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "uploadId", Err: err})
+		return
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.DeleteApiFilesIdUploadUploadId(w, r, id, uploadId)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// GetApiFilesIdUploadUploadId operation middleware
+func (siw *ServerInterfaceWrapper) GetApiFilesIdUploadUploadId(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeRead)
+
+	var err error
+
+	// ------------- Path parameter "id" -------------
+	var id string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "id", chi.URLParam(r, "id"), &id, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
+		return
+	}
+
+	// ------------- Path parameter "uploadId" -------------
+	var uploadId string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "uploadId", chi.URLParam(r, "uploadId"), &uploadId, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "uploadId", Err: err})
+		return
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetApiFilesIdUploadUploadId(w, r, id, uploadId)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// PostApiFilesIdUploadUploadIdCommit operation middleware
+func (siw *ServerInterfaceWrapper) PostApiFilesIdUploadUploadIdCommit(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeWrite)
+
+	var err error
+
+	// ------------- Path parameter "id" -------------
+	var id string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "id", chi.URLParam(r, "id"), &id, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
+		return
+	}
+
+	// ------------- Path parameter "uploadId" -------------
+	var uploadId string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "uploadId", chi.URLParam(r, "uploadId"), &uploadId, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "uploadId", Err: err})
+		return
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PostApiFilesIdUploadUploadIdCommit(w, r, id, uploadId)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// PutApiFilesIdUploadUploadIdChunk operation middleware
+func (siw *ServerInterfaceWrapper) PutApiFilesIdUploadUploadIdChunk(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeWrite)
+
+	var err error
+
+	// ------------- Path parameter "id" -------------
+	var id string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "id", chi.URLParam(r, "id"), &id, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
+		return
+	}
+
+	// ------------- Path parameter "uploadId" -------------
+	var uploadId string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "uploadId", chi.URLParam(r, "uploadId"), &uploadId, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "uploadId", Err: err})
+		return
+	}
+
+	// ------------- Path parameter "chunk" -------------
+	var chunk int
+
+	err = runtime.BindStyledParameterWithOptions("simple", "chunk", chi.URLParam(r, "chunk"), &chunk, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "chunk", Err: err})
+		return
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PutApiFilesIdUploadUploadIdChunk(w, r, id, uploadId, chunk)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// GetApiFolders operation middleware
+func (siw *ServerInterfaceWrapper) GetApiFolders(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeRead)
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetApiFolders(w, r)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// PostApiFolders operation middleware
+func (siw *ServerInterfaceWrapper) PostApiFolders(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeWrite)
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PostApiFolders(w, r)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// DeleteApiFoldersId operation middleware
+func (siw *ServerInterfaceWrapper) DeleteApiFoldersId(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeWrite)
+
+	var err error
+
+	// ------------- Path parameter "id" -------------
+	var id string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "id", chi.URLParam(r, "id"), &id, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
+		return
+	}
+
+	// Parameter object where we will unmarshal all parameters from the context
+	var params DeleteApiFoldersIdParams
+
+	// ------------- Optional query parameter "move_children" -------------
+
+	err = runtime.BindQueryParameter("form", true, false, "move_children", r.URL.Query(), &params.MoveChildren)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "move_children", Err: err})
+		return
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.DeleteApiFoldersId(w, r, id, params)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// PutApiFoldersId operation middleware
+func (siw *ServerInterfaceWrapper) PutApiFoldersId(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeWrite)
+
+	var err error
+
+	// ------------- Path parameter "id" -------------
+	var id string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "id", chi.URLParam(r, "id"), &id, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
+		return
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PutApiFoldersId(w, r, id)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// PostApiImport operation middleware
+func (siw *ServerInterfaceWrapper) PostApiImport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeWrite)
+
+	var err error
+
+	// Parameter object where we will unmarshal all parameters from the context
+	var params PostApiImportParams
+
+	// ------------- Optional query parameter "format" -------------
+
+	err = runtime.BindQueryParameter("form", true, false, "format", r.URL.Query(), &params.Format)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "format", Err: err})
+		return
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PostApiImport(w, r, params)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// GetApiMonitorPing operation middleware
+func (siw *ServerInterfaceWrapper) GetApiMonitorPing(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetApiMonitorPing(w, r)
+	}))
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// GetApiSearch operation middleware
+func (siw *ServerInterfaceWrapper) GetApiSearch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeRead)
+
+	var err error
+
+	// Parameter object where we will unmarshal all parameters from the context
+	var params GetApiSearchParams
+
+	// ------------- Required query parameter "q" -------------
+
+	if paramValue := r.URL.Query().Get("q"); paramValue != "" {
+
+	} else {
+		siw.ErrorHandlerFunc(w, r, &RequiredParamError{ParamName: "q"})
+		return
+	}
+
+	err = runtime.BindQueryParameter("form", true, true, "q", r.URL.Query(), &params.Q)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "q", Err: err})
+		return
+	}
+
+	// ------------- Optional query parameter "table" -------------
+
+	err = runtime.BindQueryParameter("form", true, false, "table", r.URL.Query(), &params.Table)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "table", Err: err})
+		return
+	}
+
+	// ------------- Optional query parameter "limit" -------------
+
+	err = runtime.BindQueryParameter("form", true, false, "limit", r.URL.Query(), &params.Limit)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "limit", Err: err})
+		return
+	}
+
+	// ------------- Optional query parameter "partial" -------------
+
+	err = runtime.BindQueryParameter("form", true, false, "partial", r.URL.Query(), &params.Partial)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "partial", Err: err})
+		return
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetApiSearch(w, r, params)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// GetApiShares operation middleware
+func (siw *ServerInterfaceWrapper) GetApiShares(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeRead)
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetApiShares(w, r)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// GetApiSshkeys operation middleware
+func (siw *ServerInterfaceWrapper) GetApiSshkeys(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeRead)
+
+	var err error
+
+	// Parameter object where we will unmarshal all parameters from the context
+	var params GetApiSshkeysParams
+
+	// ------------- Required query parameter "fingerprint" -------------
+
+	if paramValue := r.URL.Query().Get("fingerprint"); paramValue != "" {
+
+	} else {
+		siw.ErrorHandlerFunc(w, r, &RequiredParamError{ParamName: "fingerprint"})
+		return
+	}
+
+	err = runtime.BindQueryParameter("form", true, true, "fingerprint", r.URL.Query(), &params.Fingerprint)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "fingerprint", Err: err})
+		return
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetApiSshkeys(w, r, params)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// PostApiSync operation middleware
+func (siw *ServerInterfaceWrapper) PostApiSync(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeWrite)
+	ctx = context.WithValue(ctx, RoutePulls, true)
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PostApiSync(w, r)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// PostApiSyncPush operation middleware
+func (siw *ServerInterfaceWrapper) PostApiSyncPush(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeWrite)
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PostApiSyncPush(w, r)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// GetApiUserApikeys operation middleware
+func (siw *ServerInterfaceWrapper) GetApiUserApikeys(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeSession)
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetApiUserApikeys(w, r)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// PostApiUserApikeys operation middleware
+func (siw *ServerInterfaceWrapper) PostApiUserApikeys(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeSession)
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PostApiUserApikeys(w, r)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// DeleteApiUserApikeysId operation middleware
+func (siw *ServerInterfaceWrapper) DeleteApiUserApikeysId(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeSession)
+
+	var err error
+
+	// ------------- Path parameter "id" -------------
+	var id int
+
+	err = runtime.BindStyledParameterWithOptions("simple", "id", chi.URLParam(r, "id"), &id, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
+		return
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.DeleteApiUserApikeysId(w, r, id)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// GetApiUserDevices operation middleware
+func (siw *ServerInterfaceWrapper) GetApiUserDevices(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeRead)
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetApiUserDevices(w, r)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// DeleteApiUserDevicesDeviceID operation middleware
+func (siw *ServerInterfaceWrapper) DeleteApiUserDevicesDeviceID(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeSession)
+
+	var err error
+
+	// ------------- Path parameter "deviceID" -------------
+	var deviceID string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "deviceID", chi.URLParam(r, "deviceID"), &deviceID, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "deviceID", Err: err})
+		return
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.DeleteApiUserDevicesDeviceID(w, r, deviceID)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// GetApiUserEmail operation middleware
+func (siw *ServerInterfaceWrapper) GetApiUserEmail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeRead)
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetApiUserEmail(w, r)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// PutApiUserEmail operation middleware
+func (siw *ServerInterfaceWrapper) PutApiUserEmail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeSession)
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PutApiUserEmail(w, r)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// GetApiUserLanguage operation middleware
+func (siw *ServerInterfaceWrapper) GetApiUserLanguage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeRead)
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetApiUserLanguage(w, r)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// PutApiUserLanguage operation middleware
+func (siw *ServerInterfaceWrapper) PutApiUserLanguage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeSession)
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PutApiUserLanguage(w, r)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// GetApiUserLogins operation middleware
+func (siw *ServerInterfaceWrapper) GetApiUserLogins(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeRead)
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetApiUserLogins(w, r)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// PostApiUserLogout operation middleware
+func (siw *ServerInterfaceWrapper) PostApiUserLogout(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PostApiUserLogout(w, r)
+	}))
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// PostApiUserPassword operation middleware
+func (siw *ServerInterfaceWrapper) PostApiUserPassword(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeSession)
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PostApiUserPassword(w, r)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// PostApiUserReencrypt operation middleware
+func (siw *ServerInterfaceWrapper) PostApiUserReencrypt(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeSession)
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PostApiUserReencrypt(w, r)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// PutApiUserReencryptId operation middleware
+func (siw *ServerInterfaceWrapper) PutApiUserReencryptId(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeSession)
+
+	var err error
+
+	// ------------- Path parameter "id" -------------
+	var id string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "id", chi.URLParam(r, "id"), &id, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
+		return
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PutApiUserReencryptId(w, r, id)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// PostApiUserRefresh operation middleware
+func (siw *ServerInterfaceWrapper) PostApiUserRefresh(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PostApiUserRefresh(w, r)
+	}))
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// PostApiUserReset operation middleware
+func (siw *ServerInterfaceWrapper) PostApiUserReset(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PostApiUserReset(w, r)
+	}))
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// PostApiUserResetRequest operation middleware
+func (siw *ServerInterfaceWrapper) PostApiUserResetRequest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PostApiUserResetRequest(w, r)
+	}))
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// GetApiUserVerify operation middleware
+func (siw *ServerInterfaceWrapper) GetApiUserVerify(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var err error
+
+	// Parameter object where we will unmarshal all parameters from the context
+	var params GetApiUserVerifyParams
+
+	// ------------- Required query parameter "token" -------------
+
+	if paramValue := r.URL.Query().Get("token"); paramValue != "" {
+
+	} else {
+		siw.ErrorHandlerFunc(w, r, &RequiredParamError{ParamName: "token"})
+		return
+	}
+
+	err = runtime.BindQueryParameter("form", true, true, "token", r.URL.Query(), &params.Token)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "token", Err: err})
+		return
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetApiUserVerify(w, r, params)
+	}))
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// GetApiVaultChecksum operation middleware
+func (siw *ServerInterfaceWrapper) GetApiVaultChecksum(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeRead)
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetApiVaultChecksum(w, r)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// GetApiTable operation middleware
+func (siw *ServerInterfaceWrapper) GetApiTable(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeRead)
+
+	var err error
+
+	// ------------- Path parameter "table" -------------
+	var table string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "table", chi.URLParam(r, "table"), &table, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "table", Err: err})
+		return
+	}
+
+	// Parameter object where we will unmarshal all parameters from the context
+	var params GetApiTableParams
+
+	// ------------- Optional query parameter "tag" -------------
+
+	err = runtime.BindQueryParameter("form", true, false, "tag", r.URL.Query(), &params.Tag)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "tag", Err: err})
+		return
+	}
+
+	// ------------- Optional query parameter "folder" -------------
+
+	err = runtime.BindQueryParameter("form", true, false, "folder", r.URL.Query(), &params.Folder)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "folder", Err: err})
+		return
+	}
+
+	// ------------- Optional query parameter "include_expired" -------------
+
+	err = runtime.BindQueryParameter("form", true, false, "include_expired", r.URL.Query(), &params.IncludeExpired)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "include_expired", Err: err})
+		return
+	}
+
+	// ------------- Optional query parameter "columns" -------------
+
+	err = runtime.BindQueryParameter("form", false, false, "columns", r.URL.Query(), &params.Columns)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "columns", Err: err})
 		return
 	}
 
-	ctx := r.Context()
+	// ------------- Optional query parameter "sort" -------------
 
-	// Попытка получить хешированный пароль пользователя из локальной базы данных
-	hashedPassword, err := h.storage.GetPassword(ctx, requestBody.Username)
+	err = runtime.BindQueryParameter("form", true, false, "sort", r.URL.Query(), &params.Sort)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "sort", Err: err})
 		return
 	}
 
-	if h.authz.IsBcryptHash(requestBody.Password) {
-		if hashedPassword != requestBody.Password {
-			err := fmt.Errorf("Unauthorized")
-			http.Error(w, err.Error(), http.StatusUnauthorized)
-			return
-		}
-	} else {
-		// Сравнение хешированного пароля с хешем введенного пароля
-		if !h.authz.CompareHashAndPassword(hashedPassword, requestBody.Password) {
-			err := fmt.Errorf("Unauthorized")
-			http.Error(w, err.Error(), http.StatusUnauthorized)
-			return
-		}
-	}
+	// ------------- Optional query parameter "dir" -------------
 
-	userID, err := h.storage.GetUserID(ctx, requestBody.Username)
+	err = runtime.BindQueryParameter("form", true, false, "dir", r.URL.Query(), &params.Dir)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "dir", Err: err})
 		return
 	}
 
-	// Create a new JWT for the authenticated user
-	token := h.authz.CreateJWTTokenForUser(strconv.Itoa(userID))
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetApiTable(w, r, table, params)
+	}))
 
-	// Prepare the response
-	response := map[string]interface{}{
-		"userID": userID,
-		"token":  token,
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
 	}
 
-	// Convert the response to JSON
-	responseBytes, err := json.Marshal(response)
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// GetApiTableIdHistory operation middleware
+func (siw *ServerInterfaceWrapper) GetApiTableIdHistory(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeRead)
+
+	var err error
+
+	// ------------- Path parameter "table" -------------
+	var table string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "table", chi.URLParam(r, "table"), &table, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "table", Err: err})
 		return
 	}
 
-	// Send the JWT and userID to the client in the response
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(responseBytes)
-}
+	// ------------- Path parameter "id" -------------
+	var id string
 
-// (POST /register)
-func (h *BaseController) PostRegister(w http.ResponseWriter, r *http.Request) {
-	// Parse and decode the request body into a new 'PostRegisterJSONBody' value
-	var requestBody PostRegisterJSONBody
-	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	err = runtime.BindStyledParameterWithOptions("simple", "id", chi.URLParam(r, "id"), &id, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
 		return
 	}
 
-	// Call the 'AddUser' method with the username and password from the request body
-	err = h.storage.AddUser(r.Context(), requestBody.Username, requestBody.Password)
+	// Parameter object where we will unmarshal all parameters from the context
+	var params GetApiTableIdHistoryParams
+
+	// ------------- Optional query parameter "limit" -------------
+
+	err = runtime.BindQueryParameter("form", true, false, "limit", r.URL.Query(), &params.Limit)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "limit", Err: err})
 		return
 	}
 
-	// If everything goes well, respond with a status of '200 OK'
-	w.WriteHeader(http.StatusOK)
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.GetApiTableIdHistory(w, r, table, id, params)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
 }
 
-// (POST /sendFile/{userID})
-// (POST /sendFile/{userID})
-func (h *BaseController) PostSendFileUserID(w http.ResponseWriter, r *http.Request, userID int, fileName string) {
-	// Чтение файла из тела запроса
-	file, err := io.ReadAll(r.Body)
+// PostApiTableIdRestore operation middleware
+func (siw *ServerInterfaceWrapper) PostApiTableIdRestore(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeWrite)
+
+	var err error
+
+	// ------------- Path parameter "table" -------------
+	var table string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "table", chi.URLParam(r, "table"), &table, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
 	if err != nil {
-		http.Error(w, "Ошибка при чтении файла", http.StatusInternalServerError)
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "table", Err: err})
 		return
 	}
-	defer r.Body.Close()
 
-	// Сохранение файла на сервере
-	path := filepath.Join(h.options.FileStoragePath(), fileName)
-	err = os.WriteFile(path, file, 0644)
+	// ------------- Path parameter "id" -------------
+	var id string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "id", chi.URLParam(r, "id"), &id, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
 	if err != nil {
-		http.Error(w, "Ошибка при сохранении файла", http.StatusInternalServerError)
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
 		return
 	}
 
-	// Отправка ответа
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "Файл успешно сохранен")
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PostApiTableIdRestore(w, r, table, id)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
 }
 
-// (PUT /updateData/{table}/{userID}/{entryID})
-func (h *BaseController) PutUpdateDataTableUserIDEntryID(w http.ResponseWriter, r *http.Request, table string, userID int, entryID string) {
-	// Parse and decode the request body into a new 'map[string]string' value
-	var requestBody map[string]string
-	err := json.NewDecoder(r.Body).Decode(&requestBody)
+// PostApiTableIdShares operation middleware
+func (siw *ServerInterfaceWrapper) PostApiTableIdShares(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeWrite)
+
+	var err error
+
+	// ------------- Path parameter "table" -------------
+	var table string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "table", chi.URLParam(r, "table"), &table, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "table", Err: err})
 		return
 	}
 
-	// Call the 'UpdateData' method with the userID, table, entryID, and data from the request body
-	err = h.storage.UpdateData(r.Context(), table, userID, entryID, requestBody)
+	// ------------- Path parameter "id" -------------
+	var id string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "id", chi.URLParam(r, "id"), &id, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
 		return
 	}
 
-	// If everything goes well, respond with a status of 'OK'
-	w.WriteHeader(http.StatusOK)
-}
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PostApiTableIdShares(w, r, table, id)
+	}))
 
-// ServerInterfaceWrapper converts contexts to parameters.
-type ServerInterfaceWrapper struct {
-	Handler            ServerInterface
-	HandlerMiddlewares []MiddlewareFunc
-	ErrorHandlerFunc   func(w http.ResponseWriter, r *http.Request, err error)
-}
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
 
-type MiddlewareFunc func(http.Handler) http.Handler
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
 
-// PostAddDataTableUserIDEntryID operation middleware
-func (siw *ServerInterfaceWrapper) PostAddDataTableUserIDEntryID(w http.ResponseWriter, r *http.Request) {
+// DeleteApiTableIdSharesGrantee operation middleware
+func (siw *ServerInterfaceWrapper) DeleteApiTableIdSharesGrantee(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeWrite)
+
 	var err error
 
 	// ------------- Path parameter "table" -------------
@@ -414,26 +3786,26 @@ func (siw *ServerInterfaceWrapper) PostAddDataTableUserIDEntryID(w http.Response
 		return
 	}
 
-	// ------------- Path parameter "userID" -------------
-	var userID int
+	// ------------- Path parameter "id" -------------
+	var id string
 
-	err = runtime.BindStyledParameterWithOptions("simple", "userID", chi.URLParam(r, "userID"), &userID, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	err = runtime.BindStyledParameterWithOptions("simple", "id", chi.URLParam(r, "id"), &id, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
 	if err != nil {
-		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "userID", Err: err})
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
 		return
 	}
 
-	// ------------- Path parameter "entryID" -------------
-	var entryID string
+	// ------------- Path parameter "grantee" -------------
+	var grantee string
 
-	err = runtime.BindStyledParameterWithOptions("simple", "entryID", chi.URLParam(r, "entryID"), &entryID, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
+	err = runtime.BindStyledParameterWithOptions("simple", "grantee", chi.URLParam(r, "grantee"), &grantee, runtime.BindStyledParameterOptions{ParamLocation: runtime.ParamLocationPath, Explode: false, Required: true})
 	if err != nil {
-		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "entryID", Err: err})
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "grantee", Err: err})
 		return
 	}
 
 	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		siw.Handler.PostAddDataTableUserIDEntryID(w, r, table, userID, entryID)
+		siw.Handler.DeleteApiTableIdSharesGrantee(w, r, table, id, grantee)
 	}))
 
 	for _, middleware := range siw.HandlerMiddlewares {
@@ -447,6 +3819,8 @@ func (siw *ServerInterfaceWrapper) PostAddDataTableUserIDEntryID(w http.Response
 func (siw *ServerInterfaceWrapper) DeleteDeleteDataTableUserIDEntryID(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeWrite)
+
 	var err error
 
 	// ------------- Path parameter "table" -------------
@@ -491,6 +3865,8 @@ func (siw *ServerInterfaceWrapper) DeleteDeleteDataTableUserIDEntryID(w http.Res
 func (siw *ServerInterfaceWrapper) GetGetAllDataTableUserID(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeRead)
+
 	var err error
 
 	// ------------- Path parameter "table" -------------
@@ -535,6 +3911,8 @@ func (siw *ServerInterfaceWrapper) GetGetAllDataTableUserID(w http.ResponseWrite
 func (siw *ServerInterfaceWrapper) GetGetDataTableUserIDEntryID(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeRead)
+
 	var err error
 
 	// ------------- Path parameter "table" -------------
@@ -579,6 +3957,8 @@ func (siw *ServerInterfaceWrapper) GetGetDataTableUserIDEntryID(w http.ResponseW
 func (siw *ServerInterfaceWrapper) GetGetFileUserIDEntryID(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeRead)
+
 	var err error
 
 	// ------------- Path parameter "userID" -------------
@@ -614,6 +3994,8 @@ func (siw *ServerInterfaceWrapper) GetGetFileUserIDEntryID(w http.ResponseWriter
 func (siw *ServerInterfaceWrapper) GetGetPasswordUsername(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeSession)
+
 	var err error
 
 	// ------------- Path parameter "username" -------------
@@ -684,6 +4066,8 @@ func (siw *ServerInterfaceWrapper) PostRegister(w http.ResponseWriter, r *http.R
 func (siw *ServerInterfaceWrapper) PostSendFileUserID(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeWrite)
+
 	var err error
 
 	// ------------- Path parameter "userID" -------------
@@ -719,6 +4103,8 @@ func (siw *ServerInterfaceWrapper) PostSendFileUserID(w http.ResponseWriter, r *
 func (siw *ServerInterfaceWrapper) PutUpdateDataTableUserIDEntryID(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
+	ctx = context.WithValue(ctx, RouteScope, models.ScopeWrite)
+
 	var err error
 
 	// ------------- Path parameter "table" -------------
@@ -837,6 +4223,7 @@ type ChiServerOptions struct {
 	BaseURL          string
 	BaseRouter       chi.Router
 	Middlewares      []MiddlewareFunc
+	AdminMiddlewares []MiddlewareFunc
 	ErrorHandlerFunc func(w http.ResponseWriter, r *http.Request, err error)
 }
 
@@ -869,12 +4256,184 @@ func HandlerWithOptions(si ServerInterface, options ChiServerOptions) http.Handl
 	wrapper := ServerInterfaceWrapper{
 		Handler:            si,
 		HandlerMiddlewares: options.Middlewares,
+		AdminMiddlewares:   options.AdminMiddlewares,
 		ErrorHandlerFunc:   options.ErrorHandlerFunc,
 	}
 
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/addData/{table}/{userID}", wrapper.PostAddDataTableUserID)
+	})
 	r.Group(func(r chi.Router) {
 		r.Post(options.BaseURL+"/addData/{table}/{userID}/{entryID}", wrapper.PostAddDataTableUserIDEntryID)
 	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/admin/jobs/rotation", wrapper.GetApiAdminJobsRotation)
+	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/admin/monitors", wrapper.GetApiAdminMonitors)
+	})
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/api/admin/monitors", wrapper.PostApiAdminMonitors)
+	})
+	r.Group(func(r chi.Router) {
+		r.Delete(options.BaseURL+"/api/admin/monitors/{id}", wrapper.DeleteApiAdminMonitorsId)
+	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/admin/replication", wrapper.GetApiAdminReplication)
+	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/admin/users", wrapper.GetApiAdminUsers)
+	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/admin/users/flagged", wrapper.GetApiAdminUsersFlagged)
+	})
+	r.Group(func(r chi.Router) {
+		r.Delete(options.BaseURL+"/api/admin/users/{id}", wrapper.DeleteApiAdminUsersId)
+	})
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/api/admin/users/{id}/disable", wrapper.PostApiAdminUsersIdDisable)
+	})
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/api/admin/users/{id}/enable", wrapper.PostApiAdminUsersIdEnable)
+	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/audit", wrapper.GetApiAudit)
+	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/data/pending", wrapper.GetApiDataPending)
+	})
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/api/data/tags/rename", wrapper.PostApiDataTagsRename)
+	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/events", wrapper.GetApiEvents)
+	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/export", wrapper.GetApiExport)
+	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/files/{id}/content", wrapper.GetApiFilesIdContent)
+	})
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/api/files/{id}/upload", wrapper.PostApiFilesIdUpload)
+	})
+	r.Group(func(r chi.Router) {
+		r.Delete(options.BaseURL+"/api/files/{id}/upload/{uploadId}", wrapper.DeleteApiFilesIdUploadUploadId)
+	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/files/{id}/upload/{uploadId}", wrapper.GetApiFilesIdUploadUploadId)
+	})
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/api/files/{id}/upload/{uploadId}/commit", wrapper.PostApiFilesIdUploadUploadIdCommit)
+	})
+	r.Group(func(r chi.Router) {
+		r.Put(options.BaseURL+"/api/files/{id}/upload/{uploadId}/{chunk}", wrapper.PutApiFilesIdUploadUploadIdChunk)
+	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/folders", wrapper.GetApiFolders)
+	})
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/api/folders", wrapper.PostApiFolders)
+	})
+	r.Group(func(r chi.Router) {
+		r.Delete(options.BaseURL+"/api/folders/{id}", wrapper.DeleteApiFoldersId)
+	})
+	r.Group(func(r chi.Router) {
+		r.Put(options.BaseURL+"/api/folders/{id}", wrapper.PutApiFoldersId)
+	})
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/api/import", wrapper.PostApiImport)
+	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/monitor/ping", wrapper.GetApiMonitorPing)
+	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/search", wrapper.GetApiSearch)
+	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/shares", wrapper.GetApiShares)
+	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/sshkeys", wrapper.GetApiSshkeys)
+	})
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/api/sync", wrapper.PostApiSync)
+	})
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/api/sync/push", wrapper.PostApiSyncPush)
+	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/user/apikeys", wrapper.GetApiUserApikeys)
+	})
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/api/user/apikeys", wrapper.PostApiUserApikeys)
+	})
+	r.Group(func(r chi.Router) {
+		r.Delete(options.BaseURL+"/api/user/apikeys/{id}", wrapper.DeleteApiUserApikeysId)
+	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/user/devices", wrapper.GetApiUserDevices)
+	})
+	r.Group(func(r chi.Router) {
+		r.Delete(options.BaseURL+"/api/user/devices/{deviceID}", wrapper.DeleteApiUserDevicesDeviceID)
+	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/user/email", wrapper.GetApiUserEmail)
+	})
+	r.Group(func(r chi.Router) {
+		r.Put(options.BaseURL+"/api/user/email", wrapper.PutApiUserEmail)
+	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/user/language", wrapper.GetApiUserLanguage)
+	})
+	r.Group(func(r chi.Router) {
+		r.Put(options.BaseURL+"/api/user/language", wrapper.PutApiUserLanguage)
+	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/user/logins", wrapper.GetApiUserLogins)
+	})
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/api/user/logout", wrapper.PostApiUserLogout)
+	})
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/api/user/password", wrapper.PostApiUserPassword)
+	})
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/api/user/reencrypt", wrapper.PostApiUserReencrypt)
+	})
+	r.Group(func(r chi.Router) {
+		r.Put(options.BaseURL+"/api/user/reencrypt/{id}", wrapper.PutApiUserReencryptId)
+	})
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/api/user/refresh", wrapper.PostApiUserRefresh)
+	})
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/api/user/reset", wrapper.PostApiUserReset)
+	})
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/api/user/reset/request", wrapper.PostApiUserResetRequest)
+	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/user/verify", wrapper.GetApiUserVerify)
+	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/vault/checksum", wrapper.GetApiVaultChecksum)
+	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/{table}", wrapper.GetApiTable)
+	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/{table}/{id}/history", wrapper.GetApiTableIdHistory)
+	})
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/api/{table}/{id}/restore", wrapper.PostApiTableIdRestore)
+	})
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/api/{table}/{id}/shares", wrapper.PostApiTableIdShares)
+	})
+	r.Group(func(r chi.Router) {
+		r.Delete(options.BaseURL+"/api/{table}/{id}/shares/{grantee}", wrapper.DeleteApiTableIdSharesGrantee)
+	})
 	r.Group(func(r chi.Router) {
 		r.Delete(options.BaseURL+"/deleteData/{table}/{userID}/{entryID}", wrapper.DeleteDeleteDataTableUserIDEntryID)
 	})
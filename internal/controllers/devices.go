@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"go.uber.org/zap"
+)
+
+// DeviceIDHeader carries the id of the device synchronizing, the one its refresh token was issued for.
+// The synchronization checkpoint is kept for the device, a request without it keeps none.
+const DeviceIDHeader = "X-Device-ID"
+
+// errUnknownDevice is the response to a device id which isn't registered, or was revoked.
+var errUnknownDevice = errors.New("the device is not registered, log in again")
+
+// registerDevice registers the device the tokens are issued for, a failure doesn't fail the login.
+func (h *BaseController) registerDevice(ctx context.Context, userID int, deviceID, name string) {
+	if err := h.storage.RegisterDevice(ctx, userID, deviceID, name); err != nil {
+		h.log.Warn("failed to register device", zap.Int("userID", userID), zap.String("deviceID", deviceID), zap.Error(err))
+	}
+}
+
+// syncDevice marks the device of the header as seen and returns its id, empty without the header.
+// It responds and returns false if the device isn't registered to the user.
+func (h *BaseController) syncDevice(w http.ResponseWriter, r *http.Request, userID int) (string, bool) {
+	deviceID := r.Header.Get(DeviceIDHeader)
+	if deviceID == "" {
+		return "", true
+	}
+
+	err := h.storage.TouchDevice(r.Context(), userID, deviceID)
+	if errors.Is(err, models.ErrNotFound) {
+		http.Error(w, errUnknownDevice.Error(), http.StatusUnauthorized)
+		return "", false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return "", false
+	}
+
+	return deviceID, true
+}
+
+// syncCheckpoint returns the checkpoint reached by a pull since lastSync: the latest update of the entries
+// pulled, or lastSync if none changed.
+func syncCheckpoint(data []map[string]string, lastSync time.Time) time.Time {
+	checkpoint := lastSync
+	for _, row := range data {
+		if at, err := time.Parse(time.RFC3339Nano, row["updated_at"]); err == nil && at.After(checkpoint) {
+			checkpoint = at
+		}
+	}
+
+	return checkpoint
+}
+
+// (GET /api/user/devices)
+func (h *BaseController) GetApiUserDevices(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// The devices of the user from the token, the most recently seen first
+	devices, err := h.storage.GetDevices(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, devices)
+}
+
+// (DELETE /api/user/devices/{deviceID})
+func (h *BaseController) DeleteApiUserDevicesDeviceID(w http.ResponseWriter, r *http.Request, deviceID string) {
+	ctx := r.Context()
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// The refresh tokens of the device are revoked with it, its access token lasts until it expires
+	err = h.storage.RevokeDevice(ctx, userID, deviceID)
+	if errors.Is(err, models.ErrNotFound) {
+		writeNotFound(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = h.storage.AddAuditEvent(ctx, models.AuditEvent{UserID: userID, Action: models.AuditRevokeDevice, EntryID: deviceID, Success: true})
+	if err != nil {
+		h.log.Warn("failed to write audit event", zap.String("action", string(models.AuditRevokeDevice)), zap.Error(err))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,335 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/egress"
+	"github.com/wurt83ow/gophkeeper-server/internal/mail"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"go.uber.org/zap"
+)
+
+// Mailer represents an interface for sending the notifications of the accounts, rendered in the language
+// of the user.
+type Mailer interface {
+	Notify(ctx context.Context, to, language string, n mail.Notification) error
+}
+
+// SetMailer sets the mailer notifying the verification and reset tokens. Without one, emails can't be set
+// and the reset requests are ignored.
+func (h *BaseController) SetMailer(mailer Mailer) {
+	h.mailer = mailer
+}
+
+// resetNotice is returned with the reset of a password: the server only knows the password of the account,
+// the entries encrypted on the clients stay encrypted with the keys derived from the old one.
+const resetNotice = "the password is reset, log in again; entries encrypted on the clients with the old password " +
+	"can't be decrypted by the server and are not recovered"
+
+// errMailUnavailable is the response to setting an email when the server sends no mail.
+var errMailUnavailable = errors.New("the server doesn't send mail")
+
+// errInvalidEmailToken is the response to a token which is unknown, used or expired, whatever the case.
+var errInvalidEmailToken = errors.New("the token is invalid or has expired")
+
+// sendEmailToken creates a token of the purpose for the email of the user and mails it in the language.
+func (h *BaseController) sendEmailToken(ctx context.Context, userID int, email, language, purpose string, ttl time.Duration) error {
+	// The tokens are random and stored hashed, as the refresh tokens are
+	token, err := h.authz.NewRefreshToken()
+	if err != nil {
+		return err
+	}
+	err = h.storage.CreateEmailToken(ctx, models.EmailToken{
+		Hash:      h.authz.HashRefreshToken(token),
+		UserID:    userID,
+		Purpose:   purpose,
+		Email:     email,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return err
+	}
+
+	var n mail.Notification
+	switch purpose {
+	case models.EmailTokenVerify:
+		n = mail.VerifyEmail{Token: token, TTL: ttl}
+	case models.EmailTokenReset:
+		n = mail.ResetPassword{Token: token, TTL: ttl}
+	}
+
+	return h.mailer.Notify(ctx, email, language, n)
+}
+
+// (GET /api/user/email)
+func (h *BaseController) GetApiUserEmail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	email, err := h.storage.GetUserEmail(ctx, userID)
+	if errors.Is(err, models.ErrNotFound) {
+		writeNotFound(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, email)
+}
+
+// (PUT /api/user/email)
+func (h *BaseController) PutApiUserEmail(w http.ResponseWriter, r *http.Request) {
+	var requestBody PutApiUserEmailJSONRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// An empty email clears it
+	var email string
+	if strings.TrimSpace(requestBody.Email) != "" {
+		var err error
+		if email, err = models.ParseEmail(requestBody.Email); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	// An email that can't be verified would never reset the password
+	if email != "" && h.mailer == nil {
+		http.Error(w, errMailUnavailable.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx := r.Context()
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	err = h.storage.SetUserEmail(ctx, userID, email)
+	if errors.Is(err, models.ErrEmailTaken) {
+		h.auditAuth(ctx, models.AuditEmailChange, userID, false)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, models.ErrNotFound) {
+		writeNotFound(w)
+		return
+	}
+	if err != nil {
+		h.auditAuth(ctx, models.AuditEmailChange, userID, false)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.auditAuth(ctx, models.AuditEmailChange, userID, true)
+
+	if email == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// The email is set even if the mail fails, the user sets it again to get a new token
+	user, err := h.storage.GetUserEmail(ctx, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := h.sendEmailToken(ctx, userID, email, user.Language, models.EmailTokenVerify, h.options.VerifyTokenTTL()); err != nil {
+		h.log.Warn("failed to send verification email", zap.Int("userID", userID), zap.Error(err), egress.Field(err))
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// (GET /api/user/language)
+func (h *BaseController) GetApiUserLanguage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.storage.GetUserEmail(ctx, userID)
+	if errors.Is(err, models.ErrNotFound) {
+		writeNotFound(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, PutApiUserLanguageJSONBody{Language: user.Language})
+}
+
+// (PUT /api/user/language)
+func (h *BaseController) PutApiUserLanguage(w http.ResponseWriter, r *http.Request) {
+	var requestBody PutApiUserLanguageJSONRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// An empty language clears it, the emails are then in the default language of the server
+	language, err := models.ParseLanguage(requestBody.Language)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	err = h.storage.SetUserLanguage(ctx, userID, language)
+	if errors.Is(err, models.ErrNotFound) {
+		writeNotFound(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, PutApiUserLanguageJSONBody{Language: language})
+}
+
+// (GET /api/user/verify)
+func (h *BaseController) GetApiUserVerify(w http.ResponseWriter, r *http.Request, params GetApiUserVerifyParams) {
+	ctx := r.Context()
+	token, err := h.storage.ConsumeEmailToken(ctx, h.authz.HashRefreshToken(params.Token), models.EmailTokenVerify)
+	if errors.Is(err, models.ErrNotFound) {
+		h.auditAuth(ctx, models.AuditEmailVerify, 0, false)
+		http.Error(w, errInvalidEmailToken.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The email may have changed since the token was mailed
+	err = h.storage.VerifyUserEmail(ctx, token.UserID, token.Email)
+	if errors.Is(err, models.ErrNotFound) {
+		h.auditAuth(ctx, models.AuditEmailVerify, token.UserID, false)
+		http.Error(w, errInvalidEmailToken.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.auditAuth(ctx, models.AuditEmailVerify, token.UserID, true)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// (POST /api/user/reset/request)
+func (h *BaseController) PostApiUserResetRequest(w http.ResponseWriter, r *http.Request) {
+	var requestBody PostApiUserResetRequestJSONRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	email, err := models.ParseEmail(requestBody.Email)
+	if err != nil || email == "" {
+		http.Error(w, "the email is invalid", http.StatusBadRequest)
+		return
+	}
+
+	// The response is the same whether an account has the email or not, so the accounts can't be found
+	// by their email. Only a verified email gets the token.
+	ctx := r.Context()
+	user, err := h.storage.FindUserByEmail(ctx, email)
+	if err == nil && user.Verified && h.mailer != nil {
+		if err := h.sendEmailToken(ctx, user.UserID, email, user.Language, models.EmailTokenReset, h.options.ResetTokenTTL()); err != nil {
+			h.log.Warn("failed to send reset email", zap.Int("userID", user.UserID), zap.Error(err), egress.Field(err))
+		}
+	} else if err != nil && !errors.Is(err, models.ErrNotFound) {
+		h.log.Warn("failed to find user by email", zap.Error(err))
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// (POST /api/user/reset)
+func (h *BaseController) PostApiUserReset(w http.ResponseWriter, r *http.Request) {
+	var requestBody PostApiUserResetJSONRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if requestBody.NewPassword == "" {
+		http.Error(w, "new password is empty", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	token, err := h.storage.ConsumeEmailToken(ctx, h.authz.HashRefreshToken(requestBody.Token), models.EmailTokenReset)
+	if errors.Is(err, models.ErrNotFound) {
+		h.auditAuth(ctx, models.AuditPasswordReset, 0, false)
+		http.Error(w, errInvalidEmailToken.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The token is void if the email was changed or cleared after it was mailed
+	user, err := h.storage.GetUserEmail(ctx, token.UserID)
+	if errors.Is(err, models.ErrNotFound) || (err == nil && (user.Email != token.Email || !user.Verified)) {
+		h.auditAuth(ctx, models.AuditPasswordReset, token.UserID, false)
+		http.Error(w, errInvalidEmailToken.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The token is used, a weak password needs a new one
+	newHash := requestBody.NewPassword
+	if violations := h.authz.CheckPassword(user.Username, newHash); len(violations) > 0 {
+		h.auditAuth(ctx, models.AuditPasswordReset, user.UserID, false)
+		writeWeakPassword(w, violations)
+		return
+	}
+	if !h.authz.HashedPassword(newHash) {
+		if newHash, err = h.authz.HashPassword(newHash); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// The new password ends every session, the user logs in again
+	err = h.storage.UpdatePassword(ctx, user.UserID, newHash)
+	if errors.Is(err, models.ErrNotFound) {
+		http.Error(w, errInvalidEmailToken.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		h.auditAuth(ctx, models.AuditPasswordReset, user.UserID, false)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.auditAuth(ctx, models.AuditPasswordReset, user.UserID, true)
+
+	writeJSON(w, map[string]interface{}{"userID": user.UserID, "notice": resetNotice})
+}
@@ -0,0 +1,49 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"go.uber.org/zap"
+)
+
+// dataETag returns the ETag of the entries of a user at the version. It is weak, the response
+// may be compressed or not, and the same for every list of the user at the version.
+func dataETag(version models.DataVersion) string {
+	return fmt.Sprintf(`W/"%x-%d-%d"`, version.UpdatedAt.UnixNano(), version.Entries, version.Expired)
+}
+
+// etagMatches reports whether the If-None-Match header holds the ETag, the weak comparison of RFC 9110.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// notModified sets the ETag of the current version of the user's entries and responds 304 if the client
+// has it already, so the entries aren't read. The version is read before the entries, a change in between
+// only labels the newer entries with the older ETag, which the next request doesn't match.
+// A failed version read skips the ETag, the entries are read as without it.
+func (h *BaseController) notModified(w http.ResponseWriter, r *http.Request, userID int) bool {
+	version, err := h.storage.GetUserDataVersion(r.Context(), userID)
+	if err != nil {
+		h.log.Warn("failed to get the data version", zap.Int("userID", userID), zap.Error(err))
+		return false
+	}
+
+	etag := dataETag(version)
+	w.Header().Set("ETag", etag)
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,103 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"go.uber.org/zap"
+)
+
+// eventsHeartbeat is the interval of the comments sent on an idle event stream,
+// so the proxies don't close it and the clients notice a dead one.
+const eventsHeartbeat = 25 * time.Second
+
+// Events delivers the changes made to the vault of a user to the event streams of the other sessions, see SetEvents.
+type Events interface {
+	// Publish delivers the changes made by the session of the device to the other sessions of the user.
+	Publish(ctx context.Context, userID int, deviceID string, events []models.VaultEvent)
+	// Subscribe returns the changes made by the other sessions of the user until cancel is called
+	// or the server shuts down, which closes the channel.
+	Subscribe(userID int, deviceID string) (events <-chan models.VaultEvent, cancel func())
+}
+
+// SetEvents sets the broker the changes are published to, the event streams aren't served without one.
+func (h *BaseController) SetEvents(events Events) {
+	h.events = events
+}
+
+// publish tells the other sessions of the user of the changes made by the request.
+// The session is the device of the header, a request without it is told apart from no session.
+func (h *BaseController) publish(r *http.Request, userID int, events ...models.VaultEvent) {
+	if h.events != nil {
+		h.events.Publish(r.Context(), userID, r.Header.Get(DeviceIDHeader), events)
+	}
+}
+
+// (GET /api/events)
+func (h *BaseController) GetApiEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if h.events == nil {
+		writeNotFound(w)
+		return
+	}
+
+	// The changes of the session itself aren't sent back to it
+	deviceID, ok := h.syncDevice(w, r, userID)
+	if !ok {
+		return
+	}
+
+	// The stream is held open past the write timeout of the server
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	events, cancel := h.events.Subscribe(userID, deviceID)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+
+	// The stream opens with a heartbeat, the client knows it is subscribed
+	_, err = fmt.Fprint(w, ": heartbeat\n\n")
+	for err == nil {
+		if err = rc.Flush(); err != nil {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		case ev, ok := <-events:
+			if !ok {
+				// The server shuts down, the client reconnects to another instance or once it is back
+				return
+			}
+			var data []byte
+			if data, err = json.Marshal(ev); err == nil {
+				_, err = fmt.Fprintf(w, "event: change\ndata: %s\n\n", data)
+			}
+		}
+	}
+
+	h.log.Info("event stream ended", zap.Int("user_id", userID), zap.Error(err))
+}
@@ -0,0 +1,242 @@
+package controllers
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"go.uber.org/zap"
+)
+
+// exportSchemaVersion is the version of the export document, raised with every change a reader of the
+// older ones would misread. The document is an object with the version as "schema_version", the time
+// of the export as "exported_at", the folders as "folders" and the entries as "tables", an array of them
+// per data table. An entry has its fields as stored, its metainfo, tags, folder_id and timestamps included,
+// but neither its user nor its deleted flag, only the entries and the folders which aren't deleted are
+// exported. Version 1 had no folders.
+const exportSchemaVersion = 2
+
+// exportFolder is a folder of the user in the export document, named by the folder_id of its entries
+// and the parent_id of its subfolders.
+type exportFolder struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	ParentID string `json:"parent_id,omitempty"`
+}
+
+// Export formats, the JSON document alone or a ZIP archive of the document and the files.
+const (
+	exportJSON = "json"
+	exportZip  = "zip"
+)
+
+// exportDocument is the name of the document in the ZIP archive, whose files are under exportFilesDir.
+const (
+	exportDocument = "vault.json"
+	exportFilesDir = "files/"
+)
+
+// exportFileField is the field of an entry of models.FilesTable naming its file in the ZIP archive.
+// An entry whose file isn't stored has none.
+const exportFileField = "export_file"
+
+// (GET /api/export)
+func (h *BaseController) GetApiExport(w http.ResponseWriter, r *http.Request, params GetApiExportParams) {
+	ctx := r.Context()
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	format := exportJSON
+	if params.Format != nil {
+		format = *params.Format
+	}
+	if format != exportJSON && format != exportZip {
+		http.Error(w, fmt.Sprintf("unknown export format %q, use %s or %s", format, exportJSON, exportZip), http.StatusBadRequest)
+		return
+	}
+
+	// A large vault takes longer to send than the write timeout of the server
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	name := "gophkeeper-export-" + time.Now().UTC().Format("20060102-150405")
+	w.Header().Set("Cache-Control", "no-store")
+	if format == exportZip {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, name))
+		err = h.writeExportZip(ctx, w, userID)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.json"`, name))
+		bw := bufio.NewWriter(w)
+		if err = h.writeExport(ctx, bw, userID, nil); err == nil {
+			err = bw.Flush()
+		}
+	}
+
+	// The export is recorded even if the client went away, with the context of the request cancelled
+	auditErr := h.storage.AddAuditEvent(context.WithoutCancel(ctx), models.AuditEvent{
+		UserID:  userID,
+		Action:  models.AuditExport,
+		Detail:  format,
+		Success: err == nil,
+	})
+	if auditErr != nil {
+		h.log.Warn("failed to write audit event", zap.String("action", string(models.AuditExport)), zap.Error(auditErr))
+	}
+	if err != nil {
+		// The status is sent already, the connection is dropped so the client doesn't take
+		// the truncated document for a complete one
+		h.log.Warn("failed to export vault", zap.Int("user_id", userID), zap.String("format", format), zap.Error(err))
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// writeExport writes the export document of the folders and the entries of the user to w. The entries are read
+// from the storage and written one at a time, so the vault isn't held in memory. visit is called with each entry
+// before it is written, if it isn't nil, and may add fields to it.
+func (h *BaseController) writeExport(ctx context.Context, w io.Writer, userID int, visit func(table string, entry map[string]string) error) error {
+	header, err := json.Marshal(struct {
+		SchemaVersion int       `json:"schema_version"`
+		ExportedAt    time.Time `json:"exported_at"`
+	}{exportSchemaVersion, time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+
+	// The folders are before the tables, so a reader has them before the entries filed in them
+	folders, err := h.storage.GetFolders(ctx, userID, time.Time{})
+	if err != nil {
+		return fmt.Errorf("failed to export folders: %w", err)
+	}
+	exported := make([]exportFolder, len(folders))
+	for i, f := range folders {
+		exported[i] = exportFolder{ID: f.ID, Name: f.Name, ParentID: f.ParentID}
+	}
+	list, err := json.Marshal(exported)
+	if err != nil {
+		return err
+	}
+
+	// The header is left open for the tables
+	if _, err := fmt.Fprintf(w, `%s,"folders":%s,"tables":{`, header[:len(header)-1], list); err != nil {
+		return err
+	}
+	for i, table := range models.DataTables {
+		sep := ","
+		if i == 0 {
+			sep = ""
+		}
+		if _, err := fmt.Fprintf(w, `%s"%s":[`, sep, table); err != nil {
+			return err
+		}
+
+		entries := 0
+		err := h.storage.ExportData(ctx, table, userID, func(entry map[string]string) error {
+			delete(entry, "user_id")
+			delete(entry, "deleted")
+			if visit != nil {
+				if err := visit(table, entry); err != nil {
+					return err
+				}
+			}
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if entries > 0 {
+				if _, err := io.WriteString(w, ","); err != nil {
+					return err
+				}
+			}
+			entries++
+			_, err = w.Write(data)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to export %s: %w", table, err)
+		}
+		if _, err := io.WriteString(w, "]"); err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, "}}\n")
+
+	return err
+}
+
+// writeExportZip writes a ZIP archive of the export document and the stored files of the entries
+// of models.FilesTable to w. The files are stored as they are, the clients encrypt them already.
+func (h *BaseController) writeExportZip(ctx context.Context, w io.Writer, userID int) error {
+	now := time.Now()
+	zw := zip.NewWriter(w)
+
+	doc, err := zw.CreateHeader(&zip.FileHeader{Name: exportDocument, Method: zip.Deflate, Modified: now})
+	if err != nil {
+		return err
+	}
+
+	// The files are added after the document, only their ids are held meanwhile
+	var files []string
+	err = h.writeExport(ctx, doc, userID, func(table string, entry map[string]string) error {
+		id := entry["id"]
+		if table != models.FilesTable || filepath.Base(id) != id || !filepath.IsLocal(id) {
+			return nil
+		}
+		file, err := h.openFile(ctx, userID, id)
+		if errors.Is(err, models.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		file.Close()
+		entry[exportFileField] = exportFilesDir + id
+		files = append(files, id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: exportFilesDir + id, Method: zip.Store, Modified: now})
+		if err != nil {
+			return err
+		}
+		if err := h.copyFile(ctx, fw, userID, id); err != nil {
+			return fmt.Errorf("failed to export file %s: %w", id, err)
+		}
+	}
+
+	return zw.Close()
+}
+
+// copyFile copies the contents of the file of the entry of the user to w.
+func (h *BaseController) copyFile(ctx context.Context, w io.Writer, userID int, entryID string) error {
+	f, err := h.openFile(ctx, userID, entryID)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
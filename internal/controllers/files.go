@@ -0,0 +1,162 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"github.com/wurt83ow/gophkeeper-server/internal/objstore"
+	"go.uber.org/zap"
+)
+
+// (GET /api/files/{id}/content)
+func (h *BaseController) GetApiFilesIdContent(w http.ResponseWriter, r *http.Request, id string) {
+	if !validEntryID(w, id) {
+		return
+	}
+	ctx := r.Context()
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// The file is only found through a live entry of the user, the storage filters by the user in the same lookup
+	entry, err := h.storage.GetData(ctx, models.FilesTable, userID, id, false)
+	if errors.Is(err, models.ErrNotFound) || (err == nil && entry["deleted"] == "true") {
+		writeNotFound(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	file, err := h.openFile(ctx, userID, id)
+	if errors.Is(err, models.ErrNotFound) {
+		writeNotFound(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	// A large file takes longer to send than the write timeout of the server
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The contents are encrypted by the clients, the type of the file they decrypt to is in the entry
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	if name := path.Base(filepath.ToSlash(entry["path"])); entry["path"] != "" && name != "/" && name != "." {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	}
+	// The version of the entry validates the ranges resumed with If-Range
+	updatedAt, _ := time.Parse(time.RFC3339Nano, entry["updated_at"])
+	if !updatedAt.IsZero() {
+		w.Header().Set("ETag", strconv.Quote(fmt.Sprintf("%s-%d", id, updatedAt.UnixNano())))
+	}
+
+	// Content-Length, the ranges and 206 are served from the file, read as they are sent
+	http.ServeContent(w, r, "", updatedAt, file)
+}
+
+// FileBlobPrefix starts the keys of the objects of the files in the blob store, see SetBlobStore.
+const FileBlobPrefix = "files/"
+
+// errNoBlobStore is the error of reading a file stored in the blob store once none is configured.
+var errNoBlobStore = errors.New("the file is in the blob store, which isn't configured")
+
+// SetBlobStore sets the store the files uploaded in chunks are put into. Without one they are kept in the file
+// storage under the ids of their entries, as the files sent whole always are.
+func (h *BaseController) SetBlobStore(blobs objstore.BlobStore) {
+	h.blobs = blobs
+}
+
+// fileBlobKey returns a new key of the object of the contents of the checksum. Contents stored again once
+// no entry pointed at them get another key, so an object being deleted is never pointed at again.
+func fileBlobKey(sum string) string {
+	return FileBlobPrefix + sum + "/" + uuid.NewString()
+}
+
+// openFile opens the contents of the file of the entry of the user: the object of its blob, or the file kept
+// on disk under the id of the entry if it has none. It returns models.ErrNotFound if there is neither.
+func (h *BaseController) openFile(ctx context.Context, userID int, entryID string) (io.ReadSeekCloser, error) {
+	blob, err := h.storage.GetFileBlob(ctx, userID, entryID)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		return nil, err
+	}
+	if blob.Key == "" {
+		return openDiskFile(filepath.Join(h.options.FileStoragePath(), entryID))
+	}
+	if h.blobs == nil {
+		return nil, errNoBlobStore
+	}
+
+	obj, err := h.blobs.Get(ctx, blob.Key)
+	if errors.Is(err, objstore.ErrNotFound) {
+		return nil, models.ErrNotFound
+	}
+
+	return obj, err
+}
+
+// openDiskFile opens the regular file at the path, or returns models.ErrNotFound.
+func openDiskFile(path string) (*os.File, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, models.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, models.ErrNotFound
+	}
+
+	return file, nil
+}
+
+// deleteBlob deletes the object of the key from the blob store, even once the request is canceled.
+// An object left is deleted by the reconciliation of the store, so a failure is only logged.
+func (h *BaseController) deleteBlob(ctx context.Context, key string) {
+	if err := h.blobs.Delete(context.WithoutCancel(ctx), key); err != nil {
+		h.log.Warn("failed to delete blob", zap.String("key", key), zap.Error(err))
+	}
+}
+
+// withContentURLs adds the URL of the contents of their files to the live entries of the table, if it is
+// models.FilesTable, so the clients download them apart rather than with the entries.
+func withContentURLs(table string, entries []map[string]string) {
+	if table != models.FilesTable {
+		return
+	}
+	for _, entry := range entries {
+		if entry["deleted"] != "true" && entry["id"] != "" {
+			entry[models.ContentURLField] = models.FileContentURL(entry["id"])
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// (GET /api/folders)
+func (h *BaseController) GetApiFolders(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// The folders as they are now, the sync pulls their changes
+	folders, err := h.storage.GetFolders(r.Context(), userID, time.Time{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, folders)
+}
+
+// (POST /api/folders)
+func (h *BaseController) PostApiFolders(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var requestBody PostApiFoldersJSONRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// A client working offline picks the id itself to file its entries before the folder is created
+	if requestBody.Id == "" {
+		requestBody.Id = models.NewEntryID()
+	}
+
+	folder, err := h.storage.CreateFolder(r.Context(), models.Folder{
+		ID:       requestBody.Id,
+		UserID:   userID,
+		Name:     requestBody.Name,
+		ParentID: requestBody.ParentId,
+	})
+	if err != nil {
+		writeFolderError(w, err)
+		return
+	}
+	h.publish(r, userID, models.VaultEvent{UpdatedAt: folder.UpdatedAt})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(folder)
+}
+
+// (PUT /api/folders/{id})
+func (h *BaseController) PutApiFoldersId(w http.ResponseWriter, r *http.Request, id string) {
+	userID, err := userIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var requestBody PutApiFoldersIdJSONRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The folder is renamed and moved at once, its entries stay in it
+	folder, err := h.storage.UpdateFolder(r.Context(), models.Folder{
+		ID:       id,
+		UserID:   userID,
+		Name:     requestBody.Name,
+		ParentID: requestBody.ParentId,
+	})
+	if err != nil {
+		writeFolderError(w, err)
+		return
+	}
+	h.publish(r, userID, models.VaultEvent{UpdatedAt: folder.UpdatedAt})
+
+	writeJSON(w, folder)
+}
+
+// (DELETE /api/folders/{id})
+func (h *BaseController) DeleteApiFoldersId(w http.ResponseWriter, r *http.Request, id string, params DeleteApiFoldersIdParams) {
+	userID, err := userIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	moveChildren := params.MoveChildren != nil && *params.MoveChildren
+	updatedAt, err := h.storage.DeleteFolder(r.Context(), userID, id, moveChildren)
+	if err != nil {
+		writeFolderError(w, err)
+		return
+	}
+	h.publish(r, userID, models.VaultEvent{UpdatedAt: updatedAt})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeFolderError responds to a failed change of a folder.
+func writeFolderError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, models.ErrInvalidFolder):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, models.ErrFolderExists), errors.Is(err, models.ErrFolderNotEmpty):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, models.ErrNotFound):
+		writeNotFound(w)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
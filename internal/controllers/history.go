@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// The changes between two versions of an entry are computed once and cached, a version never changes.
+// The key has the 'updated_at' of both versions, so a write to the entry reaches a new key.
+const historyDiffsCacheSize = 10000
+
+// historyDiffKey identifies the change from a version of an entry of a user to the next one.
+type historyDiffKey struct {
+	table  string
+	userID int
+	id     string
+	from   string
+	to     string
+}
+
+// diffHistory sets the changes of the versions of the entry, newest first as GetDataHistory returns them.
+// The change of a version is to the one before it in the slice, or to the current state of the entry
+// for the newest. The changes to the preview are redacted where no metadata may be read in plain.
+func (h *BaseController) diffHistory(ctx context.Context, table string, userID int, id string, versions []models.EntryVersion) error {
+	if len(versions) == 0 {
+		return nil
+	}
+
+	next, err := h.storage.GetData(ctx, table, userID, id, true)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		return err
+	}
+
+	for i := range versions {
+		if i > 0 {
+			next = versions[i-1].Snapshot
+		}
+		if next == nil {
+			continue
+		}
+
+		prev := versions[i].Snapshot
+		key := historyDiffKey{table, userID, id, prev["updated_at"], next["updated_at"]}
+		changes, ok := h.historyDiffs.Get(key)
+		if !ok {
+			changes = models.DiffVersions(table, prev, next)
+			h.historyDiffs.Add(key, changes)
+		}
+
+		versions[i].Changes = h.redactChanges(changes)
+	}
+
+	return nil
+}
+
+// redactChanges returns the changes as the plaintext metadata policy lets them be read.
+// The cached changes aren't modified.
+func (h *BaseController) redactChanges(changes []models.FieldChange) []models.FieldChange {
+	if h.options.PlaintextPreviews() {
+		return changes
+	}
+
+	redacted := make([]models.FieldChange, len(changes))
+	for i, change := range changes {
+		if change.Field == models.PreviewField {
+			change = change.Redact()
+		}
+		redacted[i] = change
+	}
+
+	return redacted
+}
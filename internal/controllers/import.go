@@ -0,0 +1,781 @@
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"go.uber.org/zap"
+)
+
+// Import formats: the export document of this server, the CSV export of KeePass and KeePassXC,
+// and the unencrypted JSON export of Bitwarden.
+const (
+	importGophkeeper = "gophkeeper"
+	importKeePass    = "keepass"
+	importBitwarden  = "bitwarden"
+)
+
+// importErrorsLimit is the number of failed records whose reasons are sent back, the others are only counted.
+const importErrorsLimit = 100
+
+// errMalformedImport is the error of an import whose file can't be read in its format, nothing of it is imported.
+var errMalformedImport = errors.New("malformed import")
+
+// importFields are the fields of the entries of the tables an import writes to, their payload and meta_info.
+// The entries with the same values of these fields are duplicates. The payload fields are required,
+// meta_info and importOptional may be missing.
+var importFields = map[string][]string{
+	"UserCredentials":   {"login", "password", "meta_info"},
+	"CreditCardData":    {"card_number", "expiration_date", "cvv", "meta_info"},
+	"TextData":          {"data", "meta_info"},
+	models.OtpTable:     {models.OtpSecretField, "issuer", "account", "meta_info"},
+	models.SshKeysTable: {models.SshPrivateKeyField, models.SshPublicKeyField, "title", "passphrase_hint", "meta_info"},
+}
+
+// importOptional are the other fields an imported entry may have, with the fields of the seeds.
+var importOptional = []string{models.TagsField, models.ExpiresAtField, models.ClientCreatedAt, models.ClientModifiedAt, models.PreviewField}
+
+// importDropped are the fields of the exported entries which the server sets besides models.ServerFields,
+// they are dropped from the entries imported along with those. The imported entries get new ids, so the seeds lose
+// the entries they are linked to. The fingerprints of the public keys are computed again. The folder_id is kept,
+// and mapped to the folder recreated from the document.
+var importDropped = map[string]bool{
+	exportFileField: true, models.DataWarning: true, models.OtpLinkedField: true, models.SshFingerprintField: true,
+}
+
+// importRecord is a record of an import mapped to an entry of the table, or the reason it can't be.
+// A folder of the export document is a record of its own, which isn't counted.
+type importRecord struct {
+	table  string
+	fields map[string]string
+	folder *exportFolder
+	err    error
+}
+
+// importParser reads the records of an import from r, calling visit with each of them in order.
+// An error of a record is set in it, an error reading the file is returned.
+type importParser func(r io.Reader, visit func(rec importRecord) error) error
+
+// importParsers are the parsers of the import formats.
+var importParsers = map[string]importParser{
+	importGophkeeper: parseGophkeeperImport,
+	importKeePass:    parseKeePassImport,
+	importBitwarden:  parseBitwardenImport,
+}
+
+// importResult is the response to an import.
+type importResult struct {
+	Imported int           `json:"imported"`
+	Skipped  int           `json:"skipped"`
+	Failed   int           `json:"failed"`
+	Folders  int           `json:"folders"`
+	Errors   []importError `json:"errors,omitempty"`
+}
+
+// importError is the reason the record at a position of the import, counted from 1, failed.
+type importError struct {
+	Record int    `json:"record"`
+	Reason string `json:"reason"`
+}
+
+// fail counts the record as failed with its reason.
+func (res *importResult) fail(record int, err error) {
+	res.Failed++
+	if len(res.Errors) < importErrorsLimit {
+		res.Errors = append(res.Errors, importError{Record: record, Reason: err.Error()})
+	}
+}
+
+// (POST /api/import)
+func (h *BaseController) PostApiImport(w http.ResponseWriter, r *http.Request, params PostApiImportParams) {
+	ctx := r.Context()
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	format := importGophkeeper
+	if params.Format != nil {
+		format = *params.Format
+	}
+	parse, ok := importParsers[format]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown import format %q, use %s, %s or %s", format,
+			importGophkeeper, importKeePass, importBitwarden), http.StatusBadRequest)
+		return
+	}
+
+	// A large file takes longer to receive and write than the write timeout of the server
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, int64(h.options.ImportMaxSize()))
+	result, err := h.importVault(ctx, userID, parse, body)
+
+	// The import is recorded even if the client went away, with the context of the request cancelled
+	auditErr := h.storage.AddAuditEvent(context.WithoutCancel(ctx), models.AuditEvent{
+		UserID:  userID,
+		Action:  models.AuditImport,
+		Detail:  format,
+		Success: err == nil,
+	})
+	if auditErr != nil {
+		h.log.Warn("failed to write audit event", zap.String("action", string(models.AuditImport)), zap.Error(auditErr))
+	}
+
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, fmt.Sprintf("the import is larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	case errors.Is(err, errMalformedImport), errors.Is(err, models.ErrInvalidChange), errors.Is(err, models.ErrInvalidFolder):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, models.ErrRetrySync):
+		// Nothing was imported, the client sends the file again
+		writeRetrySync(w)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The entries imported may be of any table
+	if result.Imported > 0 || result.Folders > 0 {
+		h.publish(r, userID, models.VaultEvent{UpdatedAt: time.Now().UTC()})
+	}
+
+	writeJSON(w, result)
+}
+
+// importVault reads the records of the import from body with parse and adds the valid ones which aren't duplicates
+// of an entry of the user, or of a record before them, to the vault. The records are read as they come, only
+// the entries to add and the fingerprints of the entries are held, and added in one batch: either all of them
+// are or none is. The folders of the import are created before the entries filed in them, and deleted again
+// if the entries fail.
+func (h *BaseController) importVault(ctx context.Context, userID int, parse importParser, body io.Reader) (importResult, error) {
+	var result importResult
+	seen, err := h.importFingerprints(ctx, userID)
+	if err != nil {
+		return result, err
+	}
+
+	var changes []models.Change
+	var folders []exportFolder
+	record := 0
+	err = parse(body, func(rec importRecord) error {
+		if rec.folder != nil {
+			folders = append(folders, *rec.folder)
+			return nil
+		}
+		record++
+		if rec.err == nil {
+			rec.fields, rec.err = h.importEntry(rec.table, rec.fields)
+		}
+		if rec.err != nil {
+			result.fail(record, rec.err)
+			return nil
+		}
+
+		fingerprint := importFingerprint(rec.table, rec.fields)
+		if seen[fingerprint] {
+			result.Skipped++
+			return nil
+		}
+		seen[fingerprint] = true
+		changes = append(changes, models.Change{
+			Table:   rec.table,
+			Op:      models.ChangeAdd,
+			EntryID: uuid.NewString(),
+			Fields:  rec.fields,
+		})
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	folderIDs, created, err := h.importFolders(ctx, userID, folders)
+	if err != nil {
+		h.dropFolders(ctx, userID, created)
+		return result, err
+	}
+	result.Folders = len(created)
+	for _, c := range changes {
+		if folderID, ok := c.Fields[models.FolderField]; ok {
+			// An entry whose folder isn't in the document is at the top
+			if folderIDs[folderID] == "" {
+				delete(c.Fields, models.FolderField)
+			} else {
+				c.Fields[models.FolderField] = folderIDs[folderID]
+			}
+		}
+	}
+	if len(changes) == 0 {
+		return result, nil
+	}
+
+	if _, err := h.storage.ApplyChanges(ctx, userID, changes); err != nil {
+		h.dropFolders(ctx, userID, created)
+		result.Folders = 0
+		return result, err
+	}
+	result.Imported = len(changes)
+
+	return result, nil
+}
+
+// importFolders recreates the folders of an import in the vault of the user, each after its parent, and returns
+// the ids of the folders in the vault by their ids in the import, with the ids of the folders it created in the
+// order it created them. A folder with the name of a folder of the vault in the same parent is merged into it,
+// so importing a document twice creates its folders once. A folder whose parent isn't in the import is at the top.
+func (h *BaseController) importFolders(ctx context.Context, userID int, folders []exportFolder) (map[string]string, []string, error) {
+	if len(folders) == 0 {
+		return nil, nil, nil
+	}
+	existing, err := h.storage.GetFolders(ctx, userID, time.Time{})
+	if err != nil {
+		return nil, nil, err
+	}
+	type place struct{ parentID, nameKey string }
+	placed := make(map[place]string, len(existing)+len(folders))
+	for _, f := range existing {
+		placed[place{f.ParentID, models.FolderNameKey(f.Name)}] = f.ID
+	}
+	inImport := make(map[string]bool, len(folders))
+	for _, f := range folders {
+		inImport[f.ID] = true
+	}
+
+	ids := make(map[string]string, len(folders))
+	var created []string
+	for pending := folders; len(pending) > 0; {
+		var waiting []exportFolder
+		for _, f := range pending {
+			parentID := ""
+			if inImport[f.ParentID] {
+				var ok bool
+				if parentID, ok = ids[f.ParentID]; !ok {
+					waiting = append(waiting, f)
+					continue
+				}
+			}
+			at := place{parentID, models.FolderNameKey(strings.TrimSpace(f.Name))}
+			if id, ok := placed[at]; ok {
+				ids[f.ID] = id
+				continue
+			}
+			folder, err := h.storage.CreateFolder(ctx, models.Folder{ID: uuid.NewString(), UserID: userID, Name: f.Name, ParentID: parentID})
+			if err != nil {
+				return nil, created, fmt.Errorf("failed to import folder %q: %w", f.Name, err)
+			}
+			ids[f.ID], placed[at] = folder.ID, folder.ID
+			created = append(created, folder.ID)
+		}
+		if len(waiting) == len(pending) {
+			return nil, created, fmt.Errorf("%w: the folders are nested in each other", errMalformedImport)
+		}
+		pending = waiting
+	}
+
+	return ids, created, nil
+}
+
+// dropFolders deletes the folders created by an import which failed, the subfolders before their parents.
+func (h *BaseController) dropFolders(ctx context.Context, userID int, created []string) {
+	ctx = context.WithoutCancel(ctx)
+	for i := len(created) - 1; i >= 0; i-- {
+		if _, err := h.storage.DeleteFolder(ctx, userID, created[i], false); err != nil {
+			h.log.Warn("failed to delete imported folder", zap.String("folder_id", created[i]), zap.Error(err))
+		}
+	}
+}
+
+// importFingerprints returns the fingerprints of the entries of the user in the tables an import writes to.
+func (h *BaseController) importFingerprints(ctx context.Context, userID int) (map[[sha256.Size]byte]bool, error) {
+	seen := make(map[[sha256.Size]byte]bool)
+	for table := range importFields {
+		err := h.storage.ExportData(ctx, table, userID, func(entry map[string]string) error {
+			seen[importFingerprint(table, entry)] = true
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", table, err)
+		}
+	}
+
+	return seen, nil
+}
+
+// importFingerprint returns the hash of the table and the importFields of the entry, equal for the duplicates.
+func importFingerprint(table string, entry map[string]string) [sha256.Size]byte {
+	h := sha256.New()
+	io.WriteString(h, table)
+	for _, field := range importFields[table] {
+		// The length delimits the values, whatever they contain
+		fmt.Fprintf(h, "\x00%d:%s", len(entry[field]), entry[field])
+	}
+
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// importEntry validates the fields of a record of the table and returns them as they are written, so an invalid
+// record fails alone rather than the whole batch.
+func (h *BaseController) importEntry(table string, fields map[string]string) (map[string]string, error) {
+	required, ok := importFields[table]
+	if !ok {
+		if table == models.FilesTable {
+			return nil, fmt.Errorf("the entries of %s aren't imported, their files aren't in the document", table)
+		}
+		return nil, fmt.Errorf("unknown table %q", table)
+	}
+
+	fields, err := models.NormalizeFields(fields)
+	if err != nil {
+		return nil, err
+	}
+	entry := make(map[string]string, len(fields))
+	now := time.Now()
+	for key, value := range fields {
+		switch {
+		case models.ServerFields[key] || importDropped[key]:
+			continue
+		case key == models.FolderField:
+			if value, err = models.ParseFolderID(value); err != nil {
+				return nil, err
+			}
+		case key == models.TagsField:
+			tags, err := models.ParseTags(value)
+			if err != nil {
+				return nil, err
+			}
+			value = models.FormatTags(tags)
+		case key == models.ExpiresAtField:
+			if _, err := models.ParseExpiresAt(value); err != nil {
+				return nil, err
+			}
+		case models.IsClientTimeField(key):
+			if value, err = models.NormalizeClientTime(key, value, now); err != nil {
+				return nil, err
+			}
+		case key == models.PreviewField:
+			if !h.options.PlaintextPreviews() {
+				return nil, errPreviewForbidden
+			}
+			if value, err = models.ParsePreview(table, value); err != nil {
+				return nil, err
+			}
+		case models.IsOtpField(table, key):
+			if value, err = models.ParseOtpField(key, value); err != nil {
+				return nil, err
+			}
+		case !slices.Contains(required, key) && !slices.Contains(importOptional, key):
+			return nil, fmt.Errorf("%s has no field %q", table, key)
+		}
+		entry[key] = value
+	}
+	if err := models.DeriveSshFields(table, entry); err != nil {
+		return nil, err
+	}
+
+	empty := true
+	for _, field := range required {
+		if field == "meta_info" {
+			continue
+		}
+		if _, ok := entry[field]; !ok {
+			return nil, fmt.Errorf("the field %q is missing", field)
+		}
+		empty = empty && entry[field] == ""
+	}
+	if empty {
+		return nil, errors.New("the record has no data")
+	}
+
+	return entry, nil
+}
+
+// parseGophkeeperImport reads the records of an export document of this server, see exportSchemaVersion.
+// The tables are read an entry at a time. The documents of a newer schema are rejected, the ones of version 1
+// have no folders.
+func parseGophkeeperImport(r io.Reader, visit func(rec importRecord) error) error {
+	dec := json.NewDecoder(r)
+	err := walkObject(dec, func(key string) error {
+		switch key {
+		case "schema_version":
+			var version int
+			if err := dec.Decode(&version); err != nil {
+				return err
+			}
+			if version > exportSchemaVersion {
+				return fmt.Errorf("the schema version %d is newer than %d", version, exportSchemaVersion)
+			}
+			return nil
+		case "folders":
+			return walkArray(dec, func() error {
+				var folder exportFolder
+				if err := dec.Decode(&folder); err != nil {
+					return err
+				}
+				return visit(importRecord{folder: &folder})
+			})
+		case "tables":
+			return walkObject(dec, func(table string) error {
+				return walkArray(dec, func() error {
+					var entry map[string]string
+					err := decodeRecord(dec, &entry)
+					if errors.Is(err, errMalformedImport) {
+						return err
+					}
+					return visit(importRecord{table: table, fields: entry, err: err})
+				})
+			})
+		}
+		return skipValue(dec)
+	})
+	if err != nil {
+		return malformedImport(err)
+	}
+
+	return nil
+}
+
+// KeePass CSV columns, of KeePassXC and of KeePass 2, matched regardless of the case.
+var (
+	keepassTitle    = []string{"title", "account"}
+	keepassUsername = []string{"username", "user name", "login name"}
+	keepassPassword = []string{"password"}
+	keepassURL      = []string{"url", "web site"}
+	keepassNotes    = []string{"notes", "comments"}
+	keepassGroup    = []string{"group"}
+	keepassCreated  = []string{"created"}
+	keepassModified = []string{"last modified"}
+)
+
+// parseKeePassImport reads the records of a CSV export of KeePass, with the names of the columns on its first row.
+// An entry with a username or a password is a login, the others are notes. The title, the URL and the notes
+// of a login are its meta_info, one per line. The last part of the group is a tag.
+func parseKeePassImport(r io.Reader, visit func(rec importRecord) error) error {
+	// The exports of Windows start with a byte order mark, which would be read into the first column
+	br := bufio.NewReader(r)
+	if bom, _, err := br.ReadRune(); err == nil && bom != '\ufeff' {
+		br.UnreadRune()
+	}
+	cr := csv.NewReader(br)
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err != nil {
+		return malformedImport(err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	column := func(names []string) int {
+		for _, name := range names {
+			if i, ok := columns[name]; ok {
+				return i
+			}
+		}
+		return -1
+	}
+	title, username, password, url := column(keepassTitle), column(keepassUsername), column(keepassPassword), column(keepassURL)
+	notes, group, created, modified := column(keepassNotes), column(keepassGroup), column(keepassCreated), column(keepassModified)
+	if password < 0 && notes < 0 {
+		return malformedImport(errors.New("the file has neither a Password nor a Notes column"))
+	}
+
+	for {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if errors.Is(err, csv.ErrFieldCount) {
+			if err := visit(importRecord{err: errors.New("wrong number of fields")}); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return malformedImport(err)
+		}
+
+		value := func(i int) string {
+			if i < 0 || i >= len(row) {
+				return ""
+			}
+			return row[i]
+		}
+		rec := importRecord{table: "UserCredentials", fields: map[string]string{
+			"login":    value(username),
+			"password": value(password),
+		}}
+		meta := []string{value(title), value(url), value(notes)}
+		if rec.fields["login"] == "" && rec.fields["password"] == "" {
+			rec.table, rec.fields = "TextData", map[string]string{"data": value(notes)}
+			meta = meta[:1]
+		}
+		rec.fields["meta_info"] = joinNonEmpty(meta)
+		setImportTag(rec.fields, value(group)[strings.LastIndex(value(group), "/")+1:])
+		setImportTime(rec.fields, models.ClientCreatedAt, value(created))
+		setImportTime(rec.fields, models.ClientModifiedAt, value(modified))
+		if err := visit(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// Bitwarden item types.
+const (
+	bitwardenLogin    = 1
+	bitwardenNote     = 2
+	bitwardenCard     = 3
+	bitwardenIdentity = 4
+)
+
+// bitwardenItem is an item of an unencrypted Bitwarden export, with the fields an import maps.
+type bitwardenItem struct {
+	Type         int     `json:"type"`
+	Name         string  `json:"name"`
+	Notes        *string `json:"notes"`
+	FolderID     *string `json:"folderId"`
+	CreationDate string  `json:"creationDate"`
+	RevisionDate string  `json:"revisionDate"`
+	Login        *struct {
+		Username *string `json:"username"`
+		Password *string `json:"password"`
+		URIs     []struct {
+			URI *string `json:"uri"`
+		} `json:"uris"`
+	} `json:"login"`
+	Card *struct {
+		Number   *string `json:"number"`
+		ExpMonth *string `json:"expMonth"`
+		ExpYear  *string `json:"expYear"`
+		Code     *string `json:"code"`
+	} `json:"card"`
+}
+
+// parseBitwardenImport reads the records of an unencrypted JSON export of Bitwarden. The logins, the secure notes
+// and the cards are imported, with their name, URIs and notes as meta_info, one per line, and their folder as a tag.
+// The folders are listed before the items in the exports, an item only has the tag of a folder listed before it.
+func parseBitwardenImport(r io.Reader, visit func(rec importRecord) error) error {
+	dec := json.NewDecoder(r)
+	folders := make(map[string]string)
+	err := walkObject(dec, func(key string) error {
+		switch key {
+		case "encrypted":
+			var encrypted bool
+			if err := dec.Decode(&encrypted); err != nil {
+				return err
+			}
+			if encrypted {
+				return errors.New("the export is encrypted, export the vault unencrypted")
+			}
+			return nil
+		case "folders":
+			return walkArray(dec, func() error {
+				var folder struct {
+					ID   string `json:"id"`
+					Name string `json:"name"`
+				}
+				if err := dec.Decode(&folder); err != nil {
+					return err
+				}
+				folders[folder.ID] = folder.Name
+				return nil
+			})
+		case "items":
+			return walkArray(dec, func() error {
+				var item bitwardenItem
+				if err := decodeRecord(dec, &item); errors.Is(err, errMalformedImport) {
+					return err
+				} else if err != nil {
+					return visit(importRecord{err: err})
+				}
+				rec := bitwardenRecord(item)
+				if rec.err == nil && item.FolderID != nil {
+					setImportTag(rec.fields, folders[*item.FolderID])
+				}
+				return visit(rec)
+			})
+		}
+		return skipValue(dec)
+	})
+	if err != nil {
+		return malformedImport(err)
+	}
+
+	return nil
+}
+
+// bitwardenRecord maps the Bitwarden item to an entry.
+func bitwardenRecord(item bitwardenItem) importRecord {
+	meta := []string{item.Name}
+	var rec importRecord
+	switch item.Type {
+	case bitwardenLogin:
+		rec.table, rec.fields = "UserCredentials", map[string]string{}
+		if item.Login != nil {
+			rec.fields["login"] = deref(item.Login.Username)
+			rec.fields["password"] = deref(item.Login.Password)
+			for _, uri := range item.Login.URIs {
+				meta = append(meta, deref(uri.URI))
+			}
+		}
+	case bitwardenNote:
+		rec.table, rec.fields = "TextData", map[string]string{"data": deref(item.Notes)}
+	case bitwardenCard:
+		rec.table, rec.fields = "CreditCardData", map[string]string{}
+		if item.Card != nil {
+			rec.fields["card_number"] = deref(item.Card.Number)
+			rec.fields["cvv"] = deref(item.Card.Code)
+			if month, year := deref(item.Card.ExpMonth), deref(item.Card.ExpYear); month != "" || year != "" {
+				if len(month) == 1 {
+					month = "0" + month
+				}
+				rec.fields["expiration_date"] = month + "/" + year[max(len(year)-2, 0):]
+			}
+		}
+	case bitwardenIdentity:
+		return importRecord{err: errors.New("the identities aren't imported")}
+	default:
+		return importRecord{err: fmt.Errorf("unknown item type %d", item.Type)}
+	}
+
+	if item.Type != bitwardenNote {
+		meta = append(meta, deref(item.Notes))
+	}
+	rec.fields["meta_info"] = joinNonEmpty(meta)
+	setImportTime(rec.fields, models.ClientCreatedAt, item.CreationDate)
+	setImportTime(rec.fields, models.ClientModifiedAt, item.RevisionDate)
+
+	return rec
+}
+
+// deref returns the string, empty for nil.
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+
+	return *s
+}
+
+// joinNonEmpty joins the values which aren't empty with line breaks.
+func joinNonEmpty(values []string) string {
+	lines := make([]string, 0, len(values))
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			lines = append(lines, v)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// setImportTag labels the entry with the folder or the group of the other manager, unless it can't be a tag.
+func setImportTag(fields map[string]string, name string) {
+	if tag, err := models.ParseTag(name); err == nil {
+		fields[models.TagsField] = tag
+	}
+}
+
+// setImportTime sets the display timestamp of the entry from the other manager, unless it isn't RFC 3339.
+func setImportTime(fields map[string]string, key, value string) {
+	if _, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		fields[key] = value
+	}
+}
+
+// malformedImport wraps the error reading an import, keeping the limit of the body to be seen.
+func malformedImport(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) || errors.Is(err, errMalformedImport) {
+		return err
+	}
+
+	return fmt.Errorf("%w: %w", errMalformedImport, err)
+}
+
+// decodeRecord decodes the next value of the stream into v. A value of the wrong type is an error of its record,
+// the stream goes on after it; another error is returned wrapped in errMalformedImport to stop the import.
+func decodeRecord(dec *json.Decoder, v any) error {
+	err := dec.Decode(v)
+	var typeErr *json.UnmarshalTypeError
+	if err == nil || errors.As(err, &typeErr) {
+		return err
+	}
+
+	return malformedImport(err)
+}
+
+// walkObject reads the JSON object at the position of the decoder, calling fn with each of its keys.
+// fn reads the value of the key.
+func walkObject(dec *json.Decoder, fn func(key string) error) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if err := fn(tok.(string)); err != nil {
+			return err
+		}
+	}
+
+	return expectDelim(dec, '}')
+}
+
+// walkArray reads the JSON array at the position of the decoder, calling fn to read each of its elements.
+func walkArray(dec *json.Decoder, fn func() error) error {
+	if err := expectDelim(dec, '['); err != nil {
+		return err
+	}
+	for dec.More() {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+
+	return expectDelim(dec, ']')
+}
+
+// expectDelim reads the next token of the decoder, which has to be the delimiter.
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("expected %s, got %v", delim, tok)
+	}
+
+	return nil
+}
+
+// skipValue reads past the next value of the decoder.
+func skipValue(dec *json.Decoder) error {
+	var v json.RawMessage
+	return dec.Decode(&v)
+}
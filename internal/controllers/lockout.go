@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"go.uber.org/zap"
+)
+
+// loginWindow is the period over which the failed logins from an address are counted.
+const loginWindow = time.Minute
+
+// failureWindow counts the failed logins from an address since the start of its window.
+type failureWindow struct {
+	start    time.Time
+	failures int
+}
+
+// loginLimiter rejects the logins from an address once its failed logins in a window reach the limit,
+// until the window ends. It complements the lockout of the accounts, which doesn't stop a password
+// list tried against many accounts. The counts are kept in memory, per server.
+type loginLimiter struct {
+	limit int
+	now   func() time.Time
+
+	mu      sync.Mutex
+	windows map[string]*failureWindow
+	swept   time.Time
+}
+
+// newLoginLimiter creates a limiter of the failed logins per address, a limit of 0 or less disables it.
+func newLoginLimiter(limit int) *loginLimiter {
+	return &loginLimiter{limit: limit, now: time.Now, windows: make(map[string]*failureWindow)}
+}
+
+// retryAfter returns how long the logins from the address are still rejected, 0 if they aren't.
+func (l *loginLimiter) retryAfter(addr string) time.Duration {
+	if l.limit <= 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	w, ok := l.windows[addr]
+	if !ok || w.failures < l.limit {
+		return 0
+	}
+
+	return max(w.start.Add(loginWindow).Sub(l.now()), 0)
+}
+
+// fail counts a failed login from the address. The windows which ended are dropped once per window,
+// so the addresses seen once don't accumulate.
+func (l *loginLimiter) fail(addr string) {
+	if l.limit <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.swept) >= loginWindow {
+		for a, w := range l.windows {
+			if now.Sub(w.start) >= loginWindow {
+				delete(l.windows, a)
+			}
+		}
+		l.swept = now
+	}
+
+	w, ok := l.windows[addr]
+	if !ok || now.Sub(w.start) >= loginWindow {
+		w = &failureWindow{start: now}
+		l.windows[addr] = w
+	}
+	w.failures++
+}
+
+// clientAddr returns the address of the client of the request, without its port.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// writeTooManyLogins rejects a login from a limited address or to a locked account.
+func writeTooManyLogins(w http.ResponseWriter, retry time.Duration) {
+	writeRetryAfter(w, retry)
+	http.Error(w, "too many failed logins, retry later", http.StatusTooManyRequests)
+}
+
+// writeRetryAfter sets the 'Retry-After' header of a rejected request, after which clients retry it,
+// to the delay in whole seconds.
+func writeRetryAfter(w http.ResponseWriter, retry time.Duration) {
+	seconds := max(int(math.Ceil(retry.Seconds())), 1)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
+
+// failedLogin records a failed login in the audit log, against the limit of the address and against
+// the account, which is locked once its consecutive failures reach the threshold. A failed login
+// to a known account is also added to its login history.
+func (h *BaseController) failedLogin(ctx context.Context, addr, username string) {
+	h.auditFailedLogin(ctx, username)
+	h.logins.fail(addr)
+
+	lockedUntil, err := h.storage.RecordFailedLogin(ctx, username, h.options.LoginMaxFailures())
+	if errors.Is(err, models.ErrNotFound) {
+		return
+	}
+	userID, _ := h.storage.GetUserID(ctx, username)
+	if userID != 0 {
+		h.recordLogin(ctx, userID, addr, false)
+	}
+	if err != nil {
+		h.log.Warn("failed to record failed login", zap.Error(err))
+		return
+	}
+	if lockedUntil.IsZero() {
+		return
+	}
+
+	h.log.Warn("account locked after failed logins", zap.Int("user_id", userID), zap.Time("locked_until", lockedUntil))
+	h.auditAuth(ctx, models.AuditLockout, userID, true)
+}
+
+// recordLogin adds a login attempt from the address to the login history of the user, keeping the number
+// of attempts of the options. The history must not fail the login, so a failed write is only logged.
+func (h *BaseController) recordLogin(ctx context.Context, userID int, addr string, success bool) {
+	ev := models.LoginEvent{UserID: userID, IP: addr, UserAgent: models.ClientFrom(ctx).UserAgent, Success: success}
+	if err := h.storage.RecordLogin(context.WithoutCancel(ctx), ev, h.options.LoginHistory()); err != nil {
+		h.log.Warn("failed to record login", zap.Int("user_id", userID), zap.Error(err))
+	}
+}
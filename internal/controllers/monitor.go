@@ -0,0 +1,249 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"go.uber.org/zap"
+)
+
+// monitorScheme starts the Authorization header of the monitor pings.
+const monitorScheme = "Bearer "
+
+// maxMonitorName bounds the name of a monitor token, it only names the monitor in the list of the admins.
+const maxMonitorName = 100
+
+// The monitor tokens are cached, so a ping doesn't reach the storage. A token revoked on another server
+// is still accepted here until it expires from the cache.
+const (
+	monitorTokensCacheSize = 1000
+	monitorTokensCacheTTL  = 30 * time.Second
+)
+
+// monitorTouchInterval is how often the last use of a monitor token is updated.
+const monitorTouchInterval = time.Minute
+
+// pingWindow is the period over which the pings of a monitor token are counted.
+const pingWindow = time.Minute
+
+// Health reports the health of the server as last checked, see SetHealth.
+type Health interface {
+	// Status returns whether the server is up and a coarse status for the monitors.
+	Status() (up bool, status string)
+}
+
+// createdMonitorToken is the response to the creation of a monitor token, the only one carrying the token itself.
+type createdMonitorToken struct {
+	models.MonitorToken
+	Token string `json:"token"`
+}
+
+// SetHealth sets the health served by the monitor ping. Without one, the ping reports the server down.
+func (h *BaseController) SetHealth(health Health) {
+	h.health = health
+}
+
+// (GET /api/monitor/ping)
+func (h *BaseController) GetApiMonitorPing(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), monitorScheme)
+	if !ok || secret == "" {
+		http.Error(w, "Authorization error", http.StatusUnauthorized)
+		return
+	}
+	hash := h.authz.HashMonitorToken(secret)
+	token, err := h.monitorTokens.GetOrLoad(ctx, hash, func(ctx context.Context) (models.MonitorToken, error) {
+		token, err := h.storage.GetMonitorTokenByHash(ctx, hash)
+		// The unknown tokens are cached too, as tokens without an id
+		if errors.Is(err, models.ErrNotFound) {
+			return models.MonitorToken{}, nil
+		}
+		return token, err
+	})
+	if err != nil {
+		h.log.Info("Error occurred getting monitor token", zap.Error(err))
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if token.ID == 0 {
+		http.Error(w, "Authorization error", http.StatusUnauthorized)
+		return
+	}
+
+	if retry := h.pings.allow(token.ID); retry > 0 {
+		writeRetryAfter(w, retry)
+		http.Error(w, "too many pings, retry later", http.StatusTooManyRequests)
+		return
+	}
+	h.touchMonitorToken(ctx, token)
+
+	// Only the coarse status is sent, nothing of the version or the features of the server
+	up, status := false, "unavailable"
+	if h.health != nil {
+		up, status = h.health.Status()
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if up {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	io.WriteString(w, status+"\n")
+}
+
+// touchMonitorToken updates the last use of the token once per monitorTouchInterval, and the cached token
+// with it. The last use is only shown to the admins, a failed update doesn't fail the ping.
+func (h *BaseController) touchMonitorToken(ctx context.Context, token models.MonitorToken) {
+	if token.LastUsedAt != nil && time.Since(*token.LastUsedAt) < monitorTouchInterval {
+		return
+	}
+	if err := h.storage.TouchMonitorToken(ctx, token.ID); err != nil {
+		h.log.Info("Error occurred touching monitor token", zap.Int("monitor_token_id", token.ID), zap.Error(err))
+		return
+	}
+
+	now := time.Now().UTC()
+	token.LastUsedAt = &now
+	h.monitorTokens.Add(token.Hash, token)
+}
+
+// (GET /api/admin/monitors)
+func (h *BaseController) GetApiAdminMonitors(w http.ResponseWriter, r *http.Request) {
+	tokens, err := h.storage.ListMonitorTokens(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, tokens)
+}
+
+// (POST /api/admin/monitors)
+func (h *BaseController) PostApiAdminMonitors(w http.ResponseWriter, r *http.Request) {
+	var requestBody PostApiAdminMonitorsJSONRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(requestBody.Name)
+	if name == "" || len(name) > maxMonitorName {
+		http.Error(w, "a monitor needs a name of at most 100 bytes", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	adminID, err := userIDFromContext(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Only the hash is stored, the token is shown once and can't be recovered
+	secret, err := h.authz.NewMonitorToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	token, err := h.storage.CreateMonitorToken(ctx, models.MonitorToken{
+		Hash: h.authz.HashMonitorToken(secret),
+		Name: name,
+	})
+	if err != nil {
+		h.auditEntry(ctx, models.AuditCreateMonitorToken, adminID, 0, false)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.auditEntry(ctx, models.AuditCreateMonitorToken, adminID, token.ID, true)
+
+	writeJSON(w, createdMonitorToken{MonitorToken: token, Token: secret})
+}
+
+// (DELETE /api/admin/monitors/{id})
+func (h *BaseController) DeleteApiAdminMonitorsId(w http.ResponseWriter, r *http.Request, id int) {
+	ctx := r.Context()
+	adminID, err := userIDFromContext(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	token, err := h.storage.RevokeMonitorToken(ctx, id)
+	if errors.Is(err, models.ErrNotFound) {
+		writeNotFound(w)
+		return
+	}
+	if err != nil {
+		h.auditEntry(ctx, models.AuditRevokeMonitorToken, adminID, id, false)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// This server rejects the token at once, the others once it expires from their cache
+	h.monitorTokens.Remove(token.Hash)
+	h.auditEntry(ctx, models.AuditRevokeMonitorToken, adminID, id, true)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pingCount counts the pings of a monitor token since the start of its window.
+type pingCount struct {
+	start time.Time
+	pings int
+}
+
+// pingLimiter rejects the pings of a monitor token once they reach the limit in a window, until the window
+// ends, so a misconfigured monitor can't load the server. The counts are kept in memory, per server.
+type pingLimiter struct {
+	limit int
+	now   func() time.Time
+
+	mu      sync.Mutex
+	windows map[int]*pingCount
+	swept   time.Time
+}
+
+// newPingLimiter creates a limiter of the pings per monitor token, a limit of 0 or less disables it.
+func newPingLimiter(limit int) *pingLimiter {
+	return &pingLimiter{limit: limit, now: time.Now, windows: make(map[int]*pingCount)}
+}
+
+// allow counts a ping of the token and returns how long its pings are rejected, 0 if this one is allowed.
+// The windows which ended are dropped once per window, so the revoked tokens don't accumulate.
+func (l *pingLimiter) allow(id int) time.Duration {
+	if l.limit <= 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.swept) >= pingWindow {
+		for i, c := range l.windows {
+			if now.Sub(c.start) >= pingWindow {
+				delete(l.windows, i)
+			}
+		}
+		l.swept = now
+	}
+
+	c, ok := l.windows[id]
+	if !ok || now.Sub(c.start) >= pingWindow {
+		c = &pingCount{start: now}
+		l.windows[id] = c
+	}
+	if c.pings >= l.limit {
+		return max(c.start.Add(pingWindow).Sub(now), time.Nanosecond)
+	}
+	c.pings++
+
+	return 0
+}
@@ -0,0 +1,237 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"go.uber.org/zap"
+)
+
+// errVaultLocked is the error of the writes fenced by the re-encryption of the vault on another device.
+var errVaultLocked = errors.New("vault locked for re-encryption")
+
+// fenceKey is the key of the operation fencing the device of a request on a pulling route, in its context.
+type fenceKey struct{}
+
+// lockedOperation is the response to a request turned away by the running operation of another device,
+// for the client to wait until it is expected to end.
+type lockedOperation struct {
+	Error           string    `json:"error"`
+	OperationID     string    `json:"operation_id"`
+	Kind            string    `json:"kind"`
+	ExpectedSeconds int       `json:"expected_seconds"`
+	StartedAt       time.Time `json:"started_at"`
+	ExpiresAt       time.Time `json:"expires_at"`
+}
+
+// WriteFence is a middleware rejecting the writes of a user while another device of theirs re-encrypts the vault,
+// with 423 and the running operation: the entries they would write are encrypted under the old key. The reads
+// aren't fenced, nor are the writes of the device running the operation, the one of its X-Device-ID. The writes
+// to a vault replicated from a primary server are rejected with 409, see SetReplication. A route which pulls along
+// with pushing, see RoutePulls, is left to reject the push itself, see fencedBy and isReplica.
+// It has to run after the authentication, which puts the user in the context.
+func (h *BaseController) WriteFence(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if scope, _ := ctx.Value(RouteScope).(string); scope != models.ScopeWrite {
+			next.ServeHTTP(w, r)
+			return
+		}
+		userID, err := userIDFromContext(ctx)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if h.replicated(userID) {
+			if pulls, _ := ctx.Value(RoutePulls).(bool); pulls {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, replicaKey{}, true)))
+				return
+			}
+			http.Error(w, errReadOnlyReplica.Error(), http.StatusConflict)
+			return
+		}
+
+		op, err := h.storage.GetRunningOperation(ctx, userID)
+		if errors.Is(err, models.ErrNotFound) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if op.DeviceID == r.Header.Get(DeviceIDHeader) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if pulls, _ := ctx.Value(RoutePulls).(bool); pulls {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, fenceKey{}, op)))
+			return
+		}
+
+		writeLocked(w, http.StatusLocked, errVaultLocked, op)
+	})
+}
+
+// fencedBy returns the operation fencing the writes of the request on a route which pulls, see WriteFence.
+func fencedBy(ctx context.Context) (models.UserOperation, bool) {
+	op, ok := ctx.Value(fenceKey{}).(models.UserOperation)
+	return op, ok
+}
+
+// writeLocked responds with the status and the running operation, and when to retry.
+func writeLocked(w http.ResponseWriter, status int, err error, op models.UserOperation) {
+	responseBytes, jsonErr := json.Marshal(lockedOperation{
+		Error:           err.Error(),
+		OperationID:     op.ID,
+		Kind:            op.Kind,
+		ExpectedSeconds: op.ExpectedSeconds,
+		StartedAt:       op.StartedAt,
+		ExpiresAt:       op.ExpiresAt,
+	})
+	if jsonErr != nil {
+		http.Error(w, jsonErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	retryAfter := math.Ceil(time.Until(op.ExpiresAt).Seconds())
+	w.Header().Set("Retry-After", strconv.Itoa(int(max(retryAfter, 1))))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(responseBytes)
+}
+
+// (POST /api/user/reencrypt)
+func (h *BaseController) PostApiUserReencrypt(w http.ResponseWriter, r *http.Request) {
+	var requestBody PostApiUserReencryptJSONRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if requestBody.ExpectedSeconds < 0 {
+		http.Error(w, "the expected duration is negative", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// The device running the operation is the one whose writes aren't fenced
+	deviceID := r.Header.Get(DeviceIDHeader)
+	if deviceID == "" {
+		http.Error(w, fmt.Sprintf("the re-encryption is run by a device, send its id in %s", DeviceIDHeader), http.StatusBadRequest)
+		return
+	}
+
+	op, err := h.storage.StartUserOperation(ctx, models.UserOperation{
+		ID:              uuid.NewString(),
+		UserID:          userID,
+		Kind:            models.OperationReencrypt,
+		DeviceID:        deviceID,
+		ExpectedSeconds: requestBody.ExpectedSeconds,
+		ExpiresAt:       time.Now().Add(h.options.ReencryptTimeout()),
+	})
+	if errors.Is(err, models.ErrOperationRunning) {
+		running, err := h.storage.GetRunningOperation(ctx, userID)
+		if err == nil {
+			writeLocked(w, http.StatusConflict, models.ErrOperationRunning, running)
+			return
+		}
+		// The running operation ended meanwhile, the client may start again
+		http.Error(w, models.ErrOperationRunning.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.auditOperation(ctx, op)
+
+	responseBytes, err := json.Marshal(op)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(responseBytes)
+}
+
+// (PUT /api/user/reencrypt/{id})
+func (h *BaseController) PutApiUserReencryptId(w http.ResponseWriter, r *http.Request, id string) {
+	var requestBody PutApiUserReencryptIdJSONRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	status := requestBody.Status
+	if status != models.OperationRunning && status != models.OperationCompleted && status != models.OperationFailed {
+		http.Error(w, fmt.Sprintf("unknown status %q, use %s, %s or %s", status,
+			models.OperationRunning, models.OperationCompleted, models.OperationFailed), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Only the device running the operation extends or finishes it, the others wait for it to end or expire
+	running, err := h.storage.GetRunningOperation(ctx, userID)
+	if errors.Is(err, models.ErrNotFound) || (err == nil && running.ID != id) {
+		writeNotFound(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if running.DeviceID != r.Header.Get(DeviceIDHeader) {
+		writeLocked(w, http.StatusLocked, errVaultLocked, running)
+		return
+	}
+
+	op, err := h.storage.UpdateUserOperation(ctx, userID, id, status, time.Now().Add(h.options.ReencryptTimeout()))
+	if errors.Is(err, models.ErrNotFound) {
+		writeNotFound(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if op.Status != models.OperationRunning {
+		h.auditOperation(ctx, op)
+	}
+
+	writeJSON(w, op)
+}
+
+// auditOperation records the start or the end of the operation in the audit log of its user.
+func (h *BaseController) auditOperation(ctx context.Context, op models.UserOperation) {
+	err := h.storage.AddAuditEvent(ctx, models.AuditEvent{
+		UserID:  op.UserID,
+		Action:  models.AuditReencrypt,
+		EntryID: op.ID,
+		Detail:  op.Status,
+		Success: true,
+	})
+	if err != nil {
+		h.log.Warn("failed to write audit event", zap.String("action", string(models.AuditReencrypt)), zap.Error(err))
+	}
+}
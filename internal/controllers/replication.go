@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// Replication is the replication of the vault of a user from a primary server, see SetReplication.
+type Replication interface {
+	// Replicates reports whether the vault of the user is the replica of one on the primary.
+	Replicates(userID int) bool
+	// Status returns the state of the replication as of its last round.
+	Status() models.ReplicationStatus
+}
+
+// errReadOnlyReplica is the error of the writes to a vault replicated from a primary server, they would be
+// overwritten by the next round, the clients write to the primary.
+var errReadOnlyReplica = errors.New("the vault is a read-only replica, write to the primary server")
+
+// replicaKey marks a request on a pulling route of a replicated user, in its context.
+type replicaKey struct{}
+
+// SetReplication sets the replication of the server, whose users' writes are rejected by WriteFence.
+func (h *BaseController) SetReplication(replication Replication) {
+	h.replication = replication
+}
+
+// replicated reports whether the writes of the user are rejected, their vault being replicated.
+func (h *BaseController) replicated(userID int) bool {
+	return h.replication != nil && h.replication.Replicates(userID)
+}
+
+// isReplica reports whether the request is on a pulling route of a replicated user, see WriteFence.
+func isReplica(ctx context.Context) bool {
+	replica, _ := ctx.Value(replicaKey{}).(bool)
+	return replica
+}
+
+// (GET /api/vault/checksum)
+func (h *BaseController) GetApiVaultChecksum(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	entries := make(map[string][]map[string]string, len(models.DataTables))
+	for _, table := range models.DataTables {
+		rows, err := h.storage.GetAllData(ctx, table, userID, models.VaultChecksumQuery)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		entries[table] = rows
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, models.ChecksumVault(userID, entries))
+}
+
+// (GET /api/admin/replication)
+func (h *BaseController) GetApiAdminReplication(w http.ResponseWriter, r *http.Request) {
+	if h.replication == nil {
+		http.Error(w, "the server doesn't replicate a primary server", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, h.replication.Status())
+}
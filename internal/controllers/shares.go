@@ -0,0 +1,123 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// errUnknownGrantee is the response to a share with a user who doesn't exist.
+var errUnknownGrantee = errors.New("unknown user")
+
+// (GET /api/shares)
+func (h *BaseController) GetApiShares(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// The entries shared with the user from the token as they are now, the sync pulls their changes
+	shared, err := h.storage.GetSharedWithUser(r.Context(), userID, time.Time{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, shared)
+}
+
+// (POST /api/{table}/{id}/shares)
+func (h *BaseController) PostApiTableIdShares(w http.ResponseWriter, r *http.Request, table string, id string) {
+	ctx := r.Context()
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !validTable(w, table) {
+		return
+	}
+	if !validEntryID(w, id) {
+		return
+	}
+
+	var requestBody PostApiTableIdSharesJSONRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if requestBody.Permission == "" {
+		requestBody.Permission = models.ShareRead
+	}
+	granteeID, err := h.storage.GetUserID(ctx, requestBody.Grantee)
+	if err != nil {
+		http.Error(w, errUnknownGrantee.Error(), http.StatusNotFound)
+		return
+	}
+
+	// Sharing an entry shared already changes its permission
+	share, err := h.storage.ShareEntry(ctx, models.Share{
+		OwnerID:    userID,
+		GranteeID:  granteeID,
+		Table:      table,
+		EntryID:    id,
+		Permission: requestBody.Permission,
+	})
+	if errors.Is(err, models.ErrInvalidShare) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, models.ErrNotFound) {
+		writeNotFound(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.publish(r, granteeID, models.VaultEvent{Table: table, EntryID: id, UpdatedAt: share.UpdatedAt})
+
+	writeJSON(w, share)
+}
+
+// (DELETE /api/{table}/{id}/shares/{grantee})
+func (h *BaseController) DeleteApiTableIdSharesGrantee(w http.ResponseWriter, r *http.Request, table string, id string, grantee string) {
+	ctx := r.Context()
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !validTable(w, table) {
+		return
+	}
+
+	// An unknown grantee has no share, like a grantee the entry isn't shared with
+	granteeID, err := h.storage.GetUserID(ctx, grantee)
+	if err != nil {
+		writeNotFound(w)
+		return
+	}
+	err = h.storage.RevokeShare(ctx, userID, granteeID, table, id)
+	if errors.Is(err, models.ErrNotFound) {
+		writeNotFound(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The grantee drops the entry on their next sync
+	h.publish(r, granteeID, models.VaultEvent{Table: table, EntryID: id, UpdatedAt: time.Now().UTC()})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeReadOnlyShare responds to a write to an entry shared read-only with the user.
+func writeReadOnlyShare(w http.ResponseWriter) {
+	http.Error(w, models.ErrReadOnlyShare.Error(), http.StatusForbidden)
+}
@@ -0,0 +1,38 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// (GET /api/sshkeys)
+func (h *BaseController) GetApiSshkeys(w http.ResponseWriter, r *http.Request, params GetApiSshkeysParams) {
+	userID, err := userIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	fingerprint, err := models.ParseSshFingerprint(params.Fingerprint)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The key pairs of the public key presented by a server or an agent, without their private keys,
+	// the full entry is returned by getData
+	data, err := h.storage.GetAllData(r.Context(), models.SshKeysTable, userID, models.DataQuery{
+		Columns: models.TableListColumns(models.SshKeysTable),
+		Filter:  models.Filter{{Column: models.SshFingerprintField, Op: models.FilterEq, Value: fingerprint}},
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if data == nil {
+		data = []map[string]string{}
+	}
+
+	writeJSON(w, data)
+}
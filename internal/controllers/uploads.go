@@ -0,0 +1,567 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"github.com/wurt83ow/gophkeeper-server/internal/storage"
+	"go.uber.org/zap"
+)
+
+// UploadStagingDir is the directory under the file storage where the chunks of the uploads are staged,
+// in a directory per upload session named by its id, until they are committed into a file.
+const UploadStagingDir = ".uploads"
+
+// maxUploadChunks bounds the number of chunks of an upload, numbered from 0, and with the size
+// of a chunk the size of an upload.
+const maxUploadChunks = 10000
+
+// errUploadTooLarge is the response to the chunks which are larger than the size of their upload.
+var errUploadTooLarge = errors.New("the chunks are larger than the size of the upload")
+
+// errFileTaken is the error of an upload to the id of a file entry of another user. The files of all the users
+// are stored by the ids of their entries, the upload would overwrite the file of the other user.
+var errFileTaken = fmt.Errorf("%w: the id is taken by another entry", storage.ErrConflict)
+
+// uploadStatus is an upload session with the chunks staged so far, for a client to resume the upload
+// by sending the others.
+type uploadStatus struct {
+	models.UploadSession
+	Chunks   []int `json:"chunks"`
+	Received int64 `json:"received"`
+}
+
+// missingChunks is the response to the commit of an upload which lacks some of its chunks.
+type missingChunks struct {
+	Error   string `json:"error"`
+	Missing []int  `json:"missing"`
+}
+
+// (POST /api/files/{id}/upload)
+func (h *BaseController) PostApiFilesIdUpload(w http.ResponseWriter, r *http.Request, id string) {
+	if !validEntryID(w, id) {
+		return
+	}
+	var requestBody PostApiFilesIdUploadJSONRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if requestBody.Size <= 0 {
+		http.Error(w, "the size of the upload must be positive", http.StatusBadRequest)
+		return
+	}
+	if maxSize := int64(maxUploadChunks) * int64(h.options.UploadChunkMaxSize()); requestBody.Size > maxSize {
+		http.Error(w, fmt.Sprintf("the upload is larger than %d bytes", maxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	ctx := r.Context()
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if taken, err := h.storage.FileEntryTaken(ctx, userID, id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if taken {
+		http.Error(w, errFileTaken.Error(), http.StatusConflict)
+		return
+	}
+
+	session, err := h.storage.CreateUploadSession(ctx, models.UploadSession{
+		ID:        uuid.NewString(),
+		UserID:    userID,
+		EntryID:   id,
+		Size:      requestBody.Size,
+		ExpiresAt: time.Now().Add(h.options.UploadSessionTTL()),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := os.MkdirAll(h.stagingPath(session.ID), 0700); err != nil {
+		h.dropUploadSession(r, session)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	responseBytes, err := json.Marshal(session)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(responseBytes)
+}
+
+// (GET /api/files/{id}/upload/{uploadId})
+func (h *BaseController) GetApiFilesIdUploadUploadId(w http.ResponseWriter, r *http.Request, id string, uploadId string) {
+	_, session, ok := h.uploadSession(w, r, id, uploadId)
+	if !ok {
+		return
+	}
+
+	chunks, received, err := stagedChunks(h.stagingPath(session.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, uploadStatus{UploadSession: session, Chunks: chunks, Received: received})
+}
+
+// (PUT /api/files/{id}/upload/{uploadId}/{chunk})
+func (h *BaseController) PutApiFilesIdUploadUploadIdChunk(w http.ResponseWriter, r *http.Request, id string, uploadId string, chunk int) {
+	if chunk < 0 || chunk >= maxUploadChunks {
+		http.Error(w, fmt.Sprintf("the chunk number must be from 0 to %d", maxUploadChunks-1), http.StatusBadRequest)
+		return
+	}
+	_, session, ok := h.uploadSession(w, r, id, uploadId)
+	if !ok {
+		return
+	}
+
+	// A chunk on a slow link takes longer to receive than the write timeout of the server
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The chunk is staged under a temporary name and renamed, so a dropped connection leaves no partial chunk.
+	// A chunk sent again replaces the one staged.
+	dir := h.stagingPath(session.ID)
+	tmp, err := os.CreateTemp(dir, ".chunk-*")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(tmp, http.MaxBytesReader(w, r.Body, int64(h.options.UploadChunkMaxSize())))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("the chunk is larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := strconv.Itoa(chunk)
+	chunks, received, err := stagedChunks(dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if i := sort.SearchInts(chunks, chunk); i < len(chunks) && chunks[i] == chunk {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		received -= info.Size()
+	}
+	if received+written > session.Size {
+		http.Error(w, errUploadTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// (POST /api/files/{id}/upload/{uploadId}/commit)
+func (h *BaseController) PostApiFilesIdUploadUploadIdCommit(w http.ResponseWriter, r *http.Request, id string, uploadId string) {
+	var requestBody PostApiFilesIdUploadUploadIdCommitJSONRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if requestBody.Chunks <= 0 || requestBody.Chunks > maxUploadChunks {
+		http.Error(w, fmt.Sprintf("the number of chunks must be from 1 to %d", maxUploadChunks), http.StatusBadRequest)
+		return
+	}
+	checksum, err := hex.DecodeString(requestBody.Sha256)
+	if err != nil || len(checksum) != sha256.Size {
+		http.Error(w, "the sha256 of the upload must be 64 hexadecimal digits", http.StatusBadRequest)
+		return
+	}
+	if !h.allowedFields(w, requestBody.Fields) {
+		return
+	}
+
+	userID, session, ok := h.uploadSession(w, r, id, uploadId)
+	if !ok {
+		return
+	}
+
+	// Assembling and moving a large file takes longer than the write timeout of the server
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The file is assembled next to the files, so it is moved in place by a rename
+	dir := h.stagingPath(session.ID)
+	assembled, missing, err := h.assembleUpload(dir, requestBody.Chunks, session.Size, checksum)
+	if len(missing) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(missingChunks{Error: "the upload lacks chunks", Missing: missing})
+		return
+	}
+	if errors.Is(err, errUploadMismatch) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(assembled)
+
+	ctx := r.Context()
+	_, err = h.storage.GetData(ctx, models.FilesTable, userID, id, true)
+	exists := err == nil
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Ending the session claims the upload, of two commits racing each other the other one finds no session
+	if err := h.storage.DeleteUploadSession(ctx, userID, session.ID); errors.Is(err, models.ErrNotFound) {
+		writeNotFound(w)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var updatedAt time.Time
+	if h.blobs != nil {
+		updatedAt, err = h.commitBlob(r, userID, id, assembled, session.Size, checksum, requestBody.Fields)
+	} else {
+		updatedAt, err = h.replaceFile(r, userID, id, session.ID, assembled, exists, requestBody.Fields)
+	}
+	if err != nil {
+		// The chunks are still staged, the session is restored for the commit to be retried
+		if _, createErr := h.storage.CreateUploadSession(ctx, session); createErr != nil {
+			h.log.Warn("failed to restore upload session", zap.String("upload_id", session.ID), zap.Error(createErr))
+		}
+		if errors.Is(err, models.ErrInvalidChange) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, storage.ErrConflict) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		h.log.Warn("failed to delete staged chunks", zap.String("upload_id", session.ID), zap.Error(err))
+	}
+
+	h.publish(r, userID, models.VaultEvent{Table: models.FilesTable, EntryID: id, UpdatedAt: updatedAt})
+
+	writeJSON(w, map[string]interface{}{
+		"id":         id,
+		"updated_at": updatedAt,
+	})
+}
+
+// (DELETE /api/files/{id}/upload/{uploadId})
+func (h *BaseController) DeleteApiFilesIdUploadUploadId(w http.ResponseWriter, r *http.Request, id string, uploadId string) {
+	userID, session, ok := h.uploadSession(w, r, id, uploadId)
+	if !ok {
+		return
+	}
+
+	err := h.storage.DeleteUploadSession(r.Context(), userID, session.ID)
+	if errors.Is(err, models.ErrNotFound) {
+		writeNotFound(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := os.RemoveAll(h.stagingPath(session.ID)); err != nil {
+		h.log.Warn("failed to delete staged chunks", zap.String("upload_id", session.ID), zap.Error(err))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadSession returns the user of the request and their upload session with the id for the file entry,
+// responding with 404 if they have no such session or it expired.
+func (h *BaseController) uploadSession(w http.ResponseWriter, r *http.Request, entryID, uploadID string) (int, models.UploadSession, bool) {
+	userID, err := userIDFromContext(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return 0, models.UploadSession{}, false
+	}
+	// The id names the staging directory, only a UUID is looked up
+	if _, err := uuid.Parse(uploadID); err != nil {
+		writeNotFound(w)
+		return 0, models.UploadSession{}, false
+	}
+
+	session, err := h.storage.GetUploadSession(r.Context(), userID, uploadID)
+	if errors.Is(err, models.ErrNotFound) || (err == nil && session.EntryID != entryID) {
+		writeNotFound(w)
+		return 0, models.UploadSession{}, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return 0, models.UploadSession{}, false
+	}
+
+	return userID, session, true
+}
+
+// stagingPath returns the directory of the chunks of the upload session.
+func (h *BaseController) stagingPath(uploadID string) string {
+	return filepath.Join(h.options.FileStoragePath(), UploadStagingDir, uploadID)
+}
+
+// dropUploadSession deletes the upload session which couldn't be started.
+func (h *BaseController) dropUploadSession(r *http.Request, session models.UploadSession) {
+	if err := h.storage.DeleteUploadSession(r.Context(), session.UserID, session.ID); err != nil {
+		h.log.Warn("failed to delete upload session", zap.String("upload_id", session.ID), zap.Error(err))
+	}
+}
+
+// stagedChunks returns the numbers of the chunks staged in the directory, in order, and their size in bytes.
+func stagedChunks(dir string) ([]int, int64, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read staged chunks: %w", err)
+	}
+
+	chunks := make([]int, 0, len(files))
+	var size int64
+	for _, file := range files {
+		// The chunks being received have a temporary name
+		n, err := strconv.Atoi(file.Name())
+		if err != nil {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read staged chunks: %w", err)
+		}
+		chunks = append(chunks, n)
+		size += info.Size()
+	}
+	sort.Ints(chunks)
+
+	return chunks, size, nil
+}
+
+// errUploadMismatch is the error of an assembled upload whose size or checksum isn't the one of the client.
+var errUploadMismatch = errors.New("the upload doesn't match")
+
+// assembleUpload concatenates the chunks 0 to n-1 staged in the directory into a temporary file
+// in the file storage and returns its path. It returns the numbers of the chunks missing, if any,
+// and errUploadMismatch if the file hasn't the size or the SHA-256 of the upload.
+func (h *BaseController) assembleUpload(dir string, n int, size int64, checksum []byte) (string, []int, error) {
+	var missing []int
+	for i := 0; i < n; i++ {
+		if _, err := os.Stat(filepath.Join(dir, strconv.Itoa(i))); errors.Is(err, os.ErrNotExist) {
+			missing = append(missing, i)
+		} else if err != nil {
+			return "", nil, err
+		}
+	}
+	if len(missing) > 0 {
+		return "", missing, nil
+	}
+
+	out, err := os.CreateTemp(h.options.FileStoragePath(), ".upload-*")
+	if err != nil {
+		return "", nil, err
+	}
+	hash := sha256.New()
+	written, err := appendChunks(io.MultiWriter(out, hash), dir, n)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	switch {
+	case err != nil:
+	case written != size:
+		err = fmt.Errorf("%w: %d bytes were received of %d", errUploadMismatch, written, size)
+	case !bytes.Equal(hash.Sum(nil), checksum):
+		err = fmt.Errorf("%w: the sha256 is %x", errUploadMismatch, hash.Sum(nil))
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", nil, err
+	}
+
+	return out.Name(), nil, nil
+}
+
+// appendChunks writes the chunks 0 to n-1 staged in the directory to w and returns the bytes written.
+func appendChunks(w io.Writer, dir string, n int) (int64, error) {
+	var written int64
+	for i := 0; i < n; i++ {
+		chunk, err := os.Open(filepath.Join(dir, strconv.Itoa(i)))
+		if err != nil {
+			return written, err
+		}
+		copied, err := io.Copy(w, chunk)
+		chunk.Close()
+		written += copied
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// replaceFile moves the assembled file in place of the file of the entry and writes the entry with the fields,
+// adding it unless it exists. The previous file is kept aside under the id of the upload and put back
+// if the entry can't be written. It returns errFileTaken, touching no file, if another user took the id
+// since the upload started.
+func (h *BaseController) replaceFile(r *http.Request, userID int, entryID, uploadID, assembled string, exists bool, fields map[string]string) (time.Time, error) {
+	taken, err := h.storage.FileEntryTaken(r.Context(), userID, entryID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if taken {
+		return time.Time{}, errFileTaken
+	}
+
+	path := filepath.Join(h.options.FileStoragePath(), entryID)
+	previous := path + "." + uploadID
+	hadPrevious := true
+	if err := os.Rename(path, previous); errors.Is(err, os.ErrNotExist) {
+		hadPrevious = false
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	if err := os.Rename(assembled, path); err != nil {
+		h.restoreFile(path, previous, hadPrevious)
+		return time.Time{}, err
+	}
+
+	if fields == nil {
+		fields = map[string]string{}
+	}
+	var updatedAt time.Time
+	if exists {
+		updatedAt, err = h.storage.UpdateData(r.Context(), models.FilesTable, userID, entryID, fields)
+	} else {
+		_, updatedAt, err = h.storage.AddData(r.Context(), models.FilesTable, userID, entryID, fields)
+	}
+	if err != nil {
+		h.restoreFile(path, previous, hadPrevious)
+		return time.Time{}, err
+	}
+	if hadPrevious {
+		os.Remove(previous)
+	}
+
+	return updatedAt, nil
+}
+
+// commitBlob writes the entry with the fields, adding it unless it exists, pointing at the contents of the checksum
+// in the blob store, then deletes the objects no entry points at any more. The contents stored for another entry
+// are shared, new ones are put from the assembled file under a new key before the entry is written again,
+// so an entry never points at a missing object: the object of an entry which couldn't be written is deleted,
+// one left by a crash in between is deleted by the reconciliation of the store.
+func (h *BaseController) commitBlob(r *http.Request, userID int, entryID, assembled string, size int64, checksum []byte, fields map[string]string) (time.Time, error) {
+	ctx := r.Context()
+	if fields == nil {
+		fields = map[string]string{}
+	}
+
+	blob := models.FileBlob{Size: size, SHA256: hex.EncodeToString(checksum)}
+	released, updatedAt, err := h.storage.WriteFileBlob(ctx, userID, entryID, fields, blob)
+	if errors.Is(err, models.ErrBlobNotStored) {
+		blob.Key = fileBlobKey(blob.SHA256)
+		if err := h.putBlob(ctx, blob, assembled); err != nil {
+			return time.Time{}, err
+		}
+		released, updatedAt, err = h.storage.WriteFileBlob(ctx, userID, entryID, fields, blob)
+		if err != nil {
+			h.deleteBlob(ctx, blob.Key)
+		}
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	for _, key := range released {
+		h.deleteBlob(ctx, key)
+	}
+	// The file kept on disk before the store was configured, if any, is replaced
+	if err := os.Remove(filepath.Join(h.options.FileStoragePath(), entryID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		h.log.Warn("failed to delete file", zap.String("entry_id", entryID), zap.Error(err))
+	}
+
+	return updatedAt, nil
+}
+
+// putBlob puts the file at the path into the blob store as the object of the blob.
+func (h *BaseController) putBlob(ctx context.Context, blob models.FileBlob, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := h.blobs.Put(ctx, blob.Key, file, blob.Size); err != nil {
+		return fmt.Errorf("failed to store file: %w", err)
+	}
+
+	return nil
+}
+
+// restoreFile puts the previous file of an entry back in place, or removes the new one if there was none.
+func (h *BaseController) restoreFile(path, previous string, hadPrevious bool) {
+	var err error
+	if hadPrevious {
+		err = os.Rename(previous, path)
+	} else {
+		err = os.Remove(path)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		h.log.Warn("failed to restore file", zap.String("path", path), zap.Error(err))
+	}
+}
@@ -0,0 +1,347 @@
+// Package egress enforces the policy of the connections the server opens to the outside, such as to the SMTP server
+// or the username checker. The features get their dialer or HTTP client from the Policy rather than building their own,
+// so every outbound connection is checked the same way and counted by destination class.
+package egress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Class is the kind of destination a feature connects to, the policy has rules per class.
+type Class string
+
+const (
+	// ClassSMTP is the SMTP server sending the account emails
+	ClassSMTP Class = "smtp"
+	// ClassUsernameChecker is the external service moderating the usernames
+	ClassUsernameChecker Class = "username_checker"
+	// ClassReplication is the primary server the vault of a user is replicated from
+	ClassReplication Class = "replication"
+	// ClassObjectStore is the S3 or MinIO endpoint the contents of the files are stored in
+	ClassObjectStore Class = "object_store"
+)
+
+// Classes are the destination classes the rules may be given for.
+var Classes = []Class{ClassSMTP, ClassUsernameChecker, ClassReplication, ClassObjectStore}
+
+// Metrics counts the outbound connections by destination class.
+type Metrics interface {
+	// ObserveEgress counts a connection to a destination of the class, allowed or denied.
+	ObserveEgress(class string, allowed bool)
+}
+
+// Resolver resolves the hosts connected to, *net.Resolver implements it.
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// DialFunc opens a connection to the address, as net.Dialer.DialContext.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Rule lists the destinations allowed for a class. A destination is allowed if its host matches one of the hosts
+// or its address is in one of the prefixes, or if the rule is empty. The private, loopback and link-local addresses
+// are denied even so, unless they are in one of the prefixes: a host name can't open them.
+type Rule struct {
+	// Prefixes are the ranges of addresses allowed, the private ones included
+	Prefixes []netip.Prefix
+	// Hosts are the host names allowed, "*.example.com" matches the subdomains of example.com
+	Hosts []string
+}
+
+// nonPublic are the ranges of addresses which aren't reachable on the Internet besides the private,
+// loopback, link-local, multicast and unspecified ones netip tells apart.
+var nonPublic = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// public reports whether the address is reachable on the Internet.
+func public(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublic {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// addrReason tells why an address the rule doesn't allow is denied.
+func addrReason(addr netip.Addr) string {
+	if public(addr) {
+		return "the address isn't allowed"
+	}
+	return "the address is private"
+}
+
+// matchHost reports whether the host matches one of the patterns.
+func (r Rule) matchHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range r.Hosts {
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+			if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allows reports whether an address the host resolved to may be connected to.
+func (r Rule) allows(hostMatched bool, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range r.Prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	empty := len(r.Prefixes) == 0 && len(r.Hosts) == 0
+	return public(addr) && (empty || hostMatched)
+}
+
+// DeniedError is returned for a connection the policy denies.
+type DeniedError struct {
+	Class Class
+	// Host is the host connected to, as the feature named it
+	Host string
+	// Addr is the address denied, empty if the host itself isn't allowed
+	Addr string
+	// Reason tells why the connection was denied
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+	if e.Addr != "" {
+		return fmt.Sprintf("egress to %s (%s) of class %s denied: %s", e.Host, e.Addr, e.Class, e.Reason)
+	}
+	return fmt.Sprintf("egress to %s of class %s denied: %s", e.Host, e.Class, e.Reason)
+}
+
+// MarshalLogObject logs the denial as its fields.
+func (e *DeniedError) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("class", string(e.Class))
+	enc.AddString("host", e.Host)
+	if e.Addr != "" {
+		enc.AddString("addr", e.Addr)
+	}
+	enc.AddString("reason", e.Reason)
+	return nil
+}
+
+// Field returns the denial behind the error as a log field, or a field logging nothing if the policy didn't deny it.
+func Field(err error) zap.Field {
+	var denied *DeniedError
+	if errors.As(err, &denied) {
+		return zap.Object("egress_denied", denied)
+	}
+	return zap.Skip()
+}
+
+// Policy checks the outbound connections against the rules of their destination class.
+// The classes without a rule may connect to any public address.
+type Policy struct {
+	rules    map[Class]Rule
+	proxy    *url.URL
+	resolver Resolver
+	metrics  Metrics
+	dialer   net.Dialer
+}
+
+// NewPolicy creates a new instance of Policy with the rules per class. The HTTP clients connect through the proxy
+// if it isn't nil; the proxy resolves the hosts then, so only the host names and address literals are checked.
+func NewPolicy(rules map[Class]Rule, proxy *url.URL) *Policy {
+	return &Policy{
+		rules:    rules,
+		proxy:    proxy,
+		resolver: net.DefaultResolver,
+		dialer:   net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+	}
+}
+
+// SetMetrics sets the metrics the connections are counted with.
+func (p *Policy) SetMetrics(m Metrics) {
+	p.metrics = m
+}
+
+// observe counts a connection of the class.
+func (p *Policy) observe(class Class, allowed bool) {
+	if p.metrics != nil {
+		p.metrics.ObserveEgress(string(class), allowed)
+	}
+}
+
+// check returns the addresses of the host the class may connect to, resolving it unless it is an address.
+func (p *Policy) check(ctx context.Context, class Class, host string) ([]netip.Addr, error) {
+	rule := p.rules[class]
+
+	addrs := []netip.Addr{}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = append(addrs, addr)
+	} else {
+		resolved, err := p.resolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+		addrs = resolved
+	}
+
+	hostMatched := rule.matchHost(host)
+	allowed := make([]netip.Addr, 0, len(addrs))
+	for _, addr := range addrs {
+		if rule.allows(hostMatched, addr) {
+			allowed = append(allowed, addr)
+		}
+	}
+	if len(allowed) == 0 {
+		p.observe(class, false)
+		denied := &DeniedError{Class: class, Host: host, Reason: "the host isn't allowed"}
+		if len(addrs) > 0 && (hostMatched || len(rule.Hosts) == 0) {
+			denied.Addr, denied.Reason = addrs[0].String(), addrReason(addrs[0])
+		}
+		return nil, denied
+	}
+	p.observe(class, true)
+
+	return allowed, nil
+}
+
+// Dialer returns the dialer of the connections of the class. It resolves the host once and connects to the very
+// addresses it checked, so a host resolving to another address in between, the DNS rebinding, can't reach it.
+func (p *Policy) Dialer(class Class) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := p.check(ctx, class, host)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ip := range addrs {
+			var conn net.Conn
+			conn, err = p.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+
+		return nil, err
+	}
+}
+
+// HTTPClient returns a client of the destination class, whose requests time out after the timeout if it isn't 0.
+// The redirects are checked as the first request.
+func (p *Policy) HTTPClient(class Class, timeout time.Duration) *http.Client {
+	transport := &http.Transport{
+		DialContext:           p.Dialer(class),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	if p.proxy != nil {
+		// The proxy is connected to as configured, the requests are checked by their host instead
+		transport.DialContext = p.dialer.DialContext
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if err := p.checkProxied(class, req.URL.Hostname()); err != nil {
+				return nil, err
+			}
+			return p.proxy, nil
+		}
+	}
+
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// checkProxied checks a host requested through the proxy, which resolves it.
+// A host name must match the rule of the class, an address must be allowed by it.
+func (p *Policy) checkProxied(class Class, host string) error {
+	rule := p.rules[class]
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if !rule.allows(false, addr) {
+			p.observe(class, false)
+			return &DeniedError{Class: class, Host: host, Addr: addr.String(), Reason: addrReason(addr)}
+		}
+	} else if len(rule.Hosts) > 0 || len(rule.Prefixes) > 0 {
+		if !rule.matchHost(host) {
+			p.observe(class, false)
+			return &DeniedError{Class: class, Host: host, Reason: "the host isn't allowed"}
+		}
+	}
+	p.observe(class, true)
+
+	return nil
+}
+
+// ParseRules parses the rules of the classes, as "class=entry,entry;class=entry". An entry is a range of addresses
+// in CIDR notation, an address, or a host name which may start with "*." to match the subdomains.
+func ParseRules(spec string) (map[Class]Rule, error) {
+	rules := make(map[Class]Rule)
+	for _, part := range strings.Split(spec, ";") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		name, list, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("egress rule %q: missing class", part)
+		}
+		class := Class(strings.TrimSpace(name))
+		if !knownClass(class) {
+			return nil, fmt.Errorf("egress rule %q: unknown class %q", part, class)
+		}
+
+		rule := rules[class]
+		for _, entry := range strings.Split(list, ",") {
+			entry = strings.ToLower(strings.TrimSpace(entry))
+			if entry == "" {
+				continue
+			}
+			if prefix, err := netip.ParsePrefix(entry); err == nil {
+				rule.Prefixes = append(rule.Prefixes, prefix.Masked())
+			} else if addr, err := netip.ParseAddr(entry); err == nil {
+				rule.Prefixes = append(rule.Prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			} else if strings.Contains(entry, "/") || strings.Contains(strings.TrimPrefix(entry, "*."), "*") {
+				return nil, fmt.Errorf("egress rule %q: invalid entry %q", part, entry)
+			} else {
+				rule.Hosts = append(rule.Hosts, strings.TrimSuffix(entry, "."))
+			}
+		}
+		rules[class] = rule
+	}
+
+	return rules, nil
+}
+
+// knownClass reports whether the class is one of Classes.
+func knownClass(class Class) bool {
+	for _, c := range Classes {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,216 @@
+package egress
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeResolver answers the lookups with the answers in turn, repeating the last one.
+type fakeResolver struct {
+	mu      sync.Mutex
+	answers [][]netip.Addr
+	lookups int
+}
+
+func (r *fakeResolver) LookupNetIP(_ context.Context, _, _ string) ([]netip.Addr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	answer := r.answers[min(r.lookups, len(r.answers)-1)]
+	r.lookups++
+	return answer, nil
+}
+
+// countingMetrics counts the connections by class and result.
+type countingMetrics struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (m *countingMetrics) ObserveEgress(class string, allowed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.counts == nil {
+		m.counts = make(map[string]int)
+	}
+	m.counts[fmt.Sprintf("%s/%t", class, allowed)]++
+}
+
+func (m *countingMetrics) count(class Class, allowed bool) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.counts[fmt.Sprintf("%s/%t", class, allowed)]
+}
+
+// loopback allows the loopback address the test servers listen on.
+var loopback = []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules(" smtp = 10.0.0.0/8, Mail.Example.com. ; username_checker=*.moderation.example,192.168.1.7")
+	require.NoError(t, err)
+	assert.Equal(t, Rule{
+		Prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		Hosts:    []string{"mail.example.com"},
+	}, rules[ClassSMTP])
+	assert.Equal(t, Rule{
+		Prefixes: []netip.Prefix{netip.MustParsePrefix("192.168.1.7/32")},
+		Hosts:    []string{"*.moderation.example"},
+	}, rules[ClassUsernameChecker])
+
+	rules, err = ParseRules("")
+	require.NoError(t, err)
+	assert.Empty(t, rules)
+
+	for _, spec := range []string{"smtp", "webhooks=example.com", "smtp=10.0.0.0/33", "smtp=mail.*.example.com"} {
+		_, err := ParseRules(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestPolicy_Check(t *testing.T) {
+	ctx := context.Background()
+	public, private := netip.MustParseAddr("93.184.216.34"), netip.MustParseAddr("10.1.2.3")
+	tests := []struct {
+		name    string
+		rule    Rule
+		host    string
+		addrs   []netip.Addr
+		allowed []netip.Addr
+	}{
+		{name: "public address without rule", host: "example.com", addrs: []netip.Addr{public}, allowed: []netip.Addr{public}},
+		{name: "private address without rule", host: "example.com", addrs: []netip.Addr{private}},
+		{name: "metadata address", host: "169.254.169.254"},
+		{name: "mapped loopback", host: "::ffff:127.0.0.1"},
+		{name: "shared address space", host: "100.64.0.1"},
+		{name: "private addresses are skipped", host: "example.com", addrs: []netip.Addr{private, public}, allowed: []netip.Addr{public}},
+		{
+			name: "host matching", rule: Rule{Hosts: []string{"*.example.com"}},
+			host: "api.example.com", addrs: []netip.Addr{public}, allowed: []netip.Addr{public},
+		},
+		{name: "host not matching", rule: Rule{Hosts: []string{"*.example.com"}}, host: "example.com", addrs: []netip.Addr{public}},
+		{name: "host doesn't open a private address", rule: Rule{Hosts: []string{"internal.example.com"}}, host: "internal.example.com", addrs: []netip.Addr{private}},
+		{
+			name: "prefix opens a private address", rule: Rule{Prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}},
+			host: "relay.internal", addrs: []netip.Addr{private}, allowed: []netip.Addr{private},
+		},
+		{name: "prefix only", rule: Rule{Prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}, host: "example.com", addrs: []netip.Addr{public}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPolicy(map[Class]Rule{ClassSMTP: tt.rule}, nil)
+			p.resolver = &fakeResolver{answers: [][]netip.Addr{tt.addrs}}
+
+			allowed, err := p.check(ctx, ClassSMTP, tt.host)
+			if tt.allowed == nil {
+				var denied *DeniedError
+				require.ErrorAs(t, err, &denied)
+				assert.Equal(t, ClassSMTP, denied.Class)
+				assert.Equal(t, tt.host, denied.Host)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.allowed, allowed)
+		})
+	}
+}
+
+func TestPolicy_HTTPClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	// The checker is denied the private address of the server by default, and the denial is counted
+	m := &countingMetrics{}
+	p := NewPolicy(nil, nil)
+	p.SetMetrics(m)
+	_, err := p.HTTPClient(ClassUsernameChecker, time.Second).Get(srv.URL)
+	var denied *DeniedError
+	require.ErrorAs(t, err, &denied)
+	assert.Equal(t, DeniedError{Class: ClassUsernameChecker, Host: "127.0.0.1", Addr: "127.0.0.1", Reason: "the address is private"}, *denied)
+	assert.Equal(t, 1, m.count(ClassUsernameChecker, false))
+
+	// A destination allowed by the rule of the class is reached, the other classes are still denied
+	p = NewPolicy(map[Class]Rule{ClassUsernameChecker: {Prefixes: loopback}}, nil)
+	p.SetMetrics(m)
+	resp, err := p.HTTPClient(ClassUsernameChecker, time.Second).Get(srv.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1, m.count(ClassUsernameChecker, true))
+
+	_, err = p.HTTPClient(ClassSMTP, time.Second).Get(srv.URL)
+	assert.ErrorAs(t, err, &denied)
+}
+
+func TestPolicy_DNSRebinding(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+
+	// The host resolves to the allowed address first, then to the metadata service
+	p := NewPolicy(map[Class]Rule{ClassUsernameChecker: {Prefixes: loopback}}, nil)
+	resolver := &fakeResolver{answers: [][]netip.Addr{
+		{netip.MustParseAddr("127.0.0.1")},
+		{netip.MustParseAddr("169.254.169.254")},
+	}}
+	p.resolver = resolver
+	client := p.HTTPClient(ClassUsernameChecker, time.Second)
+	target := fmt.Sprintf("http://moderation.example:%d/", port)
+
+	// The connection goes to the address checked without resolving the host again
+	resp, err := client.Get(target)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 1, resolver.lookups)
+
+	// A new connection resolves the host again and is denied the address it got
+	client.CloseIdleConnections()
+	_, err = client.Get(target)
+	var denied *DeniedError
+	require.ErrorAs(t, err, &denied)
+	assert.Equal(t, "169.254.169.254", denied.Addr)
+}
+
+func TestPolicy_Proxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		io.WriteString(w, "ok")
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+
+	// The proxy is reached although it is private, the requests are checked by their host
+	p := NewPolicy(map[Class]Rule{ClassUsernameChecker: {Hosts: []string{"moderation.example"}}}, proxyURL)
+	client := p.HTTPClient(ClassUsernameChecker, time.Second)
+	resp, err := client.Get("http://moderation.example/check")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, []string{"http://moderation.example/check"}, proxied)
+
+	var denied *DeniedError
+	_, err = client.Get("http://other.example/check")
+	assert.ErrorAs(t, err, &denied)
+	_, err = client.Get("http://10.0.0.1/check")
+	require.ErrorAs(t, err, &denied)
+	assert.Equal(t, "the address is private", denied.Reason)
+	assert.Len(t, proxied, 1)
+}
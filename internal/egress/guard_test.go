@@ -0,0 +1,136 @@
+package egress
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// forbiddenCalls are the identifiers connecting to the outside without the policy.
+var forbiddenCalls = map[string][]string{
+	"net/http":   {"DefaultClient", "DefaultTransport", "Get", "Head", "Post", "PostForm"},
+	"net":        {"Dial", "DialTimeout"},
+	"net/smtp":   {"Dial", "SendMail"},
+	"crypto/tls": {"Dial", "DialWithDialer"},
+}
+
+// forbiddenTypes are the types of the clients and dialers built by the policy only.
+var forbiddenTypes = map[string][]string{
+	"net/http": {"Client", "Transport"},
+	"net":      {"Dialer"},
+}
+
+// TestNoDirectEgress fails if the code of the server, the tests aside, connects to the outside
+// without the policy, e.g. with http.DefaultClient or a client of its own.
+func TestNoDirectEgress(t *testing.T) {
+	fset := token.NewFileSet()
+	for _, root := range []string{"..", "../../cmd"} {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() && (d.Name() == "egress" || d.Name() == "testdata") {
+				return filepath.SkipDir
+			}
+			if d.IsDir() || !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+				return nil
+			}
+
+			file, err := parser.ParseFile(fset, path, nil, 0)
+			if err != nil {
+				return err
+			}
+			for _, pos := range directEgress(file) {
+				t.Errorf("%s: connects to the outside without the egress policy", fset.Position(pos))
+			}
+			return nil
+		})
+		require.NoError(t, err)
+	}
+}
+
+// directEgress returns the positions of the file using a forbidden identifier.
+func directEgress(file *ast.File) []token.Pos {
+	imports := make(map[string]string)
+	for _, imp := range file.Imports {
+		path, _ := strconv.Unquote(imp.Path.Value)
+		name := path[strings.LastIndex(path, "/")+1:]
+		if imp.Name != nil {
+			name = imp.Name.Name
+		}
+		imports[name] = path
+	}
+	refers := func(expr ast.Expr, forbidden map[string][]string) bool {
+		sel, ok := expr.(*ast.SelectorExpr)
+		if !ok {
+			return false
+		}
+		pkg, ok := sel.X.(*ast.Ident)
+		if !ok {
+			return false
+		}
+		for _, name := range forbidden[imports[pkg.Name]] {
+			if sel.Sel.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	var found []token.Pos
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.SelectorExpr:
+			if refers(n, forbiddenCalls) {
+				found = append(found, n.Pos())
+			}
+		case *ast.CompositeLit:
+			if refers(n.Type, forbiddenTypes) {
+				found = append(found, n.Pos())
+			}
+		case *ast.CallExpr:
+			if fn, ok := n.Fun.(*ast.Ident); ok && fn.Name == "new" && len(n.Args) == 1 && refers(n.Args[0], forbiddenTypes) {
+				found = append(found, n.Pos())
+			}
+		}
+		return true
+	})
+
+	return found
+}
+
+func TestDirectEgress(t *testing.T) {
+	src := `package feature
+
+import (
+	"net/http"
+	nethttp "net/http"
+	"net/smtp"
+)
+
+var client = &http.Client{}
+
+func send() {
+	http.DefaultClient.Do(nil)
+	nethttp.Get("http://169.254.169.254/")
+	smtp.SendMail("", nil, "", nil, nil)
+	_ = new(http.Transport)
+	var ok *http.Client
+	_ = ok
+	_ = http.MethodPost
+}
+`
+	file, err := parser.ParseFile(token.NewFileSet(), "feature.go", src, 0)
+	require.NoError(t, err)
+
+	// The clients built and the connections opened are found, the types and constants aren't
+	assert.Len(t, directEgress(file), 5)
+}
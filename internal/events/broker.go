@@ -0,0 +1,114 @@
+// Package events delivers the changes made to the vault of a user to the other sessions of the user
+// holding an event stream, so their clients synchronize when something changed instead of polling.
+package events
+
+import (
+	"context"
+	"sync"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// bufferSize is the number of events a subscriber may lag behind. The events of a slower one are dropped,
+// it synchronizes on the events it reads anyway, which fetches the dropped changes as well.
+const bufferSize = 16
+
+// Broker delivers the events published by a session of a user to the subscriptions of the other sessions
+// of the user. The sessions are told apart by their device; the sessions without one receive every event.
+// The events only reach the subscriptions of this instance, those of the other instances
+// are published by the keeper's change listener.
+type Broker struct {
+	mu     sync.Mutex
+	subs   map[int]map[*subscriber]struct{}
+	closed bool
+}
+
+// subscriber is the subscription of a session, deviceID is empty for a session without a device.
+type subscriber struct {
+	deviceID string
+	ch       chan models.VaultEvent
+}
+
+// NewBroker creates a broker delivering the events within this instance.
+func NewBroker() *Broker {
+	return &Broker{subs: make(map[int]map[*subscriber]struct{})}
+}
+
+// Subscribe returns the events published by the other sessions of the user until cancel is called
+// or the broker is closed, which closes the channel.
+func (b *Broker) Subscribe(userID int, deviceID string) (<-chan models.VaultEvent, func()) {
+	s := &subscriber{deviceID: deviceID, ch: make(chan models.VaultEvent, bufferSize)}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(s.ch)
+		return s.ch, func() {}
+	}
+	if b.subs[userID] == nil {
+		b.subs[userID] = make(map[*subscriber]struct{})
+	}
+	b.subs[userID][s] = struct{}{}
+
+	cancel := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[userID][s]; !ok {
+			return
+		}
+		delete(b.subs[userID], s)
+		if len(b.subs[userID]) == 0 {
+			delete(b.subs, userID)
+		}
+		close(s.ch)
+	}
+
+	return s.ch, cancel
+}
+
+// Subscribers returns the number of the subscriptions of this instance.
+func (b *Broker) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := 0
+	for _, subs := range b.subs {
+		n += len(subs)
+	}
+
+	return n
+}
+
+// Publish delivers the events of a change made by the session of the device to the other sessions of the user.
+// A subscription whose buffer is full misses them rather than blocking the publisher.
+func (b *Broker) Publish(_ context.Context, userID int, deviceID string, events []models.VaultEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for s := range b.subs[userID] {
+		if deviceID != "" && s.deviceID == deviceID {
+			continue
+		}
+		for _, ev := range events {
+			select {
+			case s.ch <- ev:
+			default:
+			}
+		}
+	}
+}
+
+// Close ends the subscriptions, closing their channels, so the event streams return and the server can stop.
+// The subscriptions made afterwards are closed at once.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for userID, subs := range b.subs {
+		for s := range subs {
+			close(s.ch)
+		}
+		delete(b.subs, userID)
+	}
+}
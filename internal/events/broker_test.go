@@ -0,0 +1,80 @@
+package events
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// received returns the events waiting on the channel.
+func received(ch <-chan models.VaultEvent) []models.VaultEvent {
+	var events []models.VaultEvent
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return events
+			}
+			events = append(events, ev)
+		default:
+			return events
+		}
+	}
+}
+
+func TestBroker_Publish(t *testing.T) {
+	ctx := context.Background()
+	b := NewBroker()
+	ev := models.VaultEvent{Table: "TextData", EntryID: "note", UpdatedAt: time.Now()}
+
+	laptop, cancelLaptop := b.Subscribe(1, "laptop")
+	phone, cancelPhone := b.Subscribe(1, "phone")
+	other, cancelOther := b.Subscribe(2, "laptop")
+	defer cancelOther()
+	assert.Equal(t, 3, b.Subscribers())
+
+	// The events reach the other sessions of the user, not the publishing one nor the other users
+	b.Publish(ctx, 1, "laptop", []models.VaultEvent{ev})
+	assert.Empty(t, received(laptop))
+	assert.Equal(t, []models.VaultEvent{ev}, received(phone))
+	assert.Empty(t, received(other))
+
+	// A publisher without a device reaches every session
+	b.Publish(ctx, 1, "", []models.VaultEvent{ev})
+	assert.Len(t, received(laptop), 1)
+	assert.Len(t, received(phone), 1)
+
+	// A subscriber lagging behind misses the events over its buffer, the publisher isn't blocked
+	for i := 0; i < 2*bufferSize; i++ {
+		b.Publish(ctx, 1, "laptop", []models.VaultEvent{ev})
+	}
+	assert.Len(t, received(phone), bufferSize)
+
+	// A canceled subscription is closed and forgotten
+	cancelPhone()
+	cancelPhone()
+	_, ok := <-phone
+	assert.False(t, ok)
+	assert.Equal(t, 2, b.Subscribers())
+	cancelLaptop()
+	assert.Equal(t, 1, b.Subscribers())
+}
+
+func TestBroker_Close(t *testing.T) {
+	b := NewBroker()
+	ch, cancel := b.Subscribe(1, "laptop")
+
+	// The subscriptions end with the broker, the later ones at once
+	b.Close()
+	_, ok := <-ch
+	assert.False(t, ok)
+	cancel()
+	assert.Zero(t, b.Subscribers())
+
+	ch, _ = b.Subscribe(1, "laptop")
+	_, ok = <-ch
+	assert.False(t, ok)
+}
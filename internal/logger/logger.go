@@ -1,10 +1,36 @@
 package logger
 
 import (
+	"context"
+
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
+// fieldsKey is the context key of the request-scoped log fields.
+type fieldsKey struct{}
+
+// WithFields returns a copy of ctx carrying the fields in addition to those it already carries,
+// so the components handling a request can log them without knowing the request.
+func WithFields(ctx context.Context, fields ...zap.Field) context.Context {
+	carried, _ := ctx.Value(fieldsKey{}).([]zap.Field)
+	all := make([]zap.Field, 0, len(carried)+len(fields))
+	all = append(append(all, carried...), fields...)
+
+	return context.WithValue(ctx, fieldsKey{}, all)
+}
+
+// ContextFields returns the fields carried by ctx followed by the given fields.
+func ContextFields(ctx context.Context, fields ...zap.Field) []zap.Field {
+	carried, _ := ctx.Value(fieldsKey{}).([]zap.Field)
+	if len(carried) == 0 {
+		return fields
+	}
+
+	all := make([]zap.Field, 0, len(carried)+len(fields))
+	return append(append(all, carried...), fields...)
+}
+
 type Logger struct {
 	zap *zap.Logger
 }
@@ -21,7 +47,8 @@ func NewLogger(level string) (*Logger, error) {
 	// set the level
 	config.Level = lvl
 	// config.OutputPaths = []string{"stdout", "./logs/" + logFile}
-	logger, err := config.Build(zap.AddCaller())
+	// skip the methods of Logger, so the caller is the code logging the message
+	logger, err := config.Build(zap.AddCaller(), zap.AddCallerSkip(1))
 	if err != nil {
 		return nil, err
 	}
@@ -29,6 +56,11 @@ func NewLogger(level string) (*Logger, error) {
 	return &Logger{zap: logger}, err
 }
 
+// FromZap wraps the zap logger, e.g. one observing the entries in tests.
+func FromZap(logger *zap.Logger) *Logger {
+	return &Logger{zap: logger}
+}
+
 func (l Logger) Debug(msg string, fields ...zap.Field) {
 	l.writer().Debug(msg, fields...)
 }
@@ -41,6 +73,10 @@ func (l Logger) Warn(msg string, fields ...zapcore.Field) {
 	l.writer().Warn(msg, fields...)
 }
 
+func (l Logger) Error(msg string, fields ...zapcore.Field) {
+	l.writer().Error(msg, fields...)
+}
+
 func (l Logger) writer() *zap.Logger {
 	noOpLogger := zap.NewNop()
 	if l.zap == nil {
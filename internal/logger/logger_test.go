@@ -1,9 +1,11 @@
 package logger
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 )
 
 func TestNewLogger(t *testing.T) {
@@ -37,6 +39,26 @@ func TestLogger_Warn(t *testing.T) {
 	logger.Warn("Warning message")
 }
 
+func TestLogger_Error(t *testing.T) {
+	logger, _ := NewLogger("error")
+	assert.NotNil(t, logger)
+
+	logger.Error("Error message")
+}
+
+func TestContextFields(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, []zap.Field{zap.Int("n", 1)}, ContextFields(ctx, zap.Int("n", 1)))
+
+	ctx = WithFields(ctx, zap.String("request_id", "r1"))
+	child := WithFields(ctx, zap.String("user_id", "7"))
+
+	assert.Equal(t, []zap.Field{zap.String("request_id", "r1"), zap.String("user_id", "7"), zap.Int("n", 1)},
+		ContextFields(child, zap.Int("n", 1)))
+	// The parent context is unchanged
+	assert.Equal(t, []zap.Field{zap.String("request_id", "r1")}, ContextFields(ctx))
+}
+
 func TestLogger_Writer(t *testing.T) {
 	logger := Logger{}
 	assert.NotNil(t, logger.writer())
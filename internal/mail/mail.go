@@ -0,0 +1,199 @@
+// Package mail sends the emails of the accounts, such as the tokens verifying an email or resetting a password.
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/egress"
+)
+
+// Message is an email to a single recipient, in plain text. HTML, if set, is sent as an alternative to the text.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+	HTML    string
+}
+
+// Sender sends the emails of the accounts.
+type Sender interface {
+	// Send sends the message, it returns once the server accepted it.
+	Send(ctx context.Context, msg Message) error
+}
+
+// errHeaderInjection rejects a recipient or a subject which would add headers to the message.
+var errHeaderInjection = errors.New("mail header contains a line break")
+
+// SMTPSender sends the emails through an SMTP server, authenticating with PLAIN if a username is given.
+// The connection is upgraded with STARTTLS if the server offers it.
+type SMTPSender struct {
+	addr string
+	host string
+	from string
+	auth smtp.Auth
+	dial egress.DialFunc
+}
+
+// NewSMTPSender creates a new instance of SMTPSender for the server at addr, as host:port, sending from the address.
+// It connects to the server with dial, the dialer of the egress policy.
+func NewSMTPSender(addr, username, password, from string, dial egress.DialFunc) *SMTPSender {
+	host, _, _ := net.SplitHostPort(addr)
+	s := &SMTPSender{addr: addr, host: host, from: from, dial: dial}
+	if username != "" {
+		s.auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return s
+}
+
+// Send sends the message. The connection is closed once the context is done, failing the exchange in progress.
+func (s *SMTPSender) Send(ctx context.Context, msg Message) error {
+	body, err := buildMessage(s.from, msg, time.Now())
+	if err != nil {
+		return err
+	}
+
+	conn, err := s.dial(ctx, "tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to send mail: %w", err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := s.send(conn, msg.To, body); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("failed to send mail: %w", err)
+	}
+
+	return nil
+}
+
+// send runs the SMTP exchange of the message on the connection, as smtp.SendMail does.
+func (s *SMTPSender) send(conn net.Conn, to string, body []byte) error {
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+			return err
+		}
+	}
+	if s.auth != nil {
+		if err := c.Auth(s.auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// buildMessage returns the message in the format of RFC 5322 with CRLF line endings.
+func buildMessage(from string, msg Message, date time.Time) ([]byte, error) {
+	for _, header := range []string{from, msg.To, msg.Subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, errHeaderInjection
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	// A subject which isn't ASCII, e.g. of a translated email, is encoded, ASCII is kept as is
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	if msg.HTML == "" {
+		b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		b.WriteString("\r\n")
+		b.WriteString(crlf(msg.Body))
+
+		return []byte(b.String()), nil
+	}
+
+	// The clients show the last part they can, the HTML
+	parts := multipart.NewWriter(&b)
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%s\r\n", parts.Boundary())
+	b.WriteString("\r\n")
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", msg.Body},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {part.contentType}})
+		if err != nil {
+			return nil, err
+		}
+		io.WriteString(w, crlf(part.content))
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	return []byte(b.String()), nil
+}
+
+// crlf returns the text with CRLF line endings.
+func crlf(text string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\n", "\r\n")
+}
+
+// Fake keeps the messages instead of sending them, for tests. Err, if set, fails every Send.
+type Fake struct {
+	mu   sync.Mutex
+	sent []Message
+	Err  error
+}
+
+// Send keeps the message, or returns Err.
+func (f *Fake) Send(ctx context.Context, msg Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Err != nil {
+		return f.Err
+	}
+	f.sent = append(f.sent, msg)
+
+	return nil
+}
+
+// Sent returns the messages sent so far, oldest first.
+func (f *Fake) Sent() []Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]Message(nil), f.sent...)
+}
@@ -0,0 +1,169 @@
+package mail
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	netmail "net/mail"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/egress"
+)
+
+func TestBuildMessage(t *testing.T) {
+	date := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	msg := Message{To: "alice@example.com", Subject: "Verify your email", Body: "Token:\nabc\n"}
+
+	body, err := buildMessage("keeper@example.com", msg, date)
+	require.NoError(t, err)
+	assert.Equal(t, "From: keeper@example.com\r\n"+
+		"To: alice@example.com\r\n"+
+		"Subject: Verify your email\r\n"+
+		"Date: Wed, 01 May 2024 12:00:00 +0000\r\n"+
+		"MIME-Version: 1.0\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"\r\n"+
+		"Token:\r\nabc\r\n", string(body))
+
+	// A line break in a header would let the recipient add headers, such as more recipients
+	for _, msg := range []Message{
+		{To: "alice@example.com\r\nBcc: eve@example.com", Subject: "Hi"},
+		{To: "alice@example.com", Subject: "Hi\nBcc: eve@example.com"},
+	} {
+		_, err := buildMessage("keeper@example.com", msg, date)
+		assert.ErrorIs(t, err, errHeaderInjection)
+	}
+}
+
+func TestBuildMessage_HTML(t *testing.T) {
+	date := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	msg := Message{To: "alice@example.com", Subject: "Сброс пароля", Body: "Token:\nabc\n", HTML: "<p>abc</p>\n"}
+
+	body, err := buildMessage("keeper@example.com", msg, date)
+	require.NoError(t, err)
+
+	parsed, err := netmail.ReadMessage(bytes.NewReader(body))
+	require.NoError(t, err)
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	require.NoError(t, err)
+	assert.Equal(t, msg.Subject, subject)
+
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/alternative", mediaType)
+
+	// The text comes first, the clients show the last part they can
+	parts := multipart.NewReader(parsed.Body, params["boundary"])
+	for _, want := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", "Token:\r\nabc\r\n"},
+		{"text/html; charset=utf-8", "<p>abc</p>\r\n"},
+	} {
+		part, err := parts.NextPart()
+		require.NoError(t, err)
+		assert.Equal(t, want.contentType, part.Header.Get("Content-Type"))
+		content, err := io.ReadAll(part)
+		require.NoError(t, err)
+		assert.Equal(t, want.content, string(content))
+	}
+	_, err = parts.NextPart()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestFake(t *testing.T) {
+	var f Fake
+	require.NoError(t, f.Send(context.Background(), Message{To: "alice@example.com", Subject: "1"}))
+	require.NoError(t, f.Send(context.Background(), Message{To: "bob@example.com", Subject: "2"}))
+
+	sent := f.Sent()
+	require.Len(t, sent, 2)
+	assert.Equal(t, "alice@example.com", sent[0].To)
+	assert.Equal(t, "2", sent[1].Subject)
+
+	f.Err = errors.New("unavailable")
+	assert.Error(t, f.Send(context.Background(), Message{To: "carol@example.com"}))
+	assert.Len(t, f.Sent(), 2)
+}
+
+// serveSMTP answers a single SMTP session on the listener without TLS nor authentication,
+// and sends the message it received to the channel.
+func serveSMTP(ln net.Listener, received chan<- string) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 localhost ESMTP")
+	var data strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case cmd == "DATA":
+			reply("354 go ahead")
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			received <- data.String()
+			reply("250 queued")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func TestSMTPSender(t *testing.T) {
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	received := make(chan string, 1)
+	go serveSMTP(ln, received)
+
+	// The loopback SMTP server is only reached once the policy allows its address
+	msg := Message{To: "alice@example.com", Subject: "Verify your email", Body: "Token: abc"}
+	denied := NewSMTPSender(ln.Addr().String(), "", "", "keeper@example.com", egress.NewPolicy(nil, nil).Dialer(egress.ClassSMTP))
+	err = denied.Send(ctx, msg)
+	var deniedErr *egress.DeniedError
+	require.ErrorAs(t, err, &deniedErr)
+	assert.Equal(t, egress.ClassSMTP, deniedErr.Class)
+
+	policy := egress.NewPolicy(map[egress.Class]egress.Rule{
+		egress.ClassSMTP: {Prefixes: []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}},
+	}, nil)
+	sender := NewSMTPSender(ln.Addr().String(), "", "", "keeper@example.com", policy.Dialer(egress.ClassSMTP))
+	require.NoError(t, sender.Send(ctx, msg))
+	select {
+	case data := <-received:
+		assert.Contains(t, data, "To: alice@example.com\r\n")
+		assert.Contains(t, data, "Token: abc")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+}
@@ -0,0 +1,52 @@
+package mail
+
+import "time"
+
+// Notification is the data of an email, rendered by the templates of its kind. The templates read
+// its fields, so a field renamed here fails the templates using it when they are loaded.
+type Notification interface {
+	// Kind names the templates of the notification, as <language>/<kind>.txt and .html.
+	Kind() string
+}
+
+// The kinds of the notifications.
+const (
+	KindVerifyEmail   = "verify_email"
+	KindResetPassword = "reset_password"
+)
+
+// VerifyEmail is the email with the token verifying the email of an account, valid for TTL.
+type VerifyEmail struct {
+	Token string
+	TTL   time.Duration
+}
+
+// Kind returns KindVerifyEmail.
+func (VerifyEmail) Kind() string { return KindVerifyEmail }
+
+// ResetPassword is the email with the token resetting the password of an account, valid for TTL.
+type ResetPassword struct {
+	Token string
+	TTL   time.Duration
+}
+
+// Kind returns KindResetPassword.
+func (ResetPassword) Kind() string { return KindResetPassword }
+
+// Samples are the notifications of every kind with sample data. The templates are checked by rendering
+// them, and the operators preview them with it.
+var Samples = []Notification{
+	VerifyEmail{Token: "c2FtcGxlLXZlcmlmaWNhdGlvbi10b2tlbg", TTL: 24 * time.Hour},
+	ResetPassword{Token: "c2FtcGxlLXJlc2V0LXRva2Vu", TTL: time.Hour},
+}
+
+// Sample returns the sample notification of the kind.
+func Sample(kind string) (Notification, bool) {
+	for _, n := range Samples {
+		if n.Kind() == kind {
+			return n, true
+		}
+	}
+
+	return nil, false
+}
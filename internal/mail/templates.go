@@ -0,0 +1,269 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+
+	"golang.org/x/text/language"
+)
+
+// defaultTemplates are the templates of the notifications shipped with the server, overridden by those
+// of the deployment.
+//
+//go:embed templates
+var defaultTemplates embed.FS
+
+// DefaultLanguage is the language of the notifications of the users without one, or whose language
+// has no templates.
+const DefaultLanguage = "en"
+
+// The extensions of the templates of a notification: the text template defines the "subject" and the "body"
+// of the email, the HTML one, optional, defines its "body" as an alternative to the text.
+const (
+	textExt = ".txt"
+	htmlExt = ".html"
+)
+
+// templateKey identifies the templates of a kind of notification in a language.
+type templateKey struct {
+	language string
+	kind     string
+}
+
+// Templates renders the notifications in the language of their recipient, falling back to the parent
+// languages and then to DefaultLanguage, e.g. pt-BR to pt and en.
+type Templates struct {
+	text map[templateKey]*texttemplate.Template
+	html map[templateKey]*htmltemplate.Template
+}
+
+// LoadTemplates loads the default templates, then those of the directory over them, laid out
+// as <language>/<kind>.txt and <language>/<kind>.html, and checks them by rendering every template
+// with the sample of its notification. An empty directory loads the default templates only.
+// A template which doesn't parse, misses a part or reads a field its notification doesn't have
+// is an error naming it, so a broken override fails the startup rather than the emails.
+func LoadTemplates(dir string) (*Templates, error) {
+	t := &Templates{
+		text: make(map[templateKey]*texttemplate.Template),
+		html: make(map[templateKey]*htmltemplate.Template),
+	}
+
+	defaults, err := fs.Sub(defaultTemplates, "templates")
+	if err != nil {
+		return nil, err
+	}
+	if err := t.load(defaults, "default"); err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		if err := t.load(os.DirFS(dir), dir); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// load parses the templates of the file system over those loaded before, source names it in the errors.
+func (t *Templates) load(fsys fs.FS, source string) error {
+	dirs, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return fmt.Errorf("mail templates %s: %w", source, err)
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			return fmt.Errorf("mail template %s: not in the directory of a language", path.Join(source, dir.Name()))
+		}
+		tag, err := language.Parse(dir.Name())
+		if err != nil {
+			return fmt.Errorf("mail templates %s: unknown language: %w", path.Join(source, dir.Name()), err)
+		}
+
+		files, err := fs.ReadDir(fsys, dir.Name())
+		if err != nil {
+			return fmt.Errorf("mail templates %s: %w", path.Join(source, dir.Name()), err)
+		}
+		for _, file := range files {
+			name := path.Join(dir.Name(), file.Name())
+			if err := t.parse(fsys, name, tag.String()); err != nil {
+				return fmt.Errorf("mail template %s: %w", path.Join(source, name), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// parse parses the template of the file in the language.
+func (t *Templates) parse(fsys fs.FS, name, lang string) error {
+	ext := path.Ext(name)
+	kind := strings.TrimSuffix(path.Base(name), ext)
+	if _, ok := Sample(kind); !ok {
+		return fmt.Errorf("unknown notification %q", kind)
+	}
+
+	content, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return err
+	}
+
+	key := templateKey{language: lang, kind: kind}
+	switch ext {
+	case textExt:
+		tmpl, err := texttemplate.New(name).Option("missingkey=error").Parse(string(content))
+		if err != nil {
+			return err
+		}
+		for _, part := range []string{"subject", "body"} {
+			if tmpl.Lookup(part) == nil {
+				return fmt.Errorf("the template doesn't define the %s", part)
+			}
+		}
+		t.text[key] = tmpl
+	case htmlExt:
+		tmpl, err := htmltemplate.New(name).Option("missingkey=error").Parse(string(content))
+		if err != nil {
+			return err
+		}
+		if tmpl.Lookup("body") == nil {
+			return errors.New("the template doesn't define the body")
+		}
+		t.html[key] = tmpl
+	default:
+		return fmt.Errorf("unknown extension %q, use %s or %s", ext, textExt, htmlExt)
+	}
+
+	return nil
+}
+
+// check renders every template with the sample of its notification. An HTML template needs
+// the text one of its language, the text is the part every client shows.
+func (t *Templates) check() error {
+	for key := range t.html {
+		if _, ok := t.text[key]; !ok {
+			return fmt.Errorf("mail template %s/%s%s: no %s template in its language", key.language, key.kind, htmlExt, textExt)
+		}
+	}
+	for _, sample := range Samples {
+		if _, ok := t.text[templateKey{language: DefaultLanguage, kind: sample.Kind()}]; !ok {
+			return fmt.Errorf("mail template %s/%s%s: missing", DefaultLanguage, sample.Kind(), textExt)
+		}
+	}
+
+	for key := range t.text {
+		sample, _ := Sample(key.kind)
+		if _, err := t.render(key, sample); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Render renders the notification in the language, or the closest one which has templates for it.
+// The message has no recipient.
+func (t *Templates) Render(lang string, n Notification) (Message, error) {
+	for _, candidate := range fallbacks(lang) {
+		key := templateKey{language: candidate, kind: n.Kind()}
+		if _, ok := t.text[key]; ok {
+			return t.render(key, n)
+		}
+	}
+
+	return Message{}, fmt.Errorf("no mail template for the notification %q", n.Kind())
+}
+
+// render renders the templates of the key with the notification.
+func (t *Templates) render(key templateKey, n Notification) (Message, error) {
+	name := key.language + "/" + key.kind
+	tmpl := t.text[key]
+
+	var subject, body bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&subject, "subject", n); err != nil {
+		return Message{}, fmt.Errorf("mail template %s%s: %w", name, textExt, err)
+	}
+	if err := tmpl.ExecuteTemplate(&body, "body", n); err != nil {
+		return Message{}, fmt.Errorf("mail template %s%s: %w", name, textExt, err)
+	}
+	msg := Message{Subject: strings.TrimSpace(subject.String()), Body: body.String()}
+	if strings.ContainsAny(msg.Subject, "\r\n") {
+		return Message{}, fmt.Errorf("mail template %s%s: the subject has several lines", name, textExt)
+	}
+
+	if html, ok := t.html[key]; ok {
+		var b strings.Builder
+		if err := html.ExecuteTemplate(&b, "body", n); err != nil {
+			return Message{}, fmt.Errorf("mail template %s%s: %w", name, htmlExt, err)
+		}
+		msg.HTML = b.String()
+	}
+
+	return msg, nil
+}
+
+// Languages returns the languages which have templates, sorted.
+func (t *Templates) Languages() []string {
+	seen := make(map[string]bool)
+	for key := range t.text {
+		seen[key.language] = true
+	}
+
+	languages := make([]string, 0, len(seen))
+	for lang := range seen {
+		languages = append(languages, lang)
+	}
+	sort.Strings(languages)
+
+	return languages
+}
+
+// fallbacks returns the languages whose templates render a notification in the language, closest first:
+// the language, its parents, then DefaultLanguage. An invalid language only falls back to DefaultLanguage.
+func fallbacks(lang string) []string {
+	var chain []string
+	if tag, err := language.Parse(lang); err == nil {
+		for ; tag != language.Und; tag = tag.Parent() {
+			chain = append(chain, tag.String())
+		}
+	}
+
+	return append(chain, DefaultLanguage)
+}
+
+// Notifier renders the notifications with the templates and sends them with the sender, so that
+// the code notifying only supplies the data of the notification.
+type Notifier struct {
+	sender    Sender
+	templates *Templates
+}
+
+// NewNotifier creates a new instance of Notifier.
+func NewNotifier(sender Sender, templates *Templates) *Notifier {
+	return &Notifier{sender: sender, templates: templates}
+}
+
+// Notify renders the notification in the language of the recipient and sends it to the address.
+func (n *Notifier) Notify(ctx context.Context, to, lang string, notification Notification) error {
+	msg, err := n.templates.Render(lang, notification)
+	if err != nil {
+		return err
+	}
+	msg.To = to
+
+	return n.sender.Send(ctx, msg)
+}
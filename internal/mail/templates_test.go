@@ -0,0 +1,174 @@
+package mail
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTemplate writes the template of the language and file name in the directory.
+func writeTemplate(t *testing.T, dir, lang, name, content string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, lang), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, lang, name), []byte(content), 0o644))
+}
+
+func TestLoadTemplates_Defaults(t *testing.T) {
+	templates, err := LoadTemplates("")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"en", "ru"}, templates.Languages())
+
+	// Every notification renders in every language with its sample, as text and HTML
+	for _, lang := range templates.Languages() {
+		for _, sample := range Samples {
+			msg, err := templates.Render(lang, sample)
+			require.NoError(t, err, "%s/%s", lang, sample.Kind())
+			assert.NotEmpty(t, msg.Subject, "%s/%s", lang, sample.Kind())
+			assert.NotEmpty(t, msg.Body, "%s/%s", lang, sample.Kind())
+			assert.NotEmpty(t, msg.HTML, "%s/%s", lang, sample.Kind())
+		}
+	}
+
+	msg, err := templates.Render("en", VerifyEmail{Token: "abc<def>", TTL: time.Hour})
+	require.NoError(t, err)
+	assert.Equal(t, "Verify your email", msg.Subject)
+	assert.Contains(t, msg.Body, "\n\nabc<def>\n\n")
+	assert.Contains(t, msg.Body, "The token expires in 1h0m0s.")
+	assert.Contains(t, msg.HTML, "abc&lt;def&gt;", "the HTML escapes the data")
+}
+
+func TestLoadTemplates_Override(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplate(t, dir, "en", "reset_password.txt",
+		`{{define "subject"}}Reset your Acme Vault password{{end}}{{define "body"}}Token: {{.Token}}{{end}}`)
+	writeTemplate(t, dir, "de", "verify_email.txt",
+		`{{define "subject"}}E-Mail bestätigen{{end}}{{define "body"}}Token: {{.Token}}, gültig {{.TTL}}{{end}}`)
+
+	templates, err := LoadTemplates(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"de", "en", "ru"}, templates.Languages())
+
+	// The override replaces the text of the default, and its HTML is kept
+	msg, err := templates.Render("en", ResetPassword{Token: "abc", TTL: time.Hour})
+	require.NoError(t, err)
+	assert.Equal(t, "Reset your Acme Vault password", msg.Subject)
+	assert.Equal(t, "Token: abc", msg.Body)
+	assert.Contains(t, msg.HTML, "abc")
+
+	// A new language has its own templates, and the defaults for the others
+	msg, err = templates.Render("de", VerifyEmail{Token: "abc", TTL: time.Hour})
+	require.NoError(t, err)
+	assert.Equal(t, "E-Mail bestätigen", msg.Subject)
+	assert.Empty(t, msg.HTML)
+	msg, err = templates.Render("de", ResetPassword{Token: "abc", TTL: time.Hour})
+	require.NoError(t, err)
+	assert.Equal(t, "Reset your Acme Vault password", msg.Subject)
+
+	// The other defaults are unchanged
+	msg, err = templates.Render("en", VerifyEmail{Token: "abc", TTL: time.Hour})
+	require.NoError(t, err)
+	assert.Equal(t, "Verify your email", msg.Subject)
+}
+
+func TestLoadTemplates_BrokenOverride(t *testing.T) {
+	for _, tc := range []struct {
+		name, lang, file, content string
+		wantErr                   []string
+	}{
+		{
+			name: "parse error", lang: "en", file: "verify_email.txt",
+			content: `{{define "subject"}}Verify{{end}}{{define "body"}}{{.Token{{end}}`,
+			wantErr: []string{"en/verify_email.txt"},
+		},
+		{
+			name: "missing variable", lang: "en", file: "verify_email.txt",
+			content: `{{define "subject"}}Verify{{end}}{{define "body"}}{{.Tokn}}{{end}}`,
+			wantErr: []string{"en/verify_email.txt", "Tokn"},
+		},
+		{
+			name: "missing variable in HTML", lang: "en", file: "reset_password.html",
+			content: `{{define "body"}}<p>{{.Code}}</p>{{end}}`,
+			wantErr: []string{"en/reset_password.html", "Code"},
+		},
+		{
+			name: "missing part", lang: "en", file: "verify_email.txt",
+			content: `{{define "body"}}{{.Token}}{{end}}`,
+			wantErr: []string{"en/verify_email.txt", "subject"},
+		},
+		{
+			name: "subject of several lines", lang: "en", file: "verify_email.txt",
+			content: "{{define \"subject\"}}Verify\nBcc: eve@example.com{{end}}{{define \"body\"}}{{.Token}}{{end}}",
+			wantErr: []string{"en/verify_email.txt", "several lines"},
+		},
+		{
+			name: "unknown notification", lang: "en", file: "welcome.txt",
+			content: `{{define "subject"}}Hi{{end}}{{define "body"}}Hi{{end}}`,
+			wantErr: []string{"en/welcome.txt", "unknown notification"},
+		},
+		{
+			name: "unknown extension", lang: "en", file: "verify_email.md",
+			content: `{{.Token}}`,
+			wantErr: []string{"en/verify_email.md", "unknown extension"},
+		},
+		{
+			name: "unknown language", lang: "english", file: "verify_email.txt",
+			content: `{{define "subject"}}Verify{{end}}{{define "body"}}{{.Token}}{{end}}`,
+			wantErr: []string{"english", "unknown language"},
+		},
+		{
+			name: "HTML without text", lang: "fr", file: "verify_email.html",
+			content: `{{define "body"}}<p>{{.Token}}</p>{{end}}`,
+			wantErr: []string{"fr/verify_email.html", "no .txt template"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTemplate(t, dir, tc.lang, tc.file, tc.content)
+
+			_, err := LoadTemplates(dir)
+			require.Error(t, err)
+			for _, want := range tc.wantErr {
+				assert.Contains(t, err.Error(), want)
+			}
+		})
+	}
+}
+
+func TestTemplates_Fallback(t *testing.T) {
+	templates, err := LoadTemplates("")
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		lang, want string
+	}{
+		{"ru", "Подтвердите email"},
+		{"ru-RU", "Подтвердите email"},
+		{"pt-BR", "Verify your email"},
+		{"", "Verify your email"},
+		{"not a language", "Verify your email"},
+	} {
+		msg, err := templates.Render(tc.lang, VerifyEmail{Token: "abc", TTL: time.Hour})
+		require.NoError(t, err, tc.lang)
+		assert.Equal(t, tc.want, msg.Subject, tc.lang)
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	templates, err := LoadTemplates("")
+	require.NoError(t, err)
+	var fake Fake
+	notifier := NewNotifier(&fake, templates)
+
+	require.NoError(t, notifier.Notify(context.Background(), "alice@example.com", "ru", ResetPassword{Token: "abc", TTL: time.Hour}))
+	sent := fake.Sent()
+	require.Len(t, sent, 1)
+	assert.Equal(t, "alice@example.com", sent[0].To)
+	assert.Equal(t, "Сброс пароля", sent[0].Subject)
+	assert.Contains(t, sent[0].Body, "abc")
+	assert.Contains(t, sent[0].HTML, "abc")
+}
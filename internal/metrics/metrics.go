@@ -0,0 +1,258 @@
+// Package metrics provides the Prometheus metrics of the server.
+package metrics
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// queryLabels identifies the series of an operation on a table.
+type queryLabels struct {
+	op, table string
+}
+
+// querySeries holds the series of an operation on a table, resolved once.
+type querySeries struct {
+	duration prometheus.Observer
+	errors   prometheus.Counter
+}
+
+// Storage exports the latencies and errors of the storage operations.
+// It implements bdkeeper.Metrics.
+type Storage struct {
+	duration  *prometheus.HistogramVec
+	errors    *prometheus.CounterVec
+	retries   *prometheus.CounterVec
+	exhausted *prometheus.CounterVec
+	truncated *prometheus.CounterVec
+	partial   *prometheus.CounterVec
+	unchanged *prometheus.CounterVec
+	// series caches the series by labels, resolving the labels of a vector allocates
+	series sync.Map
+}
+
+// NewStorage creates the storage metrics and registers them with reg.
+func NewStorage(reg prometheus.Registerer) (*Storage, error) {
+	s := &Storage{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "gophkeeper",
+			Subsystem: "storage",
+			Name:      "query_duration_seconds",
+			Help:      "Duration of the storage operations by operation and table.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		}, []string{"op", "table"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "gophkeeper",
+			Subsystem: "storage",
+			Name:      "query_errors_total",
+			Help:      "Failed storage operations by operation and table.",
+		}, []string{"op", "table"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "gophkeeper",
+			Subsystem: "storage",
+			Name:      "tx_retries_total",
+			Help:      "Transactions run again after a concurrent transaction aborted them, by operation.",
+		}, []string{"op"}),
+		exhausted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "gophkeeper",
+			Subsystem: "storage",
+			Name:      "tx_retries_exhausted_total",
+			Help:      "Operations failed because of concurrent transactions, the clients retry them, by operation.",
+		}, []string{"op"}),
+		truncated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "gophkeeper",
+			Subsystem: "storage",
+			Name:      "search_text_truncated_total",
+			Help:      "Entries whose meta information was cut to the indexed length when written, by table.",
+		}, []string{"table"}),
+		partial: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "gophkeeper",
+			Subsystem: "storage",
+			Name:      "partial_failures_total",
+			Help:      "Tables which failed in the reads returning the other tables, by operation and table.",
+		}, []string{"op", "table"}),
+		unchanged: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "gophkeeper",
+			Subsystem: "storage",
+			Name:      "unchanged_updates_total",
+			Help:      "Updates pushed by the clients which changed nothing and were skipped, by table.",
+		}, []string{"table"}),
+	}
+
+	for _, c := range []prometheus.Collector{s.duration, s.errors, s.retries, s.exhausted, s.truncated, s.partial, s.unchanged} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// ObserveQuery records the duration of the operation and counts it as failed if err is set.
+// A missing entry is an answer rather than a failure, so models.ErrNotFound isn't counted.
+func (s *Storage) ObserveQuery(op, table string, d time.Duration, err error) {
+	series := s.seriesFor(op, table)
+
+	series.duration.Observe(d.Seconds())
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		series.errors.Inc()
+	}
+}
+
+// ObserveRetry counts a retried transaction of the operation, or an exhausted one.
+// Retries are rare, so the series are resolved on every call.
+func (s *Storage) ObserveRetry(op string, exhausted bool) {
+	if exhausted {
+		s.exhausted.WithLabelValues(op).Inc()
+		return
+	}
+
+	s.retries.WithLabelValues(op).Inc()
+}
+
+// ObserveTruncation counts an entry of the table whose search text was cut.
+func (s *Storage) ObserveTruncation(table string) {
+	s.truncated.WithLabelValues(table).Inc()
+}
+
+// ObservePartialFailure counts a table which failed in a partial read of the operation.
+func (s *Storage) ObservePartialFailure(op, table string) {
+	s.partial.WithLabelValues(op, table).Inc()
+}
+
+// ObserveUnchanged counts an update of an entry of the table skipped because it changed nothing.
+func (s *Storage) ObserveUnchanged(table string) {
+	s.unchanged.WithLabelValues(table).Inc()
+}
+
+// seriesFor returns the series of the operation on the table, resolving them on first use.
+func (s *Storage) seriesFor(op, table string) *querySeries {
+	key := queryLabels{op: op, table: table}
+	if v, ok := s.series.Load(key); ok {
+		return v.(*querySeries)
+	}
+
+	v, _ := s.series.LoadOrStore(key, &querySeries{
+		duration: s.duration.WithLabelValues(op, table),
+		errors:   s.errors.WithLabelValues(op, table),
+	})
+
+	return v.(*querySeries)
+}
+
+// RateLimit exports the requests rejected by the rate limiter.
+// It implements middleware.RateMetrics.
+type RateLimit struct {
+	rejected *prometheus.CounterVec
+}
+
+// NewRateLimit creates the rate limiter metrics and registers them with reg.
+func NewRateLimit(reg prometheus.Registerer) (*RateLimit, error) {
+	m := &RateLimit{
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "gophkeeper",
+			Subsystem: "http",
+			Name:      "rate_limited_total",
+			Help:      "Requests rejected because their client was over its rate limit, by route.",
+		}, []string{"route"}),
+	}
+
+	if err := reg.Register(m.rejected); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// ObserveRateLimited counts a rejected request of the route.
+func (m *RateLimit) ObserveRateLimited(route string) {
+	m.rejected.WithLabelValues(route).Inc()
+}
+
+// Egress exports the outbound connections checked by the egress policy.
+// It implements egress.Metrics.
+type Egress struct {
+	connections *prometheus.CounterVec
+}
+
+// NewEgress creates the egress metrics and registers them with reg.
+func NewEgress(reg prometheus.Registerer) (*Egress, error) {
+	m := &Egress{
+		connections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "gophkeeper",
+			Subsystem: "egress",
+			Name:      "connections_total",
+			Help:      "Outbound connections by destination class and result, allowed or denied by the egress policy.",
+		}, []string{"class", "result"}),
+	}
+
+	if err := reg.Register(m.connections); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// ObserveEgress counts a connection to a destination of the class.
+func (m *Egress) ObserveEgress(class string, allowed bool) {
+	result := "denied"
+	if allowed {
+		result = "allowed"
+	}
+	m.connections.WithLabelValues(class, result).Inc()
+}
+
+// Replication exports the rounds of the replication of a vault from a primary server.
+// It implements replication.Metrics.
+type Replication struct {
+	rounds    *prometheus.CounterVec
+	lag       prometheus.Gauge
+	converged prometheus.Gauge
+}
+
+// NewReplication creates the replication metrics and registers them with reg.
+func NewReplication(reg prometheus.Registerer) (*Replication, error) {
+	m := &Replication{
+		rounds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "gophkeeper",
+			Subsystem: "replication",
+			Name:      "rounds_total",
+			Help:      "Replication rounds by result: converged, diverged, or failed to reach the primary.",
+		}, []string{"result"}),
+		lag: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "gophkeeper",
+			Subsystem: "replication",
+			Name:      "lag_seconds",
+			Help:      "Time since the replica last converged with the primary.",
+		}),
+		converged: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "gophkeeper",
+			Subsystem: "replication",
+			Name:      "converged",
+			Help:      "Whether the checksum of the replica matched the primary in the last round, 1 or 0.",
+		}),
+	}
+
+	for _, c := range []prometheus.Collector{m.rounds, m.lag, m.converged} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// ObserveReplication records the result of a round and the lag of the replica after it.
+func (m *Replication) ObserveReplication(result string, lag time.Duration) {
+	m.rounds.WithLabelValues(result).Inc()
+	m.lag.Set(lag.Seconds())
+	if result == "converged" {
+		m.converged.Set(1)
+	} else {
+		m.converged.Set(0)
+	}
+}
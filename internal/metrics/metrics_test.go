@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+func TestStorage_ObserveQuery(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	s, err := NewStorage(reg)
+	require.NoError(t, err)
+
+	s.ObserveQuery("get_data", "UserCredentials", 2*time.Millisecond, nil)
+	s.ObserveQuery("get_data", "UserCredentials", 3*time.Millisecond, fmt.Errorf("get: %w", models.ErrNotFound))
+	s.ObserveQuery("get_data", "TextData", time.Millisecond, errors.New("connection reset"))
+
+	assert.Equal(t, 2, testutil.CollectAndCount(s.duration))
+	assert.Equal(t, 0.0, testutil.ToFloat64(s.errors.WithLabelValues("get_data", "UserCredentials")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(s.errors.WithLabelValues("get_data", "TextData")))
+
+	s.ObserveRetry("with_snapshot", false)
+	s.ObserveRetry("with_snapshot", false)
+	s.ObserveRetry("apply_changes", true)
+	assert.Equal(t, 2.0, testutil.ToFloat64(s.retries.WithLabelValues("with_snapshot")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(s.exhausted.WithLabelValues("apply_changes")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(s.exhausted.WithLabelValues("with_snapshot")))
+
+	s.ObserveTruncation("TextData")
+	assert.Equal(t, 1.0, testutil.ToFloat64(s.truncated.WithLabelValues("TextData")))
+
+	s.ObservePartialFailure("search_data", "TextData")
+	s.ObservePartialFailure("search_data", "TextData")
+	assert.Equal(t, 2.0, testutil.ToFloat64(s.partial.WithLabelValues("search_data", "TextData")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(s.partial.WithLabelValues("pending_data", "TextData")))
+
+	s.ObserveUnchanged("UserCredentials")
+	assert.Equal(t, 1.0, testutil.ToFloat64(s.unchanged.WithLabelValues("UserCredentials")))
+
+	// The metrics can be registered only once
+	_, err = NewStorage(reg)
+	assert.Error(t, err)
+}
+
+func TestStorage_ObserveQueryAllocs(t *testing.T) {
+	s, err := NewStorage(prometheus.NewRegistry())
+	require.NoError(t, err)
+	s.ObserveQuery("get_all_data", "UserCredentials", time.Millisecond, nil)
+
+	// Once the series are resolved, observing doesn't allocate
+	allocs := testing.AllocsPerRun(100, func() {
+		s.ObserveQuery("get_all_data", "UserCredentials", time.Millisecond, nil)
+	})
+	assert.Zero(t, allocs)
+}
+
+func TestRateLimit_ObserveRateLimited(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := NewRateLimit(reg)
+	require.NoError(t, err)
+
+	m.ObserveRateLimited("/login")
+	m.ObserveRateLimited("/login")
+	m.ObserveRateLimited("/api/sync/")
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.rejected.WithLabelValues("/login")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.rejected.WithLabelValues("/api/sync/")))
+
+	_, err = NewRateLimit(reg)
+	assert.Error(t, err)
+}
+
+func TestEgress_ObserveEgress(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := NewEgress(reg)
+	require.NoError(t, err)
+
+	m.ObserveEgress("smtp", true)
+	m.ObserveEgress("username_checker", false)
+	m.ObserveEgress("username_checker", false)
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.connections.WithLabelValues("smtp", "allowed")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.connections.WithLabelValues("username_checker", "denied")))
+	assert.Zero(t, testutil.ToFloat64(m.connections.WithLabelValues("smtp", "denied")))
+}
+
+func TestReplication_ObserveReplication(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := NewReplication(reg)
+	require.NoError(t, err)
+
+	m.ObserveReplication("converged", time.Second)
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.converged))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.lag))
+
+	m.ObserveReplication("failed", time.Minute)
+	m.ObserveReplication("failed", 2*time.Minute)
+	assert.Zero(t, testutil.ToFloat64(m.converged))
+	assert.Equal(t, 120.0, testutil.ToFloat64(m.lag))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.rounds.WithLabelValues("converged")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.rounds.WithLabelValues("failed")))
+}
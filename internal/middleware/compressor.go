@@ -2,49 +2,248 @@
 package middleware
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/wurt83ow/gophkeeper-server/internal/compress"
 )
 
-// GzipMiddleware is an HTTP middleware that adds support for gzip compression.
-// It compresses the response if the client supports gzip, and decompresses the request
-// if the client sends compressed data in gzip format.
-func GzipMiddleware(h http.Handler) http.Handler {
+// gzipWriters pools the writers of the compressed responses, a writer allocates its window.
+var gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(io.Discard) }}
+
+// errBodyTooLarge rejects a request body larger than the limit once decompressed.
+var errBodyTooLarge = errors.New("the decompressed request body is too large")
+
+// Compressor is an HTTP middleware compressing the responses of the clients which accept gzip, once they are
+// at least minSize bytes long: the smaller ones don't gain enough to pay for it. It decompresses the gzipped
+// bodies of the requests to the push routes, up to maxBody bytes so that a small body can't inflate without end.
+type Compressor struct {
+	minSize int
+	maxBody int64
+	routes  []string
+}
+
+// NewCompressor creates a new instance of Compressor, the routes whose path starts with one of the prefixes
+// accept gzipped bodies.
+func NewCompressor(minSize int, maxBody int64, routes []string) *Compressor {
+	return &Compressor{minSize: minSize, maxBody: maxBody, routes: routes}
+}
+
+// Compress compresses the response and decompresses the request of the handler.
+// A request body in another encoding, or gzipped to a route not accepting it, gets 415.
+func (c *Compressor) Compress(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// by default set the original http.ResponseWriter as the one
-		// that will be passed to the next function
-		ow := w
-
-		// check that the client can receive compressed data in gzip format from the server
-		acceptEncoding := r.Header.Get("Accept-Encoding")
-		supportsGzip := strings.Contains(acceptEncoding, "gzip")
-		if supportsGzip {
-			// wrap the original http.ResponseWriter with a new one with compression support
-			cw := compress.NewCompressWriter(w)
-			// change the original http.ResponseWriter to a new one
-			ow = cw
-			// do not forget to send all compressed data to the client after the middleware is completed
-			defer cw.Close()
-		}
-
-		// check that the client sent compressed data to the server in gzip format
-		contentEncoding := r.Header.Get("Content-Encoding")
-		sendsGzip := strings.Contains(contentEncoding, "gzip")
-		if sendsGzip {
-			// wrap the request body in io.Reader with decompression support
-			cr, err := compress.NewCompressReader(r.Body)
+		if encoding := strings.TrimSpace(r.Header.Get("Content-Encoding")); encoding != "" && !strings.EqualFold(encoding, "identity") {
+			if !strings.EqualFold(encoding, "gzip") || !c.decompresses(r.URL.Path) {
+				http.Error(w, fmt.Sprintf("content encoding %q is not supported", encoding), http.StatusUnsupportedMediaType)
+				return
+			}
+
+			body, err := c.decompress(r.Body)
+			if errors.Is(err, errBodyTooLarge) {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
 			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
+				http.Error(w, "the request body is not valid gzip", http.StatusBadRequest)
 				return
 			}
-			// change the request body to a new one
-			r.Body = cr
-			defer cr.Close()
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			r.Header.Del("Content-Encoding")
+			r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		}
+
+		// The response depends on the encodings accepted whether it is compressed or not
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			h.ServeHTTP(w, r)
+			return
 		}
 
-		// transfer control to the handler
-		h.ServeHTTP(ow, r)
+		gw := &gzipWriter{ResponseWriter: w, minSize: c.minSize}
+		defer gw.close()
+		h.ServeHTTP(gw, r)
 	})
 }
+
+// decompresses reports whether the route of the path accepts gzipped bodies.
+func (c *Compressor) decompresses(path string) bool {
+	for _, prefix := range c.routes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// decompress reads the gzipped body whole, failing once it is over the limit.
+// The handlers get the body as if it was sent as it is.
+func (c *Compressor) decompress(body io.ReadCloser) ([]byte, error) {
+	cr, err := compress.NewCompressReader(body)
+	if err != nil {
+		return nil, err
+	}
+	defer cr.Close()
+
+	data, err := io.ReadAll(io.LimitReader(cr, c.maxBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > c.maxBody {
+		return nil, fmt.Errorf("%w: over %d bytes", errBodyTooLarge, c.maxBody)
+	}
+
+	return data, nil
+}
+
+// acceptsGzip reports whether the Accept-Encoding header accepts gzip, which it doesn't with a quality of 0.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		if name = strings.TrimSpace(name); !strings.EqualFold(name, "gzip") && name != "*" {
+			continue
+		}
+		q, found := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q=")
+		if !found {
+			return true
+		}
+		quality, err := strconv.ParseFloat(q, 64)
+		return err == nil && quality > 0
+	}
+
+	return false
+}
+
+// gzipWriter holds the start of the response until it is minSize bytes long, then compresses it.
+// A shorter response, or one flushed before, is sent as it is, as are the event streams,
+// the responses without a body and those encoded by the handler already.
+type gzipWriter struct {
+	http.ResponseWriter
+	minSize int
+	status  int
+	buf     []byte
+	// started is set once the header is sent, zw is the writer of the body if it is compressed
+	started bool
+	zw      *gzip.Writer
+}
+
+// WriteHeader holds the status until the encoding is chosen, the informational ones are sent at once.
+func (g *gzipWriter) WriteHeader(status int) {
+	if status >= 100 && status < 200 {
+		g.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if g.status == 0 {
+		g.status = status
+	}
+}
+
+// Write holds the body until it is long enough to compress.
+func (g *gzipWriter) Write(p []byte) (int, error) {
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	if g.started {
+		if g.zw != nil {
+			return g.zw.Write(p)
+		}
+		return g.ResponseWriter.Write(p)
+	}
+
+	g.buf = append(g.buf, p...)
+	if len(g.buf) >= g.minSize {
+		if err := g.start(true); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Flush sends the response so far, as it is if it wasn't compressed yet.
+func (g *gzipWriter) Flush() {
+	if !g.started {
+		g.start(false)
+	}
+	if g.zw != nil {
+		g.zw.Flush()
+	}
+	http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+// Unwrap returns the writer wrapped, for http.ResponseController.
+func (g *gzipWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// start sends the header, compressing the body if asked and the response may be, then the body held so far.
+func (g *gzipWriter) start(compress bool) error {
+	g.started = true
+
+	h := g.Header()
+	if compress && compressible(h, g.status) {
+		// The type is sniffed from the body as it is, not once compressed
+		if h.Get("Content-Type") == "" {
+			h.Set("Content-Type", http.DetectContentType(g.buf))
+		}
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		// The compressed body is another representation, it can't have the strong validator of the original
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		g.zw = gzipWriters.Get().(*gzip.Writer)
+		g.zw.Reset(g.ResponseWriter)
+	}
+	if g.status != 0 {
+		g.ResponseWriter.WriteHeader(g.status)
+	}
+
+	if len(g.buf) == 0 {
+		return nil
+	}
+	buf := g.buf
+	g.buf = nil
+	if g.zw != nil {
+		_, err := g.zw.Write(buf)
+		return err
+	}
+	_, err := g.ResponseWriter.Write(buf)
+	return err
+}
+
+// close sends what is held of a short response, or ends the compressed one.
+func (g *gzipWriter) close() {
+	if !g.started {
+		g.start(false)
+	}
+	if g.zw != nil {
+		g.zw.Close()
+		g.zw.Reset(io.Discard)
+		gzipWriters.Put(g.zw)
+		g.zw = nil
+	}
+}
+
+// compressible reports whether a response of the header and the status may be compressed.
+// The event streams are sent as they are written, the files are encrypted by the clients and don't compress,
+// nor do the archives of the exports. A range is of the bytes as they are.
+func compressible(h http.Header, status int) bool {
+	if status == http.StatusNoContent || status == http.StatusNotModified || status == http.StatusPartialContent ||
+		h.Get("Content-Encoding") != "" {
+		return false
+	}
+
+	contentType := h.Get("Content-Type")
+	return !strings.HasPrefix(contentType, "text/event-stream") && !strings.HasPrefix(contentType, "application/octet-stream") &&
+		!strings.HasPrefix(contentType, "application/zip")
+}
@@ -7,8 +7,10 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/wurt83ow/gophkeeper-server/internal/models"
 )
@@ -27,9 +29,30 @@ func testHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func TestGzipMiddleware(t *testing.T) {
+// gzipped returns the data compressed with gzip.
+func gzipped(t *testing.T, data []byte) *bytes.Buffer {
+	buf := bytes.NewBuffer(nil)
+	zb := gzip.NewWriter(buf)
+	_, err := zb.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, zb.Close())
 
-	handler := GzipMiddleware(http.HandlerFunc(testHandler))
+	return buf
+}
+
+// gunzip returns the data decompressed from gzip.
+func gunzip(t *testing.T, r io.Reader) string {
+	zr, err := gzip.NewReader(r)
+	require.NoError(t, err)
+	b, err := io.ReadAll(zr)
+	require.NoError(t, err)
+
+	return string(b)
+}
+
+func TestCompressor(t *testing.T) {
+
+	handler := NewCompressor(0, 1<<20, []string{"/"}).Compress(http.HandlerFunc(testHandler))
 
 	srv := httptest.NewServer(handler)
 	defer srv.Close()
@@ -39,14 +62,7 @@ func TestGzipMiddleware(t *testing.T) {
 		    }`
 
 	t.Run("sends_gzip", func(t *testing.T) {
-		buf := bytes.NewBuffer(nil)
-		zb := gzip.NewWriter(buf)
-		_, err := zb.Write([]byte(successBody))
-		require.NoError(t, err)
-		err = zb.Close()
-		require.NoError(t, err)
-
-		r := httptest.NewRequest("POST", srv.URL, buf)
+		r := httptest.NewRequest("POST", srv.URL, gzipped(t, []byte(successBody)))
 		r.RequestURI = ""
 		r.Header.Set("Content-Encoding", "gzip")
 
@@ -75,13 +91,139 @@ func TestGzipMiddleware(t *testing.T) {
 
 		defer resp.Body.Close()
 
-		zr, err := gzip.NewReader(resp.Body)
-		require.NoError(t, err)
+		require.JSONEq(t, successBody, gunzip(t, resp.Body))
 
-		b, err := io.ReadAll(zr)
-		require.NoError(t, err)
+	})
+}
 
-		require.JSONEq(t, successBody, string(b))
+func TestCompressor_Response(t *testing.T) {
+	large := strings.Repeat(`{"id": "entry", "login": "alice"},`, 100)
+	var body, contentType, etag string
+	var status int
+	c := NewCompressor(1024, 1<<20, nil)
+	handler := c.Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		w.Header().Set("Content-Length", "1")
+		if status != 0 {
+			w.WriteHeader(status)
+		}
+		io.WriteString(w, body)
+	}))
+	serve := func(acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/UserCredentials", nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
 
-	})
+	// A large response is compressed, its length is unknown and its strong validator is weakened
+	body, contentType, etag = large, "application/json", `"v1"`
+	w := serve("deflate, gzip")
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Empty(t, w.Header().Get("Content-Length"))
+	assert.Equal(t, `W/"v1"`, w.Header().Get("ETag"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, large, gunzip(t, w.Body))
+
+	// A weak validator stays, the untyped body is typed from its content rather than the compressed one
+	contentType, etag = "", `W/"v1"`
+	w = serve("gzip")
+	assert.Equal(t, `W/"v1"`, w.Header().Get("ETag"))
+	assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+
+	// The clients not accepting gzip, and the small responses, get the response as it is
+	for _, acceptEncoding := range []string{"", "gzip;q=0", "br"} {
+		w = serve(acceptEncoding)
+		assert.Empty(t, w.Header().Get("Content-Encoding"), acceptEncoding)
+		assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+		assert.Equal(t, large, w.Body.String())
+	}
+	body = `{"id": "entry"}`
+	w = serve("gzip")
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "1", w.Header().Get("Content-Length"))
+	assert.Equal(t, body, w.Body.String())
+
+	// The files and the archives don't compress and a not modified list has no body
+	body, contentType = large, "application/octet-stream"
+	assert.Empty(t, serve("gzip").Header().Get("Content-Encoding"))
+	contentType = "application/zip"
+	assert.Empty(t, serve("gzip").Header().Get("Content-Encoding"))
+	// Nor does a range, whatever its type
+	contentType, status = "application/pdf", http.StatusPartialContent
+	assert.Empty(t, serve("gzip").Header().Get("Content-Encoding"))
+	body, contentType, status = "", "", http.StatusNotModified
+	w = serve("gzip")
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+}
+
+func TestCompressor_Stream(t *testing.T) {
+	handler := NewCompressor(16, 1<<20, nil).Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		rc := http.NewResponseController(w)
+		io.WriteString(w, ": heartbeat\n\n")
+		require.NoError(t, rc.Flush())
+		io.WriteString(w, "event: change\ndata: {\"table\": \"TextData\"}\n\n")
+		require.NoError(t, rc.Flush())
+	}))
+
+	// The events are sent as they are written, not held until the stream is long enough
+	r := httptest.NewRequest(http.MethodGet, "/api/events", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.True(t, w.Flushed)
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, ": heartbeat\n\nevent: change\ndata: {\"table\": \"TextData\"}\n\n", w.Body.String())
+}
+
+func TestCompressor_Request(t *testing.T) {
+	var received []byte
+	var called bool
+	handler := NewCompressor(1024, 1024, []string{"/api/sync"}).Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		assert.NotEqual(t, "gzip", r.Header.Get("Content-Encoding"))
+		var err error
+		received, err = io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(received)), r.ContentLength)
+	}))
+	push := func(path string, body io.Reader, encoding string) int {
+		called = false
+		r := httptest.NewRequest(http.MethodPost, path, body)
+		r.Header.Set("Content-Encoding", encoding)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// A gzipped push reaches the handler decompressed
+	changes := `{"changes": [{"table": "TextData", "op": "add", "entry_id": "note"}]}`
+	assert.Equal(t, http.StatusOK, push("/api/sync/push", gzipped(t, []byte(changes)), "gzip"))
+	assert.Equal(t, changes, string(received))
+
+	// A push over the limit once decompressed is rejected before the handler, however small it is compressed
+	bomb := gzipped(t, bytes.Repeat([]byte(" "), 1025))
+	assert.Less(t, bomb.Len(), 100)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, push("/api/sync/push", bomb, "gzip"))
+	assert.False(t, called)
+	assert.Equal(t, http.StatusOK, push("/api/sync/push", gzipped(t, bytes.Repeat([]byte(" "), 1024)), "gzip"))
+
+	// A body which isn't gzip, another encoding and a route not taking compressed bodies are rejected
+	assert.Equal(t, http.StatusBadRequest, push("/api/sync/push", strings.NewReader(changes), "gzip"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, push("/api/sync/push", strings.NewReader(changes), "br"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, push("/sendFile/1/notes.txt", gzipped(t, []byte(changes)), "gzip"))
+	assert.False(t, called)
+	assert.Equal(t, http.StatusOK, push("/sendFile/1/notes.txt", strings.NewReader(changes), "identity"))
 }
@@ -0,0 +1,221 @@
+package middleware
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Priority is the importance of a class of requests under overload.
+// Requests of lower priorities are shed first.
+type Priority int
+
+const (
+	// PriorityLow is the priority of reads which clients can retry later.
+	PriorityLow Priority = iota
+	// PrioritySync is the priority of writes made by synchronization.
+	PrioritySync
+	// PriorityAuth is the priority of registration and login.
+	PriorityAuth
+	// PriorityCritical is the priority of health probes, which are never shed.
+	PriorityCritical
+)
+
+// String returns the name of the priority.
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PrioritySync:
+		return "sync"
+	case PriorityAuth:
+		return "auth"
+	case PriorityCritical:
+		return "critical"
+	}
+
+	return "unknown"
+}
+
+// latencyWindow is the number of recent request latencies the p95 is computed from.
+const latencyWindow = 256
+
+// RouteClass assigns a priority to the requests whose path starts with Prefix.
+// The requests of a Stream class are held open, such as the event streams: they are admitted
+// at their priority, but neither counted in flight nor timed once admitted.
+type RouteClass struct {
+	Prefix   string
+	Priority Priority
+	Stream   bool
+}
+
+// ShedStats describes the current state of the load shedder.
+type ShedStats struct {
+	Level    int
+	InFlight int64
+	P95      time.Duration
+	Shed     map[Priority]int64
+}
+
+// LoadShedder is an HTTP middleware rejecting requests when the server is overloaded.
+// The load is the larger of the in-flight requests and the p95 latency relative
+// to their limits, the higher it gets the more priorities are shed.
+type LoadShedder struct {
+	maxInFlight int64
+	maxLatency  time.Duration
+	classes     []RouteClass
+	log         Log
+
+	inFlight int64
+	shed     [PriorityCritical + 1]int64
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	next      int
+}
+
+// NewLoadShedder creates a new instance of LoadShedder with the specified limits and route classes.
+// A zero limit disables shedding by that signal. Paths not matching any class get PriorityLow.
+func NewLoadShedder(maxInFlight int, maxLatency time.Duration, classes []RouteClass, log Log) *LoadShedder {
+	return &LoadShedder{
+		maxInFlight: int64(maxInFlight),
+		maxLatency:  maxLatency,
+		classes:     classes,
+		log:         log,
+		latencies:   make([]time.Duration, 0, latencyWindow),
+	}
+}
+
+// Shed is an HTTP middleware that rejects requests with 503 Service Unavailable
+// when their priority is shed at the current load level.
+func (ls *LoadShedder) Shed(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class := ls.class(r.URL.Path)
+		priority := class.Priority
+
+		level := ls.level(atomic.LoadInt64(&ls.inFlight), ls.p95())
+		if !admitted(priority, level) {
+			atomic.AddInt64(&ls.shed[priority], 1)
+			ls.log.Info("request shed",
+				zap.String("path", r.URL.Path),
+				zap.String("priority", priority.String()),
+				zap.Int("level", level),
+			)
+
+			w.Header().Set("Retry-After", strconv.Itoa(level))
+			http.Error(w, "server is overloaded", http.StatusServiceUnavailable)
+			return
+		}
+
+		if class.Stream {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		atomic.AddInt64(&ls.inFlight, 1)
+		defer atomic.AddInt64(&ls.inFlight, -1)
+
+		start := time.Now()
+		h.ServeHTTP(w, r)
+
+		// Health probes are cheap and would hide the latency of the storage
+		if priority != PriorityCritical {
+			ls.observe(time.Since(start))
+		}
+	})
+}
+
+// Stats returns the current load level, in-flight requests, p95 latency and shed counts.
+func (ls *LoadShedder) Stats() ShedStats {
+	inFlight := atomic.LoadInt64(&ls.inFlight)
+	p95 := ls.p95()
+
+	stats := ShedStats{
+		Level:    ls.level(inFlight, p95),
+		InFlight: inFlight,
+		P95:      p95,
+		Shed:     make(map[Priority]int64, len(ls.shed)),
+	}
+	for p := range ls.shed {
+		stats.Shed[Priority(p)] = atomic.LoadInt64(&ls.shed[p])
+	}
+
+	return stats
+}
+
+// class returns the first route class matching the path, a class of PriorityLow if none does.
+func (ls *LoadShedder) class(path string) RouteClass {
+	for _, c := range ls.classes {
+		if strings.HasPrefix(path, c.Prefix) {
+			return c
+		}
+	}
+
+	return RouteClass{Prefix: path, Priority: PriorityLow}
+}
+
+// level returns the number of priorities shed at the given load.
+// Up to the limits nothing is shed, then every half of the limit over it sheds one more priority.
+func (ls *LoadShedder) level(inFlight int64, p95 time.Duration) int {
+	var load float64
+	if ls.maxInFlight > 0 {
+		load = float64(inFlight) / float64(ls.maxInFlight)
+	}
+	if ls.maxLatency > 0 {
+		if l := float64(p95) / float64(ls.maxLatency); l > load {
+			load = l
+		}
+	}
+
+	switch {
+	case load < 1:
+		return 0
+	case load < 1.5:
+		return 1
+	case load < 2:
+		return 2
+	}
+
+	return int(PriorityCritical)
+}
+
+// admitted reports whether a request of the priority is served at the load level.
+func admitted(priority Priority, level int) bool {
+	return priority == PriorityCritical || int(priority) >= level
+}
+
+// observe records the latency of a served request.
+func (ls *LoadShedder) observe(d time.Duration) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if len(ls.latencies) < latencyWindow {
+		ls.latencies = append(ls.latencies, d)
+		return
+	}
+
+	ls.latencies[ls.next] = d
+	ls.next = (ls.next + 1) % latencyWindow
+}
+
+// p95 returns the 95th percentile of the recent request latencies.
+func (ls *LoadShedder) p95() time.Duration {
+	ls.mu.Lock()
+	sorted := make([]time.Duration, len(ls.latencies))
+	copy(sorted, ls.latencies)
+	ls.mu.Unlock()
+
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return sorted[(len(sorted)*95-1)/100]
+}
@@ -0,0 +1,135 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zapcore"
+)
+
+type nopLog struct{}
+
+func (nopLog) Info(string, ...zapcore.Field) {}
+
+var testClasses = []RouteClass{
+	{Prefix: "/ping", Priority: PriorityCritical},
+	{Prefix: "/login", Priority: PriorityAuth},
+	{Prefix: "/api/sync/push", Priority: PrioritySync},
+	{Prefix: "/api/events", Priority: PriorityLow, Stream: true},
+}
+
+func TestLoadShedder_PriorityOrdering(t *testing.T) {
+	ls := NewLoadShedder(100, time.Second, testClasses, nopLog{})
+
+	tests := []struct {
+		name     string
+		inFlight int64
+		p95      time.Duration
+		admitted []Priority
+	}{
+		{"idle", 0, 0, []Priority{PriorityLow, PrioritySync, PriorityAuth, PriorityCritical}},
+		{"in-flight at limit", 100, 0, []Priority{PrioritySync, PriorityAuth, PriorityCritical}},
+		{"slow storage", 0, 1200 * time.Millisecond, []Priority{PrioritySync, PriorityAuth, PriorityCritical}},
+		{"in-flight over limit", 160, 0, []Priority{PriorityAuth, PriorityCritical}},
+		{"very slow storage", 10, 1800 * time.Millisecond, []Priority{PriorityAuth, PriorityCritical}},
+		{"saturated", 500, 10 * time.Second, []Priority{PriorityCritical}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			level := ls.level(tt.inFlight, tt.p95)
+
+			var got []Priority
+			for p := PriorityLow; p <= PriorityCritical; p++ {
+				if admitted(p, level) {
+					got = append(got, p)
+				}
+			}
+			assert.Equal(t, tt.admitted, got)
+		})
+	}
+}
+
+func TestLoadShedder_Shed(t *testing.T) {
+	ls := NewLoadShedder(10, time.Second, testClasses, nopLog{})
+	handler := ls.Shed(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, serve("/getAllData/UserCredentials/1/x").Code)
+
+	// Simulate requests stuck in a slow storage
+	atomic.StoreInt64(&ls.inFlight, 16)
+
+	w := serve("/getAllData/UserCredentials/1/x")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusServiceUnavailable, serve("/api/sync/push").Code)
+	assert.Equal(t, http.StatusOK, serve("/login").Code)
+	assert.Equal(t, http.StatusOK, serve("/ping").Code)
+
+	atomic.StoreInt64(&ls.inFlight, 1000)
+	assert.Equal(t, http.StatusServiceUnavailable, serve("/login").Code)
+	assert.Equal(t, http.StatusOK, serve("/ping").Code)
+
+	stats := ls.Stats()
+	assert.Equal(t, 3, stats.Level)
+	assert.Equal(t, int64(1), stats.Shed[PriorityLow])
+	assert.Equal(t, int64(1), stats.Shed[PrioritySync])
+	assert.Equal(t, int64(1), stats.Shed[PriorityAuth])
+	assert.Equal(t, int64(0), stats.Shed[PriorityCritical])
+}
+
+func TestLoadShedder_Stream(t *testing.T) {
+	ls := NewLoadShedder(10, time.Second, testClasses, nopLog{})
+	var inFlight int64
+	handler := ls.Shed(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight = atomic.LoadInt64(&ls.inFlight)
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(path string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	// A stream held open is neither in flight nor timed
+	assert.Equal(t, http.StatusOK, serve("/api/events"))
+	assert.Zero(t, inFlight)
+	assert.Zero(t, ls.Stats().P95)
+	assert.Equal(t, http.StatusOK, serve("/getAllData/UserCredentials/1/x"))
+	assert.Equal(t, int64(1), inFlight)
+
+	// It is still shed at its priority
+	atomic.StoreInt64(&ls.inFlight, 16)
+	assert.Equal(t, http.StatusServiceUnavailable, serve("/api/events"))
+}
+
+func TestLoadShedder_P95(t *testing.T) {
+	ls := NewLoadShedder(0, time.Second, nil, nopLog{})
+
+	for i := 1; i <= 100; i++ {
+		ls.observe(time.Duration(i) * time.Millisecond)
+	}
+	assert.Equal(t, 95*time.Millisecond, ls.p95())
+	assert.Equal(t, 0, ls.Stats().Level)
+
+	// Old latencies leave the window
+	for i := 0; i < latencyWindow; i++ {
+		ls.observe(1500 * time.Millisecond)
+	}
+	assert.Equal(t, 1500*time.Millisecond, ls.p95())
+	assert.Equal(t, 2, ls.Stats().Level)
+}
@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"go.uber.org/zap"
+)
+
+// ProtocolHeader carries the range of the protocol versions a client supports on every request,
+// as "<min>-<max>" or a single version. The response carries the version negotiated for the request.
+const ProtocolHeader = "X-Protocol-Version"
+
+// The sides of a failed negotiation, the one too old to speak a version of the other.
+const (
+	OutdatedClient = "client"
+	OutdatedServer = "server"
+)
+
+// ProtocolMismatch is the response to a client with no protocol version in common with the server.
+type ProtocolMismatch struct {
+	Error    string               `json:"error"`
+	Outdated string               `json:"outdated"`
+	Client   models.ProtocolRange `json:"client"`
+	Server   models.ProtocolRange `json:"server"`
+}
+
+// ProtocolNegotiator selects the protocol version of each request, the highest version both the client
+// and the server speak. The clients from before the negotiation send no range and speak ProtocolV1.
+type ProtocolNegotiator struct {
+	server models.ProtocolRange
+	log    Log
+}
+
+// NewProtocolNegotiator creates a new instance of ProtocolNegotiator for the versions the server speaks.
+func NewProtocolNegotiator(server models.ProtocolRange, log Log) *ProtocolNegotiator {
+	return &ProtocolNegotiator{server: server, log: log}
+}
+
+// parseProtocolRange parses the range of a ProtocolHeader, an empty one is ProtocolV1.
+func parseProtocolRange(value string) (models.ProtocolRange, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return models.ProtocolRange{Min: models.ProtocolV1, Max: models.ProtocolV1}, nil
+	}
+
+	first, last, found := strings.Cut(value, "-")
+	if !found {
+		last = first
+	}
+	lo, err := strconv.Atoi(strings.TrimSpace(first))
+	if err != nil {
+		return models.ProtocolRange{}, fmt.Errorf("malformed protocol version %q", value)
+	}
+	hi, err := strconv.Atoi(strings.TrimSpace(last))
+	if err != nil {
+		return models.ProtocolRange{}, fmt.Errorf("malformed protocol version %q", value)
+	}
+	if lo < models.ProtocolV1 || hi < lo {
+		return models.ProtocolRange{}, fmt.Errorf("invalid protocol version range %q", value)
+	}
+
+	return models.ProtocolRange{Min: lo, Max: hi}, nil
+}
+
+// negotiate returns the highest version of both ranges, or the side too old to speak the other's.
+func negotiate(client, server models.ProtocolRange) (int, string) {
+	switch {
+	case client.Max < server.Min:
+		return 0, OutdatedClient
+	case client.Min > server.Max:
+		return 0, OutdatedServer
+	}
+
+	return min(client.Max, server.Max), ""
+}
+
+// Negotiate puts the negotiated protocol version into the context of the request and the response header.
+// A client with no version in common gets 426 with a ProtocolMismatch telling which side must upgrade.
+func (pn *ProtocolNegotiator) Negotiate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, err := parseProtocolRange(r.Header.Get(ProtocolHeader))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		version, outdated := negotiate(client, pn.server)
+		if outdated != "" {
+			pn.log.Info("protocol negotiation failed", zap.String("outdated", outdated),
+				zap.Int("client_min", client.Min), zap.Int("client_max", client.Max))
+			writeProtocolMismatch(w, ProtocolMismatch{
+				Error:    "no protocol version in common, the " + outdated + " must be upgraded",
+				Outdated: outdated,
+				Client:   client,
+				Server:   pn.server,
+			})
+			return
+		}
+
+		var keyProtocol models.Key = "protocol"
+		w.Header().Set(ProtocolHeader, strconv.Itoa(version))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), keyProtocol, version)))
+	})
+}
+
+// writeProtocolMismatch responds with the mismatch as 426 Upgrade Required.
+func writeProtocolMismatch(w http.ResponseWriter, mismatch ProtocolMismatch) {
+	body, err := json.Marshal(mismatch)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUpgradeRequired)
+	w.Write(body)
+}
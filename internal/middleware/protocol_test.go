@@ -0,0 +1,103 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// serveProtocol sends a request with the header of the client range, empty for none, through the negotiator.
+func serveProtocol(t *testing.T, server models.ProtocolRange, header string) (*httptest.ResponseRecorder, int) {
+	t.Helper()
+
+	var negotiated int
+	handler := NewProtocolNegotiator(server, nopLog{}).Negotiate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		negotiated = models.ProtocolFromContext(r.Context())
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/sync/push", nil)
+	if header != "" {
+		req.Header.Set(ProtocolHeader, header)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	return rr, negotiated
+}
+
+func TestProtocolNegotiator_Overlap(t *testing.T) {
+	server := models.ProtocolRange{Min: 1, Max: 3}
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"client range within", "1-2", 2},
+		{"client range above", "2-5", 3},
+		{"single version", "2", 2},
+		{"spaces", " 1 - 3 ", 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr, negotiated := serveProtocol(t, server, tt.header)
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, tt.want, negotiated)
+			assert.Equal(t, strconv.Itoa(tt.want), rr.Header().Get(ProtocolHeader))
+		})
+	}
+}
+
+func TestProtocolNegotiator_NoOverlap(t *testing.T) {
+	server := models.ProtocolRange{Min: 2, Max: 3}
+
+	tests := []struct {
+		name     string
+		header   string
+		outdated string
+	}{
+		{"old client", "1", OutdatedClient},
+		{"client without a range", "", OutdatedClient},
+		{"old server", "4-6", OutdatedServer},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr, _ := serveProtocol(t, server, tt.header)
+			require.Equal(t, http.StatusUpgradeRequired, rr.Code)
+			assert.Empty(t, rr.Header().Get(ProtocolHeader))
+
+			var mismatch ProtocolMismatch
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &mismatch))
+			assert.Equal(t, tt.outdated, mismatch.Outdated)
+			assert.Equal(t, server, mismatch.Server)
+			assert.Contains(t, mismatch.Error, tt.outdated)
+		})
+	}
+}
+
+func TestProtocolNegotiator_V1Client(t *testing.T) {
+	server := models.ProtocolRange{Min: models.ProtocolV1, Max: 2}
+
+	// A client speaking only the first version, with or without the header, keeps speaking it
+	for _, header := range []string{"", "1", "1-1"} {
+		rr, negotiated := serveProtocol(t, server, header)
+		assert.Equal(t, http.StatusOK, rr.Code, header)
+		assert.Equal(t, models.ProtocolV1, negotiated, header)
+		assert.Equal(t, "1", rr.Header().Get(ProtocolHeader), header)
+	}
+}
+
+func TestProtocolNegotiator_Malformed(t *testing.T) {
+	for _, header := range []string{"v2", "1-x", "3-1", "0-2"} {
+		rr, _ := serveProtocol(t, models.ServerProtocol, header)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, header)
+	}
+}
@@ -0,0 +1,229 @@
+package middleware
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RateGroup is a group of routes whose requests are counted together against the limit of a client.
+type RateGroup int
+
+const (
+	// RateGroupData is the group of the data routes, and of the routes matching no RateRoute.
+	RateGroupData RateGroup = iota
+	// RateGroupAuth is the group of the routes issuing and checking credentials, limited more strictly.
+	RateGroupAuth
+	// RateGroupExempt is the group of the routes which aren't rate limited.
+	RateGroupExempt
+	// RateGroupExport is the group of the vault export and import, which read or write every entry of the user.
+	RateGroupExport
+)
+
+// String returns the name of the group.
+func (g RateGroup) String() string {
+	switch g {
+	case RateGroupData:
+		return "data"
+	case RateGroupAuth:
+		return "auth"
+	case RateGroupExempt:
+		return "exempt"
+	case RateGroupExport:
+		return "export"
+	}
+
+	return "unknown"
+}
+
+// otherRoute is the route label of the requests whose path matches no RateRoute.
+const otherRoute = "other"
+
+// rateSweepInterval is how often the buckets of MemLimiter which refilled are dropped.
+const rateSweepInterval = time.Minute
+
+// Limit is the token bucket of a client: Burst requests at once, refilled at Rate requests per second.
+// A Rate of 0 or less doesn't limit the requests.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateRoute assigns the requests whose path starts with Prefix to a group. The prefix labels the
+// rejected requests in the metrics.
+type RateRoute struct {
+	Prefix string
+	Group  RateGroup
+}
+
+// Limiter takes the tokens of the requests from the buckets of the clients. MemLimiter keeps the buckets
+// of a server in memory, a limiter on a shared store would limit a client across the servers.
+type Limiter interface {
+	// Allow takes a token from the bucket of the key and returns 0, or how long until the bucket
+	// has a token again if it is empty.
+	Allow(ctx context.Context, key string, limit Limit) (time.Duration, error)
+}
+
+// RateMetrics counts the requests rejected by the rate limiter, see RateLimiter.SetMetrics.
+type RateMetrics interface {
+	// ObserveRateLimited counts a rejected request of the route.
+	ObserveRateLimited(route string)
+}
+
+// RateLimiter is an HTTP middleware rejecting the requests of a client over the limit of their group of routes,
+// so a client retrying in a loop can't saturate the storage for the others. The clients are told apart
+// by identify, and by their address when it returns an empty key.
+type RateLimiter struct {
+	limiter  Limiter
+	limits   map[RateGroup]Limit
+	routes   []RateRoute
+	identify func(*http.Request) string
+	metrics  RateMetrics
+	log      Log
+}
+
+// NewRateLimiter creates a new instance of RateLimiter with the limits of the groups and the routes.
+// A group without a limit isn't limited.
+func NewRateLimiter(limiter Limiter, limits map[RateGroup]Limit, routes []RateRoute,
+	identify func(*http.Request) string, log Log) *RateLimiter {
+	return &RateLimiter{
+		limiter:  limiter,
+		limits:   limits,
+		routes:   routes,
+		identify: identify,
+		log:      log,
+	}
+}
+
+// SetMetrics sets the metrics the rejected requests are counted in.
+func (rl *RateLimiter) SetMetrics(m RateMetrics) {
+	rl.metrics = m
+}
+
+// Limit is an HTTP middleware that rejects the requests over the limit with 429 Too Many Requests
+// and a 'Retry-After' header. A request whose limit can't be checked is served.
+func (rl *RateLimiter) Limit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group, route := rl.route(r.URL.Path)
+		limit, ok := rl.limits[group]
+		if group == RateGroupExempt || !ok || limit.Rate <= 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		client := rl.identify(r)
+		if client == "" {
+			client = "addr:" + remoteHost(r)
+		}
+
+		retry, err := rl.limiter.Allow(r.Context(), group.String()+"|"+client, limit)
+		if err != nil {
+			rl.log.Info("rate limit unavailable", zap.String("group", group.String()), zap.Error(err))
+			h.ServeHTTP(w, r)
+			return
+		}
+		if retry > 0 {
+			if rl.metrics != nil {
+				rl.metrics.ObserveRateLimited(route)
+			}
+			rl.log.Info("request rate limited",
+				zap.String("path", r.URL.Path),
+				zap.String("group", group.String()),
+				zap.String("client", client),
+			)
+
+			seconds := max(int(math.Ceil(retry.Seconds())), 1)
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			http.Error(w, "too many requests, retry later", http.StatusTooManyRequests)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// route returns the group of the first route matching the path and its prefix, RateGroupData and
+// otherRoute if none does.
+func (rl *RateLimiter) route(path string) (RateGroup, string) {
+	for _, rr := range rl.routes {
+		if strings.HasPrefix(path, rr.Prefix) {
+			return rr.Group, rr.Prefix
+		}
+	}
+
+	return RateGroupData, otherRoute
+}
+
+// remoteHost returns the address of the client of the request, without its port.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// bucket is the token bucket of a client as of its last request.
+type bucket struct {
+	tokens float64
+	at     time.Time
+	// full is when the bucket has refilled, it is dropped after
+	full time.Time
+}
+
+// MemLimiter is a Limiter keeping the token buckets in memory, per server.
+type MemLimiter struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+// NewMemLimiter creates a new instance of MemLimiter.
+func NewMemLimiter() *MemLimiter {
+	return &MemLimiter{now: time.Now, buckets: make(map[string]*bucket)}
+}
+
+// Allow takes a token from the bucket of the key, a new bucket is full. The buckets which refilled
+// are dropped once per rateSweepInterval, so the clients seen once don't accumulate.
+func (m *MemLimiter) Allow(_ context.Context, key string, limit Limit) (time.Duration, error) {
+	burst := float64(max(limit.Burst, 1))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	if now.Sub(m.swept) >= rateSweepInterval {
+		for k, b := range m.buckets {
+			if !now.Before(b.full) {
+				delete(m.buckets, k)
+			}
+		}
+		m.swept = now
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, at: now}
+		m.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.at).Seconds()*limit.Rate)
+	b.at = now
+
+	if b.tokens < 1 {
+		return max(time.Duration((1-b.tokens)/limit.Rate*float64(time.Second)), time.Nanosecond), nil
+	}
+	b.tokens--
+	b.full = now.Add(time.Duration((burst - b.tokens) / limit.Rate * float64(time.Second)))
+
+	return 0, nil
+}
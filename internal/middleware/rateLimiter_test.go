@@ -0,0 +1,210 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testRateRoutes = []RateRoute{
+	{Prefix: "/ping", Group: RateGroupExempt},
+	{Prefix: "/login", Group: RateGroupAuth},
+	{Prefix: "/api/sync/", Group: RateGroupData},
+}
+
+// rejections counts the rejected requests by route.
+type rejections struct {
+	mu     sync.Mutex
+	routes map[string]int
+}
+
+func (r *rejections) ObserveRateLimited(route string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.routes == nil {
+		r.routes = make(map[string]int)
+	}
+	r.routes[route]++
+}
+
+// failingLimiter is a Limiter whose store is unreachable.
+type failingLimiter struct{}
+
+func (failingLimiter) Allow(context.Context, string, Limit) (time.Duration, error) {
+	return 0, errors.New("store unreachable")
+}
+
+// fixedClock returns a clock standing at now until moved.
+func fixedClock(now *time.Time) func() time.Time {
+	return func() time.Time { return *now }
+}
+
+// identifyHeader identifies the clients by the 'X-User' header of the test requests.
+func identifyHeader(r *http.Request) string {
+	if user := r.Header.Get("X-User"); user != "" {
+		return "user:" + user
+	}
+	return ""
+}
+
+func TestMemLimiter_Allow(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := NewMemLimiter()
+	m.now = fixedClock(&now)
+	limit := Limit{Rate: 2, Burst: 3}
+
+	// A new bucket is full
+	for i := 0; i < 3; i++ {
+		retry, err := m.Allow(ctx, "a", limit)
+		require.NoError(t, err)
+		assert.Zero(t, retry)
+	}
+	retry, err := m.Allow(ctx, "a", limit)
+	require.NoError(t, err)
+	assert.Equal(t, 500*time.Millisecond, retry)
+
+	// The buckets are of their key
+	retry, _ = m.Allow(ctx, "b", limit)
+	assert.Zero(t, retry)
+
+	// The bucket refills at the rate, up to the burst
+	now = now.Add(250 * time.Millisecond)
+	retry, _ = m.Allow(ctx, "a", limit)
+	assert.Equal(t, 250*time.Millisecond, retry)
+	now = now.Add(250 * time.Millisecond)
+	retry, _ = m.Allow(ctx, "a", limit)
+	assert.Zero(t, retry)
+
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		retry, _ = m.Allow(ctx, "a", limit)
+		assert.Zero(t, retry)
+	}
+	retry, _ = m.Allow(ctx, "a", limit)
+	assert.Positive(t, retry)
+
+	// The buckets which refilled are dropped
+	now = now.Add(rateSweepInterval)
+	_, _ = m.Allow(ctx, "c", limit)
+	assert.Len(t, m.buckets, 1)
+}
+
+func TestRateLimiter_Limit(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	mem := NewMemLimiter()
+	mem.now = fixedClock(&now)
+	metrics := &rejections{}
+
+	rl := NewRateLimiter(mem, map[RateGroup]Limit{
+		RateGroupAuth: {Rate: 0.1, Burst: 1},
+		RateGroupData: {Rate: 1, Burst: 2},
+	}, testRateRoutes, identifyHeader, nopLog{})
+	rl.SetMetrics(metrics)
+	handler := rl.Limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(path, user, addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = addr
+		if user != "" {
+			req.Header.Set("X-User", user)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// The auth routes are limited more strictly than the data routes
+	assert.Equal(t, http.StatusOK, serve("/login", "", "192.0.2.1:5000").Code)
+	w := serve("/login", "", "192.0.2.1:5001")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "10", w.Header().Get("Retry-After"))
+
+	// The groups have their own buckets, and the other addresses theirs
+	assert.Equal(t, http.StatusOK, serve("/api/sync/push", "", "192.0.2.1:5000").Code)
+	assert.Equal(t, http.StatusOK, serve("/login", "", "192.0.2.2:5000").Code)
+
+	// An authenticated client is limited by user wherever it connects from
+	assert.Equal(t, http.StatusOK, serve("/api/sync/push", "1", "192.0.2.3:5000").Code)
+	assert.Equal(t, http.StatusOK, serve("/getAllData/UserCredentials/1/x", "1", "192.0.2.4:5000").Code)
+	w = serve("/api/sync/push", "1", "192.0.2.5:5000")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusTooManyRequests, serve("/getAllData/UserCredentials/1/x", "1", "192.0.2.3:5000").Code)
+	assert.Equal(t, http.StatusOK, serve("/api/sync/push", "2", "192.0.2.3:5000").Code)
+
+	// The exempt routes aren't limited
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusOK, serve("/ping", "1", "192.0.2.3:5000").Code)
+	}
+
+	// The client is served again once its bucket refilled
+	now = now.Add(time.Second)
+	assert.Equal(t, http.StatusOK, serve("/api/sync/push", "1", "192.0.2.3:5000").Code)
+
+	// The rejections are counted by route, the unknown paths together
+	assert.Equal(t, map[string]int{"/login": 1, "/api/sync/": 1, otherRoute: 1}, metrics.routes)
+}
+
+func TestRateLimiter_LimiterUnavailable(t *testing.T) {
+	rl := NewRateLimiter(failingLimiter{}, map[RateGroup]Limit{RateGroupData: {Rate: 1, Burst: 1}},
+		testRateRoutes, identifyHeader, nopLog{})
+	handler := rl.Limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// The requests are served rather than all rejected
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/sync/push", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+}
+
+func TestRateLimiter_Concurrent(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	mem := NewMemLimiter()
+	mem.now = fixedClock(&now)
+
+	const burst = 20
+	rl := NewRateLimiter(mem, map[RateGroup]Limit{RateGroupData: {Rate: 1, Burst: burst}},
+		testRateRoutes, identifyHeader, nopLog{})
+
+	var served int64
+	handler := rl.Limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&served, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// The concurrent requests of two clients take exactly the tokens of their buckets
+	var wg sync.WaitGroup
+	var rejected [2]int64
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/api/sync/push", nil)
+			req.Header.Set("X-User", []string{"1", "2"}[client])
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code == http.StatusTooManyRequests {
+				atomic.AddInt64(&rejected[client], 1)
+			}
+		}(i % 2)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(2*burst), atomic.LoadInt64(&served))
+	assert.Equal(t, int64(100-burst), rejected[0])
+	assert.Equal(t, int64(100-burst), rejected[1])
+}
@@ -2,12 +2,22 @@
 package middleware
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"net/http"
 
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
+// RequestIDHeader carries the id of a request, a client or proxy may set it to correlate the logs.
+const RequestIDHeader = "X-Request-ID"
+
+// deviceIDHeader carries the id of the device of the client, see controllers.DeviceIDHeader.
+const deviceIDHeader = "X-Device-ID"
+
 // Log is an interface for logging operations.
 type Log interface {
 	Info(string, ...zapcore.Field)
@@ -26,12 +36,39 @@ func NewReqLog(log Log) *ReqLog {
 }
 
 // RequestLogger is an HTTP middleware that logs incoming requests.
+// It assigns every request an id, returned in the X-Request-ID header and carried
+// in the context as a log field, so the logs of the storage can be correlated with the request.
+// The context also carries the address and the user agent of the client for the audit log,
+// and its device for the change notifications.
 func (rl *ReqLog) RequestLogger(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		rl.log.Info("got incoming HTTP request",
+		requestID := r.Header.Get(RequestIDHeader)
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+
+		ctx := logger.WithFields(r.Context(), zap.String("request_id", requestID))
+		ctx = models.WithClient(ctx, models.Client{
+			RemoteAddr: r.RemoteAddr,
+			UserAgent:  r.UserAgent(),
+			DeviceID:   r.Header.Get(deviceIDHeader),
+		})
+
+		rl.log.Info("got incoming HTTP request", logger.ContextFields(ctx,
 			zap.String("method", r.Method),
 			zap.String("path", r.URL.Path),
-		)
-		h.ServeHTTP(w, r)
+		)...)
+		h.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// newRequestID returns a random request id.
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+
+	return hex.EncodeToString(b)
+}
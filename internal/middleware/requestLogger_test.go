@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wurt83ow/gophkeeper-server/internal/logger"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"go.uber.org/zap"
+)
+
+func TestReqLog_RequestID(t *testing.T) {
+	var fields []zap.Field
+	h := NewReqLog(nopLog{}).RequestLogger(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fields = logger.ContextFields(r.Context())
+	}))
+
+	// A request without an id is assigned one
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ping", nil))
+
+	requestID := rec.Header().Get(RequestIDHeader)
+	assert.Len(t, requestID, 16)
+	assert.Equal(t, []zap.Field{zap.String("request_id", requestID)}, fields)
+
+	// The id set by the client is kept
+	req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+	req.Header.Set(RequestIDHeader, "client-id")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	assert.Equal(t, "client-id", rec.Header().Get(RequestIDHeader))
+	assert.Equal(t, []zap.Field{zap.String("request_id", "client-id")}, fields)
+}
+
+func TestReqLog_Client(t *testing.T) {
+	var client models.Client
+	h := NewReqLog(nopLog{}).RequestLogger(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client = models.ClientFrom(r.Context())
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/login", nil)
+	req.RemoteAddr = "192.0.2.1:5000"
+	req.Header.Set("User-Agent", "gophkeeper-client/1.0")
+	req.Header.Set("X-Device-ID", "laptop")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, models.Client{RemoteAddr: "192.0.2.1:5000", UserAgent: "gophkeeper-client/1.0", DeviceID: "laptop"}, client)
+}
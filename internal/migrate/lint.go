@@ -0,0 +1,227 @@
+// Package migrate provides developer tooling for the SQL migrations.
+package migrate
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// fileNameRe describes the naming convention of migration files, e.g. 000001_create_users_table.up.sql.
+var fileNameRe = regexp.MustCompile(`^(\d{6})_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+var (
+	commentRe      = regexp.MustCompile(`--[^\n]*`)
+	ignoreRe       = regexp.MustCompile(`(?m)^--\s*lint:ignore\s+([a-z-]+)`)
+	concurrentlyRe = regexp.MustCompile(`(?i)\bCREATE\s+(UNIQUE\s+)?INDEX\s+CONCURRENTLY\b`)
+	transactionRe  = regexp.MustCompile(`(?i)^(BEGIN|COMMIT|START\s+TRANSACTION)\b`)
+	createRe       = regexp.MustCompile(`(?i)^CREATE\s+(UNIQUE\s+)?(TABLE|INDEX)\b`)
+	createIfRe     = regexp.MustCompile(`(?i)^CREATE\s+(UNIQUE\s+)?(TABLE|INDEX)\s+(CONCURRENTLY\s+)?IF\s+NOT\s+EXISTS\b`)
+	dropRe         = regexp.MustCompile(`(?i)^DROP\s+(TABLE|INDEX)\b`)
+	dropIfRe       = regexp.MustCompile(`(?i)^DROP\s+(TABLE|INDEX)\s+(CONCURRENTLY\s+)?IF\s+EXISTS\b`)
+	addColumnRe    = regexp.MustCompile(`(?i)\bADD\s+COLUMN\b`)
+	addColumnIfRe  = regexp.MustCompile(`(?i)\bADD\s+COLUMN\s+IF\s+NOT\s+EXISTS\b`)
+	dropColumnRe   = regexp.MustCompile(`(?i)\bDROP\s+COLUMN\b`)
+	dropColumnIfRe = regexp.MustCompile(`(?i)\bDROP\s+COLUMN\s+IF\s+EXISTS\b`)
+	whitespaceRe   = regexp.MustCompile(`\s+`)
+	dollarTagRe    = regexp.MustCompile(`^[A-Za-z_]*$`)
+)
+
+// Problem describes a rule violation found in a migration file.
+type Problem struct {
+	File    string
+	Message string
+}
+
+// String returns a human-readable representation of the problem.
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s", p.File, p.Message)
+}
+
+// migration holds the files of a single migration version.
+type migration struct {
+	name string
+	up   string
+	down string
+}
+
+// Lint checks the migrations in dir and returns the problems found, ordered by file name.
+func Lint(dir string) ([]Problem, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []Problem
+	migrations := make(map[int]*migration)
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		name := entry.Name()
+		m := fileNameRe.FindStringSubmatch(name)
+		if m == nil {
+			problems = append(problems, Problem{name, "file name does not match NNNNNN_name.(up|down).sql"})
+			continue
+		}
+
+		version, _ := strconv.Atoi(m[1])
+		mg, ok := migrations[version]
+		if !ok {
+			mg = &migration{name: m[2]}
+			migrations[version] = mg
+		}
+		if mg.name != m[2] {
+			problems = append(problems, Problem{name, fmt.Sprintf("version %s is used by %q and %q", m[1], mg.name, m[2])})
+			continue
+		}
+
+		if m[3] == "up" {
+			mg.up = name
+		} else {
+			mg.down = name
+		}
+
+		fileProblems, err := lintFile(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, fileProblems...)
+	}
+
+	versions := make([]int, 0, len(migrations))
+	for version := range migrations {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+
+	for i, version := range versions {
+		mg := migrations[version]
+		prefix := fmt.Sprintf("%06d_%s", version, mg.name)
+
+		if mg.up == "" {
+			problems = append(problems, Problem{prefix + ".up.sql", "up migration is missing"})
+		}
+		if mg.down == "" {
+			problems = append(problems, Problem{prefix + ".down.sql", "down migration is missing"})
+		}
+		if version != i+1 {
+			problems = append(problems, Problem{prefix, fmt.Sprintf("expected version %06d, versions must be sequential", i+1)})
+		}
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].File < problems[j].File
+	})
+
+	return problems, nil
+}
+
+// lintFile checks the statements of a single migration file.
+func lintFile(dir, name string) ([]Problem, error) {
+	content, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	statements := splitStatements(string(content))
+	if len(statements) == 0 {
+		return []Problem{{name, "migration is empty"}}, nil
+	}
+
+	// A '-- lint:ignore <rule>' line disables the rule for the whole file, e.g. for SQLite,
+	// which has no IF NOT EXISTS for ADD COLUMN
+	ignored := make(map[string]bool)
+	for _, m := range ignoreRe.FindAllStringSubmatch(string(content), -1) {
+		ignored[m[1]] = true
+	}
+
+	var problems []Problem
+	concurrently := false
+	for _, stmt := range statements {
+		if concurrentlyRe.MatchString(stmt) {
+			concurrently = true
+		}
+
+		switch {
+		case createRe.MatchString(stmt) && !createIfRe.MatchString(stmt) && !ignored["create"]:
+			problems = append(problems, Problem{name, "CREATE without IF NOT EXISTS: " + stmt})
+		case dropRe.MatchString(stmt) && !dropIfRe.MatchString(stmt) && !ignored["drop"]:
+			problems = append(problems, Problem{name, "DROP without IF EXISTS: " + stmt})
+		case addColumnRe.MatchString(stmt) && !addColumnIfRe.MatchString(stmt) && !ignored["add-column"]:
+			problems = append(problems, Problem{name, "ADD COLUMN without IF NOT EXISTS: " + stmt})
+		case dropColumnRe.MatchString(stmt) && !dropColumnIfRe.MatchString(stmt) && !ignored["drop-column"]:
+			problems = append(problems, Problem{name, "DROP COLUMN without IF EXISTS: " + stmt})
+		}
+	}
+
+	// A file is executed as a single implicit transaction, which CREATE INDEX CONCURRENTLY can't run in
+	if concurrently && len(statements) > 1 {
+		problems = append(problems, Problem{name, "CREATE INDEX CONCURRENTLY must be the only statement of the migration"})
+	}
+	for _, stmt := range statements {
+		if transactionRe.MatchString(stmt) && concurrently {
+			problems = append(problems, Problem{name, "CREATE INDEX CONCURRENTLY can't run inside a transaction block"})
+			break
+		}
+	}
+
+	return problems, nil
+}
+
+// splitStatements strips comments and splits the SQL into normalized statements.
+// Semicolons inside quoted strings and dollar-quoted bodies don't end a statement.
+func splitStatements(sql string) []string {
+	sql = commentRe.ReplaceAllString(sql, "")
+
+	var (
+		statements []string
+		current    strings.Builder
+		quote      string
+	)
+
+	flush := func() {
+		stmt := strings.TrimSpace(whitespaceRe.ReplaceAllString(current.String(), " "))
+		if stmt != "" {
+			statements = append(statements, stmt)
+		}
+		current.Reset()
+	}
+
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+
+		switch {
+		case quote != "":
+			if strings.HasPrefix(sql[i:], quote) {
+				current.WriteString(quote)
+				i += len(quote) - 1
+				quote = ""
+				continue
+			}
+		case c == '\'':
+			quote = "'"
+		case c == '$':
+			if end := strings.IndexByte(sql[i+1:], '$'); end >= 0 && dollarTagRe.MatchString(sql[i+1:i+1+end]) {
+				quote = sql[i : i+end+2]
+				current.WriteString(quote)
+				i += len(quote) - 1
+				continue
+			}
+		case c == ';':
+			flush()
+			continue
+		}
+
+		current.WriteByte(c)
+	}
+	flush()
+
+	return statements
+}
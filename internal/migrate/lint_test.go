@@ -0,0 +1,150 @@
+package migrate
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeMigrations creates a migrations directory with the given files.
+func writeMigrations(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+
+	return dir
+}
+
+func TestLint_RepositoryMigrations(t *testing.T) {
+	for _, dir := range []string{"../../migrations", "../../migrations/sqlite"} {
+		problems, err := Lint(dir)
+		require.NoError(t, err)
+
+		for _, p := range problems {
+			t.Error(p)
+		}
+	}
+}
+
+func TestLint_Rules(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{
+			name: "valid",
+			files: map[string]string{
+				"000001_create_a.up.sql":   "CREATE TABLE IF NOT EXISTS a (id TEXT); -- comment; with semicolon",
+				"000001_create_a.down.sql": "DROP TABLE IF EXISTS a;",
+			},
+		},
+		{
+			name: "missing down",
+			files: map[string]string{
+				"000001_create_a.up.sql": "CREATE TABLE IF NOT EXISTS a (id TEXT);",
+			},
+			want: "down migration is missing",
+		},
+		{
+			name: "empty down",
+			files: map[string]string{
+				"000001_create_a.up.sql":   "CREATE TABLE IF NOT EXISTS a (id TEXT);",
+				"000001_create_a.down.sql": "  -- nothing to do\n",
+			},
+			want: "migration is empty",
+		},
+		{
+			name: "bad name",
+			files: map[string]string{
+				"1_CreateA.up.sql": "CREATE TABLE IF NOT EXISTS a (id TEXT);",
+			},
+			want: "file name does not match",
+		},
+		{
+			name: "version gap",
+			files: map[string]string{
+				"000002_create_a.up.sql":   "CREATE TABLE IF NOT EXISTS a (id TEXT);",
+				"000002_create_a.down.sql": "DROP TABLE IF EXISTS a;",
+			},
+			want: "versions must be sequential",
+		},
+		{
+			name: "create without if not exists",
+			files: map[string]string{
+				"000001_create_a.up.sql":   "CREATE TABLE a (id TEXT);",
+				"000001_create_a.down.sql": "DROP TABLE IF EXISTS a;",
+			},
+			want: "CREATE without IF NOT EXISTS",
+		},
+		{
+			name: "drop without if exists",
+			files: map[string]string{
+				"000001_create_a.up.sql":   "CREATE INDEX IF NOT EXISTS a_idx ON a (id);",
+				"000001_create_a.down.sql": "DROP INDEX a_idx;",
+			},
+			want: "DROP without IF EXISTS",
+		},
+		{
+			name: "add column without if not exists",
+			files: map[string]string{
+				"000001_alter_a.up.sql":   "ALTER TABLE a ADD COLUMN b TEXT;",
+				"000001_alter_a.down.sql": "ALTER TABLE a DROP COLUMN IF EXISTS b;",
+			},
+			want: "ADD COLUMN without IF NOT EXISTS",
+		},
+		{
+			name: "ignored rule",
+			files: map[string]string{
+				"000001_alter_a.up.sql":   "-- lint:ignore add-column\nALTER TABLE a ADD COLUMN b TEXT;",
+				"000001_alter_a.down.sql": "-- lint:ignore drop-column\nALTER TABLE a DROP COLUMN b;",
+			},
+		},
+		{
+			name: "concurrently mixed with other statements",
+			files: map[string]string{
+				"000001_index_a.up.sql": `CREATE TABLE IF NOT EXISTS a (id TEXT);
+					CREATE INDEX CONCURRENTLY IF NOT EXISTS a_idx ON a (id);`,
+				"000001_index_a.down.sql": "DROP INDEX IF EXISTS a_idx;",
+			},
+			want: "must be the only statement",
+		},
+		{
+			name: "dollar quoted body",
+			files: map[string]string{
+				"000001_func_a.up.sql": `CREATE OR REPLACE FUNCTION a() RETURNS void AS $$
+					BEGIN PERFORM 1; END;
+					$$ LANGUAGE plpgsql;`,
+				"000001_func_a.down.sql": "DROP FUNCTION IF EXISTS a;",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems, err := Lint(writeMigrations(t, tt.files))
+			require.NoError(t, err)
+
+			if tt.want == "" {
+				assert.Empty(t, problems)
+				return
+			}
+
+			var messages []string
+			for _, p := range problems {
+				messages = append(messages, p.String())
+			}
+			assert.Contains(t, strings.Join(messages, "\n"), tt.want)
+		})
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	statements := splitStatements("INSERT INTO a VALUES ('x;y');\n-- comment;\nSELECT 1")
+	assert.Equal(t, []string{"INSERT INTO a VALUES ('x;y')", "SELECT 1"}, statements)
+}
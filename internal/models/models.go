@@ -1,5 +1,753 @@
 package models
 
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
+)
+
+// ErrInvalidChange indicates a malformed change pushed by a client.
+var ErrInvalidChange = errors.New("invalid change")
+
+// ErrNotFound indicates that the requested entry doesn't exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrInvalidQuery indicates a malformed search query.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// ErrUnknownColumn indicates a projection naming a column the table doesn't have.
+var ErrUnknownColumn = errors.New("unknown column")
+
+// ErrInvalidEntryID indicates an entry id sent by a client which isn't a UUID.
+var ErrInvalidEntryID = errors.New("invalid entry id")
+
+// ErrRetrySync indicates a synchronization aborted because of a concurrent one, the client retries it.
+var ErrRetrySync = errors.New("concurrent synchronization, retry")
+
+// ErrEmailTaken indicates an email set by a user which another user already has.
+var ErrEmailTaken = errors.New("email is taken")
+
+// ErrOperationRunning indicates an operation started by a user while another one of theirs is running.
+var ErrOperationRunning = errors.New("another operation is running")
+
+// ErrBlobNotStored indicates a file entry pointed at the stored contents of a checksum which aren't stored,
+// the caller puts their object and points the entry at it.
+var ErrBlobNotStored = errors.New("the contents aren't stored")
+
+// ErrInvalidShare indicates a share of an entry which can't be granted, such as one with the owner.
+var ErrInvalidShare = errors.New("invalid share")
+
+// ErrReadOnlyShare indicates a write to an entry of another user shared read-only with the user.
+var ErrReadOnlyShare = errors.New("the entry is shared read-only")
+
+// ErrInvalidFolder indicates a folder which can't be stored, such as one without a name or inside itself.
+var ErrInvalidFolder = errors.New("invalid folder")
+
+// ErrFolderExists indicates a folder named like another folder of the same parent, ignoring the case.
+var ErrFolderExists = errors.New("a folder with the name exists")
+
+// ErrFolderNotEmpty indicates the deletion of a folder which holds entries or other folders.
+var ErrFolderNotEmpty = errors.New("the folder is not empty")
+
+// DataTables lists the tables holding the entries of users.
+var DataTables = []string{"UserCredentials", "CreditCardData", "TextData", "FilesData", OtpTable, SshKeysTable}
+
+// IsDataTable reports whether the table holds the entries of users.
+func IsDataTable(table string) bool {
+	for _, t := range DataTables {
+		if t == table {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NewEntryID returns a new random entry id, for an entry added without one.
+func NewEntryID() string {
+	return uuid.NewString()
+}
+
+// ValidateEntryID checks that the entry id sent by a client is a UUID in its canonical
+// 36-character form, in either case.
+// It returns an error wrapping ErrInvalidEntryID if it isn't.
+func ValidateEntryID(id string) error {
+	if _, err := uuid.Parse(id); err != nil || len(id) != 36 {
+		return fmt.Errorf("%w: %q must be a UUID", ErrInvalidEntryID, id)
+	}
+
+	return nil
+}
+
+// SearchColumn is the column of the data tables matched by search queries.
+const SearchColumn = "meta_info"
+
+// MaxSearchText is the number of characters of the search column of an entry which are indexed,
+// the rest isn't matched by search queries. It keeps the index of a large meta information
+// well below the size limits of the full-text search.
+const MaxSearchText = 64 << 10
+
+// SearchTruncated marks the end of an indexed text cut at MaxSearchText.
+const SearchTruncated = " …"
+
+// SearchSource returns the text of the entry matched by search queries: the value of the search column,
+// followed by the preview if the entry has one.
+func SearchSource(row map[string]string) string {
+	text, preview := row[SearchColumn], row[PreviewField]
+	if text == "" || preview == "" {
+		return text + preview
+	}
+
+	return text + " " + preview
+}
+
+// SearchText returns the indexed text of the value of the search column, cut after MaxSearchText
+// characters and marked, and whether it was cut. The same value is always cut at the same place.
+func SearchText(value string) (string, bool) {
+	chars := 0
+	for i := range value {
+		if chars == MaxSearchText {
+			return value[:i] + SearchTruncated, true
+		}
+		chars++
+	}
+
+	return value, false
+}
+
+// Display timestamps are declared by clients, e.g. the dates of an entry imported from another
+// password manager. They are set when the entry is created and never changed by the server,
+// the synchronization relies on 'updated_at' only.
+const (
+	ClientCreatedAt  = "client_created_at"
+	ClientModifiedAt = "client_modified_at"
+)
+
+// ClientTimeFields lists the display timestamp fields of the entries.
+var ClientTimeFields = []string{ClientCreatedAt, ClientModifiedAt}
+
+// minClientTime is the earliest display timestamp accepted from a client.
+var minClientTime = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// maxClientTimeSkew is how far in the future a display timestamp may be, to tolerate client clocks.
+const maxClientTimeSkew = 24 * time.Hour
+
+// NormalizeClientTime validates a display timestamp and returns it in UTC RFC 3339.
+// It returns an error wrapping ErrInvalidChange if the timestamp is malformed or outside the sane range.
+func NormalizeClientTime(key, value string, now time.Time) (string, error) {
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s must be an RFC 3339 timestamp", ErrInvalidChange, key)
+	}
+	if t.Before(minClientTime) || t.After(now.Add(maxClientTimeSkew)) {
+		return "", fmt.Errorf("%w: %s is out of range", ErrInvalidChange, key)
+	}
+
+	return t.UTC().Format(time.RFC3339Nano), nil
+}
+
+// IsClientTimeField reports whether the field is a display timestamp.
+func IsClientTimeField(key string) bool {
+	return key == ClientCreatedAt || key == ClientModifiedAt
+}
+
+// TagsField is the field holding the labels of an entry, returned to clients as a comma-separated list.
+const TagsField = "tags"
+
+// ParseTags parses the tags of an entry given as a comma-separated list or a JSON array.
+// Tags are matched case-insensitively, so they are returned in lower case without duplicates.
+// It returns an error wrapping ErrInvalidChange if a tag is empty or contains a quote, a brace or a backslash.
+func ParseTags(value string) ([]string, error) {
+	var list []string
+	if strings.HasPrefix(strings.TrimSpace(value), "[") {
+		if err := json.Unmarshal([]byte(value), &list); err != nil {
+			return nil, fmt.Errorf("%w: tags must be a list: %v", ErrInvalidChange, err)
+		}
+	} else if strings.TrimSpace(value) != "" {
+		list = strings.Split(value, ",")
+	}
+
+	tags := make([]string, 0, len(list))
+	seen := make(map[string]bool, len(list))
+	for _, tag := range list {
+		tag, err := ParseTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags, nil
+}
+
+// ParseTag parses a single tag and returns it normalized.
+// It returns an error wrapping ErrInvalidChange if the tag is empty or contains a reserved character.
+func ParseTag(tag string) (string, error) {
+	tag = NormalizeTag(tag)
+	if tag == "" {
+		return "", fmt.Errorf("%w: tags must not be empty", ErrInvalidChange)
+	}
+	if strings.ContainsAny(tag, `,"{}\`) {
+		return "", fmt.Errorf("%w: tag %q contains a reserved character", ErrInvalidChange, tag)
+	}
+
+	return tag, nil
+}
+
+// RenameTag returns the tags with the tag from replaced by the tag to in its place, and whether from was among them.
+// If the entry already has the tag to, the two are merged into the first of them.
+func RenameTag(tags []string, from, to string) ([]string, bool) {
+	renamed := make([]string, 0, len(tags))
+	found := false
+	for _, tag := range tags {
+		if tag == from {
+			found = true
+			tag = to
+		}
+		if !slices.Contains(renamed, tag) {
+			renamed = append(renamed, tag)
+		}
+	}
+
+	return renamed, found
+}
+
+// NormalizeTag returns the tag in the form it is stored and matched in.
+func NormalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// FormatTags returns the tags as a comma-separated list.
+func FormatTags(tags []string) string {
+	return strings.Join(tags, ",")
+}
+
+// ExpiresAtField is the field holding the time after which an entry is deleted, e.g. of a one-time code.
+// An empty value clears it, so the entry never expires.
+const ExpiresAtField = "expires_at"
+
+// ParseExpiresAt parses the expires_at field of an entry, the zero time means it never expires.
+// It returns an error wrapping ErrInvalidChange if the value isn't an RFC 3339 timestamp.
+func ParseExpiresAt(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %s must be an RFC 3339 timestamp", ErrInvalidChange, ExpiresAtField)
+	}
+
+	return t.UTC(), nil
+}
+
+// PreviewField is the field holding the plaintext snippet of a note shown by the list views,
+// e.g. its first characters. The server can't read the notes, their clients cut and upload it.
+const PreviewField = "preview"
+
+// FilesTable is the data table of the files, whose contents are stored apart under the ids of their entries.
+const FilesTable = "FilesData"
+
+// ContentURLField is the field added to the entries of FilesTable sent to the clients, the path
+// the contents of the file are downloaded from. It isn't stored.
+const ContentURLField = "content_url"
+
+// FileContentURL returns the path of the contents of the file of the entry.
+func FileContentURL(entryID string) string {
+	return "/api/files/" + entryID + "/content"
+}
+
+// FolderField is the field holding the id of the folder of an entry, an entry without one is at the top of the vault.
+const FolderField = "folder_id"
+
+// RootFolder selects the entries in no folder, at the top of the vault, in DataQuery.Folder.
+const RootFolder = "root"
+
+// ParseFolderID validates the folder of an entry, the id of a folder or empty for none.
+// It returns an error wrapping ErrInvalidChange if the id isn't a UUID.
+func ParseFolderID(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+	if ValidateEntryID(value) != nil {
+		return "", fmt.Errorf("%w: %s must be the id of a folder", ErrInvalidChange, FolderField)
+	}
+
+	return value, nil
+}
+
+// PreviewTable is the data table of the notes, the only one whose entries have a preview.
+const PreviewTable = "TextData"
+
+// MaxPreviewChars is the number of characters a preview may have.
+const MaxPreviewChars = 120
+
+// ParsePreview returns the preview of an entry of the table on a single line: the control characters
+// are dropped and every run of spaces, tabs or line breaks becomes a single space. It returns an error wrapping ErrInvalidChange
+// if the table has no preview or the preview is longer than MaxPreviewChars.
+func ParsePreview(table, value string) (string, error) {
+	if table != PreviewTable {
+		return "", fmt.Errorf("%w: only the entries of %s have a %s", ErrInvalidChange, PreviewTable, PreviewField)
+	}
+
+	preview := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && !unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, value)
+	preview = strings.Join(strings.Fields(preview), " ")
+	if utf8.RuneCountInString(preview) > MaxPreviewChars {
+		return "", fmt.Errorf("%w: %s is longer than %d characters", ErrInvalidChange, PreviewField, MaxPreviewChars)
+	}
+
+	return preview, nil
+}
+
+// OtpTable is the data table of the TOTP seeds, the secrets of the authenticator apps.
+const OtpTable = "OtpData"
+
+// The fields of the seeds checked by the server, the other fields of the seeds are stored as sent.
+// An empty algorithm, digits or period is the default of the authenticator apps, see the OtpDefault constants.
+const (
+	OtpSecretField    = "secret"
+	OtpAlgorithmField = "algorithm"
+	OtpDigitsField    = "digits"
+	OtpPeriodField    = "period"
+	OtpLinkedField    = "linked_entry_id"
+)
+
+// The defaults of a seed which doesn't set them.
+const (
+	OtpDefaultAlgorithm = "SHA1"
+	OtpDefaultDigits    = 6
+	OtpDefaultPeriod    = 30
+)
+
+// OtpAlgorithms are the HMAC algorithms of the seeds, those of RFC 6238.
+var OtpAlgorithms = []string{"SHA1", "SHA256", "SHA512"}
+
+// The ranges of the digits and of the period, in seconds, of the seeds.
+const (
+	MinOtpDigits = 6
+	MaxOtpDigits = 8
+	MaxOtpPeriod = 300
+)
+
+// otpSecretEncoding decodes the secrets, whose padding the apps usually leave out.
+var otpSecretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// IsOtpField reports whether the field of an entry of the table is a field of a seed checked by the server.
+func IsOtpField(table, key string) bool {
+	if table != OtpTable {
+		return false
+	}
+
+	switch key {
+	case OtpSecretField, OtpAlgorithmField, OtpDigitsField, OtpPeriodField, OtpLinkedField:
+		return true
+	}
+
+	return false
+}
+
+// ParseOtpField returns the field of a seed as it is stored: the secret in upper case without spaces, dashes
+// or padding, the algorithm in upper case without a dash, e.g. SHA-256 as SHA256, and the numbers without
+// leading zeros. It returns an error wrapping ErrInvalidChange if the secret is empty or not base32,
+// the algorithm isn't one of OtpAlgorithms, the digits or the period are out of range or
+// the linked entry isn't a UUID.
+func ParseOtpField(key, value string) (string, error) {
+	value = strings.TrimSpace(value)
+	switch key {
+	case OtpSecretField:
+		secret := strings.TrimRight(strings.ToUpper(strings.NewReplacer(" ", "", "-", "").Replace(value)), "=")
+		if secret == "" {
+			return "", fmt.Errorf("%w: the %s of a seed is required", ErrInvalidChange, OtpSecretField)
+		}
+		if _, err := otpSecretEncoding.DecodeString(secret); err != nil {
+			return "", fmt.Errorf("%w: %s must be base32", ErrInvalidChange, OtpSecretField)
+		}
+		return secret, nil
+	case OtpAlgorithmField:
+		if value == "" {
+			return "", nil
+		}
+		algorithm := strings.ToUpper(strings.ReplaceAll(value, "-", ""))
+		if !slices.Contains(OtpAlgorithms, algorithm) {
+			return "", fmt.Errorf("%w: %s must be one of %s", ErrInvalidChange, OtpAlgorithmField, strings.Join(OtpAlgorithms, ", "))
+		}
+		return algorithm, nil
+	case OtpDigitsField:
+		return parseOtpNumber(key, value, MinOtpDigits, MaxOtpDigits)
+	case OtpPeriodField:
+		return parseOtpNumber(key, value, 1, MaxOtpPeriod)
+	case OtpLinkedField:
+		if value == "" {
+			return "", nil
+		}
+		if ValidateEntryID(value) != nil {
+			return "", fmt.Errorf("%w: %s must be the id of an entry", ErrInvalidChange, OtpLinkedField)
+		}
+		return value, nil
+	}
+
+	return value, nil
+}
+
+// parseOtpNumber returns the number of the field of a seed in decimal, empty if it isn't set.
+func parseOtpNumber(key, value string, lo, hi int) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < lo || n > hi {
+		return "", fmt.Errorf("%w: %s must be a number from %d to %d", ErrInvalidChange, key, lo, hi)
+	}
+
+	return strconv.Itoa(n), nil
+}
+
+// SshKeysTable is the data table of the SSH key pairs.
+const SshKeysTable = "SshKeysData"
+
+// The fields of the key pairs checked by the server. The fingerprint is computed from the public key,
+// the clients never write it.
+const (
+	SshPrivateKeyField  = "private_key"
+	SshPublicKeyField   = "public_key"
+	SshFingerprintField = "fingerprint"
+)
+
+// DeriveSshFields checks the keys of the fields of an entry of the table written by a client and sets
+// the fingerprint of the public key written, dropping the one sent. It returns an error wrapping ErrInvalidChange
+// if the private key is empty or the public key isn't one in the authorized_keys format. The fields of
+// the other tables are left as they are.
+func DeriveSshFields(table string, fields map[string]string) error {
+	if table != SshKeysTable {
+		return nil
+	}
+
+	delete(fields, SshFingerprintField)
+	if private, ok := fields[SshPrivateKeyField]; ok && strings.TrimSpace(private) == "" {
+		return fmt.Errorf("%w: the %s of a key pair is required", ErrInvalidChange, SshPrivateKeyField)
+	}
+	if public, ok := fields[SshPublicKeyField]; ok {
+		key, fingerprint, err := ParseSshPublicKey(public)
+		if err != nil {
+			return err
+		}
+		fields[SshPublicKeyField], fields[SshFingerprintField] = key, fingerprint
+	}
+
+	return nil
+}
+
+// ParseSshPublicKey returns the public key in the authorized_keys format, e.g. "ssh-ed25519 AAAA... comment",
+// without the surrounding spaces, with its SHA-256 fingerprint as ssh-keygen prints it, "SHA256:" and
+// the unpadded base64 of the hash. It returns an error wrapping ErrInvalidChange for another value.
+func ParseSshPublicKey(value string) (key, fingerprint string, err error) {
+	value = strings.TrimSpace(value)
+	pub, _, _, rest, err := ssh.ParseAuthorizedKey([]byte(value))
+	if err != nil || len(rest) > 0 {
+		return "", "", fmt.Errorf("%w: %s must be a single key in the authorized_keys format", ErrInvalidChange, SshPublicKeyField)
+	}
+
+	return value, ssh.FingerprintSHA256(pub), nil
+}
+
+// ParseSshFingerprint returns the SHA-256 fingerprint of a public key as it is stored, with the "SHA256:"
+// prefix the fingerprint may be sent without. It returns ErrInvalidQuery if it isn't one.
+func ParseSshFingerprint(value string) (string, error) {
+	hash := strings.TrimRight(strings.TrimPrefix(strings.TrimSpace(value), "SHA256:"), "=")
+	if sum, err := base64.RawStdEncoding.DecodeString(hash); err != nil || len(sum) != sha256.Size {
+		return "", fmt.Errorf("%w: the fingerprint must be a SHA-256 one, e.g. SHA256:<base64>", ErrInvalidQuery)
+	}
+
+	return "SHA256:" + hash, nil
+}
+
+// DataQuery selects the entries of a user returned by GetAllData.
+type DataQuery struct {
+	// LastSync limits the entries to those updated after it, the zero time selects all of them.
+	LastSync time.Time
+	// InclDeleted includes the entries marked as deleted.
+	InclDeleted bool
+	// InclExpired includes the entries whose expires_at has passed but which aren't deleted yet.
+	InclExpired bool
+	// Tag limits the entries to those labeled with it.
+	Tag string
+	// Folder limits the entries to those in the folder with the id, or to those in none if it is RootFolder.
+	Folder string
+	// Columns limits the fields of the returned entries to a projection, nil selects all of them.
+	// The RequiredColumns are always included.
+	Columns []string
+	// Filter limits the entries to those matching all of its conditions.
+	Filter Filter
+	// OrderBy sorts the entries, the zero value sorts them by DefaultOrder.
+	OrderBy Order
+}
+
+// Order sorts entries by a column, NULLs last in both directions.
+// Entries with equal values are sorted by id in the same direction, so the order is deterministic.
+type Order struct {
+	Column string
+	Desc   bool
+}
+
+// DefaultOrder sorts the most recently updated entries first.
+var DefaultOrder = Order{Column: "updated_at", Desc: true}
+
+// ParseOrder returns the order by the column in the direction, "asc" or "desc".
+// An empty column selects DefaultOrder and an empty direction the ascending one.
+// It returns ErrInvalidQuery for another direction.
+func ParseOrder(column, dir string) (Order, error) {
+	if column == "" {
+		if dir != "" {
+			return Order{}, fmt.Errorf("%w: the direction needs a sort column", ErrInvalidQuery)
+		}
+		return DefaultOrder, nil
+	}
+
+	switch strings.ToLower(dir) {
+	case "", "asc":
+		return Order{Column: column}, nil
+	case "desc":
+		return Order{Column: column, Desc: true}, nil
+	}
+
+	return Order{}, fmt.Errorf("%w: unknown sort direction %q", ErrInvalidQuery, dir)
+}
+
+// Validate checks the column of the order against the available columns and returns
+// the order with the column name normalized, or DefaultOrder for the zero value.
+// It returns ErrUnknownColumn for an unknown column.
+func (o Order) Validate(available []string) (Order, error) {
+	if o.Column == "" {
+		return DefaultOrder, nil
+	}
+
+	o.Column = strings.ToLower(strings.TrimSpace(o.Column))
+	for _, col := range available {
+		if col == o.Column {
+			return o, nil
+		}
+	}
+
+	return Order{}, fmt.Errorf("%w: %q", ErrUnknownColumn, o.Column)
+}
+
+// NormalizeFields returns the fields of an entry with their names in lower case, as the columns
+// of the tables are matched regardless of the case. It returns ErrInvalidChange if two names
+// differ only by case, since they would name the same column.
+func NormalizeFields(fields map[string]string) (map[string]string, error) {
+	normalized := make(map[string]string, len(fields))
+	for key, value := range fields {
+		name := strings.ToLower(key)
+		if _, ok := normalized[name]; ok {
+			return nil, fmt.Errorf("%w: duplicate field %q", ErrInvalidChange, name)
+		}
+		normalized[name] = value
+	}
+
+	return normalized, nil
+}
+
+// ServerFields are the columns of the entries which only the server writes: the id and the owner
+// identify the entry, and the deletion and the version are kept by the write operations.
+var ServerFields = map[string]bool{"id": true, "user_id": true, "deleted": true, "updated_at": true}
+
+// CheckServerFields returns ErrInvalidChange if the fields of a write name one of the ServerFields,
+// regardless of the case.
+func CheckServerFields(fields map[string]string) error {
+	for key := range fields {
+		if name := strings.ToLower(key); ServerFields[name] {
+			return fmt.Errorf("%w: %s is set by the server", ErrInvalidChange, name)
+		}
+	}
+
+	return nil
+}
+
+// RequiredColumns are the columns included in every projection, synchronization relies on them.
+var RequiredColumns = []string{"id", "updated_at", "deleted"}
+
+// ListColumns is the light projection used by list views, which don't show the secrets themselves.
+var ListColumns = []string{"meta_info", TagsField, FolderField, ExpiresAtField, ClientModifiedAt}
+
+// TableListColumns returns the ListColumns of the table, with the preview of the notes, the issuer,
+// the account and the linked entry of the seeds, and the title, the public key and the fingerprint of the key pairs.
+func TableListColumns(table string) []string {
+	switch table {
+	case PreviewTable:
+		return append(slices.Clone(ListColumns), PreviewField)
+	case OtpTable:
+		return append(slices.Clone(ListColumns), "issuer", "account", OtpLinkedField)
+	case SshKeysTable:
+		return append(slices.Clone(ListColumns), "title", SshPublicKeyField, SshFingerprintField)
+	}
+
+	return ListColumns
+}
+
+// ProjectColumns returns the columns of the table selected by the requested projection,
+// in the order of the table. An empty projection selects all columns.
+// It returns ErrUnknownColumn if a requested column isn't one of the available ones.
+func ProjectColumns(available, requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		return available, nil
+	}
+
+	known := make(map[string]bool, len(available))
+	for _, col := range available {
+		known[col] = true
+	}
+
+	selected := make(map[string]bool, len(requested)+len(RequiredColumns))
+	for _, col := range RequiredColumns {
+		selected[col] = true
+	}
+	for _, col := range requested {
+		col = strings.ToLower(strings.TrimSpace(col))
+		if !known[col] {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownColumn, col)
+		}
+		selected[col] = true
+	}
+
+	cols := make([]string, 0, len(selected))
+	for _, col := range available {
+		if selected[col] {
+			cols = append(cols, col)
+		}
+	}
+
+	return cols, nil
+}
+
+// FilterOp is an operator comparing a column of an entry with a value.
+type FilterOp string
+
+const (
+	// FilterEq matches the entries whose column equals the value.
+	FilterEq FilterOp = "="
+	// FilterNe matches the entries whose column differs from the value.
+	FilterNe FilterOp = "!="
+	// FilterILike matches the entries whose column matches the LIKE pattern of the value, ignoring the case.
+	FilterILike FilterOp = "ILIKE"
+	// FilterGt matches the entries whose column is greater than the value.
+	FilterGt FilterOp = ">"
+	// FilterLt matches the entries whose column is less than the value.
+	FilterLt FilterOp = "<"
+)
+
+// Condition compares a column of an entry with a value.
+type Condition struct {
+	Column string
+	Op     FilterOp
+	Value  string
+}
+
+// Filter is a list of conditions which all have to match.
+type Filter []Condition
+
+// Validate checks the operators and the columns of the filter against the available columns
+// and returns the filter with the column names normalized.
+// It returns ErrUnknownColumn for an unknown column and ErrInvalidQuery for an unsupported operator,
+// a value of the wrong type or a column which can't be compared, such as the tags.
+func (f Filter) Validate(available []string) (Filter, error) {
+	if len(f) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]bool, len(available))
+	for _, col := range available {
+		known[col] = true
+	}
+
+	valid := make(Filter, 0, len(f))
+	for _, c := range f {
+		c.Column = strings.ToLower(strings.TrimSpace(c.Column))
+		c.Op = FilterOp(strings.ToUpper(strings.TrimSpace(string(c.Op))))
+
+		switch c.Op {
+		case FilterEq, FilterNe, FilterILike, FilterGt, FilterLt:
+		default:
+			return nil, fmt.Errorf("%w: unsupported operator %q", ErrInvalidQuery, c.Op)
+		}
+		if !known[c.Column] {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownColumn, c.Column)
+		}
+		if err := c.validateValue(); err != nil {
+			return nil, err
+		}
+		valid = append(valid, c)
+	}
+
+	return valid, nil
+}
+
+// validateValue checks that the column can be compared with the operator and the type of the value.
+func (c Condition) validateValue() error {
+	switch {
+	case c.Column == TagsField:
+		return fmt.Errorf("%w: the tags are filtered by tag", ErrInvalidQuery)
+	case c.Column == "deleted":
+		if c.Op != FilterEq && c.Op != FilterNe {
+			return fmt.Errorf("%w: %s can't be compared with %s", ErrInvalidQuery, c.Column, c.Op)
+		}
+		if _, err := strconv.ParseBool(c.Value); err != nil {
+			return fmt.Errorf("%w: %s must be true or false", ErrInvalidQuery, c.Column)
+		}
+	case IsTimeColumn(c.Column):
+		if c.Op == FilterILike {
+			return fmt.Errorf("%w: %s can't be compared with %s", ErrInvalidQuery, c.Column, c.Op)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, c.Value); err != nil {
+			return fmt.Errorf("%w: %s must be an RFC 3339 timestamp", ErrInvalidQuery, c.Column)
+		}
+	}
+
+	return nil
+}
+
+// IsTimeColumn reports whether the column holds timestamps set by the server,
+// unlike the client timestamps which are stored as text.
+func IsTimeColumn(column string) bool {
+	return column == "updated_at" || column == ExpiresAtField
+}
+
+// DataWarning is the field added to an entry read with problems, so clients can prompt
+// the user to re-save it. Its value is one of the Warning constants.
+const DataWarning = "data_warning"
+
+// WarningInvalidUTF8 means invalid UTF-8 in the stored fields was replaced with U+FFFD.
+const WarningInvalidUTF8 = "invalid_utf8"
+
+// WarningChecksumMismatch means the stored fields don't match the checksum written with them,
+// the entry was changed outside of the server, e.g. by a bad restore.
+const WarningChecksumMismatch = "checksum_mismatch"
+
 // Key is an alias for string and represents a key used in various contexts.
 type Key string
 
@@ -7,3 +755,921 @@ type Key string
 type Response struct {
 	Result string `json:"result"`
 }
+
+// ChangeOp is the kind of a change pushed by a client.
+type ChangeOp string
+
+const (
+	// ChangeAdd creates a new entry.
+	ChangeAdd ChangeOp = "add"
+	// ChangeUpdate modifies the fields of an existing entry.
+	ChangeUpdate ChangeOp = "update"
+	// ChangeDelete marks an existing entry as deleted.
+	ChangeDelete ChangeOp = "delete"
+)
+
+// ChangeStatus is the outcome of applying a single change.
+type ChangeStatus string
+
+const (
+	// ChangeApplied means the change was stored.
+	ChangeApplied ChangeStatus = "applied"
+	// ChangeConflict means the entry was modified on the server after the client's version, the change was skipped.
+	ChangeConflict ChangeStatus = "conflict"
+	// ChangeNotFound means the entry to update or delete doesn't exist, the change was skipped.
+	ChangeNotFound ChangeStatus = "not_found"
+	// ChangeUnchanged means the update would store the fields the entry already has, the change was skipped
+	// without a new version of the entry.
+	ChangeUnchanged ChangeStatus = "unchanged"
+)
+
+// Change describes a single create, update or delete pushed by a client.
+// UpdatedAt is the server timestamp of the entry version the client changed.
+type Change struct {
+	Table     string            `json:"table"`
+	Op        ChangeOp          `json:"op"`
+	EntryID   string            `json:"entry_id"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// VaultEvent tells a session of a change made to the vault of its user by another session, see GET /api/events.
+// The clients synchronize on receipt. An event without a table is a change of entries of several tables.
+type VaultEvent struct {
+	Table     string    `json:"table,omitempty"`
+	EntryID   string    `json:"entry_id,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// AppliedEvents returns the events of the changes of a batch which were applied.
+func AppliedEvents(results []ChangeResult) []VaultEvent {
+	var events []VaultEvent
+	for _, res := range results {
+		if res.Status == ChangeApplied {
+			events = append(events, VaultEvent{Table: res.Table, EntryID: res.EntryID, UpdatedAt: res.UpdatedAt})
+		}
+	}
+
+	return events
+}
+
+// EntryVersion is a prior state of an entry kept in its history. Changes are the fields the change
+// at ChangedAt made to it, set by the history endpoint, nil if the next state isn't known.
+type EntryVersion struct {
+	Snapshot  map[string]string `json:"snapshot"`
+	ChangedAt time.Time         `json:"changed_at"`
+	Changes   []FieldChange     `json:"changes,omitempty"`
+}
+
+// FieldChange is a field changed between two versions of an entry, with its values before and after.
+// A redacted change has no values, it only tells the field changed.
+type FieldChange struct {
+	Field    string  `json:"field"`
+	Old      *string `json:"old,omitempty"`
+	New      *string `json:"new,omitempty"`
+	Redacted bool    `json:"redacted,omitempty"`
+}
+
+// Redact returns the change without its values.
+func (c FieldChange) Redact() FieldChange {
+	return FieldChange{Field: c.Field, Redacted: true}
+}
+
+// diffIgnored are the fields of the versions which aren't compared: the identity of the entry,
+// the time of the version and the warnings of the read.
+var diffIgnored = map[string]bool{"id": true, "user_id": true, "updated_at": true, DataWarning: true}
+
+// DiffVersions returns the fields changed from the version old of an entry of the table to the version new,
+// by name. A field missing from a version is empty, as the storage reads a NULL column. The changes of
+// the metadata, the TableListColumns and the deleted flag, have their values; the other fields hold
+// the secrets and their changes are redacted.
+func DiffVersions(table string, old, new map[string]string) []FieldChange {
+	fields := make(map[string]bool, len(old)+len(new))
+	for field := range old {
+		fields[field] = true
+	}
+	for field := range new {
+		fields[field] = true
+	}
+
+	metadata := TableListColumns(table)
+	changes := make([]FieldChange, 0)
+	for field := range fields {
+		before, after := old[field], new[field]
+		if diffIgnored[field] || before == after {
+			continue
+		}
+		change := FieldChange{Field: field, Old: &before, New: &after}
+		if field != "deleted" && !slices.Contains(metadata, field) {
+			change = change.Redact()
+		}
+		changes = append(changes, change)
+	}
+	slices.SortFunc(changes, func(a, b FieldChange) int { return strings.Compare(a.Field, b.Field) })
+
+	return changes
+}
+
+// ChangeResult describes the outcome of applying a change.
+// UpdatedAt is the server timestamp of the entry after the change, or of the
+// conflicting server version. It is zero for entries that were not found.
+type ChangeResult struct {
+	Table     string       `json:"table"`
+	EntryID   string       `json:"entry_id"`
+	Status    ChangeStatus `json:"status"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
+
+// SyncConflict is a pushed change that lost to a newer version of its entry on the server.
+// Both versions are sent, so the client can merge them and push the merge against the server version.
+type SyncConflict struct {
+	Table   string            `json:"table"`
+	EntryID string            `json:"entry_id"`
+	Client  Change            `json:"client"`
+	Server  map[string]string `json:"server"`
+}
+
+// SyncResult is the outcome of a synchronization in one round trip: the results of the pushed changes,
+// the conflicts among them, and the entries changed on the server since the last sync of the client
+// by table, deleted ones included. The client syncs from Watermark next.
+type SyncResult struct {
+	Results   []ChangeResult                 `json:"results"`
+	Conflicts []SyncConflict                 `json:"conflicts"`
+	Changes   map[string][]map[string]string `json:"changes"`
+	Shared    []SharedEntry                  `json:"shared"`
+	Folders   []Folder                       `json:"folders"`
+	Watermark time.Time                      `json:"watermark"`
+}
+
+// NewSyncResult returns the result of the pushed changes, its watermark is the latest of lastSync
+// and the timestamps of the applied changes.
+func NewSyncResult(lastSync time.Time, results []ChangeResult) SyncResult {
+	r := SyncResult{
+		Results:   results,
+		Conflicts: make([]SyncConflict, 0),
+		Changes:   make(map[string][]map[string]string, len(DataTables)),
+		Shared:    make([]SharedEntry, 0),
+		Folders:   make([]Folder, 0),
+		Watermark: lastSync,
+	}
+	for _, res := range results {
+		if res.Status == ChangeApplied && res.UpdatedAt.After(r.Watermark) {
+			r.Watermark = res.UpdatedAt
+		}
+	}
+
+	return r
+}
+
+// Pull adds the entries of the table changed on the server and moves the watermark past them.
+// The versions stored by the pushed changes are left out, the client has them already.
+func (r *SyncResult) Pull(table string, rows []map[string]string) {
+	stored := make(map[string]time.Time)
+	for _, res := range r.Results {
+		if res.Table == table && res.Status == ChangeApplied {
+			stored[res.EntryID] = res.UpdatedAt
+		}
+	}
+
+	delta := make([]map[string]string, 0, len(rows))
+	for _, row := range rows {
+		at, err := time.Parse(time.RFC3339Nano, row["updated_at"])
+		if err == nil && at.After(r.Watermark) {
+			r.Watermark = at
+		}
+		if s, ok := stored[row["id"]]; ok && err == nil && at.Equal(s) {
+			continue
+		}
+		delta = append(delta, row)
+	}
+	r.Changes[table] = delta
+}
+
+// PullShared adds the entries shared with the user which changed on the server, the removed ones included,
+// and moves the watermark past them.
+func (r *SyncResult) PullShared(entries []SharedEntry) {
+	for _, e := range entries {
+		if e.UpdatedAt.After(r.Watermark) {
+			r.Watermark = e.UpdatedAt
+		}
+	}
+	r.Shared = append(r.Shared, entries...)
+}
+
+// PullFolders adds the folders of the user which changed on the server, the deleted ones included,
+// and moves the watermark past them.
+func (r *SyncResult) PullFolders(folders []Folder) {
+	for _, f := range folders {
+		if f.UpdatedAt.After(r.Watermark) {
+			r.Watermark = f.UpdatedAt
+		}
+	}
+	r.Folders = append(r.Folders, folders...)
+}
+
+// JobPreview is what a dry run of a background job would change:
+// the number of the rows and the identifiers of some of them, as table/id.
+type JobPreview struct {
+	Count  int      `json:"count"`
+	Sample []string `json:"sample"`
+}
+
+// VaultChecksumQuery selects the entries covered by the checksum of a vault: every entry of the user,
+// the deleted ones included, with only the columns identifying its version.
+var VaultChecksumQuery = DataQuery{InclDeleted: true, Columns: RequiredColumns}
+
+// VaultChecksum is the digest of the versions of the entries of a user across the data tables, so that two
+// servers holding the same vault, such as a primary and its replica, agree on it. The version of an entry is
+// its id, its 'updated_at' and its deleted flag, every change of its fields moves 'updated_at'.
+type VaultChecksum struct {
+	UserID    int       `json:"user_id"`
+	Entries   int       `json:"entries"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Checksum  string    `json:"checksum"`
+}
+
+// ChecksumVault returns the checksum of the entries of the user by table, as read with VaultChecksumQuery.
+// The order of the tables and of the entries doesn't matter.
+func ChecksumVault(userID int, entries map[string][]map[string]string) VaultChecksum {
+	sum := VaultChecksum{UserID: userID}
+	lines := make([]string, 0)
+	for table, rows := range entries {
+		for _, row := range rows {
+			updatedAt, err := time.Parse(time.RFC3339Nano, row["updated_at"])
+			if err != nil {
+				// The stored value is hashed as is, it differs on both sides or on neither
+				lines = append(lines, strings.Join([]string{table, row["id"], row["updated_at"], row["deleted"]}, "\x00"))
+				continue
+			}
+			updatedAt = updatedAt.UTC()
+			if updatedAt.After(sum.UpdatedAt) {
+				sum.UpdatedAt = updatedAt
+			}
+			deleted, _ := strconv.ParseBool(row["deleted"])
+			lines = append(lines, strings.Join([]string{table, row["id"], updatedAt.Format(time.RFC3339Nano), strconv.FormatBool(deleted)}, "\x00"))
+		}
+	}
+	slices.Sort(lines)
+
+	h := sha256.New()
+	for _, line := range lines {
+		h.Write([]byte(line))
+		h.Write([]byte{'\n'})
+	}
+	sum.Entries = len(lines)
+	sum.Checksum = hex.EncodeToString(h.Sum(nil))
+
+	return sum
+}
+
+// ReplicationStatus is the state of the replication of the vault of a user from the primary server, see
+// GET /api/admin/replication. Lag is how far the replica is behind, the time since the last round which
+// converged, and grows while the primary can't be reached.
+type ReplicationStatus struct {
+	Primary   string `json:"primary"`
+	Username  string `json:"username"`
+	Converged bool   `json:"converged"`
+	// Entries and Checksum are those of the local vault as of the last round
+	Entries    int        `json:"entries"`
+	Checksum   string     `json:"checksum,omitempty"`
+	Applied    int        `json:"applied"`
+	LagSeconds float64    `json:"lag_seconds"`
+	LastRunAt  *time.Time `json:"last_run_at,omitempty"`
+	SyncedAt   *time.Time `json:"synced_at,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+}
+
+// RotationStatus is the progress of the re-encryption of the stored values with the current encryption key.
+// The previous keys are still needed until the rotation is done and a sample of the rows was verified.
+type RotationStatus struct {
+	KeyID        string          `json:"key_id"`
+	PreviousKeys []string        `json:"previous_keys"`
+	Tables       []RotationTable `json:"tables"`
+	// Percent is the share of the rows already re-encrypted or found under the current key,
+	// it is only 100 once every table is done
+	Percent    int        `json:"percent"`
+	Done       bool       `json:"done"`
+	Verified   bool       `json:"verified"`
+	StartedAt  time.Time  `json:"started_at"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+}
+
+// RotationTable is the progress of the re-encryption of a table: Rotated counts the rows re-encrypted,
+// Checked the rows passed by the rotation so far and Total all the rows of the table.
+type RotationTable struct {
+	Table   string `json:"table"`
+	Rotated int    `json:"rotated"`
+	Checked int    `json:"checked"`
+	Total   int    `json:"total"`
+	Done    bool   `json:"done"`
+}
+
+// TombstoneSize is the size counted for a deleted entry in the estimate of a synchronization,
+// the client only needs to learn its id.
+const TombstoneSize = 64
+
+// EntrySize returns the size of the entry as a synchronization sends it, its JSON encoding.
+func EntrySize(row map[string]string) int64 {
+	data, err := json.Marshal(row)
+	if err != nil {
+		return 0
+	}
+
+	return int64(len(data))
+}
+
+// PendingSize estimates what a synchronization of a table would download:
+// the number of the changed entries and their size in bytes.
+type PendingSize struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// DataVersion identifies the state of the entries of a user across the data tables. Every write, delete,
+// purge and expiry changes it, while it stays the same as long as the entries do.
+type DataVersion struct {
+	// UpdatedAt is the latest 'updated_at' of the entries, the deleted ones included
+	UpdatedAt time.Time
+	// Entries is the number of the entries, the deleted ones included
+	Entries int
+	// Expired is the number of the entries whose expires_at has passed
+	Expired int
+}
+
+// PartialError is returned by a read across the data tables in the partial mode when some of its tables failed,
+// along with the results of the other tables. Tables holds the error of each failed table.
+type PartialError struct {
+	Tables map[string]error
+}
+
+// Error lists the failed tables.
+func (e *PartialError) Error() string {
+	tables := make([]string, 0, len(e.Tables))
+	for table := range e.Tables {
+		tables = append(tables, table)
+	}
+	slices.Sort(tables)
+
+	return "failed to read tables: " + strings.Join(tables, ", ")
+}
+
+// TableStatus is the outcome of a table of a read across the data tables in the partial mode.
+type TableStatus string
+
+const (
+	TableOK     TableStatus = "ok"
+	TableFailed TableStatus = "failed"
+)
+
+// TableError describes why a table failed to the client.
+type TableError struct {
+	Message string `json:"message"`
+}
+
+// TableResult is the result of a table of a read across the data tables in the partial mode:
+// the data of the table, or the error of the table instead if it failed.
+type TableResult struct {
+	Status TableStatus `json:"status"`
+	Data   any         `json:"data,omitempty"`
+	Error  *TableError `json:"error,omitempty"`
+}
+
+// AuditAction is the kind of an event recorded in the audit log.
+type AuditAction string
+
+const (
+	// AuditLogin is a login attempt.
+	AuditLogin AuditAction = "login"
+	// AuditRegister is a registration attempt.
+	AuditRegister AuditAction = "register"
+	// AuditAdd is the creation of an entry.
+	AuditAdd AuditAction = "add"
+	// AuditUpdate is a change of the fields of an entry.
+	AuditUpdate AuditAction = "update"
+	// AuditDelete marks an entry as deleted.
+	AuditDelete AuditAction = "delete"
+	// AuditUndelete restores a deleted entry.
+	AuditUndelete AuditAction = "undelete"
+	// AuditBulkInsert is the import of many entries of a table at once.
+	AuditBulkInsert AuditAction = "bulk_insert"
+	// AuditRenameTag is the rename of a tag on all the entries of the user.
+	AuditRenameTag AuditAction = "rename_tag"
+	// AuditRefresh is the exchange of a refresh token for new tokens, it fails for a reused token.
+	AuditRefresh AuditAction = "refresh"
+	// AuditLogout ends the session of a device.
+	AuditLogout AuditAction = "logout"
+	// AuditPasswordChange is an attempt to change the password, it ends the sessions of the user.
+	AuditPasswordChange AuditAction = "password_change"
+	// AuditLockout is the lockout of an account after consecutive failed logins.
+	AuditLockout AuditAction = "lockout"
+	// AuditDisableUser is the disabling of the account of another user by an admin, recorded for the admin
+	// with the id of the user as entry id. AuditEnableUser and AuditDeleteUser are recorded alike.
+	AuditDisableUser AuditAction = "disable_user"
+	// AuditEnableUser lets a disabled user log in again.
+	AuditEnableUser AuditAction = "enable_user"
+	// AuditDeleteUser deletes the account of a user with all of their entries.
+	AuditDeleteUser AuditAction = "delete_user"
+	// AuditCreateAPIKey is the creation of an API key, with the id of the key as entry id.
+	AuditCreateAPIKey AuditAction = "create_api_key"
+	// AuditRevokeAPIKey is the revocation of an API key, with the id of the key as entry id.
+	AuditRevokeAPIKey AuditAction = "revoke_api_key"
+	// AuditEmailChange is the change of the email of the account, which is then unverified.
+	AuditEmailChange AuditAction = "email_change"
+	// AuditEmailVerify is the verification of the email with a token mailed to it.
+	AuditEmailVerify AuditAction = "email_verify"
+	// AuditPasswordReset is the reset of a forgotten password with a token mailed to the verified email,
+	// it ends the sessions of the user.
+	AuditPasswordReset AuditAction = "password_reset"
+	// AuditRevokeDevice is the revocation of a device, ending its session, with the id of the device as entry id.
+	AuditRevokeDevice AuditAction = "revoke_device"
+	// AuditOperatorQuery is an ad-hoc read query run by an operator from the command line, of no user,
+	// with the operator and the text of the query.
+	AuditOperatorQuery AuditAction = "operator_query"
+	// AuditCreateMonitorToken is the creation of a monitor token by an admin, with the id of the token as entry id.
+	AuditCreateMonitorToken AuditAction = "create_monitor_token"
+	// AuditRevokeMonitorToken is the revocation of a monitor token by an admin, with the id of the token as entry id.
+	AuditRevokeMonitorToken AuditAction = "revoke_monitor_token"
+	// AuditExport is the export of the vault of the user, with its format as detail.
+	// It fails if the export ended before the archive was complete.
+	AuditExport AuditAction = "export"
+	// AuditReencrypt is a step of the re-encryption of the vault of the user, with the id of the operation
+	// as entry id and its status after the step as detail.
+	AuditReencrypt AuditAction = "reencrypt"
+	// AuditImport is an import into the vault of the user, with its format as detail. The entries it adds
+	// are recorded one by one too.
+	AuditImport AuditAction = "import"
+	// AuditReplicate is the replication of entries of a table from the primary server, see ReplicateData.
+	AuditReplicate AuditAction = "replicate"
+	// AuditShare is the share of an entry with another user, or the change of the permission of a share,
+	// recorded for the owner with the id of the grantee as detail.
+	AuditShare AuditAction = "share"
+	// AuditRevokeShare is the revocation of the share of an entry, recorded for the owner like AuditShare.
+	AuditRevokeShare AuditAction = "revoke_share"
+	// AuditCreateFolder is the creation of a folder, with the id of the folder as entry id.
+	AuditCreateFolder AuditAction = "create_folder"
+	// AuditUpdateFolder is the rename of a folder or its move to another parent, recorded like AuditCreateFolder.
+	AuditUpdateFolder AuditAction = "update_folder"
+	// AuditDeleteFolder is the deletion of a folder, recorded like AuditCreateFolder.
+	AuditDeleteFolder AuditAction = "delete_folder"
+)
+
+// AuditEvent is an authentication or a data change of a user recorded in the audit log.
+// UserID is 0 for a failed attempt on an unknown account. ID and CreatedAt are set by the storage.
+type AuditEvent struct {
+	ID         int         `json:"id"`
+	UserID     int         `json:"-"`
+	Action     AuditAction `json:"action"`
+	Table      string      `json:"table,omitempty"`
+	EntryID    string      `json:"entry_id,omitempty"`
+	RemoteAddr string      `json:"remote_addr,omitempty"`
+	UserAgent  string      `json:"user_agent,omitempty"`
+	Success    bool        `json:"success"`
+	CreatedAt  time.Time   `json:"created_at"`
+	// Operator and Detail are the operator and the query of an AuditOperatorQuery, Detail is the format
+	// of an AuditExport or an AuditImport, the status of an AuditReencrypt and the id of the grantee of an
+	// AuditShare or an AuditRevokeShare, both are empty otherwise
+	Operator string `json:"operator,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// OperationReencrypt is the re-encryption of the vault of a user under a new key, run by one of their devices.
+const OperationReencrypt = "reencrypt"
+
+// The statuses of an operation of a user, it is running until it is completed or failed.
+const (
+	OperationRunning   = "running"
+	OperationCompleted = "completed"
+	OperationFailed    = "failed"
+)
+
+// UserOperation is a long operation of a user on their vault, run by the device DeviceID. While it is running
+// the writes of the other devices are fenced. It fails once ExpiresAt passes without the device extending it.
+// ExpectedSeconds is the duration the device expects it to take, as it told when starting it.
+type UserOperation struct {
+	ID              string     `json:"id"`
+	UserID          int        `json:"-"`
+	Kind            string     `json:"kind"`
+	DeviceID        string     `json:"device_id"`
+	Status          string     `json:"status"`
+	ExpectedSeconds int        `json:"expected_seconds"`
+	StartedAt       time.Time  `json:"started_at"`
+	ExpiresAt       time.Time  `json:"expires_at"`
+	FinishedAt      *time.Time `json:"finished_at,omitempty"`
+}
+
+// UploadSession is a chunked upload of the file of the entry EntryID of a user, of Size bytes. The chunks are
+// staged until the upload is committed, or until ExpiresAt, when the session and its chunks are deleted.
+type UploadSession struct {
+	ID        string    `json:"upload_id"`
+	UserID    int       `json:"-"`
+	EntryID   string    `json:"entry_id"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// FileBlob is the object holding the contents of the file of an entry of FilesTable in the blob store,
+// with its size in bytes and hex SHA-256. The zero FileBlob is a file kept on disk under the id of its entry.
+// The entries with the same contents share their object, counted once per entry pointing at it.
+type FileBlob struct {
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// The permissions of a share, see Share.
+const (
+	// ShareRead lets the grantee read the entry.
+	ShareRead = "read"
+	// ShareWrite lets the grantee update and delete the entry too.
+	ShareWrite = "write"
+)
+
+// Share grants a user, the grantee, access to an entry of another user, its owner, with a permission.
+// CreatedAt and UpdatedAt are set by the storage, UpdatedAt moves with every change of the share.
+type Share struct {
+	OwnerID    int       `json:"owner_id"`
+	GranteeID  int       `json:"grantee_id"`
+	Table      string    `json:"table"`
+	EntryID    string    `json:"entry_id"`
+	Permission string    `json:"permission"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Validate checks the table, the permission and the users of the share.
+func (s Share) Validate() error {
+	if !IsDataTable(s.Table) {
+		return fmt.Errorf("%w: unknown table %s", ErrInvalidShare, s.Table)
+	}
+	if s.Permission != ShareRead && s.Permission != ShareWrite {
+		return fmt.Errorf("%w: permission must be %s or %s", ErrInvalidShare, ShareRead, ShareWrite)
+	}
+	if s.OwnerID == s.GranteeID {
+		return fmt.Errorf("%w: an entry can't be shared with its owner", ErrInvalidShare)
+	}
+
+	return nil
+}
+
+// SharedEntry is an entry of another user shared with a user, as the user pulls it: the share, the username
+// of the owner and the fields of the entry. Once the share is revoked or the entry deleted it is Removed,
+// without the fields, and the grantee drops their copy. UpdatedAt is the latest change of the share or the entry.
+type SharedEntry struct {
+	Share
+	Owner   string            `json:"owner"`
+	Removed bool              `json:"removed"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// MaxFolderName is the number of characters the name of a folder may have.
+const MaxFolderName = 255
+
+// MaxFolderDepth is the number of folders a folder may be nested in.
+const MaxFolderDepth = 32
+
+// Folder groups entries of a user, and other folders. ParentID is empty for a folder at the top of the vault.
+// The names of the folders of a parent are unique, ignoring the case. UpdatedAt is set by the storage and moves
+// with every change, a deleted folder is kept as a tombstone for the sync.
+type Folder struct {
+	ID        string    `json:"id"`
+	UserID    int       `json:"-"`
+	Name      string    `json:"name"`
+	ParentID  string    `json:"parent_id,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Deleted   bool      `json:"deleted"`
+}
+
+// Validate checks the ids and the name of the folder and returns it with the name trimmed.
+// It returns an error wrapping ErrInvalidFolder if an id isn't a UUID, the folder is its own parent,
+// or the name is empty, too long or has control characters.
+func (f Folder) Validate() (Folder, error) {
+	if ValidateEntryID(f.ID) != nil {
+		return Folder{}, fmt.Errorf("%w: the id must be a UUID", ErrInvalidFolder)
+	}
+	if f.ParentID != "" && ValidateEntryID(f.ParentID) != nil {
+		return Folder{}, fmt.Errorf("%w: the parent must be the id of a folder", ErrInvalidFolder)
+	}
+	if strings.EqualFold(f.ParentID, f.ID) {
+		return Folder{}, fmt.Errorf("%w: a folder can't be its own parent", ErrInvalidFolder)
+	}
+
+	f.Name = strings.TrimSpace(f.Name)
+	switch {
+	case f.Name == "":
+		return Folder{}, fmt.Errorf("%w: the name must not be empty", ErrInvalidFolder)
+	case utf8.RuneCountInString(f.Name) > MaxFolderName:
+		return Folder{}, fmt.Errorf("%w: the name is longer than %d characters", ErrInvalidFolder, MaxFolderName)
+	case strings.IndexFunc(f.Name, unicode.IsControl) >= 0:
+		return Folder{}, fmt.Errorf("%w: the name has control characters", ErrInvalidFolder)
+	}
+
+	return f, nil
+}
+
+// FolderNameKey returns the form the names of the folders are compared in, so that they are unique ignoring the case.
+func FolderNameKey(name string) string {
+	return strings.ToLower(norm.NFC.String(name))
+}
+
+// Device is a device of a user, registered when a session is issued to it. LastSyncAt is the checkpoint
+// of its synchronization, the latest updated_at of the entries it has pulled, nil before its first pull.
+type Device struct {
+	DeviceID   string     `json:"device_id"`
+	UserID     int        `json:"-"`
+	Name       string     `json:"name"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	LastSyncAt *time.Time `json:"last_sync_at,omitempty"`
+}
+
+// RefreshToken is a refresh token issued to a device of a user, stored by the hash of its value.
+// The tokens rotated from the one issued at a login share its FamilyID.
+type RefreshToken struct {
+	Hash      string
+	UserID    int
+	DeviceID  string
+	FamilyID  string
+	ExpiresAt time.Time
+	Revoked   bool
+	// ProtocolVersion is the protocol version negotiated with the device when the token was issued
+	ProtocolVersion int
+}
+
+// LoginBackoff is how long an account is locked once its consecutive failed logins reach the threshold,
+// for the first lockout and for each further failure after it, the last one repeating.
+var LoginBackoff = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// LockoutDuration returns how long an account is locked after the consecutive failed logins,
+// 0 below maxFailures. A maxFailures of 0 or less never locks an account.
+func LockoutDuration(failures, maxFailures int) time.Duration {
+	if maxFailures <= 0 || failures < maxFailures {
+		return 0
+	}
+
+	return LoginBackoff[min(failures-maxFailures, len(LoginBackoff)-1)]
+}
+
+// ProtocolV1 is the first version of the protocol between the clients and the server. Each breaking
+// change of the encoding of the requests or the responses, such as the format of the cursors, adds a version.
+const ProtocolV1 = 1
+
+// ProtocolRange is a range of protocol versions, Min and Max included.
+type ProtocolRange struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+// ServerProtocol is the range of the protocol versions the server speaks.
+var ServerProtocol = ProtocolRange{Min: ProtocolV1, Max: ProtocolV1}
+
+// CapabilityPartialResults is the capability of the server to return the tables read by the search and
+// the synchronization estimate when others fail, if the client asks for it with the 'partial' query parameter.
+const CapabilityPartialResults = "partial_results"
+
+// ServerCapabilities are the optional features of the server, advertised with the tokens.
+// Unlike a protocol version, a client which doesn't know a capability simply doesn't use it.
+var ServerCapabilities = []string{CapabilityPartialResults}
+
+// ProtocolFromContext returns the protocol version negotiated for the request, ProtocolV1 if none was.
+// The encoders and the decoders of the versioned formats follow it.
+func ProtocolFromContext(ctx context.Context) int {
+	var keyProtocol Key = "protocol"
+
+	if version, ok := ctx.Value(keyProtocol).(int); ok {
+		return version
+	}
+
+	return ProtocolV1
+}
+
+// The roles of the users, carried by their access tokens. The admins manage the accounts of the other users.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// UserSummary describes the account of a user and the entries they store, as listed to the admins.
+// Entries and Bytes count the live entries of all the data tables, by their stored size.
+type UserSummary struct {
+	ID          int        `json:"id"`
+	Username    string     `json:"username"`
+	Role        string     `json:"role"`
+	Disabled    bool       `json:"disabled"`
+	LastLoginAt *time.Time `json:"last_login_at"`
+	Entries     int        `json:"entries"`
+	Bytes       int64      `json:"bytes"`
+	// LogicalFileBytes is the size of the files of the live entries in the blob store, PhysicalFileBytes
+	// the size of their distinct contents, stored once however many entries share them
+	LogicalFileBytes  int64 `json:"logical_file_bytes"`
+	PhysicalFileBytes int64 `json:"physical_file_bytes"`
+}
+
+// UserAccess is the state of the account of a user which the authorization of their requests checks.
+type UserAccess struct {
+	Role     string
+	Disabled bool
+	// PasswordChangedAt is the last change of the password, zero if it was never changed. The access tokens
+	// issued before it are rejected.
+	PasswordChangedAt time.Time
+}
+
+// LoginEvent is a login attempt on the account of a user, successful or not, as kept in their login history.
+type LoginEvent struct {
+	UserID    int       `json:"-"`
+	At        time.Time `json:"at"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Success   bool      `json:"success"`
+}
+
+// The scopes of the requests. Every route requires one of them. A session has all of them, and an API key
+// has the ones it was created with, ScopeRead alone or with ScopeWrite.
+const (
+	// ScopeRead reads the entries and the account
+	ScopeRead = "read"
+	// ScopeWrite changes the entries
+	ScopeWrite = "write"
+	// ScopeSession manages the account, its password, its API keys and the other accounts, no API key has it
+	ScopeSession = "session"
+)
+
+// APIKey is a key a user created for a non-interactive client, stored by the SHA-256 of its value.
+// Its value is shown once, when it is created.
+type APIKey struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"-"`
+	Hash       string     `json:"-"`
+	Label      string     `json:"label"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+}
+
+// HasScope reports whether the key has the scope.
+func (k APIKey) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, scope)
+}
+
+// MonitorToken is a token an admin created for an external uptime monitor, stored by the SHA-256 of its value.
+// It only grants the monitor ping. Its value is shown once, when it is created, and a monitor which stopped
+// probing is found by its last use.
+type MonitorToken struct {
+	ID         int        `json:"id"`
+	Hash       string     `json:"-"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// UserEmail is the email of an account and whether the user proved they receive it, Email is empty if there is none.
+// Language is the language the user is mailed in, empty for the default one.
+type UserEmail struct {
+	UserID   int    `json:"-"`
+	Username string `json:"-"`
+	Email    string `json:"email"`
+	Verified bool   `json:"verified"`
+	Language string `json:"-"`
+}
+
+// ParseEmail parses an email set by a user and returns it normalized in lower case, emails are unique
+// regardless of the case. It returns an error wrapping ErrInvalidChange if it isn't a bare address.
+func ParseEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || addr.Name != "" {
+		return "", fmt.Errorf("%w: %q is not an email address", ErrInvalidChange, email)
+	}
+
+	return email, nil
+}
+
+// maxLanguageLength bounds the length of the language of a user, a BCP 47 tag such as pt-BR.
+const maxLanguageLength = 35
+
+// ParseLanguage parses the language set by a user, a BCP 47 tag, and returns it in its canonical form.
+// An empty language is the default one. It returns an error wrapping ErrInvalidChange if it isn't a tag.
+func ParseLanguage(lang string) (string, error) {
+	lang = strings.TrimSpace(lang)
+	if lang == "" {
+		return "", nil
+	}
+	tag, err := language.Parse(lang)
+	if err != nil || len(lang) > maxLanguageLength {
+		return "", fmt.Errorf("%w: %q is not a language tag", ErrInvalidChange, lang)
+	}
+
+	return tag.String(), nil
+}
+
+// PreferredLanguage returns the language a client prefers the most in its Accept-Language header,
+// empty if it has none or the header doesn't parse.
+func PreferredLanguage(acceptLanguage string) string {
+	tags, _, err := language.ParseAcceptLanguage(acceptLanguage)
+	if err != nil {
+		return ""
+	}
+	for _, tag := range tags {
+		if lang := tag.String(); tag != language.Und && len(lang) <= maxLanguageLength {
+			return lang
+		}
+	}
+
+	return ""
+}
+
+// The purposes of the tokens mailed to the users.
+const (
+	// EmailTokenVerify proves the user receives the email it was sent to
+	EmailTokenVerify = "verify"
+	// EmailTokenReset resets the password of the user, it is only sent to a verified email
+	EmailTokenReset = "reset"
+)
+
+// EmailToken is a single-use token mailed to a user, stored by the SHA-256 of its value.
+// Email is the address it was sent to, it is void once the email of the user changes.
+type EmailToken struct {
+	Hash      string
+	UserID    int
+	Purpose   string
+	Email     string
+	ExpiresAt time.Time
+}
+
+// PolicyViolation is a rule of the password or the username policy broken by a password or a username a user chose.
+// Rule names the rule for the clients, Message explains it.
+type PolicyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// The rules of the username policy, as named in the violations. The clients tell the rejections of a username apart by them.
+const (
+	// RuleUsernameInvalid rejects a username without a letter or a digit
+	RuleUsernameInvalid = "username_invalid"
+	// RuleUsernameReserved rejects a username reserved by the server or denied by the configuration, or a lookalike of one
+	RuleUsernameReserved = "username_reserved"
+	// RuleUsernameTaken rejects a username taken by another user, or a lookalike of one
+	RuleUsernameTaken = "username_taken"
+	// RuleUsernameRejected rejects a username the external checker rejected
+	RuleUsernameRejected = "username_rejected"
+	// RuleUsernameUnchecked rejects a username the external checker couldn't check, if the policy fails closed
+	RuleUsernameUnchecked = "username_unchecked"
+)
+
+// confusables maps the characters a reader takes for others to them, once decomposed and lower-cased:
+// the Cyrillic and Greek letters looking like Latin ones and the digits and symbols looking like letters.
+// The characters looking like an l, i included, all map to it.
+var confusables = map[rune]rune{
+	'а': 'a', 'е': 'e', 'і': 'l', 'ј': 'j', 'к': 'k', 'о': 'o', 'р': 'p', 'с': 'c', 'ѕ': 's', 'у': 'y',
+	'х': 'x', 'һ': 'h', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w', 'ӏ': 'l', 'ı': 'l', 'ɡ': 'g',
+	'α': 'a', 'ε': 'e', 'ι': 'l', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x',
+	'0': 'o', '1': 'l', 'i': 'l', '|': 'l', '$': 's', '@': 'a',
+}
+
+// skeletonDigraphs replaces the pairs of letters a reader takes for a single one.
+var skeletonDigraphs = strings.NewReplacer("rn", "m", "vv", "w")
+
+// UsernameSkeleton returns the skeleton of a username, which the usernames a reader could take for each other share.
+// It follows the skeletons of UTS #39 for a pragmatic subset of the confusable characters: the compatibility
+// characters, such as the full-width ones, are decomposed and the accents dropped, the case is folded, the confusables
+// are replaced, and the separators and the invisible characters are removed, so a username made of them has none.
+func UsernameSkeleton(username string) string {
+	var b strings.Builder
+	for _, r := range norm.NFKD.String(username) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		r = unicode.ToLower(r)
+		if c, ok := confusables[r]; ok {
+			r = c
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+
+	return skeletonDigraphs.Replace(b.String())
+}
+
+// Client describes the client of a request, recorded with its audit events.
+// DeviceID is the device the client sent, the session its changes aren't notified back to.
+type Client struct {
+	RemoteAddr string
+	UserAgent  string
+	DeviceID   string
+}
+
+// clientKey is the context key of the client of a request.
+type clientKey struct{}
+
+// WithClient returns a context carrying the client of the request.
+func WithClient(ctx context.Context, c Client) context.Context {
+	return context.WithValue(ctx, clientKey{}, c)
+}
+
+// ClientFrom returns the client carried by the context, or the zero Client.
+func ClientFrom(ctx context.Context) Client {
+	c, _ := ctx.Value(clientKey{}).(Client)
+	return c
+}
@@ -0,0 +1,67 @@
+// Package objstore stores the contents of the files of the vaults as objects apart from the database,
+// on the local filesystem or in an S3 compatible store such as MinIO. The database only keeps the key,
+// the size and the checksum of the object of each file.
+package objstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is the error of reading an object which isn't stored.
+var ErrNotFound = errors.New("object not found")
+
+// ErrInvalidKey is the error of a key which isn't a relative slash-separated path of safe characters.
+var ErrInvalidKey = errors.New("invalid object key")
+
+// BlobStore stores objects of bytes under keys, slash-separated paths such as files/<entry>/<id>.
+// An object is written once under its key, a new version of the contents gets a new key.
+type BlobStore interface {
+	// Put stores the size bytes read from r as the object of the key.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get opens the object of the key, or returns ErrNotFound. The object seeks as a file does,
+	// its bytes are read as they are needed.
+	Get(ctx context.Context, key string) (io.ReadSeekCloser, error)
+	// Delete deletes the object of the key, a missing object isn't an error.
+	Delete(ctx context.Context, key string) error
+	// Exists reports whether the object of the key is stored.
+	Exists(ctx context.Context, key string) (bool, error)
+	// List calls fn with the objects whose keys start with the prefix, until fn returns an error.
+	List(ctx context.Context, prefix string, fn func(Info) error) error
+}
+
+// Info describes a stored object.
+type Info struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// checkKey returns ErrInvalidKey unless the key is a relative path of non-empty segments of letters,
+// digits, '-', '_' and '.', none of them "." or "..", so it maps to a file under the root of a store as it is.
+func checkKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("%w: empty", ErrInvalidKey)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+		}
+		for _, r := range segment {
+			if !keyChar(r) {
+				return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+			}
+		}
+	}
+
+	return nil
+}
+
+// keyChar reports whether the character may be in a segment of a key.
+func keyChar(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.'
+}
@@ -0,0 +1,324 @@
+package objstore
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultRegion is the region the requests are signed for unless one is configured, which MinIO accepts.
+const defaultRegion = "us-east-1"
+
+// maxErrorBody bounds the part of an error response kept in the error.
+const maxErrorBody = 512
+
+// S3Config is the configuration of an S3 compatible store.
+type S3Config struct {
+	// Endpoint is the URL of the service, such as https://s3.eu-central-1.amazonaws.com or http://minio:9000
+	Endpoint string
+	// Region is the region the requests are signed for, us-east-1 if empty
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PathStyle addresses the bucket in the path of the requests rather than in the host name, as MinIO does
+	PathStyle bool
+}
+
+// S3 stores the objects in a bucket of an S3 compatible service, authenticated with Signature Version 4.
+// The bodies of the objects put are streamed unsigned, the endpoint is reached over TLS or a trusted network.
+type S3 struct {
+	endpoint  *url.URL
+	bucket    string
+	pathStyle bool
+	signer    signer
+	client    *http.Client
+	now       func() time.Time
+}
+
+// NewS3 creates the store of the objects in the bucket of the configuration, reached with the HTTP client.
+func NewS3(cfg S3Config, client *http.Client) (*S3, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("the S3 blob store needs a bucket")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, errors.New("the S3 blob store needs an access key and a secret key")
+	}
+	region := cfg.Region
+	if region == "" {
+		region = defaultRegion
+	}
+
+	return &S3{
+		endpoint:  endpoint,
+		bucket:    cfg.Bucket,
+		pathStyle: cfg.PathStyle,
+		signer:    signer{accessKey: cfg.AccessKey, secretKey: cfg.SecretKey, region: region},
+		client:    client,
+		now:       time.Now,
+	}, nil
+}
+
+// Put uploads the object in a single request.
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	// The limit keeps the client from closing the reader of the caller
+	resp, err := s.do(ctx, http.MethodPut, key, nil, io.LimitReader(r, size), size, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(http.MethodPut, key, resp)
+	}
+
+	return nil
+}
+
+// Get looks the size of the object up, its bytes are read with ranged requests from the offset it is read at,
+// under the context.
+func (s *S3) Get(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+
+	size, found, err := s.head(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+
+	return &s3Object{ctx: ctx, store: s, key: key, size: size}, nil
+}
+
+// Delete deletes the object.
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+
+	return statusError(http.MethodDelete, key, resp)
+}
+
+// Exists looks the object up.
+func (s *S3) Exists(ctx context.Context, key string) (bool, error) {
+	if err := checkKey(key); err != nil {
+		return false, err
+	}
+
+	_, found, err := s.head(ctx, key)
+	return found, err
+}
+
+// listBucketResult is the response of ListObjectsV2.
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List lists the objects with ListObjectsV2, a page at a time.
+func (s *S3) List(ctx context.Context, prefix string, fn func(Info) error) error {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, 0, nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := statusError(http.MethodGet, "?list-type=2", resp)
+			resp.Body.Close()
+			return err
+		}
+		var page listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("s3: failed to decode the objects: %w", err)
+		}
+
+		for _, obj := range page.Contents {
+			if err := fn(Info{Key: obj.Key, Size: obj.Size, ModTime: obj.LastModified}); err != nil {
+				return err
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+// head returns the size of the object, and whether it exists.
+func (s *S3) head(ctx context.Context, key string) (int64, bool, error) {
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil, 0, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength, true, nil
+	case http.StatusNotFound:
+		return 0, false, nil
+	}
+
+	return 0, false, statusError(http.MethodHead, key, resp)
+}
+
+// do sends the signed request for the object of the key, or for the bucket if the key is empty.
+// A body of the size is streamed unsigned.
+func (s *S3) do(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.url(key, query).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	payloadHash := emptyPayload
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+		payloadHash = unsignedPayload
+	}
+	s.signer.sign(req, payloadHash, s.now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3: %w", err)
+	}
+
+	return resp, nil
+}
+
+// url returns the URL of the object of the key, or of the bucket if the key is empty, with the query.
+func (s *S3) url(key string, query url.Values) *url.URL {
+	u := &url.URL{Scheme: s.endpoint.Scheme, Host: s.endpoint.Host}
+	path := "/" + key
+	if s.pathStyle {
+		path = "/" + s.bucket
+		if key != "" {
+			path += "/" + key
+		}
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	u.Path, u.RawPath = path, s3Escape(path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	return u
+}
+
+// statusError returns the error of an unexpected response to the request for the key.
+func statusError(method, key string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	return fmt.Errorf("s3: %s %s: unexpected status %d: %s", method, key, resp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+// s3Object reads an object of an S3 store from its offset with a ranged request, sent once the bytes are read.
+// Seeking elsewhere closes the request, the next read sends another one.
+type s3Object struct {
+	ctx    context.Context
+	store  *S3
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+// Read reads the bytes from the offset.
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		header := http.Header{"Range": {"bytes=" + strconv.FormatInt(o.offset, 10) + "-"}}
+		resp, err := o.store.do(o.ctx, http.MethodGet, o.key, nil, nil, 0, header)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent && !(resp.StatusCode == http.StatusOK && o.offset == 0) {
+			err := statusError(http.MethodGet, o.key, resp)
+			resp.Body.Close()
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	if errors.Is(err, io.EOF) && o.offset < o.size {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+// Seek moves the offset, the size is the one of the object when it was opened.
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, errors.New("s3: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("s3: negative position")
+	}
+
+	if offset != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = offset
+
+	return offset, nil
+}
+
+// Close ends the request of the bytes, if any.
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+
+	return err
+}
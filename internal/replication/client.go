@@ -0,0 +1,81 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/middleware"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// apiKeyScheme starts the Authorization header of the requests to the primary.
+const apiKeyScheme = "ApiKey "
+
+// maxErrorBody bounds the part of an error response kept in the error.
+const maxErrorBody = 512
+
+// Client reads the vault of a user from the primary server through its public API, with an API key
+// of the user whose scopes include reading.
+type Client struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+// NewClient creates a client of the primary server at the base URL, e.g. https://vault.example.com,
+// sending the API key with the requests of the HTTP client.
+func NewClient(baseURL, token string, client *http.Client) *Client {
+	return &Client{baseURL: strings.TrimRight(baseURL, "/"), token: token, client: client}
+}
+
+// Checksum returns the checksum of the vault of the user on the primary, with the id of the user there.
+func (c *Client) Checksum(ctx context.Context) (models.VaultChecksum, error) {
+	var sum models.VaultChecksum
+	err := c.get(ctx, "/api/vault/checksum", &sum)
+
+	return sum, err
+}
+
+// Pull returns the entries of the table updated on the primary after since, the deleted ones included.
+// userID is the id of the user on the primary.
+func (c *Client) Pull(ctx context.Context, table string, userID int, since time.Time) ([]map[string]string, error) {
+	path := fmt.Sprintf("/getAllData/%s/%d/%s", url.PathEscape(table), userID, url.PathEscape(since.UTC().Format(time.RFC3339Nano)))
+
+	var rows []map[string]string
+	err := c.get(ctx, path, &rows)
+
+	return rows, err
+}
+
+// get requests the path and decodes the JSON response into v.
+func (c *Client) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", apiKeyScheme+c.token)
+	req.Header.Set(middleware.ProtocolHeader, strconv.Itoa(models.ProtocolV1))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("primary: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return fmt.Errorf("primary: %s: unexpected status %d: %s", path, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("primary: %s: %w", path, err)
+	}
+
+	return nil
+}
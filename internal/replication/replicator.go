@@ -0,0 +1,306 @@
+// Package replication replicates the vault of a user from a primary server to this one, a hot backup
+// kept in sync through the public API of the primary rather than the replication of its database.
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// The results of a round of the replication.
+const (
+	// ResultConverged is a round after which the checksums of both vaults matched
+	ResultConverged = "converged"
+	// ResultDiverged is a round which applied the changes but whose checksums still differ, the next round
+	// pulls the vault from the start
+	ResultDiverged = "diverged"
+	// ResultFailed is a round which couldn't reach the primary or apply its changes
+	ResultFailed = "failed"
+)
+
+// pullOverlap is how far before the last entry pulled a pull starts again. The entries written on the primary
+// within the same timestamp as the last one aren't missed, those pulled twice are skipped by ReplicateData.
+const pullOverlap = time.Second
+
+// Storage is the keeper of the replica.
+type Storage interface {
+	GetUserID(ctx context.Context, username string) (int, error)
+	GetAllData(ctx context.Context, table string, user_id int, q models.DataQuery) ([]map[string]string, error)
+	ReplicateData(ctx context.Context, table string, user_id int, rows []map[string]string) (int, error)
+}
+
+// Primary reads the vault of the user on the primary server, *Client implements it.
+type Primary interface {
+	Checksum(ctx context.Context) (models.VaultChecksum, error)
+	Pull(ctx context.Context, table string, userID int, since time.Time) ([]map[string]string, error)
+}
+
+// Metrics records the rounds of the replication, see SetMetrics.
+type Metrics interface {
+	// ObserveReplication records the result of a round and the lag of the replica after it.
+	ObserveReplication(result string, lag time.Duration)
+}
+
+// Log is the logger of the rounds.
+type Log interface {
+	Info(string, ...zapcore.Field)
+	Warn(string, ...zapcore.Field)
+}
+
+// Replicator replicates the vault of a user from the primary into the keeper of the user of the same name here.
+// Every round pulls the entries changed since the last one, keeping their ids, versions and tombstones, then
+// compares the checksums of both vaults. The writes of the user here are rejected while it runs, see Replicates.
+type Replicator struct {
+	keeper   Storage
+	primary  Primary
+	url      string
+	username string
+	now      func() time.Time
+	log      Log
+	metrics  Metrics
+
+	// round serializes the rounds
+	round sync.Mutex
+
+	mu         sync.RWMutex
+	userID     int
+	watermarks map[string]time.Time
+	startedAt  time.Time
+	status     models.ReplicationStatus
+}
+
+// New creates the replicator of the vault of the user of the username, read from the primary at the URL.
+func New(keeper Storage, primary Primary, url, username string, log Log) *Replicator {
+	return &Replicator{
+		keeper:     keeper,
+		primary:    primary,
+		url:        url,
+		username:   username,
+		now:        time.Now,
+		log:        log,
+		watermarks: make(map[string]time.Time),
+		startedAt:  time.Now(),
+	}
+}
+
+// SetMetrics sets the metrics recording the rounds.
+func (r *Replicator) SetMetrics(metrics Metrics) {
+	r.metrics = metrics
+}
+
+// Run runs a round at once, then every interval until the context is done.
+func (r *Replicator) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.Sync(ctx); err != nil && ctx.Err() == nil {
+			r.log.Warn("replication round failed", zap.String("primary", r.url), zap.String("username", r.username), zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync runs a round of the replication: it applies the changes of the primary and compares the checksums.
+// It returns an error if the primary can't be reached or its changes applied, and if the vaults still differ.
+func (r *Replicator) Sync(ctx context.Context) error {
+	r.round.Lock()
+	defer r.round.Unlock()
+
+	runAt := r.now()
+	local, applied, err := r.sync(ctx)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := ResultConverged
+	switch {
+	case err == nil:
+		r.status.SyncedAt = &runAt
+	case errors.Is(err, errDiverged):
+		result = ResultDiverged
+		// Something was missed, or written here, the next round pulls everything again
+		r.watermarks = make(map[string]time.Time)
+	default:
+		result = ResultFailed
+	}
+
+	r.status.Converged = err == nil
+	r.status.Applied = applied
+	r.status.LastRunAt = &runAt
+	r.status.LastError = ""
+	if err != nil {
+		r.status.LastError = err.Error()
+	}
+	if local.Checksum != "" {
+		r.status.Entries, r.status.Checksum = local.Entries, local.Checksum
+	}
+	if r.metrics != nil {
+		r.metrics.ObserveReplication(result, r.lag())
+	}
+	if applied > 0 {
+		r.log.Info("replicated the changes of the primary", zap.String("result", result), zap.Int("applied", applied))
+	}
+
+	return err
+}
+
+// errDiverged is the error of a round after which the checksums of the vaults differ.
+var errDiverged = errors.New("the vault differs from the primary")
+
+// sync runs a round, it returns the checksum of the local vault and the number of the entries changed.
+func (r *Replicator) sync(ctx context.Context) (models.VaultChecksum, int, error) {
+	userID, err := r.localUser(ctx)
+	if err != nil {
+		return models.VaultChecksum{}, 0, err
+	}
+	// The keeper scopes the queries to the user of the context
+	var keyUserID models.Key = "userID"
+	ctx = context.WithValue(ctx, keyUserID, strconv.Itoa(userID))
+
+	// The primary may change during the pull, so a mismatch is checked once more after another pull
+	var local models.VaultChecksum
+	applied := 0
+	for attempt := 0; attempt < 2; attempt++ {
+		remote, err := r.primary.Checksum(ctx)
+		if err != nil {
+			return local, applied, err
+		}
+		n, err := r.pull(ctx, userID, remote.UserID)
+		applied += n
+		if err != nil {
+			return local, applied, err
+		}
+
+		local, err = r.checksum(ctx, userID)
+		if err != nil {
+			return local, applied, err
+		}
+		if local.Checksum == remote.Checksum {
+			return local, applied, nil
+		}
+	}
+
+	return local, applied, errDiverged
+}
+
+// pull applies the entries changed on the primary since the last pull of each table, and moves the watermarks
+// past them. remoteUserID is the id of the user on the primary.
+func (r *Replicator) pull(ctx context.Context, userID, remoteUserID int) (int, error) {
+	applied := 0
+	for _, table := range models.DataTables {
+		r.mu.RLock()
+		watermark, ok := r.watermarks[table]
+		r.mu.RUnlock()
+		// The zero time doesn't pull the tombstones, the start of the epoch does
+		since := time.Unix(0, 0)
+		if ok {
+			since = watermark.Add(-pullOverlap)
+		}
+
+		rows, err := r.primary.Pull(ctx, table, remoteUserID, since)
+		if err != nil {
+			return applied, err
+		}
+		if len(rows) == 0 {
+			continue
+		}
+		n, err := r.keeper.ReplicateData(ctx, table, userID, rows)
+		applied += n
+		if err != nil {
+			return applied, fmt.Errorf("failed to replicate %s: %w", table, err)
+		}
+
+		latest := watermark
+		for _, row := range rows {
+			if updatedAt, err := time.Parse(time.RFC3339Nano, row["updated_at"]); err == nil && updatedAt.After(latest) {
+				latest = updatedAt
+			}
+		}
+		r.mu.Lock()
+		r.watermarks[table] = latest
+		r.mu.Unlock()
+	}
+
+	return applied, nil
+}
+
+// checksum returns the checksum of the local vault of the user.
+func (r *Replicator) checksum(ctx context.Context, userID int) (models.VaultChecksum, error) {
+	entries := make(map[string][]map[string]string, len(models.DataTables))
+	for _, table := range models.DataTables {
+		rows, err := r.keeper.GetAllData(ctx, table, userID, models.VaultChecksumQuery)
+		if err != nil {
+			return models.VaultChecksum{}, err
+		}
+		entries[table] = rows
+	}
+
+	return models.ChecksumVault(userID, entries), nil
+}
+
+// localUser returns the id of the user here, looked up once. The user registers here as on the primary,
+// the replica only holds their vault.
+func (r *Replicator) localUser(ctx context.Context) (int, error) {
+	r.mu.RLock()
+	userID := r.userID
+	r.mu.RUnlock()
+	if userID != 0 {
+		return userID, nil
+	}
+
+	userID, err := r.keeper.GetUserID(ctx, r.username)
+	if err != nil {
+		return 0, fmt.Errorf("the user %q of the replica: %w", r.username, err)
+	}
+
+	r.mu.Lock()
+	r.userID = userID
+	r.mu.Unlock()
+
+	return userID, nil
+}
+
+// Replicates reports whether the vault of the user is the replica, known once a round found the user.
+func (r *Replicator) Replicates(userID int) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.userID != 0 && r.userID == userID
+}
+
+// Status returns the state of the replication as of its last round.
+func (r *Replicator) Status() models.ReplicationStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	status := r.status
+	status.Primary, status.Username = r.url, r.username
+	status.LagSeconds = r.lag().Seconds()
+
+	return status
+}
+
+// lag returns the time since the last round which converged, or since the start before the first one.
+// The caller holds mu.
+func (r *Replicator) lag() time.Duration {
+	since := r.startedAt
+	if r.status.SyncedAt != nil {
+		since = *r.status.SyncedAt
+	}
+
+	return r.now().Sub(since)
+}
@@ -0,0 +1,2847 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+)
+
+// memUser represents a user record held by MemKeeper.
+type memUser struct {
+	id             int
+	password       string
+	failedAttempts int
+	lockedUntil    time.Time
+	lastLoginAt    time.Time
+	role           string
+	disabled       bool
+	email          string
+	emailVerified  bool
+	language       string
+	// passwordChangedAt is the last change of the password, see GetUserAccess
+	passwordChangedAt time.Time
+}
+
+// memEntry represents a data record held by MemKeeper.
+type memEntry struct {
+	userID    int
+	fields    map[string]string
+	deleted   bool
+	updatedAt time.Time
+	// blob is the object of the contents of a file entry in the blob store, see WriteFileBlob
+	blob models.FileBlob
+}
+
+// memBlob is the stored contents of the files of a checksum, with the number of the entries pointing at them.
+type memBlob struct {
+	key  string
+	size int64
+	refs int
+}
+
+// shareKey identifies the share of an entry with a grantee, the ids of the entries are unique across the users.
+type shareKey struct {
+	granteeID int
+	table     string
+	entryID   string
+}
+
+// memShare is a share held by MemKeeper. A revoked share is kept, so the grantee drops the entry on their next sync.
+type memShare struct {
+	models.Share
+	revoked bool
+}
+
+// historyKey identifies the history of an entry of a user.
+type historyKey struct {
+	table   string
+	userID  int
+	entryID string
+}
+
+// memHistoryLimit is the default number of prior versions retained per entry.
+const memHistoryLimit = 10
+
+// MemKeeper is an in-memory Keeper implementation backed by maps.
+// It mirrors the semantics of the database keeper and is intended for tests.
+type MemKeeper struct {
+	// txMu serializes the transactions, mu is only held by single calls
+	txMu         sync.Mutex
+	mu           sync.RWMutex
+	users        map[string]*memUser
+	tables       map[string]map[string]*memEntry
+	history      map[historyKey][]models.EntryVersion
+	historyLimit int
+	lastID       int
+	audit        []models.AuditEvent
+	lastAuditID  int
+	tokens       map[string]models.RefreshToken
+	logins       map[int][]models.LoginEvent
+	apiKeys      map[int]models.APIKey
+	lastKeyID    int
+	emailTokens  map[string]models.EmailToken
+	devices      map[int]map[string]models.Device
+	operations   map[int][]models.UserOperation
+	uploads      map[string]models.UploadSession
+	revoked      map[string]time.Time
+	monitors     map[int]models.MonitorToken
+	lastMonitor  int
+	blobs        map[string]*memBlob
+	shares       map[shareKey]*memShare
+	folders      map[string]*models.Folder
+	now          func() time.Time
+}
+
+// NewMemKeeper creates a new empty MemKeeper instance.
+func NewMemKeeper() *MemKeeper {
+	return &MemKeeper{
+		users:        make(map[string]*memUser),
+		tables:       make(map[string]map[string]*memEntry),
+		history:      make(map[historyKey][]models.EntryVersion),
+		historyLimit: memHistoryLimit,
+		tokens:       make(map[string]models.RefreshToken),
+		logins:       make(map[int][]models.LoginEvent),
+		apiKeys:      make(map[int]models.APIKey),
+		emailTokens:  make(map[string]models.EmailToken),
+		devices:      make(map[int]map[string]models.Device),
+		operations:   make(map[int][]models.UserOperation),
+		uploads:      make(map[string]models.UploadSession),
+		revoked:      make(map[string]time.Time),
+		monitors:     make(map[int]models.MonitorToken),
+		blobs:        make(map[string]*memBlob),
+		shares:       make(map[shareKey]*memShare),
+		folders:      make(map[string]*models.Folder),
+		now:          func() time.Time { return time.Now().UTC() },
+	}
+}
+
+// SetHistoryLimit sets the number of prior versions retained per entry, 0 disables the history.
+func (mk *MemKeeper) SetHistoryLimit(limit int) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	mk.historyLimit = limit
+}
+
+// UserExists checks if a user exists.
+func (mk *MemKeeper) UserExists(ctx context.Context, username string) (bool, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	_, ok := mk.users[username]
+	return ok, nil
+}
+
+// UsernameTaken reports whether a user has the username or a lookalike of it, a username of the same skeleton.
+func (mk *MemKeeper) UsernameTaken(ctx context.Context, username string) (bool, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	skeleton := models.UsernameSkeleton(username)
+	for name := range mk.users {
+		if name == username || models.UsernameSkeleton(name) == skeleton {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// AddUser adds a new user to the storage.
+func (mk *MemKeeper) AddUser(ctx context.Context, username string, hashedPassword string) error {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	if _, ok := mk.users[username]; ok {
+		return ErrConflict
+	}
+
+	mk.lastID++
+	mk.users[username] = &memUser{id: mk.lastID, password: hashedPassword, role: models.RoleUser}
+
+	return nil
+}
+
+// GetPassword retrieves the password for the given username.
+func (mk *MemKeeper) GetPassword(ctx context.Context, username string) (string, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	u, ok := mk.users[username]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+
+	return u.password, nil
+}
+
+// GetUserID retrieves the user ID for the given username.
+func (mk *MemKeeper) GetUserID(ctx context.Context, username string) (int, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	u, ok := mk.users[username]
+	if !ok {
+		return 0, sql.ErrNoRows
+	}
+
+	return u.id, nil
+}
+
+// UpdatePassword replaces the hashed password of a user, records the time of the change and revokes
+// all their refresh tokens, or returns models.ErrNotFound.
+func (mk *MemKeeper) UpdatePassword(ctx context.Context, user_id int, hashedPassword string) error {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	for _, u := range mk.users {
+		if u.id != user_id {
+			continue
+		}
+		u.password = hashedPassword
+		u.passwordChangedAt = time.Now().UTC()
+		for hash, tok := range mk.tokens {
+			if tok.UserID == user_id {
+				tok.Revoked = true
+				mk.tokens[hash] = tok
+			}
+		}
+		return nil
+	}
+
+	return models.ErrNotFound
+}
+
+// RehashPassword replaces the hashed password of a user with another hash of the same password
+// if it is still oldHash, the sessions go on. It reports whether it was replaced.
+func (mk *MemKeeper) RehashPassword(ctx context.Context, user_id int, oldHash, newHash string) (bool, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	for _, u := range mk.users {
+		if u.id == user_id && u.password == oldHash {
+			u.password = newHash
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// RecordFailedLogin counts a failed login of the account and locks it once its consecutive failures
+// reach maxFailures. It returns the end of the lockout it started, the zero time if the account
+// isn't locked, or models.ErrNotFound if there is no such account.
+func (mk *MemKeeper) RecordFailedLogin(ctx context.Context, username string, maxFailures int) (time.Time, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	u, ok := mk.users[username]
+	if !ok {
+		return time.Time{}, models.ErrNotFound
+	}
+	u.failedAttempts++
+	lockFor := models.LockoutDuration(u.failedAttempts, maxFailures)
+	if lockFor == 0 {
+		return time.Time{}, nil
+	}
+	u.lockedUntil = mk.now().Add(lockFor).UTC()
+
+	return u.lockedUntil, nil
+}
+
+// ResetFailedLogins clears the failed logins of the account after a successful one.
+func (mk *MemKeeper) ResetFailedLogins(ctx context.Context, username string) error {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	if u, ok := mk.users[username]; ok {
+		u.failedAttempts = 0
+		u.lockedUntil = time.Time{}
+	}
+
+	return nil
+}
+
+// IsLocked reports whether the account is locked and until when. An unknown account is never locked.
+func (mk *MemKeeper) IsLocked(ctx context.Context, username string) (bool, time.Time, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	u, ok := mk.users[username]
+	if !ok || !u.lockedUntil.After(mk.now()) {
+		return false, time.Time{}, nil
+	}
+
+	return true, u.lockedUntil, nil
+}
+
+// RecordLogin adds a login attempt to the login history of its user, a successful one also becomes
+// their last login. The history keeps the last keep attempts of the user, a keep of 0 or less keeps all.
+func (mk *MemKeeper) RecordLogin(ctx context.Context, ev models.LoginEvent, keep int) error {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	ev.At = mk.now()
+	logins := append(mk.logins[ev.UserID], ev)
+	if keep > 0 && len(logins) > keep {
+		logins = append([]models.LoginEvent(nil), logins[len(logins)-keep:]...)
+	}
+	mk.logins[ev.UserID] = logins
+
+	if ev.Success {
+		for _, u := range mk.users {
+			if u.id == ev.UserID {
+				u.lastLoginAt = ev.At
+			}
+		}
+	}
+
+	return nil
+}
+
+// GetLoginHistory returns up to limit login attempts of the user, newest first.
+// A limit of 0 or less returns all of them.
+func (mk *MemKeeper) GetLoginHistory(ctx context.Context, user_id int, limit int) ([]models.LoginEvent, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	logins := mk.logins[user_id]
+	events := make([]models.LoginEvent, 0)
+	for i := len(logins) - 1; i >= 0; i-- {
+		if limit > 0 && len(events) == limit {
+			break
+		}
+		events = append(events, logins[i])
+	}
+
+	return events, nil
+}
+
+// userByID returns the username and the record of the user, or nil, the caller must hold the lock.
+func (mk *MemKeeper) userByID(user_id int) (string, *memUser) {
+	for name, u := range mk.users {
+		if u.id == user_id {
+			return name, u
+		}
+	}
+
+	return "", nil
+}
+
+// SetUserRole sets the role of the user, or returns models.ErrNotFound. The database keeper has no
+// counterpart, the admins are appointed in the database.
+func (mk *MemKeeper) SetUserRole(ctx context.Context, user_id int, role string) error {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	_, u := mk.userByID(user_id)
+	if u == nil {
+		return models.ErrNotFound
+	}
+	u.role = role
+
+	return nil
+}
+
+// GetUserAccess returns the role of the user, whether their account is disabled and the last change
+// of their password, or models.ErrNotFound.
+func (mk *MemKeeper) GetUserAccess(ctx context.Context, user_id int) (models.UserAccess, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	_, u := mk.userByID(user_id)
+	if u == nil {
+		return models.UserAccess{}, models.ErrNotFound
+	}
+
+	return models.UserAccess{Role: u.role, Disabled: u.disabled, PasswordChangedAt: u.passwordChangedAt}, nil
+}
+
+// ListUsers returns up to limit users with an id greater than afterID, by id, with the number and
+// the stored size of their live entries.
+func (mk *MemKeeper) ListUsers(ctx context.Context, afterID int, limit int) ([]models.UserSummary, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	users := make([]models.UserSummary, 0)
+	for name, u := range mk.users {
+		if u.id <= afterID {
+			continue
+		}
+		sum := models.UserSummary{ID: u.id, Username: name, Role: u.role, Disabled: u.disabled}
+		if !u.lastLoginAt.IsZero() {
+			at := u.lastLoginAt
+			sum.LastLoginAt = &at
+		}
+		users = append(users, sum)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	if len(users) > limit {
+		users = users[:limit]
+	}
+
+	byID := make(map[int]*models.UserSummary, len(users))
+	for i := range users {
+		byID[users[i].ID] = &users[i]
+	}
+	for _, table := range models.DataTables {
+		for id, e := range mk.tables[table] {
+			if u, ok := byID[e.userID]; ok && !e.deleted {
+				u.Entries++
+				u.Bytes += models.EntrySize(e.row(id))
+			}
+		}
+	}
+	// The contents shared by files of a user count once in their physical usage
+	shared := make(map[int]map[string]bool)
+	for _, e := range mk.tables[models.FilesTable] {
+		u, ok := byID[e.userID]
+		if !ok || e.deleted || e.blob.Key == "" {
+			continue
+		}
+		u.LogicalFileBytes += e.blob.Size
+		if shared[e.userID] == nil {
+			shared[e.userID] = make(map[string]bool)
+		}
+		if !shared[e.userID][e.blob.SHA256] {
+			shared[e.userID][e.blob.SHA256] = true
+			u.PhysicalFileBytes += e.blob.Size
+		}
+	}
+
+	return users, nil
+}
+
+// SetUserDisabled disables or enables the account of the user, or returns models.ErrNotFound.
+// Disabling it also revokes all of their refresh tokens.
+func (mk *MemKeeper) SetUserDisabled(ctx context.Context, user_id int, disabled bool) error {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	_, u := mk.userByID(user_id)
+	if u == nil {
+		return models.ErrNotFound
+	}
+	u.disabled = disabled
+	if !disabled {
+		return nil
+	}
+	for hash, tok := range mk.tokens {
+		if tok.UserID == user_id {
+			tok.Revoked = true
+			mk.tokens[hash] = tok
+		}
+	}
+
+	return nil
+}
+
+// DeleteUser deletes the account of the user with their entries, their folders, their history, their audit events,
+// their refresh tokens, their API keys, their devices, their operations, their uploads, their logins and
+// the shares with them, or returns models.ErrNotFound. The shares of their entries are revoked.
+func (mk *MemKeeper) DeleteUser(ctx context.Context, user_id int) error {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	name, u := mk.userByID(user_id)
+	if u == nil {
+		return models.ErrNotFound
+	}
+	delete(mk.users, name)
+
+	// The objects of the contents no entry points at any more are left to the reconciliation of the store
+	for _, entries := range mk.tables {
+		for id, e := range entries {
+			if e.userID == user_id {
+				mk.releaseBlob(e.blob)
+				delete(entries, id)
+			}
+		}
+	}
+	for key := range mk.history {
+		if key.userID == user_id {
+			delete(mk.history, key)
+		}
+	}
+	kept := mk.audit[:0]
+	for _, ev := range mk.audit {
+		if ev.UserID != user_id {
+			kept = append(kept, ev)
+		}
+	}
+	mk.audit = kept
+	for hash, tok := range mk.tokens {
+		if tok.UserID == user_id {
+			delete(mk.tokens, hash)
+		}
+	}
+	delete(mk.logins, user_id)
+	for id, key := range mk.apiKeys {
+		if key.UserID == user_id {
+			delete(mk.apiKeys, id)
+		}
+	}
+	mk.deleteEmailTokens(user_id)
+	delete(mk.devices, user_id)
+	delete(mk.operations, user_id)
+	for id, session := range mk.uploads {
+		if session.UserID == user_id {
+			delete(mk.uploads, id)
+		}
+	}
+	for id, f := range mk.folders {
+		if f.UserID == user_id {
+			delete(mk.folders, id)
+		}
+	}
+	// The grantees of the entries of the user drop them on their next sync
+	for key, s := range mk.shares {
+		switch {
+		case key.granteeID == user_id:
+			delete(mk.shares, key)
+		case s.OwnerID == user_id && !s.revoked:
+			mk.touchShare(s)
+			s.revoked = true
+		}
+	}
+
+	return nil
+}
+
+// CreateAPIKey stores an API key created by a user and returns it with its id and its creation time.
+func (mk *MemKeeper) CreateAPIKey(ctx context.Context, key models.APIKey) (models.APIKey, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	for _, k := range mk.apiKeys {
+		if k.Hash == key.Hash {
+			return models.APIKey{}, ErrConflict
+		}
+	}
+
+	mk.lastKeyID++
+	key.ID = mk.lastKeyID
+	key.CreatedAt = mk.now()
+	key.Scopes = slices.Clone(key.Scopes)
+	if key.ExpiresAt != nil {
+		at := key.ExpiresAt.UTC()
+		key.ExpiresAt = &at
+	}
+	mk.apiKeys[key.ID] = key
+
+	return key, nil
+}
+
+// GetAPIKeyByHash returns the API key with the given hash, expired or not, or models.ErrNotFound.
+func (mk *MemKeeper) GetAPIKeyByHash(ctx context.Context, hash string) (models.APIKey, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	for _, key := range mk.apiKeys {
+		if key.Hash == hash {
+			return key, nil
+		}
+	}
+
+	return models.APIKey{}, models.ErrNotFound
+}
+
+// ListAPIKeys returns the API keys of the user, oldest first.
+func (mk *MemKeeper) ListAPIKeys(ctx context.Context, user_id int) ([]models.APIKey, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	keys := make([]models.APIKey, 0)
+	for _, key := range mk.apiKeys {
+		if key.UserID == user_id {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+
+	return keys, nil
+}
+
+// TouchAPIKey sets the last use of the API key to now.
+func (mk *MemKeeper) TouchAPIKey(ctx context.Context, id int) error {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	if key, ok := mk.apiKeys[id]; ok {
+		now := mk.now()
+		key.LastUsedAt = &now
+		mk.apiKeys[id] = key
+	}
+
+	return nil
+}
+
+// RevokeAPIKey deletes the API key of the user, or returns models.ErrNotFound.
+func (mk *MemKeeper) RevokeAPIKey(ctx context.Context, user_id int, id int) error {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	key, ok := mk.apiKeys[id]
+	if !ok || key.UserID != user_id {
+		return models.ErrNotFound
+	}
+	delete(mk.apiKeys, id)
+
+	return nil
+}
+
+// CreateMonitorToken stores a monitor token created by an admin and returns it with its id and its creation time.
+func (mk *MemKeeper) CreateMonitorToken(ctx context.Context, token models.MonitorToken) (models.MonitorToken, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	for _, t := range mk.monitors {
+		if t.Hash == token.Hash {
+			return models.MonitorToken{}, ErrConflict
+		}
+	}
+
+	mk.lastMonitor++
+	token.ID = mk.lastMonitor
+	token.CreatedAt = mk.now()
+	token.LastUsedAt = nil
+	mk.monitors[token.ID] = token
+
+	return token, nil
+}
+
+// GetMonitorTokenByHash returns the monitor token with the given hash, or models.ErrNotFound.
+func (mk *MemKeeper) GetMonitorTokenByHash(ctx context.Context, hash string) (models.MonitorToken, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	for _, token := range mk.monitors {
+		if token.Hash == hash {
+			return token, nil
+		}
+	}
+
+	return models.MonitorToken{}, models.ErrNotFound
+}
+
+// ListMonitorTokens returns the monitor tokens, oldest first.
+func (mk *MemKeeper) ListMonitorTokens(ctx context.Context) ([]models.MonitorToken, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	tokens := make([]models.MonitorToken, 0, len(mk.monitors))
+	for _, token := range mk.monitors {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+
+	return tokens, nil
+}
+
+// TouchMonitorToken sets the last use of the monitor token to now.
+func (mk *MemKeeper) TouchMonitorToken(ctx context.Context, id int) error {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	if token, ok := mk.monitors[id]; ok {
+		now := mk.now()
+		token.LastUsedAt = &now
+		mk.monitors[id] = token
+	}
+
+	return nil
+}
+
+// RevokeMonitorToken deletes the monitor token and returns it, or returns models.ErrNotFound.
+func (mk *MemKeeper) RevokeMonitorToken(ctx context.Context, id int) (models.MonitorToken, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	token, ok := mk.monitors[id]
+	if !ok {
+		return models.MonitorToken{}, models.ErrNotFound
+	}
+	delete(mk.monitors, id)
+
+	return token, nil
+}
+
+// SetUserEmail sets the email of the user, unverified, or clears it if it is empty. The tokens mailed
+// to the previous email are void. It returns models.ErrEmailTaken if another user has the email.
+func (mk *MemKeeper) SetUserEmail(ctx context.Context, user_id int, email string) error {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	_, u := mk.userByID(user_id)
+	if u == nil {
+		return models.ErrNotFound
+	}
+	if email != "" {
+		for _, other := range mk.users {
+			if other != u && other.email == email {
+				return models.ErrEmailTaken
+			}
+		}
+	}
+	u.email, u.emailVerified = email, false
+	mk.deleteEmailTokens(user_id)
+
+	return nil
+}
+
+// SetUserLanguage sets the language the user is mailed in, empty for the default one,
+// or returns models.ErrNotFound if the user doesn't exist.
+func (mk *MemKeeper) SetUserLanguage(ctx context.Context, user_id int, language string) error {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	_, u := mk.userByID(user_id)
+	if u == nil {
+		return models.ErrNotFound
+	}
+	u.language = language
+
+	return nil
+}
+
+// deleteEmailTokens deletes the email tokens of the user, the caller must hold the lock.
+func (mk *MemKeeper) deleteEmailTokens(userID int) {
+	for hash, token := range mk.emailTokens {
+		if token.UserID == userID {
+			delete(mk.emailTokens, hash)
+		}
+	}
+}
+
+// userEmail returns the email of the user, the caller must hold the lock.
+func userEmail(name string, u *memUser) models.UserEmail {
+	return models.UserEmail{UserID: u.id, Username: name, Email: u.email, Verified: u.emailVerified, Language: u.language}
+}
+
+// GetUserEmail returns the email of the user, or models.ErrNotFound if the user doesn't exist.
+func (mk *MemKeeper) GetUserEmail(ctx context.Context, user_id int) (models.UserEmail, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	name, u := mk.userByID(user_id)
+	if u == nil {
+		return models.UserEmail{}, models.ErrNotFound
+	}
+
+	return userEmail(name, u), nil
+}
+
+// FindUserByEmail returns the user with the email, or models.ErrNotFound.
+func (mk *MemKeeper) FindUserByEmail(ctx context.Context, email string) (models.UserEmail, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	for name, u := range mk.users {
+		if email != "" && u.email == email {
+			return userEmail(name, u), nil
+		}
+	}
+
+	return models.UserEmail{}, models.ErrNotFound
+}
+
+// VerifyUserEmail marks the email of the user as verified if it is still the given one,
+// or returns models.ErrNotFound.
+func (mk *MemKeeper) VerifyUserEmail(ctx context.Context, user_id int, email string) error {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	_, u := mk.userByID(user_id)
+	if u == nil || email == "" || u.email != email {
+		return models.ErrNotFound
+	}
+	u.emailVerified = true
+
+	return nil
+}
+
+// CreateEmailToken stores a token mailed to a user. The expired tokens of the user are deleted with it.
+func (mk *MemKeeper) CreateEmailToken(ctx context.Context, token models.EmailToken) error {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	now := mk.now()
+	for hash, t := range mk.emailTokens {
+		if t.UserID == token.UserID && !now.Before(t.ExpiresAt) {
+			delete(mk.emailTokens, hash)
+		}
+	}
+	if _, ok := mk.emailTokens[token.Hash]; ok {
+		return ErrConflict
+	}
+	token.ExpiresAt = token.ExpiresAt.UTC()
+	mk.emailTokens[token.Hash] = token
+
+	return nil
+}
+
+// ConsumeEmailToken deletes the token of the purpose with the given hash and returns it,
+// or returns models.ErrNotFound if there is none or it has expired.
+func (mk *MemKeeper) ConsumeEmailToken(ctx context.Context, hash, purpose string) (models.EmailToken, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	token, ok := mk.emailTokens[hash]
+	if !ok || token.Purpose != purpose {
+		return models.EmailToken{}, models.ErrNotFound
+	}
+	delete(mk.emailTokens, hash)
+	if !mk.now().Before(token.ExpiresAt) {
+		return models.EmailToken{}, models.ErrNotFound
+	}
+
+	return token, nil
+}
+
+// RegisterDevice registers the device of the user, or marks a registered one as seen now.
+// An empty name keeps the name the device was registered with.
+func (mk *MemKeeper) RegisterDevice(ctx context.Context, user_id int, device_id, name string) error {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	devices := mk.devices[user_id]
+	if devices == nil {
+		devices = make(map[string]models.Device)
+		mk.devices[user_id] = devices
+	}
+	d, ok := devices[device_id]
+	if !ok {
+		d = models.Device{DeviceID: device_id, UserID: user_id}
+	}
+	if name != "" {
+		d.Name = name
+	}
+	d.LastSeenAt = mk.now()
+	devices[device_id] = d
+
+	return nil
+}
+
+// TouchDevice marks the registered device of the user as seen now, or returns models.ErrNotFound.
+func (mk *MemKeeper) TouchDevice(ctx context.Context, user_id int, device_id string) error {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	d, ok := mk.devices[user_id][device_id]
+	if !ok {
+		return models.ErrNotFound
+	}
+	d.LastSeenAt = mk.now()
+	mk.devices[user_id][device_id] = d
+
+	return nil
+}
+
+// GetDevices returns the devices of the user, the most recently seen first.
+func (mk *MemKeeper) GetDevices(ctx context.Context, user_id int) ([]models.Device, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	devices := make([]models.Device, 0, len(mk.devices[user_id]))
+	for _, d := range mk.devices[user_id] {
+		if d.LastSyncAt != nil {
+			at := *d.LastSyncAt
+			d.LastSyncAt = &at
+		}
+		devices = append(devices, d)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		if !devices[i].LastSeenAt.Equal(devices[j].LastSeenAt) {
+			return devices[i].LastSeenAt.After(devices[j].LastSeenAt)
+		}
+		return devices[i].DeviceID < devices[j].DeviceID
+	})
+
+	return devices, nil
+}
+
+// SetDeviceLastSync moves the synchronization checkpoint of the registered device of the user forward to at,
+// a checkpoint already later is kept. It returns models.ErrNotFound if the device isn't registered.
+func (mk *MemKeeper) SetDeviceLastSync(ctx context.Context, user_id int, device_id string, at time.Time) error {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	d, ok := mk.devices[user_id][device_id]
+	if !ok {
+		return models.ErrNotFound
+	}
+	if d.LastSyncAt == nil || at.After(*d.LastSyncAt) {
+		at = at.UTC()
+		d.LastSyncAt = &at
+		mk.devices[user_id][device_id] = d
+	}
+
+	return nil
+}
+
+// RevokeDevice deletes the device of the user and revokes its refresh tokens, or returns models.ErrNotFound.
+func (mk *MemKeeper) RevokeDevice(ctx context.Context, user_id int, device_id string) error {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	if _, ok := mk.devices[user_id][device_id]; !ok {
+		return models.ErrNotFound
+	}
+	delete(mk.devices[user_id], device_id)
+
+	for hash, tok := range mk.tokens {
+		if tok.UserID == user_id && tok.DeviceID == device_id {
+			tok.Revoked = true
+			mk.tokens[hash] = tok
+		}
+	}
+
+	return nil
+}
+
+// StartUserOperation starts the operation of the user, running until its ExpiresAt unless extended, and returns it
+// with its status and its start time. A running operation of the user which expired fails first. It returns
+// models.ErrOperationRunning if another one is still running.
+func (mk *MemKeeper) StartUserOperation(ctx context.Context, op models.UserOperation) (models.UserOperation, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	if _, ok := mk.runningOperation(op.UserID); ok {
+		return models.UserOperation{}, models.ErrOperationRunning
+	}
+	op.Status, op.StartedAt, op.FinishedAt = models.OperationRunning, mk.now(), nil
+	op.ExpiresAt = op.ExpiresAt.UTC()
+	mk.operations[op.UserID] = append(mk.operations[op.UserID], op)
+
+	return op, nil
+}
+
+// GetRunningOperation returns the running operation of the user, or models.ErrNotFound.
+// A running operation which expired fails and isn't returned.
+func (mk *MemKeeper) GetRunningOperation(ctx context.Context, user_id int) (models.UserOperation, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	i, ok := mk.runningOperation(user_id)
+	if !ok {
+		return models.UserOperation{}, models.ErrNotFound
+	}
+
+	return mk.operations[user_id][i], nil
+}
+
+// UpdateUserOperation moves the running operation of the user with the id to the status and returns it.
+// An operation still running is extended until expiresAt, a completed or failed one is finished now.
+// It returns models.ErrNotFound if the user has no such operation running, an expired one included.
+func (mk *MemKeeper) UpdateUserOperation(ctx context.Context, user_id int, id, status string, expiresAt time.Time) (models.UserOperation, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	i, ok := mk.runningOperation(user_id)
+	if !ok || mk.operations[user_id][i].ID != id {
+		return models.UserOperation{}, models.ErrNotFound
+	}
+	op := &mk.operations[user_id][i]
+	if status == models.OperationRunning {
+		op.ExpiresAt = expiresAt.UTC()
+	} else {
+		now := mk.now()
+		op.Status, op.FinishedAt = status, &now
+	}
+
+	return *op, nil
+}
+
+// CreateUploadSession creates the upload session of the user and returns it with its creation time.
+func (mk *MemKeeper) CreateUploadSession(ctx context.Context, session models.UploadSession) (models.UploadSession, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	session.CreatedAt, session.ExpiresAt = mk.now(), session.ExpiresAt.UTC()
+	mk.uploads[session.ID] = session
+
+	return session, nil
+}
+
+// GetUploadSession returns the upload session of the user, or models.ErrNotFound if it is missing or expired.
+func (mk *MemKeeper) GetUploadSession(ctx context.Context, user_id int, id string) (models.UploadSession, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	session, ok := mk.uploads[id]
+	if !ok || session.UserID != user_id || !session.ExpiresAt.After(mk.now()) {
+		return models.UploadSession{}, models.ErrNotFound
+	}
+
+	return session, nil
+}
+
+// DeleteUploadSession deletes the upload session of the user, or returns models.ErrNotFound.
+func (mk *MemKeeper) DeleteUploadSession(ctx context.Context, user_id int, id string) error {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	session, ok := mk.uploads[id]
+	if !ok || session.UserID != user_id {
+		return models.ErrNotFound
+	}
+	delete(mk.uploads, id)
+
+	return nil
+}
+
+// FileEntryTaken reports whether another user has a file entry with the id, deleted or not.
+func (mk *MemKeeper) FileEntryTaken(ctx context.Context, user_id int, entry_id string) (bool, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	e, ok := mk.tables[models.FilesTable][entry_id]
+	return ok && e.userID != user_id, nil
+}
+
+// PruneUploadSessions deletes the upload sessions expired before the given time and returns their ids.
+func (mk *MemKeeper) PruneUploadSessions(ctx context.Context, before time.Time) ([]string, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	var pruned []string
+	for id, session := range mk.uploads {
+		if session.ExpiresAt.Before(before) {
+			delete(mk.uploads, id)
+			pruned = append(pruned, id)
+		}
+	}
+
+	return pruned, nil
+}
+
+// WriteFileBlob writes the file entry of the user with the fields, adding it unless the user has it,
+// and points it at the contents of the checksum of the blob, stored once for all the entries. A blob
+// without a key points it at the stored contents, or returns models.ErrBlobNotStored. It returns the keys
+// of the objects no entry points at any more.
+func (mk *MemKeeper) WriteFileBlob(ctx context.Context, user_id int, entry_id string, fields map[string]string, blob models.FileBlob) ([]string, time.Time, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	stored, ok := mk.blobs[blob.SHA256]
+	if !ok && blob.Key == "" {
+		return nil, time.Time{}, models.ErrBlobNotStored
+	}
+
+	action := models.AuditUpdate
+	var updatedAt time.Time
+	var err error
+	if mk.entry(models.FilesTable, user_id, entry_id) == nil {
+		action = models.AuditAdd
+		updatedAt, err = mk.addData(models.FilesTable, user_id, entry_id, fields)
+	} else {
+		updatedAt, err = mk.updateData(models.FilesTable, user_id, entry_id, fields)
+	}
+	mk.recordAudit(ctx, action, models.FilesTable, user_id, entry_id, err == nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	// An object put for contents stored meanwhile isn't needed
+	var released []string
+	if !ok {
+		stored = &memBlob{key: blob.Key, size: blob.Size}
+		mk.blobs[blob.SHA256] = stored
+	} else if blob.Key != "" && blob.Key != stored.key {
+		released = append(released, blob.Key)
+	}
+	stored.refs++
+
+	e := mk.entry(models.FilesTable, user_id, entry_id)
+	previous := e.blob
+	e.blob = models.FileBlob{Key: stored.key, Size: stored.size, SHA256: blob.SHA256}
+	if key, ok := mk.releaseBlob(previous); ok {
+		released = append(released, key)
+	}
+
+	return released, updatedAt, nil
+}
+
+// releaseBlob drops the reference of an entry to the blob, returning the key of its object if no entry
+// points at it any more, the caller must hold the lock.
+func (mk *MemKeeper) releaseBlob(blob models.FileBlob) (string, bool) {
+	if blob.Key == "" {
+		return "", false
+	}
+	stored, ok := mk.blobs[blob.SHA256]
+	if !ok || stored.key != blob.Key {
+		return blob.Key, true
+	}
+	stored.refs--
+	if stored.refs > 0 {
+		return "", false
+	}
+	delete(mk.blobs, blob.SHA256)
+
+	return stored.key, true
+}
+
+// GetFileBlob returns the blob of the file entry of the user, the zero one if its file is kept on disk,
+// or models.ErrNotFound if the user has no such entry.
+func (mk *MemKeeper) GetFileBlob(ctx context.Context, user_id int, entry_id string) (models.FileBlob, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	e := mk.entry(models.FilesTable, user_id, entry_id)
+	if e == nil {
+		return models.FileBlob{}, models.ErrNotFound
+	}
+
+	return e.blob, nil
+}
+
+// ReferencedBlobs returns which of the keys of the blob store the file entries of any user point at,
+// the deleted ones included, or which hold stored contents.
+func (mk *MemKeeper) ReferencedBlobs(ctx context.Context, keys []string) (map[string]bool, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	wanted := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		wanted[key] = true
+	}
+	referenced := make(map[string]bool)
+	for _, e := range mk.tables[models.FilesTable] {
+		if e.blob.Key != "" && wanted[e.blob.Key] {
+			referenced[e.blob.Key] = true
+		}
+	}
+	for _, stored := range mk.blobs {
+		if wanted[stored.key] {
+			referenced[stored.key] = true
+		}
+	}
+
+	return referenced, nil
+}
+
+// runningOperation returns the index of the running operation of the user, failing it if it expired,
+// the caller must hold the lock.
+func (mk *MemKeeper) runningOperation(userID int) (int, bool) {
+	ops := mk.operations[userID]
+	for i := range ops {
+		if ops[i].Status != models.OperationRunning {
+			continue
+		}
+		if ops[i].ExpiresAt.After(mk.now()) {
+			return i, true
+		}
+		expiredAt := ops[i].ExpiresAt
+		ops[i].Status, ops[i].FinishedAt = models.OperationFailed, &expiredAt
+	}
+
+	return 0, false
+}
+
+// AddData adds data to the storage. An entry without an id gets a new one.
+func (mk *MemKeeper) AddData(ctx context.Context, table string, user_id int, entry_id string, data map[string]string) (string, time.Time, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	if entry_id == "" {
+		entry_id = models.NewEntryID()
+	}
+	updatedAt, err := mk.addData(table, user_id, entry_id, data)
+	mk.recordAudit(ctx, models.AuditAdd, table, user_id, entry_id, err == nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return entry_id, updatedAt, nil
+}
+
+// UpdateData updates existing data in the storage and refreshes the 'updated_at' field.
+// An entry of another user shared with the user is updated if the share permits it.
+// It returns models.ErrNotFound if the user has no such entry.
+func (mk *MemKeeper) UpdateData(ctx context.Context, table string, user_id int, entry_id string, data map[string]string) (time.Time, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	var updatedAt time.Time
+	owner, err := mk.writableEntry(table, user_id, entry_id)
+	if err == nil {
+		updatedAt, err = mk.updateData(table, owner, entry_id, data)
+	}
+	mk.recordAudit(ctx, models.AuditUpdate, table, user_id, entry_id, err == nil)
+
+	return updatedAt, err
+}
+
+// DeleteData marks data as deleted in the storage and updates the 'updated_at' field.
+// An entry of another user shared with the user is deleted if the share permits it.
+// It returns models.ErrNotFound if the user has no such entry.
+func (mk *MemKeeper) DeleteData(ctx context.Context, table string, user_id int, entry_id string) (time.Time, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	var updatedAt time.Time
+	owner, err := mk.writableEntry(table, user_id, entry_id)
+	if err == nil {
+		updatedAt, err = mk.deleteData(table, owner, entry_id)
+	}
+	mk.recordAudit(ctx, models.AuditDelete, table, user_id, entry_id, err == nil)
+
+	return updatedAt, err
+}
+
+// writableEntry returns the owner of the entry written by the user: the user, unless the entry of another user
+// is shared with them, or models.ErrReadOnlyShare if it is shared read-only. The caller must hold the lock.
+func (mk *MemKeeper) writableEntry(table string, userID int, entryID string) (int, error) {
+	s, ok := mk.shares[shareKey{userID, table, entryID}]
+	if !ok || s.revoked {
+		return userID, nil
+	}
+	if s.Permission != models.ShareWrite {
+		return 0, models.ErrReadOnlyShare
+	}
+
+	return s.OwnerID, nil
+}
+
+// ShareEntry shares the entry of the owner with the grantee, or changes the permission of its share.
+func (mk *MemKeeper) ShareEntry(ctx context.Context, share models.Share) (models.Share, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	err := mk.shareEntry(&share)
+	mk.addAuditEvent(ctx, models.AuditEvent{
+		UserID: share.OwnerID, Action: models.AuditShare, Table: share.Table, EntryID: share.EntryID,
+		Detail: strconv.Itoa(share.GranteeID), Success: err == nil,
+	})
+	if err != nil {
+		return models.Share{}, err
+	}
+
+	return share, nil
+}
+
+// shareEntry stores the share and sets its times, the caller must hold the lock.
+func (mk *MemKeeper) shareEntry(share *models.Share) error {
+	if err := share.Validate(); err != nil {
+		return err
+	}
+	if e := mk.entry(share.Table, share.OwnerID, share.EntryID); e == nil || e.deleted {
+		return models.ErrNotFound
+	}
+	if _, u := mk.userByID(share.GranteeID); u == nil {
+		return models.ErrNotFound
+	}
+
+	key := shareKey{share.GranteeID, share.Table, share.EntryID}
+	s, ok := mk.shares[key]
+	if !ok {
+		s = &memShare{revoked: true}
+		mk.shares[key] = s
+	}
+	mk.touchShare(s)
+	// A revoked share granted again is a new one
+	if s.revoked {
+		s.CreatedAt = s.UpdatedAt
+	}
+	s.OwnerID, s.GranteeID, s.Table, s.EntryID, s.Permission = share.OwnerID, share.GranteeID, share.Table, share.EntryID, share.Permission
+	s.revoked = false
+	*share = s.Share
+
+	return nil
+}
+
+// RevokeShare revokes the share of the entry of the owner with the grantee, or returns models.ErrNotFound.
+func (mk *MemKeeper) RevokeShare(ctx context.Context, owner_id, grantee_id int, table, entry_id string) error {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	s, ok := mk.shares[shareKey{grantee_id, table, entry_id}]
+	found := ok && !s.revoked && s.OwnerID == owner_id
+	mk.addAuditEvent(ctx, models.AuditEvent{
+		UserID: owner_id, Action: models.AuditRevokeShare, Table: table, EntryID: entry_id,
+		Detail: strconv.Itoa(grantee_id), Success: found,
+	})
+	if !found {
+		return models.ErrNotFound
+	}
+	mk.touchShare(s)
+	s.revoked = true
+
+	return nil
+}
+
+// GetSharedWithUser returns the entries shared with the user which changed since the given time.
+func (mk *MemKeeper) GetSharedWithUser(ctx context.Context, user_id int, since time.Time) ([]models.SharedEntry, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	shared := make([]models.SharedEntry, 0)
+	for key, s := range mk.shares {
+		if key.granteeID != user_id {
+			continue
+		}
+		entry := models.SharedEntry{Share: s.Share, Removed: s.revoked}
+		entry.Owner, _ = mk.userByID(s.OwnerID)
+		var e *memEntry
+		if !s.revoked {
+			e = mk.entry(s.Table, s.OwnerID, s.EntryID)
+			if e == nil || e.deleted {
+				entry.Removed = true
+			}
+			if e != nil && e.updatedAt.After(entry.UpdatedAt) {
+				entry.UpdatedAt = e.updatedAt
+			}
+		}
+		// The first sync has nothing to remove
+		if !entry.UpdatedAt.After(since) || (entry.Removed && since.IsZero()) {
+			continue
+		}
+		if !entry.Removed {
+			entry.Fields = e.row(s.EntryID)
+		}
+		shared = append(shared, entry)
+	}
+	sortShared(shared)
+
+	return shared, nil
+}
+
+// sortShared orders the shared entries by table and id.
+func sortShared(shared []models.SharedEntry) {
+	slices.SortFunc(shared, func(a, b models.SharedEntry) int {
+		if c := strings.Compare(a.Table, b.Table); c != 0 {
+			return c
+		}
+		return strings.Compare(a.EntryID, b.EntryID)
+	})
+}
+
+// touchShare moves the 'updated_at' of the share forward, even if the clock hasn't advanced.
+func (mk *MemKeeper) touchShare(s *memShare) {
+	now := mk.now()
+	if !now.After(s.UpdatedAt) {
+		now = s.UpdatedAt.Add(time.Microsecond)
+	}
+	s.UpdatedAt = now
+}
+
+// CreateFolder creates the folder of its user and returns it with its 'updated_at'.
+func (mk *MemKeeper) CreateFolder(ctx context.Context, folder models.Folder) (models.Folder, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	f, err := mk.createFolder(folder)
+	mk.recordAudit(ctx, models.AuditCreateFolder, "", folder.UserID, folder.ID, err == nil)
+
+	return f, err
+}
+
+// createFolder stores the new folder, the caller must hold the lock.
+func (mk *MemKeeper) createFolder(folder models.Folder) (models.Folder, error) {
+	folder, err := folder.Validate()
+	if err != nil {
+		return models.Folder{}, err
+	}
+	// The ids are unique across the users, as with the primary key in the database
+	if _, ok := mk.folders[folder.ID]; ok {
+		return models.Folder{}, fmt.Errorf("%w: the id is taken", models.ErrInvalidFolder)
+	}
+	if err := mk.checkFolder(folder); err != nil {
+		return models.Folder{}, err
+	}
+
+	f := &models.Folder{ID: folder.ID, UserID: folder.UserID, Name: folder.Name, ParentID: folder.ParentID}
+	mk.touchFolder(f)
+	mk.folders[f.ID] = f
+
+	return *f, nil
+}
+
+// UpdateFolder renames the folder of its user or moves it to another parent.
+func (mk *MemKeeper) UpdateFolder(ctx context.Context, folder models.Folder) (models.Folder, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	f, err := mk.updateFolder(folder)
+	mk.recordAudit(ctx, models.AuditUpdateFolder, "", folder.UserID, folder.ID, err == nil)
+
+	return f, err
+}
+
+// updateFolder changes the name and the parent of the folder, the caller must hold the lock.
+func (mk *MemKeeper) updateFolder(folder models.Folder) (models.Folder, error) {
+	folder, err := folder.Validate()
+	if err != nil {
+		return models.Folder{}, err
+	}
+	f := mk.folder(folder.UserID, folder.ID)
+	if f == nil {
+		return models.Folder{}, models.ErrNotFound
+	}
+	if err := mk.checkFolder(folder); err != nil {
+		return models.Folder{}, err
+	}
+
+	f.Name, f.ParentID = folder.Name, folder.ParentID
+	mk.touchFolder(f)
+
+	return *f, nil
+}
+
+// DeleteFolder deletes the folder of the user, moving what it holds to its parent if moveChildren is set.
+func (mk *MemKeeper) DeleteFolder(ctx context.Context, user_id int, folder_id string, moveChildren bool) (time.Time, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	updatedAt, err := mk.deleteFolder(user_id, folder_id, moveChildren)
+	mk.recordAudit(ctx, models.AuditDeleteFolder, "", user_id, folder_id, err == nil)
+
+	return updatedAt, err
+}
+
+// deleteFolder marks the folder as deleted, the caller must hold the lock.
+func (mk *MemKeeper) deleteFolder(userID int, folderID string, moveChildren bool) (time.Time, error) {
+	f := mk.folder(userID, folderID)
+	if f == nil {
+		return time.Time{}, models.ErrNotFound
+	}
+
+	var children []*models.Folder
+	for _, child := range mk.folders {
+		if child.UserID == userID && child.ParentID == folderID && !child.Deleted {
+			children = append(children, child)
+		}
+	}
+	// The deleted entries in the folder don't keep it, but move with the live ones
+	var entries []*memEntry
+	live := false
+	for _, table := range models.DataTables {
+		for _, e := range mk.tables[table] {
+			if e.userID == userID && e.fields[models.FolderField] == folderID {
+				entries = append(entries, e)
+				live = live || !e.deleted
+			}
+		}
+	}
+	if (len(children) > 0 || live) && !moveChildren {
+		return time.Time{}, models.ErrFolderNotEmpty
+	}
+	for _, child := range children {
+		if mk.folderNamed(userID, f.ParentID, child.Name, child.ID, folderID) {
+			return time.Time{}, fmt.Errorf("%w: %q is in the parent folder already", models.ErrFolderExists, child.Name)
+		}
+	}
+
+	for _, child := range children {
+		child.ParentID = f.ParentID
+		mk.touchFolder(child)
+	}
+	for _, e := range entries {
+		e.fields[models.FolderField] = f.ParentID
+		mk.touch(e)
+	}
+	f.Deleted = true
+	mk.touchFolder(f)
+
+	return f.UpdatedAt, nil
+}
+
+// GetFolders returns the folders of the user changed since the given time, or all the live ones.
+func (mk *MemKeeper) GetFolders(ctx context.Context, user_id int, since time.Time) ([]models.Folder, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	folders := make([]models.Folder, 0)
+	for _, f := range mk.folders {
+		if f.UserID != user_id || !f.UpdatedAt.After(since) || (f.Deleted && since.IsZero()) {
+			continue
+		}
+		folders = append(folders, *f)
+	}
+	slices.SortFunc(folders, func(a, b models.Folder) int {
+		if c := strings.Compare(models.FolderNameKey(a.Name), models.FolderNameKey(b.Name)); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	return folders, nil
+}
+
+// folder returns the live folder of the user or nil if there is none.
+func (mk *MemKeeper) folder(userID int, folderID string) *models.Folder {
+	f, ok := mk.folders[folderID]
+	if !ok || f.UserID != userID || f.Deleted {
+		return nil
+	}
+
+	return f
+}
+
+// entryFolder checks that the folder of an entry written by a client, as stored, is a live folder of the user.
+// An entry outside the folders passes. The caller must hold the lock.
+func (mk *MemKeeper) entryFolder(userID int, folderID string) error {
+	if folderID != "" && mk.folder(userID, folderID) == nil {
+		return fmt.Errorf("%w: %s isn't a folder of the user", models.ErrInvalidChange, models.FolderField)
+	}
+
+	return nil
+}
+
+// checkFolder checks that the parent of the folder is a folder of its user which isn't inside it, and that
+// the parent has no other folder with its name, the caller must hold the lock.
+func (mk *MemKeeper) checkFolder(folder models.Folder) error {
+	parentID := folder.ParentID
+	for depth := 0; parentID != ""; depth++ {
+		if parentID == folder.ID {
+			return fmt.Errorf("%w: a folder can't be moved inside itself", models.ErrInvalidFolder)
+		}
+		if depth == models.MaxFolderDepth {
+			return fmt.Errorf("%w: folders can't be nested more than %d deep", models.ErrInvalidFolder, models.MaxFolderDepth)
+		}
+		parent := mk.folder(folder.UserID, parentID)
+		if parent == nil {
+			return fmt.Errorf("%w: the parent folder doesn't exist", models.ErrInvalidFolder)
+		}
+		parentID = parent.ParentID
+	}
+	if mk.folderNamed(folder.UserID, folder.ParentID, folder.Name, folder.ID) {
+		return models.ErrFolderExists
+	}
+
+	return nil
+}
+
+// folderNamed reports whether the parent has a live folder of the user with the name, other than the excluded ones.
+func (mk *MemKeeper) folderNamed(userID int, parentID, name string, excluded ...string) bool {
+	key := models.FolderNameKey(name)
+	for _, f := range mk.folders {
+		if f.UserID == userID && f.ParentID == parentID && !f.Deleted && models.FolderNameKey(f.Name) == key &&
+			!slices.Contains(excluded, f.ID) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// touchFolder moves the 'updated_at' of the folder forward, even if the clock hasn't advanced.
+func (mk *MemKeeper) touchFolder(f *models.Folder) {
+	now := mk.now()
+	if !now.After(f.UpdatedAt) {
+		now = f.UpdatedAt.Add(time.Microsecond)
+	}
+	f.UpdatedAt = now
+}
+
+// UndeleteData restores data marked as deleted and updates the 'updated_at' field.
+// The deleted version of the entry is kept in the history. It returns models.ErrNotFound if the user has no such entry.
+func (mk *MemKeeper) UndeleteData(ctx context.Context, table string, user_id int, entry_id string) (time.Time, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	e := mk.entry(table, user_id, entry_id)
+	mk.recordAudit(ctx, models.AuditUndelete, table, user_id, entry_id, e != nil)
+	if e == nil {
+		return time.Time{}, models.ErrNotFound
+	}
+
+	mk.saveVersion(table, entry_id, e)
+
+	e.deleted = false
+	mk.touch(e)
+
+	return e.updatedAt, nil
+}
+
+// RenameTag renames the tag on all the entries of the user and returns the number of entries changed.
+// The entries are touched but no version is kept in the history, as in the database keeper.
+func (mk *MemKeeper) RenameTag(ctx context.Context, user_id int, from, to string) (int, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	renamed, err := mk.renameTag(user_id, from, to)
+	mk.recordAudit(ctx, models.AuditRenameTag, "", user_id, "", err == nil)
+
+	return renamed, err
+}
+
+// renameTag renames the tag on the entries of the user, the caller must hold the lock.
+func (mk *MemKeeper) renameTag(userID int, from, to string) (int, error) {
+	from, err := models.ParseTag(from)
+	if err != nil {
+		return 0, err
+	}
+	if to, err = models.ParseTag(to); err != nil {
+		return 0, err
+	}
+	if from == to {
+		return 0, nil
+	}
+
+	renamed := 0
+	for _, table := range models.DataTables {
+		for _, e := range mk.tables[table] {
+			if e.userID != userID {
+				continue
+			}
+			tags, found := models.RenameTag(strings.Split(e.fields[models.TagsField], ","), from, to)
+			if !found {
+				continue
+			}
+			e.fields[models.TagsField] = models.FormatTags(tags)
+			mk.touch(e)
+			renamed++
+		}
+	}
+
+	return renamed, nil
+}
+
+// ApplyChanges applies a batch of client changes atomically.
+// On failure the storage is restored to the state before the batch.
+func (mk *MemKeeper) ApplyChanges(ctx context.Context, user_id int, changes []models.Change) ([]models.ChangeResult, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	snapshot, history := mk.cloneTables(), mk.cloneHistory()
+
+	results := make([]models.ChangeResult, 0, len(changes))
+	for i, c := range changes {
+		status, updatedAt, err := mk.applyChange(user_id, c)
+		if err != nil {
+			mk.tables, mk.history = snapshot, history
+			for _, c := range changes {
+				mk.recordAudit(ctx, models.AuditAction(c.Op), c.Table, user_id, c.EntryID, false)
+			}
+			return nil, fmt.Errorf("change %d (%s %s/%s): %w", i, c.Op, c.Table, c.EntryID, err)
+		}
+
+		results = append(results, models.ChangeResult{
+			Table:     c.Table,
+			EntryID:   c.EntryID,
+			Status:    status,
+			UpdatedAt: updatedAt,
+		})
+	}
+	for i, r := range results {
+		// Nothing was written for an unchanged entry
+		if r.Status == models.ChangeUnchanged {
+			continue
+		}
+		mk.recordAudit(ctx, models.AuditAction(changes[i].Op), r.Table, user_id, r.EntryID, r.Status == models.ChangeApplied)
+	}
+
+	return results, nil
+}
+
+// Sync applies a batch of client changes and returns, in the same transaction, the entries and the folders of the user
+// changed since lastSync, the deleted ones too unless it is the first sync, with the server versions
+// of the conflicting changes.
+func (mk *MemKeeper) Sync(ctx context.Context, user_id int, lastSync time.Time, changes []models.Change) (models.SyncResult, error) {
+	var result models.SyncResult
+	err := mk.WithTx(ctx, func(tx Keeper) error {
+		results, err := tx.ApplyChanges(ctx, user_id, changes)
+		if err != nil {
+			return err
+		}
+		result = models.NewSyncResult(lastSync, results)
+
+		for i, r := range results {
+			if r.Status != models.ChangeConflict {
+				continue
+			}
+			server, err := tx.GetData(ctx, r.Table, user_id, r.EntryID, true)
+			if err != nil {
+				return err
+			}
+			result.Conflicts = append(result.Conflicts, models.SyncConflict{
+				Table: r.Table, EntryID: r.EntryID, Client: changes[i], Server: server,
+			})
+		}
+
+		for _, table := range models.DataTables {
+			rows, err := tx.GetAllData(ctx, table, user_id, models.DataQuery{LastSync: lastSync, InclDeleted: !lastSync.IsZero()})
+			if err != nil {
+				return err
+			}
+			result.Pull(table, rows)
+		}
+
+		shared, err := tx.GetSharedWithUser(ctx, user_id, lastSync)
+		if err != nil {
+			return err
+		}
+		result.PullShared(shared)
+
+		folders, err := tx.GetFolders(ctx, user_id, lastSync)
+		if err != nil {
+			return err
+		}
+		result.PullFolders(folders)
+
+		return nil
+	})
+	if err != nil {
+		return models.SyncResult{}, err
+	}
+
+	return result, nil
+}
+
+// GetDataHistory returns up to limit prior versions of an entry of the user, newest first.
+// A limit of 0 or less returns all retained versions.
+func (mk *MemKeeper) GetDataHistory(ctx context.Context, table string, user_id int, entry_id string, limit int) ([]models.EntryVersion, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	versions := mk.history[historyKey{table, user_id, entry_id}]
+
+	result := make([]models.EntryVersion, 0, len(versions))
+	for i := len(versions) - 1; i >= 0; i-- {
+		if limit > 0 && len(result) == limit {
+			break
+		}
+		result = append(result, models.EntryVersion{
+			Snapshot:  copyFields(versions[i].Snapshot),
+			ChangedAt: versions[i].ChangedAt,
+		})
+	}
+
+	return result, nil
+}
+
+// SearchData returns the entries of the user whose meta information contains every term of the query,
+// grouped by table. Terms are matched as case-insensitive substrings, like the SQLite keeper does.
+// The tables in memory can't fail one by one, so partial changes nothing.
+func (mk *MemKeeper) SearchData(ctx context.Context, user_id int, query string, tables []string, limit int, partial bool) (map[string][]map[string]string, error) {
+	terms := strings.Fields(strings.ToLower(query))
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("%w: the query is empty", models.ErrInvalidQuery)
+	}
+
+	if len(tables) == 0 {
+		tables = models.DataTables
+	}
+	for _, table := range tables {
+		if !models.IsDataTable(table) {
+			return nil, fmt.Errorf("%w: table %q can't be searched", models.ErrInvalidQuery, table)
+		}
+	}
+
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	results := make(map[string][]map[string]string)
+	now := mk.now()
+	for _, table := range tables {
+		var ids []string
+		for id, e := range mk.tables[table] {
+			text, _ := models.SearchText(models.SearchSource(e.fields))
+			if e.userID == user_id && !e.deleted && !e.expired(now) && containsAll(strings.ToLower(text), terms) {
+				ids = append(ids, id)
+			}
+		}
+
+		// Most recently updated first, as with the database keeper
+		rows := mk.tables[table]
+		sort.Slice(ids, func(i, j int) bool {
+			return rows[ids[i]].updatedAt.After(rows[ids[j]].updatedAt)
+		})
+		if limit > 0 && len(ids) > limit {
+			ids = ids[:limit]
+		}
+
+		for _, id := range ids {
+			results[table] = append(results[table], rows[id].row(id))
+		}
+	}
+
+	return results, nil
+}
+
+// PendingData estimates per data table what a synchronization of the user from the cursor would download,
+// the entries GetAllData selects for it with the sizes of their rows, the deleted ones as tombstones.
+// The tables in memory can't fail one by one, so partial changes nothing.
+func (mk *MemKeeper) PendingData(ctx context.Context, user_id int, since time.Time, partial bool) (map[string]models.PendingSize, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	results := make(map[string]models.PendingSize, len(models.DataTables))
+	now := mk.now()
+	for _, table := range models.DataTables {
+		var pending models.PendingSize
+		for id, e := range mk.tables[table] {
+			if e.userID != user_id || e.expired(now) || !e.updatedAt.After(since) || (since.IsZero() && e.deleted) {
+				continue
+			}
+			pending.Entries++
+			if e.deleted {
+				pending.Bytes += models.TombstoneSize
+			} else {
+				pending.Bytes += models.EntrySize(e.row(id))
+			}
+		}
+		results[table] = pending
+	}
+
+	return results, nil
+}
+
+// replicaIgnored are the fields of a replicated entry which aren't stored as fields: the identity of the entry,
+// its version kept apart, the warnings of the read on the primary and the URL of the contents of a file.
+var replicaIgnored = map[string]bool{"id": true, "user_id": true, "updated_at": true, "deleted": true, models.DataWarning: true, models.ContentURLField: true}
+
+// ReplicateData stores the entries of the table as read from the primary server of a replication, keeping their ids,
+// 'updated_at' and deleted flags. The entries already at their version are skipped, a version replaced
+// is kept in the history. On failure the storage is restored to the state before the batch.
+func (mk *MemKeeper) ReplicateData(ctx context.Context, table string, user_id int, rows []map[string]string) (int, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	snapshot, history := mk.cloneTables(), mk.cloneHistory()
+	replicated := 0
+	for _, row := range rows {
+		changed, err := mk.replicateEntry(table, user_id, row)
+		if err != nil {
+			mk.tables, mk.history = snapshot, history
+			mk.recordAudit(ctx, models.AuditReplicate, table, user_id, "", false)
+			return 0, fmt.Errorf("entry %s/%s: %w", table, row["id"], err)
+		}
+		if changed {
+			replicated++
+		}
+	}
+	mk.recordAudit(ctx, models.AuditReplicate, table, user_id, "", true)
+
+	return replicated, nil
+}
+
+// replicateEntry stores a replicated entry and reports whether it changed, the caller must hold the lock.
+func (mk *MemKeeper) replicateEntry(table string, userID int, row map[string]string) (bool, error) {
+	id := row["id"]
+	if id == "" {
+		return false, errors.New("entry_id must be specified")
+	}
+	updatedAt, err := time.Parse(time.RFC3339Nano, row["updated_at"])
+	if err != nil {
+		return false, fmt.Errorf("%w: invalid updated_at: %v", models.ErrInvalidChange, err)
+	}
+	updatedAt = updatedAt.UTC()
+	deleted, _ := strconv.ParseBool(row["deleted"])
+
+	fields, err := models.NormalizeFields(row)
+	if err != nil {
+		return false, err
+	}
+	for key, value := range fields {
+		// An empty field is a NULL column on the primary
+		if replicaIgnored[key] || value == "" {
+			delete(fields, key)
+			continue
+		}
+		if fields[key], err = normalizeField(table, key, value); err != nil {
+			return false, err
+		}
+	}
+
+	rows, ok := mk.tables[table]
+	if !ok {
+		rows = make(map[string]*memEntry)
+		mk.tables[table] = rows
+	}
+	e, ok := rows[id]
+	if ok && e.userID != userID {
+		// Entry ids are unique across all users, as with the primary key in the database
+		return false, fmt.Errorf("%w: the entry belongs to another user", models.ErrInvalidChange)
+	}
+	if ok && e.updatedAt.Equal(updatedAt) && e.deleted == deleted {
+		return false, nil
+	}
+	if ok {
+		mk.saveVersion(table, id, e)
+	}
+	rows[id] = &memEntry{userID: userID, fields: fields, deleted: deleted, updatedAt: updatedAt}
+
+	return true, nil
+}
+
+// GetUserDataVersion returns the version of the entries of the user across the data tables.
+func (mk *MemKeeper) GetUserDataVersion(ctx context.Context, user_id int) (models.DataVersion, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	var version models.DataVersion
+	now := mk.now()
+	for _, table := range models.DataTables {
+		for _, e := range mk.tables[table] {
+			if e.userID != user_id {
+				continue
+			}
+			version.Entries++
+			if e.expired(now) {
+				version.Expired++
+			}
+			if e.updatedAt.After(version.UpdatedAt) {
+				version.UpdatedAt = e.updatedAt
+			}
+		}
+	}
+
+	return version, nil
+}
+
+// GetData retrieves a single entry of the user from the storage.
+// It returns models.ErrNotFound if the user has no such entry, or it has expired and incl_expired is false.
+func (mk *MemKeeper) GetData(ctx context.Context, table string, user_id int, entry_id string, incl_expired bool) (map[string]string, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	e := mk.entry(table, user_id, entry_id)
+	if e == nil || (!incl_expired && e.expired(mk.now())) {
+		return nil, models.ErrNotFound
+	}
+
+	return e.row(entry_id), nil
+}
+
+// GetAllData retrieves the data of the user selected by the query from the storage.
+func (mk *MemKeeper) GetAllData(ctx context.Context, table string, user_id int, q models.DataQuery) ([]map[string]string, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	available := mk.columns(table)
+	filter, err := q.Filter.Validate(available)
+	if err != nil {
+		return nil, err
+	}
+	order, err := q.OrderBy.Validate(available)
+	if err != nil {
+		return nil, err
+	}
+	cols, err := models.ProjectColumns(available, q.Columns)
+	if err != nil {
+		return nil, err
+	}
+	projected := len(q.Columns) > 0
+
+	tag := models.NormalizeTag(q.Tag)
+	folderID := q.Folder
+	if folderID == models.RootFolder {
+		folderID = ""
+	}
+	now := mk.now()
+
+	var data []map[string]string
+	for id, e := range mk.tables[table] {
+		if e.userID != user_id {
+			continue
+		}
+		if !q.InclDeleted && e.deleted {
+			continue
+		}
+		if !q.InclExpired && e.expired(now) {
+			continue
+		}
+		if !q.LastSync.IsZero() && !e.updatedAt.After(q.LastSync) {
+			continue
+		}
+		if tag != "" && !hasTag(e.fields[models.TagsField], tag) {
+			continue
+		}
+		if q.Folder != "" && e.fields[models.FolderField] != folderID {
+			continue
+		}
+
+		row := e.row(id)
+		if !matchFilter(row, filter) {
+			continue
+		}
+		data = append(data, row)
+	}
+
+	sortRows(data, order)
+	if projected {
+		for i, row := range data {
+			data[i] = projectRow(row, cols)
+		}
+	}
+
+	return data, nil
+}
+
+// ExportData calls fn with each entry of the user in the table which isn't deleted, by id.
+// The entries are copied under the lock first, so fn may use the keeper.
+func (mk *MemKeeper) ExportData(ctx context.Context, table string, user_id int, fn func(entry map[string]string) error) error {
+	data, err := mk.GetAllData(ctx, table, user_id, models.DataQuery{InclExpired: true, OrderBy: models.Order{Column: "id"}})
+	if err != nil {
+		return err
+	}
+
+	for _, row := range data {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sortRows sorts the rows by the validated order, missing values last and the id as the tiebreaker.
+func sortRows(rows []map[string]string, o models.Order) {
+	sort.Slice(rows, func(i, j int) bool {
+		a, aok := orderValue(rows[i], o.Column)
+		b, bok := orderValue(rows[j], o.Column)
+		if aok != bok {
+			return aok
+		}
+
+		cmp := 0
+		if aok {
+			cmp = compareValues(o.Column, a, b)
+		}
+		if cmp == 0 {
+			cmp = strings.Compare(rows[i]["id"], rows[j]["id"])
+		}
+		if o.Desc {
+			return cmp > 0
+		}
+		return cmp < 0
+	})
+}
+
+// orderValue returns the value of the column in the row and false if it is NULL in the database,
+// which is a missing field or an empty timestamp.
+func orderValue(row map[string]string, column string) (string, bool) {
+	v, ok := row[column]
+	if models.IsTimeColumn(column) && v == "" {
+		return "", false
+	}
+
+	return v, ok
+}
+
+// compareValues compares two values of the column as the database compares them.
+func compareValues(column, a, b string) int {
+	switch {
+	case column == "deleted":
+		x, _ := strconv.ParseBool(a)
+		y, _ := strconv.ParseBool(b)
+		switch {
+		case x == y:
+			return 0
+		case y:
+			return -1
+		}
+		return 1
+	case models.IsTimeColumn(column):
+		x, _ := time.Parse(time.RFC3339Nano, a)
+		y, _ := time.Parse(time.RFC3339Nano, b)
+		return x.Compare(y)
+	}
+
+	return strings.Compare(a, b)
+}
+
+// memColumns are the columns every data table has, whether or not an entry sets them.
+var memColumns = []string{"id", "user_id", "deleted", "updated_at", "meta_info",
+	models.TagsField, models.FolderField, models.ExpiresAtField, models.ClientCreatedAt, models.ClientModifiedAt}
+
+// columns returns the known columns of the table: the common ones and every field
+// stored in its entries, the caller must hold the lock.
+func (mk *MemKeeper) columns(table string) []string {
+	cols := append([]string(nil), memColumns...)
+	if table == models.PreviewTable {
+		cols = append(cols, models.PreviewField)
+	}
+	known := make(map[string]bool, len(cols))
+	for _, col := range cols {
+		known[col] = true
+	}
+
+	var extra []string
+	for _, e := range mk.tables[table] {
+		for key := range e.fields {
+			if !known[key] {
+				known[key] = true
+				extra = append(extra, key)
+			}
+		}
+	}
+	sort.Strings(extra)
+
+	return append(cols, extra...)
+}
+
+// matchFilter reports whether the row matches all conditions of the validated filter.
+// A missing field matches no condition, like NULL in SQL.
+func matchFilter(row map[string]string, f models.Filter) bool {
+	for _, c := range f {
+		v, ok := row[c.Column]
+		if !ok || !matchCondition(c, v) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchCondition reports whether the value of a field matches the condition.
+func matchCondition(c models.Condition, v string) bool {
+	if c.Op == models.FilterILike {
+		return likeMatch(v, c.Value)
+	}
+
+	if _, ok := orderValue(map[string]string{c.Column: v}, c.Column); !ok {
+		return false
+	}
+	cmp := compareValues(c.Column, v, c.Value)
+
+	switch c.Op {
+	case models.FilterEq:
+		return cmp == 0
+	case models.FilterNe:
+		return cmp != 0
+	case models.FilterGt:
+		return cmp > 0
+	case models.FilterLt:
+		return cmp < 0
+	}
+
+	return false
+}
+
+// likeMatch reports whether the value matches the LIKE pattern ignoring the case,
+// % matches any sequence of characters and _ a single one.
+func likeMatch(v, pattern string) bool {
+	var re strings.Builder
+	re.WriteString("(?is)^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			re.WriteString(".*")
+		case '_':
+			re.WriteString(".")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	re.WriteString("$")
+
+	return regexp.MustCompile(re.String()).MatchString(v)
+}
+
+// projectRow returns the fields of the row which are in the columns.
+func projectRow(row map[string]string, cols []string) map[string]string {
+	projected := make(map[string]string, len(cols))
+	for _, col := range cols {
+		if v, ok := row[col]; ok {
+			projected[col] = v
+		}
+	}
+
+	return projected
+}
+
+// ExpireData marks the entries whose expires_at has passed as deleted and returns their number.
+func (mk *MemKeeper) ExpireData(ctx context.Context) (int, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	expired := mk.expiredEntries()
+	for _, sel := range expired {
+		sel.entry.deleted = true
+		mk.touch(sel.entry)
+	}
+
+	return len(expired), nil
+}
+
+// PreviewExpiry returns the number of the entries ExpireData would delete
+// and up to sample of their identifiers, without changing anything.
+func (mk *MemKeeper) PreviewExpiry(ctx context.Context, sample int) (models.JobPreview, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	expired := mk.expiredEntries()
+	preview := models.JobPreview{Count: len(expired), Sample: make([]string, 0)}
+	for _, sel := range expired[:min(sample, len(expired))] {
+		preview.Sample = append(preview.Sample, sel.table+"/"+sel.id)
+	}
+
+	return preview, nil
+}
+
+// selectedEntry is an entry selected by a background job.
+type selectedEntry struct {
+	table, id string
+	entry     *memEntry
+}
+
+// expiredEntries selects the live entries whose expires_at has passed, ordered by table and id.
+// ExpireData and its dry run share it, the caller must hold the lock.
+func (mk *MemKeeper) expiredEntries() []selectedEntry {
+	var expired []selectedEntry
+	now := mk.now()
+	for _, table := range models.DataTables {
+		var ids []string
+		for id, e := range mk.tables[table] {
+			if !e.deleted && e.expired(now) {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			expired = append(expired, selectedEntry{table: table, id: id, entry: mk.tables[table][id]})
+		}
+	}
+
+	return expired
+}
+
+// AddAuditEvent records an event in the audit log, with the client carried by the context if the event names none.
+func (mk *MemKeeper) AddAuditEvent(ctx context.Context, ev models.AuditEvent) error {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	mk.addAuditEvent(ctx, ev)
+
+	return nil
+}
+
+// GetAuditEvents returns up to limit audit events of the user recorded since the given time,
+// newest first. A limit of 0 or less returns all of them.
+func (mk *MemKeeper) GetAuditEvents(ctx context.Context, user_id int, since time.Time, limit int) ([]models.AuditEvent, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	events := make([]models.AuditEvent, 0)
+	for i := len(mk.audit) - 1; i >= 0; i-- {
+		if limit > 0 && len(events) == limit {
+			break
+		}
+		if ev := mk.audit[i]; ev.UserID == user_id && !ev.CreatedAt.Before(since) {
+			events = append(events, ev)
+		}
+	}
+
+	return events, nil
+}
+
+// PruneAuditEvents deletes the audit events recorded before the given time and returns their number.
+func (mk *MemKeeper) PruneAuditEvents(ctx context.Context, before time.Time) (int, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	kept := mk.audit[:0]
+	for _, ev := range mk.audit {
+		if !pruned(ev, before) {
+			kept = append(kept, ev)
+		}
+	}
+	n := len(mk.audit) - len(kept)
+	mk.audit = kept
+
+	return n, nil
+}
+
+// PreviewAuditPruning returns the number of the audit events PruneAuditEvents would delete
+// and up to sample of their identifiers, without changing anything.
+func (mk *MemKeeper) PreviewAuditPruning(ctx context.Context, before time.Time, sample int) (models.JobPreview, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	preview := models.JobPreview{Sample: make([]string, 0)}
+	for _, ev := range mk.audit {
+		if !pruned(ev, before) {
+			continue
+		}
+		preview.Count++
+		if len(preview.Sample) < sample {
+			preview.Sample = append(preview.Sample, "audit_log/"+strconv.Itoa(ev.ID))
+		}
+	}
+
+	return preview, nil
+}
+
+// pruned reports whether PruneAuditEvents deletes the event, its dry run shares it.
+func pruned(ev models.AuditEvent, before time.Time) bool {
+	return ev.CreatedAt.Before(before)
+}
+
+// RotationStatus returns models.ErrNotFound, the memory keeper doesn't encrypt the entries.
+func (mk *MemKeeper) RotationStatus(ctx context.Context) (models.RotationStatus, error) {
+	return models.RotationStatus{}, models.ErrNotFound
+}
+
+// StoreRefreshToken stores a refresh token issued to a device of a user.
+func (mk *MemKeeper) StoreRefreshToken(ctx context.Context, tok models.RefreshToken) error {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	if _, ok := mk.tokens[tok.Hash]; ok {
+		return ErrConflict
+	}
+	tok.ExpiresAt = tok.ExpiresAt.UTC()
+	if tok.ProtocolVersion == 0 {
+		tok.ProtocolVersion = models.ProtocolV1
+	}
+	mk.tokens[tok.Hash] = tok
+
+	return nil
+}
+
+// GetRefreshToken returns the refresh token with the given hash, revoked or not, or models.ErrNotFound.
+func (mk *MemKeeper) GetRefreshToken(ctx context.Context, hash string) (models.RefreshToken, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	tok, ok := mk.tokens[hash]
+	if !ok {
+		return models.RefreshToken{}, models.ErrNotFound
+	}
+
+	return tok, nil
+}
+
+// RevokeRefreshToken revokes the refresh token with the given hash and reports whether this call revoked it.
+func (mk *MemKeeper) RevokeRefreshToken(ctx context.Context, hash string) (bool, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	tok, ok := mk.tokens[hash]
+	if !ok || tok.Revoked {
+		return false, nil
+	}
+	tok.Revoked = true
+	mk.tokens[hash] = tok
+
+	return true, nil
+}
+
+// RevokeRefreshTokenFamily revokes all the refresh tokens of the family.
+func (mk *MemKeeper) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	for hash, tok := range mk.tokens {
+		if tok.FamilyID == familyID {
+			tok.Revoked = true
+			mk.tokens[hash] = tok
+		}
+	}
+
+	return nil
+}
+
+// RevokeToken revokes the access token with the JWT ID until it expires at expiresAt, the zero time
+// for a token which doesn't expire. Revoking a token twice keeps the first revocation.
+func (mk *MemKeeper) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	if _, ok := mk.revoked[jti]; !ok {
+		mk.revoked[jti] = expiresAt
+	}
+
+	return nil
+}
+
+// IsTokenRevoked reports whether the access token with the JWT ID is revoked.
+func (mk *MemKeeper) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	mk.mu.RLock()
+	defer mk.mu.RUnlock()
+
+	_, ok := mk.revoked[jti]
+	return ok, nil
+}
+
+// PruneRevokedTokens deletes the revocations of the tokens expired before the given time and returns their number.
+func (mk *MemKeeper) PruneRevokedTokens(ctx context.Context, before time.Time) (int, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	n := 0
+	for jti, expiresAt := range mk.revoked {
+		if !expiresAt.IsZero() && expiresAt.Before(before) {
+			delete(mk.revoked, jti)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// Ping always succeeds for the in-memory storage.
+func (mk *MemKeeper) Ping() bool {
+	return true
+}
+
+// Close always succeeds for the in-memory storage.
+func (mk *MemKeeper) Close() bool {
+	return true
+}
+
+// WithTx runs fn with a view of the keeper, undoing the changes made through it
+// if fn returns an error or panics. Transactions run one at a time, but calls made
+// outside of them aren't isolated from a running one and are undone along with it.
+func (mk *MemKeeper) WithTx(ctx context.Context, fn func(tx Keeper) error) error {
+	mk.txMu.Lock()
+	defer mk.txMu.Unlock()
+
+	tx := &memTx{MemKeeper: mk}
+	return mk.undoOnFailure(func() error { return fn(tx) })
+}
+
+// WithSnapshot runs fn with a view of the keeper. Waiting for the running transaction
+// to finish, it doesn't see its changes unless they are committed.
+func (mk *MemKeeper) WithSnapshot(ctx context.Context, fn func(tx Keeper) error) error {
+	mk.txMu.Lock()
+	defer mk.txMu.Unlock()
+
+	return fn(&memTx{MemKeeper: mk})
+}
+
+// memTx is the view of a MemKeeper handed to the function of WithTx.
+type memTx struct {
+	*MemKeeper
+}
+
+// WithTx runs fn with the same view, undoing only the changes made by fn on failure,
+// like a savepoint of the outer transaction.
+func (tx *memTx) WithTx(ctx context.Context, fn func(tx Keeper) error) error {
+	return tx.undoOnFailure(func() error { return fn(tx) })
+}
+
+// WithSnapshot runs fn with the same view.
+func (tx *memTx) WithSnapshot(ctx context.Context, fn func(tx Keeper) error) error {
+	return fn(tx)
+}
+
+// Close does nothing for a transaction view, which doesn't own the storage, and returns false.
+func (tx *memTx) Close() bool {
+	return false
+}
+
+// memState is a copy of the contents of a MemKeeper.
+type memState struct {
+	users   map[string]*memUser
+	tables  map[string]map[string]*memEntry
+	history map[historyKey][]models.EntryVersion
+	tokens  map[string]models.RefreshToken
+	lastID  int
+}
+
+// undoOnFailure runs fn and restores the contents of the storage if it returns an error or panics.
+func (mk *MemKeeper) undoOnFailure(fn func() error) error {
+	mk.mu.RLock()
+	state := memState{users: mk.cloneUsers(), tables: mk.cloneTables(), history: mk.cloneHistory(), tokens: maps.Clone(mk.tokens), lastID: mk.lastID}
+	events := len(mk.audit)
+	mk.mu.RUnlock()
+
+	// The audit events are kept, those of the undone changes as failed
+	restore := func() {
+		mk.mu.Lock()
+		mk.users, mk.tables, mk.history, mk.tokens, mk.lastID = state.users, state.tables, state.history, state.tokens, state.lastID
+		for i := events; i < len(mk.audit); i++ {
+			mk.audit[i].Success = false
+		}
+		mk.mu.Unlock()
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			restore()
+			panic(p)
+		}
+	}()
+
+	if err := fn(); err != nil {
+		restore()
+		return err
+	}
+
+	return nil
+}
+
+// addData adds data to the storage, the caller must hold the lock.
+func (mk *MemKeeper) addData(table string, userID int, entryID string, data map[string]string) (time.Time, error) {
+	// Only the data tables are created on the first entry, as only they exist in the database
+	if !models.IsDataTable(table) {
+		return time.Time{}, fmt.Errorf("%w: unknown table %q", models.ErrInvalidQuery, table)
+	}
+	rows, ok := mk.tables[table]
+	if !ok {
+		rows = make(map[string]*memEntry)
+		mk.tables[table] = rows
+	}
+
+	// Entry ids are unique across all users, as with the primary key in the database
+	if _, ok := rows[entryID]; ok {
+		return time.Time{}, ErrConflict
+	}
+
+	fields, err := models.NormalizeFields(data)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := models.CheckServerFields(fields); err != nil {
+		return time.Time{}, err
+	}
+	if err := models.DeriveSshFields(table, fields); err != nil {
+		return time.Time{}, err
+	}
+	for key, value := range fields {
+		normalized, err := normalizeField(table, key, value)
+		if err != nil {
+			return time.Time{}, err
+		}
+		fields[key] = normalized
+	}
+	if err := mk.entryFolder(userID, fields[models.FolderField]); err != nil {
+		return time.Time{}, err
+	}
+
+	// The timestamp is always assigned by the storage
+	e := &memEntry{
+		userID:    userID,
+		fields:    fields,
+		updatedAt: mk.now(),
+	}
+	rows[entryID] = e
+
+	return e.updatedAt, nil
+}
+
+// updateData updates existing data in the storage, or returns models.ErrNotFound, the caller must hold the lock.
+func (mk *MemKeeper) updateData(table string, userID int, entryID string, data map[string]string) (time.Time, error) {
+	e := mk.entry(table, userID, entryID)
+	if e == nil {
+		return time.Time{}, models.ErrNotFound
+	}
+
+	fields, err := updateFields(table, data)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := mk.entryFolder(userID, fields[models.FolderField]); err != nil {
+		return time.Time{}, err
+	}
+
+	mk.saveVersion(table, entryID, e)
+
+	// A new expiry revives an entry deleted because the previous one passed
+	if _, ok := fields[models.ExpiresAtField]; ok && e.expired(mk.now()) {
+		e.deleted = false
+	}
+
+	for key, value := range fields {
+		e.fields[key] = value
+	}
+	mk.touch(e)
+
+	return e.updatedAt, nil
+}
+
+// updateFields returns the fields of an update of an entry of the table as they are stored.
+// The display timestamps are kept as created, so they are left out.
+func updateFields(table string, data map[string]string) (map[string]string, error) {
+	data, err := models.NormalizeFields(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := models.CheckServerFields(data); err != nil {
+		return nil, err
+	}
+	if err := models.DeriveSshFields(table, data); err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]string, len(data))
+	for key, value := range data {
+		if models.IsClientTimeField(key) {
+			continue
+		}
+		normalized, err := normalizeField(table, key, value)
+		if err != nil {
+			return nil, err
+		}
+		fields[key] = normalized
+	}
+
+	return fields, nil
+}
+
+// unchangedUpdate reports whether the update would store the fields the entry already has.
+// An update without fields touches the entry, and one of a deleted entry or which the write
+// rejects is applied as before. The caller must hold the lock.
+func unchangedUpdate(table string, e *memEntry, data map[string]string) bool {
+	if len(data) == 0 || e.deleted {
+		return false
+	}
+	fields, err := updateFields(table, data)
+	if err != nil {
+		return false
+	}
+	for key, value := range fields {
+		if e.fields[key] != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// normalizeField validates the value of an entry field of the table sent by a client and returns it as stored.
+func normalizeField(table, key, value string) (string, error) {
+	switch {
+	case key == models.TagsField:
+		tags, err := models.ParseTags(value)
+		if err != nil {
+			return "", err
+		}
+		return models.FormatTags(tags), nil
+	case models.IsClientTimeField(key):
+		return models.NormalizeClientTime(key, value, time.Now())
+	case key == models.ExpiresAtField:
+		expiresAt, err := models.ParseExpiresAt(value)
+		if err != nil || expiresAt.IsZero() {
+			return "", err
+		}
+		return expiresAt.Format(time.RFC3339Nano), nil
+	case key == models.PreviewField:
+		return models.ParsePreview(table, value)
+	case key == models.FolderField:
+		return models.ParseFolderID(value)
+	case models.IsOtpField(table, key):
+		return models.ParseOtpField(key, value)
+	}
+
+	return value, nil
+}
+
+// expired reports whether the expires_at field of the entry has passed.
+func (e *memEntry) expired(now time.Time) bool {
+	expiresAt, err := time.Parse(time.RFC3339Nano, e.fields[models.ExpiresAtField])
+	return err == nil && !expiresAt.After(now)
+}
+
+// deleteData marks data as deleted in the storage, or returns models.ErrNotFound, the caller must hold the lock.
+func (mk *MemKeeper) deleteData(table string, userID int, entryID string) (time.Time, error) {
+	// Check user_id and table
+	if userID == 0 || table == "" {
+		return time.Time{}, errors.New("user_id and table must be specified")
+	}
+
+	// Check entry_id
+	if entryID == "" {
+		return time.Time{}, errors.New("entry_id must be specified")
+	}
+
+	e := mk.entry(table, userID, entryID)
+	if e == nil {
+		return time.Time{}, models.ErrNotFound
+	}
+
+	mk.saveVersion(table, entryID, e)
+
+	e.deleted = true
+	mk.touch(e)
+
+	return e.updatedAt, nil
+}
+
+// applyChange applies a single change, the caller must hold the lock.
+// It returns the status of the change and the resulting 'updated_at' value of the entry.
+func (mk *MemKeeper) applyChange(userID int, c models.Change) (models.ChangeStatus, time.Time, error) {
+	if c.Table == "" || c.EntryID == "" {
+		return "", time.Time{}, fmt.Errorf("%w: table and entry_id must be specified", models.ErrInvalidChange)
+	}
+	if err := models.CheckServerFields(c.Fields); err != nil {
+		return "", time.Time{}, err
+	}
+
+	switch c.Op {
+	case models.ChangeAdd:
+		updatedAt, err := mk.addData(c.Table, userID, c.EntryID, c.Fields)
+		return models.ChangeApplied, updatedAt, err
+	case models.ChangeUpdate, models.ChangeDelete:
+	default:
+		return "", time.Time{}, fmt.Errorf("%w: unknown operation %q", models.ErrInvalidChange, c.Op)
+	}
+
+	e := mk.entry(c.Table, userID, c.EntryID)
+	if e == nil {
+		return models.ChangeNotFound, time.Time{}, nil
+	}
+	// A client resending an entry as it is gets the version it already has, whatever version it sends
+	if c.Op == models.ChangeUpdate && unchangedUpdate(c.Table, e, c.Fields) {
+		return models.ChangeUnchanged, e.updatedAt, nil
+	}
+	if e.updatedAt.After(c.UpdatedAt) {
+		return models.ChangeConflict, e.updatedAt, nil
+	}
+
+	if c.Op == models.ChangeUpdate {
+		updatedAt, err := mk.updateData(c.Table, userID, c.EntryID, c.Fields)
+		return models.ChangeApplied, updatedAt, err
+	}
+
+	updatedAt, err := mk.deleteData(c.Table, userID, c.EntryID)
+	return models.ChangeApplied, updatedAt, err
+}
+
+// saveVersion stores the current state of an entry in the history before it is changed
+// and prunes the versions above the limit, the caller must hold the lock.
+func (mk *MemKeeper) saveVersion(table string, entryID string, e *memEntry) {
+	if mk.historyLimit <= 0 {
+		return
+	}
+
+	key := historyKey{table, e.userID, entryID}
+	versions := append(mk.history[key], models.EntryVersion{
+		Snapshot:  e.row(entryID),
+		ChangedAt: mk.now(),
+	})
+	if len(versions) > mk.historyLimit {
+		versions = versions[len(versions)-mk.historyLimit:]
+	}
+	mk.history[key] = versions
+}
+
+// recordAudit records a data change of a user in the audit log, the caller must hold the lock.
+func (mk *MemKeeper) recordAudit(ctx context.Context, action models.AuditAction, table string, userID int, entryID string, success bool) {
+	mk.addAuditEvent(ctx, models.AuditEvent{
+		UserID:  userID,
+		Action:  action,
+		Table:   table,
+		EntryID: entryID,
+		Success: success,
+	})
+}
+
+// addAuditEvent adds the event to the audit log, the caller must hold the lock.
+func (mk *MemKeeper) addAuditEvent(ctx context.Context, ev models.AuditEvent) {
+	if ev.RemoteAddr == "" && ev.UserAgent == "" {
+		c := models.ClientFrom(ctx)
+		ev.RemoteAddr, ev.UserAgent = c.RemoteAddr, c.UserAgent
+	}
+	mk.lastAuditID++
+	ev.ID, ev.CreatedAt = mk.lastAuditID, mk.now()
+	mk.audit = append(mk.audit, ev)
+}
+
+// touch moves the 'updated_at' field of the entry forward, even if the clock hasn't advanced.
+func (mk *MemKeeper) touch(e *memEntry) {
+	now := mk.now()
+	if !now.After(e.updatedAt) {
+		now = e.updatedAt.Add(time.Microsecond)
+	}
+	e.updatedAt = now
+}
+
+// row returns the entry as seen by a client.
+func (e *memEntry) row(id string) map[string]string {
+	row := copyFields(e.fields)
+	row["id"] = id
+	row["user_id"] = strconv.Itoa(e.userID)
+	row["deleted"] = strconv.FormatBool(e.deleted)
+	row["updated_at"] = e.updatedAt.Format(time.RFC3339Nano)
+
+	return row
+}
+
+// entry returns the entry owned by the user or nil if there is none.
+func (mk *MemKeeper) entry(table string, userID int, entryID string) *memEntry {
+	e, ok := mk.tables[table][entryID]
+	if !ok || e.userID != userID {
+		return nil
+	}
+
+	return e
+}
+
+// cloneTables returns a deep copy of the data tables, the caller must hold the lock.
+func (mk *MemKeeper) cloneTables() map[string]map[string]*memEntry {
+	tables := make(map[string]map[string]*memEntry, len(mk.tables))
+	for name, rows := range mk.tables {
+		clone := make(map[string]*memEntry, len(rows))
+		for id, e := range rows {
+			c := *e
+			c.fields = copyFields(e.fields)
+			clone[id] = &c
+		}
+		tables[name] = clone
+	}
+
+	return tables
+}
+
+// cloneUsers returns a copy of the users, the caller must hold the lock.
+func (mk *MemKeeper) cloneUsers() map[string]*memUser {
+	users := make(map[string]*memUser, len(mk.users))
+	for name, u := range mk.users {
+		c := *u
+		users[name] = &c
+	}
+
+	return users
+}
+
+// cloneHistory returns a copy of the entry history, the caller must hold the lock.
+// Versions are never modified in place, so copying the slices is enough.
+func (mk *MemKeeper) cloneHistory() map[historyKey][]models.EntryVersion {
+	history := make(map[historyKey][]models.EntryVersion, len(mk.history))
+	for key, versions := range mk.history {
+		history[key] = append([]models.EntryVersion(nil), versions...)
+	}
+
+	return history
+}
+
+// containsAll reports whether s contains every term.
+func containsAll(s string, terms []string) bool {
+	for _, term := range terms {
+		if !strings.Contains(s, term) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// copyFields returns a copy of the data map.
+func copyFields(data map[string]string) map[string]string {
+	fields := make(map[string]string, len(data))
+	for key, value := range data {
+		fields[key] = value
+	}
+
+	return fields
+}
+
+// hasTag reports whether the comma-separated tags contain the tag.
+func hasTag(tags, tag string) bool {
+	for _, t := range strings.Split(tags, ",") {
+		if t == tag {
+			return true
+		}
+	}
+
+	return false
+}
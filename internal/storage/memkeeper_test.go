@@ -0,0 +1,14 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/wurt83ow/gophkeeper-server/internal/storage"
+	"github.com/wurt83ow/gophkeeper-server/internal/storage/storagetest"
+)
+
+func TestMemKeeper(t *testing.T) {
+	storagetest.RunKeeperTests(t, func(t *testing.T) storage.Keeper {
+		return storage.NewMemKeeper()
+	})
+}
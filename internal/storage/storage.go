@@ -6,6 +6,7 @@ import (
 	"errors"
 	"time"
 
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
 	"go.uber.org/zap/zapcore"
 )
 
@@ -27,20 +28,219 @@ type MemoryStorage struct {
 type Keeper interface {
 	// UserExists checks if a user exists.
 	UserExists(ctx context.Context, username string) (bool, error)
+	// UsernameTaken reports whether a user has the username or a lookalike of it, see models.UsernameSkeleton.
+	UsernameTaken(ctx context.Context, username string) (bool, error)
 	// AddUser adds a new user to the storage.
 	AddUser(ctx context.Context, username string, hashedPassword string) error
 	// GetPassword retrieves the password for the given username.
 	GetPassword(ctx context.Context, username string) (string, error)
 	// GetUserID retrieves the user ID for the given username.
 	GetUserID(ctx context.Context, username string) (int, error)
-	// AddData adds data to the storage.
-	AddData(ctx context.Context, table string, user_id int, entry_id string, data map[string]string) error
-	// UpdateData updates existing data in the storage.
-	UpdateData(ctx context.Context, table string, user_id int, entry_id string, data map[string]string) error
-	// DeleteData deletes data from the storage.
-	DeleteData(ctx context.Context, table string, user_id int, entry_id string) error
-	// GetAllData retrieves all data from the storage.
-	GetAllData(ctx context.Context, table string, user_id int, last_sync time.Time, incl_del bool) ([]map[string]string, error)
+	// UpdatePassword replaces the hashed password of a user and revokes all their refresh tokens atomically,
+	// or returns models.ErrNotFound.
+	UpdatePassword(ctx context.Context, user_id int, hashedPassword string) error
+	// RehashPassword replaces the hashed password of a user with another hash of the same password
+	// if it is still oldHash, without ending the sessions. It reports whether it was replaced.
+	RehashPassword(ctx context.Context, user_id int, oldHash, newHash string) (bool, error)
+	// RecordFailedLogin counts a failed login of the account, locks it once its consecutive failures
+	// reach maxFailures and returns the end of the lockout, or models.ErrNotFound.
+	RecordFailedLogin(ctx context.Context, username string, maxFailures int) (time.Time, error)
+	// ResetFailedLogins clears the failed logins of the account after a successful one.
+	ResetFailedLogins(ctx context.Context, username string) error
+	// IsLocked reports whether the account is locked and until when.
+	IsLocked(ctx context.Context, username string) (bool, time.Time, error)
+	// RecordLogin adds a login attempt to the login history of its user, a successful one also becomes
+	// their last login. The history keeps the last keep attempts of the user, 0 or less keeps all.
+	RecordLogin(ctx context.Context, ev models.LoginEvent, keep int) error
+	// GetLoginHistory returns up to limit login attempts of the user, newest first.
+	GetLoginHistory(ctx context.Context, user_id int, limit int) ([]models.LoginEvent, error)
+	// GetUserAccess returns the role of the user, whether their account is disabled and the last change of their password.
+	GetUserAccess(ctx context.Context, user_id int) (models.UserAccess, error)
+	// ListUsers returns up to limit users with an id greater than afterID, by id, with their usage.
+	ListUsers(ctx context.Context, afterID int, limit int) ([]models.UserSummary, error)
+	// SetUserDisabled disables or enables the account of the user, disabling it revokes their refresh tokens.
+	SetUserDisabled(ctx context.Context, user_id int, disabled bool) error
+	// DeleteUser deletes the account of the user with all of their data.
+	DeleteUser(ctx context.Context, user_id int) error
+	// CreateAPIKey stores an API key created by a user and returns it with its id and its creation time.
+	CreateAPIKey(ctx context.Context, key models.APIKey) (models.APIKey, error)
+	// GetAPIKeyByHash returns the API key with the given hash, expired or not, or models.ErrNotFound.
+	GetAPIKeyByHash(ctx context.Context, hash string) (models.APIKey, error)
+	// ListAPIKeys returns the API keys of the user, oldest first.
+	ListAPIKeys(ctx context.Context, user_id int) ([]models.APIKey, error)
+	// TouchAPIKey sets the last use of the API key to now.
+	TouchAPIKey(ctx context.Context, id int) error
+	// RevokeAPIKey deletes the API key of the user, or returns models.ErrNotFound.
+	RevokeAPIKey(ctx context.Context, user_id int, id int) error
+	// CreateMonitorToken stores a monitor token created by an admin and returns it with its id and its creation time.
+	CreateMonitorToken(ctx context.Context, token models.MonitorToken) (models.MonitorToken, error)
+	// GetMonitorTokenByHash returns the monitor token with the given hash, or models.ErrNotFound.
+	GetMonitorTokenByHash(ctx context.Context, hash string) (models.MonitorToken, error)
+	// ListMonitorTokens returns the monitor tokens, oldest first.
+	ListMonitorTokens(ctx context.Context) ([]models.MonitorToken, error)
+	// TouchMonitorToken sets the last use of the monitor token to now.
+	TouchMonitorToken(ctx context.Context, id int) error
+	// RevokeMonitorToken deletes the monitor token and returns it, or returns models.ErrNotFound.
+	RevokeMonitorToken(ctx context.Context, id int) (models.MonitorToken, error)
+	// SetUserEmail sets the email of the user, unverified, or clears it if it is empty.
+	// It returns models.ErrEmailTaken if another user has the email.
+	SetUserEmail(ctx context.Context, user_id int, email string) error
+	// SetUserLanguage sets the language the user is mailed in, empty for the default one, or returns models.ErrNotFound.
+	SetUserLanguage(ctx context.Context, user_id int, language string) error
+	// GetUserEmail returns the email of the user, or models.ErrNotFound.
+	GetUserEmail(ctx context.Context, user_id int) (models.UserEmail, error)
+	// FindUserByEmail returns the user with the email, or models.ErrNotFound.
+	FindUserByEmail(ctx context.Context, email string) (models.UserEmail, error)
+	// VerifyUserEmail marks the email of the user as verified if it is still the given one, or returns models.ErrNotFound.
+	VerifyUserEmail(ctx context.Context, user_id int, email string) error
+	// CreateEmailToken stores a token mailed to a user.
+	CreateEmailToken(ctx context.Context, token models.EmailToken) error
+	// ConsumeEmailToken deletes and returns the unexpired token of the purpose with the hash, or returns models.ErrNotFound.
+	ConsumeEmailToken(ctx context.Context, hash, purpose string) (models.EmailToken, error)
+	// RegisterDevice registers the device of the user, or marks a registered one as seen now.
+	// An empty name keeps the name of the device.
+	RegisterDevice(ctx context.Context, user_id int, device_id, name string) error
+	// TouchDevice marks the registered device of the user as seen now, or returns models.ErrNotFound.
+	TouchDevice(ctx context.Context, user_id int, device_id string) error
+	// GetDevices returns the devices of the user, the most recently seen first.
+	GetDevices(ctx context.Context, user_id int) ([]models.Device, error)
+	// SetDeviceLastSync moves the synchronization checkpoint of the registered device forward to at,
+	// or returns models.ErrNotFound.
+	SetDeviceLastSync(ctx context.Context, user_id int, device_id string, at time.Time) error
+	// RevokeDevice deletes the device of the user and revokes its refresh tokens, or returns models.ErrNotFound.
+	RevokeDevice(ctx context.Context, user_id int, device_id string) error
+	// StartUserOperation starts the operation of the user and returns it with its status and its start time,
+	// or returns models.ErrOperationRunning if another one is running.
+	StartUserOperation(ctx context.Context, op models.UserOperation) (models.UserOperation, error)
+	// GetRunningOperation returns the running operation of the user, failing it if it expired, or models.ErrNotFound.
+	GetRunningOperation(ctx context.Context, user_id int) (models.UserOperation, error)
+	// UpdateUserOperation extends the running operation of the user until expiresAt or finishes it with the status,
+	// or returns models.ErrNotFound.
+	UpdateUserOperation(ctx context.Context, user_id int, id, status string, expiresAt time.Time) (models.UserOperation, error)
+	// CreateUploadSession creates the upload session of the user and returns it with its creation time.
+	CreateUploadSession(ctx context.Context, session models.UploadSession) (models.UploadSession, error)
+	// GetUploadSession returns the upload session of the user, or models.ErrNotFound if it is missing or expired.
+	GetUploadSession(ctx context.Context, user_id int, id string) (models.UploadSession, error)
+	// DeleteUploadSession deletes the upload session of the user, or returns models.ErrNotFound.
+	DeleteUploadSession(ctx context.Context, user_id int, id string) error
+	// PruneUploadSessions deletes the upload sessions expired before the given time and returns their ids.
+	PruneUploadSessions(ctx context.Context, before time.Time) ([]string, error)
+	// FileEntryTaken reports whether another user has a file entry with the id, deleted or not.
+	FileEntryTaken(ctx context.Context, user_id int, entry_id string) (bool, error)
+	// WriteFileBlob writes the file entry of the user with the fields, adding it unless the user has it,
+	// and points it at the contents of the checksum of the blob, stored once for all the entries. A blob
+	// without a key points it at the stored contents, or returns models.ErrBlobNotStored. It returns the keys
+	// of the objects no entry points at any more, which the caller deletes.
+	WriteFileBlob(ctx context.Context, user_id int, entry_id string, fields map[string]string, blob models.FileBlob) ([]string, time.Time, error)
+	// GetFileBlob returns the blob of the file entry of the user, the zero one if its file is kept on disk,
+	// or models.ErrNotFound if the user has no such entry.
+	GetFileBlob(ctx context.Context, user_id int, entry_id string) (models.FileBlob, error)
+	// ReferencedBlobs returns which of the keys of the blob store the file entries of any user point at,
+	// the deleted ones included, or which hold stored contents.
+	ReferencedBlobs(ctx context.Context, keys []string) (map[string]bool, error)
+	// ShareEntry shares the entry of the owner of the share with its grantee and returns the share with its times,
+	// a share of the entry with the grantee already is changed to the permission. It returns models.ErrNotFound
+	// if the owner has no such entry, or it is deleted.
+	ShareEntry(ctx context.Context, share models.Share) (models.Share, error)
+	// RevokeShare revokes the share of the entry of the owner with the grantee, or returns models.ErrNotFound.
+	// The grantee drops the entry on their next sync.
+	RevokeShare(ctx context.Context, owner_id, grantee_id int, table, entry_id string) error
+	// GetSharedWithUser returns the entries shared with the user which changed since the given time, the share or
+	// the entry, ordered by table and id. The revoked shares and the deleted entries are returned as removed,
+	// unless the time is zero.
+	GetSharedWithUser(ctx context.Context, user_id int, since time.Time) ([]models.SharedEntry, error)
+	// CreateFolder creates the folder of its user and returns it with its 'updated_at'. It returns
+	// models.ErrInvalidFolder if the parent isn't a folder of the user or the id is taken, and
+	// models.ErrFolderExists if the parent has a folder with the name already.
+	CreateFolder(ctx context.Context, folder models.Folder) (models.Folder, error)
+	// UpdateFolder renames the folder of its user or moves it to another parent and returns it with its new
+	// 'updated_at', or models.ErrNotFound. A move inside the folder itself fails with models.ErrInvalidFolder.
+	UpdateFolder(ctx context.Context, folder models.Folder) (models.Folder, error)
+	// DeleteFolder deletes the folder of the user and returns its new 'updated_at', or models.ErrNotFound.
+	// A folder holding entries or other folders fails with models.ErrFolderNotEmpty, unless moveChildren
+	// is set, then they are moved to its parent.
+	DeleteFolder(ctx context.Context, user_id int, folder_id string, moveChildren bool) (time.Time, error)
+	// GetFolders returns the folders of the user changed since the given time, the deleted ones included,
+	// or all the folders which aren't deleted if the time is zero, ordered by name.
+	GetFolders(ctx context.Context, user_id int, since time.Time) ([]models.Folder, error)
+	// AddData adds data to the storage and returns the id of the entry and the 'updated_at'
+	// assigned by the storage. An entry without an id gets a new UUID.
+	AddData(ctx context.Context, table string, user_id int, entry_id string, data map[string]string) (string, time.Time, error)
+	// UpdateData updates existing data in the storage and returns the new 'updated_at', or models.ErrNotFound.
+	UpdateData(ctx context.Context, table string, user_id int, entry_id string, data map[string]string) (time.Time, error)
+	// DeleteData deletes data from the storage and returns the new 'updated_at', or models.ErrNotFound.
+	DeleteData(ctx context.Context, table string, user_id int, entry_id string) (time.Time, error)
+	// UndeleteData restores deleted data in the storage and returns the new 'updated_at'.
+	UndeleteData(ctx context.Context, table string, user_id int, entry_id string) (time.Time, error)
+	// GetDataHistory returns up to limit prior versions of an entry, newest first.
+	GetDataHistory(ctx context.Context, table string, user_id int, entry_id string, limit int) ([]models.EntryVersion, error)
+	// RenameTag renames a tag on all the entries of the user and returns the number of entries changed.
+	RenameTag(ctx context.Context, user_id int, from, to string) (int, error)
+	// SearchData returns the entries of the user matching the query, grouped by table.
+	// If partial is set, the tables which fail are returned in a *models.PartialError along with the results of the others.
+	SearchData(ctx context.Context, user_id int, query string, tables []string, limit int, partial bool) (map[string][]map[string]string, error)
+	// GetData retrieves a single entry of the user, or models.ErrNotFound. Expired entries are found if incl_expired is set.
+	GetData(ctx context.Context, table string, user_id int, entry_id string, incl_expired bool) (map[string]string, error)
+	// GetAllData retrieves the data of the user selected by the query from the storage.
+	GetAllData(ctx context.Context, table string, user_id int, q models.DataQuery) ([]map[string]string, error)
+	// ExportData calls fn with each entry of the user in the table which isn't deleted, the expired ones included,
+	// by id. It stops at the first error of fn and returns it. The entries are read a page at a time,
+	// so an export doesn't hold the table in memory.
+	ExportData(ctx context.Context, table string, user_id int, fn func(entry map[string]string) error) error
+	// PendingData estimates per data table what a synchronization of the user from the cursor would download.
+	// If partial is set, the tables which fail are returned in a *models.PartialError along with the estimates of the others.
+	PendingData(ctx context.Context, user_id int, since time.Time, partial bool) (map[string]models.PendingSize, error)
+	// GetUserDataVersion returns the version of the entries of the user, which changes with every change of them.
+	GetUserDataVersion(ctx context.Context, user_id int) (models.DataVersion, error)
+	// ExpireData marks the entries whose expires_at has passed as deleted and returns their number.
+	ExpireData(ctx context.Context) (int, error)
+	// PreviewExpiry is the dry run of ExpireData, it returns what ExpireData would delete without changing anything.
+	PreviewExpiry(ctx context.Context, sample int) (models.JobPreview, error)
+	// ApplyChanges applies a batch of client changes atomically.
+	ApplyChanges(ctx context.Context, user_id int, changes []models.Change) ([]models.ChangeResult, error)
+	// Sync applies a batch of client changes and returns, in the same transaction, the entries changed since lastSync.
+	Sync(ctx context.Context, user_id int, lastSync time.Time, changes []models.Change) (models.SyncResult, error)
+	// ReplicateData stores the entries of the table as read from the primary server of a replication, keeping their ids,
+	// 'updated_at' and deleted flags, atomically. It returns the number of the entries changed, those already at
+	// their version are skipped.
+	ReplicateData(ctx context.Context, table string, user_id int, rows []map[string]string) (int, error)
+	// AddAuditEvent records an authentication or a data change of a user in the audit log.
+	AddAuditEvent(ctx context.Context, ev models.AuditEvent) error
+	// GetAuditEvents returns up to limit audit events of the user recorded since the given time, newest first.
+	GetAuditEvents(ctx context.Context, user_id int, since time.Time, limit int) ([]models.AuditEvent, error)
+	// PruneAuditEvents deletes the audit events recorded before the given time and returns their number.
+	PruneAuditEvents(ctx context.Context, before time.Time) (int, error)
+	// PreviewAuditPruning is the dry run of PruneAuditEvents, it returns what PruneAuditEvents would delete
+	// without changing anything.
+	PreviewAuditPruning(ctx context.Context, before time.Time, sample int) (models.JobPreview, error)
+	// RotationStatus returns the progress of the rotation to the current encryption key,
+	// or models.ErrNotFound if no rotation was started or the keeper doesn't encrypt.
+	RotationStatus(ctx context.Context) (models.RotationStatus, error)
+	// StoreRefreshToken stores a refresh token issued to a device of a user.
+	StoreRefreshToken(ctx context.Context, tok models.RefreshToken) error
+	// GetRefreshToken returns the refresh token with the given hash, revoked or not, or models.ErrNotFound.
+	GetRefreshToken(ctx context.Context, hash string) (models.RefreshToken, error)
+	// RevokeRefreshToken revokes the refresh token with the given hash and reports whether this call revoked it.
+	RevokeRefreshToken(ctx context.Context, hash string) (bool, error)
+	// RevokeRefreshTokenFamily revokes all the refresh tokens of the family.
+	RevokeRefreshTokenFamily(ctx context.Context, familyID string) error
+	// RevokeToken revokes the access token with the JWT ID until it expires at expiresAt,
+	// the zero time for a token which doesn't expire.
+	RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error
+	// IsTokenRevoked reports whether the access token with the JWT ID is revoked.
+	IsTokenRevoked(ctx context.Context, jti string) (bool, error)
+	// PruneRevokedTokens deletes the revocations of the tokens expired before the given time and returns their number.
+	PruneRevokedTokens(ctx context.Context, before time.Time) (int, error)
+	// WithTx runs fn with a view of the storage whose changes are committed if fn returns nil
+	// and rolled back if it returns an error or panics. Nested calls roll back only their own changes.
+	WithTx(ctx context.Context, fn func(tx Keeper) error) error
+	// WithSnapshot runs fn with a read-only view of the storage seeing one consistent state.
+	// fn may be run more than once, so it must not have other effects.
+	WithSnapshot(ctx context.Context, fn func(tx Keeper) error) error
+	// Ping checks that the storage is reachable.
+	Ping() bool
+	// Close releases the resources held by the storage.
+	Close() bool
 }
 
 // NewMemoryStorage creates a new MemoryStorage instance with the provided Keeper and logger.
@@ -56,6 +256,11 @@ func (ms *MemoryStorage) UserExists(ctx context.Context, username string) (bool,
 	return ms.keeper.UserExists(ctx, username)
 }
 
+// UsernameTaken reports whether a user has the username or a lookalike of it.
+func (ms *MemoryStorage) UsernameTaken(ctx context.Context, username string) (bool, error) {
+	return ms.keeper.UsernameTaken(ctx, username)
+}
+
 // AddUser adds a new user to the storage.
 func (ms *MemoryStorage) AddUser(ctx context.Context, username string, hashedPassword string) error {
 	return ms.keeper.AddUser(ctx, username, hashedPassword)
@@ -71,22 +276,412 @@ func (ms *MemoryStorage) GetUserID(ctx context.Context, username string) (int, e
 	return ms.keeper.GetUserID(ctx, username)
 }
 
+// UpdatePassword replaces the hashed password of a user and revokes all their refresh tokens.
+func (ms *MemoryStorage) UpdatePassword(ctx context.Context, user_id int, hashedPassword string) error {
+	return ms.keeper.UpdatePassword(ctx, user_id, hashedPassword)
+}
+
+// RehashPassword replaces the hashed password of a user with another hash of the same password.
+func (ms *MemoryStorage) RehashPassword(ctx context.Context, user_id int, oldHash, newHash string) (bool, error) {
+	return ms.keeper.RehashPassword(ctx, user_id, oldHash, newHash)
+}
+
+// RecordFailedLogin counts a failed login of the account and returns the end of the lockout it started.
+func (ms *MemoryStorage) RecordFailedLogin(ctx context.Context, username string, maxFailures int) (time.Time, error) {
+	return ms.keeper.RecordFailedLogin(ctx, username, maxFailures)
+}
+
+// ResetFailedLogins clears the failed logins of the account.
+func (ms *MemoryStorage) ResetFailedLogins(ctx context.Context, username string) error {
+	return ms.keeper.ResetFailedLogins(ctx, username)
+}
+
+// IsLocked reports whether the account is locked and until when.
+func (ms *MemoryStorage) IsLocked(ctx context.Context, username string) (bool, time.Time, error) {
+	return ms.keeper.IsLocked(ctx, username)
+}
+
+// RecordLogin adds a login attempt to the login history of its user.
+func (ms *MemoryStorage) RecordLogin(ctx context.Context, ev models.LoginEvent, keep int) error {
+	return ms.keeper.RecordLogin(ctx, ev, keep)
+}
+
+// GetLoginHistory returns the login attempts of the user, newest first.
+func (ms *MemoryStorage) GetLoginHistory(ctx context.Context, user_id int, limit int) ([]models.LoginEvent, error) {
+	return ms.keeper.GetLoginHistory(ctx, user_id, limit)
+}
+
+// GetUserAccess returns the role of the user, whether their account is disabled and the last change of their password.
+func (ms *MemoryStorage) GetUserAccess(ctx context.Context, user_id int) (models.UserAccess, error) {
+	return ms.keeper.GetUserAccess(ctx, user_id)
+}
+
+// ListUsers returns a page of the users with their usage.
+func (ms *MemoryStorage) ListUsers(ctx context.Context, afterID int, limit int) ([]models.UserSummary, error) {
+	return ms.keeper.ListUsers(ctx, afterID, limit)
+}
+
+// SetUserDisabled disables or enables the account of the user.
+func (ms *MemoryStorage) SetUserDisabled(ctx context.Context, user_id int, disabled bool) error {
+	return ms.keeper.SetUserDisabled(ctx, user_id, disabled)
+}
+
+// DeleteUser deletes the account of the user with all of their data.
+func (ms *MemoryStorage) DeleteUser(ctx context.Context, user_id int) error {
+	return ms.keeper.DeleteUser(ctx, user_id)
+}
+
+// CreateAPIKey stores an API key created by a user.
+func (ms *MemoryStorage) CreateAPIKey(ctx context.Context, key models.APIKey) (models.APIKey, error) {
+	return ms.keeper.CreateAPIKey(ctx, key)
+}
+
+// GetAPIKeyByHash returns the API key with the given hash.
+func (ms *MemoryStorage) GetAPIKeyByHash(ctx context.Context, hash string) (models.APIKey, error) {
+	return ms.keeper.GetAPIKeyByHash(ctx, hash)
+}
+
+// ListAPIKeys returns the API keys of the user.
+func (ms *MemoryStorage) ListAPIKeys(ctx context.Context, user_id int) ([]models.APIKey, error) {
+	return ms.keeper.ListAPIKeys(ctx, user_id)
+}
+
+// TouchAPIKey sets the last use of the API key to now.
+func (ms *MemoryStorage) TouchAPIKey(ctx context.Context, id int) error {
+	return ms.keeper.TouchAPIKey(ctx, id)
+}
+
+// RevokeAPIKey deletes the API key of the user.
+func (ms *MemoryStorage) RevokeAPIKey(ctx context.Context, user_id int, id int) error {
+	return ms.keeper.RevokeAPIKey(ctx, user_id, id)
+}
+
+// CreateMonitorToken stores a monitor token created by an admin.
+func (ms *MemoryStorage) CreateMonitorToken(ctx context.Context, token models.MonitorToken) (models.MonitorToken, error) {
+	return ms.keeper.CreateMonitorToken(ctx, token)
+}
+
+// GetMonitorTokenByHash returns the monitor token with the given hash.
+func (ms *MemoryStorage) GetMonitorTokenByHash(ctx context.Context, hash string) (models.MonitorToken, error) {
+	return ms.keeper.GetMonitorTokenByHash(ctx, hash)
+}
+
+// ListMonitorTokens returns the monitor tokens.
+func (ms *MemoryStorage) ListMonitorTokens(ctx context.Context) ([]models.MonitorToken, error) {
+	return ms.keeper.ListMonitorTokens(ctx)
+}
+
+// TouchMonitorToken sets the last use of the monitor token to now.
+func (ms *MemoryStorage) TouchMonitorToken(ctx context.Context, id int) error {
+	return ms.keeper.TouchMonitorToken(ctx, id)
+}
+
+// RevokeMonitorToken deletes the monitor token.
+func (ms *MemoryStorage) RevokeMonitorToken(ctx context.Context, id int) (models.MonitorToken, error) {
+	return ms.keeper.RevokeMonitorToken(ctx, id)
+}
+
 // AddData adds data to the storage.
-func (ms *MemoryStorage) AddData(ctx context.Context, table string, user_id int, entry_id string, data map[string]string) error {
+func (ms *MemoryStorage) AddData(ctx context.Context, table string, user_id int, entry_id string, data map[string]string) (string, time.Time, error) {
 	return ms.keeper.AddData(ctx, table, user_id, entry_id, data)
 }
 
 // UpdateData updates existing data in the storage.
-func (ms *MemoryStorage) UpdateData(ctx context.Context, table string, user_id int, entry_id string, data map[string]string) error {
+func (ms *MemoryStorage) UpdateData(ctx context.Context, table string, user_id int, entry_id string, data map[string]string) (time.Time, error) {
 	return ms.keeper.UpdateData(ctx, table, user_id, entry_id, data)
 }
 
 // DeleteData deletes data from the storage.
-func (ms *MemoryStorage) DeleteData(ctx context.Context, table string, user_id int, entry_id string) error {
+func (ms *MemoryStorage) DeleteData(ctx context.Context, table string, user_id int, entry_id string) (time.Time, error) {
 	return ms.keeper.DeleteData(ctx, table, user_id, entry_id)
 }
 
+// UndeleteData restores deleted data in the storage.
+func (ms *MemoryStorage) UndeleteData(ctx context.Context, table string, user_id int, entry_id string) (time.Time, error) {
+	return ms.keeper.UndeleteData(ctx, table, user_id, entry_id)
+}
+
+// GetDataHistory returns up to limit prior versions of an entry, newest first.
+func (ms *MemoryStorage) GetDataHistory(ctx context.Context, table string, user_id int, entry_id string, limit int) ([]models.EntryVersion, error) {
+	return ms.keeper.GetDataHistory(ctx, table, user_id, entry_id, limit)
+}
+
+// SetUserEmail sets the email of the user, unverified.
+func (ms *MemoryStorage) SetUserEmail(ctx context.Context, user_id int, email string) error {
+	return ms.keeper.SetUserEmail(ctx, user_id, email)
+}
+
+// SetUserLanguage sets the language the user is mailed in.
+func (ms *MemoryStorage) SetUserLanguage(ctx context.Context, user_id int, language string) error {
+	return ms.keeper.SetUserLanguage(ctx, user_id, language)
+}
+
+// GetUserEmail returns the email of the user.
+func (ms *MemoryStorage) GetUserEmail(ctx context.Context, user_id int) (models.UserEmail, error) {
+	return ms.keeper.GetUserEmail(ctx, user_id)
+}
+
+// FindUserByEmail returns the user with the email.
+func (ms *MemoryStorage) FindUserByEmail(ctx context.Context, email string) (models.UserEmail, error) {
+	return ms.keeper.FindUserByEmail(ctx, email)
+}
+
+// VerifyUserEmail marks the email of the user as verified if it is still the given one.
+func (ms *MemoryStorage) VerifyUserEmail(ctx context.Context, user_id int, email string) error {
+	return ms.keeper.VerifyUserEmail(ctx, user_id, email)
+}
+
+// CreateEmailToken stores a token mailed to a user.
+func (ms *MemoryStorage) CreateEmailToken(ctx context.Context, token models.EmailToken) error {
+	return ms.keeper.CreateEmailToken(ctx, token)
+}
+
+// ConsumeEmailToken deletes and returns the token of the purpose with the hash.
+func (ms *MemoryStorage) ConsumeEmailToken(ctx context.Context, hash, purpose string) (models.EmailToken, error) {
+	return ms.keeper.ConsumeEmailToken(ctx, hash, purpose)
+}
+
+// RegisterDevice registers the device of the user, or marks it as seen now.
+func (ms *MemoryStorage) RegisterDevice(ctx context.Context, user_id int, device_id, name string) error {
+	return ms.keeper.RegisterDevice(ctx, user_id, device_id, name)
+}
+
+// TouchDevice marks the registered device of the user as seen now.
+func (ms *MemoryStorage) TouchDevice(ctx context.Context, user_id int, device_id string) error {
+	return ms.keeper.TouchDevice(ctx, user_id, device_id)
+}
+
+// GetDevices returns the devices of the user.
+func (ms *MemoryStorage) GetDevices(ctx context.Context, user_id int) ([]models.Device, error) {
+	return ms.keeper.GetDevices(ctx, user_id)
+}
+
+// SetDeviceLastSync moves the synchronization checkpoint of the device forward.
+func (ms *MemoryStorage) SetDeviceLastSync(ctx context.Context, user_id int, device_id string, at time.Time) error {
+	return ms.keeper.SetDeviceLastSync(ctx, user_id, device_id, at)
+}
+
+// RevokeDevice deletes the device of the user and revokes its refresh tokens.
+func (ms *MemoryStorage) RevokeDevice(ctx context.Context, user_id int, device_id string) error {
+	return ms.keeper.RevokeDevice(ctx, user_id, device_id)
+}
+
+// StartUserOperation starts the operation of the user.
+func (ms *MemoryStorage) StartUserOperation(ctx context.Context, op models.UserOperation) (models.UserOperation, error) {
+	return ms.keeper.StartUserOperation(ctx, op)
+}
+
+// GetRunningOperation returns the running operation of the user.
+func (ms *MemoryStorage) GetRunningOperation(ctx context.Context, user_id int) (models.UserOperation, error) {
+	return ms.keeper.GetRunningOperation(ctx, user_id)
+}
+
+// UpdateUserOperation extends or finishes the running operation of the user.
+func (ms *MemoryStorage) UpdateUserOperation(ctx context.Context, user_id int, id, status string, expiresAt time.Time) (models.UserOperation, error) {
+	return ms.keeper.UpdateUserOperation(ctx, user_id, id, status, expiresAt)
+}
+
+// CreateUploadSession creates the upload session of the user.
+func (ms *MemoryStorage) CreateUploadSession(ctx context.Context, session models.UploadSession) (models.UploadSession, error) {
+	return ms.keeper.CreateUploadSession(ctx, session)
+}
+
+// GetUploadSession returns the upload session of the user.
+func (ms *MemoryStorage) GetUploadSession(ctx context.Context, user_id int, id string) (models.UploadSession, error) {
+	return ms.keeper.GetUploadSession(ctx, user_id, id)
+}
+
+// DeleteUploadSession deletes the upload session of the user.
+func (ms *MemoryStorage) DeleteUploadSession(ctx context.Context, user_id int, id string) error {
+	return ms.keeper.DeleteUploadSession(ctx, user_id, id)
+}
+
+// PruneUploadSessions deletes the upload sessions expired before the given time.
+func (ms *MemoryStorage) PruneUploadSessions(ctx context.Context, before time.Time) ([]string, error) {
+	return ms.keeper.PruneUploadSessions(ctx, before)
+}
+
+// FileEntryTaken reports whether another user has a file entry with the id.
+func (ms *MemoryStorage) FileEntryTaken(ctx context.Context, user_id int, entry_id string) (bool, error) {
+	return ms.keeper.FileEntryTaken(ctx, user_id, entry_id)
+}
+
+// WriteFileBlob writes the file entry of the user and points it at the blob.
+func (ms *MemoryStorage) WriteFileBlob(ctx context.Context, user_id int, entry_id string, fields map[string]string, blob models.FileBlob) ([]string, time.Time, error) {
+	return ms.keeper.WriteFileBlob(ctx, user_id, entry_id, fields, blob)
+}
+
+// GetFileBlob returns the blob of the file entry of the user.
+func (ms *MemoryStorage) GetFileBlob(ctx context.Context, user_id int, entry_id string) (models.FileBlob, error) {
+	return ms.keeper.GetFileBlob(ctx, user_id, entry_id)
+}
+
+// ReferencedBlobs returns which of the keys the file entries point at.
+func (ms *MemoryStorage) ReferencedBlobs(ctx context.Context, keys []string) (map[string]bool, error) {
+	return ms.keeper.ReferencedBlobs(ctx, keys)
+}
+
+// ShareEntry shares the entry of the owner with the grantee.
+func (ms *MemoryStorage) ShareEntry(ctx context.Context, share models.Share) (models.Share, error) {
+	return ms.keeper.ShareEntry(ctx, share)
+}
+
+// RevokeShare revokes the share of the entry of the owner with the grantee.
+func (ms *MemoryStorage) RevokeShare(ctx context.Context, owner_id, grantee_id int, table, entry_id string) error {
+	return ms.keeper.RevokeShare(ctx, owner_id, grantee_id, table, entry_id)
+}
+
+// GetSharedWithUser returns the entries shared with the user which changed since the given time.
+func (ms *MemoryStorage) GetSharedWithUser(ctx context.Context, user_id int, since time.Time) ([]models.SharedEntry, error) {
+	return ms.keeper.GetSharedWithUser(ctx, user_id, since)
+}
+
+// CreateFolder creates the folder of its user.
+func (ms *MemoryStorage) CreateFolder(ctx context.Context, folder models.Folder) (models.Folder, error) {
+	return ms.keeper.CreateFolder(ctx, folder)
+}
+
+// UpdateFolder renames the folder of its user or moves it to another parent.
+func (ms *MemoryStorage) UpdateFolder(ctx context.Context, folder models.Folder) (models.Folder, error) {
+	return ms.keeper.UpdateFolder(ctx, folder)
+}
+
+// DeleteFolder deletes the folder of the user.
+func (ms *MemoryStorage) DeleteFolder(ctx context.Context, user_id int, folder_id string, moveChildren bool) (time.Time, error) {
+	return ms.keeper.DeleteFolder(ctx, user_id, folder_id, moveChildren)
+}
+
+// GetFolders returns the folders of the user changed since the given time.
+func (ms *MemoryStorage) GetFolders(ctx context.Context, user_id int, since time.Time) ([]models.Folder, error) {
+	return ms.keeper.GetFolders(ctx, user_id, since)
+}
+
+// RenameTag renames a tag on all the entries of the user.
+func (ms *MemoryStorage) RenameTag(ctx context.Context, user_id int, from, to string) (int, error) {
+	return ms.keeper.RenameTag(ctx, user_id, from, to)
+}
+
+// SearchData returns the entries of the user matching the query, grouped by table.
+func (ms *MemoryStorage) SearchData(ctx context.Context, user_id int, query string, tables []string, limit int, partial bool) (map[string][]map[string]string, error) {
+	return ms.keeper.SearchData(ctx, user_id, query, tables, limit, partial)
+}
+
+// PendingData estimates per data table what a synchronization of the user from the cursor would download.
+func (ms *MemoryStorage) PendingData(ctx context.Context, user_id int, since time.Time, partial bool) (map[string]models.PendingSize, error) {
+	return ms.keeper.PendingData(ctx, user_id, since, partial)
+}
+
+// GetUserDataVersion returns the version of the entries of the user.
+func (ms *MemoryStorage) GetUserDataVersion(ctx context.Context, user_id int) (models.DataVersion, error) {
+	return ms.keeper.GetUserDataVersion(ctx, user_id)
+}
+
+// GetData retrieves a single entry of the user.
+func (ms *MemoryStorage) GetData(ctx context.Context, table string, user_id int, entry_id string, incl_expired bool) (map[string]string, error) {
+	return ms.keeper.GetData(ctx, table, user_id, entry_id, incl_expired)
+}
+
 // GetAllData retrieves all data from the storage.
-func (ms *MemoryStorage) GetAllData(ctx context.Context, table string, user_id int, last_sync time.Time, incl_del bool) ([]map[string]string, error) {
-	return ms.keeper.GetAllData(ctx, table, user_id, last_sync, incl_del)
+func (ms *MemoryStorage) GetAllData(ctx context.Context, table string, user_id int, q models.DataQuery) ([]map[string]string, error) {
+	return ms.keeper.GetAllData(ctx, table, user_id, q)
+}
+
+// ExportData calls fn with each entry of the user in the table which isn't deleted.
+func (ms *MemoryStorage) ExportData(ctx context.Context, table string, user_id int, fn func(entry map[string]string) error) error {
+	return ms.keeper.ExportData(ctx, table, user_id, fn)
+}
+
+// ExpireData marks the entries whose expires_at has passed as deleted.
+func (ms *MemoryStorage) ExpireData(ctx context.Context) (int, error) {
+	return ms.keeper.ExpireData(ctx)
+}
+
+// PreviewExpiry returns what ExpireData would delete.
+func (ms *MemoryStorage) PreviewExpiry(ctx context.Context, sample int) (models.JobPreview, error) {
+	return ms.keeper.PreviewExpiry(ctx, sample)
+}
+
+// ApplyChanges applies a batch of client changes atomically.
+func (ms *MemoryStorage) ApplyChanges(ctx context.Context, user_id int, changes []models.Change) ([]models.ChangeResult, error) {
+	return ms.keeper.ApplyChanges(ctx, user_id, changes)
+}
+
+// Sync applies a batch of client changes and returns the entries changed since lastSync.
+func (ms *MemoryStorage) Sync(ctx context.Context, user_id int, lastSync time.Time, changes []models.Change) (models.SyncResult, error) {
+	return ms.keeper.Sync(ctx, user_id, lastSync, changes)
+}
+
+// ReplicateData stores the entries of the table as read from the primary server of a replication.
+func (ms *MemoryStorage) ReplicateData(ctx context.Context, table string, user_id int, rows []map[string]string) (int, error) {
+	return ms.keeper.ReplicateData(ctx, table, user_id, rows)
+}
+
+// AddAuditEvent records an event in the audit log.
+func (ms *MemoryStorage) AddAuditEvent(ctx context.Context, ev models.AuditEvent) error {
+	return ms.keeper.AddAuditEvent(ctx, ev)
+}
+
+// GetAuditEvents returns the audit events of the user recorded since the given time, newest first.
+func (ms *MemoryStorage) GetAuditEvents(ctx context.Context, user_id int, since time.Time, limit int) ([]models.AuditEvent, error) {
+	return ms.keeper.GetAuditEvents(ctx, user_id, since, limit)
+}
+
+// PruneAuditEvents deletes the audit events recorded before the given time.
+func (ms *MemoryStorage) PruneAuditEvents(ctx context.Context, before time.Time) (int, error) {
+	return ms.keeper.PruneAuditEvents(ctx, before)
+}
+
+// PreviewAuditPruning returns what PruneAuditEvents would delete.
+func (ms *MemoryStorage) PreviewAuditPruning(ctx context.Context, before time.Time, sample int) (models.JobPreview, error) {
+	return ms.keeper.PreviewAuditPruning(ctx, before, sample)
+}
+
+// RotationStatus returns the progress of the rotation to the current encryption key.
+func (ms *MemoryStorage) RotationStatus(ctx context.Context) (models.RotationStatus, error) {
+	return ms.keeper.RotationStatus(ctx)
+}
+
+// StoreRefreshToken stores a refresh token issued to a device of a user.
+func (ms *MemoryStorage) StoreRefreshToken(ctx context.Context, tok models.RefreshToken) error {
+	return ms.keeper.StoreRefreshToken(ctx, tok)
+}
+
+// GetRefreshToken returns the refresh token with the given hash.
+func (ms *MemoryStorage) GetRefreshToken(ctx context.Context, hash string) (models.RefreshToken, error) {
+	return ms.keeper.GetRefreshToken(ctx, hash)
+}
+
+// RevokeRefreshToken revokes the refresh token with the given hash.
+func (ms *MemoryStorage) RevokeRefreshToken(ctx context.Context, hash string) (bool, error) {
+	return ms.keeper.RevokeRefreshToken(ctx, hash)
+}
+
+// RevokeRefreshTokenFamily revokes all the refresh tokens of the family.
+func (ms *MemoryStorage) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	return ms.keeper.RevokeRefreshTokenFamily(ctx, familyID)
+}
+
+// RevokeToken revokes the access token with the JWT ID until it expires.
+func (ms *MemoryStorage) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	return ms.keeper.RevokeToken(ctx, jti, expiresAt)
+}
+
+// IsTokenRevoked reports whether the access token with the JWT ID is revoked.
+func (ms *MemoryStorage) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	return ms.keeper.IsTokenRevoked(ctx, jti)
+}
+
+// PruneRevokedTokens deletes the revocations of the tokens expired before the given time.
+func (ms *MemoryStorage) PruneRevokedTokens(ctx context.Context, before time.Time) (int, error) {
+	return ms.keeper.PruneRevokedTokens(ctx, before)
+}
+
+// WithTx runs fn with a transactional view of the storage.
+func (ms *MemoryStorage) WithTx(ctx context.Context, fn func(tx Keeper) error) error {
+	return ms.keeper.WithTx(ctx, fn)
+}
+
+// WithSnapshot runs fn with a consistent read-only view of the storage.
+func (ms *MemoryStorage) WithSnapshot(ctx context.Context, fn func(tx Keeper) error) error {
+	return ms.keeper.WithSnapshot(ctx, fn)
 }
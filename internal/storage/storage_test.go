@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
 	"go.uber.org/zap/zapcore"
 )
 
@@ -15,6 +16,10 @@ func (m *mockKeeper) UserExists(ctx context.Context, username string) (bool, err
 	return true, nil
 }
 
+func (m *mockKeeper) UsernameTaken(ctx context.Context, username string) (bool, error) {
+	return true, nil
+}
+
 func (m *mockKeeper) AddUser(ctx context.Context, username string, hashedPassword string) error {
 	return nil
 }
@@ -27,22 +32,342 @@ func (m *mockKeeper) GetUserID(ctx context.Context, username string) (int, error
 	return 123, nil
 }
 
-func (m *mockKeeper) AddData(ctx context.Context, table string, user_id int, entry_id string, data map[string]string) error {
+func (m *mockKeeper) UpdatePassword(ctx context.Context, user_id int, hashedPassword string) error {
+	return nil
+}
+
+func (m *mockKeeper) RehashPassword(ctx context.Context, user_id int, oldHash, newHash string) (bool, error) {
+	return false, nil
+}
+
+func (m *mockKeeper) RecordFailedLogin(ctx context.Context, username string, maxFailures int) (time.Time, error) {
+	return time.Time{}, nil
+}
+
+func (m *mockKeeper) ResetFailedLogins(ctx context.Context, username string) error {
+	return nil
+}
+
+func (m *mockKeeper) IsLocked(ctx context.Context, username string) (bool, time.Time, error) {
+	return false, time.Time{}, nil
+}
+
+func (m *mockKeeper) RecordLogin(ctx context.Context, ev models.LoginEvent, keep int) error {
+	return nil
+}
+
+func (m *mockKeeper) GetLoginHistory(ctx context.Context, user_id int, limit int) ([]models.LoginEvent, error) {
+	return nil, nil
+}
+
+func (m *mockKeeper) GetUserAccess(ctx context.Context, user_id int) (models.UserAccess, error) {
+	return models.UserAccess{Role: models.RoleUser}, nil
+}
+
+func (m *mockKeeper) ListUsers(ctx context.Context, afterID int, limit int) ([]models.UserSummary, error) {
+	return nil, nil
+}
+
+func (m *mockKeeper) SetUserDisabled(ctx context.Context, user_id int, disabled bool) error {
+	return nil
+}
+
+func (m *mockKeeper) DeleteUser(ctx context.Context, user_id int) error {
+	return nil
+}
+
+func (m *mockKeeper) CreateAPIKey(ctx context.Context, key models.APIKey) (models.APIKey, error) {
+	return key, nil
+}
+
+func (m *mockKeeper) GetAPIKeyByHash(ctx context.Context, hash string) (models.APIKey, error) {
+	return models.APIKey{}, models.ErrNotFound
+}
+
+func (m *mockKeeper) ListAPIKeys(ctx context.Context, user_id int) ([]models.APIKey, error) {
+	return nil, nil
+}
+
+func (m *mockKeeper) TouchAPIKey(ctx context.Context, id int) error {
+	return nil
+}
+
+func (m *mockKeeper) RevokeAPIKey(ctx context.Context, user_id int, id int) error {
+	return nil
+}
+
+func (m *mockKeeper) CreateMonitorToken(ctx context.Context, token models.MonitorToken) (models.MonitorToken, error) {
+	return token, nil
+}
+
+func (m *mockKeeper) GetMonitorTokenByHash(ctx context.Context, hash string) (models.MonitorToken, error) {
+	return models.MonitorToken{}, models.ErrNotFound
+}
+
+func (m *mockKeeper) ListMonitorTokens(ctx context.Context) ([]models.MonitorToken, error) {
+	return nil, nil
+}
+
+func (m *mockKeeper) TouchMonitorToken(ctx context.Context, id int) error {
+	return nil
+}
+
+func (m *mockKeeper) RevokeMonitorToken(ctx context.Context, id int) (models.MonitorToken, error) {
+	return models.MonitorToken{}, models.ErrNotFound
+}
+
+func (m *mockKeeper) AddData(ctx context.Context, table string, user_id int, entry_id string, data map[string]string) (string, time.Time, error) {
+	return entry_id, time.Time{}, nil
+}
+
+func (m *mockKeeper) UpdateData(ctx context.Context, table string, user_id int, entry_id string, data map[string]string) (time.Time, error) {
+	return time.Time{}, nil
+}
+
+func (m *mockKeeper) DeleteData(ctx context.Context, table string, user_id int, entry_id string) (time.Time, error) {
+	return time.Time{}, nil
+}
+
+func (m *mockKeeper) UndeleteData(ctx context.Context, table string, user_id int, entry_id string) (time.Time, error) {
+	return time.Time{}, nil
+}
+
+func (m *mockKeeper) GetDataHistory(ctx context.Context, table string, user_id int, entry_id string, limit int) ([]models.EntryVersion, error) {
+	return nil, nil
+}
+
+func (m *mockKeeper) SetUserEmail(ctx context.Context, user_id int, email string) error {
+	return nil
+}
+
+func (m *mockKeeper) SetUserLanguage(ctx context.Context, user_id int, language string) error {
+	return nil
+}
+
+func (m *mockKeeper) GetUserEmail(ctx context.Context, user_id int) (models.UserEmail, error) {
+	return models.UserEmail{}, nil
+}
+
+func (m *mockKeeper) FindUserByEmail(ctx context.Context, email string) (models.UserEmail, error) {
+	return models.UserEmail{}, nil
+}
+
+func (m *mockKeeper) VerifyUserEmail(ctx context.Context, user_id int, email string) error {
+	return nil
+}
+
+func (m *mockKeeper) CreateEmailToken(ctx context.Context, token models.EmailToken) error {
+	return nil
+}
+
+func (m *mockKeeper) ConsumeEmailToken(ctx context.Context, hash, purpose string) (models.EmailToken, error) {
+	return models.EmailToken{}, nil
+}
+
+func (m *mockKeeper) RegisterDevice(ctx context.Context, user_id int, device_id, name string) error {
+	return nil
+}
+
+func (m *mockKeeper) TouchDevice(ctx context.Context, user_id int, device_id string) error {
+	return nil
+}
+
+func (m *mockKeeper) GetDevices(ctx context.Context, user_id int) ([]models.Device, error) {
+	return nil, nil
+}
+
+func (m *mockKeeper) SetDeviceLastSync(ctx context.Context, user_id int, device_id string, at time.Time) error {
+	return nil
+}
+
+func (m *mockKeeper) RevokeDevice(ctx context.Context, user_id int, device_id string) error {
+	return nil
+}
+
+func (m *mockKeeper) StartUserOperation(ctx context.Context, op models.UserOperation) (models.UserOperation, error) {
+	return op, nil
+}
+
+func (m *mockKeeper) GetRunningOperation(ctx context.Context, user_id int) (models.UserOperation, error) {
+	return models.UserOperation{}, models.ErrNotFound
+}
+
+func (m *mockKeeper) UpdateUserOperation(ctx context.Context, user_id int, id, status string, expiresAt time.Time) (models.UserOperation, error) {
+	return models.UserOperation{}, nil
+}
+
+func (m *mockKeeper) CreateUploadSession(ctx context.Context, session models.UploadSession) (models.UploadSession, error) {
+	return session, nil
+}
+
+func (m *mockKeeper) GetUploadSession(ctx context.Context, user_id int, id string) (models.UploadSession, error) {
+	return models.UploadSession{}, models.ErrNotFound
+}
+
+func (m *mockKeeper) DeleteUploadSession(ctx context.Context, user_id int, id string) error {
+	return nil
+}
+
+func (m *mockKeeper) FileEntryTaken(ctx context.Context, user_id int, entry_id string) (bool, error) {
+	return false, nil
+}
+
+func (m *mockKeeper) PruneUploadSessions(ctx context.Context, before time.Time) ([]string, error) {
+	return nil, nil
+}
+
+func (m *mockKeeper) WriteFileBlob(ctx context.Context, user_id int, entry_id string, fields map[string]string, blob models.FileBlob) ([]string, time.Time, error) {
+	return nil, time.Time{}, nil
+}
+
+func (m *mockKeeper) GetFileBlob(ctx context.Context, user_id int, entry_id string) (models.FileBlob, error) {
+	return models.FileBlob{}, models.ErrNotFound
+}
+
+func (m *mockKeeper) ReferencedBlobs(ctx context.Context, keys []string) (map[string]bool, error) {
+	return map[string]bool{}, nil
+}
+
+func (m *mockKeeper) ShareEntry(ctx context.Context, share models.Share) (models.Share, error) {
+	return share, nil
+}
+
+func (m *mockKeeper) RevokeShare(ctx context.Context, owner_id, grantee_id int, table, entry_id string) error {
 	return nil
 }
 
-func (m *mockKeeper) UpdateData(ctx context.Context, table string, user_id int, entry_id string, data map[string]string) error {
+func (m *mockKeeper) GetSharedWithUser(ctx context.Context, user_id int, since time.Time) ([]models.SharedEntry, error) {
+	return nil, nil
+}
+
+func (m *mockKeeper) CreateFolder(ctx context.Context, folder models.Folder) (models.Folder, error) {
+	return folder, nil
+}
+
+func (m *mockKeeper) UpdateFolder(ctx context.Context, folder models.Folder) (models.Folder, error) {
+	return folder, nil
+}
+
+func (m *mockKeeper) DeleteFolder(ctx context.Context, user_id int, folder_id string, moveChildren bool) (time.Time, error) {
+	return time.Time{}, nil
+}
+
+func (m *mockKeeper) GetFolders(ctx context.Context, user_id int, since time.Time) ([]models.Folder, error) {
+	return nil, nil
+}
+
+func (m *mockKeeper) RenameTag(ctx context.Context, user_id int, from, to string) (int, error) {
+	return 0, nil
+}
+
+func (m *mockKeeper) SearchData(ctx context.Context, user_id int, query string, tables []string, limit int, partial bool) (map[string][]map[string]string, error) {
+	return nil, nil
+}
+
+func (m *mockKeeper) PendingData(ctx context.Context, user_id int, since time.Time, partial bool) (map[string]models.PendingSize, error) {
+	return nil, nil
+}
+
+func (m *mockKeeper) GetUserDataVersion(ctx context.Context, user_id int) (models.DataVersion, error) {
+	return models.DataVersion{}, nil
+}
+
+func (m *mockKeeper) GetData(ctx context.Context, table string, user_id int, entry_id string, incl_expired bool) (map[string]string, error) {
+	return nil, nil
+}
+
+func (m *mockKeeper) GetAllData(ctx context.Context, table string, user_id int, q models.DataQuery) ([]map[string]string, error) {
+	return nil, nil
+}
+
+func (m *mockKeeper) ExportData(ctx context.Context, table string, user_id int, fn func(entry map[string]string) error) error {
 	return nil
 }
 
-func (m *mockKeeper) DeleteData(ctx context.Context, table string, user_id int, entry_id string) error {
+func (m *mockKeeper) ExpireData(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+func (m *mockKeeper) PreviewExpiry(ctx context.Context, sample int) (models.JobPreview, error) {
+	return models.JobPreview{}, nil
+}
+
+func (m *mockKeeper) ApplyChanges(ctx context.Context, user_id int, changes []models.Change) ([]models.ChangeResult, error) {
+	return []models.ChangeResult{}, nil
+}
+
+func (m *mockKeeper) Sync(ctx context.Context, user_id int, lastSync time.Time, changes []models.Change) (models.SyncResult, error) {
+	return models.NewSyncResult(lastSync, nil), nil
+}
+
+func (m *mockKeeper) ReplicateData(ctx context.Context, table string, user_id int, rows []map[string]string) (int, error) {
+	return 0, nil
+}
+
+func (m *mockKeeper) AddAuditEvent(ctx context.Context, ev models.AuditEvent) error {
 	return nil
 }
 
-func (m *mockKeeper) GetAllData(ctx context.Context, table string, user_id int, last_sync time.Time, incl_del bool) ([]map[string]string, error) {
+func (m *mockKeeper) GetAuditEvents(ctx context.Context, user_id int, since time.Time, limit int) ([]models.AuditEvent, error) {
 	return nil, nil
 }
 
+func (m *mockKeeper) PruneAuditEvents(ctx context.Context, before time.Time) (int, error) {
+	return 0, nil
+}
+
+func (m *mockKeeper) PreviewAuditPruning(ctx context.Context, before time.Time, sample int) (models.JobPreview, error) {
+	return models.JobPreview{}, nil
+}
+
+func (m *mockKeeper) RotationStatus(ctx context.Context) (models.RotationStatus, error) {
+	return models.RotationStatus{}, models.ErrNotFound
+}
+
+func (m *mockKeeper) StoreRefreshToken(ctx context.Context, tok models.RefreshToken) error {
+	return nil
+}
+
+func (m *mockKeeper) GetRefreshToken(ctx context.Context, hash string) (models.RefreshToken, error) {
+	return models.RefreshToken{}, models.ErrNotFound
+}
+
+func (m *mockKeeper) RevokeRefreshToken(ctx context.Context, hash string) (bool, error) {
+	return false, nil
+}
+
+func (m *mockKeeper) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	return nil
+}
+
+func (m *mockKeeper) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	return nil
+}
+
+func (m *mockKeeper) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	return false, nil
+}
+
+func (m *mockKeeper) PruneRevokedTokens(ctx context.Context, before time.Time) (int, error) {
+	return 0, nil
+}
+
+func (m *mockKeeper) WithTx(ctx context.Context, fn func(tx Keeper) error) error {
+	return fn(m)
+}
+
+func (m *mockKeeper) WithSnapshot(ctx context.Context, fn func(tx Keeper) error) error {
+	return fn(m)
+}
+
+func (m *mockKeeper) Ping() bool {
+	return true
+}
+
+func (m *mockKeeper) Close() bool {
+	return true
+}
+
 type mockLogger struct{}
 
 func (m *mockLogger) Info(string, ...zapcore.Field) {}
@@ -76,25 +401,32 @@ func TestMemoryStorage_GetUserID(t *testing.T) {
 
 func TestMemoryStorage_AddData(t *testing.T) {
 	storage := NewMemoryStorage(&mockKeeper{}, &mockLogger{})
-	err := storage.AddData(context.Background(), "table", 123, "entry", map[string]string{"key": "value"})
+	_, _, err := storage.AddData(context.Background(), "table", 123, "entry", map[string]string{"key": "value"})
 	assert.NoError(t, err)
 }
 
 func TestMemoryStorage_UpdateData(t *testing.T) {
 	storage := NewMemoryStorage(&mockKeeper{}, &mockLogger{})
-	err := storage.UpdateData(context.Background(), "table", 123, "entry", map[string]string{"key": "value"})
+	_, err := storage.UpdateData(context.Background(), "table", 123, "entry", map[string]string{"key": "value"})
 	assert.NoError(t, err)
 }
 
 func TestMemoryStorage_DeleteData(t *testing.T) {
 	storage := NewMemoryStorage(&mockKeeper{}, &mockLogger{})
-	err := storage.DeleteData(context.Background(), "table", 123, "entry")
+	_, err := storage.DeleteData(context.Background(), "table", 123, "entry")
 	assert.NoError(t, err)
 }
 
 func TestMemoryStorage_GetAllData(t *testing.T) {
 	storage := NewMemoryStorage(&mockKeeper{}, &mockLogger{})
-	data, err := storage.GetAllData(context.Background(), "table", 123, time.Now(), false)
+	data, err := storage.GetAllData(context.Background(), "table", 123, models.DataQuery{LastSync: time.Now()})
 	assert.NoError(t, err)
 	assert.Nil(t, data)
 }
+
+func TestMemoryStorage_ApplyChanges(t *testing.T) {
+	storage := NewMemoryStorage(&mockKeeper{}, &mockLogger{})
+	results, err := storage.ApplyChanges(context.Background(), 123, []models.Change{})
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+}
@@ -0,0 +1,3219 @@
+// Package storagetest provides conformance tests shared by all storage.Keeper implementations.
+package storagetest
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wurt83ow/gophkeeper-server/internal/models"
+	"github.com/wurt83ow/gophkeeper-server/internal/storage"
+	"golang.org/x/crypto/ssh"
+)
+
+// Table is the data table used by the conformance tests.
+const Table = "UserCredentials"
+
+// RunKeeperTests runs the conformance tests against the keeper returned by newKeeper.
+// The keeper may be shared between tests, so every test works with unique users and entries.
+func RunKeeperTests(t *testing.T, newKeeper func(t *testing.T) storage.Keeper) {
+	t.Run("Ping", func(t *testing.T) {
+		assert.True(t, newKeeper(t).Ping())
+	})
+
+	t.Run("Users", func(t *testing.T) {
+		testUsers(t, newKeeper(t))
+	})
+
+	t.Run("AddAndGetData", func(t *testing.T) {
+		testAddAndGetData(t, newKeeper(t))
+	})
+
+	t.Run("GeneratedID", func(t *testing.T) {
+		testGeneratedID(t, newKeeper(t))
+	})
+
+	t.Run("UserIsolation", func(t *testing.T) {
+		testUserIsolation(t, newKeeper(t))
+	})
+
+	t.Run("ExistenceLeak", func(t *testing.T) {
+		testExistenceLeak(t, newKeeper(t))
+	})
+
+	t.Run("UpdateData", func(t *testing.T) {
+		testUpdateData(t, newKeeper(t))
+	})
+
+	t.Run("DeleteData", func(t *testing.T) {
+		testDeleteData(t, newKeeper(t))
+	})
+
+	t.Run("UndeleteData", func(t *testing.T) {
+		testUndeleteData(t, newKeeper(t))
+	})
+
+	t.Run("History", func(t *testing.T) {
+		testHistory(t, newKeeper(t))
+	})
+
+	t.Run("GetData", func(t *testing.T) {
+		testGetData(t, newKeeper(t))
+	})
+
+	t.Run("Tags", func(t *testing.T) {
+		testTags(t, newKeeper(t))
+	})
+
+	t.Run("TagRename", func(t *testing.T) {
+		testTagRename(t, newKeeper(t))
+	})
+
+	t.Run("FieldCase", func(t *testing.T) {
+		testFieldCase(t, newKeeper(t))
+	})
+
+	t.Run("Projection", func(t *testing.T) {
+		testProjection(t, newKeeper(t))
+	})
+
+	t.Run("Filter", func(t *testing.T) {
+		testFilter(t, newKeeper(t))
+	})
+
+	t.Run("Order", func(t *testing.T) {
+		testOrder(t, newKeeper(t))
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		testExpiry(t, newKeeper(t))
+	})
+
+	t.Run("DryRun", func(t *testing.T) {
+		testDryRun(t, newKeeper(t))
+	})
+
+	t.Run("Search", func(t *testing.T) {
+		testSearch(t, newKeeper(t))
+	})
+
+	t.Run("SearchTextCap", func(t *testing.T) {
+		testSearchTextCap(t, newKeeper(t))
+	})
+
+	t.Run("Previews", func(t *testing.T) {
+		testPreviews(t, newKeeper(t))
+	})
+
+	t.Run("Seeds", func(t *testing.T) {
+		testSeeds(t, newKeeper(t))
+	})
+
+	t.Run("SshKeys", func(t *testing.T) {
+		testSshKeys(t, newKeeper(t))
+	})
+
+	t.Run("LastSync", func(t *testing.T) {
+		testLastSync(t, newKeeper(t))
+	})
+
+	t.Run("WriteTimestamps", func(t *testing.T) {
+		testWriteTimestamps(t, newKeeper(t))
+	})
+
+	t.Run("ClientTimestamps", func(t *testing.T) {
+		testClientTimestamps(t, newKeeper(t))
+	})
+
+	t.Run("ApplyChanges", func(t *testing.T) {
+		testApplyChanges(t, newKeeper(t))
+	})
+
+	t.Run("ApplyChangesRollback", func(t *testing.T) {
+		testApplyChangesRollback(t, newKeeper(t))
+	})
+
+	t.Run("ApplyChangesUnchanged", func(t *testing.T) {
+		testApplyChangesUnchanged(t, newKeeper(t))
+	})
+
+	t.Run("Sync", func(t *testing.T) {
+		testSync(t, newKeeper(t))
+	})
+	t.Run("ReplicateData", func(t *testing.T) {
+		testReplicateData(t, newKeeper(t))
+	})
+
+	t.Run("SyncRollback", func(t *testing.T) {
+		testSyncRollback(t, newKeeper(t))
+	})
+
+	t.Run("WithTx", func(t *testing.T) {
+		testWithTx(t, newKeeper(t))
+	})
+
+	t.Run("Audit", func(t *testing.T) {
+		testAudit(t, newKeeper(t))
+	})
+
+	t.Run("RefreshTokens", func(t *testing.T) {
+		testRefreshTokens(t, newKeeper(t))
+	})
+
+	t.Run("RevokedTokens", func(t *testing.T) {
+		testRevokedTokens(t, newKeeper(t))
+	})
+
+	t.Run("UpdatePassword", func(t *testing.T) {
+		testUpdatePassword(t, newKeeper(t))
+	})
+
+	t.Run("RehashPassword", func(t *testing.T) {
+		testRehashPassword(t, newKeeper(t))
+	})
+
+	t.Run("PendingData", func(t *testing.T) {
+		testPendingData(t, newKeeper(t))
+	})
+
+	t.Run("DataVersion", func(t *testing.T) {
+		testDataVersion(t, newKeeper(t))
+	})
+
+	t.Run("ExportData", func(t *testing.T) {
+		testExportData(t, newKeeper(t))
+	})
+
+	t.Run("LoginLockout", func(t *testing.T) {
+		testLoginLockout(t, newKeeper(t))
+	})
+
+	t.Run("LoginHistory", func(t *testing.T) {
+		testLoginHistory(t, newKeeper(t))
+	})
+
+	t.Run("UserManagement", func(t *testing.T) {
+		testUserManagement(t, newKeeper(t))
+	})
+
+	t.Run("APIKeys", func(t *testing.T) {
+		testAPIKeys(t, newKeeper(t))
+	})
+
+	t.Run("UserEmail", func(t *testing.T) {
+		testUserEmail(t, newKeeper(t))
+	})
+	t.Run("UserLanguage", func(t *testing.T) {
+		testUserLanguage(t, newKeeper(t))
+	})
+
+	t.Run("Devices", func(t *testing.T) {
+		testDevices(t, newKeeper(t))
+	})
+
+	t.Run("UserOperations", func(t *testing.T) {
+		testUserOperations(t, newKeeper(t))
+	})
+
+	t.Run("UploadSessions", func(t *testing.T) {
+		testUploadSessions(t, newKeeper(t))
+	})
+
+	t.Run("FileBlobs", func(t *testing.T) {
+		testFileBlobs(t, newKeeper(t))
+	})
+	t.Run("MonitorTokens", func(t *testing.T) {
+		testMonitorTokens(t, newKeeper(t))
+	})
+	t.Run("Shares", func(t *testing.T) {
+		testShares(t, newKeeper(t))
+	})
+	t.Run("ServerFields", func(t *testing.T) {
+		testServerFields(t, newKeeper(t))
+	})
+	t.Run("Folders", func(t *testing.T) {
+		testFolders(t, newKeeper(t))
+	})
+}
+
+// uniqueName returns a name that does not clash with the data of previous runs.
+func uniqueName(prefix string) string {
+	return fmt.Sprintf("%s-%d", prefix, time.Now().UnixNano())
+}
+
+// newUser registers a new user and returns its ID.
+func newUser(t *testing.T, k storage.Keeper) int {
+	t.Helper()
+
+	ctx := context.Background()
+	username := uniqueName("user")
+
+	require.NoError(t, k.AddUser(ctx, username, "hashedPassword"))
+	id, err := k.GetUserID(ctx, username)
+	require.NoError(t, err)
+
+	return id
+}
+
+// credential returns the fields of a UserCredentials entry.
+func credential(login string) map[string]string {
+	return map[string]string{
+		"login":     login,
+		"password":  "secret",
+		"meta_info": "meta",
+	}
+}
+
+func testUsers(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	username := uniqueName("user")
+
+	exists, err := k.UserExists(ctx, username)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	require.NoError(t, k.AddUser(ctx, username, "hashedPassword"))
+	assert.Error(t, k.AddUser(ctx, username, "hashedPassword"))
+
+	exists, err = k.UserExists(ctx, username)
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	password, err := k.GetPassword(ctx, username)
+	require.NoError(t, err)
+	assert.Equal(t, "hashedPassword", password)
+
+	id, err := k.GetUserID(ctx, username)
+	require.NoError(t, err)
+	assert.NotZero(t, id)
+
+	_, err = k.GetPassword(ctx, uniqueName("missing"))
+	assert.Error(t, err)
+
+	// A username is taken by the users having it and by those having a lookalike of it
+	taken, err := k.UsernameTaken(ctx, username)
+	require.NoError(t, err)
+	assert.True(t, taken)
+	taken, err = k.UsernameTaken(ctx, "_"+strings.ToUpper(strings.ReplaceAll(username, "u", "υ"))+"_")
+	require.NoError(t, err)
+	assert.True(t, taken)
+	taken, err = k.UsernameTaken(ctx, uniqueName("missing"))
+	require.NoError(t, err)
+	assert.False(t, taken)
+}
+
+func testAddAndGetData(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	entryID := uniqueName("entry")
+
+	added, _, err := k.AddData(ctx, Table, userID, entryID, credential("alice"))
+	require.NoError(t, err)
+	assert.Equal(t, entryID, added)
+	_, _, err = k.AddData(ctx, Table, userID, entryID, credential("alice"))
+	assert.Error(t, err)
+
+	data, err := k.GetAllData(ctx, Table, userID, models.DataQuery{})
+	require.NoError(t, err)
+	require.Len(t, data, 1)
+
+	assert.Equal(t, entryID, data[0]["id"])
+	assert.Equal(t, "alice", data[0]["login"])
+	assert.Equal(t, "secret", data[0]["password"])
+	assert.Equal(t, "meta", data[0]["meta_info"])
+	assert.Equal(t, "false", data[0]["deleted"])
+	assert.NotEmpty(t, data[0]["updated_at"])
+}
+
+func testGeneratedID(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+
+	// Entries added without an id get distinct UUIDs instead of colliding on an empty one
+	first, _, err := k.AddData(ctx, Table, userID, "", credential("alice"))
+	require.NoError(t, err)
+	second, _, err := k.AddData(ctx, Table, userID, "", credential("bob"))
+	require.NoError(t, err)
+	assert.NoError(t, models.ValidateEntryID(first))
+	assert.NoError(t, models.ValidateEntryID(second))
+	assert.NotEqual(t, first, second)
+
+	for id, login := range map[string]string{first: "alice", second: "bob"} {
+		data, err := k.GetData(ctx, Table, userID, id, false)
+		require.NoError(t, err)
+		assert.Equal(t, login, data["login"])
+	}
+	_, err = k.GetData(ctx, Table, userID, "", false)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+}
+
+func testUserIsolation(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	owner := newUser(t, k)
+	other := newUser(t, k)
+	entryID := uniqueName("entry")
+
+	_, _, err := k.AddData(ctx, Table, owner, entryID, credential("alice"))
+	require.NoError(t, err)
+
+	// Another user can neither see, change nor delete the entry
+	data, err := k.GetAllData(ctx, Table, other, models.DataQuery{InclDeleted: true})
+	require.NoError(t, err)
+	assert.Empty(t, data)
+
+	_, err = k.UpdateData(ctx, Table, other, entryID, map[string]string{"login": "mallory"})
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	_, err = k.DeleteData(ctx, Table, other, entryID)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	data, err = k.GetAllData(ctx, Table, owner, models.DataQuery{})
+	require.NoError(t, err)
+	require.Len(t, data, 1)
+	assert.Equal(t, "alice", data[0]["login"])
+}
+
+// outcome is the result of a single-entry operation as seen by a client.
+type outcome struct {
+	Found bool
+	Data  any
+	Err   string
+}
+
+// newOutcome returns the outcome of an operation, the timestamps of writes only tell whether one was made.
+func newOutcome(data any, err error) outcome {
+	o := outcome{Data: data}
+	if t, ok := data.(time.Time); ok {
+		o.Found, o.Data = !t.IsZero(), nil
+	}
+	if err != nil {
+		o.Err = err.Error()
+	}
+
+	return o
+}
+
+func testExistenceLeak(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	owner := newUser(t, k)
+	prober := newUser(t, k)
+	foreign, missing := uniqueName("foreign"), uniqueName("missing")
+
+	_, _, err := k.AddData(ctx, Table, owner, foreign, credential("alice"))
+	require.NoError(t, err)
+	_, err = k.UpdateData(ctx, Table, owner, foreign, map[string]string{"login": "bob"})
+	require.NoError(t, err)
+
+	// Every single-entry operation of another user sees the entry exactly like a missing one
+	probes := map[string]func(entryID string) outcome{
+		"GetData": func(entryID string) outcome {
+			return newOutcome(k.GetData(ctx, Table, prober, entryID, true))
+		},
+		"GetDataHistory": func(entryID string) outcome {
+			return newOutcome(k.GetDataHistory(ctx, Table, prober, entryID, 0))
+		},
+		"UpdateData": func(entryID string) outcome {
+			return newOutcome(k.UpdateData(ctx, Table, prober, entryID, map[string]string{"login": "mallory"}))
+		},
+		"DeleteData": func(entryID string) outcome {
+			return newOutcome(k.DeleteData(ctx, Table, prober, entryID))
+		},
+		"UndeleteData": func(entryID string) outcome {
+			return newOutcome(k.UndeleteData(ctx, Table, prober, entryID))
+		},
+		"ApplyChanges": func(entryID string) outcome {
+			results, err := k.ApplyChanges(ctx, prober, []models.Change{
+				{Table: Table, Op: models.ChangeDelete, EntryID: entryID, UpdatedAt: time.Now()},
+			})
+			var statuses []models.ChangeStatus
+			for _, r := range results {
+				statuses = append(statuses, r.Status)
+			}
+			return newOutcome(statuses, err)
+		},
+	}
+	for name, probe := range probes {
+		assert.Equal(t, probe(missing), probe(foreign), name)
+	}
+
+	// The probes left the entry of the owner alone
+	entry, err := k.GetData(ctx, Table, owner, foreign, false)
+	require.NoError(t, err)
+	assert.Equal(t, "bob", entry["login"])
+}
+
+func testUpdateData(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	entryID := uniqueName("entry")
+
+	_, _, err := k.AddData(ctx, Table, userID, entryID, credential("alice"))
+	require.NoError(t, err)
+	_, err = k.UpdateData(ctx, Table, userID, entryID, map[string]string{"login": "bob"})
+	require.NoError(t, err)
+
+	data, err := k.GetAllData(ctx, Table, userID, models.DataQuery{})
+	require.NoError(t, err)
+	require.Len(t, data, 1)
+	assert.Equal(t, "bob", data[0]["login"])
+	assert.Equal(t, "secret", data[0]["password"])
+}
+
+func testDeleteData(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	entryID := uniqueName("entry")
+
+	_, _, err := k.AddData(ctx, Table, userID, entryID, credential("alice"))
+	require.NoError(t, err)
+	_, err = k.DeleteData(ctx, Table, userID, entryID)
+	require.NoError(t, err)
+
+	_, err = k.DeleteData(ctx, Table, 0, entryID)
+	assert.Error(t, err)
+	_, err = k.DeleteData(ctx, Table, userID, "")
+	assert.Error(t, err)
+
+	data, err := k.GetAllData(ctx, Table, userID, models.DataQuery{})
+	require.NoError(t, err)
+	assert.Empty(t, data)
+
+	// Deleted entries are kept as tombstones for synchronization
+	data, err = k.GetAllData(ctx, Table, userID, models.DataQuery{InclDeleted: true})
+	require.NoError(t, err)
+	require.Len(t, data, 1)
+	assert.Equal(t, "true", data[0]["deleted"])
+}
+
+func testUndeleteData(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	entryID := uniqueName("entry")
+
+	_, _, err := k.AddData(ctx, Table, userID, entryID, credential("alice"))
+	require.NoError(t, err)
+	deleted, err := k.DeleteData(ctx, Table, userID, entryID)
+	require.NoError(t, err)
+
+	restored, err := k.UndeleteData(ctx, Table, userID, entryID)
+	require.NoError(t, err)
+	assert.True(t, restored.After(deleted))
+
+	// The restored entry is picked up by the next incremental synchronization
+	data, err := k.GetAllData(ctx, Table, userID, models.DataQuery{LastSync: deleted})
+	require.NoError(t, err)
+	require.Len(t, data, 1)
+	assert.Equal(t, entryID, data[0]["id"])
+	assert.Equal(t, "false", data[0]["deleted"])
+	assert.Equal(t, "alice", data[0]["login"])
+
+	_, err = k.UndeleteData(ctx, Table, userID, uniqueName("missing"))
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	_, err = k.UndeleteData(ctx, Table, newUser(t, k), entryID)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+}
+
+func testHistory(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	entryID := uniqueName("entry")
+
+	_, _, err := k.AddData(ctx, Table, userID, entryID, credential("alice"))
+	require.NoError(t, err)
+
+	versions, err := k.GetDataHistory(ctx, Table, userID, entryID, 0)
+	require.NoError(t, err)
+	assert.Empty(t, versions)
+
+	for _, login := range []string{"bob", "carol"} {
+		_, err = k.UpdateData(ctx, Table, userID, entryID, map[string]string{"login": login})
+		require.NoError(t, err)
+	}
+	_, err = k.DeleteData(ctx, Table, userID, entryID)
+	require.NoError(t, err)
+
+	// Every write keeps the state before it, newest first
+	versions, err = k.GetDataHistory(ctx, Table, userID, entryID, 0)
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+	assert.Equal(t, "carol", versions[0].Snapshot["login"])
+	assert.Equal(t, "bob", versions[1].Snapshot["login"])
+	assert.Equal(t, "alice", versions[2].Snapshot["login"])
+	assert.Equal(t, "secret", versions[2].Snapshot["password"])
+	assert.Equal(t, "false", versions[0].Snapshot["deleted"])
+	assert.False(t, versions[0].ChangedAt.Before(versions[1].ChangedAt))
+
+	versions, err = k.GetDataHistory(ctx, Table, userID, entryID, 1)
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+	assert.Equal(t, "carol", versions[0].Snapshot["login"])
+
+	// The restore is a write too, the deleted state is kept
+	_, err = k.UndeleteData(ctx, Table, userID, entryID)
+	require.NoError(t, err)
+	versions, err = k.GetDataHistory(ctx, Table, userID, entryID, 0)
+	require.NoError(t, err)
+	require.Len(t, versions, 4)
+	assert.Equal(t, "true", versions[0].Snapshot["deleted"])
+
+	// The history isn't visible to other users
+	versions, err = k.GetDataHistory(ctx, Table, newUser(t, k), entryID, 0)
+	require.NoError(t, err)
+	assert.Empty(t, versions)
+}
+
+func testGetData(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	entryID := uniqueName("entry")
+
+	_, _, err := k.AddData(ctx, Table, userID, entryID, credential("alice"))
+	require.NoError(t, err)
+
+	row, err := k.GetData(ctx, Table, userID, entryID, false)
+	require.NoError(t, err)
+	assert.Equal(t, entryID, row["id"])
+	assert.Equal(t, "alice", row["login"])
+
+	// Entries of other users are not found
+	_, err = k.GetData(ctx, Table, newUser(t, k), entryID, false)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	_, err = k.GetData(ctx, Table, userID, uniqueName("missing"), false)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+}
+
+func testFieldCase(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	entryID := uniqueName("entry")
+
+	// Field names are matched regardless of the case and returned in lower case
+	_, _, err := k.AddData(ctx, Table, userID, entryID, map[string]string{"Login": "alice", "PASSWORD": "secret"})
+	require.NoError(t, err)
+	_, err = k.UpdateData(ctx, Table, userID, entryID, map[string]string{"Meta_Info": "meta"})
+	require.NoError(t, err)
+
+	row, err := k.GetData(ctx, Table, userID, entryID, false)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", row["login"])
+	assert.Equal(t, "secret", row["password"])
+	assert.Equal(t, "meta", row["meta_info"])
+	assert.NotContains(t, row, "Login")
+
+	// Names differing only by case would set the same column twice
+	_, _, err = k.AddData(ctx, Table, userID, uniqueName("entry"), map[string]string{"login": "a", "LOGIN": "b", "password": "p"})
+	assert.ErrorIs(t, err, models.ErrInvalidChange)
+	_, err = k.UpdateData(ctx, Table, userID, entryID, map[string]string{"password": "a", "Password": "b"})
+	assert.ErrorIs(t, err, models.ErrInvalidChange)
+
+	row, err = k.GetData(ctx, Table, userID, entryID, false)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", row["password"])
+}
+
+func testProjection(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	entryID := uniqueName("entry")
+
+	_, _, err := k.AddData(ctx, Table, userID, entryID, credential("alice"))
+	require.NoError(t, err)
+
+	// The required columns are always returned, the others only when requested
+	data, err := k.GetAllData(ctx, Table, userID, models.DataQuery{Columns: []string{"meta_info"}})
+	require.NoError(t, err)
+	require.Len(t, data, 1)
+	assert.Equal(t, entryID, data[0]["id"])
+	assert.Equal(t, "meta", data[0]["meta_info"])
+	assert.Equal(t, "false", data[0]["deleted"])
+	assert.NotEmpty(t, data[0]["updated_at"])
+	assert.NotContains(t, data[0], "login")
+	assert.NotContains(t, data[0], "password")
+
+	// Without a projection the full entries are returned
+	data, err = k.GetAllData(ctx, Table, userID, models.DataQuery{})
+	require.NoError(t, err)
+	require.Len(t, data, 1)
+	assert.Equal(t, "alice", data[0]["login"])
+	assert.Equal(t, "secret", data[0]["password"])
+
+	// Unknown columns are rejected before querying the entries
+	_, err = k.GetAllData(ctx, Table, userID, models.DataQuery{Columns: []string{"meta_info", "no_such_column"}})
+	assert.ErrorIs(t, err, models.ErrUnknownColumn)
+	_, err = k.GetAllData(ctx, Table, userID, models.DataQuery{Columns: []string{"meta_info; DROP TABLE users"}})
+	assert.ErrorIs(t, err, models.ErrUnknownColumn)
+}
+
+func testFilter(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	bank, mail, old := uniqueName("bank"), uniqueName("mail"), uniqueName("old")
+
+	withMeta := func(login, meta string) map[string]string {
+		fields := credential(login)
+		fields["meta_info"] = meta
+		return fields
+	}
+
+	_, _, err := k.AddData(ctx, Table, userID, old, withMeta("carol", "Old Bank account"))
+	require.NoError(t, err)
+	_, err = k.DeleteData(ctx, Table, userID, old)
+	require.NoError(t, err)
+	deletedAt := entryUpdatedAt(t, k, userID, old)
+
+	_, _, err = k.AddData(ctx, Table, userID, bank, withMeta("alice", "My Bank account"))
+	require.NoError(t, err)
+	_, _, err = k.AddData(ctx, Table, userID, mail, withMeta("bob", "Mail"))
+	require.NoError(t, err)
+	_, _, err = k.AddData(ctx, Table, newUser(t, k), uniqueName("foreign"), withMeta("alice", "Bank"))
+	require.NoError(t, err)
+
+	ids := func(q models.DataQuery) []string {
+		data, err := k.GetAllData(ctx, Table, userID, q)
+		require.NoError(t, err)
+
+		var ids []string
+		for _, row := range data {
+			ids = append(ids, row["id"])
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	where := func(column string, op models.FilterOp, value string) models.DataQuery {
+		return models.DataQuery{Filter: models.Filter{{Column: column, Op: op, Value: value}}}
+	}
+
+	assert.Equal(t, []string{bank}, ids(where("login", models.FilterEq, "alice")))
+	assert.Equal(t, []string{mail}, ids(where("login", models.FilterNe, "alice")))
+	assert.Equal(t, []string{bank}, ids(where("meta_info", models.FilterILike, "%BANK%")))
+	assert.Equal(t, []string{bank}, ids(where("login", models.FilterLt, "b")))
+	assert.Equal(t, []string{mail}, ids(where("login", models.FilterGt, "alice")))
+
+	// The filter is combined with the other conditions of the query
+	assert.Empty(t, ids(where("deleted", models.FilterEq, "true")))
+	q := where("meta_info", models.FilterILike, "%bank%")
+	q.InclDeleted = true
+	assert.Equal(t, sortedIDs(bank, old), ids(q))
+	q.Filter = append(q.Filter, models.Condition{Column: "deleted", Op: models.FilterEq, Value: "true"})
+	assert.Equal(t, []string{old}, ids(q))
+	hourAgo := deletedAt.Add(-time.Hour).Format(time.RFC3339Nano)
+	q.Filter = models.Filter{{Column: "updated_at", Op: models.FilterGt, Value: hourAgo}}
+	assert.Equal(t, sortedIDs(bank, mail, old), ids(q))
+	q.Filter = models.Filter{{Column: "updated_at", Op: models.FilterLt, Value: hourAgo}}
+	assert.Empty(t, ids(q))
+
+	// Values are compared as data, not as SQL
+	assert.Empty(t, ids(where("login", models.FilterEq, "' OR '1'='1")))
+	assert.Empty(t, ids(where("login", models.FilterILike, "%' OR login LIKE '%")))
+
+	// Column names and operators are validated before querying the entries
+	invalid := []struct {
+		filter models.Filter
+		err    error
+	}{
+		{models.Filter{{Column: "login = login OR 1=1 --", Op: models.FilterEq, Value: "x"}}, models.ErrUnknownColumn},
+		{models.Filter{{Column: "no_such_column", Op: models.FilterEq, Value: "x"}}, models.ErrUnknownColumn},
+		{models.Filter{{Column: "login", Op: "= 'x' OR 1=1 --", Value: "x"}}, models.ErrInvalidQuery},
+		{models.Filter{{Column: "login", Op: "LIKE", Value: "x"}}, models.ErrInvalidQuery},
+		{models.Filter{{Column: models.TagsField, Op: models.FilterEq, Value: "x"}}, models.ErrInvalidQuery},
+		{models.Filter{{Column: "deleted", Op: models.FilterEq, Value: "maybe"}}, models.ErrInvalidQuery},
+		{models.Filter{{Column: "updated_at", Op: models.FilterGt, Value: "yesterday"}}, models.ErrInvalidQuery},
+	}
+	for _, tt := range invalid {
+		_, err := k.GetAllData(ctx, Table, userID, models.DataQuery{Filter: tt.filter})
+		assert.ErrorIs(t, err, tt.err, "filter %v", tt.filter)
+	}
+
+	// The entries are intact after the attempts
+	assert.Len(t, ids(models.DataQuery{}), 2)
+}
+
+func testOrder(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+
+	// The ids increase with the creation, so entries created within the same
+	// timestamp tick are still ordered by the tiebreaker
+	a, b, c := uniqueName("entry"), uniqueName("entry"), uniqueName("entry")
+	now := time.Now().UTC()
+	entries := []struct {
+		id, meta  string
+		expiresAt time.Time
+	}{
+		{a, "beta", now.Add(time.Hour)},
+		{b, "alpha", now.Add(2 * time.Hour)},
+		{c, "beta", time.Time{}},
+	}
+	for _, e := range entries {
+		fields := credential("alice")
+		fields["meta_info"] = e.meta
+		if !e.expiresAt.IsZero() {
+			fields[models.ExpiresAtField] = e.expiresAt.Format(time.RFC3339)
+		}
+		_, _, err := k.AddData(ctx, Table, userID, e.id, fields)
+		require.NoError(t, err)
+	}
+
+	ids := func(o models.Order) []string {
+		data, err := k.GetAllData(ctx, Table, userID, models.DataQuery{OrderBy: o})
+		require.NoError(t, err)
+
+		var ids []string
+		for _, row := range data {
+			ids = append(ids, row["id"])
+		}
+		return ids
+	}
+
+	// The most recently updated entries come first by default
+	assert.Equal(t, []string{c, b, a}, ids(models.Order{}))
+	assert.Equal(t, []string{c, b, a}, ids(models.DefaultOrder))
+
+	// Equal values are ordered by id in the same direction
+	assert.Equal(t, []string{b, a, c}, ids(models.Order{Column: "meta_info"}))
+	assert.Equal(t, []string{c, a, b}, ids(models.Order{Column: "META_INFO", Desc: true}))
+
+	// NULLs come last in both directions
+	assert.Equal(t, []string{a, b, c}, ids(models.Order{Column: models.ExpiresAtField}))
+	assert.Equal(t, []string{b, a, c}, ids(models.Order{Column: models.ExpiresAtField, Desc: true}))
+
+	_, err := k.GetAllData(ctx, Table, userID, models.DataQuery{OrderBy: models.Order{Column: "meta_info DESC; --"}})
+	assert.ErrorIs(t, err, models.ErrUnknownColumn)
+}
+
+// sortedIDs returns the entry IDs in ascending order.
+func sortedIDs(ids ...string) []string {
+	sort.Strings(ids)
+	return ids
+}
+
+func testTags(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	work, bank, none := uniqueName("work"), uniqueName("bank"), uniqueName("none")
+
+	withTags := func(tags string) map[string]string {
+		fields := credential("alice")
+		fields[models.TagsField] = tags
+		return fields
+	}
+
+	// Both list formats are accepted, tags are stored in lower case without duplicates
+	_, _, err := k.AddData(ctx, Table, userID, work, withTags(" Work , home office,work"))
+	require.NoError(t, err)
+	_, _, err = k.AddData(ctx, Table, userID, bank, withTags(`["Banking", "null"]`))
+	require.NoError(t, err)
+	_, _, err = k.AddData(ctx, Table, userID, none, credential("alice"))
+	require.NoError(t, err)
+	_, _, err = k.AddData(ctx, Table, newUser(t, k), uniqueName("foreign"), withTags("work"))
+	require.NoError(t, err)
+
+	row, err := k.GetData(ctx, Table, userID, work, false)
+	require.NoError(t, err)
+	assert.Equal(t, "work,home office", row[models.TagsField])
+
+	row, err = k.GetData(ctx, Table, userID, bank, false)
+	require.NoError(t, err)
+	assert.Equal(t, "banking,null", row[models.TagsField])
+
+	ids := func(tag string) []string {
+		data, err := k.GetAllData(ctx, Table, userID, models.DataQuery{Tag: tag})
+		require.NoError(t, err)
+
+		var ids []string
+		for _, row := range data {
+			ids = append(ids, row["id"])
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	// Tags are matched as a whole and case-insensitively
+	assert.Equal(t, []string{work}, ids("WORK"))
+	assert.Equal(t, []string{work}, ids("home office"))
+	assert.Equal(t, []string{bank}, ids("banking"))
+	assert.Empty(t, ids("bank"))
+	assert.Len(t, ids(""), 3)
+
+	// Updates replace the tags
+	_, err = k.UpdateData(ctx, Table, userID, work, map[string]string{models.TagsField: "banking"})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{bank, work}, ids("banking"))
+	assert.Empty(t, ids("work"))
+
+	// Empty tags are rejected
+	for _, tags := range []string{"work,,banking", `["work", " "]`, `{"work"}`, `["a"`} {
+		_, _, err := k.AddData(ctx, Table, userID, uniqueName("invalid"), withTags(tags))
+		assert.ErrorIs(t, err, models.ErrInvalidChange, tags)
+	}
+	_, err = k.UpdateData(ctx, Table, userID, work, map[string]string{models.TagsField: ","})
+	assert.ErrorIs(t, err, models.ErrInvalidChange)
+}
+
+func testTagRename(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	banks, both, other := uniqueName("banks"), uniqueName("both"), uniqueName("other")
+
+	withTags := func(tags string) map[string]string {
+		fields := credential("alice")
+		fields[models.TagsField] = tags
+		return fields
+	}
+	_, _, err := k.AddData(ctx, Table, userID, banks, withTags("banks,work"))
+	require.NoError(t, err)
+	_, _, err = k.AddData(ctx, Table, userID, both, withTags("banking,banks"))
+	require.NoError(t, err)
+	_, _, err = k.AddData(ctx, Table, userID, other, withTags("work"))
+	require.NoError(t, err)
+	foreignID, foreign := newUser(t, k), uniqueName("foreign")
+	_, _, err = k.AddData(ctx, Table, foreignID, foreign, withTags("banks"))
+	require.NoError(t, err)
+	last, err := k.GetData(ctx, Table, userID, other, false)
+	require.NoError(t, err)
+	since, err := time.Parse(time.RFC3339Nano, last["updated_at"])
+	require.NoError(t, err)
+
+	// The tag is replaced in place, an entry which already has the new one keeps it once
+	renamed, err := k.RenameTag(ctx, userID, " Banks", "BANKING")
+	require.NoError(t, err)
+	assert.Equal(t, 2, renamed)
+	row, err := k.GetData(ctx, Table, userID, banks, false)
+	require.NoError(t, err)
+	assert.Equal(t, "banking,work", row[models.TagsField])
+	row, err = k.GetData(ctx, Table, userID, both, false)
+	require.NoError(t, err)
+	assert.Equal(t, "banking", row[models.TagsField])
+	row, err = k.GetData(ctx, Table, foreignID, foreign, false)
+	require.NoError(t, err)
+	assert.Equal(t, "banks", row[models.TagsField])
+
+	// The renamed entries are synchronized again, but the rename keeps no version
+	data, err := k.GetAllData(ctx, Table, userID, models.DataQuery{LastSync: since})
+	require.NoError(t, err)
+	var synced []string
+	for _, row := range data {
+		synced = append(synced, row["id"])
+	}
+	assert.ElementsMatch(t, []string{banks, both}, synced)
+	history, err := k.GetDataHistory(ctx, Table, userID, banks, 0)
+	require.NoError(t, err)
+	assert.Empty(t, history)
+
+	// Renaming to the same tag, whatever the case, or an unused tag changes nothing
+	for _, to := range []string{"banking", "Banking"} {
+		renamed, err = k.RenameTag(ctx, userID, "banking", to)
+		require.NoError(t, err)
+		assert.Zero(t, renamed)
+	}
+	renamed, err = k.RenameTag(ctx, userID, "unused", "other")
+	require.NoError(t, err)
+	assert.Zero(t, renamed)
+
+	for _, to := range []string{"", " ", "a,b", `"quoted"`} {
+		_, err = k.RenameTag(ctx, userID, "work", to)
+		assert.ErrorIs(t, err, models.ErrInvalidChange, to)
+	}
+}
+
+func testExpiry(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	gone, later, plain := uniqueName("gone"), uniqueName("later"), uniqueName("plain")
+
+	expiring := func(at time.Time) map[string]string {
+		fields := credential("alice")
+		fields[models.ExpiresAtField] = at.Format(time.RFC3339Nano)
+		return fields
+	}
+
+	_, _, err := k.AddData(ctx, Table, userID, gone, expiring(time.Now().Add(-time.Hour)))
+	require.NoError(t, err)
+	_, _, err = k.AddData(ctx, Table, userID, later, expiring(time.Now().Add(time.Hour)))
+	require.NoError(t, err)
+	_, _, err = k.AddData(ctx, Table, userID, plain, credential("alice"))
+	require.NoError(t, err)
+
+	ids := func(q models.DataQuery) []string {
+		data, err := k.GetAllData(ctx, Table, userID, q)
+		require.NoError(t, err)
+
+		var ids []string
+		for _, row := range data {
+			if row["deleted"] == "false" {
+				ids = append(ids, row["id"])
+			}
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	// Expired entries are hidden before the job deletes them, unless asked for
+	assert.ElementsMatch(t, []string{later, plain}, ids(models.DataQuery{}))
+	assert.ElementsMatch(t, []string{gone, later, plain}, ids(models.DataQuery{InclExpired: true}))
+
+	_, err = k.GetData(ctx, Table, userID, gone, false)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	_, err = k.GetData(ctx, Table, userID, gone, true)
+	assert.NoError(t, err)
+
+	// The job deletes the expired entries, the tombstones reach the clients with the next synchronization
+	before := entryUpdatedAt(t, k, userID, gone)
+	expired, err := k.ExpireData(ctx)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, expired, 1)
+
+	data, err := k.GetAllData(ctx, Table, userID, models.DataQuery{LastSync: before, InclDeleted: true, InclExpired: true})
+	require.NoError(t, err)
+	deleted := make(map[string]string)
+	for _, row := range data {
+		deleted[row["id"]] = row["deleted"]
+	}
+	assert.Equal(t, "true", deleted[gone])
+	assert.NotEqual(t, "true", deleted[later])
+
+	// A new expiry revives the expired entry
+	_, err = k.UpdateData(ctx, Table, userID, gone, map[string]string{models.ExpiresAtField: time.Now().Add(time.Hour).Format(time.RFC3339)})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{gone, later, plain}, ids(models.DataQuery{}))
+
+	// An empty expiry clears it
+	_, err = k.UpdateData(ctx, Table, userID, later, map[string]string{models.ExpiresAtField: ""})
+	require.NoError(t, err)
+	row, err := k.GetData(ctx, Table, userID, later, false)
+	require.NoError(t, err)
+	assert.Empty(t, row[models.ExpiresAtField])
+
+	_, err = k.UpdateData(ctx, Table, userID, plain, map[string]string{models.ExpiresAtField: "tomorrow"})
+	assert.ErrorIs(t, err, models.ErrInvalidChange)
+}
+
+func testSearch(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	other := newUser(t, k)
+	cabin, home, gone := uniqueName("cabin"), uniqueName("home"), uniqueName("gone")
+
+	withMeta := func(meta string) map[string]string {
+		fields := credential("alice")
+		fields["meta_info"] = meta
+		return fields
+	}
+
+	_, _, err := k.AddData(ctx, Table, userID, cabin, withMeta("WiFi password for the cabin"))
+	require.NoError(t, err)
+	_, _, err = k.AddData(ctx, Table, userID, home, withMeta("wifi at home"))
+	require.NoError(t, err)
+	_, _, err = k.AddData(ctx, Table, userID, gone, withMeta("old wifi of the cabin"))
+	require.NoError(t, err)
+	_, err = k.DeleteData(ctx, Table, userID, gone)
+	require.NoError(t, err)
+	_, _, err = k.AddData(ctx, Table, other, uniqueName("foreign"), withMeta("wifi cabin"))
+	require.NoError(t, err)
+
+	// All terms must match, deleted entries and other users' entries are excluded
+	results, err := k.SearchData(ctx, userID, "cabin WIFI", nil, 0, false)
+	require.NoError(t, err)
+	require.Len(t, results[Table], 1)
+	assert.Equal(t, cabin, results[Table][0]["id"])
+	assert.Equal(t, "alice", results[Table][0]["login"])
+
+	// Most recently updated first, an update always moves the entry after the others
+	_, err = k.UpdateData(ctx, Table, userID, home, map[string]string{"login": "bob"})
+	require.NoError(t, err)
+
+	results, err = k.SearchData(ctx, userID, "wifi", []string{Table}, 0, false)
+	require.NoError(t, err)
+	require.Len(t, results[Table], 2)
+	assert.Equal(t, home, results[Table][0]["id"])
+
+	results, err = k.SearchData(ctx, userID, "wifi", []string{Table}, 1, false)
+	require.NoError(t, err)
+	assert.Len(t, results[Table], 1)
+
+	results, err = k.SearchData(ctx, userID, "wifi", []string{"TextData"}, 0, false)
+	require.NoError(t, err)
+	assert.Empty(t, results)
+
+	_, err = k.SearchData(ctx, userID, "  ", nil, 0, false)
+	assert.ErrorIs(t, err, models.ErrInvalidQuery)
+
+	_, err = k.SearchData(ctx, userID, "wifi", []string{"Users"}, 0, false)
+	assert.ErrorIs(t, err, models.ErrInvalidQuery)
+}
+
+func testSearchTextCap(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	atCap, beyond := uniqueName("at-cap"), uniqueName("beyond")
+
+	withMeta := func(meta string) map[string]string {
+		fields := credential("alice")
+		fields["meta_info"] = meta
+		return fields
+	}
+
+	// The cap counts characters, the filler takes two bytes each
+	full := "harbor " + strings.Repeat("é", models.MaxSearchText-len("harbor ")-len(" lighthouse")) + " lighthouse"
+	long := "anchor " + strings.Repeat("é", models.MaxSearchText) + " beacon"
+	_, _, err := k.AddData(ctx, Table, userID, atCap, withMeta(full))
+	require.NoError(t, err)
+	_, _, err = k.AddData(ctx, Table, userID, beyond, withMeta(long))
+	require.NoError(t, err)
+
+	// A text at the cap is indexed whole
+	results, err := k.SearchData(ctx, userID, "lighthouse harbor", nil, 0, false)
+	require.NoError(t, err)
+	require.Len(t, results[Table], 1)
+	assert.Equal(t, atCap, results[Table][0]["id"])
+
+	// Beyond the cap only the retained prefix matches, the entry is still returned whole
+	results, err = k.SearchData(ctx, userID, "anchor", nil, 0, false)
+	require.NoError(t, err)
+	require.Len(t, results[Table], 1)
+	assert.Equal(t, long, results[Table][0]["meta_info"])
+
+	results, err = k.SearchData(ctx, userID, "beacon", nil, 0, false)
+	require.NoError(t, err)
+	assert.Empty(t, results)
+
+	// An update moving the term past the cap stops it matching
+	_, err = k.UpdateData(ctx, Table, userID, atCap, map[string]string{"meta_info": "é" + full})
+	require.NoError(t, err)
+	results, err = k.SearchData(ctx, userID, "lighthouse", nil, 0, false)
+	require.NoError(t, err)
+	assert.Empty(t, results)
+
+	data, err := k.GetData(ctx, Table, userID, atCap, false)
+	require.NoError(t, err)
+	assert.Equal(t, "é"+full, data["meta_info"])
+}
+
+func testPreviews(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	note, other := uniqueName("note"), uniqueName("other")
+
+	// The preview is kept on a single line, without the control characters
+	_, _, err := k.AddData(ctx, models.PreviewTable, userID, note, map[string]string{
+		"data": "sealed", "meta_info": "groceries", models.PreviewField: "  Milk,\r\n\teggs\x00 and\x1b bread ",
+	})
+	require.NoError(t, err)
+	atCap := strings.Repeat("é", models.MaxPreviewChars)
+	_, _, err = k.AddData(ctx, models.PreviewTable, userID, other, map[string]string{
+		"data": "sealed", "meta_info": "other", models.PreviewField: atCap,
+	})
+	require.NoError(t, err)
+
+	data, err := k.GetAllData(ctx, models.PreviewTable, userID, models.DataQuery{Columns: models.TableListColumns(models.PreviewTable)})
+	require.NoError(t, err)
+	require.Len(t, data, 2)
+	byID := map[string]map[string]string{data[0]["id"]: data[0], data[1]["id"]: data[1]}
+	assert.Equal(t, "Milk, eggs and bread", byID[note][models.PreviewField])
+	assert.Equal(t, atCap, byID[other][models.PreviewField])
+	assert.NotContains(t, byID[note], "data")
+
+	// The cap counts characters, a longer preview is rejected rather than cut
+	_, err = k.UpdateData(ctx, models.PreviewTable, userID, note, map[string]string{models.PreviewField: atCap + "é"})
+	assert.ErrorIs(t, err, models.ErrInvalidChange)
+
+	// Only the notes have a preview
+	_, _, err = k.AddData(ctx, Table, userID, uniqueName("credential"), map[string]string{
+		"login": "alice", "password": "secret", models.PreviewField: "alice",
+	})
+	assert.ErrorIs(t, err, models.ErrInvalidChange)
+
+	// The search matches the preview with the meta information
+	results, err := k.SearchData(ctx, userID, "eggs groceries", nil, 0, false)
+	require.NoError(t, err)
+	require.Len(t, results[models.PreviewTable], 1)
+	assert.Equal(t, note, results[models.PreviewTable][0]["id"])
+
+	_, err = k.UpdateData(ctx, models.PreviewTable, userID, note, map[string]string{models.PreviewField: "Flour"})
+	require.NoError(t, err)
+	results, err = k.SearchData(ctx, userID, "eggs", nil, 0, false)
+	require.NoError(t, err)
+	assert.Empty(t, results)
+	results, err = k.SearchData(ctx, userID, "flour", []string{models.PreviewTable}, 0, false)
+	require.NoError(t, err)
+	assert.Len(t, results[models.PreviewTable], 1)
+}
+
+func testSeeds(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	seed, linked := uniqueName("seed"), models.NewEntryID()
+
+	// The secret is stored as the apps show it too, in groups of lower case letters
+	_, _, err := k.AddData(ctx, models.OtpTable, userID, seed, map[string]string{
+		models.OtpSecretField: "jbsw y3dp-ehpk 3pxp==", "issuer": "Example", "account": "alice@example.com",
+		models.OtpAlgorithmField: "sha-256", models.OtpDigitsField: "08", models.OtpLinkedField: linked,
+	})
+	require.NoError(t, err)
+	data, err := k.GetData(ctx, models.OtpTable, userID, seed, false)
+	require.NoError(t, err)
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", data[models.OtpSecretField])
+	assert.Equal(t, "SHA256", data[models.OtpAlgorithmField])
+	assert.Equal(t, "8", data[models.OtpDigitsField])
+	assert.Empty(t, data[models.OtpPeriodField])
+	assert.Equal(t, linked, data[models.OtpLinkedField])
+
+	// The list shows whose seed it is, not the secret
+	list, err := k.GetAllData(ctx, models.OtpTable, userID, models.DataQuery{Columns: models.TableListColumns(models.OtpTable)})
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, "Example", list[0]["issuer"])
+	assert.NotContains(t, list[0], models.OtpSecretField)
+
+	for _, fields := range []map[string]string{
+		{models.OtpSecretField: "not base32!"},
+		{models.OtpSecretField: ""},
+		{models.OtpAlgorithmField: "MD5"},
+		{models.OtpDigitsField: "5"},
+		{models.OtpPeriodField: "0"},
+		{models.OtpLinkedField: "entry"},
+	} {
+		_, err = k.UpdateData(ctx, models.OtpTable, userID, seed, fields)
+		assert.ErrorIs(t, err, models.ErrInvalidChange, fields)
+	}
+
+	_, err = k.UpdateData(ctx, models.OtpTable, userID, seed, map[string]string{models.OtpPeriodField: "60"})
+	require.NoError(t, err)
+	data, err = k.GetData(ctx, models.OtpTable, userID, seed, false)
+	require.NoError(t, err)
+	assert.Equal(t, "60", data[models.OtpPeriodField])
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", data[models.OtpSecretField])
+}
+
+func testSshKeys(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	pair := uniqueName("ssh")
+	laptop, laptopFingerprint := sshPublicKey(t)
+	server, serverFingerprint := sshPublicKey(t)
+
+	// The fingerprint is the server's, whatever the client sends
+	_, _, err := k.AddData(ctx, models.SshKeysTable, userID, pair, map[string]string{
+		models.SshPrivateKeyField: "sealed", models.SshPublicKeyField: "  " + laptop + " alice@laptop\n",
+		"title": "Laptop", models.SshFingerprintField: serverFingerprint,
+	})
+	require.NoError(t, err)
+	data, err := k.GetData(ctx, models.SshKeysTable, userID, pair, false)
+	require.NoError(t, err)
+	assert.Equal(t, laptop+" alice@laptop", data[models.SshPublicKeyField])
+	assert.Equal(t, laptopFingerprint, data[models.SshFingerprintField])
+	assert.Equal(t, "sealed", data[models.SshPrivateKeyField])
+
+	lookup := func(fingerprint string) []map[string]string {
+		t.Helper()
+		data, err := k.GetAllData(ctx, models.SshKeysTable, userID, models.DataQuery{
+			Columns: models.TableListColumns(models.SshKeysTable),
+			Filter:  models.Filter{{Column: models.SshFingerprintField, Op: models.FilterEq, Value: fingerprint}},
+		})
+		require.NoError(t, err)
+		return data
+	}
+	found := lookup(laptopFingerprint)
+	require.Len(t, found, 1)
+	assert.Equal(t, "Laptop", found[0]["title"])
+	assert.NotContains(t, found[0], models.SshPrivateKeyField)
+	assert.Empty(t, lookup(serverFingerprint))
+
+	for _, fields := range []map[string]string{
+		{models.SshPublicKeyField: "ssh-ed25519 not-a-key"},
+		{models.SshPublicKeyField: laptop + "\n" + server},
+		{models.SshPublicKeyField: ""},
+		{models.SshPrivateKeyField: " "},
+	} {
+		_, err = k.UpdateData(ctx, models.SshKeysTable, userID, pair, fields)
+		assert.ErrorIs(t, err, models.ErrInvalidChange, fields)
+	}
+
+	// The fingerprint follows the public key
+	_, err = k.UpdateData(ctx, models.SshKeysTable, userID, pair, map[string]string{
+		"title": "Server", models.SshFingerprintField: laptopFingerprint,
+	})
+	require.NoError(t, err)
+	assert.Len(t, lookup(laptopFingerprint), 1)
+	_, err = k.UpdateData(ctx, models.SshKeysTable, userID, pair, map[string]string{models.SshPublicKeyField: server})
+	require.NoError(t, err)
+	assert.Empty(t, lookup(laptopFingerprint))
+	assert.Len(t, lookup(serverFingerprint), 1)
+}
+
+// sshPublicKey returns a new public key in the authorized_keys format, without a comment, and its fingerprint.
+func sshPublicKey(t *testing.T) (key, fingerprint string) {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	sshKey, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshKey))), ssh.FingerprintSHA256(sshKey)
+}
+
+func testLastSync(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	entryID := uniqueName("entry")
+
+	_, _, err := k.AddData(ctx, Table, userID, entryID, credential("alice"))
+	require.NoError(t, err)
+
+	data, err := k.GetAllData(ctx, Table, userID, models.DataQuery{LastSync: time.Now().Add(-24 * time.Hour), InclDeleted: true})
+	require.NoError(t, err)
+	assert.Len(t, data, 1)
+
+	data, err = k.GetAllData(ctx, Table, userID, models.DataQuery{LastSync: time.Now().Add(24 * time.Hour), InclDeleted: true})
+	require.NoError(t, err)
+	assert.Empty(t, data)
+}
+
+func testDryRun(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+
+	expired := []string{uniqueName("expired"), uniqueName("expired")}
+	for _, id := range expired {
+		fields := credential("alice")
+		fields[models.ExpiresAtField] = time.Now().Add(-time.Hour).Format(time.RFC3339Nano)
+		_, _, err := k.AddData(ctx, Table, userID, id, fields)
+		require.NoError(t, err)
+	}
+	before := entryUpdatedAt(t, k, userID, expired[0])
+
+	// The dry run reports the expired entries and changes none of them
+	preview, err := k.PreviewExpiry(ctx, 1000)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, preview.Count, len(expired))
+	assert.Len(t, preview.Sample, preview.Count)
+	for _, id := range expired {
+		assert.Contains(t, preview.Sample, Table+"/"+id)
+		row, err := k.GetData(ctx, Table, userID, id, true)
+		require.NoError(t, err)
+		assert.Equal(t, "false", row["deleted"])
+	}
+	assert.Equal(t, before, entryUpdatedAt(t, k, userID, expired[0]))
+
+	limited, err := k.PreviewExpiry(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, preview.Count, limited.Count)
+	assert.Len(t, limited.Sample, 1)
+
+	// The job deletes what the dry run reported
+	n, err := k.ExpireData(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, preview.Count, n)
+	preview, err = k.PreviewExpiry(ctx, 10)
+	require.NoError(t, err)
+	assert.Zero(t, preview.Count)
+	assert.Empty(t, preview.Sample)
+
+	// The same for the audit events
+	for i := 0; i < 3; i++ {
+		require.NoError(t, k.AddAuditEvent(ctx, models.AuditEvent{UserID: userID, Action: models.AuditLogin, Success: true}))
+	}
+	events, err := k.GetAuditEvents(ctx, userID, time.Time{}, 0)
+	require.NoError(t, err)
+	cutoff := time.Now().Add(time.Hour)
+
+	auditPreview, err := k.PreviewAuditPruning(ctx, cutoff, 1000)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, auditPreview.Count, len(events))
+	for _, ev := range events {
+		assert.Contains(t, auditPreview.Sample, fmt.Sprintf("audit_log/%d", ev.ID))
+	}
+	kept, err := k.GetAuditEvents(ctx, userID, time.Time{}, 0)
+	require.NoError(t, err)
+	assert.Equal(t, events, kept)
+
+	notYet, err := k.PreviewAuditPruning(ctx, events[len(events)-1].CreatedAt, 10)
+	require.NoError(t, err)
+	assert.NotContains(t, notYet.Sample, fmt.Sprintf("audit_log/%d", events[len(events)-1].ID))
+
+	n, err = k.PruneAuditEvents(ctx, cutoff)
+	require.NoError(t, err)
+	assert.Equal(t, auditPreview.Count, n)
+}
+
+// testReplicateData checks that the entries read from a primary server are stored with their ids, versions
+// and tombstones, so that the checksums of the vaults agree.
+func testReplicateData(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	otherID := newUser(t, k)
+	first, second := uniqueName("first"), uniqueName("second")
+
+	// The entries as a primary server sends them, with the id of its user and a warning of its read.
+	// SQLite keeps the milliseconds of the timestamps only
+	at := time.Now().UTC().Add(-time.Hour).Truncate(time.Millisecond)
+	primaryRow := func(id string, at time.Time, deleted bool, login string) map[string]string {
+		row := credential(login)
+		row["id"], row["user_id"], row["deleted"] = id, "999999", strconv.FormatBool(deleted)
+		row["updated_at"] = at.Format(time.RFC3339Nano)
+		row[models.DataWarning] = "checksum_mismatch"
+		return row
+	}
+	rows := []map[string]string{primaryRow(first, at, false, "alice"), primaryRow(second, at.Add(time.Second), false, "bob")}
+
+	n, err := k.ReplicateData(ctx, Table, userID, rows)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	entry, err := k.GetData(ctx, Table, userID, first, true)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", entry["login"])
+	assert.Equal(t, strconv.Itoa(userID), entry["user_id"])
+	assert.Empty(t, entry[models.DataWarning])
+	assert.True(t, at.Equal(entryUpdatedAt(t, k, userID, first)), "the version of the primary is kept")
+
+	// The entries already at their version are skipped
+	n, err = k.ReplicateData(ctx, Table, userID, rows)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	// A tombstone replaces the entry
+	tombstone := primaryRow(second, at.Add(2*time.Second), true, "bob")
+	n, err = k.ReplicateData(ctx, Table, userID, []map[string]string{tombstone})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	local, err := k.GetAllData(ctx, Table, userID, models.VaultChecksumQuery)
+	require.NoError(t, err)
+	assert.Equal(t, models.ChecksumVault(0, map[string][]map[string]string{Table: {rows[0], tombstone}}).Checksum,
+		models.ChecksumVault(0, map[string][]map[string]string{Table: local}).Checksum)
+
+	// The entry of another user isn't taken over, and nothing of the batch is stored
+	third := uniqueName("third")
+	_, err = k.ReplicateData(ctx, Table, otherID, []map[string]string{primaryRow(third, at, false, "carol"), primaryRow(first, at, false, "eve")})
+	assert.ErrorIs(t, err, models.ErrInvalidChange)
+	_, err = k.GetData(ctx, Table, otherID, third, true)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	entry, err = k.GetData(ctx, Table, userID, first, true)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", entry["login"])
+}
+
+// entryUpdatedAt returns the 'updated_at' field of an entry as seen by a client.
+func entryUpdatedAt(t *testing.T, k storage.Keeper, userID int, entryID string) time.Time {
+	t.Helper()
+
+	data, err := k.GetAllData(context.Background(), Table, userID, models.DataQuery{InclDeleted: true, InclExpired: true})
+	require.NoError(t, err)
+
+	for _, row := range data {
+		if row["id"] == entryID {
+			updatedAt, err := time.Parse(time.RFC3339Nano, row["updated_at"])
+			require.NoError(t, err)
+			return updatedAt
+		}
+	}
+
+	t.Fatalf("entry %s not found", entryID)
+	return time.Time{}
+}
+
+func testWriteTimestamps(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	entryID := uniqueName("entry")
+
+	_, added, err := k.AddData(ctx, Table, userID, entryID, credential("alice"))
+	require.NoError(t, err)
+	assert.True(t, added.Equal(entryUpdatedAt(t, k, userID, entryID)))
+
+	// The returned timestamp is the watermark of the client, the entry isn't synchronized again
+	data, err := k.GetAllData(ctx, Table, userID, models.DataQuery{LastSync: added, InclDeleted: true})
+	require.NoError(t, err)
+	assert.Empty(t, data)
+
+	// The timestamp is kept by the server, the callers can't set it
+	_, err = k.UpdateData(ctx, Table, userID, entryID, map[string]string{"login": "bob", "updated_at": "2000-01-01T00:00:00Z"})
+	assert.ErrorIs(t, err, models.ErrInvalidChange)
+
+	// Every later write moves the timestamp forward
+	updated, err := k.UpdateData(ctx, Table, userID, entryID, map[string]string{"login": "bob"})
+	require.NoError(t, err)
+	assert.True(t, updated.After(added))
+	assert.True(t, updated.Equal(entryUpdatedAt(t, k, userID, entryID)))
+
+	deleted, err := k.DeleteData(ctx, Table, userID, entryID)
+	require.NoError(t, err)
+	assert.True(t, deleted.After(updated))
+	assert.True(t, deleted.Equal(entryUpdatedAt(t, k, userID, entryID)))
+
+	// Writes to the entries of other users change nothing and aren't found
+	other := newUser(t, k)
+	updated, err = k.UpdateData(ctx, Table, other, entryID, map[string]string{"login": "mallory"})
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	assert.True(t, updated.IsZero())
+}
+
+func testClientTimestamps(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	imported, pushed := uniqueName("imported"), uniqueName("pushed")
+
+	fields := credential("alice")
+	fields[models.ClientCreatedAt] = "2015-03-01T10:00:00+02:00"
+	fields[models.ClientModifiedAt] = "2019-07-15T12:30:00Z"
+	_, _, err := k.AddData(ctx, Table, userID, imported, fields)
+	require.NoError(t, err)
+
+	// Server-side edits change updated_at only, the display timestamps are kept as imported
+	_, err = k.UpdateData(ctx, Table, userID, imported, map[string]string{"login": "bob", models.ClientModifiedAt: "2024-01-01T00:00:00Z"})
+	require.NoError(t, err)
+	_, err = k.DeleteData(ctx, Table, userID, imported)
+	require.NoError(t, err)
+	_, err = k.UndeleteData(ctx, Table, userID, imported)
+	require.NoError(t, err)
+
+	_, err = k.ApplyChanges(ctx, userID, []models.Change{{
+		Table: Table, Op: models.ChangeAdd, EntryID: pushed,
+		Fields: map[string]string{"login": "carol", "password": "secret", models.ClientCreatedAt: "2020-02-02T02:02:02Z"},
+	}})
+	require.NoError(t, err)
+
+	data, err := k.GetAllData(ctx, Table, userID, models.DataQuery{})
+	require.NoError(t, err)
+	rows := make(map[string]map[string]string)
+	for _, row := range data {
+		rows[row["id"]] = row
+	}
+
+	require.Contains(t, rows, imported)
+	assert.Equal(t, "bob", rows[imported]["login"])
+	assert.Equal(t, "2015-03-01T08:00:00Z", rows[imported][models.ClientCreatedAt])
+	assert.Equal(t, "2019-07-15T12:30:00Z", rows[imported][models.ClientModifiedAt])
+
+	require.Contains(t, rows, pushed)
+	assert.Equal(t, "2020-02-02T02:02:02Z", rows[pushed][models.ClientCreatedAt])
+
+	// Malformed and out of range timestamps are rejected
+	for _, value := range []string{"yesterday", "1960-01-01T00:00:00Z", time.Now().Add(72 * time.Hour).Format(time.RFC3339)} {
+		fields := credential("alice")
+		fields[models.ClientCreatedAt] = value
+		_, _, err := k.AddData(ctx, Table, userID, uniqueName("invalid"), fields)
+		assert.ErrorIs(t, err, models.ErrInvalidChange, value)
+	}
+}
+
+func testApplyChanges(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	fresh, stale, gone, added := uniqueName("fresh"), uniqueName("stale"), uniqueName("gone"), uniqueName("added")
+
+	_, _, err := k.AddData(ctx, Table, userID, fresh, credential("alice"))
+	require.NoError(t, err)
+	_, _, err = k.AddData(ctx, Table, userID, stale, credential("alice"))
+	require.NoError(t, err)
+	_, _, err = k.AddData(ctx, Table, userID, gone, credential("alice"))
+	require.NoError(t, err)
+
+	results, err := k.ApplyChanges(ctx, userID, []models.Change{
+		{Table: Table, Op: models.ChangeAdd, EntryID: added, Fields: credential("carol")},
+		{Table: Table, Op: models.ChangeUpdate, EntryID: fresh, Fields: map[string]string{"login": "bob"},
+			UpdatedAt: entryUpdatedAt(t, k, userID, fresh)},
+		{Table: Table, Op: models.ChangeUpdate, EntryID: stale, Fields: map[string]string{"login": "bob"},
+			UpdatedAt: time.Now().Add(-24 * time.Hour)},
+		{Table: Table, Op: models.ChangeDelete, EntryID: gone, UpdatedAt: entryUpdatedAt(t, k, userID, gone)},
+		{Table: Table, Op: models.ChangeUpdate, EntryID: uniqueName("missing"), UpdatedAt: time.Now()},
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 5)
+
+	assert.Equal(t, models.ChangeApplied, results[0].Status)
+	assert.True(t, results[0].UpdatedAt.Equal(entryUpdatedAt(t, k, userID, added)))
+	assert.Equal(t, models.ChangeApplied, results[1].Status)
+	assert.True(t, results[1].UpdatedAt.Equal(entryUpdatedAt(t, k, userID, fresh)))
+	assert.Equal(t, models.ChangeConflict, results[2].Status)
+	assert.Equal(t, stale, results[2].EntryID)
+	assert.True(t, results[2].UpdatedAt.Equal(entryUpdatedAt(t, k, userID, stale)))
+	assert.Equal(t, models.ChangeApplied, results[3].Status)
+	assert.Equal(t, models.ChangeNotFound, results[4].Status)
+
+	data, err := k.GetAllData(ctx, Table, userID, models.DataQuery{})
+	require.NoError(t, err)
+
+	logins := make(map[string]string)
+	for _, row := range data {
+		logins[row["id"]] = row["login"]
+	}
+	assert.Equal(t, map[string]string{added: "carol", fresh: "bob", stale: "alice"}, logins)
+}
+
+func testApplyChangesRollback(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	existing, added := uniqueName("existing"), uniqueName("added")
+
+	_, _, err := k.AddData(ctx, Table, userID, existing, credential("alice"))
+	require.NoError(t, err)
+
+	// Adding an entry with an existing id fails in the middle of the batch
+	_, err = k.ApplyChanges(ctx, userID, []models.Change{
+		{Table: Table, Op: models.ChangeAdd, EntryID: added, Fields: credential("carol")},
+		{Table: Table, Op: models.ChangeUpdate, EntryID: existing, Fields: map[string]string{"login": "bob"},
+			UpdatedAt: entryUpdatedAt(t, k, userID, existing)},
+		{Table: Table, Op: models.ChangeAdd, EntryID: existing, Fields: credential("dave")},
+	})
+	require.Error(t, err)
+
+	_, err = k.ApplyChanges(ctx, userID, []models.Change{
+		{Table: Table, Op: "rename", EntryID: existing},
+	})
+	assert.ErrorIs(t, err, models.ErrInvalidChange)
+
+	data, err := k.GetAllData(ctx, Table, userID, models.DataQuery{})
+	require.NoError(t, err)
+	require.Len(t, data, 1)
+	assert.Equal(t, existing, data[0]["id"])
+	assert.Equal(t, "alice", data[0]["login"])
+
+	// The version saved by the rolled back update is gone as well
+	versions, err := k.GetDataHistory(ctx, Table, userID, existing, 0)
+	require.NoError(t, err)
+	assert.Empty(t, versions)
+}
+
+func testApplyChangesUnchanged(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	id, removed := uniqueName("resent"), uniqueName("removed")
+
+	fields := credential("alice")
+	fields[models.TagsField] = "work,home"
+	_, _, err := k.AddData(ctx, Table, userID, id, fields)
+	require.NoError(t, err)
+	_, _, err = k.AddData(ctx, Table, userID, removed, credential("alice"))
+	require.NoError(t, err)
+	_, err = k.DeleteData(ctx, Table, userID, removed)
+	require.NoError(t, err)
+	version := entryUpdatedAt(t, k, userID, id)
+	time.Sleep(5 * time.Millisecond)
+
+	update := func(id string, fields map[string]string, updatedAt time.Time) models.ChangeResult {
+		t.Helper()
+		results, err := k.ApplyChanges(ctx, userID, []models.Change{
+			{Table: Table, Op: models.ChangeUpdate, EntryID: id, Fields: fields, UpdatedAt: updatedAt},
+		})
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+		return results[0]
+	}
+	history := func() int {
+		t.Helper()
+		versions, err := k.GetDataHistory(ctx, Table, userID, id, 0)
+		require.NoError(t, err)
+		return len(versions)
+	}
+
+	// The entry resent as it is, with its tags in another form, keeps its version and gets no history
+	resent := credential("alice")
+	resent[models.TagsField] = `["Work", "home", "work"]`
+	result := update(id, resent, version)
+	assert.Equal(t, models.ChangeUnchanged, result.Status)
+	assert.True(t, result.UpdatedAt.Equal(version))
+	assert.True(t, entryUpdatedAt(t, k, userID, id).Equal(version))
+	assert.Zero(t, history())
+
+	// A stale version resending the fields the entry has doesn't conflict either
+	result = update(id, map[string]string{"login": "alice"}, version.Add(-time.Hour))
+	assert.Equal(t, models.ChangeUnchanged, result.Status)
+	assert.True(t, result.UpdatedAt.Equal(version))
+
+	// But one differing by a byte does
+	result = update(id, map[string]string{"login": "alicf"}, version.Add(-time.Hour))
+	assert.Equal(t, models.ChangeConflict, result.Status)
+
+	// A byte of difference with the current version is written
+	result = update(id, map[string]string{"password": "secreT"}, version)
+	assert.Equal(t, models.ChangeApplied, result.Status)
+	assert.True(t, result.UpdatedAt.After(version))
+	assert.Equal(t, 1, history())
+	version = result.UpdatedAt
+
+	// An update of a deleted entry is applied as before, and one without fields touches the entry
+	result = update(removed, credential("alice"), entryUpdatedAt(t, k, userID, removed))
+	assert.Equal(t, models.ChangeApplied, result.Status)
+	result = update(id, nil, version)
+	assert.Equal(t, models.ChangeApplied, result.Status)
+	assert.True(t, result.UpdatedAt.After(version))
+
+	// The unchanged updates of a sync don't move its watermark, nor are they sent back
+	version = entryUpdatedAt(t, k, userID, id)
+	synced, err := k.Sync(ctx, userID, version, []models.Change{
+		{Table: Table, Op: models.ChangeUpdate, EntryID: id, Fields: map[string]string{"login": "alice", "password": "secreT"},
+			UpdatedAt: version},
+	})
+	require.NoError(t, err)
+	require.Len(t, synced.Results, 1)
+	assert.Equal(t, models.ChangeUnchanged, synced.Results[0].Status)
+	assert.True(t, synced.Watermark.Equal(version))
+	assert.Empty(t, synced.Changes[Table])
+}
+
+func testSync(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	kept, edited, removed := uniqueName("kept"), uniqueName("edited"), uniqueName("removed")
+	remote, local := uniqueName("remote"), uniqueName("local")
+
+	// The client synced these entries
+	for _, id := range []string{kept, edited, removed} {
+		_, _, err := k.AddData(ctx, Table, userID, id, credential("alice"))
+		require.NoError(t, err)
+	}
+	lastSync := entryUpdatedAt(t, k, userID, removed)
+	time.Sleep(5 * time.Millisecond)
+
+	// Another device changed the server since
+	_, err := k.UpdateData(ctx, Table, userID, edited, map[string]string{"login": "server"})
+	require.NoError(t, err)
+	_, err = k.DeleteData(ctx, Table, userID, removed)
+	require.NoError(t, err)
+	_, _, err = k.AddData(ctx, Table, userID, remote, credential("dave"))
+	require.NoError(t, err)
+
+	result, err := k.Sync(ctx, userID, lastSync, []models.Change{
+		{Table: Table, Op: models.ChangeAdd, EntryID: local, Fields: credential("carol")},
+		{Table: Table, Op: models.ChangeUpdate, EntryID: edited, Fields: map[string]string{"login": "client"}, UpdatedAt: lastSync},
+		{Table: Table, Op: models.ChangeUpdate, EntryID: kept, Fields: map[string]string{"login": "bob"},
+			UpdatedAt: entryUpdatedAt(t, k, userID, kept)},
+	})
+	require.NoError(t, err)
+	require.Len(t, result.Results, 3)
+	assert.Equal(t, models.ChangeApplied, result.Results[0].Status)
+	assert.Equal(t, models.ChangeApplied, result.Results[2].Status)
+
+	// The client change loses to the newer server row, and gets both versions to merge
+	assert.Equal(t, models.ChangeConflict, result.Results[1].Status)
+	require.Len(t, result.Conflicts, 1)
+	conflict := result.Conflicts[0]
+	assert.Equal(t, edited, conflict.EntryID)
+	assert.Equal(t, "client", conflict.Client.Fields["login"])
+	assert.Equal(t, "server", conflict.Server["login"])
+	assert.True(t, result.Results[1].UpdatedAt.Equal(entryUpdatedAt(t, k, userID, edited)))
+	row, err := k.GetData(ctx, Table, userID, edited, false)
+	require.NoError(t, err)
+	assert.Equal(t, "server", row["login"])
+
+	// The pull has the server changes with the deletion, but not the versions the client pushed
+	pulled := make(map[string]map[string]string)
+	ids := make([]string, 0, len(result.Changes[Table]))
+	for _, row := range result.Changes[Table] {
+		pulled[row["id"]] = row
+		ids = append(ids, row["id"])
+	}
+	assert.ElementsMatch(t, []string{edited, removed, remote}, ids)
+	assert.Equal(t, "server", pulled[edited]["login"])
+	assert.Equal(t, "true", pulled[removed]["deleted"])
+	for _, table := range models.DataTables {
+		assert.Contains(t, result.Changes, table)
+	}
+
+	// The watermark is past every change, so syncing from it gets nothing
+	for _, id := range []string{kept, edited, removed, remote, local} {
+		assert.False(t, entryUpdatedAt(t, k, userID, id).After(result.Watermark), id)
+	}
+	next, err := k.Sync(ctx, userID, result.Watermark, nil)
+	require.NoError(t, err)
+	assert.Empty(t, next.Results)
+	assert.Empty(t, next.Changes[Table])
+	assert.True(t, next.Watermark.Equal(result.Watermark))
+
+	// The first sync gets the live entries only
+	first, err := k.Sync(ctx, userID, time.Time{}, nil)
+	require.NoError(t, err)
+	ids = ids[:0]
+	for _, row := range first.Changes[Table] {
+		ids = append(ids, row["id"])
+	}
+	assert.ElementsMatch(t, []string{kept, edited, remote, local}, ids)
+}
+
+func testSyncRollback(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	existing, added := uniqueName("existing"), uniqueName("added")
+
+	_, _, err := k.AddData(ctx, Table, userID, existing, credential("alice"))
+	require.NoError(t, err)
+
+	// Adding an entry with an existing id fails in the middle of the batch, nothing of it is applied
+	_, err = k.Sync(ctx, userID, time.Time{}, []models.Change{
+		{Table: Table, Op: models.ChangeAdd, EntryID: added, Fields: credential("carol")},
+		{Table: Table, Op: models.ChangeAdd, EntryID: existing, Fields: credential("dave")},
+	})
+	require.Error(t, err)
+
+	_, err = k.Sync(ctx, userID, time.Time{}, []models.Change{{Table: Table, Op: "rename", EntryID: existing}})
+	assert.ErrorIs(t, err, models.ErrInvalidChange)
+
+	data, err := k.GetAllData(ctx, Table, userID, models.DataQuery{})
+	require.NoError(t, err)
+	require.Len(t, data, 1)
+	assert.Equal(t, existing, data[0]["id"])
+}
+
+func testWithTx(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	committed, failed, panicked := uniqueName("committed"), uniqueName("failed"), uniqueName("panicked")
+
+	// The changes of a successful function are committed
+	err := k.WithTx(ctx, func(tx storage.Keeper) error {
+		if _, _, err := tx.AddData(ctx, Table, userID, committed, credential("alice")); err != nil {
+			return err
+		}
+		// The view sees its own changes
+		if _, err := tx.GetData(ctx, Table, userID, committed, false); err != nil {
+			return err
+		}
+		_, err := tx.UpdateData(ctx, Table, userID, committed, map[string]string{"login": "bob"})
+		return err
+	})
+	require.NoError(t, err)
+
+	entry, err := k.GetData(ctx, Table, userID, committed, false)
+	require.NoError(t, err)
+	assert.Equal(t, "bob", entry["login"])
+
+	// The changes of a failing function are rolled back and its error is returned
+	errAbort := errors.New("abort")
+	err = k.WithTx(ctx, func(tx storage.Keeper) error {
+		if _, _, err := tx.AddData(ctx, Table, userID, failed, credential("carol")); err != nil {
+			return err
+		}
+		if _, err := tx.DeleteData(ctx, Table, userID, committed); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	assert.ErrorIs(t, err, errAbort)
+
+	_, err = k.GetData(ctx, Table, userID, failed, true)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	_, err = k.GetData(ctx, Table, userID, committed, false)
+	require.NoError(t, err)
+
+	// A panic rolls the changes back and is passed on
+	assert.Panics(t, func() {
+		_ = k.WithTx(ctx, func(tx storage.Keeper) error {
+			if _, _, err := tx.AddData(ctx, Table, userID, panicked, credential("dave")); err != nil {
+				return err
+			}
+			panic("boom")
+		})
+	})
+
+	_, err = k.GetData(ctx, Table, userID, panicked, true)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	// A nested call rolls back only its own changes, even after a failed statement
+	outer, inner := uniqueName("outer"), uniqueName("inner")
+	err = k.WithTx(ctx, func(tx storage.Keeper) error {
+		if _, _, err := tx.AddData(ctx, Table, userID, outer, credential("erin")); err != nil {
+			return err
+		}
+
+		err := tx.WithTx(ctx, func(tx storage.Keeper) error {
+			if _, _, err := tx.AddData(ctx, Table, userID, inner, credential("frank")); err != nil {
+				return err
+			}
+			// The id is taken, so the insert fails
+			_, _, err := tx.AddData(ctx, Table, userID, outer, credential("grace"))
+			return err
+		})
+		if err == nil {
+			return errors.New("adding an existing entry succeeded")
+		}
+
+		_, err = tx.UpdateData(ctx, Table, userID, outer, map[string]string{"login": "heidi"})
+		return err
+	})
+	require.NoError(t, err)
+
+	entry, err = k.GetData(ctx, Table, userID, outer, false)
+	require.NoError(t, err)
+	assert.Equal(t, "heidi", entry["login"])
+	_, err = k.GetData(ctx, Table, userID, inner, true)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+}
+
+func testAudit(t *testing.T, k storage.Keeper) {
+	client := models.Client{RemoteAddr: "192.0.2.1:5000", UserAgent: "gophkeeper-client/1.0"}
+	ctx := models.WithClient(context.Background(), client)
+	userID := newUser(t, k)
+	entryID := uniqueName("entry")
+
+	require.NoError(t, k.AddAuditEvent(ctx, models.AuditEvent{UserID: userID, Action: models.AuditLogin, Success: true}))
+	_, _, err := k.AddData(ctx, Table, userID, entryID, credential("alice"))
+	require.NoError(t, err)
+	_, err = k.UpdateData(ctx, Table, userID, entryID, map[string]string{"login": "bob"})
+	require.NoError(t, err)
+	_, err = k.UndeleteData(ctx, Table, userID, uniqueName("missing"))
+	require.ErrorIs(t, err, models.ErrNotFound)
+
+	// The changes rolled back with their transaction are recorded as failed
+	errAbort := errors.New("abort")
+	err = k.WithTx(ctx, func(tx storage.Keeper) error {
+		if _, err := tx.DeleteData(ctx, Table, userID, entryID); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	require.ErrorIs(t, err, errAbort)
+
+	// The events of the user are returned newest first, with the client of the request
+	events, err := k.GetAuditEvents(ctx, userID, time.Time{}, 0)
+	require.NoError(t, err)
+	require.Len(t, events, 5)
+	actions := make([]models.AuditAction, 0, len(events))
+	for _, ev := range events {
+		actions = append(actions, ev.Action)
+	}
+	assert.Equal(t, []models.AuditAction{models.AuditDelete, models.AuditUndelete, models.AuditUpdate, models.AuditAdd, models.AuditLogin}, actions)
+	assert.False(t, events[0].Success)
+	assert.False(t, events[1].Success)
+	assert.True(t, events[2].Success)
+	assert.Equal(t, Table, events[3].Table)
+	assert.Equal(t, entryID, events[3].EntryID)
+	assert.Equal(t, client.RemoteAddr, events[3].RemoteAddr)
+	assert.Equal(t, client.UserAgent, events[3].UserAgent)
+	assert.False(t, events[0].CreatedAt.Before(events[4].CreatedAt))
+
+	limited, err := k.GetAuditEvents(ctx, userID, time.Time{}, 2)
+	require.NoError(t, err)
+	assert.Equal(t, events[:2], limited)
+
+	recent, err := k.GetAuditEvents(ctx, userID, events[0].CreatedAt, 0)
+	require.NoError(t, err)
+	assert.NotEmpty(t, recent)
+	recent, err = k.GetAuditEvents(ctx, userID, events[0].CreatedAt.Add(time.Hour), 0)
+	require.NoError(t, err)
+	assert.Empty(t, recent)
+
+	// The events aren't visible to other users
+	others, err := k.GetAuditEvents(ctx, newUser(t, k), time.Time{}, 0)
+	require.NoError(t, err)
+	assert.Empty(t, others)
+
+	// Pruning keeps the events recorded since the cutoff
+	pruned, err := k.PruneAuditEvents(ctx, events[4].CreatedAt)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, pruned, 0)
+	events, err = k.GetAuditEvents(ctx, userID, time.Time{}, 0)
+	require.NoError(t, err)
+	assert.Len(t, events, 5)
+
+	pruned, err = k.PruneAuditEvents(ctx, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, pruned, 5)
+	events, err = k.GetAuditEvents(ctx, userID, time.Time{}, 0)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+}
+
+// testRefreshTokens checks the storage of the refresh tokens, their rotation and the revocation of a family.
+func testRefreshTokens(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	family := uniqueName("family")
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+
+	first := models.RefreshToken{Hash: uniqueName("hash-1"), UserID: userID, DeviceID: "phone", FamilyID: family, ExpiresAt: expiresAt}
+	require.NoError(t, k.StoreRefreshToken(ctx, first))
+	assert.Error(t, k.StoreRefreshToken(ctx, first), "the hashes are unique")
+
+	got, err := k.GetRefreshToken(ctx, first.Hash)
+	require.NoError(t, err)
+	assert.Equal(t, userID, got.UserID)
+	assert.Equal(t, "phone", got.DeviceID)
+	assert.Equal(t, family, got.FamilyID)
+	assert.WithinDuration(t, expiresAt, got.ExpiresAt, time.Millisecond)
+	assert.False(t, got.Revoked)
+	assert.Equal(t, models.ProtocolV1, got.ProtocolVersion, "a token without a version is of the first one")
+
+	_, err = k.GetRefreshToken(ctx, uniqueName("missing"))
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	// A token is revoked once, the second revocation reports it was revoked already
+	rotated, err := k.RevokeRefreshToken(ctx, first.Hash)
+	require.NoError(t, err)
+	assert.True(t, rotated)
+	rotated, err = k.RevokeRefreshToken(ctx, first.Hash)
+	require.NoError(t, err)
+	assert.False(t, rotated)
+	rotated, err = k.RevokeRefreshToken(ctx, uniqueName("missing"))
+	require.NoError(t, err)
+	assert.False(t, rotated)
+	got, err = k.GetRefreshToken(ctx, first.Hash)
+	require.NoError(t, err)
+	assert.True(t, got.Revoked)
+
+	// Revoking the family revokes its tokens only
+	second := first
+	second.Hash = uniqueName("hash-2")
+	require.NoError(t, k.StoreRefreshToken(ctx, second))
+	other := models.RefreshToken{Hash: uniqueName("hash-3"), UserID: userID, DeviceID: "laptop", FamilyID: uniqueName("family"),
+		ExpiresAt: expiresAt, ProtocolVersion: 2}
+	require.NoError(t, k.StoreRefreshToken(ctx, other))
+	got, err = k.GetRefreshToken(ctx, other.Hash)
+	require.NoError(t, err)
+	assert.Equal(t, 2, got.ProtocolVersion)
+
+	require.NoError(t, k.RevokeRefreshTokenFamily(ctx, family))
+	got, err = k.GetRefreshToken(ctx, second.Hash)
+	require.NoError(t, err)
+	assert.True(t, got.Revoked)
+	got, err = k.GetRefreshToken(ctx, other.Hash)
+	require.NoError(t, err)
+	assert.False(t, got.Revoked)
+}
+
+func testRevokedTokens(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	expired := uniqueName("jti-expired")
+	live := uniqueName("jti-live")
+	forever := uniqueName("jti-forever")
+
+	revoked, err := k.IsTokenRevoked(ctx, live)
+	require.NoError(t, err)
+	assert.False(t, revoked)
+
+	require.NoError(t, k.RevokeToken(ctx, expired, time.Now().Add(-time.Minute)))
+	require.NoError(t, k.RevokeToken(ctx, live, time.Now().Add(time.Hour)))
+	require.NoError(t, k.RevokeToken(ctx, live, time.Now().Add(-time.Minute)), "a second revocation keeps the first")
+	require.NoError(t, k.RevokeToken(ctx, forever, time.Time{}))
+	for _, jti := range []string{expired, live, forever} {
+		revoked, err := k.IsTokenRevoked(ctx, jti)
+		require.NoError(t, err)
+		assert.True(t, revoked, jti)
+	}
+
+	// Only the revocations of the expired tokens are pruned, a token without an expiry stays revoked
+	pruned, err := k.PruneRevokedTokens(ctx, time.Now())
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, pruned, 1)
+	revoked, err = k.IsTokenRevoked(ctx, expired)
+	require.NoError(t, err)
+	assert.False(t, revoked)
+	for _, jti := range []string{live, forever} {
+		revoked, err := k.IsTokenRevoked(ctx, jti)
+		require.NoError(t, err)
+		assert.True(t, revoked, jti)
+	}
+}
+
+// testUpdatePassword checks that a password change ends the sessions of the user, and only theirs.
+func testUpdatePassword(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	username := uniqueName("user")
+	require.NoError(t, k.AddUser(ctx, username, "oldHash"))
+	userID, err := k.GetUserID(ctx, username)
+	require.NoError(t, err)
+	otherID := newUser(t, k)
+
+	expiresAt := time.Now().Add(time.Hour)
+	phone := models.RefreshToken{Hash: uniqueName("hash"), UserID: userID, DeviceID: "phone", FamilyID: uniqueName("family"), ExpiresAt: expiresAt}
+	laptop := models.RefreshToken{Hash: uniqueName("hash"), UserID: userID, DeviceID: "laptop", FamilyID: uniqueName("family"), ExpiresAt: expiresAt}
+	other := models.RefreshToken{Hash: uniqueName("hash"), UserID: otherID, DeviceID: "phone", FamilyID: uniqueName("family"), ExpiresAt: expiresAt}
+	for _, tok := range []models.RefreshToken{phone, laptop, other} {
+		require.NoError(t, k.StoreRefreshToken(ctx, tok))
+	}
+
+	require.NoError(t, k.UpdatePassword(ctx, userID, "newHash"))
+	password, err := k.GetPassword(ctx, username)
+	require.NoError(t, err)
+	assert.Equal(t, "newHash", password)
+
+	// The time of the change ends the access tokens issued before it
+	access, err := k.GetUserAccess(ctx, userID)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), access.PasswordChangedAt, 5*time.Second)
+	access, err = k.GetUserAccess(ctx, otherID)
+	require.NoError(t, err)
+	assert.True(t, access.PasswordChangedAt.IsZero())
+
+	for _, tok := range []models.RefreshToken{phone, laptop} {
+		got, err := k.GetRefreshToken(ctx, tok.Hash)
+		require.NoError(t, err)
+		assert.True(t, got.Revoked, tok.DeviceID)
+	}
+	got, err := k.GetRefreshToken(ctx, other.Hash)
+	require.NoError(t, err)
+	assert.False(t, got.Revoked)
+
+	assert.ErrorIs(t, k.UpdatePassword(ctx, -1, "newHash"), models.ErrNotFound)
+}
+
+// testRehashPassword checks that a rehash keeps the sessions and doesn't undo a concurrent password change.
+func testRehashPassword(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	username := uniqueName("user")
+	require.NoError(t, k.AddUser(ctx, username, "oldHash"))
+	userID, err := k.GetUserID(ctx, username)
+	require.NoError(t, err)
+
+	phone := models.RefreshToken{Hash: uniqueName("hash"), UserID: userID, DeviceID: "phone", FamilyID: uniqueName("family"), ExpiresAt: time.Now().Add(time.Hour)}
+	require.NoError(t, k.StoreRefreshToken(ctx, phone))
+
+	replaced, err := k.RehashPassword(ctx, userID, "oldHash", "newHash")
+	require.NoError(t, err)
+	assert.True(t, replaced)
+	password, err := k.GetPassword(ctx, username)
+	require.NoError(t, err)
+	assert.Equal(t, "newHash", password)
+	got, err := k.GetRefreshToken(ctx, phone.Hash)
+	require.NoError(t, err)
+	assert.False(t, got.Revoked)
+
+	// The hash changed since it was read, the rehash is dropped
+	replaced, err = k.RehashPassword(ctx, userID, "oldHash", "staleHash")
+	require.NoError(t, err)
+	assert.False(t, replaced)
+	password, err = k.GetPassword(ctx, username)
+	require.NoError(t, err)
+	assert.Equal(t, "newHash", password)
+
+	replaced, err = k.RehashPassword(ctx, -1, "oldHash", "newHash")
+	require.NoError(t, err)
+	assert.False(t, replaced)
+}
+
+// syncedSize returns the number of the entries of the user a synchronization from the cursor downloads
+// and their size as sent, the deleted entries as tombstones.
+func syncedSize(t *testing.T, k storage.Keeper, userID int, since time.Time) models.PendingSize {
+	t.Helper()
+
+	var synced models.PendingSize
+	for _, table := range models.DataTables {
+		data, err := k.GetAllData(context.Background(), table, userID, models.DataQuery{LastSync: since, InclDeleted: !since.IsZero()})
+		require.NoError(t, err)
+		for _, row := range data {
+			synced.Entries++
+			if row["deleted"] == "true" {
+				synced.Bytes += models.TombstoneSize
+				continue
+			}
+			encoded, err := json.Marshal(row)
+			require.NoError(t, err)
+			synced.Bytes += int64(len(encoded))
+		}
+	}
+
+	return synced
+}
+
+// assertPending checks the estimate of a synchronization from the cursor against what it downloads.
+func assertPending(t *testing.T, k storage.Keeper, userID int, since time.Time) map[string]models.PendingSize {
+	t.Helper()
+
+	pending, err := k.PendingData(context.Background(), userID, since, false)
+	require.NoError(t, err)
+	var total models.PendingSize
+	for _, p := range pending {
+		total.Entries += p.Entries
+		total.Bytes += p.Bytes
+	}
+
+	synced := syncedSize(t, k, userID, since)
+	assert.Equal(t, synced.Entries, total.Entries)
+	assert.InEpsilon(t, synced.Bytes+1, total.Bytes+1, 0.05)
+
+	return pending
+}
+
+func testPendingData(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	otherID := newUser(t, k)
+
+	// Nothing is pending for a new user
+	pending, err := k.PendingData(ctx, userID, time.Time{}, false)
+	require.NoError(t, err)
+	for _, table := range models.DataTables {
+		assert.Zero(t, pending[table], table)
+	}
+
+	ids := make([]string, 3)
+	var cursor time.Time
+	for i := range ids {
+		ids[i] = uniqueName("entry")
+		_, cursor, err = k.AddData(ctx, Table, userID, ids[i], credential(fmt.Sprintf("login-%d", i)))
+		require.NoError(t, err)
+	}
+	_, cursor, err = k.AddData(ctx, "TextData", userID, uniqueName("entry"), map[string]string{"data": "some text", "meta_info": "note"})
+	require.NoError(t, err)
+	_, _, err = k.AddData(ctx, Table, otherID, uniqueName("entry"), credential("other"))
+	require.NoError(t, err)
+
+	// A full download, the entries of other users aren't counted
+	pending = assertPending(t, k, userID, time.Time{})
+	assert.Equal(t, 3, pending[Table].Entries)
+	assert.Equal(t, 1, pending["TextData"].Entries)
+	assert.Zero(t, pending["CreditCardData"].Entries)
+
+	// Nothing changed since the last write
+	pending = assertPending(t, k, userID, cursor)
+	assert.Zero(t, pending[Table])
+
+	// An edit counts the entry at its new size, a deletion as a tombstone
+	_, err = k.UpdateData(ctx, Table, userID, ids[0], map[string]string{"meta_info": strings.Repeat("long meta info ", 100)})
+	require.NoError(t, err)
+	_, err = k.DeleteData(ctx, Table, userID, ids[1])
+	require.NoError(t, err)
+	pending = assertPending(t, k, userID, cursor)
+	assert.Equal(t, 2, pending[Table].Entries)
+	assert.Greater(t, pending[Table].Bytes, int64(1500+models.TombstoneSize))
+
+	// The deleted entry isn't downloaded at all by a full synchronization
+	pending = assertPending(t, k, userID, time.Time{})
+	assert.Equal(t, 2, pending[Table].Entries)
+
+	// A restored entry counts at its size again
+	_, err = k.UndeleteData(ctx, Table, userID, ids[1])
+	require.NoError(t, err)
+	pending = assertPending(t, k, userID, cursor)
+	assert.Equal(t, 2, pending[Table].Entries)
+	assert.Greater(t, pending[Table].Bytes, 2*int64(models.TombstoneSize)+1500)
+}
+
+func testDataVersion(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	otherID := newUser(t, k)
+
+	version := func() models.DataVersion {
+		v, err := k.GetUserDataVersion(ctx, userID)
+		require.NoError(t, err)
+		return v
+	}
+
+	// A user without entries has the zero version, the same state gives the same version
+	assert.Zero(t, version())
+
+	id := uniqueName("entry")
+	_, addedAt, err := k.AddData(ctx, Table, userID, id, credential("alice"))
+	require.NoError(t, err)
+	added := version()
+	assert.Equal(t, 1, added.Entries)
+	assert.True(t, addedAt.Equal(added.UpdatedAt), "%v != %v", addedAt, added.UpdatedAt)
+	assert.Equal(t, added, version())
+
+	// The entries of other users don't change it
+	_, _, err = k.AddData(ctx, Table, otherID, uniqueName("entry"), credential("bob"))
+	require.NoError(t, err)
+	assert.Equal(t, added, version())
+
+	// An update and a delete move it forward, the deleted entry still counts
+	updatedAt, err := k.UpdateData(ctx, Table, userID, id, credential("alice2"))
+	require.NoError(t, err)
+	updated := version()
+	assert.True(t, updatedAt.Equal(updated.UpdatedAt))
+	assert.True(t, updated.UpdatedAt.After(added.UpdatedAt))
+
+	deletedAt, err := k.DeleteData(ctx, Table, userID, id)
+	require.NoError(t, err)
+	deleted := version()
+	assert.True(t, deletedAt.Equal(deleted.UpdatedAt))
+	assert.Equal(t, 1, deleted.Entries)
+
+	// An expired entry is counted apart, so the version changes once an entry expires
+	_, _, err = k.AddData(ctx, "TextData", userID, uniqueName("entry"), map[string]string{
+		"data": "note", "meta_info": "gone", models.ExpiresAtField: time.Now().Add(-time.Hour).Format(time.RFC3339Nano),
+	})
+	require.NoError(t, err)
+	expired := version()
+	assert.Equal(t, 2, expired.Entries)
+	assert.Equal(t, 1, expired.Expired)
+	assert.Equal(t, expired, version())
+}
+
+func testExportData(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	otherID := newUser(t, k)
+
+	prefix := uniqueName("entry")
+	for _, id := range []string{prefix + "-c", prefix + "-a", prefix + "-b", prefix + "-deleted"} {
+		_, _, err := k.AddData(ctx, Table, userID, id, credential(id))
+		require.NoError(t, err)
+	}
+	_, err := k.DeleteData(ctx, Table, userID, prefix+"-deleted")
+	require.NoError(t, err)
+	_, _, err = k.AddData(ctx, Table, otherID, uniqueName("entry"), credential("bob"))
+	require.NoError(t, err)
+	expired := uniqueName("entry")
+	_, _, err = k.AddData(ctx, "TextData", userID, expired, map[string]string{
+		"data": "note", "meta_info": "gone", models.ExpiresAtField: time.Now().Add(-time.Hour).Format(time.RFC3339Nano),
+	})
+	require.NoError(t, err)
+
+	export := func(table string) []map[string]string {
+		var entries []map[string]string
+		require.NoError(t, k.ExportData(ctx, table, userID, func(entry map[string]string) error {
+			entries = append(entries, entry)
+			return nil
+		}))
+		return entries
+	}
+
+	// The entries of the user which aren't deleted come by id, with their fields
+	entries := export(Table)
+	require.Len(t, entries, 3)
+	for i, suffix := range []string{"-a", "-b", "-c"} {
+		assert.Equal(t, prefix+suffix, entries[i]["id"])
+		assert.Equal(t, prefix+suffix, entries[i]["login"])
+		assert.Equal(t, "meta", entries[i]["meta_info"])
+		assert.NotEmpty(t, entries[i]["updated_at"])
+	}
+
+	// The expired entries aren't deleted yet, so they are exported
+	entries = export("TextData")
+	require.Len(t, entries, 1)
+	assert.Equal(t, expired, entries[0]["id"])
+
+	// An error of the callback stops the export
+	stop := errors.New("stop")
+	calls := 0
+	err = k.ExportData(ctx, Table, userID, func(entry map[string]string) error {
+		calls++
+		return stop
+	})
+	assert.ErrorIs(t, err, stop)
+	assert.Equal(t, 1, calls)
+}
+
+func testLoginLockout(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	username := uniqueName("user")
+	require.NoError(t, k.AddUser(ctx, username, "hashedPassword"))
+
+	locked, _, err := k.IsLocked(ctx, username)
+	require.NoError(t, err)
+	assert.False(t, locked)
+
+	// The account is locked once the consecutive failures reach the threshold
+	for i := 0; i < 2; i++ {
+		lockedUntil, err := k.RecordFailedLogin(ctx, username, 3)
+		require.NoError(t, err)
+		assert.True(t, lockedUntil.IsZero())
+	}
+	lockedUntil, err := k.RecordFailedLogin(ctx, username, 3)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), lockedUntil, 5*time.Second)
+
+	locked, until, err := k.IsLocked(ctx, username)
+	require.NoError(t, err)
+	assert.True(t, locked)
+	assert.WithinDuration(t, lockedUntil, until, time.Millisecond)
+
+	// Each further failure locks it for longer, up to the last backoff
+	for _, want := range []time.Duration{5 * time.Minute, 15 * time.Minute, 15 * time.Minute} {
+		lockedUntil, err := k.RecordFailedLogin(ctx, username, 3)
+		require.NoError(t, err)
+		assert.WithinDuration(t, time.Now().Add(want), lockedUntil, 5*time.Second)
+	}
+
+	// A successful login starts over
+	require.NoError(t, k.ResetFailedLogins(ctx, username))
+	locked, _, err = k.IsLocked(ctx, username)
+	require.NoError(t, err)
+	assert.False(t, locked)
+	lockedUntil, err = k.RecordFailedLogin(ctx, username, 3)
+	require.NoError(t, err)
+	assert.True(t, lockedUntil.IsZero())
+
+	// A threshold of 0 never locks, an unknown account has nothing to count
+	for i := 0; i < 5; i++ {
+		lockedUntil, err = k.RecordFailedLogin(ctx, username, 0)
+		require.NoError(t, err)
+		assert.True(t, lockedUntil.IsZero())
+	}
+	_, err = k.RecordFailedLogin(ctx, uniqueName("nobody"), 3)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	locked, _, err = k.IsLocked(ctx, uniqueName("nobody"))
+	require.NoError(t, err)
+	assert.False(t, locked)
+}
+
+// testLoginHistory checks that the login attempts are kept per user, newest first, up to the given number.
+func testLoginHistory(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	otherID := newUser(t, k)
+
+	for i := 0; i < 5; i++ {
+		ev := models.LoginEvent{UserID: userID, IP: fmt.Sprintf("10.0.0.%d", i), UserAgent: "cli/1.0", Success: i%2 == 0}
+		require.NoError(t, k.RecordLogin(ctx, ev, 3))
+	}
+	require.NoError(t, k.RecordLogin(ctx, models.LoginEvent{UserID: otherID, IP: "192.0.2.1", Success: true}, 3))
+
+	// Only the last three attempts of the user are kept
+	logins, err := k.GetLoginHistory(ctx, userID, 0)
+	require.NoError(t, err)
+	require.Len(t, logins, 3)
+	var ips []string
+	for _, ev := range logins {
+		ips = append(ips, ev.IP)
+		assert.Equal(t, "cli/1.0", ev.UserAgent)
+		assert.WithinDuration(t, time.Now(), ev.At, 5*time.Second)
+	}
+	assert.Equal(t, []string{"10.0.0.4", "10.0.0.3", "10.0.0.2"}, ips)
+	assert.True(t, logins[0].Success)
+	assert.False(t, logins[1].Success)
+
+	logins, err = k.GetLoginHistory(ctx, userID, 2)
+	require.NoError(t, err)
+	assert.Len(t, logins, 2)
+
+	// A keep of 0 prunes nothing
+	require.NoError(t, k.RecordLogin(ctx, models.LoginEvent{UserID: userID, Success: true}, 0))
+	logins, err = k.GetLoginHistory(ctx, userID, 0)
+	require.NoError(t, err)
+	assert.Len(t, logins, 4)
+
+	logins, err = k.GetLoginHistory(ctx, otherID, 0)
+	require.NoError(t, err)
+	require.Len(t, logins, 1)
+	assert.Equal(t, "192.0.2.1", logins[0].IP)
+
+	logins, err = k.GetLoginHistory(ctx, -1, 0)
+	require.NoError(t, err)
+	assert.Empty(t, logins)
+}
+
+// testUserManagement checks the listing of the users with their usage, disabling them and deleting them.
+func testUserManagement(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	otherID := newUser(t, k)
+
+	access, err := k.GetUserAccess(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.RoleUser, access.Role)
+	assert.False(t, access.Disabled)
+	assert.True(t, access.PasswordChangedAt.IsZero())
+	_, err = k.GetUserAccess(ctx, -1)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	_, _, err = k.AddData(ctx, Table, userID, "", credential("alice"))
+	require.NoError(t, err)
+	deleted, _, err := k.AddData(ctx, Table, userID, "", credential("bob"))
+	require.NoError(t, err)
+	_, err = k.DeleteData(ctx, Table, userID, deleted)
+	require.NoError(t, err)
+	require.NoError(t, k.RecordLogin(ctx, models.LoginEvent{UserID: userID, Success: true}, 0))
+
+	// The page after the users created before starts with them, the deleted entry isn't counted
+	users, err := k.ListUsers(ctx, userID-1, 1)
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, userID, users[0].ID)
+	assert.Equal(t, models.RoleUser, users[0].Role)
+	assert.Equal(t, 1, users[0].Entries)
+	pending, err := k.PendingData(ctx, userID, time.Time{}, false)
+	require.NoError(t, err)
+	assert.Equal(t, pending[Table].Bytes, users[0].Bytes)
+	require.NotNil(t, users[0].LastLoginAt)
+	assert.WithinDuration(t, time.Now(), *users[0].LastLoginAt, 5*time.Second)
+
+	users, err = k.ListUsers(ctx, userID, 1)
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, otherID, users[0].ID)
+	assert.Zero(t, users[0].Entries)
+	assert.Zero(t, users[0].Bytes)
+	assert.Nil(t, users[0].LastLoginAt)
+
+	// Disabling an account revokes its refresh tokens, enabling it again doesn't restore them
+	tok := models.RefreshToken{Hash: uniqueName("hash"), UserID: userID, DeviceID: "phone", FamilyID: uniqueName("family"),
+		ExpiresAt: time.Now().Add(time.Hour)}
+	require.NoError(t, k.StoreRefreshToken(ctx, tok))
+	require.NoError(t, k.SetUserDisabled(ctx, userID, true))
+	access, err = k.GetUserAccess(ctx, userID)
+	require.NoError(t, err)
+	assert.True(t, access.Disabled)
+	got, err := k.GetRefreshToken(ctx, tok.Hash)
+	require.NoError(t, err)
+	assert.True(t, got.Revoked)
+
+	require.NoError(t, k.SetUserDisabled(ctx, userID, false))
+	access, err = k.GetUserAccess(ctx, userID)
+	require.NoError(t, err)
+	assert.False(t, access.Disabled)
+	assert.ErrorIs(t, k.SetUserDisabled(ctx, -1, true), models.ErrNotFound)
+
+	// Deleting a user removes all of their rows, the other users keep theirs
+	require.NoError(t, k.AddAuditEvent(ctx, models.AuditEvent{UserID: userID, Action: models.AuditLogin, Success: true}))
+	_, _, err = k.AddData(ctx, Table, otherID, "", credential("carol"))
+	require.NoError(t, err)
+	require.NoError(t, k.DeleteUser(ctx, userID))
+
+	_, err = k.GetUserAccess(ctx, userID)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	_, err = k.GetRefreshToken(ctx, tok.Hash)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	events, err := k.GetAuditEvents(ctx, userID, time.Time{}, 0)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+	logins, err := k.GetLoginHistory(ctx, userID, 0)
+	require.NoError(t, err)
+	assert.Empty(t, logins)
+	pending, err = k.PendingData(ctx, userID, time.Time{}, false)
+	require.NoError(t, err)
+	assert.Zero(t, pending[Table].Entries)
+	pending, err = k.PendingData(ctx, otherID, time.Time{}, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, pending[Table].Entries)
+	assert.ErrorIs(t, k.DeleteUser(ctx, userID), models.ErrNotFound)
+}
+
+// testAPIKeys checks the storage of the API keys, their lookup by hash, their last use and their revocation.
+func testAPIKeys(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	otherID := newUser(t, k)
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+
+	backup, err := k.CreateAPIKey(ctx, models.APIKey{Hash: uniqueName("key-1"), UserID: userID, Label: "backup",
+		Scopes: []string{models.ScopeRead}})
+	require.NoError(t, err)
+	assert.NotZero(t, backup.ID)
+	assert.WithinDuration(t, time.Now(), backup.CreatedAt, 5*time.Second)
+	script, err := k.CreateAPIKey(ctx, models.APIKey{Hash: uniqueName("key-2"), UserID: userID, Label: "script",
+		Scopes: []string{models.ScopeRead, models.ScopeWrite}, ExpiresAt: &expiresAt})
+	require.NoError(t, err)
+	_, err = k.CreateAPIKey(ctx, models.APIKey{Hash: uniqueName("key-3"), UserID: otherID, Scopes: []string{models.ScopeRead}})
+	require.NoError(t, err)
+	_, err = k.CreateAPIKey(ctx, models.APIKey{Hash: backup.Hash, UserID: otherID, Scopes: []string{models.ScopeRead}})
+	assert.Error(t, err, "the hashes are unique")
+
+	got, err := k.GetAPIKeyByHash(ctx, script.Hash)
+	require.NoError(t, err)
+	assert.Equal(t, script.ID, got.ID)
+	assert.Equal(t, userID, got.UserID)
+	assert.Equal(t, "script", got.Label)
+	assert.Equal(t, []string{models.ScopeRead, models.ScopeWrite}, got.Scopes)
+	require.NotNil(t, got.ExpiresAt)
+	assert.WithinDuration(t, expiresAt, *got.ExpiresAt, time.Millisecond)
+	assert.Nil(t, got.LastUsedAt)
+	_, err = k.GetAPIKeyByHash(ctx, uniqueName("missing"))
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	require.NoError(t, k.TouchAPIKey(ctx, backup.ID))
+	got, err = k.GetAPIKeyByHash(ctx, backup.Hash)
+	require.NoError(t, err)
+	require.NotNil(t, got.LastUsedAt)
+	assert.WithinDuration(t, time.Now(), *got.LastUsedAt, 5*time.Second)
+	assert.Nil(t, got.ExpiresAt)
+
+	// Every user lists and revokes only their own keys
+	keys, err := k.ListAPIKeys(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	assert.Equal(t, backup.ID, keys[0].ID)
+	assert.Equal(t, script.ID, keys[1].ID)
+
+	assert.ErrorIs(t, k.RevokeAPIKey(ctx, otherID, backup.ID), models.ErrNotFound)
+	require.NoError(t, k.RevokeAPIKey(ctx, userID, backup.ID))
+	assert.ErrorIs(t, k.RevokeAPIKey(ctx, userID, backup.ID), models.ErrNotFound)
+	_, err = k.GetAPIKeyByHash(ctx, backup.Hash)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	keys, err = k.ListAPIKeys(ctx, userID)
+	require.NoError(t, err)
+	assert.Len(t, keys, 1)
+
+	// The keys are deleted with their user
+	require.NoError(t, k.DeleteUser(ctx, userID))
+	_, err = k.GetAPIKeyByHash(ctx, script.Hash)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+}
+
+func testUserEmail(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	otherID := newUser(t, k)
+	email := uniqueName("user") + "@example.com"
+
+	// Accounts have no email until their user sets one, and it is unverified until it is verified
+	got, err := k.GetUserEmail(ctx, userID)
+	require.NoError(t, err)
+	assert.Empty(t, got.Email)
+	assert.NotEmpty(t, got.Username)
+	_, err = k.FindUserByEmail(ctx, email)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	require.NoError(t, k.SetUserEmail(ctx, userID, email))
+	assert.ErrorIs(t, k.SetUserEmail(ctx, otherID, email), models.ErrEmailTaken)
+	assert.ErrorIs(t, k.SetUserEmail(ctx, 999999, uniqueName("nobody")+"@example.com"), models.ErrNotFound)
+	got, err = k.FindUserByEmail(ctx, email)
+	require.NoError(t, err)
+	assert.Equal(t, userID, got.UserID)
+	assert.False(t, got.Verified)
+
+	assert.ErrorIs(t, k.VerifyUserEmail(ctx, userID, "other@example.com"), models.ErrNotFound)
+	require.NoError(t, k.VerifyUserEmail(ctx, userID, email))
+	got, err = k.GetUserEmail(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, email, got.Email)
+	assert.True(t, got.Verified)
+
+	// A token is used once, for its purpose, until it expires
+	token := models.EmailToken{Hash: uniqueName("token"), UserID: userID, Purpose: models.EmailTokenReset,
+		Email: email, ExpiresAt: time.Now().Add(time.Hour)}
+	require.NoError(t, k.CreateEmailToken(ctx, token))
+	_, err = k.ConsumeEmailToken(ctx, token.Hash, models.EmailTokenVerify)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	used, err := k.ConsumeEmailToken(ctx, token.Hash, models.EmailTokenReset)
+	require.NoError(t, err)
+	assert.Equal(t, userID, used.UserID)
+	assert.Equal(t, email, used.Email)
+	assert.WithinDuration(t, token.ExpiresAt, used.ExpiresAt, time.Millisecond)
+	_, err = k.ConsumeEmailToken(ctx, token.Hash, models.EmailTokenReset)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	expired := models.EmailToken{Hash: uniqueName("expired"), UserID: userID, Purpose: models.EmailTokenReset,
+		Email: email, ExpiresAt: time.Now().Add(-time.Minute)}
+	require.NoError(t, k.CreateEmailToken(ctx, expired))
+	_, err = k.ConsumeEmailToken(ctx, expired.Hash, models.EmailTokenReset)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	// A new email is unverified, the tokens mailed to the previous one are void
+	pending := models.EmailToken{Hash: uniqueName("pending"), UserID: userID, Purpose: models.EmailTokenVerify,
+		Email: email, ExpiresAt: time.Now().Add(time.Hour)}
+	require.NoError(t, k.CreateEmailToken(ctx, pending))
+	require.NoError(t, k.SetUserEmail(ctx, userID, ""))
+	_, err = k.ConsumeEmailToken(ctx, pending.Hash, models.EmailTokenVerify)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	got, err = k.GetUserEmail(ctx, userID)
+	require.NoError(t, err)
+	assert.Empty(t, got.Email)
+	assert.False(t, got.Verified)
+	require.NoError(t, k.SetUserEmail(ctx, otherID, email), "a cleared email is free again")
+}
+
+// testUserLanguage checks the language the users are mailed in.
+func testUserLanguage(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	require.NoError(t, k.SetUserEmail(ctx, userID, uniqueName("user")+"@example.com"))
+
+	// Accounts have no language until their user sets one
+	got, err := k.GetUserEmail(ctx, userID)
+	require.NoError(t, err)
+	assert.Empty(t, got.Language)
+
+	require.NoError(t, k.SetUserLanguage(ctx, userID, "pt-BR"))
+	got, err = k.GetUserEmail(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, "pt-BR", got.Language)
+	found, err := k.FindUserByEmail(ctx, got.Email)
+	require.NoError(t, err)
+	assert.Equal(t, "pt-BR", found.Language, "the reset emails are in the language of the user")
+
+	require.NoError(t, k.SetUserLanguage(ctx, userID, ""))
+	got, err = k.GetUserEmail(ctx, userID)
+	require.NoError(t, err)
+	assert.Empty(t, got.Language)
+
+	assert.ErrorIs(t, k.SetUserLanguage(ctx, 999999, "en"), models.ErrNotFound)
+}
+
+// testDevices checks the registration of the devices, their synchronization checkpoints and their revocation.
+func testDevices(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	otherID := newUser(t, k)
+
+	devices, err := k.GetDevices(ctx, userID)
+	require.NoError(t, err)
+	assert.Empty(t, devices)
+	assert.ErrorIs(t, k.TouchDevice(ctx, userID, "phone"), models.ErrNotFound)
+	assert.ErrorIs(t, k.SetDeviceLastSync(ctx, userID, "phone", time.Now()), models.ErrNotFound)
+
+	// A device registered again keeps its name unless it is given a new one, the ids are per user
+	require.NoError(t, k.RegisterDevice(ctx, userID, "phone", "My phone"))
+	require.NoError(t, k.RegisterDevice(ctx, userID, "laptop", "Laptop"))
+	require.NoError(t, k.RegisterDevice(ctx, otherID, "phone", "Other phone"))
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, k.RegisterDevice(ctx, userID, "phone", ""))
+
+	devices, err = k.GetDevices(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, devices, 2)
+	assert.Equal(t, "phone", devices[0].DeviceID)
+	assert.Equal(t, "My phone", devices[0].Name)
+	assert.Equal(t, "laptop", devices[1].DeviceID)
+	assert.Nil(t, devices[0].LastSyncAt)
+
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, k.TouchDevice(ctx, userID, "laptop"))
+	devices, err = k.GetDevices(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, "laptop", devices[0].DeviceID)
+
+	// The checkpoint only moves forward
+	checkpoint := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, k.SetDeviceLastSync(ctx, userID, "phone", checkpoint))
+	require.NoError(t, k.SetDeviceLastSync(ctx, userID, "phone", checkpoint.Add(-time.Hour)))
+	devices, err = k.GetDevices(ctx, userID)
+	require.NoError(t, err)
+	require.NotNil(t, devices[1].LastSyncAt)
+	assert.True(t, checkpoint.Equal(*devices[1].LastSyncAt), devices[1].LastSyncAt)
+
+	// A revoked device is gone with its session, the devices of the other user are kept
+	expiresAt := time.Now().Add(time.Hour)
+	phone := models.RefreshToken{Hash: uniqueName("hash"), UserID: userID, DeviceID: "phone", FamilyID: uniqueName("family"), ExpiresAt: expiresAt}
+	laptop := models.RefreshToken{Hash: uniqueName("hash"), UserID: userID, DeviceID: "laptop", FamilyID: uniqueName("family"), ExpiresAt: expiresAt}
+	other := models.RefreshToken{Hash: uniqueName("hash"), UserID: otherID, DeviceID: "phone", FamilyID: uniqueName("family"), ExpiresAt: expiresAt}
+	for _, tok := range []models.RefreshToken{phone, laptop, other} {
+		require.NoError(t, k.StoreRefreshToken(ctx, tok))
+	}
+	require.NoError(t, k.RevokeDevice(ctx, userID, "phone"))
+	assert.ErrorIs(t, k.RevokeDevice(ctx, userID, "phone"), models.ErrNotFound)
+
+	for hash, revoked := range map[string]bool{phone.Hash: true, laptop.Hash: false, other.Hash: false} {
+		got, err := k.GetRefreshToken(ctx, hash)
+		require.NoError(t, err)
+		assert.Equal(t, revoked, got.Revoked, got.DeviceID)
+	}
+	devices, err = k.GetDevices(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, devices, 1)
+	assert.Equal(t, "laptop", devices[0].DeviceID)
+	devices, err = k.GetDevices(ctx, otherID)
+	require.NoError(t, err)
+	assert.Len(t, devices, 1)
+}
+
+// testUserOperations checks that a user has one running operation at most, which fails once it expires
+// unless it is extended, and is finished by its update.
+func testUserOperations(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	otherID := newUser(t, k)
+
+	_, err := k.GetRunningOperation(ctx, userID)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	start := func(userID int, expiresAt time.Time) (models.UserOperation, error) {
+		return k.StartUserOperation(ctx, models.UserOperation{ID: uniqueName("operation"), UserID: userID,
+			Kind: models.OperationReencrypt, DeviceID: "phone", ExpectedSeconds: 60, ExpiresAt: expiresAt})
+	}
+	op, err := start(userID, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, models.OperationRunning, op.Status)
+	assert.Equal(t, "phone", op.DeviceID)
+	assert.Equal(t, 60, op.ExpectedSeconds)
+	assert.False(t, op.StartedAt.IsZero())
+	assert.Nil(t, op.FinishedAt)
+
+	// Another operation of the user waits for the running one, the other users don't
+	_, err = start(userID, time.Now().Add(time.Hour))
+	assert.ErrorIs(t, err, models.ErrOperationRunning)
+	other, err := start(otherID, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+
+	running, err := k.GetRunningOperation(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, op.ID, running.ID)
+
+	// Extending the operation keeps it running, finishing it ends it
+	extended := time.Now().Add(2 * time.Hour).UTC().Truncate(time.Millisecond)
+	running, err = k.UpdateUserOperation(ctx, userID, op.ID, models.OperationRunning, extended)
+	require.NoError(t, err)
+	assert.Equal(t, models.OperationRunning, running.Status)
+	assert.True(t, extended.Equal(running.ExpiresAt))
+	_, err = k.UpdateUserOperation(ctx, otherID, op.ID, models.OperationCompleted, time.Time{})
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	done, err := k.UpdateUserOperation(ctx, userID, op.ID, models.OperationCompleted, time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, models.OperationCompleted, done.Status)
+	require.NotNil(t, done.FinishedAt)
+	_, err = k.GetRunningOperation(ctx, userID)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	_, err = k.UpdateUserOperation(ctx, userID, op.ID, models.OperationFailed, time.Time{})
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	// An operation which expired fails, it can't be extended and no longer holds back the next one
+	stalled, err := start(userID, time.Now().Add(-time.Second))
+	require.NoError(t, err)
+	_, err = k.GetRunningOperation(ctx, userID)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	_, err = k.UpdateUserOperation(ctx, userID, stalled.ID, models.OperationRunning, time.Now().Add(time.Hour))
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	_, err = start(userID, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+
+	running, err = k.GetRunningOperation(ctx, otherID)
+	require.NoError(t, err)
+	assert.Equal(t, other.ID, running.ID)
+}
+
+// testUploadSessions checks that an upload session is only found by its user until it expires,
+// that the expired sessions are pruned, and that the ids of the file entries of another user are taken.
+func testUploadSessions(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	otherID := newUser(t, k)
+
+	create := func(expiresAt time.Time) models.UploadSession {
+		session, err := k.CreateUploadSession(ctx, models.UploadSession{ID: uniqueName("upload"), UserID: userID,
+			EntryID: uniqueName("entry"), Size: 5 << 20, ExpiresAt: expiresAt})
+		require.NoError(t, err)
+		return session
+	}
+	session := create(time.Now().Add(time.Hour))
+	assert.False(t, session.CreatedAt.IsZero())
+
+	got, err := k.GetUploadSession(ctx, userID, session.ID)
+	require.NoError(t, err)
+	assert.Equal(t, session.EntryID, got.EntryID)
+	assert.Equal(t, int64(5<<20), got.Size)
+	_, err = k.GetUploadSession(ctx, otherID, session.ID)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	// An expired session isn't found, it is pruned with the other expired ones
+	expired := create(time.Now().Add(-time.Minute))
+	_, err = k.GetUploadSession(ctx, userID, expired.ID)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	pruned, err := k.PruneUploadSessions(ctx, time.Now())
+	require.NoError(t, err)
+	assert.Contains(t, pruned, expired.ID)
+	assert.NotContains(t, pruned, session.ID)
+	assert.ErrorIs(t, k.DeleteUploadSession(ctx, userID, expired.ID), models.ErrNotFound)
+
+	assert.ErrorIs(t, k.DeleteUploadSession(ctx, otherID, session.ID), models.ErrNotFound)
+	require.NoError(t, k.DeleteUploadSession(ctx, userID, session.ID))
+	_, err = k.GetUploadSession(ctx, userID, session.ID)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	// The id of a file entry of another user, deleted or not, is taken
+	entryID := models.NewEntryID()
+	taken, err := k.FileEntryTaken(ctx, userID, entryID)
+	require.NoError(t, err)
+	assert.False(t, taken)
+	_, _, err = k.AddData(ctx, models.FilesTable, otherID, entryID, map[string]string{"path": "scan.pdf"})
+	require.NoError(t, err)
+	_, err = k.DeleteData(ctx, models.FilesTable, otherID, entryID)
+	require.NoError(t, err)
+	taken, err = k.FileEntryTaken(ctx, userID, entryID)
+	require.NoError(t, err)
+	assert.True(t, taken)
+	taken, err = k.FileEntryTaken(ctx, otherID, entryID)
+	require.NoError(t, err)
+	assert.False(t, taken)
+}
+
+// testFileBlobs checks that the file entries with the same contents share their stored blob, counted once
+// per entry, that the blob is only found through its user, that the clients can't write it, and that
+// the contents are released once no entry points at them.
+func testFileBlobs(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	otherID := newUser(t, k)
+	entryA, entryB, entryC, entryD := uniqueName("entry"), uniqueName("entry"), uniqueName("entry"), uniqueName("entry")
+	fields := map[string]string{"path": "scan.pdf"}
+	scan := models.FileBlob{Size: 12, SHA256: uniqueName("sum")}
+	photo := models.FileBlob{Key: uniqueName("files/blob"), Size: 7, SHA256: uniqueName("sum")}
+
+	blobOf := func(userID int, entryID string) models.FileBlob {
+		blob, err := k.GetFileBlob(ctx, userID, entryID)
+		require.NoError(t, err)
+		return blob
+	}
+	write := func(userID int, entryID string, blob models.FileBlob) []string {
+		released, updatedAt, err := k.WriteFileBlob(ctx, userID, entryID, fields, blob)
+		require.NoError(t, err)
+		assert.False(t, updatedAt.IsZero())
+		return released
+	}
+
+	// New contents are only pointed at with the key of their object, nothing is written before
+	_, _, err := k.WriteFileBlob(ctx, userID, entryA, fields, scan)
+	assert.ErrorIs(t, err, models.ErrBlobNotStored)
+	_, err = k.GetFileBlob(ctx, userID, entryA)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	stored := scan
+	stored.Key = uniqueName("files/blob")
+	assert.Empty(t, write(userID, entryA, stored))
+	assert.Equal(t, stored, blobOf(userID, entryA))
+	entry, err := k.GetData(ctx, models.FilesTable, userID, entryA, false)
+	require.NoError(t, err)
+	assert.Equal(t, "scan.pdf", entry["path"])
+	assert.NotContains(t, entry, "blob_key")
+	_, err = k.GetFileBlob(ctx, otherID, entryA)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	// The same contents are shared, an object put for them meanwhile isn't needed
+	assert.Empty(t, write(userID, entryB, scan))
+	assert.Equal(t, stored, blobOf(userID, entryB))
+	racing := scan
+	racing.Key = uniqueName("files/blob")
+	assert.Equal(t, []string{racing.Key}, write(otherID, entryC, racing))
+	assert.Equal(t, stored, blobOf(otherID, entryC))
+
+	// New contents of an entry keep the shared ones stored
+	assert.Empty(t, write(userID, entryA, photo))
+	assert.Equal(t, photo, blobOf(userID, entryA))
+	assert.Empty(t, write(userID, entryD, scan))
+
+	// The clients write the fields of the entry, never its blob
+	_, err = k.UpdateData(ctx, models.FilesTable, userID, entryA, map[string]string{"path": "photo.jpg", "blob_key": stored.Key})
+	require.NoError(t, err)
+	assert.Equal(t, photo, blobOf(userID, entryA))
+
+	// The shared contents count once in the physical usage
+	users, err := k.ListUsers(ctx, userID-1, 1)
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, int64(7+12+12), users[0].LogicalFileBytes)
+	assert.Equal(t, int64(7+12), users[0].PhysicalFileBytes)
+
+	// The deleted entries still point at their contents
+	for _, entryID := range []string{entryB, entryD} {
+		_, err = k.DeleteData(ctx, models.FilesTable, userID, entryID)
+		require.NoError(t, err)
+	}
+	unknown := uniqueName("files/blob")
+	referenced, err := k.ReferencedBlobs(ctx, []string{stored.Key, racing.Key, photo.Key, unknown})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{stored.Key: true, photo.Key: true}, referenced)
+	referenced, err = k.ReferencedBlobs(ctx, nil)
+	require.NoError(t, err)
+	assert.Empty(t, referenced)
+
+	// The contents are released with the last entry pointing at them
+	assert.Empty(t, write(otherID, entryC, photo))
+	require.NoError(t, k.DeleteUser(ctx, userID))
+	referenced, err = k.ReferencedBlobs(ctx, []string{stored.Key, photo.Key})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{photo.Key: true}, referenced)
+	_, _, err = k.WriteFileBlob(ctx, otherID, entryC, fields, scan)
+	assert.ErrorIs(t, err, models.ErrBlobNotStored)
+	assert.Equal(t, []string{photo.Key}, write(otherID, entryC, models.FileBlob{Key: racing.Key, Size: 12, SHA256: scan.SHA256}))
+}
+
+func testMonitorTokens(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+
+	status, err := k.CreateMonitorToken(ctx, models.MonitorToken{Hash: uniqueName("monitor-1"), Name: "status page"})
+	require.NoError(t, err)
+	assert.NotZero(t, status.ID)
+	assert.WithinDuration(t, time.Now(), status.CreatedAt, 5*time.Second)
+	pager, err := k.CreateMonitorToken(ctx, models.MonitorToken{Hash: uniqueName("monitor-2"), Name: "pager"})
+	require.NoError(t, err)
+	_, err = k.CreateMonitorToken(ctx, models.MonitorToken{Hash: status.Hash, Name: "copy"})
+	assert.Error(t, err, "the hashes are unique")
+
+	got, err := k.GetMonitorTokenByHash(ctx, pager.Hash)
+	require.NoError(t, err)
+	assert.Equal(t, pager.ID, got.ID)
+	assert.Equal(t, "pager", got.Name)
+	assert.Nil(t, got.LastUsedAt)
+	_, err = k.GetMonitorTokenByHash(ctx, uniqueName("missing"))
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	require.NoError(t, k.TouchMonitorToken(ctx, status.ID))
+	got, err = k.GetMonitorTokenByHash(ctx, status.Hash)
+	require.NoError(t, err)
+	require.NotNil(t, got.LastUsedAt)
+	assert.WithinDuration(t, time.Now(), *got.LastUsedAt, 5*time.Second)
+
+	// The tokens are listed oldest first, with the other tokens of the keeper
+	tokens, err := k.ListMonitorTokens(ctx)
+	require.NoError(t, err)
+	var ids []int
+	for _, token := range tokens {
+		if token.ID == status.ID || token.ID == pager.ID {
+			ids = append(ids, token.ID)
+		}
+	}
+	assert.Equal(t, []int{status.ID, pager.ID}, ids)
+
+	revoked, err := k.RevokeMonitorToken(ctx, status.ID)
+	require.NoError(t, err)
+	assert.Equal(t, status.Hash, revoked.Hash)
+	_, err = k.RevokeMonitorToken(ctx, status.ID)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	_, err = k.GetMonitorTokenByHash(ctx, status.Hash)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+}
+
+func testShares(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	ownerID := newUser(t, k)
+	granteeID := newUser(t, k)
+	otherID := newUser(t, k)
+
+	readID, _, err := k.AddData(ctx, "UserCredentials", ownerID, "", credential("shared-read"))
+	require.NoError(t, err)
+	writeID, _, err := k.AddData(ctx, "UserCredentials", ownerID, "", credential("shared-write"))
+	require.NoError(t, err)
+
+	// Only a live entry of the owner is shared, with another user
+	_, err = k.ShareEntry(ctx, models.Share{OwnerID: otherID, GranteeID: granteeID, Table: "UserCredentials", EntryID: readID, Permission: models.ShareRead})
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	_, err = k.ShareEntry(ctx, models.Share{OwnerID: ownerID, GranteeID: ownerID, Table: "UserCredentials", EntryID: readID, Permission: models.ShareRead})
+	assert.ErrorIs(t, err, models.ErrInvalidShare)
+	_, err = k.ShareEntry(ctx, models.Share{OwnerID: ownerID, GranteeID: granteeID, Table: "UserCredentials", EntryID: readID, Permission: "admin"})
+	assert.ErrorIs(t, err, models.ErrInvalidShare)
+
+	share, err := k.ShareEntry(ctx, models.Share{OwnerID: ownerID, GranteeID: granteeID, Table: "UserCredentials", EntryID: readID, Permission: models.ShareRead})
+	require.NoError(t, err)
+	assert.False(t, share.CreatedAt.IsZero())
+	_, err = k.ShareEntry(ctx, models.Share{OwnerID: ownerID, GranteeID: granteeID, Table: "UserCredentials", EntryID: writeID, Permission: models.ShareWrite})
+	require.NoError(t, err)
+
+	shared, err := k.GetSharedWithUser(ctx, granteeID, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, shared, 2)
+	byID := make(map[string]models.SharedEntry)
+	for _, e := range shared {
+		byID[e.EntryID] = e
+	}
+	assert.Equal(t, models.ShareRead, byID[readID].Permission)
+	assert.Equal(t, "shared-read", byID[readID].Fields["login"])
+	assert.Equal(t, ownerID, byID[readID].OwnerID)
+	assert.NotEmpty(t, byID[readID].Owner)
+	assert.False(t, byID[readID].Removed)
+	others, err := k.GetSharedWithUser(ctx, otherID, time.Time{})
+	require.NoError(t, err)
+	assert.Empty(t, others)
+
+	// The grantee writes an entry shared read-write, not one shared read-only or not shared with them
+	_, err = k.UpdateData(ctx, "UserCredentials", granteeID, readID, map[string]string{"login": "changed"})
+	assert.ErrorIs(t, err, models.ErrReadOnlyShare)
+	_, err = k.DeleteData(ctx, "UserCredentials", granteeID, readID)
+	assert.ErrorIs(t, err, models.ErrReadOnlyShare)
+	updatedAt, err := k.UpdateData(ctx, "UserCredentials", granteeID, writeID, map[string]string{"login": "changed"})
+	require.NoError(t, err)
+	assert.False(t, updatedAt.IsZero())
+	_, err = k.UpdateData(ctx, "UserCredentials", otherID, writeID, map[string]string{"login": "other"})
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	entry, err := k.GetData(ctx, "UserCredentials", ownerID, writeID, false)
+	require.NoError(t, err)
+	assert.Equal(t, "changed", entry["login"])
+
+	// Sharing again changes the permission
+	_, err = k.ShareEntry(ctx, models.Share{OwnerID: ownerID, GranteeID: granteeID, Table: "UserCredentials", EntryID: readID, Permission: models.ShareWrite})
+	require.NoError(t, err)
+	_, err = k.UpdateData(ctx, "UserCredentials", granteeID, readID, map[string]string{"login": "upgraded"})
+	require.NoError(t, err)
+
+	// The sync pulls the changes of the shared entries, then their removal once revoked or deleted
+	first, err := k.Sync(ctx, granteeID, time.Time{}, nil)
+	require.NoError(t, err)
+	require.Len(t, first.Shared, 2)
+	assert.Empty(t, first.Changes["UserCredentials"])
+
+	time.Sleep(5 * time.Millisecond)
+	assert.ErrorIs(t, k.RevokeShare(ctx, otherID, granteeID, "UserCredentials", readID), models.ErrNotFound)
+	require.NoError(t, k.RevokeShare(ctx, ownerID, granteeID, "UserCredentials", readID))
+	assert.ErrorIs(t, k.RevokeShare(ctx, ownerID, granteeID, "UserCredentials", readID), models.ErrNotFound)
+	_, err = k.DeleteData(ctx, "UserCredentials", ownerID, writeID)
+	require.NoError(t, err)
+
+	next, err := k.Sync(ctx, granteeID, first.Watermark, nil)
+	require.NoError(t, err)
+	require.Len(t, next.Shared, 2)
+	for _, e := range next.Shared {
+		assert.True(t, e.Removed, e.EntryID)
+		assert.Nil(t, e.Fields, e.EntryID)
+	}
+	assert.True(t, next.Watermark.After(first.Watermark))
+
+	// Nothing changed since
+	last, err := k.Sync(ctx, granteeID, next.Watermark, nil)
+	require.NoError(t, err)
+	assert.Empty(t, last.Shared)
+
+	// A revoked share gives no access and isn't listed
+	_, err = k.UpdateData(ctx, "UserCredentials", granteeID, readID, map[string]string{"login": "revoked"})
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	entry, err = k.GetData(ctx, "UserCredentials", ownerID, readID, false)
+	require.NoError(t, err)
+	assert.Equal(t, "upgraded", entry["login"])
+	shared, err = k.GetSharedWithUser(ctx, granteeID, time.Time{})
+	require.NoError(t, err)
+	assert.Empty(t, shared)
+
+	// Granted again, then the owner is deleted: the grantee drops the entry
+	_, err = k.ShareEntry(ctx, models.Share{OwnerID: ownerID, GranteeID: granteeID, Table: "UserCredentials", EntryID: readID, Permission: models.ShareRead})
+	require.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+	since := time.Now().UTC()
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, k.DeleteUser(ctx, ownerID))
+	shared, err = k.GetSharedWithUser(ctx, granteeID, since)
+	require.NoError(t, err)
+	removed := make(map[string]bool)
+	for _, e := range shared {
+		removed[e.EntryID] = e.Removed
+	}
+	assert.True(t, removed[readID])
+	_, err = k.UpdateData(ctx, "UserCredentials", granteeID, readID, map[string]string{"login": "orphan"})
+	assert.ErrorIs(t, err, models.ErrNotFound)
+}
+
+func testFolders(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	userID := newUser(t, k)
+	otherID := newUser(t, k)
+
+	work, err := k.CreateFolder(ctx, models.Folder{ID: models.NewEntryID(), UserID: userID, Name: " Work "})
+	require.NoError(t, err)
+	assert.Equal(t, "Work", work.Name)
+	assert.False(t, work.UpdatedAt.IsZero())
+	projects, err := k.CreateFolder(ctx, models.Folder{ID: models.NewEntryID(), UserID: userID, Name: "Projects", ParentID: work.ID})
+	require.NoError(t, err)
+
+	// The names are unique in a parent regardless of case, the parent is a folder of the user
+	_, err = k.CreateFolder(ctx, models.Folder{ID: models.NewEntryID(), UserID: userID, Name: "WORK"})
+	assert.ErrorIs(t, err, models.ErrFolderExists)
+	_, err = k.CreateFolder(ctx, models.Folder{ID: models.NewEntryID(), UserID: otherID, Name: "Work"})
+	require.NoError(t, err)
+	_, err = k.CreateFolder(ctx, models.Folder{ID: models.NewEntryID(), UserID: otherID, Name: "Mine", ParentID: work.ID})
+	assert.ErrorIs(t, err, models.ErrInvalidFolder)
+	_, err = k.CreateFolder(ctx, models.Folder{ID: work.ID, UserID: userID, Name: "Again"})
+	assert.ErrorIs(t, err, models.ErrInvalidFolder)
+	_, err = k.CreateFolder(ctx, models.Folder{ID: models.NewEntryID(), UserID: userID, Name: ""})
+	assert.ErrorIs(t, err, models.ErrInvalidFolder)
+
+	// A folder isn't moved inside itself
+	_, err = k.UpdateFolder(ctx, models.Folder{ID: work.ID, UserID: userID, Name: "Work", ParentID: projects.ID})
+	assert.ErrorIs(t, err, models.ErrInvalidFolder)
+	_, err = k.UpdateFolder(ctx, models.Folder{ID: work.ID, UserID: otherID, Name: "Job"})
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	job, err := k.UpdateFolder(ctx, models.Folder{ID: work.ID, UserID: userID, Name: "Job"})
+	require.NoError(t, err)
+	assert.True(t, job.UpdatedAt.After(work.UpdatedAt))
+
+	folders, err := k.GetFolders(ctx, userID, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, folders, 2)
+	assert.Equal(t, "Job", folders[0].Name)
+	assert.Equal(t, work.ID, folders[1].ParentID)
+
+	// The entries are listed by folder, the ones without one at the top
+	inside, _, err := k.AddData(ctx, "UserCredentials", userID, "", map[string]string{
+		"login": "inside", "password": "secret", models.FolderField: projects.ID,
+	})
+	require.NoError(t, err)
+	top, _, err := k.AddData(ctx, "UserCredentials", userID, "", credential("top"))
+	require.NoError(t, err)
+	rows, err := k.GetAllData(ctx, "UserCredentials", userID, models.DataQuery{Folder: projects.ID})
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, inside, rows[0]["id"])
+	rows, err = k.GetAllData(ctx, "UserCredentials", userID, models.DataQuery{Folder: models.RootFolder})
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, top, rows[0]["id"])
+	_, _, err = k.AddData(ctx, "UserCredentials", userID, "", map[string]string{"login": "bad", models.FolderField: "not-a-folder"})
+	assert.ErrorIs(t, err, models.ErrInvalidChange)
+
+	// An entry is only filed in a folder of its user which isn't deleted
+	foreign, err := k.CreateFolder(ctx, models.Folder{ID: models.NewEntryID(), UserID: otherID, Name: "Foreign"})
+	require.NoError(t, err)
+	for _, folderID := range []string{foreign.ID, models.NewEntryID()} {
+		_, _, err = k.AddData(ctx, "UserCredentials", userID, "", map[string]string{"login": "bad", models.FolderField: folderID})
+		assert.ErrorIs(t, err, models.ErrInvalidChange)
+		_, err = k.UpdateData(ctx, "UserCredentials", userID, top, map[string]string{models.FolderField: folderID})
+		assert.ErrorIs(t, err, models.ErrInvalidChange)
+		_, err = k.Sync(ctx, userID, time.Time{}, []models.Change{{Table: "UserCredentials", Op: models.ChangeAdd,
+			EntryID: models.NewEntryID(), Fields: map[string]string{"login": "bad", models.FolderField: folderID}}})
+		assert.ErrorIs(t, err, models.ErrInvalidChange)
+	}
+	rows, err = k.GetAllData(ctx, "UserCredentials", userID, models.DataQuery{Folder: models.RootFolder})
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+
+	first, err := k.Sync(ctx, userID, time.Time{}, nil)
+	require.NoError(t, err)
+	assert.Len(t, first.Folders, 2)
+
+	// A folder with something in it is only deleted moving it up
+	_, err = k.DeleteFolder(ctx, userID, projects.ID, false)
+	assert.ErrorIs(t, err, models.ErrFolderNotEmpty)
+	_, err = k.DeleteFolder(ctx, userID, work.ID, false)
+	assert.ErrorIs(t, err, models.ErrFolderNotEmpty)
+	time.Sleep(5 * time.Millisecond)
+	deletedAt, err := k.DeleteFolder(ctx, userID, projects.ID, true)
+	require.NoError(t, err)
+	assert.False(t, deletedAt.IsZero())
+	_, err = k.DeleteFolder(ctx, userID, projects.ID, true)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	entry, err := k.GetData(ctx, "UserCredentials", userID, inside, false)
+	require.NoError(t, err)
+	assert.Equal(t, work.ID, entry[models.FolderField])
+
+	// The sync pulls the deleted folder and the moved entry
+	next, err := k.Sync(ctx, userID, first.Watermark, nil)
+	require.NoError(t, err)
+	require.Len(t, next.Folders, 1)
+	assert.True(t, next.Folders[0].Deleted)
+	require.Len(t, next.Changes["UserCredentials"], 1)
+	assert.Equal(t, inside, next.Changes["UserCredentials"][0]["id"])
+
+	// The name of a deleted folder is free again
+	_, err = k.CreateFolder(ctx, models.Folder{ID: models.NewEntryID(), UserID: userID, Name: "Projects", ParentID: work.ID})
+	require.NoError(t, err)
+
+	require.NoError(t, k.DeleteUser(ctx, userID))
+	folders, err = k.GetFolders(ctx, userID, time.Time{})
+	require.NoError(t, err)
+	assert.Empty(t, folders)
+}
+
+func testServerFields(t *testing.T, k storage.Keeper) {
+	ctx := context.Background()
+	ownerID := newUser(t, k)
+	granteeID := newUser(t, k)
+
+	entryID, _, err := k.AddData(ctx, "UserCredentials", ownerID, "", credential("shared"))
+	require.NoError(t, err)
+	_, err = k.ShareEntry(ctx, models.Share{OwnerID: ownerID, GranteeID: granteeID, Table: "UserCredentials", EntryID: entryID, Permission: models.ShareWrite})
+	require.NoError(t, err)
+
+	// The grantee of a read-write share neither takes the entry over nor moves it
+	for _, fields := range []map[string]string{
+		{"login": "taken", "user_id": strconv.Itoa(granteeID)},
+		{"login": "moved", "ID": uniqueName("moved")},
+		{"login": "gone", "deleted": "true"},
+	} {
+		_, err = k.UpdateData(ctx, "UserCredentials", granteeID, entryID, fields)
+		assert.ErrorIs(t, err, models.ErrInvalidChange, fields)
+	}
+	entry, err := k.GetData(ctx, "UserCredentials", ownerID, entryID, false)
+	require.NoError(t, err)
+	assert.Equal(t, "shared", entry["login"])
+	assert.Equal(t, strconv.Itoa(ownerID), entry["user_id"])
+	_, err = k.GetData(ctx, "UserCredentials", granteeID, entryID, false)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	// Neither are the fields set by the additions and the synchronized changes
+	fields := credential("alice")
+	fields["deleted"] = "true"
+	_, _, err = k.AddData(ctx, Table, granteeID, uniqueName("added"), fields)
+	assert.ErrorIs(t, err, models.ErrInvalidChange)
+	_, err = k.ApplyChanges(ctx, granteeID, []models.Change{{
+		Table: Table, Op: models.ChangeAdd, EntryID: uniqueName("pushed"),
+		Fields: map[string]string{"login": "carol", "id": entryID},
+	}})
+	assert.ErrorIs(t, err, models.ErrInvalidChange)
+}
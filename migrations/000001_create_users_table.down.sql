@@ -1 +1 @@
-DROP TABLE IF EXISTS Users;
\ No newline at end of file
+DROP TABLE IF EXISTS Users;
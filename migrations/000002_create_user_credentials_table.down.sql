@@ -1 +1 @@
-DROP TABLE IF EXISTS UserCredentials;
\ No newline at end of file
+DROP TABLE IF EXISTS UserCredentials;
@@ -1 +1 @@
-DROP TABLE IF EXISTS CreditCardData;
\ No newline at end of file
+DROP TABLE IF EXISTS CreditCardData;
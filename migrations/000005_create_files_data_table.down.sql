@@ -1 +1 @@
-DROP TABLE IF EXISTS FilesData;
\ No newline at end of file
+DROP TABLE IF EXISTS FilesData;
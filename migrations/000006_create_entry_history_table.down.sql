@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS entry_history_entry_idx;
+DROP TABLE IF EXISTS EntryHistory;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS EntryHistory (
+    id SERIAL PRIMARY KEY,
+    table_name TEXT NOT NULL,
+    entry_id TEXT NOT NULL,
+    user_id INTEGER NOT NULL,
+    snapshot JSONB NOT NULL,
+    changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES Users(id)
+);
+
+CREATE INDEX IF NOT EXISTS entry_history_entry_idx ON EntryHistory (table_name, user_id, entry_id, id);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS files_data_search_idx;
+DROP INDEX IF EXISTS text_data_search_idx;
+DROP INDEX IF EXISTS credit_card_data_search_idx;
+DROP INDEX IF EXISTS user_credentials_search_idx;
@@ -0,0 +1,4 @@
+CREATE INDEX IF NOT EXISTS user_credentials_search_idx ON UserCredentials USING GIN (to_tsvector('simple', coalesce(meta_info, '')));
+CREATE INDEX IF NOT EXISTS credit_card_data_search_idx ON CreditCardData USING GIN (to_tsvector('simple', coalesce(meta_info, '')));
+CREATE INDEX IF NOT EXISTS text_data_search_idx ON TextData USING GIN (to_tsvector('simple', coalesce(meta_info, '')));
+CREATE INDEX IF NOT EXISTS files_data_search_idx ON FilesData USING GIN (to_tsvector('simple', coalesce(meta_info, '')));
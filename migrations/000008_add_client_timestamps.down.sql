@@ -0,0 +1,8 @@
+ALTER TABLE UserCredentials DROP COLUMN IF EXISTS client_created_at;
+ALTER TABLE UserCredentials DROP COLUMN IF EXISTS client_modified_at;
+ALTER TABLE CreditCardData DROP COLUMN IF EXISTS client_created_at;
+ALTER TABLE CreditCardData DROP COLUMN IF EXISTS client_modified_at;
+ALTER TABLE TextData DROP COLUMN IF EXISTS client_created_at;
+ALTER TABLE TextData DROP COLUMN IF EXISTS client_modified_at;
+ALTER TABLE FilesData DROP COLUMN IF EXISTS client_created_at;
+ALTER TABLE FilesData DROP COLUMN IF EXISTS client_modified_at;
@@ -0,0 +1,10 @@
+-- Display timestamps declared by clients, stored as UTC RFC 3339 text, so they are
+-- returned to clients as sent whatever the database.
+ALTER TABLE UserCredentials ADD COLUMN IF NOT EXISTS client_created_at TEXT;
+ALTER TABLE UserCredentials ADD COLUMN IF NOT EXISTS client_modified_at TEXT;
+ALTER TABLE CreditCardData ADD COLUMN IF NOT EXISTS client_created_at TEXT;
+ALTER TABLE CreditCardData ADD COLUMN IF NOT EXISTS client_modified_at TEXT;
+ALTER TABLE TextData ADD COLUMN IF NOT EXISTS client_created_at TEXT;
+ALTER TABLE TextData ADD COLUMN IF NOT EXISTS client_modified_at TEXT;
+ALTER TABLE FilesData ADD COLUMN IF NOT EXISTS client_created_at TEXT;
+ALTER TABLE FilesData ADD COLUMN IF NOT EXISTS client_modified_at TEXT;
@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS user_credentials_tags_idx;
+DROP INDEX IF EXISTS credit_card_data_tags_idx;
+DROP INDEX IF EXISTS text_data_tags_idx;
+DROP INDEX IF EXISTS files_data_tags_idx;
+ALTER TABLE UserCredentials DROP COLUMN IF EXISTS tags;
+ALTER TABLE CreditCardData DROP COLUMN IF EXISTS tags;
+ALTER TABLE TextData DROP COLUMN IF EXISTS tags;
+ALTER TABLE FilesData DROP COLUMN IF EXISTS tags;
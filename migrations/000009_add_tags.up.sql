@@ -0,0 +1,9 @@
+-- Labels of the entries, matched with the containment operator through the GIN indexes.
+ALTER TABLE UserCredentials ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE CreditCardData ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE TextData ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE FilesData ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+CREATE INDEX IF NOT EXISTS user_credentials_tags_idx ON UserCredentials USING GIN (tags);
+CREATE INDEX IF NOT EXISTS credit_card_data_tags_idx ON CreditCardData USING GIN (tags);
+CREATE INDEX IF NOT EXISTS text_data_tags_idx ON TextData USING GIN (tags);
+CREATE INDEX IF NOT EXISTS files_data_tags_idx ON FilesData USING GIN (tags);
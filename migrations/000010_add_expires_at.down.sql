@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS user_credentials_expires_idx;
+DROP INDEX IF EXISTS credit_card_data_expires_idx;
+DROP INDEX IF EXISTS text_data_expires_idx;
+DROP INDEX IF EXISTS files_data_expires_idx;
+ALTER TABLE UserCredentials DROP COLUMN IF EXISTS expires_at;
+ALTER TABLE CreditCardData DROP COLUMN IF EXISTS expires_at;
+ALTER TABLE TextData DROP COLUMN IF EXISTS expires_at;
+ALTER TABLE FilesData DROP COLUMN IF EXISTS expires_at;
@@ -0,0 +1,10 @@
+-- Time after which an entry is deleted by the expiry job, in UTC like updated_at.
+-- The partial indexes keep the job from scanning the entries without an expiry.
+ALTER TABLE UserCredentials ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP;
+ALTER TABLE CreditCardData ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP;
+ALTER TABLE TextData ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP;
+ALTER TABLE FilesData ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP;
+CREATE INDEX IF NOT EXISTS user_credentials_expires_idx ON UserCredentials (expires_at) WHERE deleted = false AND expires_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS credit_card_data_expires_idx ON CreditCardData (expires_at) WHERE deleted = false AND expires_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS text_data_expires_idx ON TextData (expires_at) WHERE deleted = false AND expires_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS files_data_expires_idx ON FilesData (expires_at) WHERE deleted = false AND expires_at IS NOT NULL;
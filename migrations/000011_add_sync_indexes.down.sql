@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS user_credentials_user_updated_idx;
+DROP INDEX IF EXISTS credit_card_data_user_updated_idx;
+DROP INDEX IF EXISTS text_data_user_updated_idx;
+DROP INDEX IF EXISTS files_data_user_updated_idx;
+DROP INDEX IF EXISTS user_credentials_user_deleted_idx;
+DROP INDEX IF EXISTS credit_card_data_user_deleted_idx;
+DROP INDEX IF EXISTS text_data_user_deleted_idx;
+DROP INDEX IF EXISTS files_data_user_deleted_idx;
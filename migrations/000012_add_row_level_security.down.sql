@@ -0,0 +1,14 @@
+DROP POLICY IF EXISTS user_credentials_tenant_policy ON UserCredentials;
+ALTER TABLE UserCredentials DISABLE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS credit_card_data_tenant_policy ON CreditCardData;
+ALTER TABLE CreditCardData DISABLE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS text_data_tenant_policy ON TextData;
+ALTER TABLE TextData DISABLE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS files_data_tenant_policy ON FilesData;
+ALTER TABLE FilesData DISABLE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS entry_history_tenant_policy ON EntryHistory;
+ALTER TABLE EntryHistory DISABLE ROW LEVEL SECURITY;
@@ -0,0 +1,34 @@
+-- The policies restrict the rows of the data tables and of their history to the user
+-- stored in app.current_user_id, which the keeper sets per transaction when it enforces
+-- row-level security. The table owner isn't subject to them, so deployments connecting
+-- as the owner are unaffected, enforcement needs a role that doesn't own the tables.
+-- An unset user matches no rows.
+ALTER TABLE UserCredentials ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS user_credentials_tenant_policy ON UserCredentials;
+CREATE POLICY user_credentials_tenant_policy ON UserCredentials
+    USING (user_id = NULLIF(current_setting('app.current_user_id', true), '')::integer)
+    WITH CHECK (user_id = NULLIF(current_setting('app.current_user_id', true), '')::integer);
+
+ALTER TABLE CreditCardData ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS credit_card_data_tenant_policy ON CreditCardData;
+CREATE POLICY credit_card_data_tenant_policy ON CreditCardData
+    USING (user_id = NULLIF(current_setting('app.current_user_id', true), '')::integer)
+    WITH CHECK (user_id = NULLIF(current_setting('app.current_user_id', true), '')::integer);
+
+ALTER TABLE TextData ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS text_data_tenant_policy ON TextData;
+CREATE POLICY text_data_tenant_policy ON TextData
+    USING (user_id = NULLIF(current_setting('app.current_user_id', true), '')::integer)
+    WITH CHECK (user_id = NULLIF(current_setting('app.current_user_id', true), '')::integer);
+
+ALTER TABLE FilesData ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS files_data_tenant_policy ON FilesData;
+CREATE POLICY files_data_tenant_policy ON FilesData
+    USING (user_id = NULLIF(current_setting('app.current_user_id', true), '')::integer)
+    WITH CHECK (user_id = NULLIF(current_setting('app.current_user_id', true), '')::integer);
+
+ALTER TABLE EntryHistory ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS entry_history_tenant_policy ON EntryHistory;
+CREATE POLICY entry_history_tenant_policy ON EntryHistory
+    USING (user_id = NULLIF(current_setting('app.current_user_id', true), '')::integer)
+    WITH CHECK (user_id = NULLIF(current_setting('app.current_user_id', true), '')::integer);
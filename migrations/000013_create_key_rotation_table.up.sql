@@ -0,0 +1,10 @@
+-- Progress of the re-encryption of each table under the current encryption key,
+-- so an interrupted rotation resumes after the last rotated row.
+CREATE TABLE IF NOT EXISTS KeyRotation (
+    table_name TEXT PRIMARY KEY,
+    key_id TEXT NOT NULL,
+    last_id TEXT NOT NULL,
+    rotated INTEGER NOT NULL DEFAULT 0,
+    done BOOLEAN NOT NULL DEFAULT FALSE,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,17 @@
+-- Authentication attempts and data changes of the users, pruned after the retention period.
+-- user_id is NULL for the failed attempts on unknown accounts.
+CREATE TABLE IF NOT EXISTS audit_log (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER,
+    action TEXT NOT NULL,
+    table_name TEXT NOT NULL DEFAULT '',
+    entry_id TEXT NOT NULL DEFAULT '',
+    remote_addr TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    success BOOLEAN NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES Users(id)
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_user_idx ON audit_log (user_id, created_at);
+CREATE INDEX IF NOT EXISTS audit_log_created_idx ON audit_log (created_at);
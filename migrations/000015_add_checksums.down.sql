@@ -0,0 +1,4 @@
+ALTER TABLE UserCredentials DROP COLUMN IF EXISTS checksum;
+ALTER TABLE CreditCardData DROP COLUMN IF EXISTS checksum;
+ALTER TABLE TextData DROP COLUMN IF EXISTS checksum;
+ALTER TABLE FilesData DROP COLUMN IF EXISTS checksum;
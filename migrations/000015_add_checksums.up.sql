@@ -0,0 +1,6 @@
+-- SHA-256 of the payload of an entry, written with every change and compared by the integrity check.
+-- The entries stored before it have no checksum until their next change.
+ALTER TABLE UserCredentials ADD COLUMN IF NOT EXISTS checksum TEXT;
+ALTER TABLE CreditCardData ADD COLUMN IF NOT EXISTS checksum TEXT;
+ALTER TABLE TextData ADD COLUMN IF NOT EXISTS checksum TEXT;
+ALTER TABLE FilesData ADD COLUMN IF NOT EXISTS checksum TEXT;
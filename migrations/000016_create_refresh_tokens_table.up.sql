@@ -0,0 +1,16 @@
+-- Refresh tokens issued to the devices of the users, stored by the SHA-256 of their value.
+-- A refresh revokes the token and issues the next one of its family, which starts with a login,
+-- so a revoked token presented again reveals a theft and revokes the whole family.
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id SERIAL PRIMARY KEY,
+    token_hash TEXT NOT NULL UNIQUE,
+    user_id INTEGER NOT NULL,
+    device_id TEXT NOT NULL,
+    family_id TEXT NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    revoked BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES Users(id)
+);
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_family_idx ON refresh_tokens (family_id);
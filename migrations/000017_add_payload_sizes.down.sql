@@ -0,0 +1,4 @@
+ALTER TABLE UserCredentials DROP COLUMN IF EXISTS payload_size;
+ALTER TABLE CreditCardData DROP COLUMN IF EXISTS payload_size;
+ALTER TABLE TextData DROP COLUMN IF EXISTS payload_size;
+ALTER TABLE FilesData DROP COLUMN IF EXISTS payload_size;
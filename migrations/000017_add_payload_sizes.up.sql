@@ -0,0 +1,8 @@
+-- Size of an entry as a synchronization sends it, written with every change and summed by the
+-- estimate of the pending changes over the (user_id, updated_at) indexes.
+-- The entries stored before it are filled in by the server in batches, see the payload_sizes
+-- data migration.
+ALTER TABLE UserCredentials ADD COLUMN IF NOT EXISTS payload_size BIGINT;
+ALTER TABLE CreditCardData ADD COLUMN IF NOT EXISTS payload_size BIGINT;
+ALTER TABLE TextData ADD COLUMN IF NOT EXISTS payload_size BIGINT;
+ALTER TABLE FilesData ADD COLUMN IF NOT EXISTS payload_size BIGINT;
@@ -0,0 +1,2 @@
+ALTER TABLE Users DROP COLUMN IF EXISTS locked_until;
+ALTER TABLE Users DROP COLUMN IF EXISTS failed_attempts;
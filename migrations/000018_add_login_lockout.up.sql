@@ -0,0 +1,4 @@
+-- The consecutive failed logins of an account, reset by a successful one,
+-- and the end of its lockout once they reach the threshold.
+ALTER TABLE Users ADD COLUMN IF NOT EXISTS failed_attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE Users ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP;
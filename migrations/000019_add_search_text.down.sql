@@ -0,0 +1,12 @@
+DROP INDEX IF EXISTS files_data_search_text_idx;
+DROP INDEX IF EXISTS text_data_search_text_idx;
+DROP INDEX IF EXISTS credit_card_data_search_text_idx;
+DROP INDEX IF EXISTS user_credentials_search_text_idx;
+CREATE INDEX IF NOT EXISTS user_credentials_search_idx ON UserCredentials USING GIN (to_tsvector('simple', coalesce(meta_info, '')));
+CREATE INDEX IF NOT EXISTS credit_card_data_search_idx ON CreditCardData USING GIN (to_tsvector('simple', coalesce(meta_info, '')));
+CREATE INDEX IF NOT EXISTS text_data_search_idx ON TextData USING GIN (to_tsvector('simple', coalesce(meta_info, '')));
+CREATE INDEX IF NOT EXISTS files_data_search_idx ON FilesData USING GIN (to_tsvector('simple', coalesce(meta_info, '')));
+ALTER TABLE UserCredentials DROP COLUMN IF EXISTS search_text;
+ALTER TABLE CreditCardData DROP COLUMN IF EXISTS search_text;
+ALTER TABLE TextData DROP COLUMN IF EXISTS search_text;
+ALTER TABLE FilesData DROP COLUMN IF EXISTS search_text;
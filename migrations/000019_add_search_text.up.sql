@@ -0,0 +1,23 @@
+-- Text of meta_info as the search indexes it, cut after 65536 characters and marked, written by the server
+-- with every change. The full-text indexes move to it, so a large meta information can't exceed the size
+-- limit of tsvector. It stays NULL for the encrypted values, the database mustn't see their plaintext.
+ALTER TABLE UserCredentials ADD COLUMN IF NOT EXISTS search_text TEXT;
+ALTER TABLE CreditCardData ADD COLUMN IF NOT EXISTS search_text TEXT;
+ALTER TABLE TextData ADD COLUMN IF NOT EXISTS search_text TEXT;
+ALTER TABLE FilesData ADD COLUMN IF NOT EXISTS search_text TEXT;
+UPDATE UserCredentials SET search_text = CASE WHEN char_length(meta_info) > 65536 THEN left(meta_info, 65536) || ' …' ELSE meta_info END
+    WHERE search_text IS NULL AND meta_info <> '' AND meta_info NOT LIKE 'gkenc:v1:%';
+UPDATE CreditCardData SET search_text = CASE WHEN char_length(meta_info) > 65536 THEN left(meta_info, 65536) || ' …' ELSE meta_info END
+    WHERE search_text IS NULL AND meta_info <> '' AND meta_info NOT LIKE 'gkenc:v1:%';
+UPDATE TextData SET search_text = CASE WHEN char_length(meta_info) > 65536 THEN left(meta_info, 65536) || ' …' ELSE meta_info END
+    WHERE search_text IS NULL AND meta_info <> '' AND meta_info NOT LIKE 'gkenc:v1:%';
+UPDATE FilesData SET search_text = CASE WHEN char_length(meta_info) > 65536 THEN left(meta_info, 65536) || ' …' ELSE meta_info END
+    WHERE search_text IS NULL AND meta_info <> '' AND meta_info NOT LIKE 'gkenc:v1:%';
+DROP INDEX IF EXISTS user_credentials_search_idx;
+DROP INDEX IF EXISTS credit_card_data_search_idx;
+DROP INDEX IF EXISTS text_data_search_idx;
+DROP INDEX IF EXISTS files_data_search_idx;
+CREATE INDEX IF NOT EXISTS user_credentials_search_text_idx ON UserCredentials USING GIN (to_tsvector('simple', coalesce(search_text, '')));
+CREATE INDEX IF NOT EXISTS credit_card_data_search_text_idx ON CreditCardData USING GIN (to_tsvector('simple', coalesce(search_text, '')));
+CREATE INDEX IF NOT EXISTS text_data_search_text_idx ON TextData USING GIN (to_tsvector('simple', coalesce(search_text, '')));
+CREATE INDEX IF NOT EXISTS files_data_search_text_idx ON FilesData USING GIN (to_tsvector('simple', coalesce(search_text, '')));
@@ -0,0 +1,15 @@
+-- The last successful login of each user, and the login attempts on the accounts, successful or not,
+-- shown to their users to spot a compromise. The history is pruned to a number of attempts per user.
+ALTER TABLE Users ADD COLUMN IF NOT EXISTS last_login_at TIMESTAMP;
+
+CREATE TABLE IF NOT EXISTS login_history (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    ip TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    success BOOLEAN NOT NULL,
+    FOREIGN KEY(user_id) REFERENCES Users(id)
+);
+
+CREATE INDEX IF NOT EXISTS login_history_user_idx ON login_history (user_id, id);
@@ -0,0 +1,2 @@
+ALTER TABLE Users DROP COLUMN IF EXISTS disabled;
+ALTER TABLE Users DROP COLUMN IF EXISTS role;
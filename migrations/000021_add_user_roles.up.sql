@@ -0,0 +1,4 @@
+-- The role of each user, 'user' or 'admin', and whether an admin disabled the account.
+-- A disabled user can't log in and their tokens are rejected.
+ALTER TABLE Users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user';
+ALTER TABLE Users ADD COLUMN IF NOT EXISTS disabled BOOLEAN NOT NULL DEFAULT FALSE;
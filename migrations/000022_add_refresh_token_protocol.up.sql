@@ -0,0 +1,3 @@
+-- The protocol version negotiated with the device of each refresh token, to see which versions the clients
+-- still speak before one is dropped. The tokens issued before the negotiation were of the first version.
+ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS protocol_version INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,15 @@
+-- The API keys the users create for their non-interactive clients, stored by the SHA-256 of their value.
+-- The scopes are 'read' or 'read,write', a key without an expiry is valid until it is revoked.
+CREATE TABLE IF NOT EXISTS api_keys (
+    id SERIAL PRIMARY KEY,
+    key_hash TEXT NOT NULL UNIQUE,
+    user_id INTEGER NOT NULL,
+    label TEXT NOT NULL DEFAULT '',
+    scopes TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP,
+    expires_at TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES Users(id)
+);
+
+CREATE INDEX IF NOT EXISTS api_keys_user_idx ON api_keys (user_id);
@@ -0,0 +1,18 @@
+-- The optional email of each user, in lower case and unique among the users who set one, and whether it is
+-- verified. The tokens mailed to verify it or to reset the password are stored by the SHA-256 of their value,
+-- each token is used once, the reset tokens only for a verified email.
+ALTER TABLE Users ADD COLUMN IF NOT EXISTS email TEXT;
+ALTER TABLE Users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_idx ON Users (email);
+
+CREATE TABLE IF NOT EXISTS email_tokens (
+    token_hash TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    purpose TEXT NOT NULL,
+    email TEXT NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    FOREIGN KEY(user_id) REFERENCES Users(id)
+);
+
+CREATE INDEX IF NOT EXISTS email_tokens_user_idx ON email_tokens (user_id);
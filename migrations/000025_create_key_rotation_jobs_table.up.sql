@@ -0,0 +1,9 @@
+-- The rotations to each encryption key: the ids of the previous keys the values may still be encrypted with,
+-- and when a sample of the rows was verified to decrypt with the new key alone. Until then the server refuses
+-- to start without the previous keys.
+CREATE TABLE IF NOT EXISTS KeyRotationJobs (
+    key_id TEXT PRIMARY KEY,
+    previous_keys TEXT NOT NULL,
+    started_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    verified_at TIMESTAMP
+);
@@ -0,0 +1 @@
+ALTER TABLE TextData DROP COLUMN IF EXISTS preview;
@@ -0,0 +1,3 @@
+-- Plaintext snippet of a note uploaded by its client for the list views, cut at 120 characters by the client
+-- and checked by the server. It is indexed by the search with meta_info.
+ALTER TABLE TextData ADD COLUMN IF NOT EXISTS preview TEXT;
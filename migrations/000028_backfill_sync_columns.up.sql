@@ -0,0 +1,4 @@
+-- Entries stored before the synchronization columns had their defaults may have a NULL updated_at or deleted,
+-- which the synchronizations don't match. The server fills them in batches after this version, see the
+-- sync_columns data migration, before the next migration enforces them.
+SELECT 1;
@@ -0,0 +1,4 @@
+ALTER TABLE UserCredentials ALTER COLUMN deleted DROP NOT NULL, ALTER COLUMN updated_at DROP NOT NULL;
+ALTER TABLE CreditCardData ALTER COLUMN deleted DROP NOT NULL, ALTER COLUMN updated_at DROP NOT NULL;
+ALTER TABLE TextData ALTER COLUMN deleted DROP NOT NULL, ALTER COLUMN updated_at DROP NOT NULL;
+ALTER TABLE FilesData ALTER COLUMN deleted DROP NOT NULL, ALTER COLUMN updated_at DROP NOT NULL;
@@ -0,0 +1,10 @@
+-- The synchronization columns can't be NULL anymore, the server filled them in after the previous migration.
+-- The default time is UTC, as the server writes it.
+ALTER TABLE UserCredentials ALTER COLUMN deleted SET DEFAULT FALSE, ALTER COLUMN deleted SET NOT NULL,
+    ALTER COLUMN updated_at SET DEFAULT (now() AT TIME ZONE 'UTC'), ALTER COLUMN updated_at SET NOT NULL;
+ALTER TABLE CreditCardData ALTER COLUMN deleted SET DEFAULT FALSE, ALTER COLUMN deleted SET NOT NULL,
+    ALTER COLUMN updated_at SET DEFAULT (now() AT TIME ZONE 'UTC'), ALTER COLUMN updated_at SET NOT NULL;
+ALTER TABLE TextData ALTER COLUMN deleted SET DEFAULT FALSE, ALTER COLUMN deleted SET NOT NULL,
+    ALTER COLUMN updated_at SET DEFAULT (now() AT TIME ZONE 'UTC'), ALTER COLUMN updated_at SET NOT NULL;
+ALTER TABLE FilesData ALTER COLUMN deleted SET DEFAULT FALSE, ALTER COLUMN deleted SET NOT NULL,
+    ALTER COLUMN updated_at SET DEFAULT (now() AT TIME ZONE 'UTC'), ALTER COLUMN updated_at SET NOT NULL;
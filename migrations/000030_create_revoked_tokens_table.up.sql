@@ -0,0 +1,8 @@
+-- The access tokens revoked before they expire, by their JWT ID claim. A revocation is pruned once its token
+-- has expired, the one of a token issued without an expiry has no expires_at and is kept.
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+    jti TEXT PRIMARY KEY,
+    expires_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS revoked_tokens_expires_idx ON revoked_tokens (expires_at) WHERE expires_at IS NOT NULL;
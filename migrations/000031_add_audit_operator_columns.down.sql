@@ -0,0 +1,2 @@
+ALTER TABLE audit_log DROP COLUMN IF EXISTS detail;
+ALTER TABLE audit_log DROP COLUMN IF EXISTS operator;
@@ -0,0 +1,4 @@
+-- The operator running an ad-hoc query from the command line, and the text of the query.
+-- Both are empty for the events of the users.
+ALTER TABLE audit_log ADD COLUMN IF NOT EXISTS operator TEXT NOT NULL DEFAULT '';
+ALTER TABLE audit_log ADD COLUMN IF NOT EXISTS detail TEXT NOT NULL DEFAULT '';
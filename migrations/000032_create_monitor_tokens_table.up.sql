@@ -0,0 +1,9 @@
+-- The tokens of the external uptime monitors, created by the admins and stored by the SHA-256 of their value.
+-- A token only grants the monitor ping, and is valid until it is revoked.
+CREATE TABLE IF NOT EXISTS monitor_tokens (
+    id SERIAL PRIMARY KEY,
+    token_hash TEXT NOT NULL UNIQUE,
+    name TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS users_username_skeleton_idx;
+ALTER TABLE Users DROP COLUMN IF EXISTS username_skeleton;
@@ -0,0 +1,5 @@
+-- The skeleton of each username, the form its lookalikes share, computed by the server. A username is taken
+-- if another one has its skeleton. The users registered before are filled in by the server at startup.
+ALTER TABLE Users ADD COLUMN IF NOT EXISTS username_skeleton TEXT;
+
+CREATE INDEX IF NOT EXISTS users_username_skeleton_idx ON Users (username_skeleton);
@@ -0,0 +1,14 @@
+-- The chunked uploads of the files of the entries. The chunks are staged on the disk of the files,
+-- in a directory of the session, until the upload is committed into the entry. A session expires
+-- at expires_at, when it is deleted with its chunks.
+CREATE TABLE IF NOT EXISTS upload_sessions (
+    id TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    entry_id TEXT NOT NULL,
+    size BIGINT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    FOREIGN KEY(user_id) REFERENCES Users(id)
+);
+
+CREATE INDEX IF NOT EXISTS upload_sessions_expires_at_idx ON upload_sessions (expires_at);
@@ -0,0 +1,2 @@
+-- The language each user is mailed in, a BCP 47 tag, empty for the default language of the server.
+ALTER TABLE Users ADD COLUMN IF NOT EXISTS language TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS filesdata_blob_key_idx;
+ALTER TABLE FilesData DROP COLUMN IF EXISTS blob_sha256;
+ALTER TABLE FilesData DROP COLUMN IF EXISTS blob_size;
+ALTER TABLE FilesData DROP COLUMN IF EXISTS blob_key;
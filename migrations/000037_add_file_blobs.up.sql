@@ -0,0 +1,7 @@
+-- The object of the contents of a file in the blob store, when one is configured: its key, size in bytes
+-- and hex SHA-256. The files uploaded before it, or without a blob store, have none and stay on the disk
+-- of the files under the id of their entry. The index looks the keys up for the reconciliation of the store.
+ALTER TABLE FilesData ADD COLUMN IF NOT EXISTS blob_key TEXT;
+ALTER TABLE FilesData ADD COLUMN IF NOT EXISTS blob_size BIGINT;
+ALTER TABLE FilesData ADD COLUMN IF NOT EXISTS blob_sha256 TEXT;
+CREATE INDEX IF NOT EXISTS filesdata_blob_key_idx ON FilesData (blob_key) WHERE blob_key IS NOT NULL;
@@ -0,0 +1,4 @@
+-- The entries sharing contents keep pointing at one object, which the blob store of the previous version
+-- deletes once any of them gets new contents: roll back before the store holds shared contents.
+DROP INDEX IF EXISTS filesdata_blob_sha256_idx;
+DROP TABLE IF EXISTS blobs;
@@ -0,0 +1,24 @@
+-- The contents of the files in the blob store, by their hex SHA-256: the key of their object, their size in bytes
+-- and the number of the file entries pointing at them, the deleted ones included. The entries with the same
+-- contents share one object, which is deleted once no entry points at it.
+CREATE TABLE IF NOT EXISTS blobs (
+    hash TEXT PRIMARY KEY,
+    blob_key TEXT NOT NULL,
+    size BIGINT NOT NULL,
+    refcount BIGINT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS blobs_blob_key_idx ON blobs (blob_key);
+
+-- The files already in the store share the object of the first key of their contents, the other objects
+-- are left to the reconciliation of the store
+INSERT INTO blobs (hash, blob_key, size, refcount, created_at)
+SELECT blob_sha256, MIN(blob_key), MAX(blob_size), COUNT(*), CURRENT_TIMESTAMP FROM FilesData
+WHERE blob_key IS NOT NULL AND blob_sha256 IS NOT NULL GROUP BY blob_sha256
+ON CONFLICT (hash) DO NOTHING;
+
+UPDATE FilesData SET blob_key = (SELECT blobs.blob_key FROM blobs WHERE blobs.hash = FilesData.blob_sha256)
+WHERE blob_key IS NOT NULL AND blob_sha256 IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS filesdata_blob_sha256_idx ON FilesData (blob_sha256) WHERE blob_sha256 IS NOT NULL;
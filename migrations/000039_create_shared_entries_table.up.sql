@@ -0,0 +1,16 @@
+-- The entries shared by their owners with other users, the grantees, read or write. The ids of the entries are
+-- unique across the users, so an entry is shared once with each grantee. A revoked share is kept with revoked set
+-- and updated_at moved, the next sync of the grantee removes the entry like a deleted one.
+CREATE TABLE IF NOT EXISTS shared_entries (
+    owner_id INTEGER NOT NULL,
+    grantee_id INTEGER NOT NULL,
+    table_name TEXT NOT NULL,
+    entry_id TEXT NOT NULL,
+    permission TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    revoked BOOLEAN NOT NULL DEFAULT FALSE,
+    PRIMARY KEY (grantee_id, table_name, entry_id)
+);
+
+CREATE INDEX IF NOT EXISTS shared_entries_owner_idx ON shared_entries (owner_id);
@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS user_credentials_folder_idx;
+DROP INDEX IF EXISTS credit_card_data_folder_idx;
+DROP INDEX IF EXISTS text_data_folder_idx;
+DROP INDEX IF EXISTS files_data_folder_idx;
+ALTER TABLE UserCredentials DROP COLUMN IF EXISTS folder_id;
+ALTER TABLE CreditCardData DROP COLUMN IF EXISTS folder_id;
+ALTER TABLE TextData DROP COLUMN IF EXISTS folder_id;
+ALTER TABLE FilesData DROP COLUMN IF EXISTS folder_id;
+DROP TABLE IF EXISTS folders;
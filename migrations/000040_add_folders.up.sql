@@ -0,0 +1,26 @@
+-- The folders of the entries of the users, nested through parent_id, which is empty at the top of the vault.
+-- name_key is the name in lower case: the live folders of a parent have unique names, ignoring the case.
+-- A deleted folder is kept with deleted set and updated_at moved, like a deleted entry, for the sync.
+CREATE TABLE IF NOT EXISTS folders (
+    id TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    name_key TEXT NOT NULL,
+    parent_id TEXT NOT NULL DEFAULT '',
+    updated_at TIMESTAMP NOT NULL,
+    deleted BOOLEAN NOT NULL DEFAULT FALSE,
+    FOREIGN KEY(user_id) REFERENCES Users(id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS folders_name_idx ON folders (user_id, parent_id, name_key) WHERE deleted = FALSE;
+CREATE INDEX IF NOT EXISTS folders_user_updated_idx ON folders (user_id, updated_at);
+
+-- The folder of an entry, NULL at the top of the vault.
+ALTER TABLE UserCredentials ADD COLUMN IF NOT EXISTS folder_id TEXT;
+ALTER TABLE CreditCardData ADD COLUMN IF NOT EXISTS folder_id TEXT;
+ALTER TABLE TextData ADD COLUMN IF NOT EXISTS folder_id TEXT;
+ALTER TABLE FilesData ADD COLUMN IF NOT EXISTS folder_id TEXT;
+CREATE INDEX IF NOT EXISTS user_credentials_folder_idx ON UserCredentials (user_id, folder_id);
+CREATE INDEX IF NOT EXISTS credit_card_data_folder_idx ON CreditCardData (user_id, folder_id);
+CREATE INDEX IF NOT EXISTS text_data_folder_idx ON TextData (user_id, folder_id);
+CREATE INDEX IF NOT EXISTS files_data_folder_idx ON FilesData (user_id, folder_id);
@@ -0,0 +1,40 @@
+-- The TOTP seeds of the users, a data table like the others with the columns the earlier migrations added to them.
+-- The secret is base32, checked and encrypted by the keeper. An empty algorithm, digits or period is the default
+-- of the authenticator apps, SHA1, 6 digits and 30 seconds. linked_entry_id is the credential the seed belongs to.
+CREATE TABLE IF NOT EXISTS OtpData (
+    id TEXT PRIMARY KEY,
+    user_id INTEGER,
+    issuer TEXT,
+    account TEXT,
+    secret TEXT NOT NULL,
+    algorithm TEXT,
+    digits INTEGER,
+    period INTEGER,
+    linked_entry_id TEXT,
+    meta_info TEXT,
+    deleted BOOLEAN NOT NULL DEFAULT FALSE,
+    updated_at TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'UTC'),
+    client_created_at TEXT,
+    client_modified_at TEXT,
+    tags TEXT[] NOT NULL DEFAULT '{}',
+    expires_at TIMESTAMP,
+    checksum TEXT,
+    payload_size BIGINT,
+    search_text TEXT,
+    folder_id TEXT,
+    FOREIGN KEY(user_id) REFERENCES Users(id)
+);
+
+CREATE INDEX IF NOT EXISTS otp_data_tags_idx ON OtpData USING GIN (tags);
+CREATE INDEX IF NOT EXISTS otp_data_expires_idx ON OtpData (expires_at) WHERE deleted = false AND expires_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS otp_data_user_updated_idx ON OtpData (user_id, updated_at);
+CREATE INDEX IF NOT EXISTS otp_data_user_deleted_idx ON OtpData (user_id) WHERE deleted = TRUE;
+CREATE INDEX IF NOT EXISTS otp_data_search_text_idx ON OtpData USING GIN (to_tsvector('simple', coalesce(search_text, '')));
+CREATE INDEX IF NOT EXISTS otp_data_folder_idx ON OtpData (user_id, folder_id);
+CREATE INDEX IF NOT EXISTS otp_data_linked_idx ON OtpData (user_id, linked_entry_id);
+
+ALTER TABLE OtpData ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS otp_data_tenant_policy ON OtpData;
+CREATE POLICY otp_data_tenant_policy ON OtpData
+    USING (user_id = NULLIF(current_setting('app.current_user_id', true), '')::integer)
+    WITH CHECK (user_id = NULLIF(current_setting('app.current_user_id', true), '')::integer);
@@ -0,0 +1,38 @@
+-- The SSH key pairs of the users, a data table like the others with the columns the earlier migrations added to them.
+-- The private key is encrypted by the keeper. The fingerprint is the SHA-256 one of the public key, computed by the keeper
+-- on every write of the key, so a client looks up the key an agent or a server presents.
+CREATE TABLE IF NOT EXISTS SshKeysData (
+    id TEXT PRIMARY KEY,
+    user_id INTEGER,
+    title TEXT,
+    private_key TEXT NOT NULL,
+    public_key TEXT NOT NULL,
+    fingerprint TEXT,
+    passphrase_hint TEXT,
+    meta_info TEXT,
+    deleted BOOLEAN NOT NULL DEFAULT FALSE,
+    updated_at TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'UTC'),
+    client_created_at TEXT,
+    client_modified_at TEXT,
+    tags TEXT[] NOT NULL DEFAULT '{}',
+    expires_at TIMESTAMP,
+    checksum TEXT,
+    payload_size BIGINT,
+    search_text TEXT,
+    folder_id TEXT,
+    FOREIGN KEY(user_id) REFERENCES Users(id)
+);
+
+CREATE INDEX IF NOT EXISTS ssh_keys_data_tags_idx ON SshKeysData USING GIN (tags);
+CREATE INDEX IF NOT EXISTS ssh_keys_data_expires_idx ON SshKeysData (expires_at) WHERE deleted = false AND expires_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS ssh_keys_data_user_updated_idx ON SshKeysData (user_id, updated_at);
+CREATE INDEX IF NOT EXISTS ssh_keys_data_user_deleted_idx ON SshKeysData (user_id) WHERE deleted = TRUE;
+CREATE INDEX IF NOT EXISTS ssh_keys_data_search_text_idx ON SshKeysData USING GIN (to_tsvector('simple', coalesce(search_text, '')));
+CREATE INDEX IF NOT EXISTS ssh_keys_data_folder_idx ON SshKeysData (user_id, folder_id);
+CREATE INDEX IF NOT EXISTS ssh_keys_data_fingerprint_idx ON SshKeysData (user_id, fingerprint);
+
+ALTER TABLE SshKeysData ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS ssh_keys_data_tenant_policy ON SshKeysData;
+CREATE POLICY ssh_keys_data_tenant_policy ON SshKeysData
+    USING (user_id = NULLIF(current_setting('app.current_user_id', true), '')::integer)
+    WITH CHECK (user_id = NULLIF(current_setting('app.current_user_id', true), '')::integer);
@@ -0,0 +1 @@
+ALTER TABLE Users DROP COLUMN IF EXISTS password_changed_at;
@@ -0,0 +1,2 @@
+-- The last change of the password of each user, the access tokens issued before it are rejected.
+ALTER TABLE Users ADD COLUMN IF NOT EXISTS password_changed_at TIMESTAMP;
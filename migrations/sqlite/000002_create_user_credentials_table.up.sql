@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS UserCredentials (
+    id TEXT PRIMARY KEY,
+    user_id INTEGER,
+    login TEXT NOT NULL,
+    password TEXT NOT NULL,
+    meta_info TEXT,
+    deleted BOOLEAN DEFAULT FALSE,
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+    FOREIGN KEY(user_id) REFERENCES Users(id)
+);
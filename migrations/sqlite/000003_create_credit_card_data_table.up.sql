@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS CreditCardData (
+    id TEXT PRIMARY KEY,
+    user_id INTEGER,
+    card_number TEXT NOT NULL,
+    expiration_date TEXT NOT NULL,
+    cvv TEXT NOT NULL,
+    meta_info TEXT,
+    deleted BOOLEAN DEFAULT FALSE,
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+    FOREIGN KEY(user_id) REFERENCES Users(id)
+);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS EntryHistory (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    table_name TEXT NOT NULL,
+    entry_id TEXT NOT NULL,
+    user_id INTEGER NOT NULL,
+    snapshot TEXT NOT NULL,
+    changed_at TIMESTAMP DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+    FOREIGN KEY(user_id) REFERENCES Users(id)
+);
+
+CREATE INDEX IF NOT EXISTS entry_history_entry_idx ON EntryHistory (table_name, user_id, entry_id, id);
@@ -0,0 +1,3 @@
+-- SQLite matches search terms with a substring scan, there is no index to create.
+-- The migration keeps the versions aligned with the PostgreSQL migrations.
+SELECT 1;
@@ -0,0 +1,9 @@
+-- lint:ignore drop-column
+ALTER TABLE UserCredentials DROP COLUMN client_created_at;
+ALTER TABLE UserCredentials DROP COLUMN client_modified_at;
+ALTER TABLE CreditCardData DROP COLUMN client_created_at;
+ALTER TABLE CreditCardData DROP COLUMN client_modified_at;
+ALTER TABLE TextData DROP COLUMN client_created_at;
+ALTER TABLE TextData DROP COLUMN client_modified_at;
+ALTER TABLE FilesData DROP COLUMN client_created_at;
+ALTER TABLE FilesData DROP COLUMN client_modified_at;
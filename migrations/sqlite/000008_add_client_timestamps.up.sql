@@ -0,0 +1,10 @@
+-- lint:ignore add-column
+-- SQLite has no IF NOT EXISTS for ADD COLUMN, the migration version guards against reruns.
+ALTER TABLE UserCredentials ADD COLUMN client_created_at TEXT;
+ALTER TABLE UserCredentials ADD COLUMN client_modified_at TEXT;
+ALTER TABLE CreditCardData ADD COLUMN client_created_at TEXT;
+ALTER TABLE CreditCardData ADD COLUMN client_modified_at TEXT;
+ALTER TABLE TextData ADD COLUMN client_created_at TEXT;
+ALTER TABLE TextData ADD COLUMN client_modified_at TEXT;
+ALTER TABLE FilesData ADD COLUMN client_created_at TEXT;
+ALTER TABLE FilesData ADD COLUMN client_modified_at TEXT;
@@ -0,0 +1,5 @@
+-- lint:ignore drop-column
+ALTER TABLE UserCredentials DROP COLUMN tags;
+ALTER TABLE CreditCardData DROP COLUMN tags;
+ALTER TABLE TextData DROP COLUMN tags;
+ALTER TABLE FilesData DROP COLUMN tags;
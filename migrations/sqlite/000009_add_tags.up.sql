@@ -0,0 +1,6 @@
+-- lint:ignore add-column
+-- SQLite has no arrays, the tags are stored as a comma-delimited list, e.g. ,work,banking,
+ALTER TABLE UserCredentials ADD COLUMN tags TEXT NOT NULL DEFAULT '';
+ALTER TABLE CreditCardData ADD COLUMN tags TEXT NOT NULL DEFAULT '';
+ALTER TABLE TextData ADD COLUMN tags TEXT NOT NULL DEFAULT '';
+ALTER TABLE FilesData ADD COLUMN tags TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS user_credentials_expires_idx;
+DROP INDEX IF EXISTS credit_card_data_expires_idx;
+DROP INDEX IF EXISTS text_data_expires_idx;
+DROP INDEX IF EXISTS files_data_expires_idx;
+-- lint:ignore drop-column
+ALTER TABLE UserCredentials DROP COLUMN expires_at;
+ALTER TABLE CreditCardData DROP COLUMN expires_at;
+ALTER TABLE TextData DROP COLUMN expires_at;
+ALTER TABLE FilesData DROP COLUMN expires_at;
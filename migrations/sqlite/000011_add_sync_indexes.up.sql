@@ -0,0 +1,11 @@
+-- Synchronization reads the entries of a user updated after the last sync, the composite
+-- indexes serve it without scanning the entries of other users.
+-- The partial indexes serve the lookups of deleted entries, which are few.
+CREATE INDEX IF NOT EXISTS user_credentials_user_updated_idx ON UserCredentials (user_id, updated_at);
+CREATE INDEX IF NOT EXISTS credit_card_data_user_updated_idx ON CreditCardData (user_id, updated_at);
+CREATE INDEX IF NOT EXISTS text_data_user_updated_idx ON TextData (user_id, updated_at);
+CREATE INDEX IF NOT EXISTS files_data_user_updated_idx ON FilesData (user_id, updated_at);
+CREATE INDEX IF NOT EXISTS user_credentials_user_deleted_idx ON UserCredentials (user_id) WHERE deleted = TRUE;
+CREATE INDEX IF NOT EXISTS credit_card_data_user_deleted_idx ON CreditCardData (user_id) WHERE deleted = TRUE;
+CREATE INDEX IF NOT EXISTS text_data_user_deleted_idx ON TextData (user_id) WHERE deleted = TRUE;
+CREATE INDEX IF NOT EXISTS files_data_user_deleted_idx ON FilesData (user_id) WHERE deleted = TRUE;
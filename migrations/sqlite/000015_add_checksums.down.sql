@@ -0,0 +1,5 @@
+-- lint:ignore drop-column
+ALTER TABLE UserCredentials DROP COLUMN checksum;
+ALTER TABLE CreditCardData DROP COLUMN checksum;
+ALTER TABLE TextData DROP COLUMN checksum;
+ALTER TABLE FilesData DROP COLUMN checksum;
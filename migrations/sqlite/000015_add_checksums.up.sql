@@ -0,0 +1,6 @@
+-- lint:ignore add-column
+-- SQLite has no IF NOT EXISTS for ADD COLUMN, the migration version guards against reruns.
+ALTER TABLE UserCredentials ADD COLUMN checksum TEXT;
+ALTER TABLE CreditCardData ADD COLUMN checksum TEXT;
+ALTER TABLE TextData ADD COLUMN checksum TEXT;
+ALTER TABLE FilesData ADD COLUMN checksum TEXT;
@@ -0,0 +1,5 @@
+-- lint:ignore drop-column
+ALTER TABLE UserCredentials DROP COLUMN payload_size;
+ALTER TABLE CreditCardData DROP COLUMN payload_size;
+ALTER TABLE TextData DROP COLUMN payload_size;
+ALTER TABLE FilesData DROP COLUMN payload_size;
@@ -0,0 +1,7 @@
+-- lint:ignore add-column
+-- SQLite has no IF NOT EXISTS for ADD COLUMN, the migration version guards against reruns.
+-- The entries stored before it are filled in by the server, see the PostgreSQL migration.
+ALTER TABLE UserCredentials ADD COLUMN payload_size INTEGER;
+ALTER TABLE CreditCardData ADD COLUMN payload_size INTEGER;
+ALTER TABLE TextData ADD COLUMN payload_size INTEGER;
+ALTER TABLE FilesData ADD COLUMN payload_size INTEGER;
@@ -0,0 +1,3 @@
+-- lint:ignore drop-column
+ALTER TABLE Users DROP COLUMN locked_until;
+ALTER TABLE Users DROP COLUMN failed_attempts;
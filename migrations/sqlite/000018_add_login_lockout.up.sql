@@ -0,0 +1,4 @@
+-- lint:ignore add-column
+-- SQLite has no IF NOT EXISTS for ADD COLUMN, the migration version guards against reruns.
+ALTER TABLE Users ADD COLUMN failed_attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE Users ADD COLUMN locked_until TIMESTAMP;
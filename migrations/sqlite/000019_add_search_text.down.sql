@@ -0,0 +1,5 @@
+-- lint:ignore drop-column
+ALTER TABLE UserCredentials DROP COLUMN search_text;
+ALTER TABLE CreditCardData DROP COLUMN search_text;
+ALTER TABLE TextData DROP COLUMN search_text;
+ALTER TABLE FilesData DROP COLUMN search_text;
@@ -0,0 +1,15 @@
+-- lint:ignore add-column
+-- SQLite has no IF NOT EXISTS for ADD COLUMN, the migration version guards against reruns.
+-- The entries stored before it are backfilled from meta_info, see the PostgreSQL migration.
+ALTER TABLE UserCredentials ADD COLUMN search_text TEXT;
+ALTER TABLE CreditCardData ADD COLUMN search_text TEXT;
+ALTER TABLE TextData ADD COLUMN search_text TEXT;
+ALTER TABLE FilesData ADD COLUMN search_text TEXT;
+UPDATE UserCredentials SET search_text = CASE WHEN length(meta_info) > 65536 THEN substr(meta_info, 1, 65536) || ' …' ELSE meta_info END
+    WHERE search_text IS NULL AND meta_info <> '' AND meta_info NOT LIKE 'gkenc:v1:%';
+UPDATE CreditCardData SET search_text = CASE WHEN length(meta_info) > 65536 THEN substr(meta_info, 1, 65536) || ' …' ELSE meta_info END
+    WHERE search_text IS NULL AND meta_info <> '' AND meta_info NOT LIKE 'gkenc:v1:%';
+UPDATE TextData SET search_text = CASE WHEN length(meta_info) > 65536 THEN substr(meta_info, 1, 65536) || ' …' ELSE meta_info END
+    WHERE search_text IS NULL AND meta_info <> '' AND meta_info NOT LIKE 'gkenc:v1:%';
+UPDATE FilesData SET search_text = CASE WHEN length(meta_info) > 65536 THEN substr(meta_info, 1, 65536) || ' …' ELSE meta_info END
+    WHERE search_text IS NULL AND meta_info <> '' AND meta_info NOT LIKE 'gkenc:v1:%';
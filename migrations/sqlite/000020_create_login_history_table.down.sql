@@ -0,0 +1,3 @@
+-- lint:ignore drop-column
+DROP TABLE IF EXISTS login_history;
+ALTER TABLE Users DROP COLUMN last_login_at;
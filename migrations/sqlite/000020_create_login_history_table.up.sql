@@ -0,0 +1,17 @@
+-- lint:ignore add-column
+-- The last successful login of each user, and the login attempts on the accounts, successful or not,
+-- shown to their users to spot a compromise. The history is pruned to a number of attempts per user.
+-- SQLite has no IF NOT EXISTS for ADD COLUMN, the migration version guards against reruns.
+ALTER TABLE Users ADD COLUMN last_login_at TIMESTAMP;
+
+CREATE TABLE IF NOT EXISTS login_history (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    at TIMESTAMP DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+    ip TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    success BOOLEAN NOT NULL,
+    FOREIGN KEY(user_id) REFERENCES Users(id)
+);
+
+CREATE INDEX IF NOT EXISTS login_history_user_idx ON login_history (user_id, id);
@@ -0,0 +1,3 @@
+-- lint:ignore drop-column
+ALTER TABLE Users DROP COLUMN disabled;
+ALTER TABLE Users DROP COLUMN role;
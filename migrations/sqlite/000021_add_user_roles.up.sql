@@ -0,0 +1,4 @@
+-- lint:ignore add-column
+-- SQLite has no IF NOT EXISTS for ADD COLUMN, the migration version guards against reruns.
+ALTER TABLE Users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';
+ALTER TABLE Users ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,2 @@
+-- lint:ignore drop-column
+ALTER TABLE refresh_tokens DROP COLUMN protocol_version;
@@ -0,0 +1,5 @@
+-- lint:ignore add-column
+-- The protocol version negotiated with the device of each refresh token, to see which versions the clients
+-- still speak before one is dropped. The tokens issued before the negotiation were of the first version.
+-- SQLite has no IF NOT EXISTS for ADD COLUMN, the migration version guards against reruns.
+ALTER TABLE refresh_tokens ADD COLUMN protocol_version INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,5 @@
+-- lint:ignore drop-column
+DROP TABLE IF EXISTS email_tokens;
+DROP INDEX IF EXISTS users_email_idx;
+ALTER TABLE Users DROP COLUMN email_verified;
+ALTER TABLE Users DROP COLUMN email;
@@ -0,0 +1,12 @@
+-- The devices of the users, registered when a session is issued to them. last_sync_at is the server-side
+-- checkpoint of the synchronization of the device, the latest updated_at it has pulled, so a reinstalled
+-- client resumes from it instead of downloading everything again.
+CREATE TABLE IF NOT EXISTS devices (
+    user_id INTEGER NOT NULL,
+    device_id TEXT NOT NULL,
+    name TEXT NOT NULL DEFAULT '',
+    last_seen_at TIMESTAMP NOT NULL,
+    last_sync_at TIMESTAMP,
+    PRIMARY KEY (user_id, device_id),
+    FOREIGN KEY(user_id) REFERENCES Users(id)
+);
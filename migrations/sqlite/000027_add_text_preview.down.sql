@@ -0,0 +1,2 @@
+-- lint:ignore drop-column
+ALTER TABLE TextData DROP COLUMN preview;
@@ -0,0 +1,3 @@
+-- lint:ignore add-column
+-- SQLite has no IF NOT EXISTS for ADD COLUMN, the migration version guards against reruns.
+ALTER TABLE TextData ADD COLUMN preview TEXT;
@@ -0,0 +1,2 @@
+-- The back-filled values can't be told from the written ones, they are kept.
+SELECT 1;
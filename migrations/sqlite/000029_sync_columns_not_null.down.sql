@@ -0,0 +1,8 @@
+DROP TRIGGER IF EXISTS user_credentials_sync_insert_not_null;
+DROP TRIGGER IF EXISTS user_credentials_sync_update_not_null;
+DROP TRIGGER IF EXISTS credit_card_data_sync_insert_not_null;
+DROP TRIGGER IF EXISTS credit_card_data_sync_update_not_null;
+DROP TRIGGER IF EXISTS text_data_sync_insert_not_null;
+DROP TRIGGER IF EXISTS text_data_sync_update_not_null;
+DROP TRIGGER IF EXISTS files_data_sync_insert_not_null;
+DROP TRIGGER IF EXISTS files_data_sync_update_not_null;
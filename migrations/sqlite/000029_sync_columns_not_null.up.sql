@@ -0,0 +1,43 @@
+-- SQLite can't add NOT NULL to a column without rebuilding the table, which would drop the columns added to it
+-- outside the migrations. The triggers reject a NULL synchronization column instead, the server filled them
+-- in after the previous migration. An omitted column still gets its default before the triggers run.
+CREATE TRIGGER IF NOT EXISTS user_credentials_sync_insert_not_null BEFORE INSERT ON UserCredentials
+    WHEN NEW.deleted IS NULL OR NEW.updated_at IS NULL
+BEGIN
+    SELECT RAISE(ABORT, 'NOT NULL constraint failed: UserCredentials.deleted or UserCredentials.updated_at');
+END;
+CREATE TRIGGER IF NOT EXISTS user_credentials_sync_update_not_null BEFORE UPDATE OF deleted, updated_at ON UserCredentials
+    WHEN NEW.deleted IS NULL OR NEW.updated_at IS NULL
+BEGIN
+    SELECT RAISE(ABORT, 'NOT NULL constraint failed: UserCredentials.deleted or UserCredentials.updated_at');
+END;
+CREATE TRIGGER IF NOT EXISTS credit_card_data_sync_insert_not_null BEFORE INSERT ON CreditCardData
+    WHEN NEW.deleted IS NULL OR NEW.updated_at IS NULL
+BEGIN
+    SELECT RAISE(ABORT, 'NOT NULL constraint failed: CreditCardData.deleted or CreditCardData.updated_at');
+END;
+CREATE TRIGGER IF NOT EXISTS credit_card_data_sync_update_not_null BEFORE UPDATE OF deleted, updated_at ON CreditCardData
+    WHEN NEW.deleted IS NULL OR NEW.updated_at IS NULL
+BEGIN
+    SELECT RAISE(ABORT, 'NOT NULL constraint failed: CreditCardData.deleted or CreditCardData.updated_at');
+END;
+CREATE TRIGGER IF NOT EXISTS text_data_sync_insert_not_null BEFORE INSERT ON TextData
+    WHEN NEW.deleted IS NULL OR NEW.updated_at IS NULL
+BEGIN
+    SELECT RAISE(ABORT, 'NOT NULL constraint failed: TextData.deleted or TextData.updated_at');
+END;
+CREATE TRIGGER IF NOT EXISTS text_data_sync_update_not_null BEFORE UPDATE OF deleted, updated_at ON TextData
+    WHEN NEW.deleted IS NULL OR NEW.updated_at IS NULL
+BEGIN
+    SELECT RAISE(ABORT, 'NOT NULL constraint failed: TextData.deleted or TextData.updated_at');
+END;
+CREATE TRIGGER IF NOT EXISTS files_data_sync_insert_not_null BEFORE INSERT ON FilesData
+    WHEN NEW.deleted IS NULL OR NEW.updated_at IS NULL
+BEGIN
+    SELECT RAISE(ABORT, 'NOT NULL constraint failed: FilesData.deleted or FilesData.updated_at');
+END;
+CREATE TRIGGER IF NOT EXISTS files_data_sync_update_not_null BEFORE UPDATE OF deleted, updated_at ON FilesData
+    WHEN NEW.deleted IS NULL OR NEW.updated_at IS NULL
+BEGIN
+    SELECT RAISE(ABORT, 'NOT NULL constraint failed: FilesData.deleted or FilesData.updated_at');
+END;
@@ -0,0 +1,3 @@
+-- lint:ignore drop-column
+ALTER TABLE audit_log DROP COLUMN detail;
+ALTER TABLE audit_log DROP COLUMN operator;
@@ -0,0 +1,4 @@
+-- lint:ignore add-column
+-- SQLite has no IF NOT EXISTS for ADD COLUMN, the migration version guards against reruns.
+ALTER TABLE audit_log ADD COLUMN operator TEXT NOT NULL DEFAULT '';
+ALTER TABLE audit_log ADD COLUMN detail TEXT NOT NULL DEFAULT '';
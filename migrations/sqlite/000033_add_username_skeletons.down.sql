@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS users_username_skeleton_idx;
+-- lint:ignore drop-column
+ALTER TABLE Users DROP COLUMN username_skeleton;
@@ -0,0 +1,7 @@
+-- The skeleton of each username, the form its lookalikes share, computed by the server. A username is taken
+-- if another one has its skeleton. The users registered before are filled in by the server at startup.
+-- lint:ignore add-column
+-- SQLite has no IF NOT EXISTS for ADD COLUMN, the migration version guards against reruns.
+ALTER TABLE Users ADD COLUMN username_skeleton TEXT;
+
+CREATE INDEX IF NOT EXISTS users_username_skeleton_idx ON Users (username_skeleton);
@@ -0,0 +1,18 @@
+-- The long operations of the users on their vaults, run by one of their devices, such as the re-encryption
+-- of a vault under a new key. While an operation is running the writes of the other devices of the user are
+-- fenced. It fails once expires_at passes without its device extending it. The partial unique index keeps
+-- one running operation per user, so of two starts racing each other only one succeeds.
+CREATE TABLE IF NOT EXISTS user_operations (
+    id TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    kind TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    status TEXT NOT NULL,
+    expected_seconds INTEGER NOT NULL DEFAULT 0,
+    started_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    finished_at TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES Users(id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS user_operations_running_idx ON user_operations (user_id) WHERE status = 'running';
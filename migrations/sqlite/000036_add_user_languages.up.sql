@@ -0,0 +1,4 @@
+-- The language each user is mailed in, a BCP 47 tag, empty for the default language of the server.
+-- lint:ignore add-column
+-- SQLite has no IF NOT EXISTS for ADD COLUMN, the migration version guards against reruns.
+ALTER TABLE Users ADD COLUMN language TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS filesdata_blob_key_idx;
+-- lint:ignore drop-column
+ALTER TABLE FilesData DROP COLUMN blob_sha256;
+ALTER TABLE FilesData DROP COLUMN blob_size;
+ALTER TABLE FilesData DROP COLUMN blob_key;
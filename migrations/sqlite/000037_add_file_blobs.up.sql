@@ -0,0 +1,7 @@
+-- The object of the contents of a file in the blob store, see the PostgreSQL migration.
+-- lint:ignore add-column
+-- SQLite has no IF NOT EXISTS for ADD COLUMN, the migration version guards against reruns.
+ALTER TABLE FilesData ADD COLUMN blob_key TEXT;
+ALTER TABLE FilesData ADD COLUMN blob_size INTEGER;
+ALTER TABLE FilesData ADD COLUMN blob_sha256 TEXT;
+CREATE INDEX IF NOT EXISTS filesdata_blob_key_idx ON FilesData (blob_key) WHERE blob_key IS NOT NULL;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS shared_entries;
@@ -0,0 +1,10 @@
+DROP INDEX IF EXISTS user_credentials_folder_idx;
+DROP INDEX IF EXISTS credit_card_data_folder_idx;
+DROP INDEX IF EXISTS text_data_folder_idx;
+DROP INDEX IF EXISTS files_data_folder_idx;
+-- lint:ignore drop-column
+ALTER TABLE UserCredentials DROP COLUMN folder_id;
+ALTER TABLE CreditCardData DROP COLUMN folder_id;
+ALTER TABLE TextData DROP COLUMN folder_id;
+ALTER TABLE FilesData DROP COLUMN folder_id;
+DROP TABLE IF EXISTS folders;
@@ -0,0 +1,25 @@
+-- The folders of the entries of the users and the folder of each entry, see the PostgreSQL migration.
+-- lint:ignore add-column
+-- SQLite has no IF NOT EXISTS for ADD COLUMN, the migration version guards against reruns.
+CREATE TABLE IF NOT EXISTS folders (
+    id TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    name_key TEXT NOT NULL,
+    parent_id TEXT NOT NULL DEFAULT '',
+    updated_at TIMESTAMP NOT NULL,
+    deleted BOOLEAN NOT NULL DEFAULT FALSE,
+    FOREIGN KEY(user_id) REFERENCES Users(id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS folders_name_idx ON folders (user_id, parent_id, name_key) WHERE deleted = FALSE;
+CREATE INDEX IF NOT EXISTS folders_user_updated_idx ON folders (user_id, updated_at);
+
+ALTER TABLE UserCredentials ADD COLUMN folder_id TEXT;
+ALTER TABLE CreditCardData ADD COLUMN folder_id TEXT;
+ALTER TABLE TextData ADD COLUMN folder_id TEXT;
+ALTER TABLE FilesData ADD COLUMN folder_id TEXT;
+CREATE INDEX IF NOT EXISTS user_credentials_folder_idx ON UserCredentials (user_id, folder_id);
+CREATE INDEX IF NOT EXISTS credit_card_data_folder_idx ON CreditCardData (user_id, folder_id);
+CREATE INDEX IF NOT EXISTS text_data_folder_idx ON TextData (user_id, folder_id);
+CREATE INDEX IF NOT EXISTS files_data_folder_idx ON FilesData (user_id, folder_id);
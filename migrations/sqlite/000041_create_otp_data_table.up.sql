@@ -0,0 +1,42 @@
+-- The TOTP seeds of the users, see the PostgreSQL migration. The tags are a comma-delimited list, and
+-- the triggers of the synchronization columns are the ones the keeper checks for, like the other data tables'.
+CREATE TABLE IF NOT EXISTS OtpData (
+    id TEXT PRIMARY KEY,
+    user_id INTEGER,
+    issuer TEXT,
+    account TEXT,
+    secret TEXT NOT NULL,
+    algorithm TEXT,
+    digits INTEGER,
+    period INTEGER,
+    linked_entry_id TEXT,
+    meta_info TEXT,
+    deleted BOOLEAN NOT NULL DEFAULT FALSE,
+    updated_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+    client_created_at TEXT,
+    client_modified_at TEXT,
+    tags TEXT NOT NULL DEFAULT '',
+    expires_at TIMESTAMP,
+    checksum TEXT,
+    payload_size INTEGER,
+    search_text TEXT,
+    folder_id TEXT,
+    FOREIGN KEY(user_id) REFERENCES Users(id)
+);
+
+CREATE INDEX IF NOT EXISTS otp_data_expires_idx ON OtpData (expires_at) WHERE deleted = false AND expires_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS otp_data_user_updated_idx ON OtpData (user_id, updated_at);
+CREATE INDEX IF NOT EXISTS otp_data_user_deleted_idx ON OtpData (user_id) WHERE deleted = TRUE;
+CREATE INDEX IF NOT EXISTS otp_data_folder_idx ON OtpData (user_id, folder_id);
+CREATE INDEX IF NOT EXISTS otp_data_linked_idx ON OtpData (user_id, linked_entry_id);
+
+CREATE TRIGGER IF NOT EXISTS otp_data_sync_insert_not_null BEFORE INSERT ON OtpData
+    WHEN NEW.deleted IS NULL OR NEW.updated_at IS NULL
+BEGIN
+    SELECT RAISE(ABORT, 'NOT NULL constraint failed: OtpData.deleted or OtpData.updated_at');
+END;
+CREATE TRIGGER IF NOT EXISTS otp_data_sync_update_not_null BEFORE UPDATE OF deleted, updated_at ON OtpData
+    WHEN NEW.deleted IS NULL OR NEW.updated_at IS NULL
+BEGIN
+    SELECT RAISE(ABORT, 'NOT NULL constraint failed: OtpData.deleted or OtpData.updated_at');
+END;
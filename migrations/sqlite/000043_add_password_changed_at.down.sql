@@ -0,0 +1,2 @@
+-- lint:ignore drop-column
+ALTER TABLE Users DROP COLUMN password_changed_at;
@@ -0,0 +1,4 @@
+-- lint:ignore add-column
+-- The last change of the password of each user, the access tokens issued before it are rejected.
+-- SQLite has no IF NOT EXISTS for ADD COLUMN, the migration version guards against reruns.
+ALTER TABLE Users ADD COLUMN password_changed_at TIMESTAMP;